@@ -0,0 +1,91 @@
+package docker
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The long-running operations stop when their client aborts them, eg. by
+// disconnecting from the API. A pull or a push is given the channel closed
+// on abort, and passes it along to the registry requests and the layer
+// downloads.
+
+var ErrAborted = errors.New("Aborted by the client")
+
+// abortingWriter closes aborted once a write to the writer fails
+type abortingWriter struct {
+	io.Writer
+	aborted chan struct{}
+	once    sync.Once
+}
+
+func (w *abortingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if err != nil {
+		w.once.Do(func() { close(w.aborted) })
+	}
+	return n, err
+}
+
+// writeAborted returns a writer to w, and a channel closed once a write to
+// it fails, eg. when the client of an rcli command disconnected: the
+// operations reporting their progress to w then stop
+func writeAborted(w io.Writer) (io.Writer, <-chan struct{}) {
+	aw := &abortingWriter{Writer: w, aborted: make(chan struct{})}
+	return aw, aw.aborted
+}
+
+func isAborted(aborted <-chan struct{}) bool {
+	select {
+	case <-aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleepAbortable waits for delay, unless the operation is aborted first
+func sleepAbortable(aborted <-chan struct{}, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-aborted:
+		return ErrAborted
+	}
+}
+
+// abortableReader fails with ErrAborted once aborted is closed, eg. to stop
+// the extraction of a layer
+type abortableReader struct {
+	io.Reader
+	aborted <-chan struct{}
+}
+
+func (r *abortableReader) Read(p []byte) (int, error) {
+	if isAborted(r.aborted) {
+		return 0, ErrAborted
+	}
+	return r.Reader.Read(p)
+}
+
+// clientAborted returns a channel closed when the client of an API request
+// disconnects, and a function to call once the request is served
+func clientAborted(w http.ResponseWriter) (<-chan struct{}, func()) {
+	aborted, done := make(chan struct{}), make(chan struct{})
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed := notifier.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				close(aborted)
+			case <-done:
+			}
+		}()
+	}
+	return aborted, func() { close(done) }
+}
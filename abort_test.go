@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAbortableReader(t *testing.T) {
+	aborted := make(chan struct{})
+	r := &abortableReader{bytes.NewReader([]byte("layer")), aborted}
+	buf := make([]byte, 2)
+	if n, err := r.Read(buf); err != nil || n != 2 {
+		t.Fatalf("Unexpected read: %d (%v)", n, err)
+	}
+	close(aborted)
+	if _, err := r.Read(buf); err != ErrAborted {
+		t.Fatalf("Expected ErrAborted, got %v", err)
+	}
+	// A reader without channel is never aborted
+	if data, err := ioutil.ReadAll(&abortableReader{bytes.NewReader([]byte("layer")), nil}); err != nil || string(data) != "layer" {
+		t.Fatalf("Unexpected read: %q (%v)", data, err)
+	}
+}
+
+func TestSleepAbortable(t *testing.T) {
+	if err := sleepAbortable(nil, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	aborted := make(chan struct{})
+	close(aborted)
+	if err := sleepAbortable(aborted, time.Hour); err != ErrAborted {
+		t.Fatalf("Expected ErrAborted, got %v", err)
+	}
+}
+
+type failingWriter struct {
+	fail bool
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func TestWriteAborted(t *testing.T) {
+	client := &failingWriter{}
+	w, aborted := writeAborted(client)
+	fmt.Fprintf(w, "Pulling repository foo\n")
+	if isAborted(aborted) {
+		t.Fatalf("The operation shouldn't be aborted while its client reads the output")
+	}
+	// The client disconnected
+	client.fail = true
+	if _, err := fmt.Fprintf(w, "Pulling image bar\n"); err != io.ErrClosedPipe {
+		t.Fatalf("Expected the error of the client, got %v", err)
+	}
+	fmt.Fprintf(w, "Pulling image baz\n")
+	if !isAborted(aborted) {
+		t.Fatalf("The operation should be aborted once its output fails")
+	}
+}
+
+func TestPullOnceAborted(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+
+	// Another pull is downloading the image
+	pending := make(chan struct{})
+	defer close(pending)
+	graph.pulling["foo"] = pending
+
+	aborted := make(chan struct{})
+	close(aborted)
+	err := graph.pullOnce(ioutil.Discard, aborted, "foo", func() error {
+		t.Fatalf("The image shouldn't be pulled twice")
+		return nil
+	})
+	if err != ErrAborted {
+		t.Fatalf("Expected ErrAborted, got %v", err)
+	}
+}
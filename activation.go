@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With socket activation, systemd creates the sockets of the API, eg. with
+// contrib/systemd/docker.socket, and starts the daemon on the first
+// connection. The sockets are passed from fd 3, with LISTEN_PID, LISTEN_FDS
+// and LISTEN_FDNAMES, see sd_listen_fds(3). -H fd:// serves the API on all
+// of them, fd://NAME on the ones named NAME by FileDescriptorName=, and
+// fd://N on fd N.
+
+const SD_LISTEN_FDS_START = 3
+
+// activatedSocket is a socket passed by systemd
+type activatedSocket struct {
+	fd       int
+	name     string
+	listener net.Listener
+}
+
+var (
+	activatedSockets []*activatedSocket
+	activationErr    error
+	activationOnce   sync.Once
+)
+
+// parseListenFds returns the sockets passed to the process pid according to
+// the values of LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, without their
+// listeners. There are none if they are passed to another process.
+func parseListenFds(listenPid, listenFds, listenFdNames string, pid int) ([]*activatedSocket, error) {
+	if listenPid == "" || listenFds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(listenPid); err != nil || p != pid {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(listenFds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS: %s", listenFds)
+	}
+	var names []string
+	if listenFdNames != "" {
+		names = strings.Split(listenFdNames, ":")
+	}
+	sockets := make([]*activatedSocket, n)
+	for i := range sockets {
+		// The name systemd gives the sockets without FileDescriptorName=
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		sockets[i] = &activatedSocket{fd: SD_LISTEN_FDS_START + i, name: name}
+	}
+	return sockets, nil
+}
+
+// loadActivatedSockets takes the sockets passed by systemd, once, so that
+// neither the containers nor the programs run by the daemon inherit them
+func loadActivatedSockets() {
+	activatedSockets, activationErr = parseListenFds(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	for _, socket := range activatedSockets {
+		if activationErr != nil {
+			return
+		}
+		// FileListener dups the fd, close-on-exec
+		f := os.NewFile(uintptr(socket.fd), socket.name)
+		socket.listener, activationErr = net.FileListener(f)
+		f.Close()
+	}
+}
+
+// activatedListeners returns the listeners of the sockets passed by systemd
+// selected by the address of fd://ADDR
+func activatedListeners(addr string) ([]net.Listener, error) {
+	activationOnce.Do(loadActivatedSockets)
+	if activationErr != nil {
+		return nil, activationErr
+	}
+	var listeners []net.Listener
+	for _, socket := range activatedSockets {
+		if addr == "" || addr == socket.name || addr == strconv.Itoa(socket.fd) {
+			listeners = append(listeners, socket.listener)
+		}
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("No socket passed by systemd for fd://%s", addr)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,29 @@
+package docker
+
+import "testing"
+
+func TestParseListenFds(t *testing.T) {
+	sockets, err := parseListenFds("42", "3", "docker.socket:docker.socket", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []activatedSocket{{fd: 3, name: "docker.socket"}, {fd: 4, name: "docker.socket"}, {fd: 5, name: "unknown"}}
+	if len(sockets) != len(expected) {
+		t.Fatalf("Expected %d sockets, got %d", len(expected), len(sockets))
+	}
+	for i, socket := range sockets {
+		if *socket != expected[i] {
+			t.Errorf("Expected socket %v, got %v", expected[i], *socket)
+		}
+	}
+
+	// Passed to another process, or not at all
+	for _, pid := range []string{"43", ""} {
+		if sockets, err := parseListenFds(pid, "1", "", 42); err != nil || len(sockets) != 0 {
+			t.Errorf("No sockets expected for LISTEN_PID=%s, got %v, %v", pid, sockets, err)
+		}
+	}
+	if _, err := parseListenFds("42", "three", "", 42); err == nil {
+		t.Errorf("An invalid LISTEN_FDS should fail")
+	}
+}
@@ -0,0 +1,1127 @@
+package docker
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"github.com/dotcloud/docker/rcli"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_API_SOCKET = api.DEFAULT_API_SOCKET
+
+// Version of the remote API served by this daemon. Routes may be prefixed
+// with /v<version> (eg. /v1.0/containers/json); requests without a prefix
+// are served with the oldest schema, MIN_API_VERSION, so that clients
+// written before versioning keep working.
+const (
+	API_VERSION     = api.API_VERSION
+	MIN_API_VERSION = api.MIN_API_VERSION
+)
+
+// An API version as major and minor numbers ("1.10" is newer than "1.9")
+type apiVersion [2]int
+
+func parseApiVersion(version string) (apiVersion, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return apiVersion{}, fmt.Errorf("Invalid API version: %s", version)
+	}
+	var v apiVersion
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return apiVersion{}, fmt.Errorf("Invalid API version: %s", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v apiVersion) LessThan(other apiVersion) bool {
+	return v[0] < other[0] || (v[0] == other[0] && v[1] < other[1])
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v[0], v[1])
+}
+
+// Handlers get the API version requested by the client, so they can keep
+// serving older clients when a JSON schema changes.
+type apiHandler func(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error
+
+type apiRoute struct {
+	method  string
+	pattern []string
+	handler apiHandler
+}
+
+// Path segments starting with ':' match exactly one segment, and a segment
+// starting with '*' matches one or more (image names may contain slashes).
+var apiRoutes = []apiRoute{
+	{"GET", splitApiPath("/version"), getVersion},
+	{"GET", splitApiPath("/info"), getInfo},
+	{"GET", splitApiPath("/containers/json"), getContainersJSON},
+	{"POST", splitApiPath("/containers/prune"), pruneHandler((*Server).ContainersPrune)},
+	{"POST", splitApiPath("/containers/create"), postContainersCreate},
+	{"GET", splitApiPath("/containers/:name/json"), getContainerJSON},
+	{"POST", splitApiPath("/containers/:name/start"), postContainerAction},
+	{"POST", splitApiPath("/containers/:name/stop"), postContainerAction},
+	{"POST", splitApiPath("/containers/:name/restart"), postContainerAction},
+	{"POST", splitApiPath("/containers/:name/kill"), postContainerAction},
+	{"POST", splitApiPath("/containers/:name/wait"), postContainerWait},
+	{"POST", splitApiPath("/containers/:name/attach"), postContainerAttach},
+	{"GET", splitApiPath("/containers/:name/logs"), getContainerLogs},
+	{"GET", splitApiPath("/containers/:name/port"), getContainerPort},
+	{"POST", splitApiPath("/containers/:name/update"), postContainerUpdate},
+	{"GET", splitApiPath("/containers/:name/checkpoints"), getContainerCheckpoints},
+	{"POST", splitApiPath("/containers/:name/checkpoints"), postContainerCheckpoints},
+	{"DELETE", splitApiPath("/containers/:name/checkpoints/:checkpoint"), deleteContainerCheckpoint},
+	{"DELETE", splitApiPath("/containers/:name"), deleteContainer},
+	{"GET", splitApiPath("/events"), getEvents},
+	{"GET", splitApiPath("/images/json"), getImagesJSON},
+	{"POST", splitApiPath("/images/prune"), pruneHandler((*Server).ImagesPrune)},
+	{"POST", splitApiPath("/images/create"), postImagesCreate},
+	{"POST", splitApiPath("/images/*name/push"), postImagePush},
+	{"POST", splitApiPath("/images/*name/tag"), postImageTag},
+	{"GET", splitApiPath("/images/*name/json"), getImageJSON},
+	{"GET", splitApiPath("/images/*name/history"), getImageHistory},
+	{"DELETE", splitApiPath("/images/*name"), deleteImage},
+	{"POST", splitApiPath("/build"), postBuild},
+	{"POST", splitApiPath("/build/:id/cancel"), postBuildCancel},
+	{"GET", splitApiPath("/volumes"), getVolumes},
+	{"POST", splitApiPath("/volumes/prune"), pruneHandler((*Server).VolumesPrune)},
+	{"POST", splitApiPath("/system/prune"), pruneHandler((*Server).SystemPrune)},
+	{"GET", splitApiPath("/system/df"), getSystemDf},
+	{"POST", splitApiPath("/system/dedup"), postSystemDedup},
+	{"POST", splitApiPath("/volumes/create"), postVolumesCreate},
+	{"GET", splitApiPath("/volumes/:name"), getVolume},
+	{"DELETE", splitApiPath("/volumes/:name"), deleteVolume},
+	{"GET", splitApiPath("/trust/keys"), getTrustKeys},
+	{"POST", splitApiPath("/trust/keys"), postTrustKeys},
+	{"DELETE", splitApiPath("/trust/keys/:name"), deleteTrustKey},
+	{"GET", splitApiPath("/trust/signing-key"), getTrustSigningKey},
+	{"GET", splitApiPath("/debug/pprof"), serveDebugPprof},
+	{"GET", splitApiPath("/debug/pprof/:name"), serveDebugPprof},
+	{"POST", splitApiPath("/debug/pprof/:name"), serveDebugPprof},
+}
+
+func splitApiPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// matchApiPath returns the variables captured by pattern, or nil if the
+// path doesn't match it.
+func matchApiPath(pattern, path []string) map[string]string {
+	vars := make(map[string]string)
+	for i, segment := range pattern {
+		if i >= len(path) {
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			// Leave room for the segments following the wildcard
+			end := len(path) - (len(pattern) - i - 1)
+			if end <= i {
+				return nil
+			}
+			vars[segment[1:]] = strings.Join(path[i:end], "/")
+			if matchApiPath(pattern[i+1:], path[end:]) == nil {
+				return nil
+			}
+			return vars
+		case strings.HasPrefix(segment, ":"):
+			if path[i] == "" {
+				return nil
+			}
+			vars[segment[1:]] = path[i]
+		case segment != path[i]:
+			return nil
+		}
+	}
+	if len(pattern) != len(path) {
+		return nil
+	}
+	return vars
+}
+
+// negotiateApiVersion strips the /v<version> prefix from path, and
+// returns the version the request must be served with.
+func negotiateApiVersion(path []string) (apiVersion, []string, error) {
+	minVersion, _ := parseApiVersion(MIN_API_VERSION)
+	if len(path) == 0 || !strings.HasPrefix(path[0], "v") {
+		return minVersion, path, nil
+	}
+	version, err := parseApiVersion(path[0][1:])
+	if err != nil {
+		// Not a version prefix, eg. /version
+		return minVersion, path, nil
+	}
+	maxVersion, _ := parseApiVersion(API_VERSION)
+	if maxVersion.LessThan(version) {
+		return version, nil, fmt.Errorf("Client API version %s is too new. Maximum supported API version: %s", version, API_VERSION)
+	}
+	if version.LessThan(minVersion) {
+		return version, nil, fmt.Errorf("Client API version %s is too old. Minimum supported API version: %s", version, MIN_API_VERSION)
+	}
+	return version, path[1:], nil
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	apiLog.Debugf("%s %s", r.Method, r.URL)
+	w.Header().Set("Api-Version", API_VERSION)
+	if !srv.startRequest() {
+		http.Error(w, "The daemon is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer srv.requests.Done()
+	if srv.audit == nil || !auditedMethod(r.Method) {
+		srv.authorizeAndRoute(w, r)
+		return
+	}
+	entry := &AuditEntry{
+		Time:       time.Now().UTC(),
+		User:       requestUser(r),
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	if err := srv.authorizeAndRoute(recorder, r); err != nil {
+		entry.Error = err.Error()
+	}
+	entry.Status = recorder.code()
+	if err := srv.audit.Log(entry); err != nil {
+		apiLog.Errorf("Failed to write the audit log: %s", err)
+	}
+}
+
+// route serves r with the handler of its route, and returns the error of
+// the handler, which has already been sent to the client
+func (srv *Server) route(w http.ResponseWriter, r *http.Request) error {
+	version, path, err := negotiateApiVersion(splitApiPath(r.URL.Path))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	methodAllowed := true
+	for _, route := range apiRoutes {
+		vars := matchApiPath(route.pattern, path)
+		if vars == nil {
+			continue
+		}
+		if route.method != r.Method {
+			methodAllowed = false
+			continue
+		}
+		start, recorder := time.Now(), &statusRecorder{ResponseWriter: w}
+		defer func() {
+			apiRequestDuration.since(start, r.Method, "/"+strings.Join(route.pattern, "/"), strconv.Itoa(recorder.code()))
+		}()
+		err := route.handler(srv, version, recorder, r, vars)
+		if err != nil {
+			httpError(recorder, err)
+		}
+		return err
+	}
+	if !methodAllowed {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	http.NotFound(w, r)
+	return nil
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	apiLog.Errorf("%s", err)
+	status := http.StatusInternalServerError
+	if strings.HasPrefix(err.Error(), "No such") {
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(b)
+	return err
+}
+
+func boolValue(r *http.Request, key string) bool {
+	switch strings.ToLower(r.FormValue(key)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+func (srv *Server) lookupContainer(name string) (*Container, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	return container, nil
+}
+
+func getVersion(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, &api.Version{
+		Version:       VERSION,
+		ApiVersion:    API_VERSION,
+		MinApiVersion: MIN_API_VERSION,
+		GoVersion:     goruntime.Version(),
+		Os:            goruntime.GOOS,
+		Arch:          goruntime.GOARCH,
+	})
+}
+
+func getInfo(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	return writeJSON(w, http.StatusOK, srv.runtime.Info())
+}
+
+// Stream the events of the runtime as JSON objects, starting with the past
+// events which happened since the "since" unix timestamp, until the "until"
+// one. The events can be filtered like the containers.
+func getEvents(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var since, until int64
+	for _, param := range []struct {
+		name      string
+		timestamp *int64
+	}{{"since", &since}, {"until", &until}} {
+		if value := r.FormValue(param.name); value != "" {
+			var err error
+			if *param.timestamp, err = strconv.ParseInt(value, 10, 64); err != nil {
+				http.Error(w, "Invalid "+param.name+": "+value, http.StatusBadRequest)
+				return nil
+			}
+		}
+	}
+	filters, err := filtersValue(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	filter, err := srv.parseEventFilters(filters)
+	if err != nil {
+		if _, ok := err.(FilterError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(&rcli.AutoFlush{ResponseWriter: w})
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	srv.Events(since, until, filter, closed, func(event Event) error {
+		return encoder.Encode(&event)
+	})
+	return nil
+}
+
+// filtersValue decodes the filters parameter, a JSON object of the values
+// of each filter
+func filtersValue(r *http.Request) (map[string][]string, error) {
+	var filters map[string][]string
+	if value := r.FormValue("filters"); value != "" {
+		if err := json.Unmarshal([]byte(value), &filters); err != nil {
+			return nil, fmt.Errorf("Invalid filters: %s", err)
+		}
+	}
+	return filters, nil
+}
+
+func getContainersJSON(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	filters, err := filtersValue(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	containers, err := srv.Containers(boolValue(r, "all"), filters)
+	if err != nil {
+		if _, ok := err.(FilterError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		return err
+	}
+	return writeJSON(w, http.StatusOK, containers)
+}
+
+func postContainersCreate(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	config := &Config{}
+	if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+		http.Error(w, "Invalid container config: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if config.Image == "" {
+		http.Error(w, "Image not specified", http.StatusBadRequest)
+		return nil
+	}
+	container, err := srv.runtime.Create(config)
+	if err != nil {
+		if srv.runtime.graph.IsNotExist(err) {
+			return fmt.Errorf("No such image: %s", config.Image)
+		}
+		if _, ok := err.(ConfigError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, &api.Id{Id: container.Id})
+}
+
+func getContainerJSON(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	container, err := srv.lookupContainer(vars["name"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, container)
+}
+
+// Start, stop, restart or kill a container, depending on the last
+// segment of the path
+func postContainerAction(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	container, err := srv.lookupContainer(vars["name"])
+	if err != nil {
+		return err
+	}
+	switch action := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]; action {
+	case "start":
+		if checkpoint := r.FormValue("checkpoint"); checkpoint != "" {
+			if err := container.Restore(checkpoint, r.FormValue("checkpoint-dir")); err != nil {
+				return checkpointError(w, err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		err = container.Start()
+	case "stop":
+		err = container.Stop()
+	case "restart":
+		err = container.Restart()
+	case "kill":
+		sig := syscall.SIGKILL
+		if signal := r.FormValue("signal"); signal != "" {
+			if sig, err = ParseSignal(signal); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return nil
+			}
+		}
+		err = container.Signal(sig)
+	default:
+		return fmt.Errorf("Unknown container action: %s", action)
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Wait for a container to stop. With condition=next-exit, the headers are
+// sent as soon as the request is received, and the status code once the
+// container exits, even if it isn't started yet: clients wait for
+// containers removed on exit this way before starting them.
+func postContainerWait(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	container, err := srv.lookupContainer(vars["name"])
+	if err != nil {
+		return err
+	}
+	switch r.FormValue("condition") {
+	case "":
+		return writeJSON(w, http.StatusOK, &api.Wait{StatusCode: container.Wait()})
+	case "next-exit":
+		exits := container.State.exitCount()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return json.NewEncoder(w).Encode(&api.Wait{StatusCode: container.State.waitExit(exits)})
+	}
+	http.Error(w, "Invalid condition: "+r.FormValue("condition"), http.StatusBadRequest)
+	return nil
+}
+
+// Content type of hijacked connections and of multiplexed log streams
+const rawStreamContentType = "application/vnd.docker.raw-stream"
+
+// hijack takes over the connection of the request, and answers it with
+// the headers of a raw stream. What's written afterwards goes directly to
+// the client.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.Reader, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The connection can't be hijacked")
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\n\r\n", rawStreamContentType)
+	return conn, bufrw.Reader, nil
+}
+
+// containerOutputs returns the writers the stdout and stderr of container
+// must be copied to, according to the "stdout" and "stderr" parameters.
+// Without a tty both streams are multiplexed on out.
+func containerOutputs(container *Container, out io.Writer, r *http.Request) (stdout, stderr io.Writer) {
+	if container.Config.Tty {
+		stdout, stderr = out, out
+	} else {
+		locked := &lockedWriter{Writer: out}
+		stdout, stderr = api.NewStdWriter(locked, api.STDOUT), api.NewStdWriter(locked, api.STDERR)
+	}
+	if !boolValue(r, "stdout") {
+		stdout = nil
+	}
+	if !boolValue(r, "stderr") {
+		stderr = nil
+	}
+	return
+}
+
+func copyContainerLogs(container *Container, stdout, stderr io.Writer) error {
+	// FIXME: Interpolate stdout and stderr instead of concatenating them
+	for _, stream := range []struct {
+		name string
+		dst  io.Writer
+	}{{"stdout", stdout}, {"stderr", stderr}} {
+		if stream.dst == nil {
+			continue
+		}
+		logFile, err := container.ReadLog(stream.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(stream.dst, logFile)
+		if closer, ok := logFile.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pipes to the streams of a container
+type attachedStreams struct {
+	stdin          io.WriteCloser
+	stdout, stderr io.ReadCloser
+}
+
+// attachStreams opens pipes to the requested streams of container. Only
+// running containers and containers which were never started can be
+// attached to: the latter lets clients attach before starting them.
+// It returns nil if there's nothing to attach to.
+func attachStreams(container *Container, stdin, stdout, stderr bool) (*attachedStreams, error) {
+	if !container.State.Running && !container.State.StartedAt.IsZero() {
+		return nil, nil
+	}
+	streams := &attachedStreams{}
+	var err error
+	if stdin {
+		if streams.stdin, err = container.StdinPipe(); err != nil {
+			return nil, err
+		}
+	}
+	if stdout {
+		if streams.stdout, err = container.StdoutPipe(); err != nil {
+			return nil, err
+		}
+	}
+	if stderr {
+		if streams.stderr, err = container.StderrPipe(); err != nil {
+			return nil, err
+		}
+	}
+	return streams, nil
+}
+
+// close closes the output pipes, when they won't be copied
+func (streams *attachedStreams) close() {
+	for _, pipe := range []io.ReadCloser{streams.stdout, streams.stderr} {
+		if pipe != nil {
+			pipe.Close()
+		}
+	}
+}
+
+// copy forwards the streams until the outputs of the container are
+// closed, or until stdin is closed if no output is attached.
+func (streams *attachedStreams) copy(stdin io.Reader, stdout, stderr io.Writer) error {
+	var outputs sync.WaitGroup
+	stdinDone := make(chan error, 1)
+	if streams.stdin != nil {
+		go func() {
+			_, err := io.Copy(streams.stdin, stdin)
+			stdinDone <- err
+		}()
+	}
+	for _, stream := range []struct {
+		src io.ReadCloser
+		dst io.Writer
+	}{{streams.stdout, stdout}, {streams.stderr, stderr}} {
+		if stream.src == nil {
+			continue
+		}
+		outputs.Add(1)
+		go func(dst io.Writer, src io.ReadCloser) {
+			defer outputs.Done()
+			// Closing the pipe unsubscribes it, so that the container
+			// doesn't block on a client which is gone
+			defer src.Close()
+			io.Copy(dst, src)
+		}(stream.dst, stream.src)
+	}
+	if streams.stdout == nil && streams.stderr == nil && streams.stdin != nil {
+		return <-stdinDone
+	}
+	outputs.Wait()
+	return nil
+}
+
+// Attach to the streams of a container over a hijacked connection.
+// Parameters: logs (replay the logs first), stream (attach to the live
+// streams), stdin, stdout and stderr.
+func postContainerAttach(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	container, err := srv.lookupContainer(vars["name"])
+	if err != nil {
+		return err
+	}
+	// Open the pipes before answering, so that nothing written after the
+	// client got the response (eg. once it started the container) is lost
+	var streams *attachedStreams
+	if boolValue(r, "stream") {
+		streams, err = attachStreams(container, boolValue(r, "stdin"), boolValue(r, "stdout"), boolValue(r, "stderr"))
+		if err != nil {
+			return err
+		}
+	}
+	conn, bufReader, err := hijack(w)
+	if err != nil {
+		if streams != nil {
+			streams.close()
+		}
+		return err
+	}
+	defer conn.Close()
+	stdout, stderr := containerOutputs(container, conn, r)
+	if boolValue(r, "logs") {
+		if err := copyContainerLogs(container, stdout, stderr); err != nil {
+			apiLog.Errorf("Error sending the logs of %s: %s", container.Id, err)
+			return nil
+		}
+	}
+	if streams != nil {
+		if err := streams.copy(bufReader, stdout, stderr); err != nil {
+			apiLog.Errorf("Error attaching to %s: %s", container.Id, err)
+		}
+	}
+	return nil
+}
+
+func postContainerUpdate(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	update := &api.Update{}
+	if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+		http.Error(w, "Invalid update: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := srv.ContainerUpdate(vars["name"], update); err != nil {
+		if _, ok := err.(ConfigError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func getContainerCheckpoints(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	checkpoints, err := srv.ContainerCheckpoints(vars["name"], r.FormValue("dir"))
+	if err != nil {
+		return checkpointError(w, err)
+	}
+	return writeJSON(w, http.StatusOK, checkpoints)
+}
+
+// Checkpoint a running container, stopping it unless leave-running is set
+func postContainerCheckpoints(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	container, err := srv.lookupContainer(vars["name"])
+	if err != nil {
+		return err
+	}
+	name := r.FormValue("name")
+	if err := container.Checkpoint(name, r.FormValue("dir"), boolValue(r, "leave-running")); err != nil {
+		return checkpointError(w, err)
+	}
+	return writeJSON(w, http.StatusCreated, &api.Checkpoint{Name: name})
+}
+
+func deleteContainerCheckpoint(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	container, err := srv.lookupContainer(vars["name"])
+	if err != nil {
+		return err
+	}
+	if err := container.RemoveCheckpoint(vars["checkpoint"], r.FormValue("dir")); err != nil {
+		return checkpointError(w, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// checkpointError sends the errors of the checkpoint requests which are due
+// to the request or to the state of the container, and returns the others
+func checkpointError(w http.ResponseWriter, err error) error {
+	switch msg := err.Error(); {
+	case err == errCheckpointsDisabled, strings.HasPrefix(msg, "Invalid checkpoint name"), strings.HasPrefix(msg, "Invalid checkpoint directory"):
+		http.Error(w, msg, http.StatusBadRequest)
+	case strings.HasSuffix(msg, "is not running"), strings.HasSuffix(msg, "is already running"), strings.HasSuffix(msg, "already exists"):
+		http.Error(w, msg, http.StatusConflict)
+	default:
+		return err
+	}
+	return nil
+}
+
+// Send the port mappings of a running container
+func getContainerPort(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	ports, err := srv.ContainerPorts(vars["name"])
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "is not running") {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return nil
+		}
+		return err
+	}
+	return writeJSON(w, http.StatusOK, ports)
+}
+
+// Send the logs of a container. With follow, the connection is hijacked
+// and the live output is sent until the container stops; otherwise the
+// logs are sent with chunked encoding.
+func getContainerLogs(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	container, err := srv.lookupContainer(vars["name"])
+	if err != nil {
+		return err
+	}
+	if !boolValue(r, "follow") {
+		w.Header().Set("Content-Type", rawStreamContentType)
+		w.WriteHeader(http.StatusOK)
+		stdout, stderr := containerOutputs(container, &rcli.AutoFlush{ResponseWriter: w}, r)
+		if err := copyContainerLogs(container, stdout, stderr); err != nil {
+			apiLog.Errorf("Error sending the logs of %s: %s", container.Id, err)
+		}
+		return nil
+	}
+	streams, err := attachStreams(container, false, boolValue(r, "stdout"), boolValue(r, "stderr"))
+	if err != nil {
+		return err
+	}
+	conn, _, err := hijack(w)
+	if err != nil {
+		if streams != nil {
+			streams.close()
+		}
+		return err
+	}
+	defer conn.Close()
+	stdout, stderr := containerOutputs(container, conn, r)
+	if err := copyContainerLogs(container, stdout, stderr); err != nil {
+		apiLog.Errorf("Error sending the logs of %s: %s", container.Id, err)
+		return nil
+	}
+	if streams != nil {
+		if err := streams.copy(nil, stdout, stderr); err != nil {
+			apiLog.Errorf("Error following the logs of %s: %s", container.Id, err)
+		}
+	}
+	return nil
+}
+
+func deleteContainer(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	container, err := srv.lookupContainer(vars["name"])
+	if err != nil {
+		return err
+	}
+	if err := srv.runtime.Destroy(container); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func getImagesJSON(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	filters, err := filtersValue(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	images, err := srv.Images(boolValue(r, "all"), r.FormValue("filter"), filters)
+	if err != nil {
+		if _, ok := err.(FilterError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		return err
+	}
+	if images == nil {
+		images = []api.Images{}
+	}
+	return writeJSON(w, http.StatusOK, images)
+}
+
+// Pull an image. The progress is streamed as plain text; once it started,
+// errors can only be reported in the stream itself. The pull is aborted if
+// the client disconnects.
+func postImagesCreate(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	name := r.FormValue("fromImage")
+	if name == "" {
+		http.Error(w, "fromImage not specified", http.StatusBadRequest)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	aborted, release := clientAborted(w)
+	defer release()
+	if err := srv.ImagePull(&rcli.AutoFlush{ResponseWriter: w}, aborted, name); err != nil {
+		fmt.Fprintf(w, "Error: %s\n", err)
+	}
+	return nil
+}
+
+// Push an image, like postImagesCreate
+func postImagePush(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	aborted, release := clientAborted(w)
+	defer release()
+	if err := srv.ImagePush(&rcli.AutoFlush{ResponseWriter: w}, aborted, vars["name"]); err != nil {
+		fmt.Fprintf(w, "Error: %s\n", err)
+	}
+	return nil
+}
+
+// The body is a tar archive of the build context, which contains the
+// Dockerfile. The id of the build, which can be cancelled, is sent in the
+// Build-Id header. The build is also cancelled if the client disconnects.
+func postBuild(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	context, err := ioutil.TempDir("", "docker-build-context")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(context)
+	if err := Untar(r.Body, context); err != nil {
+		http.Error(w, "Invalid build context: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	buildArgs := make(map[string]string)
+	if value := r.FormValue("buildargs"); value != "" {
+		if err := json.Unmarshal([]byte(value), &buildArgs); err != nil {
+			http.Error(w, "Invalid buildargs: "+err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+	dockerfile, err := os.Open(path.Join(context, "Dockerfile"))
+	if os.IsNotExist(err) {
+		http.Error(w, "No Dockerfile in the build context", http.StatusBadRequest)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer dockerfile.Close()
+	// The intermediate containers are removed unless rm=0
+	rm := r.FormValue("rm") == "" || boolValue(r, "rm")
+	b := NewBuilder(srv, &rcli.AutoFlush{ResponseWriter: w}, context, !boolValue(r, "nocache"), rm, boolValue(r, "forcerm"), buildArgs)
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed := notifier.CloseNotify()
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-closed:
+				b.Cancel()
+			case <-done:
+			}
+		}()
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Build-Id", b.Id)
+	w.WriteHeader(http.StatusOK)
+	if _, err := srv.Build(b, dockerfile, r.FormValue("t")); err != nil {
+		fmt.Fprintf(w, "Error: %s\n", err)
+	}
+	return nil
+}
+
+func postBuildCancel(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	// The builds are forgotten once they are over
+	if err := srv.CancelBuild(vars["id"]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func getImageHistory(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	history, err := srv.ImageHistory(vars["name"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, history)
+}
+
+func getImageJSON(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	image, err := srv.runtime.repositories.LookupImage(vars["name"])
+	if err != nil || image == nil {
+		return fmt.Errorf("No such image: %s", vars["name"])
+	}
+	reports, err := srv.runtime.graph.ScanReports(image.Id)
+	if err != nil {
+		return err
+	}
+	platform, err := srv.runtime.graph.Platform(image.Id)
+	if err != nil {
+		return err
+	}
+	// The reports of the scanners are stored along the image, see scan.go
+	return writeJSON(w, http.StatusOK, &struct {
+		*Image
+		RepoDigests []string               `json:"repo_digests,omitempty"`
+		Platform    *Platform              `json:"platform,omitempty"`
+		ScanReports map[string]*ScanReport `json:"scan_reports,omitempty"`
+	}{image, srv.runtime.repositories.DigestsById()[image.Id], platform, reports})
+}
+
+func postImageTag(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if img, err := srv.runtime.repositories.LookupImage(vars["name"]); err != nil || img == nil {
+		return fmt.Errorf("No such image: %s", vars["name"])
+	}
+	err := srv.ImageTag(vars["name"], r.FormValue("repo"), r.FormValue("tag"), r.FormValue("force") == "1")
+	switch err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusCreated)
+	case NameError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ConflictError:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		return err
+	}
+	return nil
+}
+
+// Deleting a name only removes the image once no other name refers to it
+func deleteImage(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	result, err := srv.ImageDelete(vars["name"])
+	if err != nil {
+		if _, ok := err.(ConflictError); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return nil
+		}
+		return err
+	}
+	return writeJSON(w, http.StatusOK, result)
+}
+
+func getVolumes(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	volumes := srv.Volumes()
+	if volumes == nil {
+		volumes = []api.Volume{}
+	}
+	return writeJSON(w, http.StatusOK, volumes)
+}
+
+func postVolumesCreate(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var params struct {
+		Name   string
+		Driver string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && err != io.EOF {
+		http.Error(w, "Invalid volume parameters: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	volume, err := srv.VolumeCreate(params.Name, params.Driver)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, volume)
+}
+
+func getVolume(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	volume, err := srv.VolumeInspect(vars["name"])
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, volume)
+}
+
+func deleteVolume(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := srv.VolumeRemove(vars["name"]); err != nil {
+		if _, ok := err.(ConflictError); ok {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return nil
+		}
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func getTrustKeys(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	keys, err := srv.TrustKeys()
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		keys = []api.TrustKey{}
+	}
+	return writeJSON(w, http.StatusOK, keys)
+}
+
+func postTrustKeys(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	var params struct {
+		Name string
+		Key  string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, "Invalid key parameters: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	key, err := srv.TrustKeyAdd(params.Name, []byte(params.Key))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return writeJSON(w, http.StatusCreated, key)
+}
+
+func deleteTrustKey(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if err := srv.TrustKeyRemove(vars["name"]); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func getTrustSigningKey(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	key, err := srv.TrustSigningKey()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, key)
+}
+
+func getSystemDf(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	usage, err := srv.DiskUsage()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, usage)
+}
+
+// Link the identical files of the layers, see dedup.go
+func postSystemDedup(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	report, err := srv.runtime.graph.DedupLayers()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, report)
+}
+
+// pruneHandler serves a prune operation, with the filters of the request
+func pruneHandler(prune func(*Server, map[string][]string) (*api.PruneReport, error)) apiHandler {
+	return func(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+		filters, err := filtersValue(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		report, err := prune(srv, filters)
+		if err != nil {
+			if _, ok := err.(FilterError); ok {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return nil
+			}
+			return err
+		}
+		return writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// Listen on `addr`, using protocol `proto`, for remote API requests.
+// If tlsConfig is not nil, the API is only served over TLS.
+func ListenAndServeAPI(proto, addr string, srv *Server, tlsConfig *tls.Config) error {
+	if proto == "fd" {
+		listeners, err := activatedListeners(addr)
+		if err != nil {
+			return err
+		}
+		errors := make(chan error, len(listeners))
+		for _, listener := range listeners {
+			go func(listener net.Listener) {
+				errors <- serveAPI(listener, srv, tlsConfig)
+			}(listener)
+		}
+		return <-errors
+	}
+	if proto == "ssh" {
+		return fmt.Errorf("The API can't be served on ssh://, whose clients tunnel to the unix socket of the daemon")
+	}
+	if proto == "unix" {
+		// Remove the socket left behind by a previous daemon
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if proto == "unix" {
+		if err := os.Chmod(addr, 0660); err != nil {
+			return err
+		}
+	}
+	return serveAPI(listener, srv, tlsConfig)
+}
+
+// serveAPI serves the remote API on listener, over TLS if tlsConfig is not
+// nil
+func serveAPI(listener net.Listener, srv *Server, tlsConfig *tls.Config) error {
+	proto, addr := listener.Addr().Network(), listener.Addr().String()
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	} else if proto == "tcp" {
+		apiLog.Warnf("The API is served on %s without TLS: anybody reaching it has root access to this host", addr)
+	}
+	apiLog.Infof("Listening for HTTP API on %s://%s", proto, addr)
+	return http.Serve(listener, srv)
+}
@@ -0,0 +1,57 @@
+// Package api holds what the daemon and the clients of its remote API
+// share: the addresses and the version of the API, the types encoded as
+// JSON by the requests and the responses, and the framing of the streams.
+// It doesn't depend on the daemon, so that the clients don't either.
+package api
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Version of docker, the daemon and its clients
+const VERSION = "0.1.0"
+
+// Socket the remote API listens on when no address is given
+const DEFAULT_API_SOCKET = "/var/run/docker.sock"
+
+// Version of the remote API served by the daemon, and requested by the
+// clients. Requests without a version are served with the oldest schema,
+// MIN_API_VERSION.
+const (
+	API_VERSION     = "1.0"
+	MIN_API_VERSION = "1.0"
+)
+
+// ParseHost splits an API address such as unix:///var/run/docker.sock or
+// tcp://127.0.0.1:4243 into a protocol and an address.
+func ParseHost(host string) (proto, addr string, err error) {
+	switch {
+	case host == "":
+		return "unix", DEFAULT_API_SOCKET, nil
+	case strings.HasPrefix(host, "unix://"):
+		addr = strings.TrimPrefix(host, "unix://")
+		if addr == "" {
+			addr = DEFAULT_API_SOCKET
+		}
+		return "unix", addr, nil
+	case strings.HasPrefix(host, "tcp://"):
+		addr = strings.TrimPrefix(host, "tcp://")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("Invalid API address %s: %s", host, err)
+		}
+		return "tcp", addr, nil
+	case strings.HasPrefix(host, "fd://"):
+		// The sockets passed by systemd, see activation.go
+		return "fd", strings.TrimPrefix(host, "fd://"), nil
+	case strings.HasPrefix(host, "ssh://"):
+		// The client tunnels to the default socket of the remote host
+		addr = strings.TrimSuffix(strings.TrimPrefix(host, "ssh://"), "/")
+		if hostname := addr[strings.LastIndex(addr, "@")+1:]; hostname == "" || strings.ContainsAny(addr, "/?#") {
+			return "", "", fmt.Errorf("Invalid API address %s: expected ssh://[USER@]HOST[:PORT]", host)
+		}
+		return "ssh", addr, nil
+	}
+	return "", "", fmt.Errorf("Invalid API address %s: expected unix://PATH, tcp://HOST:PORT, ssh://[USER@]HOST[:PORT] or fd://[NAME]", host)
+}
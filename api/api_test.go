@@ -0,0 +1,34 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestParseHost(t *testing.T) {
+	for _, test := range []struct {
+		host, proto, addr string
+	}{
+		{"", "unix", DEFAULT_API_SOCKET},
+		{"unix://", "unix", DEFAULT_API_SOCKET},
+		{"unix:///tmp/docker.sock", "unix", "/tmp/docker.sock"},
+		{"tcp://127.0.0.1:4243", "tcp", "127.0.0.1:4243"},
+		{"fd://", "fd", ""},
+		{"fd://docker.socket", "fd", "docker.socket"},
+		{"ssh://alice@10.0.0.2", "ssh", "alice@10.0.0.2"},
+		{"ssh://10.0.0.2:2222/", "ssh", "10.0.0.2:2222"},
+	} {
+		proto, addr, err := ParseHost(test.host)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if proto != test.proto || addr != test.addr {
+			t.Errorf("ParseHost(%s): expected (%s, %s), got (%s, %s)", test.host, test.proto, test.addr, proto, addr)
+		}
+	}
+	for _, host := range []string{"127.0.0.1:4243", "tcp://127.0.0.1", "udp://127.0.0.1:4243", "ssh://", "ssh://alice@", "ssh://10.0.0.2/var/run/docker.sock"} {
+		if _, _, err := ParseHost(host); err == nil {
+			t.Errorf("ParseHost(%s) should fail", host)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Streams multiplexed on a single connection by the remote API, when the
+// container doesn't have a tty. Each frame starts with an 8 bytes header:
+// the stream (1 byte), 3 zero bytes, and the size of the payload as a big
+// endian uint32.
+const (
+	STDIN  byte = 0
+	STDOUT byte = 1
+	STDERR byte = 2
+
+	stdHeaderLen = 8
+)
+
+type stdWriter struct {
+	io.Writer
+	stream byte
+}
+
+// NewStdWriter returns a writer which frames everything written to it as
+// coming from stream. Each Write results in a single Write to w, so
+// several stdWriters may share a writer which serializes the writes.
+func NewStdWriter(w io.Writer, stream byte) io.Writer {
+	return &stdWriter{Writer: w, stream: stream}
+}
+
+func (w *stdWriter) Write(p []byte) (int, error) {
+	frame := make([]byte, stdHeaderLen+len(p))
+	frame[0] = w.stream
+	binary.BigEndian.PutUint32(frame[4:stdHeaderLen], uint32(len(p)))
+	copy(frame[stdHeaderLen:], p)
+	n, err := w.Writer.Write(frame)
+	n -= stdHeaderLen
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// StdCopy demultiplexes the frames read from src into dstout and dsterr,
+// until src reaches EOF.
+func StdCopy(dstout, dsterr io.Writer, src io.Reader) (written int64, err error) {
+	header := make([]byte, stdHeaderLen)
+	var buf []byte
+	for {
+		if _, err := io.ReadFull(src, header); err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+		var dst io.Writer
+		switch header[0] {
+		case STDIN, STDOUT:
+			dst = dstout
+		case STDERR:
+			dst = dsterr
+		default:
+			return written, fmt.Errorf("Unrecognized stream in frame header: %d", header[0])
+		}
+		size := int(binary.BigEndian.Uint32(header[4:]))
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		if _, err := io.ReadFull(src, buf[:size]); err != nil {
+			return written, err
+		}
+		n, err := dst.Write(buf[:size])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
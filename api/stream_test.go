@@ -0,0 +1,46 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStdCopy(t *testing.T) {
+	muxed := &bytes.Buffer{}
+	stdout := NewStdWriter(muxed, STDOUT)
+	stderr := NewStdWriter(muxed, STDERR)
+	if n, err := stdout.Write([]byte("hello ")); err != nil || n != 6 {
+		t.Fatalf("Expected 6 bytes written, got %d (%v)", n, err)
+	}
+	stderr.Write([]byte("oops\n"))
+	stdout.Write([]byte("world\n"))
+	stdout.Write([]byte{})
+
+	if muxed.Len() != 4*stdHeaderLen+17 {
+		t.Errorf("Expected %d bytes, got %d", 4*stdHeaderLen+17, muxed.Len())
+	}
+
+	outBuf, errBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	written, err := StdCopy(outBuf, errBuf, muxed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 17 {
+		t.Errorf("Expected 17 bytes copied, got %d", written)
+	}
+	if outBuf.String() != "hello world\n" {
+		t.Errorf("Unexpected stdout: %q", outBuf.String())
+	}
+	if errBuf.String() != "oops\n" {
+		t.Errorf("Unexpected stderr: %q", errBuf.String())
+	}
+}
+
+func TestStdCopyTruncated(t *testing.T) {
+	muxed := &bytes.Buffer{}
+	NewStdWriter(muxed, STDOUT).Write([]byte("hello world\n"))
+	muxed.Truncate(muxed.Len() - 1)
+	if _, err := StdCopy(&bytes.Buffer{}, &bytes.Buffer{}, muxed); err == nil {
+		t.Errorf("A truncated frame should fail")
+	}
+}
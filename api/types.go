@@ -0,0 +1,268 @@
+package api
+
+import (
+	"time"
+)
+
+// The types encoded as JSON by the remote API
+
+type Containers struct {
+	Id      string
+	Image   string
+	Command string
+	Created int64
+	Status  string
+	Labels  map[string]string
+}
+
+type Images struct {
+	Repository string
+	Tag        string
+	Id         string
+	Created    int64
+	ParentId   string
+	Labels     map[string]string
+	Untagged   string `json:",omitempty"` // The tag a dangling image lost to another image
+}
+
+// A private port of a container and the public port NAT-ed to it
+type Port struct {
+	PrivatePort int
+	PublicPort  int
+}
+
+// Changes to the resource limits and the restart policy of a container.
+// The settings left nil are unchanged, and the limits set to 0 are removed.
+type Update struct {
+	Memory     *int64  `json:",omitempty"`
+	MemorySwap *int64  `json:",omitempty"`
+	CpuShares  *int64  `json:",omitempty"`
+	CpuQuota   *int64  `json:",omitempty"`
+	Restart    *string `json:",omitempty"`
+}
+
+type Checkpoint struct {
+	Name    string
+	Created int64
+}
+
+// A layer of the history of an image, most recent first
+type History struct {
+	Id        string
+	Created   int64
+	CreatedBy string
+	Size      int64
+	Comment   string
+}
+
+type Id struct {
+	Id string
+}
+
+type Wait struct {
+	StatusCode int
+}
+
+type Version struct {
+	Version       string
+	ApiVersion    string
+	MinApiVersion string
+	GoVersion     string
+	Os            string
+	Arch          string
+}
+
+type Info struct {
+	Containers         int
+	ContainersRunning  int
+	ContainersStopped  int
+	Images             int
+	StorageDriver      string
+	DriverStatus       [][2]string // Name and value pairs, eg. whether the kernel supports the driver
+	KernelVersion      string
+	MemoryLimit        bool // The kernel supports memory limits
+	SwapLimit          bool // The kernel supports swap limits
+	CgroupVersion      int  // 2 on the hosts with the unified hierarchy, see cgroups.go
+	Version            string
+	GoVersion          string
+	Root               string
+	BridgeIface        string
+	LogDriver          string
+	DefaultUlimits     []string
+	DefaultDeviceRules []string
+	RegistryMirrors    []string
+	InsecureRegistries []string
+	LiveRestore        bool
+	Experimental       bool
+	Debug              bool
+}
+
+type PruneReport struct {
+	ContainersDeleted []string
+	ImagesDeleted     []string
+	VolumesDeleted    []string
+	SpaceReclaimed    int64 // In bytes
+}
+
+type DedupReport struct {
+	FilesLinked    int   // Identical files replaced by a link
+	SpaceReclaimed int64 // In bytes
+}
+
+type DiskUsage struct {
+	LayersSize        int64 // Size of all the layers, each counted once
+	ImagesReclaimable int64 // Size of the layers no container uses
+	Images            []ImageUsage
+	Containers        []ContainerUsage
+	Volumes           []VolumeUsage
+}
+
+type ImageUsage struct {
+	Id         string
+	Repository string
+	Tag        string
+	Created    int64
+	Size       int64 // With the parents
+	SharedSize int64 // Size of the layers other images have as well
+	UniqueSize int64
+	Containers int // Number of containers based on the image
+}
+
+type ContainerUsage struct {
+	Id      string
+	Image   string
+	Created int64
+	Running bool
+	Size    int64 // Size of the files the container changed
+}
+
+type VolumeUsage struct {
+	Name       string
+	Driver     string
+	Size       int64
+	Containers int
+}
+
+// An image untagged or deleted by rmi
+type Rmi struct {
+	Untagged string `json:",omitempty"`
+	Deleted  string `json:",omitempty"`
+}
+
+type TrustKey struct {
+	Name        string `json:",omitempty"`
+	Fingerprint string
+	Key         string `json:",omitempty"` // PEM, only for the signing key
+}
+
+type Volume struct {
+	Name       string
+	Driver     string
+	Path       string
+	Created    int64
+	Anonymous  bool
+	Containers []string // Ids of the containers using the volume
+}
+
+// Config is the configuration of a container, given when it is created,
+// and the defaults of the containers created from an image
+type Config struct {
+	Hostname    string
+	User        string // User and optionally group: "user", "uid", "user:group" or "uid:gid"
+	Memory      int64  // Memory limit (in bytes)
+	MemorySwap  int64  // Total memory usage (memory + swap); set `-1' to disable swap
+	CpuShares   int64  // Relative CPU weight, 1024 by default
+	CpuQuota    int64  // CPU time in microseconds per 100ms period, unlimited if 0
+	Restart     string // Restart policy: no, always or on-failure[:MAX], see restart.go
+	Detach      bool
+	Ports       []int
+	Tty         bool // Attach standard streams to a tty, including stdin if it is not closed.
+	OpenStdin   bool // Open stdin
+	Env         []string
+	Cmd         []string
+	Entrypoint  []string            // Prepended to Cmd
+	WorkingDir  string              // Created if it doesn't exist
+	Volumes     map[string]struct{} // Paths where a new volume is mounted
+	Binds       []string            // Host directories or named volumes to mount: SRC:/container[:ro|rw]
+	VolumesFrom []string            // Containers whose volumes are mounted: CONTAINER[:ro|rw]
+	Tmpfs       map[string]string   // Mount options of the tmpfs mounted in the container, by path
+	ShmSize     int64               // Size of the tmpfs on /dev/shm in bytes, or 0 for the default of the daemon
+	Sysctls     map[string]string   // Namespaced kernel parameters, eg. net.core.somaxconn, see sysctl.go
+	Labels      map[string]string   // Arbitrary metadata, eg. the owner of the container
+	OnBuild     []string            // Dockerfile instructions executed by the builds from the image
+	Init        bool                // Run Cmd under an init which forwards signals and reaps zombies
+	StopSignal  string              // Sent by Stop before SIGKILL, by name or number; SIGTERM by default
+	CapAdd      []string            // Capabilities added to the default ones, or ALL, see capabilities.go
+	CapDrop     []string            // Capabilities dropped from the default ones, or ALL
+	Seccomp     string              // JSON seccomp profile, "unconfined", or empty for the default one, see seccomp.go
+	SecurityOpt []string            // AppArmor and SELinux options, see security.go
+	Privileged  bool                // All the capabilities and devices, unconfined by AppArmor, SELinux and seccomp
+	Devices     []string            // Devices of the host created in the container: /host[:/container][:PERMISSIONS], see devices.go
+	DeviceRules []string            // Device cgroup rules added to the whitelist of the daemon: TYPE MAJOR:MINOR PERMISSIONS
+	ReadOnly    bool                // Read-only root filesystem, with a tmpfs on /tmp and /run
+	Timezone    string              // "host", a zone like Europe/Paris, "none", or empty for the default of the daemon, see timezone.go
+	AutoRemove  bool                // Remove the container and its anonymous volumes once it exits
+	Image       string              // Name of the image as it was passed by the operator (eg. could be symbolic)
+}
+
+type NetworkSettings struct {
+	IpAddress   string
+	IpPrefixLen int
+	Gateway     string
+	PortMapping map[string]string
+}
+
+// A Container as it is inspected
+type Container struct {
+	Id      string
+	Created time.Time
+	Path    string
+	Args    []string
+	Config  *Config
+	State   State
+	Image   string
+
+	Volumes   map[string]string // Host directories mounted in the container, by path in the container
+	VolumesRW map[string]bool
+
+	RestartCount    int // Times the restart policy restarted the container
+	StoppedByDaemon bool
+	NetworkSettings *NetworkSettings
+
+	SysInitPath     string
+	LogDriver       string
+	Shim            bool
+	SystemdScope    string
+	AppArmorProfile string
+	ProcessLabel    string
+	MountLabel      string
+}
+
+type State struct {
+	Running    bool
+	Pid        int
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// An Image as it is inspected
+type Image struct {
+	Id              string    `json:"id"`
+	Parent          string    `json:"parent,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	Created         time.Time `json:"created"`
+	Container       string    `json:"container,omitempty"`
+	ContainerConfig Config    `json:"container_config,omitempty"`
+	Config          *Config   `json:"config,omitempty"`
+}
+
+// An Event of the daemon, streamed by /events
+type Event struct {
+	Status     string
+	Id         string
+	Type       string            // "container", "image" or "trust"
+	From       string            `json:",omitempty"`
+	Time       int64             // Unix time
+	Attributes map[string]string `json:",omitempty"`
+}
@@ -0,0 +1,246 @@
+package docker
+
+import (
+	"container/list"
+	"encoding/json"
+	"github.com/dotcloud/docker/api"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestMatchApiPath(t *testing.T) {
+	for _, test := range []struct {
+		pattern, path string
+		vars          map[string]string
+	}{
+		{"/containers/json", "/containers/json", map[string]string{}},
+		{"/containers/:name/start", "/containers/abc/start", map[string]string{"name": "abc"}},
+		{"/containers/:name/start", "/containers/abc/stop", nil},
+		{"/containers/:name", "/containers/abc/start", nil},
+		{"/images/*name/push", "/images/base/push", map[string]string{"name": "base"}},
+		{"/images/*name/push", "/images/shykes/base/push", map[string]string{"name": "shykes/base"}},
+		{"/images/*name/push", "/images/push", nil},
+		{"/images/*name", "/images/localhost:5000/team/app", map[string]string{"name": "localhost:5000/team/app"}},
+	} {
+		vars := matchApiPath(splitApiPath(test.pattern), splitApiPath(test.path))
+		if (vars == nil) != (test.vars == nil) {
+			t.Errorf("%s on %s: expected %v, got %v", test.path, test.pattern, test.vars, vars)
+			continue
+		}
+		for key, value := range test.vars {
+			if vars[key] != value {
+				t.Errorf("%s on %s: expected %s=%s, got %s", test.path, test.pattern, key, value, vars[key])
+			}
+		}
+	}
+}
+
+func TestApiContainers(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	r := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/containers/create",
+		strings.NewReader(`{"Image": "`+GetTestImage(runtime).Id+`", "Cmd": ["ls", "-al"]}`))
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, r.Code, r.Body)
+	}
+	created := &api.Id{}
+	if err := json.Unmarshal(r.Body.Bytes(), created); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.Get(created.Id) == nil {
+		t.Fatalf("Container %s wasn't created", created.Id)
+	}
+
+	r = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/containers/json?all=1", nil)
+	srv.ServeHTTP(r, req)
+	var containers []api.Containers
+	if err := json.Unmarshal(r.Body.Bytes(), &containers); err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].Id != created.Id {
+		t.Errorf("Expected only container %s, got %v", created.Id, containers)
+	}
+
+	r = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/containers/"+created.Id, nil)
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, r.Code)
+	}
+
+	r = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/containers/"+created.Id+"/json", nil)
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+func TestNegotiateApiVersion(t *testing.T) {
+	for _, test := range []struct {
+		path, version, rest string
+	}{
+		{"/containers/json", MIN_API_VERSION, "containers/json"},
+		{"/v1.0/containers/json", "1.0", "containers/json"},
+		{"/version", MIN_API_VERSION, "version"},
+		{"/v" + API_VERSION + "/version", API_VERSION, "version"},
+	} {
+		version, path, err := negotiateApiVersion(splitApiPath(test.path))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if version.String() != test.version || strings.Join(path, "/") != test.rest {
+			t.Errorf("%s: expected (%s, %s), got (%s, %s)", test.path, test.version, test.rest, version, strings.Join(path, "/"))
+		}
+	}
+	for _, path := range []string{"/v0.9/containers/json", "/v99.0/containers/json"} {
+		if _, _, err := negotiateApiVersion(splitApiPath(path)); err == nil {
+			t.Errorf("%s should be rejected", path)
+		}
+	}
+	v9, _ := parseApiVersion("1.9")
+	v10, _ := parseApiVersion("1.10")
+	if !v9.LessThan(v10) {
+		t.Errorf("1.9 should be older than 1.10")
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	srv := &Server{}
+	r := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v"+API_VERSION+"/version", nil)
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, r.Code, r.Body)
+	}
+	version := &api.Version{}
+	if err := json.Unmarshal(r.Body.Bytes(), version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != VERSION || version.ApiVersion != API_VERSION || version.GoVersion == "" {
+		t.Errorf("Unexpected version: %#v", version)
+	}
+	if r.Header().Get("Api-Version") != API_VERSION {
+		t.Errorf("Expected Api-Version header %s, got %s", API_VERSION, r.Header().Get("Api-Version"))
+	}
+}
+
+func TestImageTagDeleteStatus(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := &Runtime{graph: graph, repositories: store, containers: list.New(), config: DefaultDaemonConfig()}
+	srv := &Server{runtime: runtime}
+	base := &Image{Id: GenerateId()}
+	child := &Image{Id: GenerateId(), Parent: base.Id}
+	used := &Image{Id: GenerateId()}
+	loose := &Image{Id: GenerateId()}
+	for _, img := range []*Image{base, child, used, loose} {
+		if err := graph.Register(testArchive(t), img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Set("app", "v1", child.Id, false); err != nil {
+		t.Fatal(err)
+	}
+	runtime.containers.PushBack(&Container{Id: GenerateId(), Image: used.Id})
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+	}{
+		{"POST", "/images/missing/tag?repo=app", http.StatusNotFound},
+		{"POST", "/images/" + child.Id + "/tag?repo=App+Server", http.StatusBadRequest},
+		{"POST", "/images/" + child.Id + "/tag?repo=app&tag=.v2", http.StatusBadRequest},
+		{"POST", "/images/" + base.Id + "/tag?repo=app&tag=v1", http.StatusConflict},
+		{"POST", "/images/" + base.Id + "/tag?repo=app&tag=v2", http.StatusCreated},
+		{"DELETE", "/images/" + base.Id, http.StatusConflict},  // Named, and the parent of child
+		{"DELETE", "/images/" + child.Id, http.StatusConflict}, // Named
+		{"DELETE", "/images/" + used.Id, http.StatusConflict},  // Used by a container
+		{"DELETE", "/images/" + loose.Id, http.StatusOK},
+	} {
+		r := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.method, "/v"+API_VERSION+test.path, nil)
+		srv.ServeHTTP(r, req)
+		if r.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d (%s)", test.method, test.path, test.status, r.Code, strings.TrimSpace(r.Body.String()))
+		}
+	}
+	for _, img := range []*Image{base, child, used} {
+		if !graph.Exists(img.Id) {
+			t.Errorf("The image %s in use shouldn't be deleted", img.Id)
+		}
+	}
+	if graph.Exists(loose.Id) {
+		t.Errorf("The image %s should be deleted", loose.Id)
+	}
+}
+
+func TestFilterErrorStatus(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{runtime: &Runtime{graph: graph, repositories: store, containers: list.New(), config: DefaultDaemonConfig()}}
+	for _, test := range []struct {
+		method, path, filters string
+		status                int
+	}{
+		{"GET", "/containers/json", `{"status":["paused"]}`, http.StatusBadRequest},
+		{"GET", "/containers/json", `{"name":["web"]}`, http.StatusBadRequest},
+		{"GET", "/containers/json", `{"ancestor":["missing"]}`, http.StatusNotFound},
+		{"GET", "/images/json", `{"dangling":["maybe"]}`, http.StatusBadRequest},
+		{"GET", "/images/json", `{"dangling":["true"]}`, http.StatusOK},
+		{"POST", "/images/prune", `{"until":["soon"]}`, http.StatusBadRequest},
+		{"GET", "/events", `{"type":["network"]}`, http.StatusBadRequest},
+	} {
+		r := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.method, "/v"+API_VERSION+test.path+"?filters="+url.QueryEscape(test.filters), nil)
+		srv.ServeHTTP(r, req)
+		if r.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d (%s)", test.path, test.filters, test.status, r.Code, strings.TrimSpace(r.Body.String()))
+		}
+	}
+}
+
+func TestShutdownRefusesRequests(t *testing.T) {
+	srv := &Server{runtime: &Runtime{containers: list.New(), config: DefaultDaemonConfig()}}
+	if err := srv.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v"+API_VERSION+"/version", nil)
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d after shutdown, got %d", http.StatusServiceUnavailable, r.Code)
+	}
+}
+
+func TestBuildCancelStatus(t *testing.T) {
+	srv := &Server{runtime: &Runtime{containers: list.New(), config: DefaultDaemonConfig()}}
+	r := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v"+API_VERSION+"/build/foo/cancel", nil)
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Cancelling an unknown build: expected %d, got %d (%s)", http.StatusNotFound, r.Code, strings.TrimSpace(r.Body.String()))
+	}
+}
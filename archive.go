@@ -1,10 +1,13 @@
 package docker
 
 import (
+	"archive/tar"
 	"errors"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
 )
 
 type Archive io.Reader
@@ -27,11 +30,71 @@ func (compression *Compression) Flag() string {
 	return ""
 }
 
-func Tar(path string, compression Compression) (io.Reader, error) {
+func Tar(path string, compression Compression) (io.ReadCloser, error) {
 	cmd := exec.Command("bsdtar", "-f", "-", "-C", path, "-c"+compression.Flag(), ".")
 	return CmdStream(cmd)
 }
 
+// TarFilter creates an uncompressed archive of the tree at path, without the
+// files for which exclude returns true. exclude is given paths relative to
+// path, and excluding a directory excludes its content.
+func TarFilter(path string, exclude func(rel string) bool) (io.Reader, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	pipeR, pipeW := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pipeW)
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(path, file)
+			if err != nil || rel == "." {
+				return err
+			}
+			if exclude(rel) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(file); err != nil {
+					return err
+				}
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			hdr.Name = rel
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		pipeW.CloseWithError(err)
+	}()
+	return pipeR, nil
+}
+
 func Untar(archive io.Reader, path string) error {
 	cmd := exec.Command("bsdtar", "-f", "-", "-C", path, "-x")
 	cmd.Stdin = archive
@@ -42,7 +105,7 @@ func Untar(archive io.Reader, path string) error {
 	return nil
 }
 
-func CmdStream(cmd *exec.Cmd) (io.Reader, error) {
+func CmdStream(cmd *exec.Cmd) (io.ReadCloser, error) {
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
@@ -52,10 +115,14 @@ func CmdStream(cmd *exec.Cmd) (io.Reader, error) {
 		return nil, err
 	}
 	pipeR, pipeW := io.Pipe()
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		_, err := io.Copy(pipeW, stdout)
 		if err != nil {
 			pipeW.CloseWithError(err)
+			// Let the command fail writing instead of blocking
+			stdout.Close()
 		}
 		errText, e := ioutil.ReadAll(stderr)
 		if e != nil {
@@ -71,5 +138,18 @@ func CmdStream(cmd *exec.Cmd) (io.Reader, error) {
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
-	return pipeR, nil
+	return &cmdStream{pipeR, done}, nil
+}
+
+// cmdStream is the output of a command. Closing it before the end stops
+// the command, and waits for it to exit.
+type cmdStream struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (stream *cmdStream) Close() error {
+	stream.PipeReader.Close()
+	<-stream.done
+	return nil
 }
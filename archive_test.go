@@ -35,6 +35,22 @@ func TestCmdStreamGood(t *testing.T) {
 	}
 }
 
+func TestCmdStreamClose(t *testing.T) {
+	cmd := exec.Command("yes")
+	out, err := CmdStream(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := out.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the stream stops the command
+	out.Close()
+	if cmd.ProcessState == nil {
+		t.Errorf("The command should have exited once the stream is closed")
+	}
+}
+
 func TestTarUntar(t *testing.T) {
 	archive, err := Tar(".", Uncompressed)
 	if err != nil {
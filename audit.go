@@ -0,0 +1,189 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEntry records an API request which changed the state of the daemon,
+// or an rcli command, with the method RCLI and the command line as path
+type AuditEntry struct {
+	Time       time.Time
+	User       string // Common name of the TLS client certificate, if any
+	RemoteAddr string
+	Method     string
+	Path       string
+	Status     int    `json:",omitempty"` // Not for the rcli commands
+	Error      string `json:",omitempty"`
+}
+
+// AuditLog appends the entries, one JSON object per line, to a file which
+// is rotated when it grows above maxSize: the file becomes FILE.1, FILE.1
+// becomes FILE.2, and so on up to FILE.maxFiles, which is dropped.
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	audit := &AuditLog{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := audit.open(); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+func (audit *AuditLog) open() error {
+	file, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	audit.file = file
+	audit.size = fi.Size()
+	return nil
+}
+
+func (audit *AuditLog) rotate() error {
+	audit.file.Close()
+	for i := audit.maxFiles; i > 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", audit.path, i-1), fmt.Sprintf("%s.%d", audit.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(audit.path, audit.path+".1"); err != nil {
+		return err
+	}
+	return audit.open()
+}
+
+func (audit *AuditLog) Log(entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	if audit.size > 0 && audit.size+int64(len(line)) > audit.maxSize {
+		if err := audit.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := audit.file.Write(line)
+	audit.size += int64(n)
+	return err
+}
+
+func (audit *AuditLog) Close() error {
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	return audit.file.Close()
+}
+
+// auditedCommands are the rcli commands which change the state of the daemon
+var auditedCommands = map[string]bool{
+	"build":   true,
+	"commit":  true,
+	"import":  true,
+	"kill":    true,
+	"load":    true,
+	"pull":    true,
+	"push":    true,
+	"restart": true,
+	"rm":      true,
+	"rmi":     true,
+	"run":     true,
+	"start":   true,
+	"stop":    true,
+	"tag":     true,
+}
+
+// auditedMethod returns whether the requests with method change the state
+// of the daemon
+func auditedMethod(method string) bool {
+	return method != "GET" && method != "HEAD"
+}
+
+// requestUser returns the identity of the client of r: the common name of
+// its TLS certificate, or an empty string without one
+func requestUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// statusRecorder records the status of the response written to a
+// ResponseWriter. A hijacked connection is recorded as 200 OK, like the
+// header written by hijack.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// code returns the status recorded, 200 OK if none was written
+func (w *statusRecorder) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The connection can't be hijacked")
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err == nil {
+		w.status = http.StatusOK
+	}
+	return conn, bufrw, err
+}
@@ -0,0 +1,133 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"github.com/dotcloud/docker/rcli"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func readAuditEntries(t *testing.T, file string) []*AuditEntry {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []*AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	file := path.Join(root, "audit.log")
+	entry := &AuditEntry{Method: "DELETE", Path: "/containers/abc", Status: http.StatusNoContent}
+	line, _ := json.Marshal(entry)
+	// Two entries per file
+	audit, err := NewAuditLog(file, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	for i := 0; i < 7; i++ {
+		entry.Status = i
+		if err := audit.Log(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, statuses := range map[string][]int{file: {6}, file + ".1": {4, 5}, file + ".2": {2, 3}} {
+		entries := readAuditEntries(t, file)
+		if len(entries) != len(statuses) {
+			t.Fatalf("%s: expected %d entries, got %d", file, len(statuses), len(entries))
+		}
+		for i, entry := range entries {
+			if entry.Status != statuses[i] {
+				t.Errorf("%s: expected status %d, got %d", file, statuses[i], entry.Status)
+			}
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Only 2 rotated audit logs should be kept")
+	}
+}
+
+func TestServeHTTPAudit(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	file := path.Join(root, "audit.log")
+	audit, err := NewAuditLog(file, 1024*1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	srv := &Server{runtime: &Runtime{containers: list.New(), config: DefaultDaemonConfig()}, audit: audit}
+
+	for _, method := range []string{"GET", "POST"} {
+		req, _ := http.NewRequest(method, "/v"+API_VERSION+"/containers/unknown/kill?signal=9", nil)
+		req.RemoteAddr = "10.0.0.2:4321"
+		srv.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	entries := readAuditEntries(t, file)
+	if len(entries) != 1 {
+		t.Fatalf("Only the POST should be audited, got %d entries", len(entries))
+	}
+	entry := entries[0]
+	if entry.Method != "POST" || entry.Path != "/v"+API_VERSION+"/containers/unknown/kill?signal=9" || entry.RemoteAddr != "10.0.0.2:4321" {
+		t.Errorf("Unexpected entry: %#v", entry)
+	}
+	if entry.Status != http.StatusNotFound || entry.Error == "" || entry.Time.IsZero() {
+		t.Errorf("The failure should be audited: %#v", entry)
+	}
+}
+
+func TestRcliAudit(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	file := path.Join(root, "audit.log")
+	audit, err := NewAuditLog(file, 1024*1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	srv := &Server{runtime: &Runtime{containers: list.New(), config: DefaultDaemonConfig()}, audit: audit}
+
+	var stdout bytes.Buffer
+	if err := rcli.LocalCall(srv, ioutil.NopCloser(&stdout), &stdout, "version"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rcli.LocalCall(srv, ioutil.NopCloser(&stdout), &stdout, "rm", "unknown"); err == nil {
+		t.Fatal("Expected an error removing an unknown container")
+	}
+	entries := readAuditEntries(t, file)
+	if len(entries) != 1 {
+		t.Fatalf("Only rm should be audited, got %d entries", len(entries))
+	}
+	entry := entries[0]
+	if entry.Method != "RCLI" || entry.Path != "rm unknown" || entry.Status != 0 || entry.Error != "No such container: unknown" {
+		t.Errorf("Unexpected entry: %#v", entry)
+	}
+}
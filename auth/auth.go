@@ -10,6 +10,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
 // Where we store the config file
@@ -19,18 +20,30 @@ const CONFIGFILE = ".dockercfg"
 const REGISTRY_SERVER = "https://registry.docker.io"
 
 type AuthConfig struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Email    string `json:"email"`
-	rootPath string `json:-`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth"`
+	Email         string `json:"email"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+	// Token granted by the registry for the current pull or push.
+	// It is never saved.
+	Token string `json:"-"`
 }
 
-func NewAuthConfig(username, password, email, rootPath string) *AuthConfig {
+// ConfigFile holds the credentials of every registry the user logged into,
+// indexed by server address
+type ConfigFile struct {
+	Configs  map[string]AuthConfig `json:"configs,omitempty"`
+	rootPath string
+	lock     sync.Mutex // Guards Configs and the file
+}
+
+func NewAuthConfig(username, password, email, serverAddress string) *AuthConfig {
 	return &AuthConfig{
-		Username: username,
-		Password: password,
-		Email:    email,
-		rootPath: rootPath,
+		Username:      username,
+		Password:      password,
+		Email:         email,
+		ServerAddress: serverAddress,
 	}
 }
 
@@ -55,7 +68,7 @@ func DecodeAuth(authStr string) (*AuthConfig, error) {
 	if n > decLen {
 		return nil, fmt.Errorf("Something went wrong decoding auth config")
 	}
-	arr := strings.Split(string(decoded), ":")
+	arr := strings.SplitN(string(decoded[:n]), ":", 2)
 	if len(arr) != 2 {
 		return nil, fmt.Errorf("Invalid auth configuration file")
 	}
@@ -65,54 +78,171 @@ func DecodeAuth(authStr string) (*AuthConfig, error) {
 }
 
 // load up the auth config information and return values
-// FIXME: use the internal golang config parser
-func LoadConfig(rootPath string) (*AuthConfig, error) {
+// The file is a json map of server addresses to credentials. The legacy
+// format ("auth = ...\nemail = ...") is still accepted and is attached to
+// the default registry server.
+func LoadConfig(rootPath string) (*ConfigFile, error) {
+	configFile := &ConfigFile{
+		Configs:  make(map[string]AuthConfig),
+		rootPath: rootPath,
+	}
 	confFile := path.Join(rootPath, CONFIGFILE)
 	if _, err := os.Stat(confFile); err != nil {
-		return &AuthConfig{}, fmt.Errorf("The Auth config file is missing")
+		// No config file yet: nobody logged in
+		return configFile, nil
 	}
 	b, err := ioutil.ReadFile(confFile)
 	if err != nil {
 		return nil, err
 	}
+	if err := json.Unmarshal(b, &configFile.Configs); err != nil {
+		authConfig, err := loadLegacyConfig(b)
+		if err != nil {
+			return nil, err
+		}
+		configFile.Configs = map[string]AuthConfig{REGISTRY_SERVER: *authConfig}
+		return configFile, nil
+	}
+	for server, authConfig := range configFile.Configs {
+		decoded, err := DecodeAuth(authConfig.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid credentials for %s: %s", server, err)
+		}
+		authConfig.Username = decoded.Username
+		authConfig.Password = decoded.Password
+		authConfig.ServerAddress = server
+		configFile.Configs[server] = authConfig
+	}
+	return configFile, nil
+}
+
+func loadLegacyConfig(b []byte) (*AuthConfig, error) {
 	arr := strings.Split(string(b), "\n")
+	if len(arr) < 2 {
+		return nil, fmt.Errorf("The Auth config file is empty")
+	}
 	origAuth := strings.Split(arr[0], " = ")
 	origEmail := strings.Split(arr[1], " = ")
+	if len(origAuth) != 2 || len(origEmail) != 2 {
+		return nil, fmt.Errorf("Invalid Auth config file")
+	}
 	authConfig, err := DecodeAuth(origAuth[1])
 	if err != nil {
 		return nil, err
 	}
+	authConfig.Auth = origAuth[1]
 	authConfig.Email = origEmail[1]
-	authConfig.rootPath = rootPath
+	authConfig.ServerAddress = REGISTRY_SERVER
 	return authConfig, nil
 }
 
 // save the auth config
-func saveConfig(rootPath, authStr string, email string) error {
-	lines := "auth = " + authStr + "\n" + "email = " + email + "\n"
-	b := []byte(lines)
-	err := ioutil.WriteFile(path.Join(rootPath, CONFIGFILE), b, 0600)
+// Only the encoded credentials and the email are written to disk.
+func SaveConfig(configFile *ConfigFile) error {
+	configFile.lock.Lock()
+	defer configFile.lock.Unlock()
+	return configFile.save()
+}
+
+// Set stores the credentials of a registry, and saves the config
+func (configFile *ConfigFile) Set(serverAddress string, authConfig AuthConfig) error {
+	configFile.lock.Lock()
+	defer configFile.lock.Unlock()
+	configFile.Configs[serverAddress] = authConfig
+	return configFile.save()
+}
+
+// save writes the config to a temporary file renamed over the previous
+// one, so that a reader never sees a partial file
+func (configFile *ConfigFile) save() error {
+	configs := make(map[string]AuthConfig, len(configFile.Configs))
+	for server, authConfig := range configFile.Configs {
+		configs[server] = AuthConfig{
+			Auth:  EncodeAuth(&authConfig),
+			Email: authConfig.Email,
+		}
+	}
+	b, err := json.Marshal(configs)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(configFile.rootPath, CONFIGFILE)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path.Join(configFile.rootPath, CONFIGFILE))
+}
+
+// ResolveAuthConfig returns the credentials stored for the given registry,
+// or empty credentials if the user never logged into it.
+// Server addresses are compared by hostname, so "https://foo.com/v1/" and
+// "foo.com" resolve to the same entry.
+func (configFile *ConfigFile) ResolveAuthConfig(serverAddress string) AuthConfig {
+	if configFile == nil {
+		return AuthConfig{}
+	}
+	configFile.lock.Lock()
+	defer configFile.lock.Unlock()
+	if authConfig, exists := configFile.Configs[serverAddress]; exists {
+		return authConfig
+	}
+	hostname := convertToHostname(serverAddress)
+	for server, authConfig := range configFile.Configs {
+		if convertToHostname(server) == hostname {
+			return authConfig
+		}
+	}
+	return AuthConfig{}
+}
+
+func convertToHostname(url string) string {
+	stripped := url
+	if strings.HasPrefix(url, "http://") {
+		stripped = strings.TrimPrefix(url, "http://")
+	} else if strings.HasPrefix(url, "https://") {
+		stripped = strings.TrimPrefix(url, "https://")
+	}
+	return strings.SplitN(stripped, "/", 2)[0]
 }
 
 // try to register/login to the registry server
-func Login(authConfig *AuthConfig) (string, error) {
-	storeConfig := false
+// The registry is taken from authConfig.ServerAddress, and defaults to
+// REGISTRY_SERVER. It is up to the caller to save the credentials. The
+// requests are sent with transport, or the default one if nil.
+func Login(authConfig *AuthConfig, transport http.RoundTripper) (string, error) {
 	reqStatusCode := 0
 	var status string
 	var errMsg string
 	var reqBody []byte
-	jsonBody, err := json.Marshal(authConfig)
+
+	serverAddress := authConfig.ServerAddress
+	if serverAddress == "" {
+		serverAddress = REGISTRY_SERVER
+	}
+	serverAddress = strings.TrimRight(serverAddress, "/")
+
+	// The stored auth and the server address aren't part of the account
+	jsonBody, err := json.Marshal(struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}{authConfig.Username, authConfig.Password, authConfig.Email})
 	if err != nil {
 		errMsg = fmt.Sprintf("Config Error: %s", err)
 		return "", errors.New(errMsg)
 	}
 
 	b := strings.NewReader(string(jsonBody))
-	req1, err := http.Post(REGISTRY_SERVER+"/v1/users", "application/json; charset=utf-8", b)
+	client := &http.Client{Transport: transport}
+	req1, err := client.Post(serverAddress+"/v1/users", "application/json; charset=utf-8", b)
 	if err != nil {
 		errMsg = fmt.Sprintf("Server Error: %s", err)
 		return "", errors.New(errMsg)
@@ -128,11 +258,12 @@ func Login(authConfig *AuthConfig) (string, error) {
 
 	if reqStatusCode == 201 {
 		status = "Account Created\n"
-		storeConfig = true
 	} else if reqStatusCode == 400 {
 		if string(reqBody) == "Username or email already exist" {
-			client := &http.Client{}
-			req, err := http.NewRequest("GET", REGISTRY_SERVER+"/v1/users", nil)
+			req, err := http.NewRequest("GET", serverAddress+"/v1/users", nil)
+			if err != nil {
+				return "", err
+			}
 			req.SetBasicAuth(authConfig.Username, authConfig.Password)
 			resp, err := client.Do(req)
 			if err != nil {
@@ -145,7 +276,6 @@ func Login(authConfig *AuthConfig) (string, error) {
 			}
 			if resp.StatusCode == 200 {
 				status = "Login Succeeded\n"
-				storeConfig = true
 			} else {
 				status = fmt.Sprintf("Login: %s", body)
 				return "", errors.New(status)
@@ -155,12 +285,10 @@ func Login(authConfig *AuthConfig) (string, error) {
 			return "", errors.New(status)
 		}
 	} else {
-		status = fmt.Sprintf("[%s] : %s", reqStatusCode, string(reqBody))
+		status = fmt.Sprintf("[%d] : %s", reqStatusCode, string(reqBody))
 		return "", errors.New(status)
 	}
-	if storeConfig {
-		authStr := EncodeAuth(authConfig)
-		saveConfig(authConfig.rootPath, authStr, authConfig.Email)
-	}
+	authConfig.Auth = EncodeAuth(authConfig)
+	authConfig.ServerAddress = serverAddress
 	return status, nil
 }
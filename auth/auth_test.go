@@ -1,6 +1,13 @@
 package auth
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
 	"testing"
 )
 
@@ -21,3 +28,97 @@ func TestEncodeAuth(t *testing.T) {
 		t.Fatal("AuthString encoding isn't correct.")
 	}
 }
+
+func TestSaveLoadConfig(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	configFile, err := LoadConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configFile.Configs) != 0 {
+		t.Fatalf("Expected no credentials, found %d", len(configFile.Configs))
+	}
+	configFile.Configs[REGISTRY_SERVER] = *NewAuthConfig("ken", "test", "test@example.com", REGISTRY_SERVER)
+	configFile.Configs["https://registry.example.com:5000"] = *NewAuthConfig("joe", "pass:word", "joe@example.com", "")
+	if err := SaveConfig(configFile); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Configs) != 2 {
+		t.Fatalf("Expected 2 credentials, found %d", len(loaded.Configs))
+	}
+	authConfig := loaded.ResolveAuthConfig("registry.example.com:5000")
+	if authConfig.Username != "joe" || authConfig.Password != "pass:word" {
+		t.Fatalf("Wrong credentials for registry.example.com:5000: %s/%s", authConfig.Username, authConfig.Password)
+	}
+	if authConfig.ServerAddress != "https://registry.example.com:5000" {
+		t.Fatalf("Wrong server address: %s", authConfig.ServerAddress)
+	}
+	if authConfig := loaded.ResolveAuthConfig(REGISTRY_SERVER + "/v1/"); authConfig.Username != "ken" {
+		t.Fatalf("Wrong username for %s: %s", REGISTRY_SERVER, authConfig.Username)
+	}
+	if authConfig := loaded.ResolveAuthConfig("unknown.example.com"); authConfig.Username != "" {
+		t.Fatalf("Unknown registry should resolve to empty credentials, not %s", authConfig.Username)
+	}
+
+	if err := loaded.Set("https://other.example.com", *NewAuthConfig("ann", "secret", "ann@example.com", "")); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := LoadConfig(root); err != nil || reloaded.ResolveAuthConfig("other.example.com").Username != "ann" || len(reloaded.Configs) != 3 {
+		t.Fatalf("Expected the credentials set to be saved, got %v (%v)", reloaded, err)
+	}
+	// The file is replaced, without leaving the temporary file behind
+	if files, _ := ioutil.ReadDir(root); len(files) != 1 {
+		t.Errorf("Expected only %s in %s, got %d files", CONFIGFILE, root, len(files))
+	}
+	if fi, err := os.Stat(path.Join(root, CONFIGFILE)); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the mode 0600, got %v (%v)", fi, err)
+	}
+}
+
+func TestLoadLegacyConfig(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	legacy := "auth = a2VuOnRlc3Q=\nemail = test@example.com\n"
+	if err := ioutil.WriteFile(path.Join(root, CONFIGFILE), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile, err := LoadConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authConfig := configFile.ResolveAuthConfig(REGISTRY_SERVER)
+	if authConfig.Username != "ken" || authConfig.Email != "test@example.com" {
+		t.Fatalf("Legacy config wasn't loaded correctly: %#v", authConfig)
+	}
+}
+
+func TestLoginBody(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(201)
+	}))
+	defer server.Close()
+	authConfig := &AuthConfig{Username: "ken", Password: "test", Email: "test@example.com", Auth: "stale", ServerAddress: server.URL, Token: "token"}
+	if _, err := Login(authConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Only the fields of the account are sent
+	expected := map[string]interface{}{"username": "ken", "password": "test", "email": "test@example.com"}
+	if !reflect.DeepEqual(body, expected) {
+		t.Errorf("Expected %v to be sent, got %v", expected, body)
+	}
+}
@@ -0,0 +1,296 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// With -authorization-plugin, each API request is passed to the
+// authorization plugins, see plugin.go, in the order they are given. A
+// plugin is called with /AuthZPlugin.AuthZReq before the request is served,
+// and with /AuthZPlugin.AuthZRes with the response before it is sent. Each
+// call may deny the request, and AuthZRes may replace the status, headers
+// or body of the response for the following plugins and the client.
+// The JSON bodies of requests and responses are passed to the plugins, up
+// to maxAuthzBodySize. The bodies of the routes in jsonBodyRoutes are
+// always passed, whatever their content type, and refused beyond. The
+// responses which are streamed, eg. by attach or
+// events, are sent as they are written, without AuthZRes.
+// The rcli commands are passed to AuthZReq as well, with the method RCLI
+// and the command line as the URI, eg. "run -privileged base sh". Their
+// output is streamed, so they aren't passed to AuthZRes.
+
+const maxAuthzBodySize = 1024 * 1024
+
+// jsonBodyRoutes are the routes whose handlers decode the body as JSON,
+// without checking its content type
+var jsonBodyRoutes = []apiRoute{
+	{"POST", splitApiPath("/containers/create"), nil},
+	{"POST", splitApiPath("/containers/:name/update"), nil},
+	{"POST", splitApiPath("/volumes/create"), nil},
+	{"POST", splitApiPath("/trust/keys"), nil},
+}
+
+// authzRequest is the argument of AuthZReq and AuthZRes
+type authzRequest struct {
+	User            string // Common name of the TLS client certificate, if any
+	UserAuthNMethod string // TLS, or empty without a client certificate
+	RequestMethod   string
+	RequestURI      string
+	RequestBody     []byte            `json:",omitempty"` // JSON body, if not too large
+	RequestHeaders  map[string]string `json:",omitempty"`
+
+	ResponseStatusCode int               `json:",omitempty"`
+	ResponseBody       []byte            `json:",omitempty"`
+	ResponseHeaders    map[string]string `json:",omitempty"`
+}
+
+// authzResponse is the answer of the plugins
+type authzResponse struct {
+	Allow bool
+	Msg   string // Sent to the client when the request is denied
+
+	// Replace the response, for AuthZRes
+	ModifiedStatusCode int
+	ModifiedBody       []byte
+	ModifiedHeaders    map[string]string
+}
+
+// isJSON returns whether the content type of header is JSON
+func isJSON(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// decodesJSONBody returns whether r is served by one of jsonBodyRoutes
+func decodesJSONBody(r *http.Request) bool {
+	_, path, err := negotiateApiVersion(splitApiPath(r.URL.Path))
+	if err != nil {
+		return false
+	}
+	for _, route := range jsonBodyRoutes {
+		if route.method == r.Method && matchApiPath(route.pattern, path) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func flattenHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string)
+	for name, values := range header {
+		// Never passed on to the plugins
+		if name == "X-Registry-Auth" || name == "Authorization" {
+			continue
+		}
+		if len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+	return headers
+}
+
+// authzResponseWriter buffers the response until the plugins allowed it,
+// unless it is flushed or hijacked, after which it is written through
+type authzResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	streaming bool
+}
+
+func (w *authzResponseWriter) WriteHeader(status int) {
+	if w.streaming {
+		w.ResponseWriter.WriteHeader(status)
+	} else if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *authzResponseWriter) Write(data []byte) (int, error) {
+	if w.streaming {
+		return w.ResponseWriter.Write(data)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+// stream writes the response buffered so far, and the rest as it comes
+func (w *authzResponseWriter) stream() {
+	if w.streaming {
+		return
+	}
+	w.streaming = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+		w.body.Reset()
+	}
+}
+
+func (w *authzResponseWriter) Flush() {
+	w.stream()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *authzResponseWriter) CloseNotify() <-chan bool {
+	if notifier, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (w *authzResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The connection can't be hijacked")
+	}
+	w.streaming = true
+	return hijacker.Hijack()
+}
+
+// authorize calls method of each authorization plugin with req, and
+// returns the answer of the plugin which denied it, or nil if they all
+// allowed it. The answers of AuthZRes update the response of req, and
+// header, the header of the response.
+func (srv *Server) authorize(method string, req *authzRequest, header http.Header) (*authzResponse, error) {
+	for _, name := range srv.authz {
+		plugin, err := srv.runtime.plugins.Get(name, "AuthzPlugin")
+		if err != nil {
+			return nil, err
+		}
+		res := &authzResponse{}
+		if err := plugin.Call("AuthZPlugin."+method, req, res); err != nil {
+			return nil, err
+		}
+		if !res.Allow {
+			if res.Msg == "" {
+				res.Msg = fmt.Sprintf("Denied by the authorization plugin %s", name)
+			}
+			apiLog.Infof("%s %s denied by the authorization plugin %s: %s", req.RequestMethod, req.RequestURI, name, res.Msg)
+			return res, nil
+		}
+		if method != "AuthZRes" {
+			continue
+		}
+		if res.ModifiedStatusCode != 0 {
+			req.ResponseStatusCode = res.ModifiedStatusCode
+		}
+		if res.ModifiedBody != nil {
+			req.ResponseBody = res.ModifiedBody
+		}
+		for name, value := range res.ModifiedHeaders {
+			req.ResponseHeaders[name] = value
+			header.Set(name, value)
+		}
+	}
+	return nil, nil
+}
+
+// authorizeAndRoute serves r like route, once the authorization plugins
+// allowed it
+func (srv *Server) authorizeAndRoute(w http.ResponseWriter, r *http.Request) error {
+	if len(srv.authz) == 0 {
+		return srv.route(w, r)
+	}
+	req := &authzRequest{
+		User:           requestUser(r),
+		RequestMethod:  r.Method,
+		RequestURI:     r.URL.RequestURI(),
+		RequestHeaders: flattenHeaders(r.Header),
+	}
+	if req.User != "" {
+		req.UserAuthNMethod = "TLS"
+	}
+	decoded := decodesJSONBody(r)
+	inspected := r.Body == nil || r.ContentLength == 0
+	if r.Body != nil && (decoded || isJSON(r.Header)) && r.ContentLength <= maxAuthzBodySize {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAuthzBodySize+1))
+		if err != nil {
+			httpError(w, err)
+			return err
+		}
+		if len(body) <= maxAuthzBodySize {
+			req.RequestBody = body
+			inspected = true
+		}
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	}
+	// The plugins must see what the handler decodes
+	if decoded && !inspected {
+		err := fmt.Errorf("The body of the request is too large to be authorized (maximum %d bytes)", maxAuthzBodySize)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return err
+	}
+	denied, err := srv.authorize("AuthZReq", req, nil)
+	if err != nil {
+		err = fmt.Errorf("Authorization failed: %s", err)
+		httpError(w, err)
+		return err
+	} else if denied != nil {
+		http.Error(w, denied.Msg, http.StatusForbidden)
+		return fmt.Errorf("%s", denied.Msg)
+	}
+
+	buffer := &authzResponseWriter{ResponseWriter: w}
+	routeErr := srv.route(buffer, r)
+	if buffer.streaming {
+		return routeErr
+	}
+	req.ResponseStatusCode = buffer.status
+	if req.ResponseStatusCode == 0 {
+		req.ResponseStatusCode = http.StatusOK
+	}
+	req.ResponseHeaders = flattenHeaders(w.Header())
+	body := buffer.body.Bytes()
+	if isJSON(w.Header()) && len(body) <= maxAuthzBodySize {
+		req.ResponseBody = body
+	}
+	denied, err = srv.authorize("AuthZRes", req, w.Header())
+	if err != nil {
+		err = fmt.Errorf("Authorization failed: %s", err)
+		httpError(w, err)
+		return err
+	} else if denied != nil {
+		http.Error(w, denied.Msg, http.StatusForbidden)
+		return fmt.Errorf("%s", denied.Msg)
+	}
+	if req.ResponseBody != nil && !bytes.Equal(req.ResponseBody, body) {
+		body = req.ResponseBody
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(req.ResponseStatusCode)
+	w.Write(body)
+	return routeErr
+}
+
+// authorizeCall serves the rcli command cmd with serve, once the
+// authorization plugins allowed it
+func (srv *Server) authorizeCall(cmd string, args []string, serve func() error) error {
+	if len(srv.authz) == 0 {
+		return serve()
+	}
+	req := &authzRequest{
+		RequestMethod: "RCLI",
+		RequestURI:    strings.Join(append([]string{cmd}, args...), " "),
+	}
+	denied, err := srv.authorize("AuthZReq", req, nil)
+	if err != nil {
+		return fmt.Errorf("Authorization failed: %s", err)
+	} else if denied != nil {
+		return fmt.Errorf("%s", denied.Msg)
+	}
+	return serve()
+}
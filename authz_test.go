@@ -0,0 +1,159 @@
+package docker
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"github.com/dotcloud/docker/api"
+	"github.com/dotcloud/docker/rcli"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// testAuthzPlugin denies the privileged containers, and hides the version
+// of Go
+func testAuthzPlugin(w http.ResponseWriter, r *http.Request) {
+	req := &authzRequest{}
+	json.NewDecoder(r.Body).Decode(req)
+	res := &authzResponse{Allow: true}
+	switch r.URL.Path {
+	case "/Plugin.Activate":
+		w.Write([]byte(`{"Implements": ["AuthzPlugin"]}`))
+		return
+	case "/AuthZPlugin.AuthZReq":
+		config := &Config{}
+		json.Unmarshal(req.RequestBody, config)
+		if config.Privileged || (req.RequestMethod == "RCLI" && strings.Contains(req.RequestURI, "-privileged")) {
+			res = &authzResponse{Msg: "No privileged containers"}
+		}
+	case "/AuthZPlugin.AuthZRes":
+		version := &api.Version{}
+		if strings.HasSuffix(req.RequestURI, "/version") && json.Unmarshal(req.ResponseBody, version) == nil {
+			version.GoVersion = ""
+			res.ModifiedBody, _ = json.Marshal(version)
+			res.ModifiedHeaders = map[string]string{"X-Authz": "filtered"}
+		}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+func TestAuthzPlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-authz-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", path.Join(dir, "policy.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(testAuthzPlugin)}
+	go server.Serve(listener)
+	defer server.Close()
+	runtime := &Runtime{containers: list.New(), config: DefaultDaemonConfig(), plugins: NewPluginStore(dir, nil)}
+	srv := &Server{runtime: runtime, authz: []string{"policy"}}
+
+	r := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v"+API_VERSION+"/containers/create", bytes.NewBufferString(`{"Image": "base", "Privileged": true}`))
+	req.Header.Set("Content-Type", "application/json")
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusForbidden || !strings.Contains(r.Body.String(), "No privileged containers") {
+		t.Errorf("The privileged container should be denied, got %d: %s", r.Code, r.Body)
+	}
+
+	// The body is decoded as JSON whatever its content type
+	r = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/v"+API_VERSION+"/containers/create", bytes.NewBufferString(`{"Image": "base", "Privileged": true}`))
+	req.Header.Set("Content-Type", "text/plain")
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusForbidden || !strings.Contains(r.Body.String(), "No privileged containers") {
+		t.Errorf("The privileged container should be denied without a JSON content type, got %d: %s", r.Code, r.Body)
+	}
+
+	// It can't be authorized if it is too large
+	r = httptest.NewRecorder()
+	padding := strings.Repeat(" ", maxAuthzBodySize)
+	req, _ = http.NewRequest("POST", "/v"+API_VERSION+"/containers/create", bytes.NewBufferString(`{"Image": "base", "Privileged": true}`+padding))
+	req.Header.Set("Content-Type", "application/json")
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for a body too large, got %d: %s", http.StatusRequestEntityTooLarge, r.Code, r.Body)
+	}
+
+	r = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v"+API_VERSION+"/version", nil)
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, r.Code, r.Body)
+	}
+	version := &api.Version{}
+	if err := json.Unmarshal(r.Body.Bytes(), version); err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != VERSION || version.GoVersion != "" || r.Header().Get("X-Authz") != "filtered" {
+		t.Errorf("The response should be modified by the plugin: %#v %v", version, r.Header())
+	}
+
+	// The requests are denied when a plugin is missing
+	srv.authz = append(srv.authz, "missing")
+	r = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v"+API_VERSION+"/version", nil)
+	srv.ServeHTTP(r, req)
+	if r.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d: %s", http.StatusInternalServerError, r.Code, r.Body)
+	}
+}
+
+func TestAuthzRcli(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-authz-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", path.Join(dir, "policy.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(testAuthzPlugin)}
+	go server.Serve(listener)
+	defer server.Close()
+	runtime := &Runtime{containers: list.New(), config: DefaultDaemonConfig(), plugins: NewPluginStore(dir, nil)}
+	srv := &Server{runtime: runtime, authz: []string{"policy"}}
+
+	var stdout bytes.Buffer
+	if err := rcli.LocalCall(srv, ioutil.NopCloser(&stdout), &stdout, "run", "-privileged", "base", "sh"); err == nil || err.Error() != "No privileged containers" {
+		t.Errorf("The privileged container should be denied, got %v", err)
+	}
+	if err := rcli.LocalCall(srv, ioutil.NopCloser(&stdout), &stdout, "version"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "Version:"+VERSION) {
+		t.Errorf("Unexpected output: %s", stdout.String())
+	}
+
+	srv.authz = append(srv.authz, "missing")
+	if err := rcli.LocalCall(srv, ioutil.NopCloser(&stdout), &stdout, "version"); err == nil || !strings.HasPrefix(err.Error(), "Authorization failed") {
+		t.Errorf("The commands should be denied when a plugin is missing, got %v", err)
+	}
+}
+
+func TestAuthzResponseWriterStream(t *testing.T) {
+	r := httptest.NewRecorder()
+	w := &authzResponseWriter{ResponseWriter: r}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte("buffered"))
+	if r.Body.Len() != 0 {
+		t.Fatalf("The response should be buffered")
+	}
+	w.Flush()
+	w.Write([]byte(", streamed"))
+	if r.Code != http.StatusCreated || r.Body.String() != "buffered, streamed" || !w.streaming {
+		t.Errorf("Unexpected response once flushed: %d %s", r.Code, r.Body)
+	}
+}
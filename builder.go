@@ -0,0 +1,1071 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A single instruction of a Dockerfile
+type instruction struct {
+	line int
+	cmd  string // Upper-cased name of the instruction
+	args string
+}
+
+type instructionHandler func(b *Builder, args string) error
+
+var buildInstructions map[string]instructionHandler
+
+// The handlers are set in init, as some of them dispatch instructions
+func init() {
+	buildInstructions = map[string]instructionHandler{
+		"FROM":       (*Builder).from,
+		"RUN":        (*Builder).run,
+		"CMD":        (*Builder).cmd,
+		"EXPOSE":     (*Builder).expose,
+		"ENV":        (*Builder).env,
+		"ADD":        (*Builder).add,
+		"ARG":        (*Builder).arg,
+		"ONBUILD":    (*Builder).onbuild,
+		"COPY":       (*Builder).copy,
+		"ENTRYPOINT": (*Builder).entrypoint,
+		"VOLUME":     (*Builder).volume,
+		"WORKDIR":    (*Builder).workdir,
+		"USER":       (*Builder).user,
+		"LABEL":      (*Builder).label,
+		"STOPSIGNAL": (*Builder).stopSignal,
+	}
+}
+
+// The instructions whose arguments are subject to variable substitution
+var substitutedInstructions = map[string]bool{
+	"ADD":        true,
+	"COPY":       true,
+	"ENV":        true,
+	"EXPOSE":     true,
+	"LABEL":      true,
+	"STOPSIGNAL": true,
+	"USER":       true,
+	"VOLUME":     true,
+	"WORKDIR":    true,
+}
+
+// expandVariables replaces $NAME and ${NAME} in s with lookup(NAME).
+// '\$' is a literal '$'.
+func expandVariables(s string, lookup func(string) string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '$':
+			buf.WriteByte('$')
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				buf.WriteString(s[i:])
+				return buf.String()
+			}
+			buf.WriteString(lookup(s[i+2 : i+2+end]))
+			i += end + 2
+		case s[i] == '$':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || '0' <= s[j] && s[j] <= '9' || 'a' <= s[j] && s[j] <= 'z' || 'A' <= s[j] && s[j] <= 'Z') {
+				j++
+			}
+			if j == i+1 {
+				buf.WriteByte('$')
+				continue
+			}
+			buf.WriteString(lookup(s[i+1 : j]))
+			i = j - 1
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String()
+}
+
+// parseInstruction parses a single instruction, such as an ONBUILD trigger
+func parseInstruction(s string) (instruction, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	inst := instruction{cmd: strings.ToUpper(parts[0])}
+	if len(parts) == 2 {
+		inst.args = strings.TrimSpace(parts[1])
+	}
+	if _, exists := buildInstructions[inst.cmd]; !exists {
+		return inst, fmt.Errorf("Unknown instruction: %s", parts[0])
+	}
+	if inst.args == "" {
+		return inst, fmt.Errorf("%s requires an argument", inst.cmd)
+	}
+	return inst, nil
+}
+
+// parseDockerfile splits a Dockerfile into instructions. Blank lines and
+// lines starting with '#' are ignored, and a trailing '\' continues an
+// instruction on the next line.
+func parseDockerfile(r io.Reader) ([]instruction, error) {
+	var instructions []instruction
+	scanner := bufio.NewScanner(r)
+	lineno, start := 0, 0
+	current := ""
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if current == "" {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			start = lineno
+		}
+		if strings.HasSuffix(line, "\\") {
+			current += strings.TrimSuffix(line, "\\")
+			continue
+		}
+		current += line
+		inst, err := parseInstruction(current)
+		current = ""
+		if err != nil {
+			return nil, fmt.Errorf("Dockerfile line %d: %s", start, err)
+		}
+		inst.line = start
+		if len(instructions) == 0 && inst.cmd != "FROM" {
+			return nil, fmt.Errorf("Dockerfile line %d: The first instruction must be FROM", inst.line)
+		}
+		instructions = append(instructions, inst)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != "" {
+		return nil, fmt.Errorf("Dockerfile line %d: Unexpected end of file after '\\'", start)
+	}
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("The Dockerfile is empty")
+	}
+	return instructions, nil
+}
+
+// parseCommand accepts either a JSON array, which is used as is, or a
+// plain string, which is run with /bin/sh -c
+func parseCommand(args string) ([]string, error) {
+	if strings.HasPrefix(args, "[") {
+		var cmd []string
+		if err := json.Unmarshal([]byte(args), &cmd); err != nil {
+			return nil, fmt.Errorf("Invalid JSON array: %s", args)
+		}
+		return cmd, nil
+	}
+	return []string{"/bin/sh", "-c", args}, nil
+}
+
+// splitWords splits s on whitespace, except between double quotes, which
+// are removed
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var word bytes.Buffer
+	inWord, quoted := false, false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted, inWord = !quoted, true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("Unterminated quote: %s", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// hashPath returns a checksum of the file or directory tree at p, covering
+// the names, modes and contents of its files.
+func hashPath(p string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(p, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p, file)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", rel, info.Mode())
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		} else if info.Mode().IsRegular() {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readDockerignore returns the patterns of the .dockerignore file of the
+// build context dir, if there is one
+func readDockerignore(dir string) ([]string, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := strings.TrimPrefix(filepath.Clean(line), "/")
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern in .dockerignore: %s", line)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// BuildContext returns an archive of the directory dir, to be uploaded as a
+// build context. The paths matching a pattern of the .dockerignore file of
+// dir are left out, except for the Dockerfile and .dockerignore.
+func BuildContext(dir string) (io.Reader, error) {
+	patterns, err := readDockerignore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return TarFilter(dir, func(rel string) bool {
+		if rel == "Dockerfile" || rel == ".dockerignore" {
+			return false
+		}
+		for _, pattern := range patterns {
+			// The patterns were validated by readDockerignore
+			if matched, _ := filepath.Match(pattern, rel); matched {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ParseBuildArgs converts NAME=VALUE pairs to a map
+func ParseBuildArgs(pairs []string) (map[string]string, error) {
+	buildArgs := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid build arg: %s (expected NAME=VALUE)", pair)
+		}
+		buildArgs[parts[0]] = parts[1]
+	}
+	return buildArgs, nil
+}
+
+// ReadBuildArgs reads the NAME=VALUE lines of the build arg files, in order,
+// and returns their values overridden by pairs, as with -build-arg-file and
+// -build-arg
+func ReadBuildArgs(files, pairs []string) (map[string]string, error) {
+	var filePairs []string
+	for _, file := range files {
+		values, err := ParseEnvFile(file, false)
+		if err != nil {
+			return nil, err
+		}
+		filePairs = append(filePairs, values...)
+	}
+	return ParseBuildArgs(append(filePairs, pairs...))
+}
+
+var ErrBuildCancelled = errors.New("Build cancelled")
+
+// Builder creates an image by executing the instructions of a Dockerfile,
+// each in a throwaway container which is committed to an intermediate image.
+// Unless the cache is disabled, an instruction is skipped when the image it
+// would produce already exists.
+type Builder struct {
+	Id string
+
+	srv      *Server
+	out      io.Writer
+	context  string // Directory the sources of ADD are relative to. Empty if there is none.
+	useCache bool
+	rm       bool // Remove the intermediate containers after a successful build
+	forceRm  bool // Always remove the intermediate containers
+
+	cancelled  chan struct{}
+	cancelOnce sync.Once
+	containers []*Container // Intermediate containers
+	images     []string     // Ids of the images committed by this build
+
+	buildArgs map[string]string // Values given to the ARG instructions by the operator
+	usedArgs  map[string]bool   // Build args consumed by an ARG instruction
+
+	stages     []string       // Ids of the images of the complete stages
+	stageNames map[string]int // Indexes of the stages by name
+
+	image  string            // Id of the image built so far by the current stage
+	config *Config           // Configuration of the image built so far
+	args   map[string]string // Values of the ARG instructions of the current stage
+}
+
+func NewBuilder(srv *Server, out io.Writer, context string, useCache, rm, forceRm bool, buildArgs map[string]string) *Builder {
+	return &Builder{
+		Id:         GenerateId(),
+		srv:        srv,
+		out:        out,
+		context:    context,
+		useCache:   useCache,
+		rm:         rm,
+		forceRm:    forceRm,
+		cancelled:  make(chan struct{}),
+		buildArgs:  buildArgs,
+		usedArgs:   make(map[string]bool),
+		stageNames: make(map[string]int),
+	}
+}
+
+// Build executes the Dockerfile read from dockerfile and returns the
+// resulting image. The intermediate containers are then removed according
+// to the rm policy. If the build is cancelled, the intermediate images are
+// removed as well.
+func (b *Builder) Build(dockerfile io.Reader) (*Image, error) {
+	img, err := b.build(dockerfile)
+	b.cleanup(err)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(b.out, "Successfully built %s\n", img.Id)
+	return img, nil
+}
+
+// Cancel stops the build, killing the command being run if any
+func (b *Builder) Cancel() {
+	b.cancelOnce.Do(func() { close(b.cancelled) })
+}
+
+func (b *Builder) isCancelled() bool {
+	select {
+	case <-b.cancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Builder) build(dockerfile io.Reader) (*Image, error) {
+	instructions, err := parseDockerfile(dockerfile)
+	if err != nil {
+		return nil, err
+	}
+	for i, inst := range instructions {
+		if b.isCancelled() {
+			return nil, ErrBuildCancelled
+		}
+		fmt.Fprintf(b.out, "Step %d : %s %s\n", i+1, inst.cmd, inst.args)
+		if err := b.dispatch(inst); err != nil {
+			return nil, fmt.Errorf("Dockerfile line %d: %s", inst.line, err)
+		}
+	}
+	var unused []string
+	for name := range b.buildArgs {
+		if !b.usedArgs[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		fmt.Fprintf(b.out, "Warning: Build args %s were not consumed by an ARG instruction\n", strings.Join(unused, ", "))
+	}
+	return b.srv.runtime.graph.Get(b.image)
+}
+
+func (b *Builder) cleanup(err error) {
+	cancelled := err != nil && b.isCancelled()
+	if (err == nil && b.rm) || b.forceRm || cancelled {
+		for _, container := range b.containers {
+			fmt.Fprintf(b.out, "Removing intermediate container %s\n", container.Id)
+			if err := b.srv.runtime.Destroy(container); err != nil {
+				fmt.Fprintf(b.out, "Error removing intermediate container %s: %s\n", container.Id, err)
+			}
+		}
+		b.containers = nil
+	}
+	if cancelled {
+		for i := len(b.images) - 1; i >= 0; i-- {
+			fmt.Fprintf(b.out, "Removing intermediate image %s\n", b.images[i])
+			if err := b.srv.runtime.graph.Delete(b.images[i]); err != nil {
+				fmt.Fprintf(b.out, "Error removing intermediate image %s: %s\n", b.images[i], err)
+			}
+		}
+		b.images = nil
+	}
+}
+
+// dispatch executes an instruction, after variable substitution
+func (b *Builder) dispatch(inst instruction) error {
+	args := inst.args
+	if substitutedInstructions[inst.cmd] {
+		args = expandVariables(args, b.lookupVariable)
+	}
+	return buildInstructions[inst.cmd](b, args)
+}
+
+// FROM IMAGE [AS NAME] starts a new stage. Its image can be referred to
+// by NAME, or by its index, once the stage is complete.
+func (b *Builder) from(args string) error {
+	parts := strings.Fields(args)
+	if len(parts) != 1 && (len(parts) != 3 || strings.ToUpper(parts[1]) != "AS") {
+		return fmt.Errorf("Invalid FROM: %s (expected IMAGE or IMAGE AS NAME)", args)
+	}
+	// The previous stage is complete
+	if b.image != "" {
+		b.stages = append(b.stages, b.image)
+	}
+	if len(parts) == 3 {
+		stageName := strings.ToLower(parts[2])
+		if _, exists := b.stageNames[stageName]; exists {
+			return fmt.Errorf("Duplicate stage name: %s", parts[2])
+		}
+		b.stageNames[stageName] = len(b.stages)
+	}
+	var img *Image
+	if index, exists := b.stageNames[strings.ToLower(parts[0])]; exists && index < len(b.stages) {
+		var err error
+		if img, err = b.srv.runtime.graph.Get(b.stages[index]); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if img, err = b.lookupImage(parts[0]); err != nil {
+			return err
+		}
+	}
+	b.image = img.Id
+	b.config = &Config{}
+	b.args = make(map[string]string)
+	if img.Config != nil {
+		config := *img.Config
+		b.config = &config
+	}
+	fmt.Fprintf(b.out, " ---> %s\n", img.Id)
+
+	// The triggers are executed once, they are not inherited by the images
+	// built from this one
+	triggers := b.config.OnBuild
+	b.config.OnBuild = nil
+	if len(triggers) > 0 {
+		fmt.Fprintf(b.out, "# Executing %d build triggers\n", len(triggers))
+	}
+	for _, trigger := range triggers {
+		inst, err := parseInstruction(trigger)
+		if err != nil {
+			return fmt.Errorf("Invalid trigger %s: %s", trigger, err)
+		}
+		fmt.Fprintf(b.out, "Trigger : %s %s\n", inst.cmd, inst.args)
+		if err := b.dispatch(inst); err != nil {
+			return fmt.Errorf("Trigger %s %s: %s", inst.cmd, inst.args, err)
+		}
+	}
+	return nil
+}
+
+// Look up an image, pulling it if needed
+func (b *Builder) lookupImage(name string) (*Image, error) {
+	img, err := b.srv.runtime.repositories.LookupImage(name)
+	if err != nil && b.srv.runtime.graph.IsNotExist(err) {
+		fmt.Fprintf(b.out, "Image %s not found, trying to pull it from registry.\n", name)
+		if err := b.srv.ImagePull(b.out, b.cancelled, name); err != nil {
+			return nil, err
+		}
+		img, err = b.srv.runtime.repositories.LookupImage(name)
+	}
+	return img, err
+}
+
+// stageImage returns the id of the image of a complete stage, given its
+// name or index, or else of the image called name
+func (b *Builder) stageImage(name string) (string, error) {
+	if index, exists := b.stageNames[strings.ToLower(name)]; exists {
+		if index >= len(b.stages) {
+			return "", fmt.Errorf("The stage %s is not complete", name)
+		}
+		return b.stages[index], nil
+	}
+	if index, err := strconv.Atoi(name); err == nil {
+		if index < 0 || index >= len(b.stages) {
+			return "", fmt.Errorf("Invalid stage index: %d", index)
+		}
+		return b.stages[index], nil
+	}
+	img, err := b.lookupImage(name)
+	if err != nil {
+		return "", err
+	}
+	return img.Id, nil
+}
+
+func (b *Builder) run(args string) error {
+	// The ARG values are only set while the command runs, and are part of
+	// the container config so that changing them invalidates the cache
+	config := b.runConfig([]string{args})
+	config.Env = b.runEnv()
+	if hit, err := b.probeCache(config); err != nil || hit {
+		return err
+	}
+	container, err := b.create(config)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b.out, " ---> Running in %s\n", container.Id)
+
+	out := &lockedWriter{Writer: b.out}
+	stdout, err := container.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := container.StderrPipe()
+	if err != nil {
+		return err
+	}
+	copyStdout := Go(func() error { _, err := io.Copy(out, stdout); return err })
+	copyStderr := Go(func() error { _, err := io.Copy(out, stderr); return err })
+	if err := container.Start(); err != nil {
+		return err
+	}
+	exited := make(chan int, 1)
+	go func() { exited <- container.Wait() }()
+	var status int
+	select {
+	case status = <-exited:
+	case <-b.cancelled:
+		if err := container.Kill(); err != nil {
+			return err
+		}
+		<-exited
+		return ErrBuildCancelled
+	}
+	<-copyStdout
+	<-copyStderr
+	if status != 0 {
+		return fmt.Errorf("The command %s returned a non-zero code: %d", args, status)
+	}
+	return b.commit(container, "RUN "+args)
+}
+
+func (b *Builder) cmd(args string) error {
+	cmd, err := parseCommand(args)
+	if err != nil {
+		return err
+	}
+	b.config.Cmd = cmd
+	return b.commitConfig("CMD " + args)
+}
+
+func (b *Builder) entrypoint(args string) error {
+	entrypoint, err := parseCommand(args)
+	if err != nil {
+		return err
+	}
+	b.config.Entrypoint = entrypoint
+	return b.commitConfig("ENTRYPOINT " + args)
+}
+
+func (b *Builder) expose(args string) error {
+	ports := append([]int{}, b.config.Ports...)
+	for _, field := range strings.Fields(args) {
+		port, err := strconv.Atoi(field)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("Invalid port: %s", field)
+		}
+		ports = append(ports, port)
+	}
+	b.config.Ports = ports
+	return b.commitConfig("EXPOSE " + args)
+}
+
+func (b *Builder) env(args string) error {
+	parts := strings.SplitN(args, " ", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("ENV requires a name and a value")
+	}
+	key, value := parts[0], strings.TrimSpace(parts[1])
+	env := []string{}
+	for _, e := range b.config.Env {
+		if strings.SplitN(e, "=", 2)[0] != key {
+			env = append(env, e)
+		}
+	}
+	b.config.Env = append(env, key+"="+value)
+	return b.commitConfig("ENV " + args)
+}
+
+func (b *Builder) volume(args string) error {
+	var paths []string
+	if strings.HasPrefix(args, "[") {
+		if err := json.Unmarshal([]byte(args), &paths); err != nil {
+			return fmt.Errorf("Invalid JSON array: %s", args)
+		}
+	} else {
+		paths = strings.Fields(args)
+	}
+	volumes := make(map[string]struct{})
+	for volume := range b.config.Volumes {
+		volumes[volume] = struct{}{}
+	}
+	for _, p := range paths {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("The volume path must be absolute: %s", p)
+		}
+		volumes[path.Clean(p)] = struct{}{}
+	}
+	b.config.Volumes = volumes
+	return b.commitConfig("VOLUME " + args)
+}
+
+func (b *Builder) workdir(args string) error {
+	b.config.WorkingDir = b.resolvePath(args)
+	return b.commitConfig("WORKDIR " + args)
+}
+
+func (b *Builder) user(args string) error {
+	b.config.User = args
+	return b.commitConfig("USER " + args)
+}
+
+func (b *Builder) stopSignal(args string) error {
+	if _, err := ParseSignal(args); err != nil {
+		return err
+	}
+	b.config.StopSignal = args
+	return b.commitConfig("STOPSIGNAL " + args)
+}
+
+// label sets labels of the image: LABEL KEY=VALUE [KEY="VALUE"...]
+func (b *Builder) label(args string) error {
+	words, err := splitWords(args)
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string)
+	for key, value := range b.config.Labels {
+		labels[key] = value
+	}
+	for _, word := range words {
+		parts := strings.SplitN(word, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Invalid label: %s (expected KEY=VALUE)", word)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	b.config.Labels = labels
+	return b.commitConfig("LABEL " + args)
+}
+
+func (b *Builder) add(args string) error {
+	parts := strings.Fields(args)
+	if len(parts) != 2 {
+		return fmt.Errorf("ADD requires a source and a destination")
+	}
+	src, dest := parts[0], parts[1]
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		if b.context == "" {
+			return fmt.Errorf("No build context: can't ADD local file %s", src)
+		}
+		return b.addPath(b.context, src, dest, "ADD "+args)
+	}
+	tmp, err := ioutil.TempDir("", "docker-build")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	srcPath, err := b.download(src, tmp, strings.HasSuffix(dest, "/"))
+	if err != nil {
+		return err
+	}
+	return b.addPath(tmp, path.Base(srcPath), dest, "ADD "+args)
+}
+
+// COPY [--from=STAGE|IMAGE] src dest copies src from the build context, or
+// from the filesystem of a previous stage or of an image
+func (b *Builder) copy(args string) error {
+	from := ""
+	if strings.HasPrefix(args, "--from=") {
+		parts := strings.SplitN(args, " ", 2)
+		from = strings.TrimPrefix(parts[0], "--from=")
+		if from == "" || len(parts) != 2 {
+			return fmt.Errorf("COPY --from requires a stage or an image")
+		}
+		args = strings.TrimSpace(parts[1])
+	}
+	parts := strings.Fields(args)
+	if len(parts) != 2 {
+		return fmt.Errorf("COPY requires a source and a destination")
+	}
+	src, dest := parts[0], parts[1]
+	if from == "" {
+		if b.context == "" {
+			return fmt.Errorf("No build context: can't COPY local file %s", src)
+		}
+		return b.addPath(b.context, src, dest, "COPY "+args)
+	}
+	imageId, err := b.stageImage(from)
+	if err != nil {
+		return err
+	}
+	// Mount the filesystem of the source through a container
+	source, err := b.srv.runtime.Create(&Config{
+		Image:      imageId,
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{"#(nop) COPY source"},
+	})
+	if err != nil {
+		return err
+	}
+	defer b.srv.runtime.Destroy(source)
+	if err := source.ensureMounted(b.cancelled); err != nil {
+		return err
+	}
+	return b.addPath(source.RootfsPath(), src, dest, "COPY --from="+from+" "+args)
+}
+
+// sourcePath returns the path of src, relative to root, in which src can't
+// lead out of root: the links of the build context, or of the filesystem of
+// the stage, are followed within it.
+func sourcePath(root, src string) (string, error) {
+	root = path.Clean(root)
+	srcPath := path.Join(root, src)
+	if srcPath != root && !strings.HasPrefix(srcPath, root+"/") {
+		return "", fmt.Errorf("Forbidden path outside the build context: %s", src)
+	}
+	return FollowSymlinkInScope(srcPath, root)
+}
+
+// addPath commits the current image with src, relative to root, copied to
+// dest. root is the build context or the root of a filesystem.
+func (b *Builder) addPath(root, src, dest, comment string) error {
+	srcPath, err := sourcePath(root, src)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	// The checksum of the source is part of the command, so that the
+	// cache is only used if the content is unchanged, and the name of a
+	// file, which it keeps when copied into a directory
+	hash, err := hashPath(srcPath)
+	if err != nil {
+		return err
+	}
+	name := path.Base(path.Join("/", src))
+	source := "dir:" + hash
+	if !stat.IsDir() {
+		source = "file:" + hash + " " + name
+	}
+	instruction := strings.SplitN(comment, " ", 2)[0]
+	config := b.runConfig([]string{fmt.Sprintf("#(nop) %s %s in %s", instruction, source, dest)})
+	if hit, err := b.probeCache(config); err != nil || hit {
+		return err
+	}
+
+	container, err := b.create(config)
+	if err != nil {
+		return err
+	}
+	if err := container.ensureMounted(b.cancelled); err != nil {
+		return err
+	}
+	destPath, destIsDir, err := b.destinationPath(container.RootfsPath(), dest, name, stat.IsDir())
+	if err != nil {
+		return err
+	}
+	if err := copyPath(srcPath, destPath, destIsDir); err != nil {
+		return fmt.Errorf("Unable to copy %s: %s", src, err)
+	}
+	return b.commit(container, comment)
+}
+
+// destinationPath returns the path in rootfs where the source name is
+// copied to dest, and whether it is copied into it. The links of the image
+// are followed within rootfs, so that the copy doesn't write to the host.
+func (b *Builder) destinationPath(rootfs, dest, name string, srcIsDir bool) (string, bool, error) {
+	destPath := b.resolvePath(dest)
+	destIsDir := strings.HasSuffix(dest, "/")
+	// A file copied into a directory keeps the name of the source
+	if destIsDir && !srcIsDir {
+		destPath, destIsDir = path.Join(destPath, name), false
+	}
+	destPath, err := FollowSymlinkInScope(path.Join(rootfs, destPath), rootfs)
+	return destPath, destIsDir, err
+}
+
+// Download src into dir, and return the path of the file. It is named after
+// the last component of the url if there is one.
+func (b *Builder) download(src, dir string, destIsDir bool) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		if destIsDir {
+			return "", fmt.Errorf("Can't guess a file name for %s", src)
+		}
+		name = "download"
+	}
+	resp, err := Download(src, b.out, b.cancelled)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	file, err := os.OpenFile(path.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, ProgressReader(resp.Body, int(resp.ContentLength), b.out)); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Copy srcPath to destPath. Directories are copied recursively, and a file
+// is copied into destPath if destIsDir.
+func copyPath(srcPath, destPath string, destIsDir bool) error {
+	stat, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		if err := os.MkdirAll(destPath, 0755); err != nil {
+			return err
+		}
+		srcPath += "/."
+	} else {
+		if destIsDir {
+			destPath = path.Join(destPath, path.Base(srcPath))
+		}
+		if err := os.MkdirAll(path.Dir(destPath), 0755); err != nil {
+			return err
+		}
+	}
+	if output, err := exec.Command("cp", "-a", srcPath, destPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Make p absolute, relative to the current working directory of the image
+func (b *Builder) resolvePath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	workdir := b.config.WorkingDir
+	if workdir == "" {
+		workdir = "/"
+	}
+	return path.Join(workdir, p)
+}
+
+// ONBUILD INSTRUCTION stores an instruction in the image config, to be
+// executed by the builds starting FROM the image
+func (b *Builder) onbuild(args string) error {
+	inst, err := parseInstruction(args)
+	if err != nil {
+		return err
+	}
+	if inst.cmd == "ONBUILD" || inst.cmd == "FROM" {
+		return fmt.Errorf("%s isn't allowed as an ONBUILD trigger", inst.cmd)
+	}
+	b.config.OnBuild = append(append([]string{}, b.config.OnBuild...), inst.cmd+" "+inst.args)
+	return b.commitConfig("ONBUILD " + args)
+}
+
+func (b *Builder) arg(args string) error {
+	name, value := args, ""
+	hasDefault := false
+	if i := strings.Index(args, "="); i >= 0 {
+		name, value, hasDefault = args[:i], args[i+1:], true
+	}
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("Invalid ARG: %s (expected NAME or NAME=DEFAULT)", args)
+	}
+	if buildArg, exists := b.buildArgs[name]; exists {
+		value = buildArg
+		b.usedArgs[name] = true
+	} else if !hasDefault {
+		return nil
+	}
+	b.args[name] = value
+	return nil
+}
+
+// lookupVariable returns the value of an environment variable of the image,
+// or else of an ARG
+func (b *Builder) lookupVariable(name string) string {
+	for _, env := range b.config.Env {
+		if parts := strings.SplitN(env, "=", 2); parts[0] == name && len(parts) == 2 {
+			return parts[1]
+		}
+	}
+	return b.args[name]
+}
+
+// runEnv returns the environment of a RUN instruction: the environment of
+// the image, and the ARG values it doesn't override
+func (b *Builder) runEnv() []string {
+	env := append([]string{}, b.config.Env...)
+	var names []string
+	for name := range b.args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		overridden := false
+		for _, e := range b.config.Env {
+			if strings.SplitN(e, "=", 2)[0] == name {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			env = append(env, name+"="+b.args[name])
+		}
+	}
+	return env
+}
+
+// runConfig returns the config of a container running cmd with /bin/sh -c
+// from the current image. The entrypoint is set so that the one of the
+// image is not used.
+func (b *Builder) runConfig(cmd []string) *Config {
+	config := *b.config
+	config.Image = b.image
+	config.Entrypoint = []string{"/bin/sh", "-c"}
+	config.Cmd = cmd
+	return &config
+}
+
+// create creates an intermediate container, which is removed at the end of
+// the build according to the rm policy
+func (b *Builder) create(config *Config) (*Container, error) {
+	container, err := b.srv.runtime.Create(config)
+	if err != nil {
+		return nil, err
+	}
+	b.containers = append(b.containers, container)
+	return container, nil
+}
+
+// Commit container with the current configuration as the new current image
+func (b *Builder) commit(container *Container, comment string) error {
+	config := *b.config
+	img, err := b.srv.runtime.commit(container.Id, "", "", comment, &config, b.cancelled)
+	if err != nil {
+		return err
+	}
+	b.image = img.Id
+	b.images = append(b.images, img.Id)
+	fmt.Fprintf(b.out, " ---> %s\n", img.Id)
+	return nil
+}
+
+// probeCache looks for an image built from the current image by a
+// container with the command and environment of config. If there is one,
+// it becomes the current image.
+func (b *Builder) probeCache(config *Config) (bool, error) {
+	if !b.useCache {
+		return false, nil
+	}
+	byParent, err := b.srv.runtime.graph.ByParent()
+	if err != nil {
+		return false, err
+	}
+	var cached *Image
+	for _, img := range byParent[b.image] {
+		if img.Config == nil || !equalStrings(img.ContainerConfig.Cmd, config.Cmd) ||
+			!equalStrings(img.ContainerConfig.Entrypoint, config.Entrypoint) ||
+			!equalStrings(img.ContainerConfig.Env, config.Env) {
+			continue
+		}
+		if cached == nil || img.Created.After(cached.Created) {
+			cached = img
+		}
+	}
+	if cached == nil {
+		return false, nil
+	}
+	imageConfig := *cached.Config
+	b.image, b.config = cached.Id, &imageConfig
+	fmt.Fprintf(b.out, " ---> Using cache\n ---> %s\n", cached.Id)
+	return true, nil
+}
+
+// Commit an image which only differs from its parent by its configuration
+func (b *Builder) commitConfig(comment string) error {
+	config := b.runConfig([]string{"#(nop) " + comment})
+	if hit, err := b.probeCache(config); err != nil || hit {
+		return err
+	}
+	container, err := b.create(config)
+	if err != nil {
+		return err
+	}
+	if err := container.ensureMounted(b.cancelled); err != nil {
+		return err
+	}
+	return b.commit(container, comment)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
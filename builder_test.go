@@ -0,0 +1,611 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	instructions, err := parseDockerfile(strings.NewReader(`
+# A comment
+from base
+RUN apt-get update && \
+    apt-get install -y curl
+
+cmd ["/bin/echo", "hello"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []instruction{
+		{line: 3, cmd: "FROM", args: "base"},
+		{line: 4, cmd: "RUN", args: "apt-get update && apt-get install -y curl"},
+		{line: 7, cmd: "CMD", args: `["/bin/echo", "hello"]`},
+	}
+	if len(instructions) != len(expected) {
+		t.Fatalf("Expected %d instructions, got %v", len(expected), instructions)
+	}
+	for i := range expected {
+		if instructions[i] != expected[i] {
+			t.Errorf("Expected %#v, got %#v", expected[i], instructions[i])
+		}
+	}
+
+	for _, dockerfile := range []string{
+		"",
+		"# Only a comment",
+		"RUN true",
+		"FROM base\nFOO bar",
+		"FROM base\nRUN",
+		"FROM base\nRUN true \\",
+	} {
+		if _, err := parseDockerfile(strings.NewReader(dockerfile)); err == nil {
+			t.Errorf("%q should be invalid", dockerfile)
+		}
+	}
+}
+
+func TestParseInstruction(t *testing.T) {
+	inst, err := parseInstruction("run   echo hello ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.cmd != "RUN" || inst.args != "echo hello" {
+		t.Errorf("Unexpected instruction: %#v", inst)
+	}
+	for _, s := range []string{"", "FOO bar", "RUN", "ONBUILD  "} {
+		if _, err := parseInstruction(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	if cmd, err := parseCommand(`["/bin/ls", "-l"]`); err != nil || len(cmd) != 2 || cmd[1] != "-l" {
+		t.Errorf("Unexpected command: %v (%v)", cmd, err)
+	}
+	if cmd, err := parseCommand("ls -l"); err != nil || len(cmd) != 3 || cmd[0] != "/bin/sh" || cmd[2] != "ls -l" {
+		t.Errorf("Unexpected command: %v (%v)", cmd, err)
+	}
+	if _, err := parseCommand(`["/bin/ls"`); err == nil {
+		t.Errorf("An invalid JSON array should be refused")
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	words, err := splitWords(`a=1  b="two words"	c="" "d=x y"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(words, "|") != "a=1|b=two words|c=|d=x y" || len(words) != 4 {
+		t.Errorf("Unexpected words: %q", words)
+	}
+	if _, err := splitWords(`a="1`); err == nil {
+		t.Errorf("An unterminated quote should be refused")
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	lookup := func(name string) string {
+		return map[string]string{"A": "1", "B_2": "two"}[name]
+	}
+	for s, expected := range map[string]string{
+		"$A":             "1",
+		"${A}x":          "1x",
+		"$Ax":            "",
+		"/$B_2/$C/":      "/two//",
+		`\$A`:            "$A",
+		"$ and ${":       "$ and ${",
+		"no variables":   "no variables",
+		"${A}${B_2}-$A$": "1two-1$",
+	} {
+		if expanded := expandVariables(s, lookup); expanded != expected {
+			t.Errorf("Expected %q to expand to %q, got %q", s, expected, expanded)
+		}
+	}
+}
+
+func TestParseBuildArgs(t *testing.T) {
+	buildArgs, err := ParseBuildArgs([]string{"A=1", "B=", "C=x=y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buildArgs) != 3 || buildArgs["A"] != "1" || buildArgs["B"] != "" || buildArgs["C"] != "x=y" {
+		t.Errorf("Unexpected build args: %v", buildArgs)
+	}
+	for _, pair := range []string{"A", "=1"} {
+		if _, err := ParseBuildArgs([]string{pair}); err == nil {
+			t.Errorf("%q should be invalid", pair)
+		}
+	}
+}
+
+func TestReadBuildArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-build-args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first, second := path.Join(dir, "first"), path.Join(dir, "second")
+	if err := ioutil.WriteFile(first, []byte("# versions\nA=1\nB=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(second, []byte("B=2\nC=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The later files, then the pairs, override the earlier values
+	buildArgs, err := ReadBuildArgs([]string{first, second}, []string{"C=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buildArgs) != 3 || buildArgs["A"] != "1" || buildArgs["B"] != "2" || buildArgs["C"] != "3" {
+		t.Errorf("Unexpected build args: %v", buildArgs)
+	}
+	if _, err := ReadBuildArgs([]string{path.Join(dir, "missing")}, nil); err == nil {
+		t.Errorf("A missing build arg file should fail")
+	}
+}
+
+func TestStageImage(t *testing.T) {
+	b := &Builder{
+		stages:     []string{"a", "b"},
+		stageNames: map[string]int{"build": 0, "final": 2},
+	}
+	for name, expected := range map[string]string{"build": "a", "BUILD": "a", "0": "a", "1": "b"} {
+		if id, err := b.stageImage(name); err != nil || id != expected {
+			t.Errorf("Expected stage %s to be %s, got %s (%v)", name, expected, id, err)
+		}
+	}
+	for _, name := range []string{"final", "2", "-1"} {
+		if _, err := b.stageImage(name); err == nil {
+			t.Errorf("Stage %s should be invalid", name)
+		}
+	}
+}
+
+func TestCancelBuild(t *testing.T) {
+	srv := &Server{}
+	if err := srv.CancelBuild("foo"); err == nil {
+		t.Errorf("Cancelling an unknown build should fail")
+	}
+	b := NewBuilder(srv, ioutil.Discard, "", true, true, false, nil)
+	srv.builds = map[string]*Builder{b.Id: b}
+	if err := srv.CancelBuild(b.Id); err != nil {
+		t.Fatal(err)
+	}
+	// Cancelling twice is harmless
+	b.Cancel()
+	if _, err := b.Build(strings.NewReader("FROM base")); err != ErrBuildCancelled {
+		t.Errorf("Expected the build to be cancelled, got %v", err)
+	}
+}
+
+func TestSourcePath(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-build-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Symlink("/etc", path.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	// The links lead into the context, not to the files of the host
+	for src, expected := range map[string]string{
+		"file":         path.Join(root, "file"),
+		"link/passwd":  path.Join(root, "etc", "passwd"),
+		"/link/passwd": path.Join(root, "etc", "passwd"),
+		".":            root,
+	} {
+		if srcPath, err := sourcePath(root, src); err != nil || srcPath != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", src, expected, srcPath, err)
+		}
+	}
+	if _, err := sourcePath(root, "../passwd"); err == nil {
+		t.Errorf("A path outside of the context should be forbidden")
+	}
+}
+
+func TestDestinationPath(t *testing.T) {
+	rootfs, err := ioutil.TempDir("", "docker-build-rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootfs)
+	if err := os.Symlink("/etc", path.Join(rootfs, "app")); err != nil {
+		t.Fatal(err)
+	}
+	b := &Builder{config: &Config{WorkingDir: "/srv"}}
+	for _, test := range []struct {
+		dest, name string
+		srcIsDir   bool
+		expected   string
+		destIsDir  bool
+	}{
+		// The links of the image stay in its rootfs
+		{"/app/", "passwd", false, path.Join(rootfs, "etc", "passwd"), false},
+		{"/app/conf", "conf", true, path.Join(rootfs, "etc", "conf"), false},
+		{"data/", "dir", true, path.Join(rootfs, "srv", "data"), true},
+		{"../../app/x", "x", false, path.Join(rootfs, "etc", "x"), false},
+	} {
+		destPath, destIsDir, err := b.destinationPath(rootfs, test.dest, test.name, test.srcIsDir)
+		if err != nil || destPath != test.expected || destIsDir != test.destIsDir {
+			t.Errorf("%s: expected %s %v, got %s %v (%v)", test.dest, test.expected, test.destIsDir, destPath, destIsDir, err)
+		}
+	}
+}
+
+func TestHashPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-hash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "a"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash1, err := hashPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := hashPath(dir); err != nil || hash != hash1 {
+		t.Errorf("The checksum should be stable, got %s and %s (%v)", hash1, hash, err)
+	}
+	if err := os.Chmod(path.Join(dir, "a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := hashPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash2 == hash1 {
+		t.Errorf("The checksum should depend on the modes of the files")
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "a"), []byte("b"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if hash, err := hashPath(dir); err != nil || hash == hash2 {
+		t.Errorf("The checksum should depend on the content of the files")
+	}
+}
+
+func TestBuildContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, file := range []string{"Dockerfile", "a.txt", "b.log", "sub/c.log", "tmp/d.txt"} {
+		if err := os.MkdirAll(path.Join(dir, path.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(dir, ".dockerignore"), []byte("# Comment\n*.log\n/tmp\nDockerfile\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	context, err := BuildContext(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(context)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, " ") != ".dockerignore Dockerfile a.txt sub/ sub/c.log" {
+		t.Errorf("Unexpected content of the build context: %v", names)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, ".dockerignore"), []byte("[\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildContext(dir); err == nil {
+		t.Errorf("An invalid pattern should be refused")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	context, err := ioutil.TempDir("", "docker-build-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(context)
+	if err := ioutil.WriteFile(path.Join(context, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dockerfile := `
+FROM ` + GetTestImage(runtime).Id + `
+ENV GREETING hello world
+WORKDIR /srv
+ADD hello.txt ./
+RUN test "$(cat /srv/hello.txt)" = hello
+EXPOSE 80
+LABEL maintainer="The Docker Team" version=1
+STOPSIGNAL SIGQUIT
+CMD ["cat", "hello.txt"]
+`
+	var out bytes.Buffer
+	img, err := NewBuilder(srv, &out, context, true, true, false, nil).Build(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	if img.Config == nil {
+		t.Fatalf("The built image has no config")
+	}
+	if img.Config.WorkingDir != "/srv" || len(img.Config.Ports) != 1 || img.Config.Ports[0] != 80 || img.Config.StopSignal != "SIGQUIT" {
+		t.Errorf("Unexpected config: %#v", img.Config)
+	}
+	if len(img.Config.Env) != 1 || img.Config.Env[0] != "GREETING=hello world" {
+		t.Errorf("Unexpected environment: %v", img.Config.Env)
+	}
+	if len(img.Config.Labels) != 2 || img.Config.Labels["maintainer"] != "The Docker Team" || img.Config.Labels["version"] != "1" {
+		t.Errorf("Unexpected labels: %v", img.Config.Labels)
+	}
+
+	// The config of the image is the default of its containers
+	container, err := runtime.Create(&Config{Image: img.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "hello\n" {
+		t.Errorf("Expected hello, got %q", output)
+	}
+
+	// Building again uses the cache, unless the content of an ADD changed
+	out.Reset()
+	if cached, err := NewBuilder(srv, &out, context, true, true, false, nil).Build(strings.NewReader(dockerfile)); err != nil {
+		t.Fatal(err)
+	} else if cached.Id != img.Id {
+		t.Errorf("Expected the cached image %s, got %s", img.Id, cached.Id)
+	}
+	if strings.Contains(out.String(), "Running in") {
+		t.Errorf("Nothing should run when the cache is used:\n%s", out.String())
+	}
+	if uncached, err := NewBuilder(srv, &out, context, false, true, false, nil).Build(strings.NewReader(dockerfile)); err != nil {
+		t.Fatal(err)
+	} else if uncached.Id == img.Id {
+		t.Errorf("The cache should not be used when it is disabled")
+	}
+	if err := ioutil.WriteFile(path.Join(context, "hello.txt"), []byte("bye\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBuilder(srv, &out, context, true, true, false, nil).Build(strings.NewReader(dockerfile)); err == nil {
+		t.Errorf("The cache should not be used for a modified file, which fails the RUN test")
+	}
+
+	// A failing RUN fails the build
+	if _, err := NewBuilder(srv, &out, "", true, true, false, nil).Build(strings.NewReader("FROM " + img.Id + "\nRUN false")); err == nil {
+		t.Errorf("A failing RUN instruction should fail the build")
+	}
+}
+
+func TestBuildArgs(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	dockerfile := `
+FROM ` + GetTestImage(runtime).Id + `
+ARG VERSION=1
+ARG UNSET
+RUN test "$VERSION" = 2
+ENV DIR /opt/$VERSION
+WORKDIR ${DIR}/\$UNSET
+`
+	var out bytes.Buffer
+	img, err := NewBuilder(srv, &out, "", true, true, false, map[string]string{"VERSION": "2", "OTHER": "x"}).Build(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	if img.Config.WorkingDir != "/opt/2/$UNSET" {
+		t.Errorf("Unexpected working directory: %s", img.Config.WorkingDir)
+	}
+	if len(img.Config.Env) != 1 || img.Config.Env[0] != "DIR=/opt/2" {
+		t.Errorf("The build args should not be in the environment of the image, got %v", img.Config.Env)
+	}
+	if !strings.Contains(out.String(), "Build args OTHER were not consumed") {
+		t.Errorf("Expected a warning about the unused build arg, got:\n%s", out.String())
+	}
+}
+
+func TestBuildMultiStage(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	base := GetTestImage(runtime).Id
+	dockerfile := `
+FROM ` + base + ` AS build
+RUN echo artifact > /artifact
+ENV STAGE build
+FROM ` + base + `
+COPY --from=build /artifact /srv/
+COPY --from=0 /artifact /srv/copy
+RUN test "$(cat /srv/artifact)" = artifact && test -f /srv/copy
+`
+	var out bytes.Buffer
+	img, err := NewBuilder(srv, &out, "", true, true, false, nil).Build(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	if img.Config != nil && len(img.Config.Env) != 0 {
+		t.Errorf("The config of the previous stage should not be kept, got %v", img.Config.Env)
+	}
+
+	for _, dockerfile := range []string{
+		"FROM " + base + " AS a\nFROM " + base + " AS a",
+		"FROM " + base + " AS a\nCOPY --from=a /etc/hostname /",
+		"FROM " + base + "\nCOPY --from=1 /etc/hostname /",
+		"FROM " + base + " AS",
+	} {
+		if _, err := NewBuilder(srv, &out, "", true, true, false, nil).Build(strings.NewReader(dockerfile)); err == nil {
+			t.Errorf("%q should fail", dockerfile)
+		}
+	}
+}
+
+func TestBuildOnBuild(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	var out bytes.Buffer
+	parent, err := NewBuilder(srv, &out, "", true, true, false, nil).Build(strings.NewReader(`
+FROM ` + GetTestImage(runtime).Id + `
+ONBUILD RUN touch /triggered
+onbuild env TRIGGERED yes
+`))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	if len(parent.Config.OnBuild) != 2 || parent.Config.OnBuild[1] != "ENV TRIGGERED yes" {
+		t.Fatalf("Unexpected triggers: %v", parent.Config.OnBuild)
+	}
+
+	child, err := NewBuilder(srv, &out, "", true, true, false, nil).Build(strings.NewReader("FROM " + parent.Id + "\nRUN test -f /triggered"))
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	if len(child.Config.OnBuild) != 0 {
+		t.Errorf("The triggers should not be inherited, got %v", child.Config.OnBuild)
+	}
+	if len(child.Config.Env) != 1 || child.Config.Env[0] != "TRIGGERED=yes" {
+		t.Errorf("Unexpected environment: %v", child.Config.Env)
+	}
+
+	for _, trigger := range []string{"ONBUILD ONBUILD RUN true", "ONBUILD FROM base", "ONBUILD FOO bar"} {
+		dockerfile := "FROM " + parent.Id + "\n" + trigger
+		if _, err := NewBuilder(srv, &out, "", true, true, false, nil).Build(strings.NewReader(dockerfile)); err == nil {
+			t.Errorf("%q should be refused", trigger)
+		}
+	}
+}
+
+// signalWriter closes signal when something containing pattern is written
+type signalWriter struct {
+	bytes.Buffer
+	pattern string
+	signal  chan struct{}
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	if w.signal != nil && strings.Contains(w.Buffer.String(), w.pattern) {
+		close(w.signal)
+		w.signal = nil
+	}
+	return n, err
+}
+
+func TestBuildCancelAndRm(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+	base := GetTestImage(runtime).Id
+	countImages := func() int {
+		images, err := runtime.graph.All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(images)
+	}
+
+	// Cancelling removes the intermediate containers and images
+	nImages := countImages()
+	out := &signalWriter{pattern: "Running in", signal: make(chan struct{})}
+	started := out.signal
+	b := NewBuilder(srv, out, "", false, false, false, nil)
+	done := make(chan error)
+	go func() {
+		_, err := srv.Build(b, strings.NewReader("FROM "+base+"\nENV A 1\nRUN sleep 10"), "")
+		done <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The build didn't start:\n%s", out.String())
+	}
+	if err := srv.CancelBuild(b.Id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != ErrBuildCancelled {
+			t.Errorf("Expected the build to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The build wasn't cancelled")
+	}
+	if n := len(runtime.List()); n != 0 {
+		t.Errorf("Expected the intermediate containers to be removed, found %d", n)
+	}
+	if n := countImages(); n != nImages {
+		t.Errorf("Expected the intermediate images to be removed, found %d images instead of %d", n, nImages)
+	}
+
+	// The containers of a failed build are kept, unless forceRm is set
+	var buf bytes.Buffer
+	if _, err := NewBuilder(srv, &buf, "", false, true, false, nil).Build(strings.NewReader("FROM " + base + "\nRUN false")); err == nil {
+		t.Fatalf("The build should fail")
+	}
+	if n := len(runtime.List()); n != 1 {
+		t.Errorf("Expected the failed container to be kept, found %d containers", n)
+	}
+	for _, container := range runtime.List() {
+		runtime.Destroy(container)
+	}
+	if _, err := NewBuilder(srv, &buf, "", false, true, true, nil).Build(strings.NewReader("FROM " + base + "\nRUN false")); err == nil {
+		t.Fatalf("The build should fail")
+	}
+	if n := len(runtime.List()); n != 0 {
+		t.Errorf("Expected the containers to be removed, found %d", n)
+	}
+
+	// Without rm, the containers of a successful build are kept
+	if _, err := NewBuilder(srv, &buf, "", false, false, false, nil).Build(strings.NewReader("FROM " + base + "\nRUN true")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(runtime.List()); n != 1 {
+		t.Errorf("Expected the container to be kept, found %d containers", n)
+	}
+}
@@ -0,0 +1,132 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The capabilities of linux, by number
+var capabilityNames = []string{
+	"chown",
+	"dac_override",
+	"dac_read_search",
+	"fowner",
+	"fsetid",
+	"kill",
+	"setgid",
+	"setuid",
+	"setpcap",
+	"linux_immutable",
+	"net_bind_service",
+	"net_broadcast",
+	"net_admin",
+	"net_raw",
+	"ipc_lock",
+	"ipc_owner",
+	"sys_module",
+	"sys_rawio",
+	"sys_chroot",
+	"sys_ptrace",
+	"sys_pacct",
+	"sys_admin",
+	"sys_boot",
+	"sys_nice",
+	"sys_resource",
+	"sys_time",
+	"sys_tty_config",
+	"mknod",
+	"lease",
+	"audit_write",
+	"audit_control",
+	"setfcap",
+	"mac_override",
+	"mac_admin",
+	"syslog",
+	"wake_alarm",
+	"block_suspend",
+	"audit_read",
+}
+
+// The capabilities of the containers unless they add or drop some: enough
+// for the usual daemons to drop privileges and bind low ports, but not to
+// administrate the host
+var defaultCapabilities = []string{
+	"audit_write",
+	"chown",
+	"dac_override",
+	"fowner",
+	"fsetid",
+	"kill",
+	"mknod",
+	"net_bind_service",
+	"net_raw",
+	"setfcap",
+	"setgid",
+	"setpcap",
+	"setuid",
+	"sys_chroot",
+}
+
+// parseCapability returns the name of a capability given with or without
+// the CAP_ prefix, in any case, eg. NET_ADMIN or cap_net_admin. ALL is
+// returned as "all".
+func parseCapability(name string) (string, error) {
+	capability := strings.TrimPrefix(strings.ToLower(name), "cap_")
+	if capability == "all" {
+		return capability, nil
+	}
+	for _, known := range capabilityNames {
+		if capability == known {
+			return capability, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown capability: %s", name)
+}
+
+// containerCapabilities returns the capabilities of a container: the
+// default ones, or all of them with ALL in add, or none with ALL in drop,
+// then plus the ones of add and minus the ones of drop
+func containerCapabilities(add, drop []string) ([]string, error) {
+	capabilities := make(map[string]bool)
+	for _, capability := range defaultCapabilities {
+		capabilities[capability] = true
+	}
+	var added, dropped []string
+	for _, name := range add {
+		capability, err := parseCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		if capability == "all" {
+			for _, capability := range capabilityNames {
+				capabilities[capability] = true
+			}
+		} else {
+			added = append(added, capability)
+		}
+	}
+	for _, name := range drop {
+		capability, err := parseCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		if capability == "all" {
+			capabilities = make(map[string]bool)
+		} else {
+			dropped = append(dropped, capability)
+		}
+	}
+	for _, capability := range added {
+		capabilities[capability] = true
+	}
+	for _, capability := range dropped {
+		delete(capabilities, capability)
+	}
+	var result []string
+	for capability := range capabilities {
+		result = append(result, capability)
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -0,0 +1,33 @@
+package docker
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const PR_CAPBSET_DROP = 24
+
+// dropCapabilities removes the capabilities which aren't in keep from the
+// bounding set of the process, so that the programs it executes can't get
+// them. It needs setpcap, which stays effective once it's dropped from the
+// bounding set.
+func dropCapabilities(keep []string) error {
+	kept := make(map[string]bool)
+	for _, capability := range keep {
+		kept[capability] = true
+	}
+	// The kernel may know capabilities which aren't named yet
+	for capability := 0; capability < 64; capability++ {
+		if capability < len(capabilityNames) && kept[capabilityNames[capability]] {
+			continue
+		}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_CAPBSET_DROP, uintptr(capability), 0)
+		if errno == syscall.EINVAL {
+			// Beyond the last capability of the kernel
+			break
+		} else if errno != 0 {
+			return fmt.Errorf("Unable to drop capability %d: %s", capability, errno)
+		}
+	}
+	return nil
+}
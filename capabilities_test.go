@@ -0,0 +1,62 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContainerCapabilities(t *testing.T) {
+	for _, test := range []struct {
+		add, drop []string
+		expected  string
+	}{
+		{nil, nil, strings.Join(defaultCapabilities, ",")},
+		{[]string{"NET_ADMIN"}, []string{"cap_mknod", "Setfcap"}, "audit_write,chown,dac_override,fowner,fsetid,kill,net_admin,net_bind_service,net_raw,setgid,setpcap,setuid,sys_chroot"},
+		{nil, []string{"ALL"}, ""},
+		{[]string{"net_bind_service"}, []string{"all"}, "net_bind_service"},
+		{[]string{"sys_admin"}, []string{"sys_admin"}, strings.Join(defaultCapabilities, ",")},
+	} {
+		capabilities, err := containerCapabilities(test.add, test.drop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(capabilities, ",") != test.expected {
+			t.Errorf("%v %v: expected %s, got %v", test.add, test.drop, test.expected, capabilities)
+		}
+	}
+	if capabilities, err := containerCapabilities([]string{"ALL"}, []string{"mknod"}); err != nil || len(capabilities) != len(capabilityNames)-1 {
+		t.Errorf("Expected all the capabilities but mknod, got %v (%v)", capabilities, err)
+	}
+	for _, add := range []string{"", "CAP_", "net_admn"} {
+		if _, err := containerCapabilities([]string{add}, nil); err == nil {
+			t.Errorf("%q should be invalid", add)
+		}
+	}
+}
+
+func TestDropCapabilities(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	container, err := runtime.Create(&Config{
+		Image:   GetTestImage(runtime).Id,
+		Cmd:     []string{"sh", "-c", "grep CapBnd /proc/self/status"},
+		CapDrop: []string{"ALL"},
+		CapAdd:  []string{"kill"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kill is capability 5
+	if strings.TrimSpace(string(output)) != "CapBnd:\t0000000000000020" {
+		t.Errorf("Unexpected bounding set: %q", output)
+	}
+}
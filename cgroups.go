@@ -0,0 +1,257 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// On a host booted with cgroup v2, the unified hierarchy mounted on
+// /sys/fs/cgroup, the limits of the containers are set with the files of
+// the unified controllers instead of the v1 ones:
+//
+//	memory.limit_in_bytes        memory.max
+//	memory.soft_limit_in_bytes   memory.low
+//	memory.memsw.limit_in_bytes  memory.swap.max, the swap alone
+//	cpu.shares                   cpu.weight, from [2, 262144] to [1, 10000]
+//	cpu.cfs_quota_us             cpu.max, "QUOTA PERIOD"
+//
+// The devices controller is replaced by an eBPF program, which lxc sets up
+// from the same rules.
+
+const UNIFIED_CGROUP_MOUNTPOINT = "/sys/fs/cgroup"
+
+// cgroupUnified returns whether the host uses the unified hierarchy of
+// cgroup v2, according to /proc/mounts
+func cgroupUnified() bool {
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	return unifiedInMounts(string(data))
+}
+
+// unifiedInMounts returns whether cgroup2 is mounted on
+// UNIFIED_CGROUP_MOUNTPOINT in mounts, the content of /proc/mounts. The
+// hybrid hosts mount it on a subdirectory and keep the v1 controllers.
+func unifiedInMounts(mounts string) bool {
+	for _, line := range strings.Split(mounts, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == UNIFIED_CGROUP_MOUNTPOINT && fields[2] == "cgroup2" {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroupVersion returns the version of cgroups of the host, 1 or 2
+func cgroupVersion() int {
+	if cgroupUnified() {
+		return 2
+	}
+	return 1
+}
+
+// cpuWeight converts cpu.shares to cpu.weight
+func cpuWeight(shares int64) int64 {
+	if shares < 2 {
+		shares = 2
+	} else if shares > 262144 {
+		shares = 262144
+	}
+	return 1 + (shares-2)*9999/262142
+}
+
+// cgroupLimit is the value of a file of a cgroup
+type cgroupLimit struct {
+	File  string // eg. memory.max
+	Value string
+}
+
+// cgroupLimits returns the files of the cgroups of a container with config
+// limiting its resources, in the hierarchy of version. On cgroup v2, the
+// swap is only limited if swap is true, since memory.swap.max is missing
+// without swap accounting.
+func cgroupLimits(config *Config, version int, swap bool) []cgroupLimit {
+	var limits []cgroupLimit
+	add := func(file string, value interface{}) {
+		limits = append(limits, cgroupLimit{file, fmt.Sprint(value)})
+	}
+	if config.Memory != 0 {
+		memSwap := getMemorySwap(config)
+		if version == 2 {
+			add("memory.max", config.Memory)
+			add("memory.low", config.Memory)
+			if memSwap != 0 && swap {
+				add("memory.swap.max", memSwap-config.Memory)
+			}
+		} else {
+			add("memory.limit_in_bytes", config.Memory)
+			add("memory.soft_limit_in_bytes", config.Memory)
+			if memSwap != 0 {
+				add("memory.memsw.limit_in_bytes", memSwap)
+			}
+		}
+	}
+	if config.CpuShares != 0 {
+		if version == 2 {
+			add("cpu.weight", cpuWeight(config.CpuShares))
+		} else {
+			add("cpu.shares", config.CpuShares)
+		}
+	}
+	if config.CpuQuota != 0 {
+		if version == 2 {
+			add("cpu.max", fmt.Sprintf("%d %d", config.CpuQuota, cpuPeriod))
+		} else {
+			add("cpu.cfs_period_us", cpuPeriod)
+			add("cpu.cfs_quota_us", config.CpuQuota)
+		}
+	}
+	return limits
+}
+
+// Cgroups returns whether the daemon sets the cgroups of the container,
+// which it can't in rootless mode, see rootless.go
+func (container *Container) Cgroups() bool {
+	return container.runtime == nil || !container.runtime.config.Rootless
+}
+
+// CgroupLimits returns the cgroup limits of the container for lxc
+func (container *Container) CgroupLimits() []cgroupLimit {
+	if !container.Cgroups() {
+		return nil
+	}
+	if cgroupUnified() {
+		_, swap := unifiedMemoryLimitSupport()
+		return cgroupLimits(container.Config, 2, swap)
+	}
+	return cgroupLimits(container.Config, 1, true)
+}
+
+// CgroupPrefix returns the prefix of the cgroup keys of the lxc config
+func (container *Container) CgroupPrefix() string {
+	if cgroupUnified() {
+		return "lxc.cgroup2"
+	}
+	return "lxc.cgroup"
+}
+
+// unifiedCgroupPath returns the directory of the cgroup of the process pid
+// in the unified hierarchy
+func unifiedCgroupPath(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// 0::/PATH is the cgroup of the unified hierarchy
+		if strings.HasPrefix(line, "0::") {
+			return path.Join(UNIFIED_CGROUP_MOUNTPOINT, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("Process %d has no cgroup v2", pid)
+}
+
+// unifiedMemoryLimitSupport is memoryLimitSupport on cgroup v2: the memory
+// controller is available, and the swap is accounted if the cgroup of the
+// daemon has memory.swap.max
+func unifiedMemoryLimitSupport() (memory, swap bool) {
+	data, err := ioutil.ReadFile(path.Join(UNIFIED_CGROUP_MOUNTPOINT, "cgroup.controllers"))
+	if err != nil {
+		return false, false
+	}
+	for _, controller := range strings.Fields(string(data)) {
+		memory = memory || controller == "memory"
+	}
+	if !memory {
+		return false, false
+	}
+	if dir, err := unifiedCgroupPath(os.Getpid()); err == nil {
+		_, err = os.Stat(path.Join(dir, "memory.swap.max"))
+		swap = err == nil
+	}
+	return memory, swap
+}
+
+// unifiedCgroupDir returns the cgroup created by lxc for the container in
+// the unified hierarchy: lxc.payload.ID, below or next to the cgroup of
+// lxc-start, or lxc/ID with the older versions of lxc, below the systemd
+// scope of the container if any
+func (container *Container) unifiedCgroupDir() (string, error) {
+	payload := "lxc.payload." + container.Id
+	var candidates []string
+	if dir, err := unifiedCgroupPath(container.State.Pid); err == nil {
+		candidates = append(candidates, path.Join(dir, payload), path.Join(path.Dir(dir), payload))
+	}
+	parent := path.Join(UNIFIED_CGROUP_MOUNTPOINT, container.cgroupParent())
+	candidates = append(candidates, path.Join(parent, payload), path.Join(parent, "lxc", container.Id))
+	for _, dir := range candidates {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("The cgroup of container %s wasn't found", container.Id)
+}
+
+// How often the OOM kills of the running containers are checked
+var oomCheckInterval = time.Second
+
+// parseOOMKills returns the oom_kill counter of memory.events on cgroup v2,
+// or of memory.oom_control on v1
+func parseOOMKills(data string) (int, error) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, fmt.Errorf("No oom_kill counter")
+}
+
+// oomKills returns the number of processes of the running container which
+// the OOM killer killed
+func (container *Container) oomKills() (int, error) {
+	version := cgroupVersion()
+	file := "memory.oom_control"
+	if version == 2 {
+		file = "memory.events"
+	}
+	p, err := container.cgroupFile(version, file)
+	if err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return 0, err
+	}
+	return parseOOMKills(string(data))
+}
+
+// watchOOM logs an oom event each time the OOM killer kills processes of
+// the container, until stopped is closed. The cgroup is only found once
+// lxc created it, and is usually removed with the container, so that a
+// kill which stops the container right away may be missed: its die event
+// then has the exit code 137.
+func (container *Container) watchOOM(stopped <-chan struct{}) {
+	ticker := time.NewTicker(oomCheckInterval)
+	defer ticker.Stop()
+	kills := -1
+	for {
+		if n, err := container.oomKills(); err == nil {
+			if kills >= 0 && n > kills {
+				container.runtime.events.Log("oom", container.Id, container.Image, map[string]string{"kills": strconv.Itoa(n - kills)})
+			}
+			kills = n
+		}
+		select {
+		case <-stopped:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnifiedInMounts(t *testing.T) {
+	unified := "sysfs /sys sysfs rw 0 0\ncgroup2 /sys/fs/cgroup cgroup2 rw,nosuid,nodev,noexec 0 0\n"
+	hybrid := "tmpfs /sys/fs/cgroup tmpfs ro 0 0\ncgroup2 /sys/fs/cgroup/unified cgroup2 rw 0 0\ncgroup /sys/fs/cgroup/memory cgroup rw,memory 0 0\n"
+	legacy := "tmpfs /sys/fs/cgroup tmpfs ro 0 0\ncgroup /sys/fs/cgroup/cpu cgroup rw,cpu 0 0\n"
+	if !unifiedInMounts(unified) {
+		t.Errorf("cgroup2 on %s should be unified", UNIFIED_CGROUP_MOUNTPOINT)
+	}
+	if unifiedInMounts(hybrid) || unifiedInMounts(legacy) {
+		t.Errorf("The hybrid and v1 hosts shouldn't be unified")
+	}
+}
+
+func TestCpuWeight(t *testing.T) {
+	for shares, weight := range map[int64]int64{0: 1, 2: 1, 1024: 39, 262144: 10000, 1000000: 10000} {
+		if w := cpuWeight(shares); w != weight {
+			t.Errorf("Expected weight %d for %d shares, got %d", weight, shares, w)
+		}
+	}
+}
+
+func TestCgroupLimits(t *testing.T) {
+	config := &Config{Memory: 33554432, MemorySwap: 67108864, CpuShares: 512, CpuQuota: 50000}
+
+	expected := []cgroupLimit{
+		{"memory.limit_in_bytes", "33554432"},
+		{"memory.soft_limit_in_bytes", "33554432"},
+		{"memory.memsw.limit_in_bytes", "67108864"},
+		{"cpu.shares", "512"},
+		{"cpu.cfs_period_us", "100000"},
+		{"cpu.cfs_quota_us", "50000"},
+	}
+	if limits := cgroupLimits(config, 1, true); !reflect.DeepEqual(limits, expected) {
+		t.Errorf("Unexpected v1 limits: %v", limits)
+	}
+
+	expected = []cgroupLimit{
+		{"memory.max", "33554432"},
+		{"memory.low", "33554432"},
+		{"memory.swap.max", "33554432"},
+		{"cpu.weight", "20"},
+		{"cpu.max", "50000 100000"},
+	}
+	if limits := cgroupLimits(config, 2, true); !reflect.DeepEqual(limits, expected) {
+		t.Errorf("Unexpected v2 limits: %v", limits)
+	}
+	// Without swap accounting, memory.swap.max is missing
+	expected = append(expected[:2], expected[3:]...)
+	if limits := cgroupLimits(config, 2, false); !reflect.DeepEqual(limits, expected) {
+		t.Errorf("Unexpected v2 limits without swap: %v", limits)
+	}
+
+	if limits := cgroupLimits(&Config{}, 2, true); len(limits) != 0 {
+		t.Errorf("No limits expected, got %v", limits)
+	}
+}
+
+func TestParseOOMKills(t *testing.T) {
+	v1 := "oom_kill_disable 0\nunder_oom 0\noom_kill 3\n"
+	v2 := "low 0\nhigh 0\nmax 12\noom 2\noom_kill 2\noom_group_kill 0\n"
+	if kills, err := parseOOMKills(v1); err != nil || kills != 3 {
+		t.Errorf("Expected 3 kills on v1, got %d (%v)", kills, err)
+	}
+	if kills, err := parseOOMKills(v2); err != nil || kills != 2 {
+		t.Errorf("Expected 2 kills on v2, got %d (%v)", kills, err)
+	}
+	// The kernels before 4.13 don't count the kills
+	if _, err := parseOOMKills("oom_kill_disable 0\nunder_oom 0\n"); err == nil {
+		t.Errorf("Expected an error without oom_kill")
+	}
+}
@@ -0,0 +1,229 @@
+package docker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Checkpoints are dumps of the processes of a running container, made by
+// CRIU through lxc-checkpoint. They are stored in the checkpoints directory
+// of the container, or in a directory given by the operator, eg. to restore
+// them on another host once the container was exported and imported there.
+// The directories given must be in the checkpoints directory of the daemon,
+// ROOT/checkpoints, where a shared filesystem can be mounted: the daemon
+// removes the checkpoints it is asked to, and doesn't touch the files out of
+// its root.
+// Checkpoints are experimental: the daemon must run with -experimental.
+
+var errCheckpointsDisabled = errors.New("Checkpoints are experimental: start the daemon with -experimental")
+
+var validCheckpointName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Checkpoint is the metadata saved next to the images dumped by CRIU
+type Checkpoint struct {
+	Name            string
+	Created         time.Time
+	NetworkSettings *NetworkSettings // The address and the ports, reclaimed on restore
+}
+
+func checkpointMetadataPath(dir string) string {
+	return path.Join(dir, "checkpoint.json")
+}
+
+// checkpointsDir returns the directory of the checkpoints: dir, with its
+// symbolic links resolved, if it is set, or the checkpoints directory of the
+// container.
+func (container *Container) checkpointsDir(dir string) (string, error) {
+	if dir == "" {
+		return path.Join(container.root, "checkpoints"), nil
+	}
+	root := path.Join(container.runtime.root, "checkpoints")
+	resolved, err := FollowSymlinkInScope(dir, root)
+	if err != nil {
+		return "", fmt.Errorf("Invalid checkpoint directory %s: it must be in %s", dir, root)
+	}
+	return resolved, nil
+}
+
+// checkpointDir returns the directory of the checkpoint name, in the
+// directory of the checkpoints given by dir, see checkpointsDir
+func (container *Container) checkpointDir(name, dir string) (string, error) {
+	if !validCheckpointName.MatchString(name) {
+		return "", fmt.Errorf("Invalid checkpoint name: %s", name)
+	}
+	dir, err := container.checkpointsDir(dir)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, name), nil
+}
+
+// Checkpoint dumps the processes of the running container to the checkpoint
+// name. The container is stopped unless leaveRunning is set.
+func (container *Container) Checkpoint(name, dir string, leaveRunning bool) error {
+	if !container.runtime.config.Experimental {
+		return errCheckpointsDisabled
+	}
+	dir, err := container.checkpointDir(name, dir)
+	if err != nil {
+		return err
+	}
+	if !container.State.Running {
+		return fmt.Errorf("Container %s is not running", container.Id)
+	}
+	if container.Shim {
+		return fmt.Errorf("Containers started with live-restore can't be checkpointed")
+	}
+	if !leaveRunning && container.Config.AutoRemove {
+		return fmt.Errorf("Containers removed when they exit can't be checkpointed and stopped")
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("Checkpoint %s already exists", name)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	settings := *container.NetworkSettings
+	data, err := json.Marshal(&Checkpoint{Name: name, Created: time.Now(), NetworkSettings: &settings})
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := ioutil.WriteFile(checkpointMetadataPath(dir), data, 0600); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	args := []string{"-n", container.Id, "-D", dir}
+	if !leaveRunning {
+		// Keep the restart policy from starting the container again
+		container.stopRequested = true
+		args = append(args, "-s")
+	}
+	if output, err := exec.Command("lxc-checkpoint", args...).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("Failed to checkpoint %s: %s", container.Id, output)
+	}
+	if !leaveRunning {
+		container.Wait()
+	}
+	container.runtime.events.Log("checkpoint", container.Id, container.Image, map[string]string{"name": name})
+	return nil
+}
+
+// Checkpoints returns the checkpoints of the container in dir, or in the
+// checkpoints directory of the container, sorted by name.
+func (container *Container) Checkpoints(dir string) ([]*Checkpoint, error) {
+	if !container.runtime.config.Experimental {
+		return nil, errCheckpointsDisabled
+	}
+	dir, err := container.checkpointsDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var checkpoints []*Checkpoint
+	for _, entry := range entries {
+		checkpoint, err := loadCheckpoint(path.Join(dir, entry.Name()))
+		if err != nil {
+			// Not a checkpoint
+			continue
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Sort(checkpointsByName(checkpoints))
+	return checkpoints, nil
+}
+
+func loadCheckpoint(dir string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(checkpointMetadataPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+type checkpointsByName []*Checkpoint
+
+func (c checkpointsByName) Len() int           { return len(c) }
+func (c checkpointsByName) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c checkpointsByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// RemoveCheckpoint deletes the checkpoint name of the container
+func (container *Container) RemoveCheckpoint(name, dir string) error {
+	if !container.runtime.config.Experimental {
+		return errCheckpointsDisabled
+	}
+	dir, err := container.checkpointDir(name, dir)
+	if err != nil {
+		return err
+	}
+	if _, err := loadCheckpoint(dir); err != nil {
+		return fmt.Errorf("No such checkpoint: %s", name)
+	}
+	return os.RemoveAll(dir)
+}
+
+// Restore starts the stopped container from the checkpoint name, with the
+// address and the ports it had when the checkpoint was made.
+func (container *Container) Restore(name, dir string) error {
+	if !container.runtime.config.Experimental {
+		return errCheckpointsDisabled
+	}
+	dir, err := container.checkpointDir(name, dir)
+	if err != nil {
+		return err
+	}
+	if container.State.Running {
+		return fmt.Errorf("Container %s is already running", container.Id)
+	}
+	checkpoint, err := loadCheckpoint(dir)
+	if err != nil {
+		return fmt.Errorf("No such checkpoint: %s", name)
+	}
+	container.stopRequested = false
+	if err := container.EnsureMounted(); err != nil {
+		return err
+	}
+	if err := container.setupVolumes(); err != nil {
+		return err
+	}
+	if err := container.createDevices(); err != nil {
+		return container.startFailed(err)
+	}
+	container.NetworkSettings = checkpoint.NetworkSettings
+	if err := container.reclaimNetwork(); err != nil {
+		return container.startFailed(err)
+	}
+	if err := container.generateLXCConfig(); err != nil {
+		return container.startFailed(err)
+	}
+	// lxc-checkpoint stays in the foreground until the restored container
+	// exits, so that it is monitored like lxc-start.
+	container.Shim = false
+	container.cmd = exec.Command("lxc-checkpoint", "-r", "-F", "-n", container.Id, "-D", dir, "--rcfile", container.lxcConfigPath())
+	if err := container.start(); err != nil {
+		return container.startFailed(err)
+	}
+	container.State.setRunning(container.cmd.Process.Pid)
+	container.ToDisk()
+	container.runtime.events.Log("restore", container.Id, container.Image, map[string]string{"name": name})
+	go container.monitor()
+	return nil
+}
@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCheckpoints(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	config := DefaultDaemonConfig()
+	daemonRoot := path.Join(root, "daemon")
+	container := &Container{Id: "abc", root: root, runtime: &Runtime{root: daemonRoot, config: config}}
+
+	if _, err := container.Checkpoints(""); err != errCheckpointsDisabled {
+		t.Errorf("Checkpoints should need -experimental, got %v", err)
+	}
+	config.Experimental = true
+
+	for _, name := range []string{"", "../up", "a/b", ".hidden"} {
+		if _, err := container.checkpointDir(name, ""); err == nil {
+			t.Errorf("Expected an error for the checkpoint name %q", name)
+		}
+	}
+	if dir, err := container.checkpointDir("warm", ""); err != nil || dir != path.Join(root, "checkpoints", "warm") {
+		t.Errorf("Unexpected checkpoint directory: %s (%v)", dir, err)
+	}
+	if dir, err := container.checkpointDir("warm", path.Join(daemonRoot, "checkpoints", "shared")); err != nil || dir != path.Join(daemonRoot, "checkpoints", "shared", "warm") {
+		t.Errorf("Unexpected checkpoint directory: %s (%v)", dir, err)
+	}
+	// The checkpoints stay in the checkpoints directory of the daemon
+	if err := os.MkdirAll(path.Join(daemonRoot, "checkpoints"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../..", path.Join(daemonRoot, "checkpoints", "up")); err != nil {
+		t.Fatal(err)
+	}
+	if dir, err := container.checkpointDir("warm", path.Join(daemonRoot, "checkpoints", "up")); err != nil || dir != path.Join(daemonRoot, "checkpoints", "warm") {
+		t.Errorf("Expected the link to be resolved in the checkpoints directory, got %s (%v)", dir, err)
+	}
+	for _, dir := range []string{"/mnt", "/var/lib/docker/graph", path.Join(daemonRoot, "checkpoints", ".."), "checkpoints"} {
+		if _, err := container.checkpointDir("warm", dir); err == nil || !strings.HasPrefix(err.Error(), "Invalid checkpoint directory") {
+			t.Errorf("Expected the directory %s to be refused, got %v", dir, err)
+		}
+		if err := container.RemoveCheckpoint("warm", dir); err == nil {
+			t.Errorf("Removing a checkpoint in %s should fail", dir)
+		}
+	}
+
+	if checkpoints, err := container.Checkpoints(""); err != nil || len(checkpoints) != 0 {
+		t.Errorf("Expected no checkpoint, got %v (%v)", checkpoints, err)
+	}
+	for _, name := range []string{"warm", "cold"} {
+		dir := path.Join(root, "checkpoints", name)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(checkpointMetadataPath(dir), []byte(`{"Name":"`+name+`","NetworkSettings":{"IpAddress":"10.0.0.2"}}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not a checkpoint
+	if err := os.MkdirAll(path.Join(root, "checkpoints", "other"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	checkpoints, err := container.Checkpoints("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints) != 2 || checkpoints[0].Name != "cold" || checkpoints[1].Name != "warm" || checkpoints[1].NetworkSettings.IpAddress != "10.0.0.2" {
+		t.Errorf("Unexpected checkpoints: %v", checkpoints)
+	}
+
+	if err := container.RemoveCheckpoint("other", ""); err == nil {
+		t.Errorf("Removing a directory which isn't a checkpoint should fail")
+	}
+	if err := container.RemoveCheckpoint("warm", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(root, "checkpoints", "warm")); !os.IsNotExist(err) {
+		t.Errorf("The checkpoint should be removed, got %v", err)
+	}
+	if err := container.Restore("warm", ""); err == nil {
+		t.Errorf("Restoring a removed checkpoint should fail")
+	}
+}
@@ -0,0 +1,84 @@
+package cli
+
+// The docker command-line client. Unlike the rcli commands, which run in the
+// daemon, these commands run in the client and drive the daemon through its
+// remote API.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dotcloud/docker/client"
+	"io"
+	"reflect"
+	"strings"
+)
+
+type DockerCli struct {
+	client *client.Client
+	in     io.ReadCloser
+	out    io.Writer
+	err    io.Writer
+}
+
+// NewDockerCli returns a command-line client sending its requests with c
+func NewDockerCli(in io.ReadCloser, out, err io.Writer, c *client.Client) *DockerCli {
+	return &DockerCli{
+		client: c,
+		in:     in,
+		out:    out,
+		err:    err,
+	}
+}
+
+// StatusError reports the exit status of a command, eg. the exit code of
+// the container run by 'docker run'.
+type StatusError struct {
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Exit status %d", e.Status)
+}
+
+func methodName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "Cmd" + strings.ToUpper(name[:1]) + strings.ToLower(name[1:])
+}
+
+// HasCommand returns true if the command is implemented by the client
+func HasCommand(name string) bool {
+	_, exists := reflect.TypeOf(&DockerCli{}).MethodByName(methodName(name))
+	return exists
+}
+
+// Cmd runs the command args[0] with the arguments args[1:]
+func (cli *DockerCli) Cmd(args ...string) error {
+	if len(args) == 0 {
+		return errors.New("No command given")
+	}
+	method, exists := reflect.TypeOf(cli).MethodByName(methodName(args[0]))
+	if !exists {
+		return errors.New("No such command: " + args[0])
+	}
+	ret := method.Func.CallSlice([]reflect.Value{
+		reflect.ValueOf(cli),
+		reflect.ValueOf(args[1:]),
+	})[0].Interface()
+	if ret == nil {
+		return nil
+	}
+	return ret.(error)
+}
+
+func (cli *DockerCli) Subcmd(name, signature, description string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(cli.err)
+	flags.Usage = func() {
+		fmt.Fprintf(cli.err, "\nUsage: docker %s %s\n\n%s\n\n", name, signature, description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
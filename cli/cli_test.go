@@ -0,0 +1,849 @@
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/api"
+	"github.com/dotcloud/docker/client"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCli returns a client of a fake daemon serving handler
+func newTestCli(t *testing.T, handler http.HandlerFunc) (*DockerCli, *bytes.Buffer, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	out := &bytes.Buffer{}
+	c, err := client.NewClient("tcp://"+strings.TrimPrefix(server.URL, "http://"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := NewDockerCli(nil, out, out, c)
+	return cli, out, server
+}
+
+func TestHasCommand(t *testing.T) {
+	for _, name := range []string{"run", "ps", "images", "rm", "rmi", "inspect", "stop", "kill", "restart", "build", "volume", "info", "system", "tag", "history", "port", "attach", "update", "start", "checkpoint", "verify"} {
+		if !HasCommand(name) {
+			t.Errorf("The client should implement %s", name)
+		}
+	}
+	for _, name := range []string{"", "commit", "subcmd"} {
+		if HasCommand(name) {
+			t.Errorf("The client shouldn't implement %q", name)
+		}
+	}
+}
+
+func TestCmdPs(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v"+docker.API_VERSION+"/containers/json" || r.FormValue("all") != "1" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		json.NewEncoder(w).Encode([]api.Containers{
+			{Id: "abc", Image: "base:latest", Command: "/bin/sh -c while true; do echo hello; done", Status: "Up 2 seconds"},
+		})
+	})
+	defer server.Close()
+	if err := cli.Cmd("ps", "-a"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a header and a container, got %q", out.String())
+	}
+	for _, expected := range []string{"abc", "base:latest", "/bin/sh -c while tr", "Up 2 seconds"} {
+		if !strings.Contains(lines[1], expected) {
+			t.Errorf("Expected %q in %q", expected, lines[1])
+		}
+	}
+}
+
+func TestCmdInspectNotFound(t *testing.T) {
+	var paths []string
+	cli, _, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		http.Error(w, "No such thing", http.StatusNotFound)
+	})
+	defer server.Close()
+	err := cli.Cmd("inspect", "foo")
+	if err == nil || !strings.Contains(err.Error(), "No such image or container") {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+	prefix := "/v" + docker.API_VERSION
+	if len(paths) != 2 || paths[0] != prefix+"/containers/foo/json" || paths[1] != prefix+"/images/foo/json" {
+		t.Errorf("Expected the container then the image to be looked up, got %v", paths)
+	}
+}
+
+func TestCmdStopError(t *testing.T) {
+	cli, _, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	})
+	defer server.Close()
+	if err := cli.Cmd("stop", "abc"); err == nil || err.Error() != "Something went wrong" {
+		t.Errorf("Expected the error of the daemon, got %v", err)
+	}
+}
+
+func TestCmdRunAutoRemove(t *testing.T) {
+	var requests []string
+	var lock sync.Mutex
+	startedContainer := make(chan struct{})
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION)
+		lock.Lock()
+		requests = append(requests, path)
+		lock.Unlock()
+		switch path {
+		case "/containers/create":
+			config := &docker.Config{}
+			if err := json.NewDecoder(r.Body).Decode(config); err != nil || !config.AutoRemove {
+				t.Errorf("Expected AutoRemove in the config (%v)", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&api.Id{Id: "abc"})
+		case "/containers/abc/attach":
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+			buf.Flush()
+			<-startedContainer
+			api.NewStdWriter(conn, api.STDOUT).Write([]byte("done\n"))
+		case "/containers/abc/wait":
+			if r.FormValue("condition") != "next-exit" {
+				t.Errorf("Expected to wait for the next exit, got %s", r.URL.RawQuery)
+			}
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-startedContainer
+			json.NewEncoder(w).Encode(&api.Wait{StatusCode: 3})
+		case "/containers/abc/start":
+			close(startedContainer)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+
+	err := cli.Cmd("run", "-rm", "base", "true")
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.Status != 3 {
+		t.Errorf("Expected exit status 3, got %v", err)
+	}
+	if out.String() != "done\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+	// The exit is waited for before the container starts, since it is
+	// removed once it exited
+	expected := "/containers/create /containers/abc/attach /containers/abc/wait /containers/abc/start"
+	if strings.Join(requests, " ") != expected {
+		t.Errorf("Expected the requests %s, got %v", expected, requests)
+	}
+}
+
+func TestCmdRunDetachCidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cidFile := path.Join(dir, "cid")
+
+	var started bool
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v" + docker.API_VERSION + "/containers/create":
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&api.Id{Id: "abc"})
+		case "/v" + docker.API_VERSION + "/containers/abc/start":
+			started = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+	if err := cli.Cmd("run", "-d", "-cidfile", cidFile, "base", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if !started {
+		t.Errorf("The container wasn't started")
+	}
+	if strings.TrimSpace(out.String()) != "abc" {
+		t.Errorf("Expected the container id, got %q", out.String())
+	}
+	if data, err := ioutil.ReadFile(cidFile); err != nil || string(data) != "abc" {
+		t.Errorf("Expected abc in the cidfile, got %q (%v)", data, err)
+	}
+
+	// The cidfile exists now: nothing is created
+	if err := cli.Cmd("run", "-d", "-cidfile", cidFile, "base", "true"); err == nil {
+		t.Errorf("An existing cidfile should be refused")
+	}
+	// Nor when it can't be written
+	if err := cli.Cmd("run", "-d", "-cidfile", path.Join(dir, "missing", "cid"), "base", "true"); err == nil {
+		t.Errorf("A cidfile which can't be written should be refused")
+	}
+}
+
+func TestCmdPsFiltersFormat(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.FormValue("filters")), &filters); err != nil {
+			t.Fatal(err)
+		}
+		if len(filters["status"]) != 1 || filters["status"][0] != "exited" || len(filters["exited"]) != 2 || filters["label"][0] != "owner=web" {
+			t.Errorf("Unexpected filters: %v", filters)
+		}
+		json.NewEncoder(w).Encode([]api.Containers{
+			{Id: "abc", Status: "Exit 1"},
+			{Id: "def", Status: "Exit 2"},
+		})
+	})
+	defer server.Close()
+	if err := cli.Cmd("ps", "-f", "status=exited", "-f", "exited=1", "-f", "exited=2", "-f", "label=owner=web", "-format", "{{.Id}}: {{.Status}}"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "abc: Exit 1\ndef: Exit 2\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+	if err := cli.Cmd("ps", "-f", "status"); err == nil {
+		t.Errorf("A filter without value should be refused")
+	}
+}
+
+func TestCmdInspectFormat(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v"+docker.API_VERSION+"/containers/abc/json" {
+			http.Error(w, "No such container", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"Id": "abc", "State": {"ExitCode": 3}, "NetworkSettings": {"IpAddress": "10.0.3.2"}, "Args": ["-c", "ls"]}`))
+	})
+	defer server.Close()
+	if err := cli.Cmd("inspect", "-format", "{{.NetworkSettings.IpAddress}} {{.State.ExitCode}} {{json .Args}}", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "10.0.3.2 3 [\"-c\",\"ls\"]\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+	if err := cli.Cmd("inspect", "-format", "{{.Id", "abc"); err == nil {
+		t.Errorf("An invalid template should be refused")
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) {
+		case "/containers/json":
+			json.NewEncoder(w).Encode([]api.Containers{{Id: "abc", Status: "Up 2 seconds"}, {Id: "def", Status: "Exit 0"}})
+		case "/images/json":
+			json.NewEncoder(w).Encode([]api.Images{{Repository: "base", Tag: "latest", Id: "abc"}})
+		case "/images/base/history":
+			json.NewEncoder(w).Encode([]api.History{{Id: "abc", CreatedBy: "/bin/sh -c make", Size: 42}})
+		case "/info":
+			json.NewEncoder(w).Encode(&api.Info{Containers: 2, Images: 1})
+		case "/containers/abc/json":
+			w.Write([]byte(`{"Id": "abc", "State": {"Running": true}}`))
+		default:
+			http.Error(w, "No such object", http.StatusNotFound)
+		}
+	})
+	defer server.Close()
+	for _, args := range [][]string{
+		{"ps", "-format", "json"},
+		{"images", "-format", "json"},
+		{"history", "-format", "json", "base"},
+		{"info", "-format", "json"},
+		{"inspect", "-format", "json", "abc", "abc"},
+	} {
+		out.Reset()
+		if err := cli.Cmd(args...); err != nil {
+			t.Fatal(err)
+		}
+		// An object per line
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if expected := map[string]int{"ps": 2, "inspect": 2}[args[0]]; expected != 0 && len(lines) != expected {
+			t.Errorf("Expected %d lines from %s, got %q", expected, args[0], out.String())
+		}
+		for _, line := range lines {
+			var obj map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &obj); err != nil {
+				t.Errorf("Expected a JSON object from %s, got %q (%s)", args[0], line, err)
+			}
+		}
+	}
+	if !strings.Contains(out.String(), `{"Id":"abc","State":{"Running":true}}`) {
+		t.Errorf("inspect should print the JSON on one line: %q", out.String())
+	}
+	out.Reset()
+	if err := cli.Cmd("images", "-format", "{{.Repository}}:{{.Tag}}"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "base:latest\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func TestCmdCompletion(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]api.Images{{Repository: "base", Tag: "latest", Id: "abc"}, {Repository: "<none>", Tag: "<none>", Id: "def"}})
+	})
+	defer server.Close()
+	for _, shell := range []string{"bash", "zsh"} {
+		out.Reset()
+		if err := cli.Cmd("completion", shell); err != nil {
+			t.Fatal(err)
+		}
+		script := out.String()
+		for _, expected := range []string{"commit", "-notrunc", "-cidfile", "docker completion containers"} {
+			if !strings.Contains(script, expected) {
+				t.Errorf("Expected %q in the %s script", expected, shell)
+			}
+		}
+	}
+	out.Reset()
+	if err := cli.Cmd("completion", "images"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "base:latest\nabc\ndef\n" {
+		t.Errorf("Unexpected image names: %q", out.String())
+	}
+	if err := cli.Cmd("completion", "fish"); err == nil {
+		t.Errorf("Unsupported shells should be refused")
+	}
+}
+
+func TestCmdBuild(t *testing.T) {
+	var names []string
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v"+docker.API_VERSION+"/build" || r.FormValue("t") != "foo" || r.Header.Get("Content-Type") != "application/x-tar" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			names = append(names, hdr.Name)
+		}
+		w.Write([]byte("Step 1 : FROM base\nError: Something went wrong\n"))
+	})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "docker-cli-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := cli.Cmd("build", dir); err == nil || !strings.Contains(err.Error(), "No Dockerfile") {
+		t.Errorf("Expected a missing Dockerfile error, got %v", err)
+	}
+	for name, content := range map[string]string{"Dockerfile": "FROM base\n", "hello.txt": "hello", "build.log": "", ".dockerignore": "*.log"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = cli.Cmd("build", "-t", "foo", dir)
+	if status, ok := err.(*StatusError); !ok || status.Status != 1 {
+		t.Errorf("A failed build should exit with status 1, got %v", err)
+	}
+	if strings.Join(names, " ") != ".dockerignore Dockerfile hello.txt" {
+		t.Errorf("Unexpected build context: %v", names)
+	}
+	if !strings.Contains(out.String(), "Error: Something went wrong") {
+		t.Errorf("The output of the build should be printed, got %q", out.String())
+	}
+}
+
+func TestCmdVolume(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) {
+		case "POST /volumes/create":
+			var params map[string]string
+			json.NewDecoder(r.Body).Decode(&params)
+			w.WriteHeader(http.StatusCreated)
+			if params["Driver"] != "nfs" {
+				t.Errorf("Unexpected driver: %v", params)
+			}
+			json.NewEncoder(w).Encode(&api.Volume{Name: params["Name"]})
+		case "GET /volumes":
+			json.NewEncoder(w).Encode([]api.Volume{{Name: "data", Containers: []string{"abc"}}, {Name: "logs"}})
+		case "DELETE /volumes/data":
+			http.Error(w, "Volume data is in use by abc", http.StatusConflict)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+
+	if err := cli.Cmd("volume", "create", "-d", "nfs", "data"); err != nil || out.String() != "data\n" {
+		t.Errorf("Unexpected output: %q (%v)", out.String(), err)
+	}
+	out.Reset()
+	if err := cli.Cmd("volume", "ls", "-q"); err != nil || out.String() != "data\nlogs\n" {
+		t.Errorf("Unexpected output: %q (%v)", out.String(), err)
+	}
+	out.Reset()
+	if err := cli.Cmd("volume", "rm", "data"); err == nil || !strings.Contains(out.String(), "in use by abc") {
+		t.Errorf("Expected the volume to be in use, got %q (%v)", out.String(), err)
+	}
+	if err := cli.Cmd("volume", "mount"); err == nil {
+		t.Errorf("Unknown volume commands should fail")
+	}
+}
+
+func TestCmdInfo(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v"+docker.API_VERSION+"/info" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		json.NewEncoder(w).Encode(&api.Info{
+			Containers:        3,
+			ContainersRunning: 1,
+			ContainersStopped: 2,
+			StorageDriver:     "aufs",
+			DriverStatus:      [][2]string{{"Root Dir", "/var/lib/docker/graph"}},
+			KernelVersion:     "3.8.0",
+			MemoryLimit:       true,
+			CgroupVersion:     2,
+			RegistryMirrors:   []string{"mirror.example.com"},
+		})
+	})
+	defer server.Close()
+	if err := cli.Cmd("info"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Containers: 3 (1 running, 2 stopped)\n", " Root Dir: /var/lib/docker/graph\n", "Kernel Version: 3.8.0\n", "Cgroup Version: 2\n", "Registry Mirrors: mirror.example.com\n", "WARNING: No swap limit support"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in %q", expected, out.String())
+		}
+	}
+}
+
+func TestCmdSystemPrune(t *testing.T) {
+	var paths []string
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.Method != "POST" || r.FormValue("filters") != `{"until":["24h"]}` {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		json.NewEncoder(w).Encode(&api.PruneReport{ContainersDeleted: []string{"abc"}, SpaceReclaimed: 12500000})
+	})
+	defer server.Close()
+	if err := cli.Cmd("system", "prune", "-f", "until=24h"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Deleted Containers:\nabc\n\nTotal reclaimed space: 12.5 MB\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+	if err := cli.Cmd("system", "prune", "-f", "until=24h", "images"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Cmd("volume", "prune", "-f", "until=24h"); err != nil {
+		t.Fatal(err)
+	}
+	prefix := "/v" + docker.API_VERSION
+	if strings.Join(paths, " ") != prefix+"/system/prune "+prefix+"/images/prune "+prefix+"/volumes/prune" {
+		t.Errorf("Unexpected requests: %v", paths)
+	}
+}
+
+func TestCmdSystemDedup(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v"+docker.API_VERSION+"/system/dedup" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		json.NewEncoder(w).Encode(&api.DedupReport{FilesLinked: 12, SpaceReclaimed: 3000000})
+	})
+	defer server.Close()
+	if err := cli.Cmd("system", "dedup"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Linked 12 files, reclaimed 3 MB\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func TestCmdSystemDialStdio(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v"+docker.API_VERSION+"/version" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		w.Write([]byte("proxied"))
+	})
+	defer server.Close()
+	cli.in = ioutil.NopCloser(strings.NewReader("GET /v" + docker.API_VERSION + "/version HTTP/1.0\r\nHost: docker\r\n\r\n"))
+	if err := cli.Cmd("system", "dial-stdio"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "HTTP/1.0 200 OK\r\n") || !strings.HasSuffix(out.String(), "\r\n\r\nproxied") {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func TestCmdSystemDf(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v"+docker.API_VERSION+"/system/df" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		json.NewEncoder(w).Encode(&api.DiskUsage{
+			LayersSize:        3000000,
+			ImagesReclaimable: 1000000,
+			Images:            []api.ImageUsage{{Id: "img1", Repository: "base", Tag: "latest", Size: 2000000, SharedSize: 1500000, UniqueSize: 500000, Containers: 1}},
+			Containers:        []api.ContainerUsage{{Id: "abc", Image: "base", Running: true, Size: 1000}, {Id: "def", Image: "base", Size: 2000}},
+			Volumes:           []api.VolumeUsage{{Name: "data", Driver: "local", Size: 5000}},
+		})
+	})
+	defer server.Close()
+	if err := cli.Cmd("system", "df"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected a header and 3 types, got %q", out.String())
+	}
+	for i, expected := range [][]string{
+		{"Images", "1", "3 MB", "1 MB"},
+		{"Containers", "2", "1", "3 kB", "2 kB"},
+		{"Volumes", "1", "0", "5 kB", "5 kB"},
+	} {
+		for _, field := range expected {
+			if !strings.Contains(lines[i+1], field) {
+				t.Errorf("Expected %q in %q", field, lines[i+1])
+			}
+		}
+	}
+	out.Reset()
+	if err := cli.Cmd("system", "df", "-v"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"1.5 MB", "500 kB", "def", "data"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in %q", expected, out.String())
+		}
+	}
+}
+
+func TestCmdTrust(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) {
+		case "POST /trust/keys":
+			var params map[string]string
+			json.NewDecoder(r.Body).Decode(&params)
+			if params["Name"] != "acme" || params["Key"] != "PEM" {
+				t.Errorf("Unexpected parameters: %v", params)
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&api.TrustKey{Name: "acme", Fingerprint: "abc"})
+		case "GET /trust/keys":
+			json.NewEncoder(w).Encode([]api.TrustKey{{Name: "acme", Fingerprint: "abc"}})
+		case "GET /trust/signing-key":
+			json.NewEncoder(w).Encode(&api.TrustKey{Fingerprint: "def", Key: "PUBLIC\n"})
+		case "DELETE /trust/keys/other":
+			http.Error(w, "No such key: other", http.StatusNotFound)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+
+	cli.in = ioutil.NopCloser(strings.NewReader("PEM"))
+	if err := cli.Cmd("trust", "add", "acme", "-"); err != nil || out.String() != "abc\n" {
+		t.Errorf("Unexpected output: %q (%v)", out.String(), err)
+	}
+	out.Reset()
+	if err := cli.Cmd("trust", "ls", "-q"); err != nil || out.String() != "acme\n" {
+		t.Errorf("Unexpected output: %q (%v)", out.String(), err)
+	}
+	out.Reset()
+	if err := cli.Cmd("trust", "key"); err != nil || out.String() != "PUBLIC\n" {
+		t.Errorf("Unexpected output: %q (%v)", out.String(), err)
+	}
+	out.Reset()
+	if err := cli.Cmd("trust", "rm", "other"); err == nil || !strings.Contains(out.String(), "No such key") {
+		t.Errorf("Expected No such key, got %q (%v)", out.String(), err)
+	}
+}
+
+func TestCmdTagRmi(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) {
+		case "POST /images/abc/tag":
+			if r.FormValue("repo") != "team/app:v1" || r.FormValue("force") != "1" {
+				t.Errorf("Unexpected parameters: %s", r.URL.RawQuery)
+			}
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE /images/team/app:v1":
+			json.NewEncoder(w).Encode([]api.Rmi{{Untagged: "team/app:v1"}, {Deleted: "abc"}})
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+
+	if err := cli.Cmd("tag", "-f", "abc", "team/app:v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Cmd("rmi", "team/app:v1"); err != nil || out.String() != "Untagged: team/app:v1\nDeleted: abc\n" {
+		t.Errorf("Unexpected output: %q (%v)", out.String(), err)
+	}
+}
+
+func TestCmdHistory(t *testing.T) {
+	id := strings.Repeat("a", 64)
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method+" "+strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) != "GET /images/team/app/history" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+			return
+		}
+		json.NewEncoder(w).Encode([]api.History{{
+			Id:        id,
+			Created:   time.Now().Unix(),
+			CreatedBy: "/bin/sh -c apt-get install -y build-essential python-dev",
+			Size:      2048,
+			Comment:   "imported",
+		}})
+	})
+	defer server.Close()
+
+	if err := cli.Cmd("history", "team/app"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "IMAGE") {
+		t.Fatalf("Unexpected output: %q", out.String())
+	}
+	for _, expected := range []string{id[:12] + " ", "/bin/sh -c apt-get install -y build-essential ", "2.048 kB", "imported"} {
+		if !strings.Contains(lines[1], expected) {
+			t.Errorf("Expected %q in %q", expected, lines[1])
+		}
+	}
+	if strings.Contains(lines[1], id) {
+		t.Errorf("Expected a truncated id in %q", lines[1])
+	}
+
+	out.Reset()
+	if err := cli.Cmd("history", "-no-trunc", "team/app"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), id) || !strings.Contains(out.String(), "python-dev") {
+		t.Errorf("Expected the full id and command in %q", out.String())
+	}
+}
+
+func TestCmdPort(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) {
+		case "GET /containers/web/port":
+			json.NewEncoder(w).Encode([]api.Port{{PrivatePort: 80, PublicPort: 49153}, {PrivatePort: 443, PublicPort: 49154}})
+		case "GET /containers/stopped/port":
+			http.Error(w, "Container stopped is not running", http.StatusConflict)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+
+	if err := cli.Cmd("port", "web"); err != nil || out.String() != "80 -> 49153\n443 -> 49154\n" {
+		t.Errorf("Unexpected output: %q (%v)", out.String(), err)
+	}
+	out.Reset()
+	if err := cli.Cmd("port", "web", "443"); err != nil || out.String() != "49154\n" {
+		t.Errorf("Unexpected output: %q (%v)", out.String(), err)
+	}
+	if err := cli.Cmd("port", "web", "22"); err == nil || !strings.Contains(err.Error(), "No private port '22'") {
+		t.Errorf("Expected an error for an unmapped port, got %v", err)
+	}
+	if err := cli.Cmd("port", "stopped"); err == nil || !strings.Contains(err.Error(), "is not running") {
+		t.Errorf("Expected an error for a stopped container, got %v", err)
+	}
+}
+
+func TestParseDetachKeys(t *testing.T) {
+	keys, err := parseDetachKeys(DEFAULT_DETACH_KEYS)
+	if err != nil || string(keys) != "\x10\x11" {
+		t.Errorf("Unexpected keys: %q (%v)", keys, err)
+	}
+	if keys, err := parseDetachKeys("ctrl-A,d,ctrl-@"); err != nil || string(keys) != "\x01d\x00" {
+		t.Errorf("Unexpected keys: %q (%v)", keys, err)
+	}
+	for _, invalid := range []string{"", "ctrl-", "ctrl-1", "ctrl-p,,ctrl-q", "esc"} {
+		if _, err := parseDetachKeys(invalid); err == nil {
+			t.Errorf("%q should be refused", invalid)
+		}
+	}
+}
+
+func TestDetachReader(t *testing.T) {
+	keys := []byte("\x10\x11")
+	for input, expected := range map[string]string{
+		"ls\n":                "ls\n",
+		"a\x10b\x10":          "a\x10b\x10",
+		"\x10\x10\x11ignored": "\x10",
+		"top\x10\x11":         "top",
+	} {
+		data, err := ioutil.ReadAll(newDetachReader(strings.NewReader(input), keys))
+		if string(data) != expected {
+			t.Errorf("Expected %q from %q, got %q", expected, input, data)
+		}
+		if detached := strings.Contains(input, "\x10\x11"); detached != (err == errDetached) {
+			t.Errorf("Unexpected error for %q: %v", input, err)
+		}
+	}
+}
+
+func TestCmdAttachDetach(t *testing.T) {
+	received := make(chan string, 1)
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) {
+		case "GET /containers/web/json":
+			json.NewEncoder(w).Encode(&docker.Container{Config: &docker.Config{Tty: true}, State: docker.State{Running: true}})
+		case "POST /containers/web/attach":
+			if r.FormValue("stdin") != "1" || r.FormValue("stdout") != "1" {
+				t.Errorf("Unexpected parameters: %s", r.URL.RawQuery)
+			}
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\nhello")
+			buf.Flush()
+			// The connection is left open: only the client detaching ends it
+			data, _ := ioutil.ReadAll(buf)
+			received <- string(data)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+
+	cli.in = ioutil.NopCloser(strings.NewReader("ls\x10x\x01\x02ignored"))
+	if err := cli.Cmd("attach", "-i", "-detach-keys", "ctrl-a,ctrl-b", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-received; data != "ls\x10x" {
+		t.Errorf("Expected the input before the detach keys, got %q (output %q)", data, out.String())
+	}
+}
+
+func TestCmdUpdate(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) {
+		case "POST /containers/web/update":
+			update := &api.Update{}
+			if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+				t.Fatal(err)
+			}
+			if update.Memory == nil || *update.Memory != 1048576 || update.CpuQuota == nil || *update.CpuQuota != 0 || update.Restart == nil || *update.Restart != "on-failure:3" || update.MemorySwap != nil || update.CpuShares != nil {
+				t.Errorf("Unexpected update: %#v", update)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /containers/gone/update":
+			http.Error(w, "No such container: gone", http.StatusNotFound)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+
+	err := cli.Cmd("update", "-m", "1048576", "-cpu-quota", "0", "-restart", "on-failure:3", "web", "gone")
+	if err == nil || !strings.Contains(out.String(), "Error updating container gone") {
+		t.Errorf("Expected an error for gone, got %q (%v)", out.String(), err)
+	}
+	if !strings.HasPrefix(out.String(), "web\n") {
+		t.Errorf("Expected the updated container, got %q", out.String())
+	}
+}
+
+func TestCmdCheckpoint(t *testing.T) {
+	cli, out, server := newTestCli(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/v"+docker.API_VERSION) {
+		case "POST /containers/web/checkpoints":
+			if r.FormValue("name") != "warm" || r.FormValue("leave-running") != "1" || r.FormValue("dir") != "/mnt/checkpoints" {
+				t.Errorf("Unexpected checkpoint request: %s", r.URL)
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Name":"warm"}`))
+		case "GET /containers/web/checkpoints":
+			w.Write([]byte(`[{"Name":"warm","Created":0}]`))
+		case "POST /containers/web/start":
+			if r.FormValue("checkpoint") != "warm" {
+				t.Errorf("Expected a restore from warm, got %s", r.URL)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE /containers/web/checkpoints/warm":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer server.Close()
+
+	if err := cli.Cmd("checkpoint", "create", "-leave-running", "-checkpoint-dir", "/mnt/checkpoints", "web", "warm"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Cmd("checkpoint", "ls", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Cmd("start", "-checkpoint", "warm", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.Cmd("checkpoint", "rm", "web", "warm"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 6 || lines[0] != "warm" || !strings.HasPrefix(lines[1], "CHECKPOINT") || !strings.HasPrefix(lines[2], "warm ") || lines[3] != "web" || lines[4] != "warm" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func TestCmdVerify(t *testing.T) {
+	id := strings.Repeat("ab", 32)
+	archive := func(files ...string) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+		tw := tar.NewWriter(buf)
+		for i := 0; i < len(files); i += 2 {
+			tw.WriteHeader(&tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1])), Typeflag: tar.TypeReg})
+			tw.Write([]byte(files[i+1]))
+		}
+		tw.Close()
+		return buf
+	}
+	layer := archive("etc/motd", "hello").String()
+
+	cli, out, server := newTestCli(t, nil)
+	defer server.Close()
+	cli.in = ioutil.NopCloser(archive(id+"/VERSION", "1.0", id+"/json", `{"id":"`+id+`"}`, id+"/layer.tar", layer, "repositories", `{"app":{"v1":"`+id+`"}}`))
+	if err := cli.Cmd("verify"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Warning: the archive has no checksums") || !strings.HasSuffix(out.String(), "Verified 1 images and 1 tags\n") {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+
+	// The layer is missing
+	out.Reset()
+	cli.in = ioutil.NopCloser(archive(id+"/VERSION", "1.0", id+"/json", `{"id":"`+id+`"}`))
+	err := cli.Cmd("verify", "-")
+	if status, ok := err.(*StatusError); !ok || status.Status != 1 {
+		t.Fatalf("Expected the status 1, got %v", err)
+	}
+	if !strings.Contains(out.String(), "Error: "+id+" has no layer.tar\n") {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
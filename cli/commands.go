@@ -0,0 +1,1437 @@
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/api"
+	"github.com/dotcloud/docker/client"
+	"github.com/dotcloud/docker/term"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+// Functions available in -format templates
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+}
+
+// formatter prints the objects listed by a command with -format: each as a
+// JSON object on its own line with "json", or with a Go template otherwise.
+// The JSON objects have the fields of the API, which don't change with the
+// width of the columns of the tables.
+type formatter struct {
+	out  io.Writer
+	tmpl *template.Template // nil for json
+}
+
+// newFormatter returns nil if format is empty, for the default output
+func newFormatter(out io.Writer, name, format string) (*formatter, error) {
+	if format == "" {
+		return nil, nil
+	}
+	f := &formatter{out: out}
+	if format != "json" {
+		var err error
+		if f.tmpl, err = template.New(name).Funcs(templateFuncs).Parse(format); err != nil {
+			return nil, fmt.Errorf("Invalid format: %s", err)
+		}
+	}
+	return f, nil
+}
+
+func (f *formatter) print(obj interface{}) error {
+	if f.tmpl == nil {
+		return json.NewEncoder(f.out).Encode(obj)
+	}
+	if err := f.tmpl.Execute(f.out, obj); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(f.out)
+	return err
+}
+
+func (cli *DockerCli) CmdRun(args ...string) error {
+	config, options, err := docker.ParseRun(args, cli.err)
+	if err != nil {
+		return err
+	}
+	if config.Image == "" {
+		return fmt.Errorf("Image not specified")
+	}
+	if err := docker.CheckCidFile(options.CidFile); err != nil {
+		return err
+	}
+	var stdin io.Reader
+	if config.OpenStdin {
+		if stdin, err = cli.attachInput(config.Tty, options.DetachKeys); err != nil {
+			return err
+		}
+	}
+
+	// Create the container, pulling its image if needed
+	body, err := cli.client.Call("POST", "/containers/create", config)
+	if client.IsNotFound(err) {
+		fmt.Fprintf(cli.err, "Image %s not found, trying to pull it from registry.\n", config.Image)
+		if err := cli.client.Stream("POST", "/images/create?fromImage="+url.QueryEscape(config.Image), nil, "", cli.err); err != nil {
+			return err
+		}
+		body, err = cli.client.Call("POST", "/containers/create", config)
+	}
+	if err != nil {
+		return err
+	}
+	created := &api.Id{}
+	if err := json.Unmarshal(body, created); err != nil {
+		return err
+	}
+	if err := docker.WriteCidFile(options.CidFile, created.Id); err != nil {
+		if _, err := cli.client.Call("DELETE", "/containers/"+created.Id, nil); err != nil {
+			fmt.Fprintf(cli.err, "Error removing container %s: %s\n", created.Id, err)
+		}
+		return err
+	}
+
+	if config.Detach {
+		if _, err := cli.client.Call("POST", "/containers/"+created.Id+"/start", nil); err != nil {
+			return err
+		}
+		fmt.Fprintln(cli.out, created.Id)
+		return nil
+	}
+
+	if config.Tty && term.IsTerminal(0) {
+		oldState, err := term.MakeRaw(0)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(0, oldState)
+	}
+
+	// Attach before starting the container, to get all of its output
+	v := url.Values{}
+	v.Set("stream", "1")
+	v.Set("stdout", "1")
+	v.Set("stderr", "1")
+	if stdin != nil {
+		v.Set("stdin", "1")
+	}
+	started := make(chan struct{})
+	attached := make(chan error, 1)
+	go func() {
+		attached <- cli.client.Hijack("POST", "/containers/"+created.Id+"/attach?"+v.Encode(), config.Tty, stdin, cli.out, cli.err, started)
+	}()
+	<-started
+	// The daemon removes the container once it exits: wait for the exit
+	// before starting it
+	var exited *http.Response
+	if config.AutoRemove {
+		if exited, err = cli.client.Do("POST", "/containers/"+created.Id+"/wait?condition=next-exit", nil, ""); err != nil {
+			return err
+		}
+		defer exited.Body.Close()
+	}
+	if _, err := cli.client.Call("POST", "/containers/"+created.Id+"/start", nil); err != nil {
+		return err
+	}
+	if err := <-attached; err == errDetached {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	wait := &api.Wait{}
+	if exited != nil {
+		if err := json.NewDecoder(exited.Body).Decode(wait); err != nil {
+			return err
+		}
+	} else {
+		body, err = cli.client.Call("POST", "/containers/"+created.Id+"/wait", nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, wait); err != nil {
+			return err
+		}
+	}
+	if wait.StatusCode != 0 {
+		return &StatusError{Status: wait.StatusCode}
+	}
+	return nil
+}
+
+// attachInput returns the stdin sent to a container. On a tty, it ends
+// with errDetached once the detach sequence is typed.
+func (cli *DockerCli) attachInput(tty bool, detachKeys string) (io.Reader, error) {
+	if !tty {
+		return cli.in, nil
+	}
+	if detachKeys == "" {
+		detachKeys = DEFAULT_DETACH_KEYS
+	}
+	keys, err := parseDetachKeys(detachKeys)
+	if err != nil {
+		return nil, err
+	}
+	return newDetachReader(cli.in, keys), nil
+}
+
+func (cli *DockerCli) CmdAttach(args ...string) error {
+	cmd := cli.Subcmd("attach", "[OPTIONS] CONTAINER", "Attach to a running container")
+	flStdin := cmd.Bool("i", false, "Attach to stdin")
+	flStdout := cmd.Bool("o", true, "Attach to stdout")
+	flStderr := cmd.Bool("e", true, "Attach to stderr")
+	flDetachKeys := cmd.String("detach-keys", DEFAULT_DETACH_KEYS, "Key sequence detaching from the container, eg. ctrl-a,d")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	name := cmd.Arg(0)
+	body, err := cli.client.Call("GET", "/containers/"+name+"/json", nil)
+	if err != nil {
+		return err
+	}
+	container := &docker.Container{}
+	if err := json.Unmarshal(body, container); err != nil {
+		return err
+	}
+	if !container.State.Running {
+		return fmt.Errorf("Container %s is not running", name)
+	}
+	tty := container.Config != nil && container.Config.Tty
+	v := url.Values{}
+	v.Set("stream", "1")
+	var stdin io.Reader
+	if *flStdin {
+		if stdin, err = cli.attachInput(tty, *flDetachKeys); err != nil {
+			return err
+		}
+		v.Set("stdin", "1")
+		if tty && term.IsTerminal(0) {
+			oldState, err := term.MakeRaw(0)
+			if err != nil {
+				return err
+			}
+			defer term.Restore(0, oldState)
+		}
+	}
+	if *flStdout {
+		v.Set("stdout", "1")
+	}
+	if *flStderr {
+		v.Set("stderr", "1")
+	}
+	err = cli.client.Hijack("POST", "/containers/"+name+"/attach?"+v.Encode(), tty, stdin, cli.out, cli.err, nil)
+	if err == errDetached {
+		return nil
+	}
+	return err
+}
+
+// CmdBuild uploads the directory PATH as the build context, leaving out the
+// files matched by its .dockerignore
+func (cli *DockerCli) CmdBuild(args ...string) error {
+	cmd := cli.Subcmd("build", "[OPTIONS] PATH | -", "Build a new image from the Dockerfile in PATH, or read from stdin")
+	flTag := cmd.String("t", "", "Repository name (and optionally a tag) to apply to the resulting image")
+	flNoCache := cmd.Bool("no-cache", false, "Do not use the images of previous builds")
+	flRm := cmd.Bool("rm", true, "Remove the intermediate containers after a successful build")
+	flForceRm := cmd.Bool("force-rm", false, "Always remove the intermediate containers, even if the build fails")
+	var flBuildArgs docker.ListOpts
+	cmd.Var(&flBuildArgs, "build-arg", "Set a value for an ARG instruction (NAME=VALUE)")
+	var flBuildArgFiles docker.ListOpts
+	cmd.Var(&flBuildArgFiles, "build-arg-file", "Read values for the ARG instructions from a file of NAME=VALUE lines, overridden by -build-arg")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	buildArgs, err := docker.ReadBuildArgs(flBuildArgFiles, flBuildArgs)
+	if err != nil {
+		return err
+	}
+	var context io.Reader
+	if cmd.Arg(0) == "-" {
+		// The context only contains the Dockerfile
+		dockerfile, err := ioutil.ReadAll(cli.in)
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile)), ModTime: time.Now()}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(dockerfile); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		context = buf
+	} else {
+		if _, err := os.Stat(path.Join(cmd.Arg(0), "Dockerfile")); err != nil {
+			return fmt.Errorf("No Dockerfile found in %s", cmd.Arg(0))
+		}
+		var err error
+		if context, err = docker.BuildContext(cmd.Arg(0)); err != nil {
+			return err
+		}
+	}
+	v := url.Values{}
+	if *flTag != "" {
+		v.Set("t", *flTag)
+	}
+	if *flNoCache {
+		v.Set("nocache", "1")
+	}
+	if !*flRm {
+		v.Set("rm", "0")
+	}
+	if *flForceRm {
+		v.Set("forcerm", "1")
+	}
+	if len(buildArgs) > 0 {
+		data, err := json.Marshal(buildArgs)
+		if err != nil {
+			return err
+		}
+		v.Set("buildargs", string(data))
+	}
+	// The daemon reports a failed build on the last line of the output
+	last := &client.LastLineWriter{}
+	if err := cli.client.Stream("POST", "/build?"+v.Encode(), context, "application/x-tar", io.MultiWriter(cli.out, last)); err != nil {
+		return err
+	}
+	if strings.HasPrefix(last.LastLine(), "Error: ") {
+		return &StatusError{Status: 1}
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdPort(args ...string) error {
+	cmd := cli.Subcmd("port", "[OPTIONS] CONTAINER [PRIVATE_PORT]", "List the port mappings of a container, or lookup the public-facing port which is NAT-ed to PRIVATE_PORT")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 || cmd.NArg() > 2 {
+		cmd.Usage()
+		return nil
+	}
+	body, err := cli.client.Call("GET", "/containers/"+cmd.Arg(0)+"/port", nil)
+	if err != nil {
+		return err
+	}
+	var ports []api.Port
+	if err := json.Unmarshal(body, &ports); err != nil {
+		return err
+	}
+	for _, port := range ports {
+		if cmd.NArg() == 1 {
+			fmt.Fprintf(cli.out, "%d -> %d\n", port.PrivatePort, port.PublicPort)
+		} else if strconv.Itoa(port.PrivatePort) == cmd.Arg(1) {
+			fmt.Fprintln(cli.out, port.PublicPort)
+			return nil
+		}
+	}
+	if cmd.NArg() == 2 {
+		return fmt.Errorf("No private port '%s' allocated on %s", cmd.Arg(1), cmd.Arg(0))
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdPs(args ...string) error {
+	cmd := cli.Subcmd("ps", "[OPTIONS]", "List containers")
+	quiet := cmd.Bool("q", false, "Only display numeric IDs")
+	flAll := cmd.Bool("a", false, "Show all containers. Only running containers are shown by default.")
+	flFull := cmd.Bool("notrunc", false, "Don't truncate output")
+	cmd.BoolVar(flFull, "no-trunc", false, "Don't truncate output")
+	var flFilters docker.ListOpts
+	cmd.Var(&flFilters, "f", "Filter output with KEY=VALUE: status=running|exited, id=ID, ancestor=IMAGE, exited=CODE, label=KEY[=VALUE]")
+	flFormat := cmd.String("format", "", "Print each container as JSON with 'json', or with a Go template, eg. '{{.Id}} {{.Status}}'")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	format, err := newFormatter(cli.out, "ps", *flFormat)
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	if *flAll {
+		v.Set("all", "1")
+	}
+	if err := setFilters(v, flFilters); err != nil {
+		return err
+	}
+	body, err := cli.client.Call("GET", "/containers/json?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var containers []api.Containers
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return err
+	}
+	if format != nil {
+		for _, container := range containers {
+			if err := format.print(container); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(cli.out, 12, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintf(w, "ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tCOMMENT\n")
+	}
+	for _, container := range containers {
+		if *quiet {
+			fmt.Fprintln(w, container.Id)
+			continue
+		}
+		command := container.Command
+		if !*flFull {
+			command = docker.Trunc(command, 20)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\t%s\t%s\n",
+			container.Id,
+			container.Image,
+			command,
+			docker.HumanDuration(time.Now().Sub(time.Unix(container.Created, 0))),
+			container.Status,
+			"")
+	}
+	return w.Flush()
+}
+
+// setFilters sets the filters parameter of v from KEY=VALUE filters
+func setFilters(v url.Values, flFilters docker.ListOpts) error {
+	if len(flFilters) == 0 {
+		return nil
+	}
+	filters := make(map[string][]string)
+	for _, filter := range flFilters {
+		parts := strings.SplitN(filter, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Invalid filter: %s (expected KEY=VALUE)", filter)
+		}
+		filters[parts[0]] = append(filters[parts[0]], parts[1])
+	}
+	buf, err := json.Marshal(filters)
+	if err != nil {
+		return err
+	}
+	v.Set("filters", string(buf))
+	return nil
+}
+
+func (cli *DockerCli) CmdImages(args ...string) error {
+	cmd := cli.Subcmd("images", "[OPTIONS] [NAME]", "List images")
+	quiet := cmd.Bool("q", false, "only show numeric IDs")
+	flAll := cmd.Bool("a", false, "show all images")
+	var flFilters docker.ListOpts
+	cmd.Var(&flFilters, "f", "Filter output with KEY=VALUE: label=KEY[=VALUE], dangling=true|false, untagged=REPOSITORY[:TAG]")
+	flFormat := cmd.String("format", "", "Print each image as JSON with 'json', or with a Go template, eg. '{{.Repository}}:{{.Tag}}'")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 1 {
+		cmd.Usage()
+		return nil
+	}
+	format, err := newFormatter(cli.out, "images", *flFormat)
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	if *flAll {
+		v.Set("all", "1")
+	}
+	if err := setFilters(v, flFilters); err != nil {
+		return err
+	}
+	if cmd.NArg() == 1 {
+		v.Set("filter", cmd.Arg(0))
+	}
+	body, err := cli.client.Call("GET", "/images/json?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var images []api.Images
+	if err := json.Unmarshal(body, &images); err != nil {
+		return err
+	}
+	if format != nil {
+		for _, image := range images {
+			if err := format.print(image); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintf(w, "REPOSITORY\tTAG\tID\tCREATED\tPARENT\n")
+	}
+	for _, image := range images {
+		if *quiet {
+			fmt.Fprintln(w, image.Id)
+			continue
+		}
+		tag := image.Tag
+		if image.Untagged != "" {
+			tag += " (was " + image.Untagged + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\t%s\n",
+			image.Repository,
+			tag,
+			image.Id,
+			docker.HumanDuration(time.Now().Sub(time.Unix(image.Created, 0))),
+			image.ParentId)
+	}
+	return w.Flush()
+}
+
+func (cli *DockerCli) CmdHistory(args ...string) error {
+	cmd := cli.Subcmd("history", "[OPTIONS] IMAGE", "Show the history of an image")
+	flFull := cmd.Bool("notrunc", false, "Don't truncate output")
+	cmd.BoolVar(flFull, "no-trunc", false, "Don't truncate output")
+	flFormat := cmd.String("format", "", "Print each layer as JSON with 'json', or with a Go template, eg. '{{.Id}} {{.Size}}'")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	format, err := newFormatter(cli.out, "history", *flFormat)
+	if err != nil {
+		return err
+	}
+	body, err := cli.client.Call("GET", "/images/"+cmd.Arg(0)+"/history", nil)
+	if err != nil {
+		return err
+	}
+	var history []api.History
+	if err := json.Unmarshal(body, &history); err != nil {
+		return err
+	}
+	if format != nil {
+		for _, layer := range history {
+			if err := format.print(layer); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "IMAGE\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	for _, layer := range history {
+		id, createdBy := layer.Id, layer.CreatedBy
+		if !*flFull {
+			id, createdBy = docker.Trunc(id, 12), docker.Trunc(createdBy, 45)
+		}
+		fmt.Fprintf(w, "%s\t%s ago\t%s\t%s\t%s\n",
+			id,
+			docker.HumanDuration(time.Now().Sub(time.Unix(layer.Created, 0))),
+			createdBy,
+			docker.HumanSize(layer.Size),
+			layer.Comment)
+	}
+	return w.Flush()
+}
+
+func (cli *DockerCli) CmdInspect(args ...string) error {
+	cmd := cli.Subcmd("inspect", "[OPTIONS] CONTAINER|IMAGE [CONTAINER|IMAGE...]", "Return low-level information on a container or an image")
+	flFormat := cmd.String("format", "", "Print each object as JSON on one line with 'json', or with a Go template of the JSON, eg. '{{.NetworkSettings.IpAddress}}'")
+	cmd.StringVar(flFormat, "f", "", "Shorthand for -format")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	format, err := newFormatter(cli.out, "inspect", *flFormat)
+	if err != nil {
+		return err
+	}
+	for _, name := range cmd.Args() {
+		body, err := cli.client.Call("GET", "/containers/"+name+"/json", nil)
+		if client.IsNotFound(err) {
+			body, err = cli.client.Call("GET", "/images/"+name+"/json", nil)
+			if client.IsNotFound(err) {
+				return fmt.Errorf("No such image or container: %s", name)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if format != nil && format.tmpl != nil {
+			// Execute the template on the JSON rather than on a Go type,
+			// so that it works for containers and images alike
+			var obj interface{}
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			if err := decoder.Decode(&obj); err != nil {
+				return err
+			}
+			if err := format.print(obj); err != nil {
+				return fmt.Errorf("Template parsing error: %s", err)
+			}
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if format != nil {
+			// As received, the fields in the order of the daemon
+			err = json.Compact(buf, body)
+		} else {
+			err = json.Indent(buf, body, "", "    ")
+		}
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		if _, err := buf.WriteTo(cli.out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send action to each of the containers given as argument, and print
+// their id
+func (cli *DockerCli) containerAction(action, description string, args []string) error {
+	cmd := cli.Subcmd(action, "[OPTIONS] CONTAINER [CONTAINER...]", description)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	for _, name := range cmd.Args() {
+		if _, err := cli.client.Call("POST", "/containers/"+name+"/"+action, nil); err != nil {
+			return err
+		}
+		fmt.Fprintln(cli.out, name)
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdInfo(args ...string) error {
+	cmd := cli.Subcmd("info", "[OPTIONS]", "Display system-wide information")
+	flFormat := cmd.String("format", "", "Print the information as JSON with 'json', or with a Go template, eg. '{{.Containers}}'")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	format, err := newFormatter(cli.out, "info", *flFormat)
+	if err != nil {
+		return err
+	}
+	body, err := cli.client.Call("GET", "/info", nil)
+	if err != nil {
+		return err
+	}
+	info := &api.Info{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return err
+	}
+	if format != nil {
+		return format.print(info)
+	}
+	return docker.WriteInfo(cli.out, info)
+}
+
+func (cli *DockerCli) CmdStart(args ...string) error {
+	cmd := cli.Subcmd("start", "[OPTIONS] CONTAINER [CONTAINER...]", "Start a stopped container")
+	flCheckpoint := cmd.String("checkpoint", "", "Restore the container from this checkpoint (experimental)")
+	flCheckpointDir := cmd.String("checkpoint-dir", "", "Directory of the checkpoint, instead of the container directory")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 || (*flCheckpoint != "" && cmd.NArg() > 1) {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	if *flCheckpoint != "" {
+		v.Set("checkpoint", *flCheckpoint)
+		v.Set("checkpoint-dir", *flCheckpointDir)
+	}
+	for _, name := range cmd.Args() {
+		if _, err := cli.client.Call("POST", "/containers/"+name+"/start?"+v.Encode(), nil); err != nil {
+			return err
+		}
+		fmt.Fprintln(cli.out, name)
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdStop(args ...string) error {
+	return cli.containerAction("stop", "Stop a running container", args)
+}
+
+func (cli *DockerCli) CmdRestart(args ...string) error {
+	return cli.containerAction("restart", "Restart a running container", args)
+}
+
+func (cli *DockerCli) CmdKill(args ...string) error {
+	cmd := cli.Subcmd("kill", "[OPTIONS] CONTAINER [CONTAINER...]", "Kill a running container, or send it a signal")
+	flSignal := cmd.String("s", "KILL", "Signal to send to the container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	if _, err := docker.ParseSignal(*flSignal); err != nil {
+		return err
+	}
+	for _, name := range cmd.Args() {
+		if err := cli.client.ContainerKill(name, *flSignal); err != nil {
+			return err
+		}
+		fmt.Fprintln(cli.out, name)
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdUpdate(args ...string) error {
+	cmd := cli.Subcmd("update", "[OPTIONS] CONTAINER [CONTAINER...]", "Change the resource limits and the restart policy of containers")
+	flMemory := cmd.Int64("m", 0, "Memory limit (in bytes), 0 to remove it")
+	flMemorySwap := cmd.Int64("memory-swap", 0, "Total memory usage (memory + swap), -1 to disable swap")
+	flCpuShares := cmd.Int64("c", 0, "CPU shares (relative weight), 0 for the default")
+	flCpuQuota := cmd.Int64("cpu-quota", 0, "CPU time in microseconds per 100ms period, 0 to remove it")
+	flRestart := cmd.String("restart", "", "Restart policy when the container exits: no, always or on-failure[:MAX]")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	// Only the flags given are sent, the settings of the others are kept
+	update := &api.Update{}
+	cmd.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "m":
+			update.Memory = flMemory
+		case "memory-swap":
+			update.MemorySwap = flMemorySwap
+		case "c":
+			update.CpuShares = flCpuShares
+		case "cpu-quota":
+			update.CpuQuota = flCpuQuota
+		case "restart":
+			update.Restart = flRestart
+		}
+	})
+	var lastErr error
+	for _, name := range cmd.Args() {
+		if _, err := cli.client.Call("POST", "/containers/"+name+"/update", update); err != nil {
+			fmt.Fprintf(cli.err, "Error updating container %s: %s\n", name, err)
+			lastErr = err
+			continue
+		}
+		fmt.Fprintln(cli.out, name)
+	}
+	return lastErr
+}
+
+func (cli *DockerCli) CmdRm(args ...string) error {
+	cmd := cli.Subcmd("rm", "[OPTIONS] CONTAINER [CONTAINER...]", "Remove a container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	var lastErr error
+	for _, name := range cmd.Args() {
+		if _, err := cli.client.Call("DELETE", "/containers/"+name, nil); err != nil {
+			fmt.Fprintf(cli.err, "Error destroying container %s: %s\n", name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (cli *DockerCli) CmdRmi(args ...string) error {
+	cmd := cli.Subcmd("rmi", "[OPTIONS] IMAGE [IMAGE...]", "Remove an image")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	var lastErr error
+	for _, name := range cmd.Args() {
+		body, err := cli.client.Call("DELETE", "/images/"+name, nil)
+		if err != nil {
+			fmt.Fprintf(cli.err, "Error removing image %s: %s\n", name, err)
+			lastErr = err
+			continue
+		}
+		var result []api.Rmi
+		if err := json.Unmarshal(body, &result); err != nil {
+			return err
+		}
+		for _, rmi := range result {
+			if rmi.Untagged != "" {
+				fmt.Fprintf(cli.out, "Untagged: %s\n", rmi.Untagged)
+			} else {
+				fmt.Fprintf(cli.out, "Deleted: %s\n", rmi.Deleted)
+			}
+		}
+	}
+	return lastErr
+}
+
+func (cli *DockerCli) CmdTag(args ...string) error {
+	cmd := cli.Subcmd("tag", "[OPTIONS] IMAGE REPOSITORY[:TAG]", "Tag an image into a repository")
+	force := cmd.Bool("f", false, "Move the tag if it is already set")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("repo", cmd.Arg(1))
+	if *force {
+		v.Set("force", "1")
+	}
+	_, err := cli.client.Call("POST", "/images/"+cmd.Arg(0)+"/tag?"+v.Encode(), nil)
+	return err
+}
+
+func (cli *DockerCli) CmdVolume(args ...string) error {
+	cmd := cli.Subcmd("volume", "COMMAND [OPTIONS] [ARG...]", "Manage volumes\n\nCommands:\n    create     Create a volume\n    inspect    Display information on volumes\n    ls         List volumes\n    prune      Remove the unused volumes\n    rm         Remove volumes")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "create":
+		return cli.volumeCreate(cmd.Args()[1:])
+	case "inspect":
+		return cli.volumeInspect(cmd.Args()[1:])
+	case "ls":
+		return cli.volumeLs(cmd.Args()[1:])
+	case "prune":
+		return cli.volumePrune(cmd.Args()[1:])
+	case "rm":
+		return cli.volumeRm(cmd.Args()[1:])
+	}
+	return fmt.Errorf("No such volume command: %s", cmd.Arg(0))
+}
+
+func (cli *DockerCli) volumeCreate(args []string) error {
+	cmd := cli.Subcmd("volume create", "[OPTIONS] [NAME]", "Create a volume. A name is generated if none is given")
+	flDriver := cmd.String("d", "local", "Driver storing the content of the volume")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 1 {
+		cmd.Usage()
+		return nil
+	}
+	body, err := cli.client.Call("POST", "/volumes/create", map[string]string{"Name": cmd.Arg(0), "Driver": *flDriver})
+	if err != nil {
+		return err
+	}
+	volume := &api.Volume{}
+	if err := json.Unmarshal(body, volume); err != nil {
+		return err
+	}
+	fmt.Fprintln(cli.out, volume.Name)
+	return nil
+}
+
+func (cli *DockerCli) volumeInspect(args []string) error {
+	cmd := cli.Subcmd("volume inspect", "VOLUME [VOLUME...]", "Return low-level information on volumes")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	for _, name := range cmd.Args() {
+		body, err := cli.client.Call("GET", "/volumes/"+name, nil)
+		if err != nil {
+			return err
+		}
+		indented := new(bytes.Buffer)
+		if err := json.Indent(indented, body, "", "    "); err != nil {
+			return err
+		}
+		indented.WriteByte('\n')
+		if _, err := indented.WriteTo(cli.out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cli *DockerCli) volumeLs(args []string) error {
+	cmd := cli.Subcmd("volume ls", "[OPTIONS]", "List volumes")
+	quiet := cmd.Bool("q", false, "only show names")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	body, err := cli.client.Call("GET", "/volumes", nil)
+	if err != nil {
+		return err
+	}
+	var volumes []api.Volume
+	if err := json.Unmarshal(body, &volumes); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintf(w, "NAME\tDRIVER\tCREATED\tCONTAINERS\n")
+	}
+	for _, volume := range volumes {
+		if *quiet {
+			fmt.Fprintln(w, volume.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s ago\t%d\n",
+			volume.Name,
+			volume.Driver,
+			docker.HumanDuration(time.Now().Sub(time.Unix(volume.Created, 0))),
+			len(volume.Containers))
+	}
+	return w.Flush()
+}
+
+func (cli *DockerCli) volumeRm(args []string) error {
+	cmd := cli.Subcmd("volume rm", "VOLUME [VOLUME...]", "Remove volumes which aren't used by any container")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	var lastErr error
+	for _, name := range cmd.Args() {
+		if _, err := cli.client.Call("DELETE", "/volumes/"+name, nil); err != nil {
+			fmt.Fprintf(cli.err, "Error removing volume %s: %s\n", name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (cli *DockerCli) CmdCheckpoint(args ...string) error {
+	cmd := cli.Subcmd("checkpoint", "COMMAND [OPTIONS] [ARG...]", "Manage the checkpoints of containers (experimental)\n\nCommands:\n    create     Checkpoint a running container\n    ls         List the checkpoints of a container\n    rm         Remove a checkpoint")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "create":
+		return cli.checkpointCreate(cmd.Args()[1:])
+	case "ls":
+		return cli.checkpointLs(cmd.Args()[1:])
+	case "rm":
+		return cli.checkpointRm(cmd.Args()[1:])
+	}
+	return fmt.Errorf("No such checkpoint command: %s", cmd.Arg(0))
+}
+
+func (cli *DockerCli) checkpointCreate(args []string) error {
+	cmd := cli.Subcmd("checkpoint create", "[OPTIONS] CONTAINER CHECKPOINT", "Checkpoint a running container, and stop it")
+	flLeaveRunning := cmd.Bool("leave-running", false, "Leave the container running")
+	flDir := cmd.String("checkpoint-dir", "", "Store the checkpoint in this directory instead of the container directory")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("name", cmd.Arg(1))
+	v.Set("dir", *flDir)
+	if *flLeaveRunning {
+		v.Set("leave-running", "1")
+	}
+	if _, err := cli.client.Call("POST", "/containers/"+cmd.Arg(0)+"/checkpoints?"+v.Encode(), nil); err != nil {
+		return err
+	}
+	fmt.Fprintln(cli.out, cmd.Arg(1))
+	return nil
+}
+
+func (cli *DockerCli) checkpointLs(args []string) error {
+	cmd := cli.Subcmd("checkpoint ls", "[OPTIONS] CONTAINER", "List the checkpoints of a container")
+	flDir := cmd.String("checkpoint-dir", "", "List the checkpoints of this directory instead of the container directory")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("dir", *flDir)
+	body, err := cli.client.Call("GET", "/containers/"+cmd.Arg(0)+"/checkpoints?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var checkpoints []api.Checkpoint
+	if err := json.Unmarshal(body, &checkpoints); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "CHECKPOINT\tCREATED\n")
+	for _, checkpoint := range checkpoints {
+		fmt.Fprintf(w, "%s\t%s ago\n", checkpoint.Name, docker.HumanDuration(time.Now().Sub(time.Unix(checkpoint.Created, 0))))
+	}
+	return w.Flush()
+}
+
+func (cli *DockerCli) checkpointRm(args []string) error {
+	cmd := cli.Subcmd("checkpoint rm", "[OPTIONS] CONTAINER CHECKPOINT [CHECKPOINT...]", "Remove checkpoints of a container")
+	flDir := cmd.String("checkpoint-dir", "", "Remove the checkpoints from this directory instead of the container directory")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 2 {
+		cmd.Usage()
+		return nil
+	}
+	v := url.Values{}
+	v.Set("dir", *flDir)
+	for _, name := range cmd.Args()[1:] {
+		if _, err := cli.client.Call("DELETE", "/containers/"+cmd.Arg(0)+"/checkpoints/"+name+"?"+v.Encode(), nil); err != nil {
+			return err
+		}
+		fmt.Fprintln(cli.out, name)
+	}
+	return nil
+}
+
+func (cli *DockerCli) CmdSystem(args ...string) error {
+	cmd := cli.Subcmd("system", "COMMAND [OPTIONS] [ARG...]", "Manage the daemon\n\nCommands:\n    dedup      Link the identical files of the image layers\n    df         Show the disk usage\n    dial-stdio Proxy stdin and stdout to the daemon\n    prune      Remove the unused data")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "dedup":
+		return cli.systemDedup(cmd.Args()[1:])
+	case "df":
+		return cli.systemDf(cmd.Args()[1:])
+	case "dial-stdio":
+		return cli.systemDialStdio(cmd.Args()[1:])
+	case "prune":
+		return cli.systemPrune(cmd.Args()[1:])
+	}
+	return fmt.Errorf("No such system command: %s", cmd.Arg(0))
+}
+
+func (cli *DockerCli) systemDedup(args []string) error {
+	cmd := cli.Subcmd("system dedup", "", "Replace the identical files of different image layers by hard links to a single copy")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	body, err := cli.client.Call("POST", "/system/dedup", nil)
+	if err != nil {
+		return err
+	}
+	report := &api.DedupReport{}
+	if err := json.Unmarshal(body, report); err != nil {
+		return err
+	}
+	fmt.Fprintf(cli.out, "Linked %d files, reclaimed %s\n", report.FilesLinked, docker.HumanSize(report.SpaceReclaimed))
+	return nil
+}
+
+// systemDialStdio copies stdin to a connection to the daemon, and the
+// connection to stdout, for the clients connecting with ssh://
+func (cli *DockerCli) systemDialStdio(args []string) error {
+	cmd := cli.Subcmd("system dial-stdio", "", "Proxy stdin and stdout to the daemon, for the clients connecting over ssh")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	conn, err := cli.client.Dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		io.Copy(conn, cli.in)
+		if closer, ok := conn.(interface {
+			CloseWrite() error
+		}); ok {
+			closer.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(cli.out, conn)
+	return err
+}
+
+func (cli *DockerCli) systemDf(args []string) error {
+	cmd := cli.Subcmd("system df", "[OPTIONS]", "Show the disk usage of the images, the containers and the volumes")
+	verbose := cmd.Bool("v", false, "Show the usage of each image, container and volume")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	body, err := cli.client.Call("GET", "/system/df", nil)
+	if err != nil {
+		return err
+	}
+	usage := &api.DiskUsage{}
+	if err := json.Unmarshal(body, usage); err != nil {
+		return err
+	}
+	activeImages := 0
+	for _, image := range usage.Images {
+		if image.Containers > 0 {
+			activeImages++
+		}
+	}
+	var containersSize, containersReclaimable int64
+	activeContainers := 0
+	for _, container := range usage.Containers {
+		containersSize += container.Size
+		if container.Running {
+			activeContainers++
+		} else {
+			containersReclaimable += container.Size
+		}
+	}
+	var volumesSize, volumesReclaimable int64
+	activeVolumes := 0
+	for _, volume := range usage.Volumes {
+		volumesSize += volume.Size
+		if volume.Containers > 0 {
+			activeVolumes++
+		} else {
+			volumesReclaimable += volume.Size
+		}
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE\n")
+	fmt.Fprintf(w, "Images\t%d\t%d\t%s\t%s\n", len(usage.Images), activeImages, docker.HumanSize(usage.LayersSize), docker.HumanSize(usage.ImagesReclaimable))
+	fmt.Fprintf(w, "Containers\t%d\t%d\t%s\t%s\n", len(usage.Containers), activeContainers, docker.HumanSize(containersSize), docker.HumanSize(containersReclaimable))
+	fmt.Fprintf(w, "Volumes\t%d\t%d\t%s\t%s\n", len(usage.Volumes), activeVolumes, docker.HumanSize(volumesSize), docker.HumanSize(volumesReclaimable))
+	if !*verbose {
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "\nREPOSITORY\tTAG\tID\tSIZE\tSHARED SIZE\tUNIQUE SIZE\tCONTAINERS\n")
+	for _, image := range usage.Images {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", image.Repository, image.Tag, image.Id, docker.HumanSize(image.Size), docker.HumanSize(image.SharedSize), docker.HumanSize(image.UniqueSize), image.Containers)
+	}
+	fmt.Fprintf(w, "\nID\tIMAGE\tSTATUS\tSIZE\n")
+	for _, container := range usage.Containers {
+		status := "stopped"
+		if container.Running {
+			status = "running"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", container.Id, container.Image, status, docker.HumanSize(container.Size))
+	}
+	fmt.Fprintf(w, "\nVOLUME NAME\tDRIVER\tCONTAINERS\tSIZE\n")
+	for _, volume := range usage.Volumes {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", volume.Name, volume.Driver, volume.Containers, docker.HumanSize(volume.Size))
+	}
+	return w.Flush()
+}
+
+// The prune routes by kind of object, for 'docker system prune'
+var pruneRoutes = map[string]string{
+	"containers": "/containers/prune",
+	"images":     "/images/prune",
+	"volumes":    "/volumes/prune",
+}
+
+const pruneFilterUsage = "Only remove what matches KEY=VALUE: until=TIMESTAMP|DURATION, label=KEY[=VALUE], untagged=REPOSITORY[:TAG] for the dangling images which lost this tag"
+
+func (cli *DockerCli) systemPrune(args []string) error {
+	cmd := cli.Subcmd("system prune", "[OPTIONS] [containers|images|volumes]", "Remove the stopped containers, then the images and the volumes which aren't used, or only the given kind of objects")
+	var flFilters docker.ListOpts
+	cmd.Var(&flFilters, "f", pruneFilterUsage)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	path := "/system/prune"
+	if cmd.NArg() == 1 && pruneRoutes[cmd.Arg(0)] != "" {
+		path = pruneRoutes[cmd.Arg(0)]
+	} else if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	return cli.prune(path, flFilters)
+}
+
+func (cli *DockerCli) volumePrune(args []string) error {
+	cmd := cli.Subcmd("volume prune", "[OPTIONS]", "Remove the volumes which aren't used by any container")
+	var flFilters docker.ListOpts
+	cmd.Var(&flFilters, "f", pruneFilterUsage)
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	return cli.prune("/volumes/prune", flFilters)
+}
+
+// prune runs the prune operation of path, and prints what was removed
+func (cli *DockerCli) prune(path string, flFilters docker.ListOpts) error {
+	v := url.Values{}
+	if err := setFilters(v, flFilters); err != nil {
+		return err
+	}
+	body, err := cli.client.Call("POST", path+"?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	report := &api.PruneReport{}
+	if err := json.Unmarshal(body, report); err != nil {
+		return err
+	}
+	for _, deleted := range []struct {
+		title string
+		ids   []string
+	}{
+		{"Deleted Containers", report.ContainersDeleted},
+		{"Deleted Images", report.ImagesDeleted},
+		{"Deleted Volumes", report.VolumesDeleted},
+	} {
+		if len(deleted.ids) == 0 {
+			continue
+		}
+		fmt.Fprintf(cli.out, "%s:\n", deleted.title)
+		for _, id := range deleted.ids {
+			fmt.Fprintln(cli.out, id)
+		}
+		fmt.Fprintln(cli.out)
+	}
+	fmt.Fprintf(cli.out, "Total reclaimed space: %s\n", docker.HumanSize(report.SpaceReclaimed))
+	return nil
+}
+
+func (cli *DockerCli) CmdTrust(args ...string) error {
+	cmd := cli.Subcmd("trust", "COMMAND [OPTIONS] [ARG...]", "Manage the keys of the trusted publishers\n\nCommands:\n    add        Trust the signatures of a publisher\n    key        Print the public key signing the pushed images\n    ls         List the trusted keys\n    rm         Remove trusted keys")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	switch cmd.Arg(0) {
+	case "add":
+		return cli.trustAdd(cmd.Args()[1:])
+	case "key":
+		return cli.trustKey(cmd.Args()[1:])
+	case "ls":
+		return cli.trustLs(cmd.Args()[1:])
+	case "rm":
+		return cli.trustRm(cmd.Args()[1:])
+	}
+	return fmt.Errorf("No such trust command: %s", cmd.Arg(0))
+}
+
+func (cli *DockerCli) trustAdd(args []string) error {
+	cmd := cli.Subcmd("trust add", "NAME FILE", "Trust the signatures of the publisher whose public key, in PEM, is in FILE, or - for stdin")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return nil
+	}
+	var key []byte
+	var err error
+	if cmd.Arg(1) == "-" {
+		key, err = ioutil.ReadAll(cli.in)
+	} else {
+		key, err = ioutil.ReadFile(cmd.Arg(1))
+	}
+	if err != nil {
+		return err
+	}
+	body, err := cli.client.Call("POST", "/trust/keys", map[string]string{"Name": cmd.Arg(0), "Key": string(key)})
+	if err != nil {
+		return err
+	}
+	trusted := &api.TrustKey{}
+	if err := json.Unmarshal(body, trusted); err != nil {
+		return err
+	}
+	fmt.Fprintln(cli.out, trusted.Fingerprint)
+	return nil
+}
+
+func (cli *DockerCli) trustKey(args []string) error {
+	cmd := cli.Subcmd("trust key", "", "Print the public key signing the images pushed by the daemon, to be trusted by the daemons pulling them")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	body, err := cli.client.Call("GET", "/trust/signing-key", nil)
+	if err != nil {
+		return err
+	}
+	key := &api.TrustKey{}
+	if err := json.Unmarshal(body, key); err != nil {
+		return err
+	}
+	fmt.Fprint(cli.out, key.Key)
+	return nil
+}
+
+func (cli *DockerCli) trustLs(args []string) error {
+	cmd := cli.Subcmd("trust ls", "[OPTIONS]", "List the keys of the trusted publishers")
+	quiet := cmd.Bool("q", false, "only show names")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	body, err := cli.client.Call("GET", "/trust/keys", nil)
+	if err != nil {
+		return err
+	}
+	var keys []api.TrustKey
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cli.out, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintf(w, "NAME\tFINGERPRINT\n")
+	}
+	for _, key := range keys {
+		if *quiet {
+			fmt.Fprintln(w, key.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", key.Name, key.Fingerprint)
+	}
+	return w.Flush()
+}
+
+func (cli *DockerCli) trustRm(args []string) error {
+	cmd := cli.Subcmd("trust rm", "NAME [NAME...]", "Stop trusting the signatures of publishers")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	var lastErr error
+	for _, name := range cmd.Args() {
+		if _, err := cli.client.Call("DELETE", "/trust/keys/"+name, nil); err != nil {
+			fmt.Fprintf(cli.err, "Error removing key %s: %s\n", name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// CmdVerify checks a saved archive on the host of the client, without a
+// daemon, eg. before it is carried to an air-gapped host
+func (cli *DockerCli) CmdVerify(args ...string) error {
+	cmd := cli.Subcmd("verify", "[FILE]", "Verify the checksums and the consistency of an archive written by save, read from FILE or stdin, without loading it")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 1 {
+		cmd.Usage()
+		return nil
+	}
+	var archive io.Reader = cli.in
+	if cmd.NArg() == 1 && cmd.Arg(0) != "-" {
+		f, err := os.Open(cmd.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		archive = f
+	}
+	report, err := docker.VerifyImageArchive(archive)
+	if err != nil {
+		return err
+	}
+	for _, msg := range report.Errors {
+		fmt.Fprintf(cli.err, "Error: %s\n", msg)
+	}
+	if !report.Checksums {
+		fmt.Fprintf(cli.err, "Warning: the archive has no checksums, only its consistency was verified\n")
+	}
+	tags := 0
+	for _, repo := range report.Repositories {
+		tags += len(repo)
+	}
+	if !report.Valid() {
+		return &StatusError{Status: 1}
+	}
+	fmt.Fprintf(cli.out, "Verified %d images and %d tags\n", len(report.Images), tags)
+	return nil
+}
@@ -0,0 +1,213 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/api"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Commands whose arguments are containers or images, for dynamic completion
+var (
+	containerCommands = []string{"attach", "commit", "diff", "export", "inspect", "kill", "logs", "port", "restart", "rm", "start", "stop", "wait"}
+	imageCommands     = []string{"history", "inspect", "push", "rmi", "run", "tag"}
+)
+
+type completionCommand struct {
+	Name  string
+	Flags []string
+}
+
+var (
+	helpCommandRegexp = regexp.MustCompile(`(?m)^    (\S+)\s`)
+	helpFlagRegexp    = regexp.MustCompile(`(?m)^\s+-([a-zA-Z][^\s=]*)`)
+)
+
+// completionCommands lists the commands of the daemon and of the client,
+// with the flags of the latter
+func (cli *DockerCli) completionCommands() []completionCommand {
+	names := map[string]bool{"completion": true, "help": true}
+	for _, match := range helpCommandRegexp.FindAllStringSubmatch((&docker.Server{}).Help(), -1) {
+		names[match[1]] = true
+	}
+	var commands []completionCommand
+	for name := range names {
+		command := completionCommand{Name: name}
+		if HasCommand(name) && name != "completion" {
+			// Let the command print its usage to get its flags
+			usage := &bytes.Buffer{}
+			helpCli := *cli
+			helpCli.out, helpCli.err = usage, usage
+			helpCli.Cmd(name, "--help")
+			for _, match := range helpFlagRegexp.FindAllStringSubmatch(usage.String(), -1) {
+				command.Flags = append(command.Flags, "-"+match[1])
+			}
+		}
+		commands = append(commands, command)
+	}
+	sort.Sort(completionCommands(commands))
+	return commands
+}
+
+type completionCommands []completionCommand
+
+func (c completionCommands) Len() int           { return len(c) }
+func (c completionCommands) Less(i, j int) bool { return c[i].Name < c[j].Name }
+func (c completionCommands) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func globalFlags() []string {
+	var flags []string
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, "-"+f.Name)
+	})
+	return flags
+}
+
+var completionTemplates = map[string]string{
+	"bash": `# bash completion for docker
+# Load it with: source <(docker completion bash)
+
+_docker() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local cmd="" i
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case "${COMP_WORDS[i]}" in
+		-*) ;;
+		*) cmd="${COMP_WORDS[i]}"; break ;;
+		esac
+	done
+	if [ -z "$cmd" ]; then
+		if [[ "$cur" == -* ]]; then
+			COMPREPLY=($(compgen -W "{{join .GlobalFlags " "}}" -- "$cur"))
+		else
+			COMPREPLY=($(compgen -W "{{range .Commands}}{{.Name}} {{end}}" -- "$cur"))
+		fi
+		return
+	fi
+	local words=""
+	case "$cmd" in
+{{range .Commands}}{{if .Flags}}	{{.Name}}) [[ "$cur" == -* ]] && words="{{join .Flags " "}}" ;;
+{{end}}{{end}}	esac
+	if [ -z "$words" ]; then
+		case "$cmd" in
+		{{join .ContainerCommands "|"}}) words="$(docker completion containers 2>/dev/null)" ;;
+		esac
+		case "$cmd" in
+		{{join .ImageCommands "|"}}) words="$words $(docker completion images 2>/dev/null)" ;;
+		esac
+		if [ "$cmd" = completion ]; then
+			words="bash zsh"
+		fi
+	fi
+	COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -F _docker docker
+`,
+	"zsh": `#compdef docker
+# zsh completion for docker
+# Load it with: source <(docker completion zsh)
+
+_docker() {
+	local -a commands
+	commands=({{range .Commands}}{{.Name}} {{end}})
+	if (( CURRENT == 2 )); then
+		if [[ "$PREFIX" == -* ]]; then
+			compadd -- {{join .GlobalFlags " "}}
+		else
+			compadd -a commands
+		fi
+		return
+	fi
+	local cmd="${words[2]}"
+	if [[ "$PREFIX" == -* ]]; then
+		case "$cmd" in
+{{range .Commands}}{{if .Flags}}		{{.Name}}) compadd -- {{join .Flags " "}} ;;
+{{end}}{{end}}		esac
+		return
+	fi
+	case "$cmd" in
+	{{join .ContainerCommands "|"}}) compadd -- ${(f)"$(docker completion containers 2>/dev/null)"} ;;
+	esac
+	case "$cmd" in
+	{{join .ImageCommands "|"}}) compadd -- ${(f)"$(docker completion images 2>/dev/null)"} ;;
+	esac
+	if [[ "$cmd" == completion ]]; then
+		compadd bash zsh
+	fi
+}
+compdef _docker docker
+`,
+}
+
+// 'docker completion': print a shell completion script. The scripts call
+// 'docker completion containers|images' to complete names.
+func (cli *DockerCli) CmdCompletion(args ...string) error {
+	cmd := cli.Subcmd("completion", "bash|zsh|containers|images", "Generate a shell completion script, or list the names to complete")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	switch shell := cmd.Arg(0); shell {
+	case "containers":
+		return cli.completeContainers()
+	case "images":
+		return cli.completeImages()
+	default:
+		source, exists := completionTemplates[shell]
+		if !exists {
+			return fmt.Errorf("Unsupported shell: %s (expected bash or zsh)", shell)
+		}
+		tmpl, err := template.New(shell).Funcs(template.FuncMap{"join": strings.Join}).Parse(source)
+		if err != nil {
+			return err
+		}
+		return tmpl.Execute(cli.out, map[string]interface{}{
+			"Commands":          cli.completionCommands(),
+			"GlobalFlags":       globalFlags(),
+			"ContainerCommands": containerCommands,
+			"ImageCommands":     imageCommands,
+		})
+	}
+}
+
+func (cli *DockerCli) completeContainers() error {
+	body, err := cli.client.Call("GET", "/containers/json?all=1", nil)
+	if err != nil {
+		return err
+	}
+	var containers []api.Containers
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return err
+	}
+	for _, container := range containers {
+		fmt.Fprintln(cli.out, container.Id)
+	}
+	return nil
+}
+
+func (cli *DockerCli) completeImages() error {
+	body, err := cli.client.Call("GET", "/images/json", nil)
+	if err != nil {
+		return err
+	}
+	var images []api.Images
+	if err := json.Unmarshal(body, &images); err != nil {
+		return err
+	}
+	for _, image := range images {
+		if image.Repository != "<none>" {
+			fmt.Fprintf(cli.out, "%s:%s\n", image.Repository, image.Tag)
+		}
+		fmt.Fprintln(cli.out, image.Id)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/client"
+	"io"
+	"strings"
+)
+
+// The key sequence which detaches the client from a container attached to a
+// tty, leaving the container running
+const DEFAULT_DETACH_KEYS = "ctrl-p,ctrl-q"
+
+// errDetached is returned by the streams of an attached container once the
+// detach sequence was read from stdin
+var errDetached = client.ErrDetached
+
+// parseDetachKeys parses a comma-separated key sequence. A key is a single
+// character, or ctrl- followed by a letter or one of @[\]^_
+func parseDetachKeys(keys string) ([]byte, error) {
+	var sequence []byte
+	for _, key := range strings.Split(keys, ",") {
+		switch {
+		case len(key) == 1:
+			sequence = append(sequence, key[0])
+		case len(key) == 6 && strings.HasPrefix(strings.ToLower(key), "ctrl-"):
+			c := strings.ToUpper(key[5:])[0]
+			if (c < 'A' || c > 'Z') && !strings.ContainsRune("@[\\]^_", rune(c)) {
+				return nil, fmt.Errorf("Invalid detach key: %s", key)
+			}
+			sequence = append(sequence, c&0x1f)
+		default:
+			return nil, fmt.Errorf("Invalid detach key: %s", key)
+		}
+	}
+	return sequence, nil
+}
+
+// detachReader forwards r until it reads the detach sequence, then returns
+// errDetached. The beginning of the sequence is held back until the next
+// key shows whether it is part of the sequence.
+type detachReader struct {
+	r       io.Reader
+	keys    []byte
+	matched int
+	pending []byte
+	err     error
+}
+
+func newDetachReader(r io.Reader, keys []byte) *detachReader {
+	return &detachReader{r: r, keys: keys}
+}
+
+func (d *detachReader) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.matched == len(d.keys) {
+			return 0, errDetached
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		buf := make([]byte, len(p))
+		n, err := d.r.Read(buf)
+		for _, c := range buf[:n] {
+			if c == d.keys[d.matched] {
+				if d.matched++; d.matched == len(d.keys) {
+					break
+				}
+				continue
+			}
+			d.pending = append(d.pending, d.keys[:d.matched]...)
+			d.matched = 0
+			if c == d.keys[0] {
+				d.matched = 1
+			} else {
+				d.pending = append(d.pending, c)
+			}
+		}
+		if err != nil && d.matched < len(d.keys) {
+			// The keys held back were not a detach sequence
+			d.pending = append(d.pending, d.keys[:d.matched]...)
+			d.matched = 0
+			d.err = err
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
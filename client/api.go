@@ -0,0 +1,285 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"io"
+	"net/url"
+	"strings"
+)
+
+func (c *Client) Version() (*api.Version, error) {
+	version := &api.Version{}
+	if err := c.callJSON("GET", "/version", nil, version); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+func (c *Client) Info() (*api.Info, error) {
+	info := &api.Info{}
+	if err := c.callJSON("GET", "/info", nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// ContainerList lists the running containers, or all of them
+func (c *Client) ContainerList(all bool) ([]api.Containers, error) {
+	v := url.Values{}
+	if all {
+		v.Set("all", "1")
+	}
+	var containers []api.Containers
+	if err := c.callJSON("GET", "/containers/json?"+v.Encode(), nil, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// ContainerCreate creates a container and returns its id. It fails with
+// a 404 (see IsNotFound) if the image isn't there: it isn't pulled.
+func (c *Client) ContainerCreate(config *api.Config) (string, error) {
+	created := &api.Id{}
+	if err := c.callJSON("POST", "/containers/create", config, created); err != nil {
+		return "", err
+	}
+	return created.Id, nil
+}
+
+func (c *Client) ContainerInspect(name string) (*api.Container, error) {
+	container := &api.Container{}
+	if err := c.callJSON("GET", "/containers/"+name+"/json", nil, container); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+func (c *Client) ContainerStart(name string) error {
+	_, err := c.Call("POST", "/containers/"+name+"/start", nil)
+	return err
+}
+
+func (c *Client) ContainerStop(name string) error {
+	_, err := c.Call("POST", "/containers/"+name+"/stop", nil)
+	return err
+}
+
+func (c *Client) ContainerRestart(name string) error {
+	_, err := c.Call("POST", "/containers/"+name+"/restart", nil)
+	return err
+}
+
+// ContainerKill sends signal to the container, by name or number, or kills
+// it with SIGKILL if signal is empty
+func (c *Client) ContainerKill(name, signal string) error {
+	path := "/containers/" + name + "/kill"
+	if signal != "" {
+		path += "?signal=" + url.QueryEscape(signal)
+	}
+	_, err := c.Call("POST", path, nil)
+	return err
+}
+
+func (c *Client) ContainerRemove(name string) error {
+	_, err := c.Call("DELETE", "/containers/"+name, nil)
+	return err
+}
+
+// ContainerWait blocks until the container stops, and returns its exit code
+func (c *Client) ContainerWait(name string) (int, error) {
+	wait := &api.Wait{}
+	if err := c.callJSON("POST", "/containers/"+name+"/wait", nil, wait); err != nil {
+		return -1, err
+	}
+	return wait.StatusCode, nil
+}
+
+// AttachOptions are the streams of a container to attach to. Tty must be
+// the Tty of the config of the container: its output is only multiplexed
+// without a tty.
+type AttachOptions struct {
+	Stdin  io.Reader // Not attached if nil
+	Stdout io.Writer // Not attached if nil
+	Stderr io.Writer // Not attached if nil
+	Tty    bool
+	Logs   bool // Replay the logs first
+	// Closed once the daemon answered, eg. to start the container only
+	// once attached. May be nil.
+	Started chan struct{}
+}
+
+// ContainerAttach attaches to the streams of a container until it exits,
+// or until Stdin returns ErrDetached.
+func (c *Client) ContainerAttach(name string, options *AttachOptions) error {
+	v := url.Values{}
+	v.Set("stream", "1")
+	if options.Logs {
+		v.Set("logs", "1")
+	}
+	for stream, attached := range map[string]bool{
+		"stdin":  options.Stdin != nil,
+		"stdout": options.Stdout != nil,
+		"stderr": options.Stderr != nil,
+	} {
+		if attached {
+			v.Set(stream, "1")
+		}
+	}
+	return c.Hijack("POST", "/containers/"+name+"/attach?"+v.Encode(), options.Tty, options.Stdin, options.Stdout, options.Stderr, options.Started)
+}
+
+// ContainerLogs copies the logs of a container to stdout and stderr (not
+// sent if nil). With follow, it keeps copying the output until the
+// container exits. tty is the Tty of the config of the container.
+func (c *Client) ContainerLogs(name string, follow, tty bool, stdout, stderr io.Writer) error {
+	v := url.Values{}
+	if stdout != nil {
+		v.Set("stdout", "1")
+	}
+	if stderr != nil {
+		v.Set("stderr", "1")
+	}
+	path := "/containers/" + name + "/logs?"
+	if follow {
+		v.Set("follow", "1")
+		return c.Hijack("GET", path+v.Encode(), tty, nil, stdout, stderr, nil)
+	}
+	res, err := c.Do("GET", path+v.Encode(), nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if tty {
+		_, err = io.Copy(stdout, res.Body)
+	} else {
+		_, err = api.StdCopy(stdout, stderr, res.Body)
+	}
+	return err
+}
+
+// ErrStopEvents can be returned by the handler of Events to stop following
+// the events without an error
+var ErrStopEvents = errors.New("Stop following the events")
+
+// EventsOptions select the events received by Events
+type EventsOptions struct {
+	Since   int64               // Unix timestamp of the first past event, if not 0
+	Until   int64               // Unix timestamp after which to stop, if not 0
+	Filters map[string][]string // By type, event, container, image or label
+}
+
+// Events calls handler with the events of the daemon as they happen, until
+// handler returns an error, or until options.Until.
+func (c *Client) Events(options *EventsOptions, handler func(api.Event) error) error {
+	v := url.Values{}
+	if options.Since != 0 {
+		v.Set("since", fmt.Sprintf("%d", options.Since))
+	}
+	if options.Until != 0 {
+		v.Set("until", fmt.Sprintf("%d", options.Until))
+	}
+	if len(options.Filters) > 0 {
+		filters, err := json.Marshal(options.Filters)
+		if err != nil {
+			return err
+		}
+		v.Set("filters", string(filters))
+	}
+	res, err := c.Do("GET", "/events?"+v.Encode(), nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var event api.Event
+		if err := decoder.Decode(&event); err == io.EOF && options.Until != 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := handler(event); err == ErrStopEvents {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// ImageList lists the images, all of them including the intermediate ones
+// with all
+func (c *Client) ImageList(all bool) ([]api.Images, error) {
+	v := url.Values{}
+	if all {
+		v.Set("all", "1")
+	}
+	var images []api.Images
+	if err := c.callJSON("GET", "/images/json?"+v.Encode(), nil, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (c *Client) ImageInspect(name string) (*api.Image, error) {
+	img := &api.Image{}
+	if err := c.callJSON("GET", "/images/"+name+"/json", nil, img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// ImageRemove untags or deletes an image, and returns what was done
+func (c *Client) ImageRemove(name string) ([]api.Rmi, error) {
+	var removed []api.Rmi
+	if err := c.callJSON("DELETE", "/images/"+name, nil, &removed); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// ImagePull pulls an image or a repository, copying the progress to
+// progress
+func (c *Client) ImagePull(name string, progress io.Writer) error {
+	return c.progress("/images/create?fromImage="+url.QueryEscape(name), progress)
+}
+
+// ImagePush pushes an image or a repository, like ImagePull
+func (c *Client) ImagePush(name string, progress io.Writer) error {
+	return c.progress("/images/"+name+"/push", progress)
+}
+
+// progress sends a POST whose response is the plain text progress of an
+// operation. Once it started, the daemon reports its failure on the last
+// line of the progress.
+func (c *Client) progress(path string, progress io.Writer) error {
+	last := &LastLineWriter{}
+	if err := c.Stream("POST", path, nil, "", io.MultiWriter(progress, last)); err != nil {
+		return err
+	}
+	if line := last.LastLine(); strings.HasPrefix(line, "Error: ") {
+		return errors.New(strings.TrimPrefix(line, "Error: "))
+	}
+	return nil
+}
+
+// LastLineWriter remembers the last line written to it, eg. to check
+// whether the progress of an operation ended with an error
+type LastLineWriter struct {
+	buf []byte
+}
+
+func (w *LastLineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if i := bytes.LastIndex(bytes.TrimRight(w.buf, "\n"), []byte("\n")); i >= 0 {
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *LastLineWriter) LastLine() string {
+	return strings.TrimSpace(string(w.buf))
+}
@@ -0,0 +1,262 @@
+// Package client is a Go client of the docker remote API, for the programs
+// which drive the daemon without going through the docker command.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client sends requests to the API of a daemon
+type Client struct {
+	proto     string
+	addr      string
+	tlsConfig *tls.Config
+	client    *http.Client // Shared by the requests, which reuse its connections
+}
+
+// NewClient returns a client of the API served at host, as given to
+// 'docker -H': unix://PATH, tcp://HOST:PORT, ssh://[USER@]HOST[:PORT] for
+// the default socket of a remote host, or the default socket if empty.
+// tlsConfig may be nil.
+func NewClient(host string, tlsConfig *tls.Config) (*Client, error) {
+	proto, addr, err := api.ParseHost(host)
+	if err != nil {
+		return nil, err
+	}
+	if proto == "fd" {
+		return nil, fmt.Errorf("%s is only served by the daemon, started by systemd", host)
+	}
+	if proto == "ssh" && tlsConfig != nil {
+		return nil, fmt.Errorf("TLS can't be used over %s, which is already encrypted", host)
+	}
+	c := &Client{
+		proto:     proto,
+		addr:      addr,
+		tlsConfig: tlsConfig,
+	}
+	// Dial takes care of TLS, the transport only sees a connection
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) { return c.Dial() },
+		},
+	}
+	return c, nil
+}
+
+// ErrDetached is returned by Hijack once its input returned it, eg. when
+// the detach key sequence of an attached tty was read. The container is
+// left running.
+var ErrDetached = errors.New("Detached from the container")
+
+// Error is returned when the daemon answers with an error status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Error: %s", http.StatusText(e.StatusCode))
+	}
+	return e.Message
+}
+
+// IsNotFound returns true if err is a 404 answered by the daemon, eg. for
+// a container or an image which doesn't exist
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Dial connects to the daemon, eg. to proxy its API
+func (c *Client) Dial() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if c.proto == "ssh" {
+		conn, err = dialSSH(c.addr)
+	} else {
+		conn, err = net.Dial(c.proto, c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to the docker daemon at %s://%s. Is 'docker -d' running on this host?", c.proto, c.addr)
+	}
+	if c.tlsConfig != nil {
+		config := c.tlsConfig
+		if config.ServerName == "" && c.proto == "tcp" {
+			// Verify the certificate against the host we connect to
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(c.addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return conn, nil
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, "/v"+api.API_VERSION+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = c.addr
+	if c.proto == "unix" || c.proto == "ssh" {
+		// The host is meaningless on a unix socket
+		req.Host = "docker"
+	}
+	req.Header.Set("User-Agent", "Docker-Client/"+api.VERSION)
+	return req, nil
+}
+
+// Do sends a request to path, relative to the version of the API, and
+// returns the response, or an *Error if the daemon didn't answer with a 2xx
+// status. The body of the response must be closed.
+func (c *Client) Do(method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.URL.Scheme, req.URL.Host = "http", req.Host
+	res, err := c.client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return nil, urlErr.Err
+		}
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		defer res.Body.Close()
+		msg, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &Error{res.StatusCode, strings.TrimSpace(string(msg))}
+	}
+	return res, nil
+}
+
+// Call sends data (if not nil) encoded as JSON, and returns the body of
+// the response
+func (c *Client) Call(method, path string, data interface{}) ([]byte, error) {
+	var (
+		body        io.Reader
+		contentType string
+	)
+	if data != nil {
+		buf, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		body, contentType = bytes.NewReader(buf), "application/json"
+	}
+	res, err := c.Do(method, path, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// callJSON is Call decoding the response into result
+func (c *Client) callJSON(method, path string, data, result interface{}) error {
+	body, err := c.Call(method, path, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+// Stream sends in (if not nil) with the given content type, and copies the
+// body of the response to out as it is received
+func (c *Client) Stream(method, path string, in io.Reader, contentType string, out io.Writer) error {
+	res, err := c.Do(method, path, in, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(out, res.Body)
+	return err
+}
+
+// Hijack sends a request which takes over the connection, then copies in
+// to the connection and the streams of the response to stdout and stderr.
+// Unless tty is set, the response is demultiplexed with api.StdCopy.
+// started is closed once the daemon answered, if not nil. If in returns
+// ErrDetached, the connection is closed and ErrDetached is returned.
+func (c *Client) Hijack(method, path string, tty bool, in io.Reader, stdout, stderr io.Writer, started chan struct{}) error {
+	req, err := c.newRequest(method, path, nil)
+	if err != nil {
+		return err
+	}
+	conn, err := c.Dial()
+	if err != nil {
+		if started != nil {
+			close(started)
+		}
+		return err
+	}
+	defer conn.Close()
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if started != nil {
+		close(started)
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return &Error{res.StatusCode, strings.TrimSpace(string(msg))}
+	}
+
+	detached := make(chan struct{})
+	if in != nil {
+		go func() {
+			if _, err := io.Copy(conn, in); err == ErrDetached {
+				// Leave the container running: its stdin isn't closed,
+				// the daemon stops sending the output once the
+				// connection is gone
+				close(detached)
+				conn.Close()
+				return
+			}
+			if closer, ok := conn.(interface {
+				CloseWrite() error
+			}); ok {
+				closer.CloseWrite()
+			}
+		}()
+	}
+	if tty {
+		_, err = io.Copy(stdout, br)
+	} else {
+		_, err = api.StdCopy(stdout, stderr, br)
+	}
+	select {
+	case <-detached:
+		return ErrDetached
+	default:
+	}
+	return err
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// newTestClient returns a client of a fake daemon serving handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	c, err := NewClient("tcp://"+strings.TrimPrefix(server.URL, "http://"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, server
+}
+
+func TestNewClient(t *testing.T) {
+	for host, expected := range map[string]string{
+		"":                    "unix://" + api.DEFAULT_API_SOCKET,
+		"unix:///tmp/d.sock":  "unix:///tmp/d.sock",
+		"tcp://1.2.3.4:4243":  "tcp://1.2.3.4:4243",
+		"ssh://alice@1.2.3.4": "ssh://alice@1.2.3.4",
+	} {
+		c, err := NewClient(host, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.proto+"://"+c.addr != expected {
+			t.Errorf("Expected %s for %q, got %s://%s", expected, host, c.proto, c.addr)
+		}
+	}
+	for _, host := range []string{"1.2.3.4:4243", "tcp://1.2.3.4", "fd://"} {
+		if _, err := NewClient(host, nil); err == nil {
+			t.Errorf("%q should be refused", host)
+		}
+	}
+	if _, err := NewClient("ssh://1.2.3.4", &tls.Config{}); err == nil {
+		t.Errorf("TLS over ssh:// should be refused")
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"1.2.3.4":            "-- 1.2.3.4 docker system dial-stdio",
+		"alice@1.2.3.4:2222": "-p 2222 -- alice@1.2.3.4 docker system dial-stdio",
+		"alice@[::1]":        "-- alice@[::1] docker system dial-stdio",
+		"[::1]:2222":         "-p 2222 -- [::1] docker system dial-stdio",
+	} {
+		if args := strings.Join(sshArgs(addr), " "); args != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, addr, args)
+		}
+	}
+}
+
+func TestDialSSH(t *testing.T) {
+	// A fake ssh echoing the connection
+	dir, err := ioutil.TempDir("", "docker-ssh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(path.Join(dir, "ssh"), []byte("#!/bin/sh\nexec cat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	c, err := NewClient("ssh://alice@1.2.3.4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := c.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	conn.(*sshConn).CloseWrite()
+	if data, err := ioutil.ReadAll(conn); err != nil || string(data) != "ping" {
+		t.Errorf("Expected the echo of ping, got %q, %v", data, err)
+	}
+}
+
+func TestReuseConnections(t *testing.T) {
+	c, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&api.Version{Version: api.VERSION})
+	})
+	var conns int
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns++
+		}
+	}
+	defer server.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Version(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conns != 1 {
+		t.Errorf("Expected the requests to share a connection, got %d connections", conns)
+	}
+}
+
+func TestContainerCreate(t *testing.T) {
+	c, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v"+api.API_VERSION+"/containers/create" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		config := &api.Config{}
+		if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+			t.Fatal(err)
+		}
+		if config.Image != "base" {
+			http.Error(w, "No such image: "+config.Image, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&api.Id{Id: "abc"})
+	})
+	defer server.Close()
+	if id, err := c.ContainerCreate(&api.Config{Image: "base", Cmd: []string{"true"}}); err != nil || id != "abc" {
+		t.Fatalf("Expected the container abc, got %q (%v)", id, err)
+	}
+	_, err := c.ContainerCreate(&api.Config{Image: "missing"})
+	if !IsNotFound(err) || err.Error() != "No such image: missing" {
+		t.Fatalf("Expected a 404, got %v", err)
+	}
+}
+
+func TestContainerKill(t *testing.T) {
+	var signals []string
+	c, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v"+api.API_VERSION+"/containers/abc/kill" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		signals = append(signals, r.FormValue("signal"))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer server.Close()
+	for _, signal := range []string{"", "SIGRTMIN+1"} {
+		if err := c.ContainerKill("abc", signal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(signals, ",") != ",SIGRTMIN+1" {
+		t.Fatalf("Unexpected signals: %q", signals)
+	}
+}
+
+func TestContainerLogs(t *testing.T) {
+	c, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("stdout") != "1" || r.FormValue("stderr") != "1" || r.FormValue("follow") != "" {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		api.NewStdWriter(w, api.STDOUT).Write([]byte("out\n"))
+		api.NewStdWriter(w, api.STDERR).Write([]byte("err\n"))
+	})
+	defer server.Close()
+	var stdout, stderr bytes.Buffer
+	if err := c.ContainerLogs("abc", false, false, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Fatalf("Unexpected logs: %q, %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("since") != "42" || r.FormValue("filters") != `{"type":["container"]}` {
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL)
+		}
+		encoder := json.NewEncoder(w)
+		for _, status := range []string{"create", "start", "die"} {
+			encoder.Encode(&api.Event{Status: status, Id: "abc", Time: 42})
+		}
+	})
+	defer server.Close()
+	var received []string
+	err := c.Events(&EventsOptions{Since: 42, Filters: map[string][]string{"type": {"container"}}}, func(event api.Event) error {
+		received = append(received, event.Status)
+		if event.Status == "start" {
+			return ErrStopEvents
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(received, ",") != "create,start" {
+		t.Fatalf("Unexpected events: %v", received)
+	}
+}
+
+func TestImagePull(t *testing.T) {
+	c, server := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("fromImage")
+		fmt.Fprintf(w, "Pulling repository %s\n", name)
+		if name == "missing" {
+			fmt.Fprintf(w, "Error: No such repository: %s\n", name)
+		}
+	})
+	defer server.Close()
+	var progress bytes.Buffer
+	if err := c.ImagePull("base", &progress); err != nil {
+		t.Fatal(err)
+	}
+	if progress.String() != "Pulling repository base\n" {
+		t.Errorf("Unexpected progress: %q", progress.String())
+	}
+	if err := c.ImagePull("missing", &progress); err == nil || err.Error() != "No such repository: missing" {
+		t.Fatalf("Expected the error of the pull, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// With ssh://[USER@]HOST[:PORT], each connection to the daemon is a
+// 'docker system dial-stdio' run on the remote host by ssh, which copies its
+// stdin and stdout to the default socket of the daemon there. ssh takes care
+// of the authentication, with the keys, agent and configuration of the user.
+
+// sshArgs returns the arguments of ssh connecting to the daemon at addr,
+// [USER@]HOST[:PORT]
+func sshArgs(addr string) []string {
+	var args []string
+	userHost := addr
+	if i := strings.LastIndex(addr, ":"); i > strings.LastIndex(addr, "]") {
+		userHost = addr[:i]
+		args = append(args, "-p", addr[i+1:])
+	}
+	return append(args, "--", userHost, "docker", "system", "dial-stdio")
+}
+
+// sshConn is a connection to the daemon through the stdin and stdout of ssh
+type sshConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func dialSSH(addr string) (net.Conn, error) {
+	cmd := exec.Command("ssh", sshArgs(addr)...)
+	// The prompts of ssh go to the terminal, its errors to stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshConn{cmd, stdin, stdout}, nil
+}
+
+func (conn *sshConn) Read(p []byte) (int, error) {
+	return conn.stdout.Read(p)
+}
+
+func (conn *sshConn) Write(p []byte) (int, error) {
+	return conn.stdin.Write(p)
+}
+
+// CloseWrite closes the stdin of ssh, which closes the writing side of the
+// connection to the socket on the remote host
+func (conn *sshConn) CloseWrite() error {
+	return conn.stdin.Close()
+}
+
+func (conn *sshConn) Close() error {
+	conn.stdin.Close()
+	conn.cmd.Process.Kill()
+	// Killed
+	conn.cmd.Wait()
+	return nil
+}
+
+// sshAddr is the address of both ends of an sshConn
+type sshAddr struct{}
+
+func (sshAddr) Network() string { return "ssh" }
+func (sshAddr) String() string  { return "ssh" }
+
+func (conn *sshConn) LocalAddr() net.Addr  { return sshAddr{} }
+func (conn *sshConn) RemoteAddr() net.Addr { return sshAddr{} }
+
+// The pipes have no deadlines
+func (conn *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (conn *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *sshConn) SetWriteDeadline(t time.Time) error { return nil }
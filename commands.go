@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/dotcloud/docker/api"
 	"github.com/dotcloud/docker/auth"
 	"github.com/dotcloud/docker/rcli"
 	"io"
 	"log"
-	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"runtime"
 	"strconv"
 	"strings"
@@ -19,26 +21,52 @@ import (
 	"time"
 )
 
-const VERSION = "0.1.0"
+const VERSION = api.VERSION
 
 func (srv *Server) Name() string {
 	return "docker"
 }
 
+// InterceptCall serves the rcli command cmd with serve, once the
+// authorization plugins allowed it, and logs it to the audit log if it
+// changes the state of the daemon
+func (srv *Server) InterceptCall(cmd string, args []string, serve func() error) error {
+	if srv.audit == nil || !auditedCommands[cmd] {
+		return srv.authorizeCall(cmd, args, serve)
+	}
+	entry := &AuditEntry{
+		Time:   time.Now().UTC(),
+		Method: "RCLI",
+		Path:   strings.Join(append([]string{cmd}, args...), " "),
+	}
+	err := srv.authorizeCall(cmd, args, serve)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := srv.audit.Log(entry); err != nil {
+		apiLog.Errorf("Failed to write the audit log: %s", err)
+	}
+	return err
+}
+
 // FIXME: Stop violating DRY by repeating usage here and in Subcmd declarations
 func (srv *Server) Help() string {
 	help := "Usage: docker COMMAND [arg...]\n\nA self-sufficient runtime for linux containers.\n\nCommands:\n"
 	for _, cmd := range [][]interface{}{
 		{"attach", "Attach to a running container"},
+		{"build", "Build an image from a Dockerfile"},
 		{"commit", "Create a new image from a container's changes"},
+		{"completion", "Generate a shell completion script"},
 		{"diff", "Inspect changes on a container's filesystem"},
+		{"events", "Get real time events from the server"},
 		{"export", "Stream the contents of a container as a tar archive"},
 		{"history", "Show the history of an image"},
 		{"images", "List images"},
 		{"import", "Create a new filesystem image from the contents of a tarball"},
 		{"info", "Display system-wide information"},
 		{"inspect", "Return low-level information on a container"},
-		{"kill", "Kill a running container"},
+		{"kill", "Kill a running container, or send it a signal"},
+		{"load", "Load images saved by save from a tar archive on stdin"},
 		{"login", "Register or Login to the docker registry server"},
 		{"logs", "Fetch the logs of a container"},
 		{"port", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT"},
@@ -49,33 +77,53 @@ func (srv *Server) Help() string {
 		{"rm", "Remove a container"},
 		{"rmi", "Remove an image"},
 		{"run", "Run a command in a new container"},
+		{"save", "Save images with their history and tags to a tar archive on stdout"},
+		{"search", "Search for an image in the docker registry"},
 		{"start", "Start a stopped container"},
 		{"stop", "Stop a running container"},
+		{"system", "Manage the daemon"},
 		{"tag", "Tag an image into a repository"},
+		{"trust", "Manage the keys of the trusted publishers"},
+		{"verify", "Verify an archive written by save, without loading it"},
 		{"version", "Show the docker version information"},
+		{"volume", "Manage volumes"},
 		{"wait", "Block until a container stops, then print its exit code"},
 	} {
-		help += fmt.Sprintf("    %-10.10s%s\n", cmd[0], cmd[1])
+		help += fmt.Sprintf("    %-11.11s%s\n", cmd[0], cmd[1])
 	}
 	return help
 }
 
 // 'docker login': login / register a user to registry service.
 func (srv *Server) CmdLogin(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "login", "", "Register or Login to the docker registry server")
+	cmd := rcli.Subcmd(stdout, "login", "[SERVER]", "Register or Login to a docker registry server (defaults to "+auth.REGISTRY_SERVER+")")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
+	if cmd.NArg() > 1 {
+		cmd.Usage()
+		return nil
+	}
+	serverAddress := auth.REGISTRY_SERVER
+	if cmd.NArg() == 1 {
+		serverAddress = cmd.Arg(0)
+		// A bare hostname is reached the same way as for push and pull
+		if !strings.Contains(serverAddress, "://") {
+			serverAddress = strings.TrimSuffix(srv.runtime.registryEndpoint(serverAddress), "/v1")
+		}
+	}
 	var username string
 	var password string
 	var email string
 
-	fmt.Fprint(stdout, "Username (", srv.runtime.authConfig.Username, "): ")
+	authConfig := srv.runtime.authConfigFile.ResolveAuthConfig(serverAddress)
+
+	fmt.Fprint(stdout, "Username (", authConfig.Username, "): ")
 	fmt.Fscanf(stdin, "%s", &username)
 	if username == "" {
-		username = srv.runtime.authConfig.Username
+		username = authConfig.Username
 	}
-	if username != srv.runtime.authConfig.Username {
+	if username != authConfig.Username {
 		fmt.Fprint(stdout, "Password: ")
 		fmt.Fscanf(stdin, "%s", &password)
 
@@ -83,24 +131,26 @@ func (srv *Server) CmdLogin(stdin io.ReadCloser, stdout io.Writer, args ...strin
 			return errors.New("Error : Password Required\n")
 		}
 
-		fmt.Fprint(stdout, "Email (", srv.runtime.authConfig.Email, "): ")
+		fmt.Fprint(stdout, "Email (", authConfig.Email, "): ")
 		fmt.Fscanf(stdin, "%s", &email)
 		if email == "" {
-			email = srv.runtime.authConfig.Email
+			email = authConfig.Email
 		}
 	} else {
-		password = srv.runtime.authConfig.Password
-		email = srv.runtime.authConfig.Email
+		password = authConfig.Password
+		email = authConfig.Email
 	}
-	newAuthConfig := auth.NewAuthConfig(username, password, email, srv.runtime.root)
-	status, err := auth.Login(newAuthConfig)
+	newAuthConfig := auth.NewAuthConfig(username, password, email, serverAddress)
+	status, err := auth.Login(newAuthConfig, srv.runtime.graph.registryTransport())
 	if err != nil {
 		fmt.Fprintf(stdout, "Error : %s\n", err)
 	} else {
-		srv.runtime.authConfig = newAuthConfig
+		if err := srv.runtime.authConfigFile.Set(serverAddress, *newAuthConfig); err != nil {
+			return err
+		}
 	}
 	if status != "" {
-		fmt.Fprintf(stdout, status)
+		fmt.Fprint(stdout, status)
 	}
 	return nil
 }
@@ -125,21 +175,72 @@ func (srv *Server) CmdWait(stdin io.ReadCloser, stdout io.Writer, args ...string
 	return nil
 }
 
+// 'docker events': stream the events of the runtime
+func (srv *Server) CmdEvents(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "events", "[OPTIONS]", "Get real time events from the server")
+	flSince := cmd.String("since", "", "Show previously created events since this unix timestamp")
+	flUntil := cmd.String("until", "", "Stop streaming the events at this unix timestamp")
+	var flFilters ListOpts
+	cmd.Var(&flFilters, "f", "Filter output with KEY=VALUE: type=container|image|trust, event=STATUS, container=ID, image=IMAGE, label=KEY[=VALUE]")
+	flFormat := cmd.String("format", "", "Print each event as JSON with 'json'")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() > 0 || (*flFormat != "" && *flFormat != "json") {
+		cmd.Usage()
+		return nil
+	}
+	var since, until int64
+	for _, flag := range []struct {
+		value     string
+		timestamp *int64
+	}{{*flSince, &since}, {*flUntil, &until}} {
+		if flag.value == "" {
+			continue
+		}
+		var err error
+		if *flag.timestamp, err = strconv.ParseInt(flag.value, 10, 64); err != nil {
+			return fmt.Errorf("Invalid timestamp: %s", flag.value)
+		}
+	}
+	filters, err := parseFilterOpts(flFilters)
+	if err != nil {
+		return err
+	}
+	filter, err := srv.parseEventFilters(filters)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(stdout)
+	// Stop once the client is gone
+	srv.Events(since, until, filter, nil, func(event Event) error {
+		if *flFormat == "json" {
+			return encoder.Encode(&event)
+		}
+		line := fmt.Sprintf("[%s] %s:", time.Unix(event.Time, 0).Format(time.RFC3339), event.Id)
+		if event.From != "" {
+			line += fmt.Sprintf(" (from %s)", srv.runtime.repositories.ImageName(event.From))
+		}
+		line += " " + event.Status
+		for key, value := range event.Attributes {
+			line += fmt.Sprintf(" %s=%s", key, value)
+		}
+		_, err := fmt.Fprintln(stdout, line)
+		return err
+	})
+	return nil
+}
+
 // 'docker version': show version information
 func (srv *Server) CmdVersion(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	fmt.Fprintf(stdout, "Version:%s\n", VERSION)
+	fmt.Fprintf(stdout, "API version:%s\n", API_VERSION)
+	fmt.Fprintf(stdout, "Go version:%s\n", runtime.Version())
 	return nil
 }
 
 // 'docker info': display system-wide information.
 func (srv *Server) CmdInfo(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	images, _ := srv.runtime.graph.All()
-	var imgcount int
-	if images == nil {
-		imgcount = 0
-	} else {
-		imgcount = len(images)
-	}
 	cmd := rcli.Subcmd(stdout, "info", "", "Display system-wide information.")
 	if err := cmd.Parse(args); err != nil {
 		return nil
@@ -148,10 +249,49 @@ func (srv *Server) CmdInfo(stdin io.ReadCloser, stdout io.Writer, args ...string
 		cmd.Usage()
 		return nil
 	}
-	fmt.Fprintf(stdout, "containers: %d\nversion: %s\nimages: %d\n",
-		len(srv.runtime.List()),
-		VERSION,
-		imgcount)
+	return WriteInfo(stdout, srv.runtime.Info())
+}
+
+// WriteInfo prints info as shown by 'docker info'
+func WriteInfo(w io.Writer, info *api.Info) error {
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	fmt.Fprintf(w, "Containers: %d (%d running, %d stopped)\n", info.Containers, info.ContainersRunning, info.ContainersStopped)
+	fmt.Fprintf(w, "Images: %d\n", info.Images)
+	fmt.Fprintf(w, "Storage Driver: %s\n", info.StorageDriver)
+	for _, status := range info.DriverStatus {
+		fmt.Fprintf(w, " %s: %s\n", status[0], status[1])
+	}
+	fmt.Fprintf(w, "Kernel Version: %s\n", info.KernelVersion)
+	fmt.Fprintf(w, "Memory Limit: %s\n", yesNo[info.MemoryLimit])
+	fmt.Fprintf(w, "Swap Limit: %s\n", yesNo[info.SwapLimit])
+	if info.CgroupVersion != 0 {
+		fmt.Fprintf(w, "Cgroup Version: %d\n", info.CgroupVersion)
+	}
+	fmt.Fprintf(w, "Version: %s (%s)\n", info.Version, info.GoVersion)
+	fmt.Fprintf(w, "Root: %s\n", info.Root)
+	fmt.Fprintf(w, "Bridge: %s\n", info.BridgeIface)
+	fmt.Fprintf(w, "Log Driver: %s\n", info.LogDriver)
+	fmt.Fprintf(w, "Live Restore: %s\n", yesNo[info.LiveRestore])
+	fmt.Fprintf(w, "Experimental: %s\n", yesNo[info.Experimental])
+	fmt.Fprintf(w, "Debug: %s\n", yesNo[info.Debug])
+	for _, list := range []struct {
+		name   string
+		values []string
+	}{
+		{"Default Ulimits", info.DefaultUlimits},
+		{"Default Device Rules", info.DefaultDeviceRules},
+		{"Registry Mirrors", info.RegistryMirrors},
+		{"Insecure Registries", info.InsecureRegistries},
+	} {
+		if len(list.values) > 0 {
+			fmt.Fprintf(w, "%s: %s\n", list.name, strings.Join(list.values, ", "))
+		}
+	}
+	if !info.MemoryLimit {
+		fmt.Fprintln(w, "WARNING: No memory limit support")
+	} else if !info.SwapLimit {
+		fmt.Fprintln(w, "WARNING: No swap limit support")
+	}
 	return nil
 }
 
@@ -257,25 +397,35 @@ func (srv *Server) CmdInspect(stdin io.ReadCloser, stdout io.Writer, args ...str
 }
 
 func (srv *Server) CmdPort(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "port", "[OPTIONS] CONTAINER PRIVATE_PORT", "Lookup the public-facing port which is NAT-ed to PRIVATE_PORT")
+	cmd := rcli.Subcmd(stdout, "port", "[OPTIONS] CONTAINER [PRIVATE_PORT]", "List the port mappings of a container, or lookup the public-facing port which is NAT-ed to PRIVATE_PORT")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	if cmd.NArg() != 2 {
+	if cmd.NArg() < 1 || cmd.NArg() > 2 {
 		cmd.Usage()
 		return nil
 	}
-	name := cmd.Arg(0)
-	privatePort := cmd.Arg(1)
-	if container := srv.runtime.Get(name); container == nil {
-		return errors.New("No such container: " + name)
-	} else {
-		if frontend, exists := container.NetworkSettings.PortMapping[privatePort]; !exists {
-			return fmt.Errorf("No private port '%s' allocated on %s", privatePort, name)
-		} else {
-			fmt.Fprintln(stdout, frontend)
+	ports, err := srv.ContainerPorts(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printPorts(stdout, ports, cmd.Arg(0), cmd.Arg(1))
+}
+
+// printPorts prints the public port NAT-ed to privatePort, or all the
+// mappings if privatePort is empty
+func printPorts(stdout io.Writer, ports []api.Port, name, privatePort string) error {
+	for _, port := range ports {
+		if privatePort == "" {
+			fmt.Fprintf(stdout, "%d -> %d\n", port.PrivatePort, port.PublicPort)
+		} else if strconv.Itoa(port.PrivatePort) == privatePort {
+			fmt.Fprintln(stdout, port.PublicPort)
+			return nil
 		}
 	}
+	if privatePort != "" {
+		return fmt.Errorf("No private port '%s' allocated on %s", privatePort, name)
+	}
 	return nil
 }
 
@@ -290,7 +440,15 @@ func (srv *Server) CmdRmi(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		return nil
 	}
 	for _, name := range cmd.Args() {
-		if err := srv.runtime.graph.Delete(name); err != nil {
+		result, err := srv.ImageDelete(name)
+		for _, rmi := range result {
+			if rmi.Untagged != "" {
+				fmt.Fprintf(stdout, "Untagged: %s\n", rmi.Untagged)
+			} else {
+				fmt.Fprintf(stdout, "Deleted: %s\n", rmi.Deleted)
+			}
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -299,6 +457,8 @@ func (srv *Server) CmdRmi(stdin io.ReadCloser, stdout io.Writer, args ...string)
 
 func (srv *Server) CmdHistory(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout, "history", "[OPTIONS] IMAGE", "Show the history of an image")
+	flFull := cmd.Bool("notrunc", false, "Don't truncate output")
+	cmd.BoolVar(flFull, "no-trunc", false, "Don't truncate output")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -306,21 +466,27 @@ func (srv *Server) CmdHistory(stdin io.ReadCloser, stdout io.Writer, args ...str
 		cmd.Usage()
 		return nil
 	}
-	image, err := srv.runtime.repositories.LookupImage(cmd.Arg(0))
+	history, err := srv.ImageHistory(cmd.Arg(0))
 	if err != nil {
 		return err
 	}
 	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
 	defer w.Flush()
-	fmt.Fprintf(w, "ID\tCREATED\tCREATED BY\n")
-	return image.WalkHistory(func(img *Image) error {
-		fmt.Fprintf(w, "%s\t%s\t%s\n",
-			srv.runtime.repositories.ImageName(img.Id),
-			HumanDuration(time.Now().Sub(img.Created))+" ago",
-			strings.Join(img.ContainerConfig.Cmd, " "),
+	fmt.Fprintf(w, "IMAGE\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+	for _, layer := range history {
+		id, createdBy := layer.Id, layer.CreatedBy
+		if !*flFull {
+			id, createdBy = Trunc(id, 12), Trunc(createdBy, 45)
+		}
+		fmt.Fprintf(w, "%s\t%s ago\t%s\t%s\t%s\n",
+			id,
+			HumanDuration(time.Now().Sub(time.Unix(layer.Created, 0))),
+			createdBy,
+			HumanSize(layer.Size),
+			layer.Comment,
 		)
-		return nil
-	})
+	}
+	return nil
 }
 
 func (srv *Server) CmdRm(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
@@ -342,16 +508,21 @@ func (srv *Server) CmdRm(stdin io.ReadCloser, stdout io.Writer, args ...string)
 
 // 'docker kill NAME' kills a running container
 func (srv *Server) CmdKill(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "kill", "[OPTIONS] CONTAINER [CONTAINER...]", "Kill a running container")
+	cmd := rcli.Subcmd(stdout, "kill", "[OPTIONS] CONTAINER [CONTAINER...]", "Kill a running container, or send it a signal")
+	flSignal := cmd.String("s", "KILL", "Signal to send to the container")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
+	sig, err := ParseSignal(*flSignal)
+	if err != nil {
+		return err
+	}
 	for _, name := range cmd.Args() {
 		container := srv.runtime.Get(name)
 		if container == nil {
 			return errors.New("No such container: " + name)
 		}
-		if err := container.Kill(); err != nil {
+		if err := container.Signal(sig); err != nil {
 			fmt.Fprintln(stdout, "Error killing container "+name+": "+err.Error())
 		}
 	}
@@ -359,9 +530,8 @@ func (srv *Server) CmdKill(stdin io.ReadCloser, stdout io.Writer, args ...string
 }
 
 func (srv *Server) CmdImport(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "import", "[OPTIONS] URL|- [REPOSITORY [TAG]]", "Create a new filesystem image from the contents of a tarball")
+	cmd := rcli.Subcmd(stdout, "import", "[OPTIONS] URL|FILE|- [REPOSITORY[:TAG]]", "Create a new filesystem image from the contents of a tarball")
 	var archive io.Reader
-	var resp *http.Response
 
 	if err := cmd.Parse(args); err != nil {
 		return nil
@@ -371,6 +541,15 @@ func (srv *Server) CmdImport(stdin io.ReadCloser, stdout io.Writer, args ...stri
 		return errors.New("Not enough arguments")
 	} else if src == "-" {
 		archive = stdin
+	} else if file, err := openLocalArchive(src); err != nil {
+		return err
+	} else if file != nil {
+		defer file.Close()
+		fmt.Fprintf(stdout, "Importing %s\n", file.Name())
+		archive = file
+		if stat, err := file.Stat(); err == nil {
+			archive = ProgressReader(file, int(stat.Size()), stdout)
+		}
 	} else {
 		u, err := url.Parse(src)
 		if err != nil {
@@ -382,29 +561,48 @@ func (srv *Server) CmdImport(stdin io.ReadCloser, stdout io.Writer, args ...stri
 			u.Path = ""
 		}
 		fmt.Fprintf(stdout, "Downloading from %s\n", u.String())
+		var aborted <-chan struct{}
+		stdout, aborted = writeAborted(stdout)
 		// Download with curl (pretty progress bar)
 		// If curl is not available, fallback to http.Get()
-		resp, err = Download(u.String(), stdout)
+		resp, err := Download(u.String(), stdout, aborted)
 		if err != nil {
 			return err
 		}
+		defer resp.Body.Close()
 		archive = ProgressReader(resp.Body, int(resp.ContentLength), stdout)
 	}
-	img, err := srv.runtime.graph.Create(archive, nil, "Imported from "+src)
+	// Optionally register the image at REPO[:TAG]
+	repository, tag := parseRepositoryTag(cmd.Arg(1))
+	if tag == "" {
+		tag = cmd.Arg(2) // Repository will handle an empty tag properly
+	}
+	img, err := srv.runtime.Import(archive, "Imported from "+src, repository, tag)
 	if err != nil {
 		return err
 	}
-	// Optionally register the image at REPO/TAG
-	if repository := cmd.Arg(1); repository != "" {
-		tag := cmd.Arg(2) // Repository will handle an empty tag properly
-		if err := srv.runtime.repositories.Set(repository, tag, img.Id, true); err != nil {
-			return err
-		}
-	}
 	fmt.Fprintln(stdout, img.Id)
 	return nil
 }
 
+// Open src if it designates a file on the local filesystem, either as a path
+// or as a file:// url. Returns nil if src is not a local file.
+func openLocalArchive(src string) (*os.File, error) {
+	if u, err := url.Parse(src); err == nil && u.Scheme == "file" {
+		return os.Open(u.Path)
+	}
+	if strings.Contains(src, "://") {
+		return nil, nil
+	}
+	if _, err := os.Stat(src); err != nil {
+		if os.IsNotExist(err) && !strings.HasPrefix(src, "/") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return os.Open(src)
+}
+
 func (srv *Server) CmdPush(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout, "push", "NAME", "Push an image or a repository to the registry")
 	if err := cmd.Parse(args); err != nil {
@@ -416,53 +614,21 @@ func (srv *Server) CmdPush(stdin io.ReadCloser, stdout io.Writer, args ...string
 		cmd.Usage()
 		return nil
 	}
+	stdout, aborted := writeAborted(stdout)
 
-	// If the login failed, abort
-	if srv.runtime.authConfig == nil || srv.runtime.authConfig.Username == "" {
-		if err := srv.CmdLogin(stdin, stdout, args...); err != nil {
-			return err
-		}
-		if srv.runtime.authConfig == nil || srv.runtime.authConfig.Username == "" {
-			return fmt.Errorf("Please login prior to push. ('docker login')")
+	// Login first if there are no credentials for this registry
+	hostname, _ := splitReposName(local)
+	registry := srv.runtime.registryEndpoint(hostname)
+	if authConfig := srv.runtime.authConfigFile.ResolveAuthConfig(registry); authConfig.Username == "" {
+		loginArgs := []string{}
+		if hostname != "" {
+			loginArgs = append(loginArgs, hostname)
 		}
-	}
-
-	var remote string
-
-	tmp := strings.SplitN(local, "/", 2)
-	if len(tmp) == 1 {
-		return fmt.Errorf(
-			"Impossible to push a \"root\" repository. Please rename your repository in <user>/<repo> (ex: %s/%s)",
-			srv.runtime.authConfig.Username, local)
-	} else {
-		remote = local
-	}
-
-	Debugf("Pushing [%s] to [%s]\n", local, remote)
-
-	// Try to get the image
-	// FIXME: Handle lookup
-	// FIXME: Also push the tags in case of ./docker push myrepo:mytag
-	//	img, err := srv.runtime.LookupImage(cmd.Arg(0))
-	img, err := srv.runtime.graph.Get(local)
-	if err != nil {
-		Debugf("The push refers to a repository [%s] (len: %d)\n", local, len(srv.runtime.repositories.Repositories[local]))
-		// If it fails, try to get the repository
-		if localRepo, exists := srv.runtime.repositories.Repositories[local]; exists {
-			if err := srv.runtime.graph.PushRepository(stdout, remote, localRepo, srv.runtime.authConfig); err != nil {
-				return err
-			}
-			return nil
-		} else {
+		if err := srv.CmdLogin(stdin, stdout, loginArgs...); err != nil {
 			return err
 		}
-		return nil
 	}
-	err = srv.runtime.graph.PushImage(stdout, img, srv.runtime.authConfig)
-	if err != nil {
-		return err
-	}
-	return nil
+	return srv.ImagePush(stdout, aborted, local)
 }
 
 func (srv *Server) CmdPull(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
@@ -475,17 +641,49 @@ func (srv *Server) CmdPull(stdin io.ReadCloser, stdout io.Writer, args ...string
 		cmd.Usage()
 		return nil
 	}
+	stdout, aborted := writeAborted(stdout)
+	return srv.ImagePull(stdout, aborted, remote)
+}
 
-	if srv.runtime.graph.LookupRemoteImage(remote, srv.runtime.authConfig) {
-		if err := srv.runtime.graph.PullImage(stdout, remote, srv.runtime.authConfig); err != nil {
-			return err
-		}
+func (srv *Server) CmdSearch(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "search", "[OPTIONS] [REGISTRY/]TERM", "Search for an image in the docker registry")
+	flFull := cmd.Bool("notrunc", false, "Don't truncate output")
+	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
-	// FIXME: Allow pull repo:tag
-	if err := srv.runtime.graph.PullRepository(stdout, remote, "", srv.runtime.repositories, srv.runtime.authConfig); err != nil {
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	hostname, term := splitReposName(cmd.Arg(0))
+	registry := srv.runtime.registryEndpoint(hostname)
+	authConfig := srv.runtime.authConfigFile.ResolveAuthConfig(registry)
+	results, err := srv.runtime.graph.Search(stdout, term, registry, &authConfig)
+	if err != nil {
 		return err
 	}
+	fmt.Fprintf(stdout, "Found %d results matching your query (\"%s\")\n", results.NumResults, results.Query)
+	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "NAME\tDESCRIPTION\tSTARS\tOFFICIAL\tTRUSTED\n")
+	for _, result := range results.Results {
+		name := result.Name
+		if hostname != "" {
+			name = hostname + "/" + name
+		}
+		description := strings.Replace(result.Description, "\n", " ", -1)
+		if !*flFull {
+			description = Trunc(description, 45)
+		}
+		official, trusted := "", ""
+		if result.IsOfficial {
+			official = "[OK]"
+		}
+		if result.IsTrusted {
+			trusted = "[OK]"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", name, description, result.StarCount, official, trusted)
+	}
+	w.Flush()
 	return nil
 }
 
@@ -505,72 +703,32 @@ func (srv *Server) CmdImages(stdin io.ReadCloser, stdout io.Writer, args ...stri
 	if cmd.NArg() == 1 {
 		nameFilter = cmd.Arg(0)
 	}
-	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
-	if !*quiet {
-		fmt.Fprintf(w, "REPOSITORY\tTAG\tID\tCREATED\tPARENT\n")
-	}
-	var allImages map[string]*Image
-	var err error
-	if *flAll {
-		allImages, err = srv.runtime.graph.Map()
-	} else {
-		allImages, err = srv.runtime.graph.Heads()
-	}
+	images, err := srv.Images(*flAll, nameFilter, nil)
 	if err != nil {
 		return err
 	}
-	for name, repository := range srv.runtime.repositories.Repositories {
-		if nameFilter != "" && name != nameFilter {
-			continue
-		}
-		for tag, id := range repository {
-			image, err := srv.runtime.graph.Get(id)
-			if err != nil {
-				log.Printf("Warning: couldn't load %s from %s/%s: %s", id, name, tag, err)
-				continue
-			}
-			delete(allImages, id)
-			if !*quiet {
-				for idx, field := range []string{
-					/* REPOSITORY */ name,
-					/* TAG */ tag,
-					/* ID */ id,
-					/* CREATED */ HumanDuration(time.Now().Sub(image.Created)) + " ago",
-					/* PARENT */ srv.runtime.repositories.ImageName(image.Parent),
-				} {
-					if idx == 0 {
-						w.Write([]byte(field))
-					} else {
-						w.Write([]byte("\t" + field))
-					}
-				}
-				w.Write([]byte{'\n'})
-			} else {
-				stdout.Write([]byte(image.Id + "\n"))
-			}
-		}
+	w := tabwriter.NewWriter(stdout, 20, 1, 3, ' ', 0)
+	if !*quiet {
+		fmt.Fprintf(w, "REPOSITORY\tTAG\tID\tCREATED\tPARENT\n")
 	}
-	// Display images which aren't part of a
-	if nameFilter == "" {
-		for id, image := range allImages {
-			if !*quiet {
-				for idx, field := range []string{
-					/* REPOSITORY */ "<none>",
-					/* TAG */ "<none>",
-					/* ID */ id,
-					/* CREATED */ HumanDuration(time.Now().Sub(image.Created)) + " ago",
-					/* PARENT */ srv.runtime.repositories.ImageName(image.Parent),
-				} {
-					if idx == 0 {
-						w.Write([]byte(field))
-					} else {
-						w.Write([]byte("\t" + field))
-					}
+	for _, image := range images {
+		if !*quiet {
+			for idx, field := range []string{
+				/* REPOSITORY */ image.Repository,
+				/* TAG */ image.Tag,
+				/* ID */ image.Id,
+				/* CREATED */ HumanDuration(time.Now().Sub(time.Unix(image.Created, 0))) + " ago",
+				/* PARENT */ srv.runtime.repositories.ImageName(image.ParentId),
+			} {
+				if idx == 0 {
+					w.Write([]byte(field))
+				} else {
+					w.Write([]byte("\t" + field))
 				}
-				w.Write([]byte{'\n'})
-			} else {
-				stdout.Write([]byte(image.Id + "\n"))
 			}
+			w.Write([]byte{'\n'})
+		} else {
+			stdout.Write([]byte(image.Id + "\n"))
 		}
 	}
 	if !*quiet {
@@ -592,21 +750,22 @@ func (srv *Server) CmdPs(stdin io.ReadCloser, stdout io.Writer, args ...string)
 	if !*quiet {
 		fmt.Fprintf(w, "ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tCOMMENT\n")
 	}
-	for _, container := range srv.runtime.List() {
-		if !container.State.Running && !*flAll {
-			continue
-		}
+	containers, err := srv.Containers(*flAll, nil)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
 		if !*quiet {
-			command := fmt.Sprintf("%s %s", container.Path, strings.Join(container.Args, " "))
+			command := container.Command
 			if !*flFull {
 				command = Trunc(command, 20)
 			}
 			for idx, field := range []string{
 				/* ID */ container.Id,
-				/* IMAGE */ srv.runtime.repositories.ImageName(container.Image),
+				/* IMAGE */ container.Image,
 				/* COMMAND */ command,
-				/* CREATED */ HumanDuration(time.Now().Sub(container.Created)) + " ago",
-				/* STATUS */ container.State.String(),
+				/* CREATED */ HumanDuration(time.Now().Sub(time.Unix(container.Created, 0))) + " ago",
+				/* STATUS */ container.Status,
 				/* COMMENT */ "",
 			} {
 				if idx == 0 {
@@ -626,6 +785,46 @@ func (srv *Server) CmdPs(stdin io.ReadCloser, stdout io.Writer, args ...string)
 	return nil
 }
 
+func (srv *Server) CmdBuild(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "build", "[OPTIONS] PATH | -", "Build a new image from the Dockerfile in PATH, or read from stdin")
+	flTag := cmd.String("t", "", "Repository name (and optionally a tag) to apply to the resulting image")
+	flNoCache := cmd.Bool("no-cache", false, "Do not use the images of previous builds")
+	flRm := cmd.Bool("rm", true, "Remove the intermediate containers after a successful build")
+	flForceRm := cmd.Bool("force-rm", false, "Always remove the intermediate containers, even if the build fails")
+	var flBuildArgs ListOpts
+	cmd.Var(&flBuildArgs, "build-arg", "Set a value for an ARG instruction (NAME=VALUE)")
+	var flBuildArgFiles ListOpts
+	cmd.Var(&flBuildArgFiles, "build-arg-file", "Read values for the ARG instructions from a file of NAME=VALUE lines, overridden by -build-arg")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	buildArgs, err := ReadBuildArgs(flBuildArgFiles, flBuildArgs)
+	if err != nil {
+		return err
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return nil
+	}
+	var (
+		dockerfile io.Reader
+		context    string
+	)
+	if cmd.Arg(0) == "-" {
+		dockerfile = stdin
+	} else {
+		context = cmd.Arg(0)
+		file, err := os.Open(path.Join(context, "Dockerfile"))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		dockerfile = file
+	}
+	_, err = srv.Build(NewBuilder(srv, stdout, context, !*flNoCache, *flRm, *flForceRm, buildArgs), dockerfile, *flTag)
+	return err
+}
+
 func (srv *Server) CmdCommit(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout,
 		"commit", "[OPTIONS] CONTAINER [REPOSITORY [TAG]]",
@@ -639,7 +838,7 @@ func (srv *Server) CmdCommit(stdin io.ReadCloser, stdout io.Writer, args ...stri
 		cmd.Usage()
 		return nil
 	}
-	img, err := srv.runtime.Commit(containerName, repository, tag, *flComment)
+	img, err := srv.runtime.Commit(containerName, repository, tag, *flComment, nil)
 	if err != nil {
 		return err
 	}
@@ -660,6 +859,7 @@ func (srv *Server) CmdExport(stdin io.ReadCloser, stdout io.Writer, args ...stri
 		if err != nil {
 			return err
 		}
+		defer data.Close()
 		// Stream the entire contents of the container (basically a volatile snapshot)
 		if _, err := io.Copy(stdout, data); err != nil {
 			return err
@@ -669,6 +869,38 @@ func (srv *Server) CmdExport(stdin io.ReadCloser, stdout io.Writer, args ...stri
 	return errors.New("No such container: " + name)
 }
 
+func (srv *Server) CmdSave(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "save", "[OPTIONS] IMAGE|REPOSITORY[:TAG] [...]", "Save images with their history and tags to a tar archive on stdout")
+	flOCI := cmd.Bool("oci", false, "Write a tar archive of an OCI image layout")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return nil
+	}
+	if *flOCI {
+		return srv.ImageSaveOCI(stdout, cmd.Args())
+	}
+	return srv.ImageSave(stdout, cmd.Args())
+}
+
+func (srv *Server) CmdLoad(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	cmd := rcli.Subcmd(stdout, "load", "[OPTIONS] [REPOSITORY]", "Load images saved by save from a tar archive on stdin")
+	flOCI := cmd.Bool("oci", false, "Read a tar archive of an OCI image layout, tagging the images only named by a tag in REPOSITORY")
+	if err := cmd.Parse(args); err != nil {
+		return nil
+	}
+	if *flOCI && cmd.NArg() <= 1 {
+		return srv.ImageLoadOCI(stdin, cmd.Arg(0), stdout)
+	}
+	if cmd.NArg() > 0 {
+		cmd.Usage()
+		return nil
+	}
+	return srv.ImageLoad(stdin, stdout)
+}
+
 func (srv *Server) CmdDiff(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
 	cmd := rcli.Subcmd(stdout,
 		"diff", "CONTAINER [OPTIONS]",
@@ -757,7 +989,7 @@ func (srv *Server) CmdAttach(stdin io.ReadCloser, stdout io.Writer, args ...stri
 			return err
 		}
 		wg.Add(1)
-		go func() { io.Copy(stdout, cStdout); wg.Add(-1) }()
+		go func() { io.Copy(stdout, cStdout); cStdout.Close(); wg.Add(-1) }()
 	}
 	if *flStderr {
 		cStderr, err := container.StderrPipe()
@@ -765,7 +997,7 @@ func (srv *Server) CmdAttach(stdin io.ReadCloser, stdout io.Writer, args ...stri
 			return err
 		}
 		wg.Add(1)
-		go func() { io.Copy(stdout, cStderr); wg.Add(-1) }()
+		go func() { io.Copy(stdout, cStderr); cStderr.Close(); wg.Add(-1) }()
 	}
 	wg.Wait()
 	return nil
@@ -800,8 +1032,8 @@ func (opts *ListOpts) Set(value string) error {
 }
 
 func (srv *Server) CmdTag(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	cmd := rcli.Subcmd(stdout, "tag", "[OPTIONS] IMAGE REPOSITORY [TAG]", "Tag an image into a repository")
-	force := cmd.Bool("f", false, "Force")
+	cmd := rcli.Subcmd(stdout, "tag", "[OPTIONS] IMAGE REPOSITORY[:TAG]", "Tag an image into a repository")
+	force := cmd.Bool("f", false, "Move the tag if it is already set")
 	if err := cmd.Parse(args); err != nil {
 		return nil
 	}
@@ -809,11 +1041,11 @@ func (srv *Server) CmdTag(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		cmd.Usage()
 		return nil
 	}
-	return srv.runtime.repositories.Set(cmd.Arg(1), cmd.Arg(2), cmd.Arg(0), *force)
+	return srv.ImageTag(cmd.Arg(0), cmd.Arg(1), cmd.Arg(2), *force)
 }
 
 func (srv *Server) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
-	config, err := ParseRun(args, stdout)
+	config, options, err := ParseRun(args, stdout)
 	if err != nil {
 		return err
 	}
@@ -821,9 +1053,8 @@ func (srv *Server) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		fmt.Fprintln(stdout, "Error: Image not specified")
 		return fmt.Errorf("Image not specified")
 	}
-	if len(config.Cmd) == 0 {
-		fmt.Fprintln(stdout, "Error: Command not specified")
-		return fmt.Errorf("Command not specified")
+	if err := CheckCidFile(options.CidFile); err != nil {
+		return err
 	}
 
 	// Create new container
@@ -842,6 +1073,12 @@ func (srv *Server) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string)
 			return err
 		}
 	}
+	if err := WriteCidFile(options.CidFile, container.Id); err != nil {
+		if err := srv.runtime.Destroy(container); err != nil {
+			fmt.Fprintf(stdout, "Error removing container %s: %s\n", container.Id, err)
+		}
+		return err
+	}
 	if config.OpenStdin {
 		cmdStdin, err := container.StdinPipe()
 		if err != nil {
@@ -861,10 +1098,12 @@ func (srv *Server) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string)
 		if err != nil {
 			return err
 		}
+		defer cmdStderr.Close()
 		cmdStdout, err := container.StdoutPipe()
 		if err != nil {
 			return err
 		}
+		defer cmdStdout.Close()
 		if err := container.Start(); err != nil {
 			return err
 		}
@@ -894,20 +1133,80 @@ func (srv *Server) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string)
 	return nil
 }
 
-func NewServer() (*Server, error) {
+func NewServer(config *DaemonConfig) (*Server, error) {
 	if runtime.GOARCH != "amd64" {
 		log.Fatalf("The docker runtime currently only supports amd64 (not %s). This will change in the future. Aborting.", runtime.GOARCH)
 	}
-	runtime, err := NewRuntime()
+	runtime, err := NewRuntimeFromConfig(config)
 	if err != nil {
 		return nil, err
 	}
 	srv := &Server{
-		runtime: runtime,
+		runtime:    runtime,
+		pullQueue:  newOpQueue("pulls", config.MaxPulls),
+		pushQueue:  newOpQueue("pushes", config.MaxPushes),
+		buildQueue: newOpQueue("builds", config.MaxBuilds),
+		authz:      config.AuthzPlugins,
+	}
+	if config.AuditLog != "" {
+		if srv.audit, err = NewAuditLog(config.AuditLog, config.AuditLogMaxSize*1024*1024, config.AuditLogMaxFiles); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.Webhooks) > 0 {
+		if err := srv.startWebhooks(config.Webhooks, config.WebhookFilters, config.WebhookSecretFile); err != nil {
+			return nil, err
+		}
 	}
 	return srv, nil
 }
 
 type Server struct {
-	runtime *Runtime
+	runtime    *Runtime
+	builds     map[string]*Builder // Builds in progress, by id
+	buildsLock sync.Mutex
+	// Set by Shutdown, after which the API requests are refused
+	closing     bool
+	closingLock sync.Mutex
+	requests    sync.WaitGroup // API requests in progress
+	audit       *AuditLog      // Log of the API requests changing the state of the daemon, if enabled
+	authz       []string       // Authorization plugins of the API requests, see authz.go
+	// Limit the pulls, pushes and builds running at a time, see queue.go
+	pullQueue  *opQueue
+	pushQueue  *opQueue
+	buildQueue *opQueue
+}
+
+// startRequest records an API request in progress, unless the server is
+// shutting down
+func (srv *Server) startRequest() bool {
+	srv.closingLock.Lock()
+	defer srv.closingLock.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.requests.Add(1)
+	return true
+}
+
+// Shutdown refuses new API requests, waits for the requests in progress
+// within the shutdown timeout, then shuts the runtime down.
+func (srv *Server) Shutdown() error {
+	srv.closingLock.Lock()
+	srv.closing = true
+	srv.closingLock.Unlock()
+	done := make(chan bool)
+	go func() {
+		srv.requests.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(srv.runtime.config.ShutdownTimeout):
+		apiLog.Warnf("Some API requests are still in progress, shutting down anyway")
+	}
+	if srv.audit != nil {
+		srv.audit.Close()
+	}
+	return srv.runtime.Shutdown()
 }
@@ -4,15 +4,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/dotcloud/docker/api"
 	"github.com/dotcloud/docker/rcli"
 	"github.com/kr/pty"
 	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -31,11 +35,29 @@ type Container struct {
 	State  State
 	Image  string
 
+	Volumes   map[string]string // Host directories mounted in the container, by path in the container
+	VolumesRW map[string]bool
+
+	RestartCount int // Times the restart policy restarted the container
+	// Stopped by the daemon shutting down, restarted when it starts again
+	// if it has a restart policy, see restart.go
+	StoppedByDaemon bool
+
 	network         *NetworkInterface
 	NetworkSettings *NetworkSettings
 
 	SysInitPath string
+	LogDriver   string // "file" or "none", see DaemonConfig
+	Shim        bool   // Started through docker-shim, with live-restore
+	// Scope of the container with the systemd cgroup driver, see systemd.go
+	SystemdScope string
+
+	AppArmorProfile string // Empty unless AppArmor is enabled
+	ProcessLabel    string // SELinux labels, empty unless SELinux is enabled
+	MountLabel      string
+
 	cmd         *exec.Cmd
+	shimDone    chan bool // Closed when the shim closes its socket
 	stdout      *writeBroadcaster
 	stderr      *writeBroadcaster
 	stdin       io.ReadCloser
@@ -44,40 +66,82 @@ type Container struct {
 	stdoutLog *os.File
 	stderrLog *os.File
 	runtime   *Runtime
+
+	// Output pipes which weren't drained yet, guarded by the state lock
+	streams int
+	// Set by Stop and Kill, so that the restart policy doesn't apply
+	stopRequested bool
+	// Added by the prestart hooks for the current start, see hooks.go
+	prestart *PrestartSpec
 }
 
-type Config struct {
-	Hostname   string
-	User       string
-	Memory     int64 // Memory limit (in bytes)
-	MemorySwap int64 // Total memory usage (memory + swap); set `-1' to disable swap
-	Detach     bool
-	Ports      []int
-	Tty        bool // Attach standard streams to a tty, including stdin if it is not closed.
-	OpenStdin  bool // Open stdin
-	Env        []string
-	Cmd        []string
-	Image      string // Name of the image as it was passed by the operator (eg. could be symbolic)
+// Config is the configuration of a container, see api.Config
+type Config = api.Config
+
+// RunOptions are the options of run which only concern the client, and
+// aren't sent to the daemon
+type RunOptions struct {
+	CidFile    string // Where the client writes the id of the container
+	DetachKeys string // Key sequence detaching the client from the container, eg. ctrl-p,ctrl-q
 }
 
-func ParseRun(args []string, stdout io.Writer) (*Config, error) {
+func ParseRun(args []string, stdout io.Writer) (*Config, *RunOptions, error) {
 	cmd := rcli.Subcmd(stdout, "run", "[OPTIONS] IMAGE COMMAND [ARG...]", "Run a command in a new container")
 	if len(args) > 0 && args[0] != "--help" {
 		cmd.SetOutput(ioutil.Discard)
 	}
 
-	flUser := cmd.String("u", "", "Username or UID")
+	flUser := cmd.String("u", "", "Username or UID, optionally followed by :GROUP or :GID")
 	flDetach := cmd.Bool("d", false, "Detached mode: leave the container running in the background")
 	flStdin := cmd.Bool("i", false, "Keep stdin open even if not attached")
 	flTty := cmd.Bool("t", false, "Allocate a pseudo-tty")
 	flMemory := cmd.Int64("m", 0, "Memory limit (in bytes)")
+	flCpuShares := cmd.Int64("c", 0, "CPU shares (relative weight, 1024 by default)")
+	flCpuQuota := cmd.Int64("cpu-quota", 0, "CPU time in microseconds per 100ms period, eg. 50000 for half a CPU")
+	flRestart := cmd.String("restart", "", "Restart policy when the container exits: no, always or on-failure[:MAX]")
 	var flPorts ports
 
 	cmd.Var(&flPorts, "p", "Map a network port to the container")
 	var flEnv ListOpts
-	cmd.Var(&flEnv, "e", "Set environment variables")
+	cmd.Var(&flEnv, "e", "Set environment variables (KEY=VALUE)")
+	var flEnvFiles ListOpts
+	cmd.Var(&flEnvFiles, "env-file", "Read environment variables from a file of KEY=VALUE lines, overridden by -e")
+	flEnvFileExpand := cmd.Bool("env-file-expand", false, "Expand $NAME and ${NAME} in the values of the env files")
+	flWorkingDir := cmd.String("w", "", "Working directory inside the container")
+	flEntrypoint := cmd.String("entrypoint", "", "Overwrite the default entrypoint of the image")
+	flHostname := cmd.String("h", "", "Container host name")
+	flCidFile := cmd.String("cidfile", "", "Write the container ID to the file, which must not exist")
+	flDetachKeys := cmd.String("detach-keys", "", "Key sequence detaching from the container, eg. ctrl-a,d (default ctrl-p,ctrl-q)")
+	var flVolumes ListOpts
+	cmd.Var(&flVolumes, "v", "Bind mount a directory of the host (-v /host:/container[:ro]) or a named volume (-v name:/container[:ro]), or create a volume (-v /container)")
+	var flVolumesFrom ListOpts
+	cmd.Var(&flVolumesFrom, "volumes-from", "Mount all the volumes of a container (-volumes-from CONTAINER[:ro])")
+	var flLabels ListOpts
+	cmd.Var(&flLabels, "label", "Set metadata on the container (KEY=VALUE)")
+	cmd.Var(&flLabels, "l", "Shorthand for -label")
+	var flTmpfs ListOpts
+	cmd.Var(&flTmpfs, "tmpfs", "Mount a tmpfs, limited to 64MB by default (-tmpfs /container[:size=16m,mode=1777,...])")
+	var flSysctls ListOpts
+	cmd.Var(&flSysctls, "sysctl", "Set a namespaced kernel parameter: net.*, kernel.msg* or fs.mqueue.* (-sysctl net.core.somaxconn=1024)")
+	flShmSize := cmd.String("shm-size", "", "Size of /dev/shm, eg. 1g (default of the daemon, 64m)")
+	flInit := cmd.Bool("init", false, "Run an init inside the container which forwards signals and reaps zombies")
+	var flCapAdd, flCapDrop ListOpts
+	cmd.Var(&flCapAdd, "cap-add", "Add a linux capability to the default ones, or ALL")
+	cmd.Var(&flCapDrop, "cap-drop", "Drop a linux capability from the default ones, or ALL")
+	var flSecurityOpt ListOpts
+	cmd.Var(&flSecurityOpt, "security-opt", "Security option: apparmor=PROFILE, no-new-privileges, label=user:USER, label=role:ROLE, label=type:TYPE, label=level:LEVEL or label=disable")
+	flPrivileged := cmd.Bool("privileged", false, "Give all the capabilities and devices to the container, and lift its confinement")
+	flReadOnly := cmd.Bool("read-only", false, "Mount the root filesystem of the container read-only, with a tmpfs on /tmp and /run")
+	flAutoRemove := cmd.Bool("rm", false, "Automatically remove the container and its anonymous volumes when it exits")
+	var flDevices ListOpts
+	cmd.Var(&flDevices, "device", "Make a device of the host available in the container (-device /host[:/container][:rwm])")
+	var flDeviceRules ListOpts
+	cmd.Var(&flDeviceRules, "device-rule", "Add a rule to the device cgroup whitelist of the container (-device-rule 'c 10:229 rwm')")
+	flSeccomp := cmd.String("seccomp-profile", "", "JSON file of the seccomp profile filtering the system calls of the container, or unconfined")
+	flTimezone := cmd.String("tz", "", "Timezone of the container: host, a zone of the host, eg. Europe/Paris, or none to keep the one of the image")
+	flStopSignal := cmd.String("stop-signal", "", "Signal sent to stop the container before it is killed, eg. SIGQUIT (default SIGTERM)")
 	if err := cmd.Parse(args); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	parsedArgs := cmd.Args()
 	runCmd := []string{}
@@ -88,27 +152,282 @@ func ParseRun(args []string, stdout io.Writer) (*Config, error) {
 	if len(parsedArgs) > 1 {
 		runCmd = parsedArgs[1:]
 	}
+	var entrypoint []string
+	if *flEntrypoint != "" {
+		entrypoint = []string{*flEntrypoint}
+	}
+	volumes := make(map[string]struct{})
+	var binds []string
+	for _, volume := range flVolumes {
+		if strings.Contains(volume, ":") {
+			binds = append(binds, volume)
+		} else {
+			volumes[volume] = struct{}{}
+		}
+	}
+	tmpfs := make(map[string]string)
+	for _, spec := range flTmpfs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		tmpfs[parts[0]] = parts[1]
+	}
+	var sysctls map[string]string
+	for _, sysctl := range flSysctls {
+		parts := strings.SplitN(sysctl, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("Invalid sysctl: %s (expected NAME=VALUE)", sysctl)
+		}
+		if sysctls == nil {
+			sysctls = make(map[string]string)
+		}
+		sysctls[parts[0]] = parts[1]
+	}
+	var shmSize int64
+	if *flShmSize != "" {
+		var err error
+		if shmSize, err = ParseSize(*flShmSize); err != nil {
+			return nil, nil, err
+		}
+	}
+	var env []string
+	for _, file := range flEnvFiles {
+		fileEnv, err := ParseEnvFile(file, *flEnvFileExpand)
+		if err != nil {
+			return nil, nil, err
+		}
+		env = overrideEnv(env, fileEnv)
+	}
+	env = overrideEnv(env, flEnv)
+	seccomp := *flSeccomp
+	if seccomp != "" && seccomp != SECCOMP_UNCONFINED {
+		data, err := ioutil.ReadFile(seccomp)
+		if err != nil {
+			return nil, nil, err
+		}
+		seccomp = string(data)
+	}
+	labels := make(map[string]string)
+	for _, label := range flLabels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		labels[parts[0]] = parts[1]
+	}
 	config := &Config{
-		Ports:     flPorts,
-		User:      *flUser,
-		Tty:       *flTty,
-		OpenStdin: *flStdin,
-		Memory:    *flMemory,
-		Detach:    *flDetach,
-		Env:       flEnv,
-		Cmd:       runCmd,
-		Image:     image,
+		Hostname:    *flHostname,
+		WorkingDir:  *flWorkingDir,
+		Entrypoint:  entrypoint,
+		Ports:       flPorts,
+		User:        *flUser,
+		Tty:         *flTty,
+		OpenStdin:   *flStdin,
+		Memory:      *flMemory,
+		CpuShares:   *flCpuShares,
+		CpuQuota:    *flCpuQuota,
+		Restart:     *flRestart,
+		Detach:      *flDetach,
+		Env:         env,
+		Cmd:         runCmd,
+		Volumes:     volumes,
+		Binds:       binds,
+		VolumesFrom: flVolumesFrom,
+		Tmpfs:       tmpfs,
+		ShmSize:     shmSize,
+		Sysctls:     sysctls,
+		Labels:      labels,
+		Init:        *flInit,
+		StopSignal:  *flStopSignal,
+		CapAdd:      flCapAdd,
+		CapDrop:     flCapDrop,
+		Seccomp:     seccomp,
+		SecurityOpt: flSecurityOpt,
+		Privileged:  *flPrivileged,
+		Devices:     flDevices,
+		DeviceRules: flDeviceRules,
+		ReadOnly:    *flReadOnly,
+		Timezone:    *flTimezone,
+		AutoRemove:  *flAutoRemove,
+		Image:       image,
 	}
-	return config, nil
+	return config, &RunOptions{CidFile: *flCidFile, DetachKeys: *flDetachKeys}, nil
 }
 
-type NetworkSettings struct {
-	IpAddress   string
-	IpPrefixLen int
-	Gateway     string
-	PortMapping map[string]string
+var hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// MergeConfig fills the settings left empty in userConf with the defaults
+// of the image. Environment variables, ports, volumes and labels are
+// combined.
+func MergeConfig(userConf, imageConf *Config) {
+	if userConf.User == "" {
+		userConf.User = imageConf.User
+	}
+	if userConf.WorkingDir == "" {
+		userConf.WorkingDir = imageConf.WorkingDir
+	}
+	if len(userConf.Cmd) == 0 {
+		userConf.Cmd = imageConf.Cmd
+	}
+	if len(userConf.Entrypoint) == 0 {
+		userConf.Entrypoint = imageConf.Entrypoint
+	}
+	if userConf.StopSignal == "" {
+		userConf.StopSignal = imageConf.StopSignal
+	}
+	for _, imagePort := range imageConf.Ports {
+		found := false
+		for _, port := range userConf.Ports {
+			if port == imagePort {
+				found = true
+				break
+			}
+		}
+		if !found {
+			userConf.Ports = append(userConf.Ports, imagePort)
+		}
+	}
+	env := []string{}
+	for _, imageEnv := range imageConf.Env {
+		key := strings.SplitN(imageEnv, "=", 2)[0]
+		found := false
+		for _, userEnv := range userConf.Env {
+			if strings.SplitN(userEnv, "=", 2)[0] == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			env = append(env, imageEnv)
+		}
+	}
+	userConf.Env = append(env, userConf.Env...)
+	for volume := range imageConf.Volumes {
+		if userConf.Volumes == nil {
+			userConf.Volumes = make(map[string]struct{})
+		}
+		userConf.Volumes[volume] = struct{}{}
+	}
+	for key, value := range imageConf.Labels {
+		if userConf.Labels == nil {
+			userConf.Labels = make(map[string]string)
+		}
+		if _, exists := userConf.Labels[key]; !exists {
+			userConf.Labels[key] = value
+		}
+	}
 }
 
+// ConfigError is returned when a container config is invalid
+type ConfigError string
+
+func (e ConfigError) Error() string {
+	return string(e)
+}
+
+// Check the parts of a config which would otherwise only fail once the
+// container is started
+func validateConfig(config *Config) error {
+	if len(config.Entrypoint) == 0 && len(config.Cmd) == 0 {
+		return ConfigError("Command not specified")
+	}
+	if len(config.Entrypoint) > 0 && config.Entrypoint[0] == "" {
+		return ConfigError("Entrypoint can't be empty")
+	}
+	if config.Hostname != "" && (len(config.Hostname) > 255 || !hostnameRegexp.MatchString(config.Hostname)) {
+		return ConfigError(fmt.Sprintf("Invalid hostname: %s", config.Hostname))
+	}
+	if config.WorkingDir != "" && !path.IsAbs(config.WorkingDir) {
+		return ConfigError(fmt.Sprintf("The working directory must be an absolute path: %s", config.WorkingDir))
+	}
+	if config.User != "" {
+		parts := strings.Split(config.User, ":")
+		if len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && parts[1] == "") || strings.ContainsAny(config.User, " \t\n") {
+			return ConfigError(fmt.Sprintf("Invalid user: %s (expected USER or USER:GROUP)", config.User))
+		}
+	}
+	for _, env := range config.Env {
+		if parts := strings.SplitN(env, "=", 2); len(parts) != 2 || parts[0] == "" {
+			return ConfigError(fmt.Sprintf("Invalid environment variable: %s (expected KEY=VALUE)", env))
+		}
+	}
+	for volume := range config.Volumes {
+		if !validMountPath(volume) {
+			return ConfigError(fmt.Sprintf("Invalid volume path: %q (it must be absolute, without whitespace or control characters)", volume))
+		}
+	}
+	for _, bind := range config.Binds {
+		if _, _, _, _, err := parseBind(bind); err != nil {
+			return ConfigError(err.Error())
+		}
+	}
+	for _, spec := range config.VolumesFrom {
+		if _, _, err := parseVolumesFrom(spec); err != nil {
+			return ConfigError(err.Error())
+		}
+	}
+	for key := range config.Labels {
+		if key == "" || strings.ContainsAny(key, " \t\n") {
+			return ConfigError(fmt.Sprintf("Invalid label: %q", key))
+		}
+	}
+	if config.StopSignal != "" {
+		if _, err := ParseSignal(config.StopSignal); err != nil {
+			return ConfigError(err.Error())
+		}
+	}
+	if err := validateTimezone(config.Timezone); err != nil {
+		return ConfigError(err.Error())
+	}
+	for name, value := range config.Sysctls {
+		if err := validateSysctl(name, value); err != nil {
+			return ConfigError(err.Error())
+		}
+	}
+	if config.Memory < 0 || config.CpuShares < 0 || config.ShmSize < 0 {
+		return ConfigError("The memory limit, the CPU shares and the size of /dev/shm can't be negative")
+	}
+	if config.CpuQuota != 0 && config.CpuQuota < 1000 {
+		return ConfigError(fmt.Sprintf("Invalid CPU quota: %d (expected at least 1000 microseconds)", config.CpuQuota))
+	}
+	if policy, err := parseRestartPolicy(config.Restart); err != nil {
+		return ConfigError(err.Error())
+	} else if policy.Name != "no" && config.AutoRemove {
+		return ConfigError("Containers removed on exit can't be restarted")
+	}
+	if _, err := containerCapabilities(config.CapAdd, config.CapDrop); err != nil {
+		return ConfigError(err.Error())
+	}
+	if _, err := ParseSeccompProfile(config.Seccomp); err != nil {
+		return ConfigError(err.Error())
+	}
+	if _, err := parseSecurityOpts(config.SecurityOpt); err != nil {
+		return ConfigError(err.Error())
+	}
+	for _, spec := range config.Devices {
+		if _, err := parseDevice(spec); err != nil {
+			return ConfigError(err.Error())
+		}
+	}
+	for _, rule := range config.DeviceRules {
+		if _, err := parseDeviceRule(rule); err != nil {
+			return ConfigError(err.Error())
+		}
+	}
+	for p, options := range config.Tmpfs {
+		if !validMountPath(p) {
+			return ConfigError(fmt.Sprintf("Invalid tmpfs path: %q (it must be absolute, without whitespace or control characters)", p))
+		}
+		if err := validateTmpfsOptions(options); err != nil {
+			return ConfigError(err.Error())
+		}
+	}
+	return nil
+}
+
+type NetworkSettings = api.NetworkSettings
+
 func (container *Container) Cmd() *exec.Cmd {
 	return container.cmd
 }
@@ -217,15 +536,40 @@ func (container *Container) start() error {
 }
 
 func (container *Container) Start() error {
+	container.stopRequested = false
+	container.StoppedByDaemon = false
 	if err := container.EnsureMounted(); err != nil {
 		return err
 	}
-	if err := container.allocateNetwork(); err != nil {
+	if err := container.runPrestartHooks(); err != nil {
 		return err
 	}
-	if err := container.generateLXCConfig(); err != nil {
+	if err := container.setupVolumes(); err != nil {
 		return err
 	}
+	if err := container.createDevices(); err != nil {
+		return container.startFailed(err)
+	}
+	if err := container.setupTimezone(); err != nil {
+		return container.startFailed(err)
+	}
+	if container.ShmSize() > 0 {
+		// The links of the image are followed within its root filesystem
+		rootfs := container.RootfsPath()
+		shm, err := FollowSymlinkInScope(path.Join(rootfs, "dev", "shm"), rootfs)
+		if err == nil {
+			err = os.MkdirAll(shm, 0755)
+		}
+		if err != nil {
+			return container.startFailed(err)
+		}
+	}
+	if err := container.allocateNetwork(); err != nil {
+		return container.startFailed(err)
+	}
+	if err := container.generateLXCConfig(); err != nil {
+		return container.startFailed(err)
+	}
 	params := []string{
 		"-n", container.Id,
 		"-f", container.lxcConfigPath(),
@@ -241,11 +585,66 @@ func (container *Container) Start() error {
 		params = append(params, "-u", container.Config.User)
 	}
 
+	// Working directory
+	if container.Config.WorkingDir != "" {
+		params = append(params, "-w", container.Config.WorkingDir)
+	}
+
+	// Resource limits
+	for _, ulimit := range container.runtime.config.DefaultUlimits {
+		params = append(params, "-ulimit", ulimit)
+	}
+
+	// Kernel parameters
+	for _, sysctl := range sysctlParams(container.Config.Sysctls) {
+		params = append(params, "-sysctl", sysctl)
+	}
+
+	// Capabilities and seccomp, lifted for privileged containers
+	capabilities, err := containerCapabilities(container.Config.CapAdd, container.Config.CapDrop)
+	if err != nil {
+		return container.startFailed(err)
+	}
+	seccomp := container.Config.Seccomp
+	if container.Config.Privileged {
+		capabilities = capabilityNames
+		seccomp = SECCOMP_UNCONFINED
+	}
+	params = append(params, "-caps", strings.Join(capabilities, ","))
+	params = append(params, "-seccomp", seccomp)
+
+	// Hardening
+	options, err := parseSecurityOpts(container.Config.SecurityOpt)
+	if err != nil {
+		return container.startFailed(err)
+	}
+	if options.NoNewPrivileges {
+		params = append(params, "-no-new-privs")
+	}
+	if container.Config.ReadOnly {
+		params = append(params, "-read-only")
+	}
+
+	// Init
+	if container.Config.Init {
+		params = append(params, "-init")
+	}
+
 	// Program
 	params = append(params, "--", container.Path)
 	params = append(params, container.Args...)
 
-	container.cmd = exec.Command("lxc-start", params...)
+	container.SystemdScope = ""
+	if container.runtime.config.CgroupDriver == "systemd" {
+		container.SystemdScope = systemdScopeName(container.Id)
+	}
+	if container.runtime.config.LiveRestore {
+		container.Shim = true
+		container.cmd = container.shimCommand(params)
+	} else {
+		container.Shim = false
+		container.cmd = lxcStartCommand(container.SystemdScope, params)
+	}
 
 	// Setup environment
 	container.cmd.Env = append(
@@ -255,24 +654,31 @@ func (container *Container) Start() error {
 		},
 		container.Config.Env...,
 	)
+	if container.prestart != nil {
+		container.cmd.Env = overrideEnv(container.cmd.Env, container.prestart.Env)
+	}
 
-	var err error
 	if container.Config.Tty {
 		container.cmd.Env = append(
 			[]string{"TERM=xterm"},
 			container.cmd.Env...,
 		)
+	}
+	if container.Shim {
+		err = container.startShim()
+	} else if container.Config.Tty {
 		err = container.startPty()
 	} else {
 		err = container.start()
 	}
 	if err != nil {
-		return err
+		return container.startFailed(err)
 	}
 	// FIXME: save state on disk *first*, then converge
 	// this way disk state is used as a journal, eg. we can restore after crash etc.
 	container.State.setRunning(container.cmd.Process.Pid)
 	container.ToDisk()
+	container.runtime.events.Log("start", container.Id, container.Image, nil)
 	go container.monitor()
 	return nil
 }
@@ -309,13 +715,55 @@ func (container *Container) StdinPipe() (io.WriteCloser, error) {
 func (container *Container) StdoutPipe() (io.ReadCloser, error) {
 	reader, writer := io.Pipe()
 	container.stdout.AddWriter(writer)
-	return newBufReader(reader), nil
+	return container.trackStream(newBufReader(reader)), nil
 }
 
 func (container *Container) StderrPipe() (io.ReadCloser, error) {
 	reader, writer := io.Pipe()
 	container.stderr.AddWriter(writer)
-	return newBufReader(reader), nil
+	return container.trackStream(newBufReader(reader)), nil
+}
+
+// trackStream counts an output pipe until it is drained or closed
+func (container *Container) trackStream(r io.ReadCloser) io.ReadCloser {
+	container.State.stateChangeLock.Lock()
+	container.streams++
+	container.State.stateChangeLock.Unlock()
+	return &drainedReader{ReadCloser: r, done: func() {
+		container.State.stateChangeLock.Lock()
+		container.streams--
+		container.State.stateChangeLock.Unlock()
+		container.State.broadcast()
+	}}
+}
+
+// waitStreams waits until the output pipes of the container are drained
+func (container *Container) waitStreams() {
+	container.State.stateChangeLock.Lock()
+	defer container.State.stateChangeLock.Unlock()
+	for container.streams > 0 {
+		container.State.stateChangeCond.Wait()
+	}
+}
+
+// drainedReader calls done once, when its reader fails or is closed
+type drainedReader struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (r *drainedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil {
+		r.once.Do(r.done)
+	}
+	return n, err
+}
+
+func (r *drainedReader) Close() error {
+	r.once.Do(r.done)
+	return r.ReadCloser.Close()
 }
 
 func (container *Container) allocateNetwork() error {
@@ -339,7 +787,56 @@ func (container *Container) allocateNetwork() error {
 	return nil
 }
 
+// reclaimNetwork allocates the address and the ports of a container left
+// running by a previous daemon
+func (container *Container) reclaimNetwork() error {
+	ports := make(map[int]int)
+	for port, extPort := range container.NetworkSettings.PortMapping {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return err
+		}
+		ext, err := strconv.Atoi(extPort)
+		if err != nil {
+			return err
+		}
+		ports[p] = ext
+	}
+	iface, err := container.runtime.networkManager.Reclaim(net.ParseIP(container.NetworkSettings.IpAddress), ports)
+	if err != nil {
+		return err
+	}
+	container.network = iface
+	return nil
+}
+
+// PooledVeth returns the container side of the veth pair claimed from the
+// pool, moved into the container by lxc, or an empty string if lxc creates
+// the pair
+func (container *Container) PooledVeth() string {
+	if container.network == nil || container.network.veth == nil {
+		return ""
+	}
+	return container.network.veth.peer
+}
+
+// startFailed releases the volumes and the network of a container which
+// failed to start, and returns err
+func (container *Container) startFailed(err error) error {
+	if err := container.releaseNetwork(); err != nil {
+		containerLog.Errorf("%v: Failed to release network: %v", container.Id, err)
+	}
+	if err := container.unmountVolumes(); err != nil {
+		containerLog.Errorf("%v: Failed to umount volumes: %v", container.Id, err)
+	}
+	return err
+}
+
 func (container *Container) releaseNetwork() error {
+	if container.network == nil {
+		container.NetworkSettings = &NetworkSettings{}
+		return nil
+	}
 	err := container.network.Release()
 	container.network = nil
 	container.NetworkSettings = &NetworkSettings{}
@@ -347,18 +844,30 @@ func (container *Container) releaseNetwork() error {
 }
 
 func (container *Container) monitor() {
+	stopped := make(chan struct{})
+	go container.watchOOM(stopped)
+
 	// Wait for the program to exit
-	container.cmd.Wait()
-	exitCode := container.cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+	var exitCode int
+	if container.Shim {
+		exitCode = container.waitShim()
+	} else {
+		container.cmd.Wait()
+		exitCode = container.cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+	close(stopped)
 
 	// Cleanup
 	if err := container.releaseNetwork(); err != nil {
-		log.Printf("%v: Failed to release network: %v", container.Id, err)
+		containerLog.Errorf("%v: Failed to release network: %v", container.Id, err)
 	}
 	container.stdout.Close()
 	container.stderr.Close()
 	if err := container.Unmount(); err != nil {
-		log.Printf("%v: Failed to umount filesystem: %v", container.Id, err)
+		containerLog.Errorf("%v: Failed to umount filesystem: %v", container.Id, err)
+	}
+	if err := container.unmountVolumes(); err != nil {
+		containerLog.Errorf("%v: Failed to umount volumes: %v", container.Id, err)
 	}
 
 	// Re-create a brand new stdin pipe once the container exited
@@ -367,11 +876,36 @@ func (container *Container) monitor() {
 	}
 
 	// Report status back
+	ran := time.Now().Sub(container.State.StartedAt)
 	container.State.setStopped(exitCode)
 	container.ToDisk()
+	container.runtime.events.Log("die", container.Id, container.Image, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+	if container.shouldRestart(exitCode) {
+		go container.restartOnExit(ran)
+	} else if container.Config.AutoRemove {
+		go container.autoRemove()
+	}
+}
+
+// autoRemove destroys the container once the attached clients read the end
+// of its output
+func (container *Container) autoRemove() {
+	container.waitStreams()
+	if err := container.runtime.Destroy(container); err != nil {
+		containerLog.Errorf("%v: Failed to remove the container: %v", container.Id, err)
+	}
 }
 
 func (container *Container) kill() error {
+	// The shim outlives the container, which may be left by a previous daemon
+	if container.Shim && container.State.Running {
+		if output, err := exec.Command("lxc-kill", "-n", container.Id, "9").CombinedOutput(); err != nil {
+			containerLog.Errorf("%s", output)
+			return err
+		}
+		container.Wait()
+		return nil
+	}
 	if container.cmd == nil {
 		return nil
 	}
@@ -384,29 +918,68 @@ func (container *Container) kill() error {
 }
 
 func (container *Container) Kill() error {
+	container.stopRequested = true
 	if !container.State.Running {
 		return nil
 	}
 	return container.kill()
 }
 
+// Signal sends sig to the process of the container, eg. SIGHUP to reload
+// its configuration. SIGKILL kills it like Kill; the other signals don't
+// prevent its restart policy from applying if it exits.
+func (container *Container) Signal(sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		if err := container.Kill(); err != nil {
+			return err
+		}
+	} else if !container.State.Running {
+		return fmt.Errorf("Container %s is not running", container.Id)
+	} else if output, err := exec.Command("lxc-kill", "-n", container.Id, strconv.Itoa(int(sig))).CombinedOutput(); err != nil {
+		containerLog.Errorf("%s", output)
+		return fmt.Errorf("Failed to send %v to %s: %s", sig, container.Id, err)
+	}
+	container.runtime.events.Log("kill", container.Id, container.Image, map[string]string{"signal": strconv.Itoa(int(sig))})
+	return nil
+}
+
 func (container *Container) Stop() error {
+	return container.StopTimeout(10 * time.Second)
+}
+
+// stopSignal returns the signal sent by Stop: the stop signal of the
+// config, or SIGTERM
+func (container *Container) stopSignal() syscall.Signal {
+	if container.Config.StopSignal != "" {
+		// Checked by validateConfig
+		if sig, err := ParseSignal(container.Config.StopSignal); err == nil {
+			return sig
+		}
+	}
+	return syscall.SIGTERM
+}
+
+// StopTimeout sends the stop signal to the container, SIGTERM by default,
+// and kills it if it is still running after timeout.
+func (container *Container) StopTimeout(timeout time.Duration) error {
+	container.stopRequested = true
 	if !container.State.Running {
 		return nil
 	}
+	sig := container.stopSignal()
 
-	// 1. Send a SIGTERM
-	if output, err := exec.Command("lxc-kill", "-n", container.Id, "15").CombinedOutput(); err != nil {
-		log.Printf(string(output))
-		log.Printf("Failed to send SIGTERM to the process, force killing")
+	// 1. Send the stop signal
+	if output, err := exec.Command("lxc-kill", "-n", container.Id, strconv.Itoa(int(sig))).CombinedOutput(); err != nil {
+		containerLog.Errorf("%s", output)
+		containerLog.Warnf("Failed to send %v to the process, force killing", sig)
 		if err := container.Kill(); err != nil {
 			return err
 		}
 	}
 
 	// 2. Wait for the process to exit on its own
-	if err := container.WaitTimeout(10 * time.Second); err != nil {
-		log.Printf("Container %v failed to exit within 10 seconds of SIGTERM - using the force", container.Id)
+	if err := container.WaitTimeout(timeout); err != nil {
+		containerLog.Warnf("Container %v failed to exit within %v of %v - using the force", container.Id, timeout, sig)
 		if err := container.Kill(); err != nil {
 			return err
 		}
@@ -433,15 +1006,87 @@ func (container *Container) Wait() int {
 	return container.State.ExitCode
 }
 
+// ExportRw streams the changes of the container as a tar archive, owned by
+// the ids of the container
 func (container *Container) ExportRw() (Archive, error) {
-	return Tar(container.rwPath(), Uncompressed)
+	if err := container.aufsWhiteouts(); err != nil {
+		return nil, err
+	}
+	archive, err := Tar(container.rwPath(), Uncompressed)
+	if err != nil || container.runtime.remap == nil {
+		return archive, err
+	}
+	return container.runtime.remap.ArchiveToContainer(archive), nil
 }
 
-func (container *Container) Export() (Archive, error) {
-	if err := container.EnsureMounted(); err != nil {
+// Export streams the whole filesystem of the container (its image layers and
+// its own changes, flattened) as a tar archive, which must be closed.
+// If the container isn't mounted yet, it is mounted for the duration of the
+// export, and unmounted once the archive has been read entirely or closed.
+func (container *Container) Export() (io.ReadCloser, error) {
+	mounted, err := container.Mounted()
+	if err != nil {
 		return nil, err
 	}
-	return Tar(container.RootfsPath(), Uncompressed)
+	if !mounted {
+		if err := container.Mount(); err != nil {
+			return nil, err
+		}
+	}
+	archive, err := Tar(container.RootfsPath(), Uncompressed)
+	if err != nil {
+		if !mounted {
+			container.Unmount()
+		}
+		return nil, err
+	}
+	export := &exportReader{Reader: archive, tar: archive}
+	if container.runtime.remap != nil {
+		export.Reader = container.runtime.remap.ArchiveToContainer(archive)
+	}
+	if !mounted {
+		export.onClose = func() {
+			// The container may have been started while we were exporting it
+			if container.State.Running {
+				return
+			}
+			if err := container.Unmount(); err != nil {
+				containerLog.Errorf("%v: Failed to umount filesystem after export: %v", container.Id, err)
+			}
+		}
+	}
+	return export, nil
+}
+
+// exportReader is the archive of an export. It is closed once read
+// entirely: closing it stops the tar, then calls onClose.
+type exportReader struct {
+	io.Reader
+	tar     io.Closer
+	onClose func()
+	once    sync.Once
+}
+
+func (r *exportReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil {
+		r.Close()
+	}
+	return n, err
+}
+
+func (r *exportReader) Close() error {
+	r.once.Do(func() {
+		// Unblock the remapping of the ids, if any
+		if closer, ok := r.Reader.(io.Closer); ok {
+			closer.Close()
+		}
+		r.tar.Close()
+		if r.onClose != nil {
+			r.onClose()
+		}
+	})
+	return nil
 }
 
 func (container *Container) WaitTimeout(timeout time.Duration) error {
@@ -461,20 +1106,42 @@ func (container *Container) WaitTimeout(timeout time.Duration) error {
 }
 
 func (container *Container) EnsureMounted() error {
+	return container.ensureMounted(nil)
+}
+
+// ensureMounted mounts the container like EnsureMounted, unless aborted is
+// closed first
+func (container *Container) ensureMounted(aborted <-chan struct{}) error {
 	if mounted, err := container.Mounted(); err != nil {
 		return err
 	} else if mounted {
 		return nil
 	}
-	return container.Mount()
+	return container.mount(aborted)
 }
 
 func (container *Container) Mount() error {
+	return container.mount(nil)
+}
+
+func (container *Container) mount(aborted <-chan struct{}) error {
 	image, err := container.GetImage()
 	if err != nil {
 		return err
 	}
-	return image.Mount(container.RootfsPath(), container.rwPath())
+	if err := image.mount(container.RootfsPath(), container.rwPath(), aborted); err != nil {
+		return err
+	}
+	// The top of the aufs mount is the root directory of the container
+	if remap := container.runtime.remap; remap != nil {
+		if err := remap.Chown(container.rwPath()); err != nil {
+			return err
+		}
+	}
+	if container.MountLabel != "" {
+		return relabel(container.rwPath(), container.MountLabel)
+	}
+	return nil
 }
 
 func (container *Container) Changes() ([]Change, error) {
@@ -482,9 +1149,21 @@ func (container *Container) Changes() ([]Change, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := container.aufsWhiteouts(); err != nil {
+		return nil, err
+	}
 	return image.Changes(container.rwPath())
 }
 
+// aufsWhiteouts turns the whiteouts of fuse-overlayfs in the rw branch into
+// those of aufs, see overlay.go
+func (container *Container) aufsWhiteouts() error {
+	if container.runtime == nil || container.runtime.config.StorageDriver != "fuse-overlayfs" {
+		return nil
+	}
+	return aufsWhiteouts(container.rwPath())
+}
+
 func (container *Container) GetImage() (*Image, error) {
 	if container.runtime == nil {
 		return nil, fmt.Errorf("Can't get image of unregistered container")
@@ -505,6 +1184,9 @@ func (container *Container) logPath(name string) string {
 }
 
 func (container *Container) ReadLog(name string) (io.Reader, error) {
+	if container.LogDriver == "none" {
+		return nil, fmt.Errorf("The output of %s isn't logged (log driver: none)", container.Id)
+	}
 	return os.Open(container.logPath(name))
 }
 
@@ -516,6 +1198,15 @@ func (container *Container) lxcConfigPath() string {
 	return path.Join(container.root, "config.lxc")
 }
 
+// UsernsRemap returns the user namespace remap of the container, if any.
+// This method must be exported to be used from the lxc template
+func (container *Container) UsernsRemap() *UsernsRemap {
+	if container.runtime == nil {
+		return nil
+	}
+	return container.runtime.remap
+}
+
 // This method must be exported to be used from the lxc template
 func (container *Container) RootfsPath() string {
 	return path.Join(container.root, "rootfs")
@@ -525,6 +1216,11 @@ func (container *Container) rwPath() string {
 	return path.Join(container.root, "rw")
 }
 
+// RwSize returns the size of the files the container changed
+func (container *Container) RwSize() (int64, error) {
+	return dirSize(container.rwPath(), nil)
+}
+
 func validateId(id string) error {
 	if id == "" {
 		return fmt.Errorf("Invalid empty id")
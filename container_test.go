@@ -7,9 +7,12 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/exec"
+	"path"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -71,7 +74,7 @@ func TestCommitRun(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	img, err := runtime.graph.Create(rwTar, container1, "unit test commited image")
+	img, err := runtime.graph.Create(rwTar, container1, "unit test commited image", nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -243,6 +246,65 @@ func TestExitCode(t *testing.T) {
 	}
 }
 
+func TestRunInit(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	container, err := runtime.Create(&Config{
+		Image: GetTestImage(runtime).Id,
+		Cmd:   []string{"sh", "-c", "sleep 0 & echo -n $$; exit 3"},
+		Init:  true,
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The command is a child of the init
+	if string(output) == "1" {
+		t.Errorf("The command shouldn't be PID 1 with an init")
+	}
+	if container.State.ExitCode != 3 {
+		t.Errorf("Unexpected exit code %v", container.State.ExitCode)
+	}
+}
+
+func TestStopSignal(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	container, err := runtime.Create(&Config{
+		Image:      GetTestImage(runtime).Id,
+		Cmd:        []string{"sh", "-c", "trap 'exit 42' QUIT; while true; do sleep 1; done"},
+		Init:       true,
+		StopSignal: "SIGQUIT",
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Give the shell the time to set its trap
+	time.Sleep(500 * time.Millisecond)
+	if err := container.StopTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if container.State.ExitCode != 42 {
+		t.Errorf("The container should have exited on SIGQUIT, got exit code %d", container.State.ExitCode)
+	}
+}
+
 func TestRestart(t *testing.T) {
 	runtime, err := newTestRuntime()
 	if err != nil {
@@ -636,8 +698,13 @@ func TestLXCConfig(t *testing.T) {
 		Image: GetTestImage(runtime).Id,
 		Cmd:   []string{"/bin/true"},
 
-		Hostname: "foobar",
-		Memory:   int64(mem),
+		Hostname:  "foobar",
+		Memory:    int64(mem),
+		CpuShares: 512,
+		CpuQuota:  50000,
+		Tmpfs:     map[string]string{"/tmp": "size=16m"},
+
+		DeviceRules: []string{"c 10:229 rwm"},
 	},
 	)
 	if err != nil {
@@ -646,10 +713,18 @@ func TestLXCConfig(t *testing.T) {
 	defer runtime.Destroy(container)
 	container.generateLXCConfig()
 	grepFile(t, container.lxcConfigPath(), "lxc.utsname = foobar")
+	// The keys depend on the version of cgroups of the host, see cgroups.go
+	prefix := container.CgroupPrefix()
+	if limits := container.CgroupLimits(); len(limits) < 4 || limits[0].Value != fmt.Sprint(mem) {
+		t.Fatalf("Unexpected limits: %v", limits)
+	}
+	for _, limit := range container.CgroupLimits() {
+		grepFile(t, container.lxcConfigPath(), fmt.Sprintf("%s.%s = %s", prefix, limit.File, limit.Value))
+	}
+	grepFile(t, container.lxcConfigPath(), prefix+".devices.allow = c 1:3 rwm")
+	grepFile(t, container.lxcConfigPath(), prefix+".devices.allow = c 10:229 rwm")
 	grepFile(t, container.lxcConfigPath(),
-		fmt.Sprintf("lxc.cgroup.memory.limit_in_bytes = %d", mem))
-	grepFile(t, container.lxcConfigPath(),
-		fmt.Sprintf("lxc.cgroup.memory.memsw.limit_in_bytes = %d", mem*2))
+		fmt.Sprintf("lxc.mount.entry = tmpfs %s/tmp tmpfs size=16m,rw,noexec,nosuid,nodev 0 0", container.RootfsPath()))
 }
 
 func BenchmarkRunSequencial(b *testing.B) {
@@ -733,3 +808,319 @@ func BenchmarkRunParallel(b *testing.B) {
 		b.Fatal(errors)
 	}
 }
+
+func TestParseRunEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-envfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := writeEnvFile(t, dir, "FOO=file\nBAR=file\n")
+	config, _, err := ParseRun([]string{"-env-file", file, "-e", "FOO=flag", "base", "env"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(config.Env, []string{"BAR=file", "FOO=flag"}) {
+		t.Fatalf("Unexpected env: %v", config.Env)
+	}
+	if _, _, err := ParseRun([]string{"-env-file", path.Join(dir, "missing"), "base", "env"}, ioutil.Discard); err == nil {
+		t.Fatalf("A missing env file should be an error")
+	}
+}
+
+func TestParseRunFlags(t *testing.T) {
+	config, options, err := ParseRun([]string{"-cidfile", "/tmp/cid", "-e", "FOO=bar", "-w", "/srv", "-u", "daemon:daemon", "-entrypoint", "/bin/echo", "-h", "web1", "-v", "/data", "-v", "/srv/conf:/etc/app:ro", "-volumes-from", "data:ro", "-tmpfs", "/run", "-tmpfs", "/tmp:size=16m,exec", "-shm-size", "1g", "-sysctl", "net.core.somaxconn=1024", "-l", "owner=web", "-label", "canary", "-init", "-stop-signal", "QUIT", "-cap-add", "NET_ADMIN", "-cap-drop", "mknod", "-seccomp-profile", "unconfined", "-security-opt", "label=disable", "-privileged", "-device", "/dev/fuse", "-device-rule", "c 10:229 rwm", "-read-only", "-c", "512", "-cpu-quota", "50000", "-rm", "-detach-keys", "ctrl-a,d", "base", "hello"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.CidFile != "/tmp/cid" {
+		t.Errorf("Unexpected cidfile: %s", options.CidFile)
+	}
+	if len(config.Env) != 1 || config.Env[0] != "FOO=bar" {
+		t.Errorf("Unexpected env: %v", config.Env)
+	}
+	if len(config.Sysctls) != 1 || config.Sysctls["net.core.somaxconn"] != "1024" {
+		t.Errorf("Unexpected sysctls: %v", config.Sysctls)
+	}
+	if config.ShmSize != 1<<30 {
+		t.Errorf("Unexpected size of /dev/shm: %d", config.ShmSize)
+	}
+	if config.WorkingDir != "/srv" || config.User != "daemon:daemon" || config.Hostname != "web1" || !config.Init || config.StopSignal != "QUIT" || config.Seccomp != SECCOMP_UNCONFINED {
+		t.Errorf("Unexpected config: %#v", config)
+	}
+	if len(config.Entrypoint) != 1 || config.Entrypoint[0] != "/bin/echo" {
+		t.Errorf("Unexpected entrypoint: %v", config.Entrypoint)
+	}
+	if config.Image != "base" || len(config.Cmd) != 1 || config.Cmd[0] != "hello" {
+		t.Errorf("Unexpected image and command: %s %v", config.Image, config.Cmd)
+	}
+	if _, exists := config.Volumes["/data"]; !exists || len(config.Volumes) != 1 {
+		t.Errorf("Unexpected volumes: %v", config.Volumes)
+	}
+	if len(config.Binds) != 1 || config.Binds[0] != "/srv/conf:/etc/app:ro" {
+		t.Errorf("Unexpected binds: %v", config.Binds)
+	}
+	if len(config.VolumesFrom) != 1 || config.VolumesFrom[0] != "data:ro" {
+		t.Errorf("Unexpected volumes-from: %v", config.VolumesFrom)
+	}
+	if options, exists := config.Tmpfs["/run"]; !exists || options != "" || config.Tmpfs["/tmp"] != "size=16m,exec" {
+		t.Errorf("Unexpected tmpfs: %v", config.Tmpfs)
+	}
+	if len(config.CapAdd) != 1 || config.CapAdd[0] != "NET_ADMIN" || len(config.CapDrop) != 1 || config.CapDrop[0] != "mknod" {
+		t.Errorf("Unexpected capabilities: %v %v", config.CapAdd, config.CapDrop)
+	}
+	if len(config.SecurityOpt) != 1 || config.SecurityOpt[0] != "label=disable" || !config.Privileged || len(config.Devices) != 1 || config.Devices[0] != "/dev/fuse" || !config.ReadOnly {
+		t.Errorf("Unexpected security settings: %v %v %v", config.SecurityOpt, config.Privileged, config.Devices)
+	}
+	if len(config.DeviceRules) != 1 || config.DeviceRules[0] != "c 10:229 rwm" {
+		t.Errorf("Unexpected device rules: %v", config.DeviceRules)
+	}
+	if config.CpuShares != 512 || config.CpuQuota != 50000 {
+		t.Errorf("Unexpected CPU settings: %d %d", config.CpuShares, config.CpuQuota)
+	}
+	if !config.AutoRemove || options.DetachKeys != "ctrl-a,d" {
+		t.Errorf("Unexpected client settings: %v %q", config.AutoRemove, options.DetachKeys)
+	}
+	if value, exists := config.Labels["canary"]; !exists || value != "" || config.Labels["owner"] != "web" || len(config.Labels) != 2 {
+		t.Errorf("Unexpected labels: %v", config.Labels)
+	}
+	if err := validateConfig(config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{Image: "base"},
+		{Image: "base", Entrypoint: []string{""}},
+		{Image: "base", Cmd: []string{"ls"}, Hostname: "-web"},
+		{Image: "base", Cmd: []string{"ls"}, Hostname: "web_1"},
+		{Image: "base", Cmd: []string{"ls"}, WorkingDir: "srv"},
+		{Image: "base", Cmd: []string{"ls"}, User: "daemon:"},
+		{Image: "base", Cmd: []string{"ls"}, User: "a:b:c"},
+		{Image: "base", Cmd: []string{"ls"}, Env: []string{"FOO"}},
+		{Image: "base", Cmd: []string{"ls"}, StopSignal: "SIGFOO"},
+		{Image: "base", Cmd: []string{"ls"}, Timezone: "/etc/localtime"},
+		{Image: "base", Cmd: []string{"ls"}, CapAdd: []string{"sys_foo"}},
+		{Image: "base", Cmd: []string{"ls"}, Seccomp: `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["frobnicate"], "action": "SCMP_ACT_KILL"}]}`},
+		{Image: "base", Cmd: []string{"ls"}, Env: []string{"=bar"}},
+		{Image: "base", Cmd: []string{"ls"}, Volumes: map[string]struct{}{"data": {}}},
+		{Image: "base", Cmd: []string{"ls"}, Binds: []string{"/srv:/data:rx"}},
+		{Image: "base", Cmd: []string{"ls"}, VolumesFrom: []string{"data:rx"}},
+		{Image: "base", Cmd: []string{"ls"}, VolumesFrom: []string{":ro"}},
+		{Image: "base", Cmd: []string{"ls"}, Tmpfs: map[string]string{"tmp": ""}},
+		{Image: "base", Cmd: []string{"ls"}, Tmpfs: map[string]string{"/tmp": "size"}},
+		{Image: "base", Cmd: []string{"ls"}, Tmpfs: map[string]string{"/tmp": "exec=1"}},
+		{Image: "base", Cmd: []string{"ls"}, Tmpfs: map[string]string{"/tmp": "bind"}},
+		{Image: "base", Cmd: []string{"ls"}, Labels: map[string]string{"": "web"}},
+		{Image: "base", Cmd: []string{"ls"}, CpuShares: -1},
+		{Image: "base", Cmd: []string{"ls"}, ShmSize: -1},
+		{Image: "base", Cmd: []string{"ls"}, Sysctls: map[string]string{"kernel.hostname": "web"}},
+		{Image: "base", Cmd: []string{"ls"}, CpuQuota: 500},
+		{Image: "base", Cmd: []string{"ls"}, Restart: "sometimes"},
+		{Image: "base", Cmd: []string{"ls"}, Restart: "always:3"},
+		{Image: "base", Cmd: []string{"ls"}, Restart: "on-failure:-1"},
+		{Image: "base", Cmd: []string{"ls"}, Restart: "always", AutoRemove: true},
+		{Image: "base", Cmd: []string{"ls"}, DeviceRules: []string{"c 10:229"}},
+	} {
+		if err := validateConfig(config); err == nil {
+			t.Errorf("%#v should be invalid", config)
+		}
+	}
+	for _, config := range []*Config{
+		{Image: "base", Cmd: []string{"ls"}},
+		{Image: "base", Entrypoint: []string{"/bin/ls"}},
+		{Image: "base", Cmd: []string{"ls"}, Hostname: "web-1.example.com", WorkingDir: "/srv", User: "1:1", Env: []string{"FOO=", "BAR=a=b"}},
+		{Image: "base", Cmd: []string{"ls"}, CpuShares: 512, CpuQuota: 50000, Restart: "on-failure:3"},
+		{Image: "base", Cmd: []string{"ls"}, Restart: "no", AutoRemove: true},
+	} {
+		if err := validateConfig(config); err != nil {
+			t.Errorf("%#v should be valid: %s", config, err)
+		}
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	imageConf := &Config{
+		User:       "daemon",
+		Cmd:        []string{"/bin/ls"},
+		Env:        []string{"FOO=1", "BAR=2"},
+		Ports:      []int{80, 443},
+		WorkingDir: "/srv",
+		Volumes:    map[string]struct{}{"/data": {}},
+		Labels:     map[string]string{"owner": "ops", "tier": "db"},
+		StopSignal: "SIGQUIT",
+	}
+	userConf := &Config{
+		Cmd:    []string{"/bin/echo"},
+		Env:    []string{"BAR=3"},
+		Ports:  []int{80, 8080},
+		Labels: map[string]string{"owner": "web"},
+	}
+	MergeConfig(userConf, imageConf)
+	if userConf.User != "daemon" || userConf.WorkingDir != "/srv" || userConf.StopSignal != "SIGQUIT" {
+		t.Errorf("Unexpected config: %#v", userConf)
+	}
+	if len(userConf.Cmd) != 1 || userConf.Cmd[0] != "/bin/echo" {
+		t.Errorf("The command of the user should be kept, got %v", userConf.Cmd)
+	}
+	if strings.Join(userConf.Env, " ") != "FOO=1 BAR=3" {
+		t.Errorf("Unexpected environment: %v", userConf.Env)
+	}
+	if len(userConf.Ports) != 3 || userConf.Ports[2] != 443 {
+		t.Errorf("Unexpected ports: %v", userConf.Ports)
+	}
+	if _, exists := userConf.Volumes["/data"]; !exists {
+		t.Errorf("The volumes of the image should be added, got %v", userConf.Volumes)
+	}
+	if len(userConf.Labels) != 2 || userConf.Labels["owner"] != "web" || userConf.Labels["tier"] != "db" {
+		t.Errorf("Unexpected labels: %v", userConf.Labels)
+	}
+}
+
+func TestEntrypointAndWorkingDir(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	container, err := runtime.Create(&Config{
+		Image:      GetTestImage(runtime).Id,
+		Entrypoint: []string{"/bin/sh", "-c"},
+		Cmd:        []string{"pwd"},
+		WorkingDir: "/tmp/docker-workdir",
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if container.Path != "/bin/sh" || len(container.Args) != 2 || container.Args[1] != "pwd" {
+		t.Fatalf("Unexpected command: %s %v", container.Path, container.Args)
+	}
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(output)) != "/tmp/docker-workdir" {
+		t.Errorf("Expected the working directory to be /tmp/docker-workdir, got %s", output)
+	}
+}
+
+func TestContainerStreams(t *testing.T) {
+	lock := new(sync.Mutex)
+	container := &Container{State: State{stateChangeLock: lock, stateChangeCond: sync.NewCond(lock)}}
+	drained := make(chan struct{})
+	first := container.trackStream(ioutil.NopCloser(strings.NewReader("output")))
+	second := container.trackStream(ioutil.NopCloser(strings.NewReader("")))
+	go func() {
+		container.waitStreams()
+		close(drained)
+	}()
+	if _, err := ioutil.ReadAll(first); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	select {
+	case <-drained:
+		t.Fatalf("A stream is still attached")
+	case <-time.After(50 * time.Millisecond):
+	}
+	second.Close()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("The streams should be drained")
+	}
+}
+
+func TestWaitExit(t *testing.T) {
+	lock := new(sync.Mutex)
+	state := &State{stateChangeLock: lock, stateChangeCond: sync.NewCond(lock)}
+	exits := state.exitCount()
+	// The exit isn't missed even though it happens before waitExit
+	state.setRunning(42)
+	state.setStopped(3)
+	if status := state.waitExit(exits); status != 3 {
+		t.Errorf("Expected exit code 3, got %d", status)
+	}
+}
+
+func TestAutoRemove(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	container, err := runtime.Create(&Config{
+		Image:      GetTestImage(runtime).Id,
+		Cmd:        []string{"echo", "removed"},
+		Volumes:    map[string]struct{}{"/data": {}},
+		AutoRemove: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := container.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	volumes := len(runtime.volumes.List())
+	container.Wait()
+	// The container is kept until its output is read
+	time.Sleep(100 * time.Millisecond)
+	if runtime.Get(container.Id) == nil {
+		t.Fatalf("The container was removed before its output was read")
+	}
+	output, err := ioutil.ReadAll(stdout)
+	if err != nil || string(output) != "removed\n" {
+		t.Fatalf("Unexpected output: %q (%v)", output, err)
+	}
+	for i := 0; runtime.Get(container.Id) != nil; i++ {
+		if i > 50 {
+			t.Fatalf("The container wasn't removed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := os.Stat(container.root); !os.IsNotExist(err) {
+		t.Errorf("The directory of the container should be removed (%v)", err)
+	}
+	if len(runtime.volumes.List()) != volumes-1 {
+		t.Errorf("The anonymous volume of the container should be removed")
+	}
+}
+
+func TestExportReaderClose(t *testing.T) {
+	tar, err := CmdStream(exec.Command("yes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := 0
+	export := &exportReader{Reader: tar, tar: tar, onClose: func() { closed++ }}
+	if _, err := export.Read(make([]byte, 4)); err != nil || closed != 0 {
+		t.Fatalf("Unexpected read: %v, closed %d times", err, closed)
+	}
+	// The stream is abandoned
+	export.Close()
+	export.Close()
+	if closed != 1 {
+		t.Errorf("Expected onClose to be called once, got %d", closed)
+	}
+
+	// or read until the end
+	tar, err = CmdStream(exec.Command("echo", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed = 0
+	export = &exportReader{Reader: tar, tar: tar, onClose: func() { closed++ }}
+	if output, err := ioutil.ReadAll(export); err != nil || string(output) != "hello\n" {
+		t.Fatalf("Unexpected output %q (%v)", output, err)
+	}
+	if closed != 1 {
+		t.Errorf("Expected onClose to be called at the end of the stream, got %d calls", closed)
+	}
+}
@@ -0,0 +1,442 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_DAEMON_CONFIG_FILE = "/etc/docker/daemon.json"
+
+// DaemonConfig holds the settings of the daemon. They are set by the
+// command-line flags installed by InstallFlags, and by the JSON object of
+// the config file, whose keys are the names of the flags.
+type DaemonConfig struct {
+	Root               string        // Directory of the images, containers and volumes
+	StorageDriver      string        // Filesystem of the containers: aufs or fuse-overlayfs, see overlay.go
+	MaxLayers          int           // Layers of the images committed at most, or 0 for no limit, see depth.go
+	SquashLayers       bool          // Squash the images committed beyond MaxLayers into a single layer instead of failing
+	BridgeIface        string        // Bridge the containers are connected to
+	NetworkPoolSize    int           // Number of veth pairs created in advance for the containers starting, see netpool.go
+	CgroupDriver       string        // Manager of the cgroups of the containers: cgroupfs or systemd, see systemd.go
+	DefaultUlimits     ListOpts      // Resource limits of the containers: NAME=SOFT[:HARD]
+	DefaultDeviceRules ListOpts      // Device cgroup whitelist of the containers, instead of DEFAULT_DEVICE_RULES, see devices.go
+	LogDriver          string        // Where the output of the containers goes by default
+	DefaultTimezone    string        // Timezone of the containers which don't set one, see timezone.go
+	DefaultShmSize     string        // Size of the /dev/shm of the containers which don't set one, eg. 64m
+	RegistryMirrors    ListOpts      // Registries tried before the default index when pulling
+	InsecureRegistries ListOpts      // Registries which are reached over plain http
+	ForeignLayerHosts  ListOpts      // Hosts the foreign layers may be downloaded from: HOST[:PORT], or .DOMAIN for its subdomains
+	HttpProxy          string        // Proxy of the http registries, $HTTP_PROXY if unset, see proxy.go
+	HttpsProxy         string        // Proxy of the https registries, $HTTPS_PROXY if unset
+	NoProxy            string        // Registries reached without proxy, $NO_PROXY if unset, eg. ".example.com,10.0.0.0/8"
+	RegistryProxies    ListOpts      // Proxies of given registries: HOST=URL, or HOST=direct
+	PullRetries        int           // Number of times an interrupted layer download is resumed
+	PullRetryDelay     time.Duration // Delay before resuming a download, doubled after each attempt
+	ShutdownTimeout    time.Duration // Time given to the containers to exit on shutdown before they are killed
+	LiveRestore        bool          // Keep the containers running across daemon restarts, see shim.go
+	Rootless           bool          // Run as an unprivileged user, in the namespaces of rootlesskit, see rootless.go
+	LogLevel           string        // Level of the daemon logs, with levels by subsystem, eg. "info,graph=debug"
+	LogFormat          string        // Format of the daemon logs: text or json
+	AuditLog           string        // File logging the API requests which change the state of the daemon, if set
+	AuditLogMaxSize    int64         // Size in MB above which the audit log is rotated
+	AuditLogMaxFiles   int           // Number of rotated audit logs kept
+	UsernsRemap        string        // USER[:GROUP] whose subordinate ids the ids of the containers are mapped to, see userns.go
+	SelinuxEnabled     bool          // Label the processes and files of the containers for SELinux, see security.go
+	ContentTrust       bool          // Refuse to pull the images which aren't signed by a trusted key, see trust.go
+	Scanners           ListOpts      // Commands scanning the images pulled and built, see scan.go
+	PrestartHooks      ListOpts      // Commands adding devices, mounts and env to the containers starting, see hooks.go
+	AuthzPlugins       ListOpts      // Plugins allowing or denying the API requests, see authz.go
+	Experimental       bool          // Enable the experimental features, eg. checkpoints, see checkpoint.go
+	MetricsAddr        string        // HOST:PORT serving the metrics in the Prometheus format on /metrics, if set, see metrics.go
+	MaxPulls           int           // Pulls running at a time, the others are queued, or 0 for no limit, see queue.go
+	MaxPushes          int           // Pushes running at a time, likewise
+	MaxBuilds          int           // Builds running at a time, likewise
+	Webhooks           ListOpts      // URLs the events are POSTed to, see webhook.go
+	WebhookFilters     ListOpts      // Filters of the events POSTed, like those of 'docker events'
+	WebhookSecretFile  string        // File of the key signing the events POSTed, if set
+}
+
+func DefaultDaemonConfig() *DaemonConfig {
+	return &DaemonConfig{
+		Root:             "/var/lib/docker",
+		StorageDriver:    "aufs",
+		MaxLayers:        DEFAULT_MAX_LAYERS,
+		BridgeIface:      networkBridgeIface,
+		CgroupDriver:     "cgroupfs",
+		LogDriver:        "file",
+		DefaultShmSize:   "64m",
+		PullRetries:      DEFAULT_DOWNLOAD_RETRIES,
+		PullRetryDelay:   DEFAULT_DOWNLOAD_RETRY_DELAY,
+		ShutdownTimeout:  10 * time.Second,
+		LogLevel:         "info",
+		LogFormat:        "text",
+		AuditLogMaxSize:  100,
+		AuditLogMaxFiles: 5,
+		MaxPulls:         3,
+		MaxPushes:        5,
+	}
+}
+
+// The storage drivers, and the filesystems they need from the kernel
+var storageDrivers = map[string]string{
+	"aufs":           "aufs",
+	"fuse-overlayfs": "fuse", // Mountable by unprivileged users
+}
+
+// The drivers storing the output of the containers
+var logDrivers = map[string]bool{
+	"file": true, // In files of the container directory, for 'docker logs'
+	"none": true, // Discarded
+}
+
+// The resources which can be limited with DefaultUlimits, by their
+// numbers on linux, where the containers run
+var ulimitResources = map[string]int{
+	"as":      9,
+	"core":    4,
+	"cpu":     0,
+	"data":    2,
+	"fsize":   1,
+	"memlock": 8,
+	"nofile":  7,
+	"nproc":   6,
+	"stack":   3,
+}
+
+// rlimit is a resource limit, like syscall.Rlimit on linux
+type rlimit struct {
+	Cur uint64
+	Max uint64
+}
+
+var daemonFlagShorthands = map[string]string{
+	"g": "graph",
+	"s": "storage-driver",
+	"b": "bridge",
+}
+
+// InstallFlags defines the flags of the daemon settings in fs, with the
+// current values of config as defaults
+func (config *DaemonConfig) InstallFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.Root, "graph", config.Root, "Root of the docker runtime (daemon mode only)")
+	fs.StringVar(&config.StorageDriver, "storage-driver", config.StorageDriver, "Storage driver of the containers: aufs, or fuse-overlayfs for unprivileged users (daemon mode only)")
+	fs.IntVar(&config.MaxLayers, "max-layers", config.MaxLayers, "Number of layers of the images committed and built at most, or 0 for no limit (daemon mode only)")
+	fs.BoolVar(&config.SquashLayers, "squash-layers", config.SquashLayers, "Squash the images committed beyond -max-layers into a single layer instead of failing (daemon mode only)")
+	fs.StringVar(&config.BridgeIface, "bridge", config.BridgeIface, "Bridge the containers are connected to (daemon mode only)")
+	fs.IntVar(&config.NetworkPoolSize, "network-pool-size", config.NetworkPoolSize, "Number of veth pairs created in advance for the containers starting, or 0 to create them as the containers start (daemon mode only)")
+	for shorthand, name := range daemonFlagShorthands {
+		f := fs.Lookup(name)
+		fs.Var(f.Value, shorthand, "Shorthand for -"+name)
+	}
+	fs.StringVar(&config.CgroupDriver, "cgroup-driver", config.CgroupDriver, "Manager of the cgroups of the containers: cgroupfs, or systemd to start them in systemd scopes (daemon mode only)")
+	fs.Var(&config.DefaultUlimits, "default-ulimit", "Resource limit of the containers, eg. nofile=1024:2048 (daemon mode only)")
+	fs.Var(&config.DefaultDeviceRules, "default-device-rule", "Rule of the device cgroup whitelist of the containers, replacing the built-in whitelist, eg. 'c 10:229 rwm' (daemon mode only)")
+	fs.StringVar(&config.LogDriver, "log-driver", config.LogDriver, "Default log driver of the containers: file or none (daemon mode only)")
+	fs.StringVar(&config.DefaultShmSize, "default-shm-size", config.DefaultShmSize, "Size of /dev/shm in the containers which don't set one with -shm-size (daemon mode only)")
+	fs.StringVar(&config.DefaultTimezone, "default-timezone", config.DefaultTimezone, "Timezone of the containers which don't set one with -tz: host, a zone, eg. Europe/Paris, or none (daemon mode only)")
+	fs.Var(&config.RegistryMirrors, "registry-mirror", "Try pulling images of the docker index from the mirror at URL first (daemon mode only)")
+	fs.Var(&config.InsecureRegistries, "insecure-registry", "Allow plain http access to the registry at HOST:PORT (daemon mode only)")
+	fs.Var(&config.ForeignLayerHosts, "foreign-layer-host", "Allow downloading the foreign layers of the images pulled from HOST[:PORT], or from the subdomains of .DOMAIN (daemon mode only)")
+	fs.StringVar(&config.HttpProxy, "http-proxy", config.HttpProxy, "Proxy of the requests to the http registries, $HTTP_PROXY if unset (daemon mode only)")
+	fs.StringVar(&config.HttpsProxy, "https-proxy", config.HttpsProxy, "Proxy of the requests to the https registries, $HTTPS_PROXY if unset (daemon mode only)")
+	fs.StringVar(&config.NoProxy, "no-proxy", config.NoProxy, "Comma-separated registries reached without proxy: hosts, domains, IPs or CIDRs, $NO_PROXY if unset (daemon mode only)")
+	fs.Var(&config.RegistryProxies, "registry-proxy", "Proxy of the registry at HOST[:PORT]: HOST=URL, or HOST=direct to bypass the proxies (daemon mode only)")
+	fs.IntVar(&config.PullRetries, "pull-retries", config.PullRetries, "Number of times an interrupted layer download is resumed (daemon mode only)")
+	fs.DurationVar(&config.PullRetryDelay, "pull-retry-delay", config.PullRetryDelay, "Delay before resuming an interrupted layer download, doubled after each attempt (daemon mode only)")
+	fs.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "Time given to the containers to exit when the daemon shuts down, before they are killed (daemon mode only)")
+	fs.BoolVar(&config.LiveRestore, "live-restore", config.LiveRestore, "Keep the containers running across daemon restarts (daemon mode only)")
+	fs.BoolVar(&config.Rootless, "rootless", config.Rootless, "Run the daemon as an unprivileged user, through rootlesskit (daemon mode only)")
+	fs.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Level of the daemon logs: debug, info, warn or error, optionally followed by levels of subsystems, eg. info,graph=debug (daemon mode only)")
+	fs.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Format of the daemon logs: text or json (daemon mode only)")
+	fs.StringVar(&config.AuditLog, "audit-log", config.AuditLog, "Log the API requests which change the state of the daemon to this file (daemon mode only)")
+	fs.Int64Var(&config.AuditLogMaxSize, "audit-log-max-size", config.AuditLogMaxSize, "Size in MB above which the audit log is rotated (daemon mode only)")
+	fs.IntVar(&config.AuditLogMaxFiles, "audit-log-max-files", config.AuditLogMaxFiles, "Number of rotated audit logs kept (daemon mode only)")
+	fs.BoolVar(&config.ContentTrust, "content-trust", config.ContentTrust, "Refuse to pull the images which aren't signed by a trusted key (daemon mode only)")
+	fs.Var(&config.Scanners, "scanner", "Command scanning the images pulled and built, eg. for vulnerabilities (daemon mode only)")
+	fs.Var(&config.PrestartHooks, "prestart-hook", "Command adding devices, mounts and environment variables to the containers before they start, eg. for GPUs (daemon mode only)")
+	fs.Var(&config.AuthzPlugins, "authorization-plugin", "Plugin allowing or denying the API requests, in the order given (daemon mode only)")
+	fs.BoolVar(&config.SelinuxEnabled, "selinux-enabled", config.SelinuxEnabled, "Label the processes and files of the containers for SELinux (daemon mode only)")
+	fs.StringVar(&config.UsernsRemap, "userns-remap", config.UsernsRemap, "Map root and the other users of the containers to the subordinate ids of USER[:GROUP] (daemon mode only)")
+	fs.BoolVar(&config.Experimental, "experimental", config.Experimental, "Enable the experimental features, eg. checkpoints (daemon mode only)")
+	fs.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "Serve the metrics of the daemon in the Prometheus format on /metrics at HOST:PORT (daemon mode only)")
+	fs.IntVar(&config.MaxPulls, "max-pulls", config.MaxPulls, "Number of pulls running at a time, the others are queued, or 0 for no limit (daemon mode only)")
+	fs.IntVar(&config.MaxPushes, "max-pushes", config.MaxPushes, "Number of pushes running at a time, the others are queued, or 0 for no limit (daemon mode only)")
+	fs.IntVar(&config.MaxBuilds, "max-builds", config.MaxBuilds, "Number of builds running at a time, the others are queued, or 0 for no limit (daemon mode only)")
+	fs.Var(&config.Webhooks, "webhook", "POST the events as JSON to this URL (daemon mode only)")
+	fs.Var(&config.WebhookFilters, "webhook-filter", "POST only the events matching KEY=VALUE, like the filters of 'docker events' (daemon mode only)")
+	fs.StringVar(&config.WebhookSecretFile, "webhook-secret-file", config.WebhookSecretFile, "Sign the events POSTed with HMAC-SHA256 and the key in this file (daemon mode only)")
+}
+
+// LoadDaemonConfigFile sets the flags of fs which weren't given on the
+// command line from the JSON object in file, eg.
+// {"graph": "/srv/docker", "registry-mirror": ["mirror.example.com"]}.
+// A missing file is ignored unless mustExist is true.
+func LoadDaemonConfigFile(fs *flag.FlagSet, file string, mustExist bool) error {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) && !mustExist {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("Invalid config file %s: %s", file, err)
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if name, isShorthand := daemonFlagShorthands[f.Name]; isShorthand {
+			given[name] = true
+		}
+	})
+	for name, value := range values {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("Invalid config file %s: unknown setting %s", file, name)
+		}
+		if given[name] {
+			continue
+		}
+		list, isList := value.([]interface{})
+		if !isList {
+			list = []interface{}{value}
+		}
+		for _, v := range list {
+			if _, isObject := v.(map[string]interface{}); isObject {
+				return fmt.Errorf("Invalid config file %s: invalid value of %s", file, name)
+			}
+			if err := fs.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("Invalid config file %s: %s: %s", file, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseUlimit parses a resource limit: NAME=SOFT[:HARD]. The hard limit
+// defaults to the soft one.
+func parseUlimit(ulimit string) (resource int, limit *rlimit, err error) {
+	parts := strings.SplitN(ulimit, "=", 2)
+	resource, exists := ulimitResources[parts[0]]
+	if !exists || len(parts) != 2 {
+		return 0, nil, fmt.Errorf("Invalid ulimit: %s (expected NAME=SOFT[:HARD])", ulimit)
+	}
+	values := strings.SplitN(parts[1], ":", 2)
+	limit = &rlimit{}
+	if limit.Cur, err = strconv.ParseUint(values[0], 10, 64); err != nil {
+		return 0, nil, fmt.Errorf("Invalid ulimit: %s", ulimit)
+	}
+	limit.Max = limit.Cur
+	if len(values) == 2 {
+		if limit.Max, err = strconv.ParseUint(values[1], 10, 64); err != nil {
+			return 0, nil, fmt.Errorf("Invalid ulimit: %s", ulimit)
+		}
+	}
+	if limit.Cur > limit.Max {
+		return 0, nil, fmt.Errorf("Invalid ulimit: %s (the soft limit is above the hard limit)", ulimit)
+	}
+	return resource, limit, nil
+}
+
+// Validate checks the settings
+func (config *DaemonConfig) Validate() error {
+	if !path.IsAbs(config.Root) {
+		return fmt.Errorf("The root of the runtime must be an absolute path: %s", config.Root)
+	}
+	if _, exists := storageDrivers[config.StorageDriver]; !exists {
+		return fmt.Errorf("Unsupported storage driver: %s (expected aufs or fuse-overlayfs)", config.StorageDriver)
+	}
+	if config.MaxLayers < 0 {
+		return fmt.Errorf("The maximum number of layers can't be negative")
+	}
+	if config.BridgeIface == "" {
+		return fmt.Errorf("The bridge can't be empty")
+	}
+	if config.NetworkPoolSize < 0 {
+		return fmt.Errorf("The size of the network pool can't be negative")
+	}
+	if !cgroupDrivers[config.CgroupDriver] {
+		return fmt.Errorf("Unknown cgroup driver: %s (expected cgroupfs or systemd)", config.CgroupDriver)
+	}
+	for _, ulimit := range config.DefaultUlimits {
+		if _, _, err := parseUlimit(ulimit); err != nil {
+			return err
+		}
+	}
+	for _, rule := range config.DefaultDeviceRules {
+		if _, err := parseDeviceRule(rule); err != nil {
+			return err
+		}
+	}
+	if !logDrivers[config.LogDriver] {
+		return fmt.Errorf("Unknown log driver: %s", config.LogDriver)
+	}
+	if err := validateTimezone(config.DefaultTimezone); err != nil {
+		return err
+	}
+	if size, err := ParseSize(config.DefaultShmSize); err != nil {
+		return err
+	} else if size == 0 {
+		return fmt.Errorf("The size of /dev/shm can't be 0")
+	}
+	for _, proxy := range []string{config.HttpProxy, config.HttpsProxy} {
+		if _, err := parseProxyURL(proxy); err != nil {
+			return err
+		}
+	}
+	for _, override := range config.RegistryProxies {
+		if _, _, err := parseRegistryProxy(override); err != nil {
+			return err
+		}
+	}
+	if config.PullRetries < 0 || config.PullRetryDelay < 0 {
+		return fmt.Errorf("The pull retries and their delay can't be negative")
+	}
+	if config.ShutdownTimeout < 0 {
+		return fmt.Errorf("The shutdown timeout can't be negative")
+	}
+	if _, _, err := parseLogLevels(config.LogLevel); err != nil {
+		return err
+	}
+	if !logFormats[config.LogFormat] {
+		return fmt.Errorf("Unknown log format: %s (expected text or json)", config.LogFormat)
+	}
+	if config.AuditLog != "" && !path.IsAbs(config.AuditLog) {
+		return fmt.Errorf("The audit log must be an absolute path: %s", config.AuditLog)
+	}
+	if config.AuditLogMaxSize <= 0 || config.AuditLogMaxFiles <= 0 {
+		return fmt.Errorf("The size and the number of the audit logs must be positive")
+	}
+	if config.Rootless && config.StorageDriver != "fuse-overlayfs" {
+		return fmt.Errorf("Rootless mode requires the fuse-overlayfs storage driver")
+	}
+	if config.Rootless && (config.UsernsRemap != "" || config.CgroupDriver == "systemd") {
+		return fmt.Errorf("Rootless mode can't be combined with userns-remap or the systemd cgroup driver")
+	}
+	if config.UsernsRemap != "" {
+		if _, _, err := parseUsernsRemap(config.UsernsRemap); err != nil {
+			return err
+		}
+	}
+	for _, host := range config.ForeignLayerHosts {
+		if host == "" || host == "." || strings.ContainsAny(host, "/*") {
+			return fmt.Errorf("Invalid foreign layer host: %s (expected HOST[:PORT] or .DOMAIN)", host)
+		}
+	}
+	for _, scanner := range config.Scanners {
+		if !path.IsAbs(scanner) {
+			return fmt.Errorf("The scanner must be an absolute path: %s", scanner)
+		}
+	}
+	for _, hook := range config.PrestartHooks {
+		if !path.IsAbs(hook) {
+			return fmt.Errorf("The prestart hook must be an absolute path: %s", hook)
+		}
+	}
+	for _, plugin := range config.AuthzPlugins {
+		if plugin == "" || strings.ContainsAny(plugin, "/") {
+			return fmt.Errorf("Invalid authorization plugin: %s (expected the name of a plugin)", plugin)
+		}
+	}
+	if config.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(config.MetricsAddr); err != nil {
+			return fmt.Errorf("Invalid metrics address %s: %s", config.MetricsAddr, err)
+		}
+	}
+	if config.MaxPulls < 0 || config.MaxPushes < 0 || config.MaxBuilds < 0 {
+		return fmt.Errorf("The maximum numbers of pulls, pushes and builds can't be negative")
+	}
+	for _, hook := range config.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid webhook: %s (expected an http or https URL)", hook)
+		}
+	}
+	filters, err := parseFilterOpts(config.WebhookFilters)
+	if err != nil {
+		return err
+	}
+	for name := range filters {
+		if !eventFilters[name] {
+			return fmt.Errorf("Invalid webhook filter: %s", name)
+		}
+	}
+	if config.WebhookSecretFile != "" && !path.IsAbs(config.WebhookSecretFile) {
+		return fmt.Errorf("The webhook secret file must be an absolute path: %s", config.WebhookSecretFile)
+	}
+	return nil
+}
+
+// String returns the settings, one per line, by flag name
+func (config *DaemonConfig) String() string {
+	settings := map[string]interface{}{
+		"graph":                config.Root,
+		"storage-driver":       config.StorageDriver,
+		"max-layers":           config.MaxLayers,
+		"squash-layers":        config.SquashLayers,
+		"bridge":               config.BridgeIface,
+		"network-pool-size":    config.NetworkPoolSize,
+		"cgroup-driver":        config.CgroupDriver,
+		"default-ulimit":       []string(config.DefaultUlimits),
+		"default-device-rule":  []string(config.DefaultDeviceRules),
+		"log-driver":           config.LogDriver,
+		"default-timezone":     config.DefaultTimezone,
+		"default-shm-size":     config.DefaultShmSize,
+		"registry-mirror":      []string(config.RegistryMirrors),
+		"insecure-registry":    []string(config.InsecureRegistries),
+		"foreign-layer-host":   []string(config.ForeignLayerHosts),
+		"http-proxy":           redactProxy(config.HttpProxy),
+		"https-proxy":          redactProxy(config.HttpsProxy),
+		"no-proxy":             config.NoProxy,
+		"registry-proxy":       redactRegistryProxies(config.RegistryProxies),
+		"pull-retries":         config.PullRetries,
+		"pull-retry-delay":     config.PullRetryDelay,
+		"shutdown-timeout":     config.ShutdownTimeout,
+		"live-restore":         config.LiveRestore,
+		"rootless":             config.Rootless,
+		"log-level":            config.LogLevel,
+		"log-format":           config.LogFormat,
+		"audit-log":            config.AuditLog,
+		"audit-log-max-size":   config.AuditLogMaxSize,
+		"audit-log-max-files":  config.AuditLogMaxFiles,
+		"userns-remap":         config.UsernsRemap,
+		"selinux-enabled":      config.SelinuxEnabled,
+		"content-trust":        config.ContentTrust,
+		"scanner":              config.Scanners,
+		"prestart-hook":        []string(config.PrestartHooks),
+		"authorization-plugin": []string(config.AuthzPlugins),
+		"experimental":         config.Experimental,
+		"metrics-addr":         config.MetricsAddr,
+		"max-pulls":            config.MaxPulls,
+		"max-pushes":           config.MaxPushes,
+		"max-builds":           config.MaxBuilds,
+		"webhook":              []string(config.Webhooks),
+		"webhook-filter":       []string(config.WebhookFilters),
+		"webhook-secret-file":  config.WebhookSecretFile,
+	}
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		value := settings[name]
+		if list, isList := value.([]string); isList {
+			value = strings.Join(list, ", ")
+		}
+		fmt.Fprintf(&buf, "%s: %v\n", name, value)
+	}
+	return buf.String()
+}
@@ -0,0 +1,135 @@
+package docker
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDaemonConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "daemon.json")
+	if err := ioutil.WriteFile(file, []byte(`{
+	"graph": "/srv/docker",
+	"bridge": "br0",
+	"registry-mirror": ["mirror1.example.com", "mirror2.example.com"],
+	"pull-retries": 2,
+	"pull-retry-delay": "3s",
+	"live-restore": true
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultDaemonConfig()
+	fs := flag.NewFlagSet("docker", flag.ContinueOnError)
+	config.InstallFlags(fs)
+	if err := fs.Parse([]string{"-b", "docker0", "-insecure-registry", "registry.local:5000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadDaemonConfigFile(fs, file, true); err != nil {
+		t.Fatal(err)
+	}
+	if config.Root != "/srv/docker" || config.PullRetries != 2 || config.PullRetryDelay != 3*time.Second {
+		t.Errorf("Unexpected config: %#v", config)
+	}
+	if !config.LiveRestore || config.ShutdownTimeout != 10*time.Second {
+		t.Errorf("Unexpected shutdown settings: %v %v", config.LiveRestore, config.ShutdownTimeout)
+	}
+	if config.BridgeIface != "docker0" {
+		t.Errorf("The flags should take precedence over the file, got bridge %s", config.BridgeIface)
+	}
+	if strings.Join(config.RegistryMirrors, " ") != "mirror1.example.com mirror2.example.com" || len(config.InsecureRegistries) != 1 {
+		t.Errorf("Unexpected registries: %v %v", config.RegistryMirrors, config.InsecureRegistries)
+	}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(config.String(), "graph: /srv/docker\n") {
+		t.Errorf("Unexpected printout: %s", config)
+	}
+
+	if err := LoadDaemonConfigFile(fs, path.Join(dir, "missing.json"), false); err != nil {
+		t.Errorf("A missing default file should be ignored: %s", err)
+	}
+	if err := LoadDaemonConfigFile(fs, path.Join(dir, "missing.json"), true); err == nil {
+		t.Errorf("A missing file should be refused when it is given")
+	}
+	for _, content := range []string{`{"graphs": "/srv"}`, `{"pull-retries": "many"}`, `{"graph": {"path": "/srv"}}`, `["graph"]`} {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fs := flag.NewFlagSet("docker", flag.ContinueOnError)
+		DefaultDaemonConfig().InstallFlags(fs)
+		if err := LoadDaemonConfigFile(fs, file, true); err == nil {
+			t.Errorf("%s should be refused", content)
+		}
+	}
+}
+
+func TestDaemonConfigValidate(t *testing.T) {
+	for _, change := range []func(*DaemonConfig){
+		func(c *DaemonConfig) { c.Root = "docker" },
+		func(c *DaemonConfig) { c.StorageDriver = "btrfs" },
+		func(c *DaemonConfig) { c.MaxLayers = -1 },
+		func(c *DaemonConfig) { c.BridgeIface = "" },
+		func(c *DaemonConfig) { c.DefaultUlimits = ListOpts{"nofile=2048:1024"} },
+		func(c *DaemonConfig) { c.DefaultDeviceRules = ListOpts{"c 10:229 rwx"} },
+		func(c *DaemonConfig) { c.LogDriver = "syslog" },
+		func(c *DaemonConfig) { c.DefaultTimezone = "../etc/shadow" },
+		func(c *DaemonConfig) { c.DefaultShmSize = "64q" },
+		func(c *DaemonConfig) { c.DefaultShmSize = "0" },
+		func(c *DaemonConfig) { c.HttpsProxy = "ftp://proxy.example.com" },
+		func(c *DaemonConfig) { c.RegistryProxies = ListOpts{"registry.example.com"} },
+		func(c *DaemonConfig) { c.PullRetries = -1 },
+		func(c *DaemonConfig) { c.ShutdownTimeout = -time.Second },
+		func(c *DaemonConfig) { c.LogLevel = "verbose" },
+		func(c *DaemonConfig) { c.LogLevel = "info,storage=debug" },
+		func(c *DaemonConfig) { c.LogFormat = "xml" },
+		func(c *DaemonConfig) { c.AuditLog = "audit.log" },
+		func(c *DaemonConfig) { c.AuditLogMaxSize = 0 },
+		func(c *DaemonConfig) { c.AuditLogMaxFiles = -1 },
+		func(c *DaemonConfig) { c.UsernsRemap = "dockremap:" },
+		func(c *DaemonConfig) { c.MetricsAddr = "9323" },
+		func(c *DaemonConfig) { c.NetworkPoolSize = -1 },
+		func(c *DaemonConfig) { c.CgroupDriver = "cgmanager" },
+		func(c *DaemonConfig) { c.Rootless = true },
+		func(c *DaemonConfig) {
+			c.Rootless, c.StorageDriver, c.CgroupDriver = true, "fuse-overlayfs", "systemd"
+		},
+		func(c *DaemonConfig) { c.PrestartHooks = ListOpts{"nvidia-hook"} },
+		func(c *DaemonConfig) { c.AuthzPlugins = ListOpts{"/run/docker/plugins/policy.sock"} },
+		func(c *DaemonConfig) { c.MaxBuilds = -1 },
+		func(c *DaemonConfig) { c.Webhooks = ListOpts{"hooks.example.com/docker"} },
+		func(c *DaemonConfig) { c.WebhookFilters = ListOpts{"status=running"} },
+		func(c *DaemonConfig) { c.WebhookFilters = ListOpts{"event"} },
+		func(c *DaemonConfig) { c.WebhookSecretFile = "secret" },
+	} {
+		config := DefaultDaemonConfig()
+		change(config)
+		if err := config.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", config)
+		}
+	}
+}
+
+func TestParseUlimit(t *testing.T) {
+	if resource, limit, err := parseUlimit("nofile=1024:2048"); err != nil || resource != ulimitResources["nofile"] || limit.Cur != 1024 || limit.Max != 2048 {
+		t.Errorf("Unexpected limit: %v %v (%v)", resource, limit, err)
+	}
+	if _, limit, err := parseUlimit("core=0"); err != nil || limit.Cur != 0 || limit.Max != 0 {
+		t.Errorf("Unexpected limit: %v (%v)", limit, err)
+	}
+	for _, ulimit := range []string{"nofile", "files=10", "nofile=a", "nofile=1:b", "nofile=-1"} {
+		if _, _, err := parseUlimit(ulimit); err == nil {
+			t.Errorf("%s should be invalid", ulimit)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+//go:build !linux
+// +build !linux
+
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// The daemon only runs on linux, where the containers run. On the other
+// platforms, the package builds for the client of a remote daemon, and the
+// parts of the daemon which need linux fail.
+
+var errDaemonUnsupported = errors.New("The docker daemon only runs on linux")
+
+func mount(source string, target string, fstype string, flags uintptr, data string) (err error) {
+	return errDaemonUnsupported
+}
+
+func remount(target string, fstype string, data string) error {
+	return errDaemonUnsupported
+}
+
+func Unmount(target string) error {
+	return errDaemonUnsupported
+}
+
+func Mounted(mountpoint string) (bool, error) {
+	return false, errDaemonUnsupported
+}
+
+func KernelVersion() (string, error) {
+	return "", errDaemonUnsupported
+}
+
+func SysInit() {
+	fmt.Fprintln(os.Stderr, errDaemonUnsupported)
+	os.Exit(1)
+}
+
+func (device *Device) stat() error {
+	return errDaemonUnsupported
+}
+
+func (container *Container) createDevices() error {
+	return errDaemonUnsupported
+}
+
+func isOverlayWhiteout(f os.FileInfo) bool {
+	return false
+}
+
+func newDedupFile(layer, path string, info os.FileInfo) (dedupKey, *dedupFile, bool) {
+	return dedupKey{}, nil, false
+}
+
+func shimSysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// The signals which can be given by name, without the SIG prefix, only
+// checked by the client, which sends them to the daemon by name. Their
+// numbers are the ones of linux on x86.
+var signalNames = map[string]syscall.Signal{
+	"ABRT":   6,
+	"ALRM":   14,
+	"BUS":    7,
+	"CHLD":   17,
+	"CLD":    17,
+	"CONT":   18,
+	"FPE":    8,
+	"HUP":    1,
+	"ILL":    4,
+	"INT":    2,
+	"IO":     29,
+	"IOT":    6,
+	"KILL":   9,
+	"PIPE":   13,
+	"POLL":   29,
+	"PROF":   27,
+	"PWR":    30,
+	"QUIT":   3,
+	"SEGV":   11,
+	"STOP":   19,
+	"SYS":    31,
+	"TERM":   15,
+	"TRAP":   5,
+	"TSTP":   20,
+	"TTIN":   21,
+	"TTOU":   22,
+	"URG":    23,
+	"USR1":   10,
+	"USR2":   12,
+	"VTALRM": 26,
+	"WINCH":  28,
+	"XCPU":   24,
+	"XFSZ":   25,
+}
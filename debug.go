@@ -0,0 +1,48 @@
+package docker
+
+import (
+	"github.com/dotcloud/docker/rcli"
+	"net/http"
+	"net/http/pprof"
+	goruntime "runtime"
+)
+
+// With -D, the daemon serves the profiles of net/http/pprof on the API,
+// under /debug/pprof, eg. /debug/pprof/goroutine?debug=2 for the stacks of
+// all the goroutines. SIGUSR1 logs the stacks, with or without -D.
+
+func serveDebugPprof(srv *Server, version apiVersion, w http.ResponseWriter, r *http.Request, vars map[string]string) error {
+	if !rcli.DEBUG_FLAG {
+		http.NotFound(w, r)
+		return nil
+	}
+	switch name := vars["name"]; name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+	return nil
+}
+
+// DumpStacks logs the stacks of all the goroutines of the daemon
+func DumpStacks() {
+	buf := make([]byte, 64*1024)
+	for {
+		n := goruntime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	runtimeLog.Warnf("Stacks of the goroutines, dumped on SIGUSR1:\n%s", buf)
+}
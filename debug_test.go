@@ -0,0 +1,50 @@
+package docker
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/dotcloud/docker/rcli"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDebugPprof(t *testing.T) {
+	srv := &Server{runtime: &Runtime{containers: list.New(), config: DefaultDaemonConfig()}}
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		srv.ServeHTTP(r, req)
+		return r
+	}
+	defer func(debug bool) { rcli.DEBUG_FLAG = debug }(rcli.DEBUG_FLAG)
+
+	rcli.DEBUG_FLAG = false
+	if r := get("/debug/pprof/goroutine"); r.Code != http.StatusNotFound {
+		t.Errorf("The profiles should only be served in debug mode, got %d", r.Code)
+	}
+
+	rcli.DEBUG_FLAG = true
+	if r := get("/v" + API_VERSION + "/debug/pprof/"); r.Code != http.StatusOK || !strings.Contains(r.Body.String(), "goroutine") {
+		t.Errorf("Unexpected index: %d %q", r.Code, r.Body.String())
+	}
+	if r := get("/debug/pprof/goroutine?debug=2"); r.Code != http.StatusOK || !strings.Contains(r.Body.String(), "TestDebugPprof") {
+		t.Errorf("Expected the stacks of the goroutines, got %d %q", r.Code, r.Body.String())
+	}
+	if r := get("/debug/pprof/cmdline"); r.Code != http.StatusOK || !strings.Contains(r.Body.String(), os.Args[0]) {
+		t.Errorf("Unexpected command line: %d %q", r.Code, r.Body.String())
+	}
+}
+
+func TestDumpStacks(t *testing.T) {
+	var output bytes.Buffer
+	logging.output = &output
+	defer func() { logging.output = os.Stderr }()
+
+	DumpStacks()
+	if !strings.Contains(output.String(), "[warn] runtime: Stacks of the goroutines") || !strings.Contains(output.String(), "TestDumpStacks") {
+		t.Errorf("Expected the stacks in the log, got %q", output.String())
+	}
+}
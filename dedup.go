@@ -0,0 +1,156 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Images rebuilt with small changes hold many files identical to the ones of
+// the layers of the previous builds. DedupLayers replaces them with hard
+// links to a single copy. The layers are only read by aufs, which copies a
+// file up to the container before modifying it, so that the files linked
+// are never modified in place.
+// Only files of different layers are linked, since the links within a
+// layer would be stored as such in its archive.
+
+// The files which may be identical have the same attributes
+type dedupKey struct {
+	size     int64
+	mode     os.FileMode
+	uid, gid uint32
+	mtime    int64
+}
+
+type dedupFile struct {
+	layer string // Id of the image
+	path  string
+	dev   uint64
+	ino   uint64
+	nlink uint64
+}
+
+// DedupLayers links the identical regular files of the layers of the graph
+func (graph *Graph) DedupLayers() (*api.DedupReport, error) {
+	images, err := graph.All()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(imagesById(images))
+	candidates := make(map[dedupKey][]*dedupFile)
+	for _, img := range images {
+		layer := layerPath(graph.imageRoot(img.Id))
+		err := filepath.Walk(layer, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				// Deleted in the meantime
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || info.Size() == 0 {
+				return nil
+			}
+			if key, file, ok := newDedupFile(img.Id, path, info); ok {
+				candidates[key] = append(candidates[key], file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	tmp, err := ioutil.TempDir(graph.Root, ":dedup:")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	report := &api.DedupReport{}
+	for key, files := range candidates {
+		if len(files) < 2 {
+			continue
+		}
+		if err := dedupFiles(files, key.size, tmp, report); err != nil {
+			return report, err
+		}
+	}
+	graph.sizesLock.Lock()
+	graph.sizes = make(map[string]int64)
+	graph.sizesLock.Unlock()
+	graphLog.Infof("Linked %d identical files of the layers, reclaiming %s", report.FilesLinked, HumanSize(report.SpaceReclaimed))
+	return report, nil
+}
+
+// dedupFiles links the files of size bytes with the same content to the
+// first of them, in a layer other than theirs
+func dedupFiles(files []*dedupFile, size int64, tmp string, report *api.DedupReport) error {
+	copies := make(map[string][]*dedupFile) // By checksum
+	var sums []string
+	for _, file := range files {
+		sum, err := fileChecksum(file.path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if copies[sum] == nil {
+			sums = append(sums, sum)
+		}
+		copies[sum] = append(copies[sum], file)
+	}
+	for _, sum := range sums {
+		original := copies[sum][0]
+		// The layers holding a link to the original, at most one each
+		linked := make(map[string]bool)
+		for _, file := range copies[sum] {
+			if file.dev == original.dev && file.ino == original.ino {
+				linked[file.layer] = true
+			}
+		}
+		for _, file := range copies[sum][1:] {
+			if linked[file.layer] {
+				continue
+			}
+			linked[file.layer] = true
+			// Replace the file atomically, so that it is never missing
+			link := path.Join(tmp, fmt.Sprintf("%d", report.FilesLinked))
+			if err := os.Link(original.path, link); err != nil {
+				return err
+			}
+			if err := os.Rename(link, file.path); err != nil {
+				os.Remove(link)
+				return err
+			}
+			report.FilesLinked++
+			if file.nlink == 1 {
+				report.SpaceReclaimed += size
+			}
+		}
+	}
+	return nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type imagesById []*Image
+
+func (images imagesById) Len() int           { return len(images) }
+func (images imagesById) Less(i, j int) bool { return images[i].Id < images[j].Id }
+func (images imagesById) Swap(i, j int)      { images[i], images[j] = images[j], images[i] }
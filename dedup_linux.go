@@ -0,0 +1,17 @@
+package docker
+
+import (
+	"os"
+	"syscall"
+)
+
+// newDedupFile returns the file at path in the layer, with the key of the
+// files which may be identical to it
+func newDedupFile(layer, path string, info os.FileInfo) (dedupKey, *dedupFile, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return dedupKey{}, nil, false
+	}
+	key := dedupKey{info.Size(), info.Mode(), stat.Uid, stat.Gid, info.ModTime().UnixNano()}
+	return key, &dedupFile{layer, path, uint64(stat.Dev), uint64(stat.Ino), uint64(stat.Nlink)}, true
+}
@@ -0,0 +1,53 @@
+package docker
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestDedupLayers(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	for id, files := range map[string][]string{
+		"a": {"bin/sh", "#!shell", "etc/motd", "hello"},
+		"b": {"bin/sh", "#!shell", "etc/other", "hello", "etc/new", "new"},
+		"c": {"bin/sh", "#!shell", "bin/sh2", "#!shell"},
+	} {
+		if err := graph.Register(bytes.NewReader(testLayer(t, false, files...)), &Image{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inode := func(id, file string) uint64 {
+		info, err := os.Stat(path.Join(layerPath(graph.imageRoot(id)), file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Ino
+	}
+
+	report, err := graph.DedupLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b/bin/sh, b/etc/other and one of c/bin/sh and c/bin/sh2
+	if report.FilesLinked != 3 || report.SpaceReclaimed != int64(2*len("#!shell")+len("hello")) {
+		t.Fatalf("Unexpected report: %#v", report)
+	}
+	if inode("a", "bin/sh") != inode("b", "bin/sh") || inode("a", "etc/motd") != inode("b", "etc/other") {
+		t.Errorf("The identical files of a and b should be linked")
+	}
+	if inode("c", "bin/sh") == inode("c", "bin/sh2") {
+		t.Errorf("The files of a layer shouldn't be linked together")
+	}
+	if inode("a", "bin/sh") != inode("c", "bin/sh") && inode("a", "bin/sh") != inode("c", "bin/sh2") {
+		t.Errorf("A file of c should be linked to a/bin/sh")
+	}
+
+	// Nothing is left to link
+	if report, err := graph.DedupLayers(); err != nil || report.FilesLinked != 0 {
+		t.Fatalf("Expected no file to link, got %#v (%v)", report, err)
+	}
+}
@@ -0,0 +1,51 @@
+package docker
+
+import (
+	"fmt"
+)
+
+// aufs mounts at most 127 branches, with the default
+// CONFIG_AUFS_BRANCH_MAX_127 of the kernel, the rw branch of the container
+// included. The branches which don't fit in the page of the mount data,
+// about 40 of them, are appended by remounting, see MountAUFS. The images
+// with more layers are committed, but their containers fail to mount. The
+// commits which would go beyond -max-layers fail instead, or with
+// -squash-layers, the image committed has the whole filesystem of the
+// container in a single layer, without parent.
+
+const DEFAULT_MAX_LAYERS = 126
+
+// Depth returns the number of layers of the image id, itself included
+func (graph *Graph) Depth(id string) (int, error) {
+	img, err := graph.Get(id)
+	if err != nil {
+		return 0, err
+	}
+	depth := 0
+	if err := img.WalkHistory(func(*Image) error {
+		depth++
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return depth, nil
+}
+
+// squashCommit returns whether the image committed from container must be
+// squashed to stay within the limit of layers, or an error if it can't be
+func (graph *Graph) squashCommit(container *Container) (bool, error) {
+	if graph.maxLayers == 0 {
+		return false, nil
+	}
+	depth, err := graph.Depth(container.Image)
+	if err != nil {
+		return false, err
+	}
+	if depth+1 <= graph.maxLayers {
+		return false, nil
+	}
+	if !graph.squashLayers {
+		return false, fmt.Errorf("The image would have %d layers, more than the limit of %d: squash it with -squash-layers, or export the container and import it", depth+1, graph.maxLayers)
+	}
+	return true, nil
+}
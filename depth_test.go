@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSquashCommit(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	parent := ""
+	for i := 0; i < 3; i++ {
+		img := &Image{Id: GenerateId(), Parent: parent}
+		if err := graph.Register(testArchive(t), img); err != nil {
+			t.Fatal(err)
+		}
+		parent = img.Id
+	}
+	if depth, err := graph.Depth(parent); err != nil || depth != 3 {
+		t.Fatalf("Expected 3 layers, got %d (%v)", depth, err)
+	}
+	container := &Container{Id: GenerateId(), Image: parent, Config: &Config{}}
+
+	// No limit
+	if squashed, err := graph.squashCommit(container); err != nil || squashed {
+		t.Errorf("Expected a plain commit without limit, got %v (%v)", squashed, err)
+	}
+	graph.maxLayers = 4
+	if squashed, err := graph.squashCommit(container); err != nil || squashed {
+		t.Errorf("Expected a plain commit within the limit, got %v (%v)", squashed, err)
+	}
+	graph.maxLayers = 3
+	if _, err := graph.squashCommit(container); err == nil {
+		t.Errorf("Expected the commit beyond the limit to fail")
+	}
+	graph.squashLayers = true
+	if squashed, err := graph.squashCommit(container); err != nil || !squashed {
+		t.Errorf("Expected the commit beyond the limit to be squashed, got %v (%v)", squashed, err)
+	}
+
+	img, err := graph.create(testArchive(t), container, "squashed", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Parent != "" || img.Container != container.Id {
+		t.Errorf("Expected the squashed image to have no parent, got %s", img.Parent)
+	}
+	if depth, err := graph.Depth(img.Id); err != nil || depth != 1 {
+		t.Errorf("Expected a single layer, got %d (%v)", depth, err)
+	}
+}
+
+// The branches of an image at the limit of layers don't fit in the mount
+// data: the ones left are appended
+func TestAufsBranches(t *testing.T) {
+	var ro []string
+	for i := 0; i < DEFAULT_MAX_LAYERS; i++ {
+		ro = append(ro, path.Join("/var/lib/docker/graph", GenerateId(), "layer"))
+	}
+	rw := path.Join("/var/lib/docker/containers", GenerateId(), "rw")
+	data, appended := aufsBranches(ro, rw)
+	if len(data) >= aufsMountDataSize {
+		t.Fatalf("The mount data is %d bytes, more than a page", len(data))
+	}
+	if len(appended) == 0 {
+		t.Fatalf("Expected the lower branches to be appended")
+	}
+	branches := strings.Split(strings.TrimPrefix(data, "br:"), ":")
+	if branches[0] != rw+"=rw" {
+		t.Errorf("Unexpected rw branch: %s", branches[0])
+	}
+	for _, layer := range appended {
+		branches = append(branches, layer+"=ro")
+	}
+	if len(branches) != DEFAULT_MAX_LAYERS+1 {
+		t.Fatalf("Expected %d branches, got %d", DEFAULT_MAX_LAYERS+1, len(branches))
+	}
+	for i, layer := range ro {
+		if branches[i+1] != layer+"=ro" {
+			t.Fatalf("Expected the branch %d to be %s, got %s", i+1, layer, branches[i+1])
+		}
+	}
+	if data, appended := aufsBranches(ro[:3], rw); len(appended) != 0 || strings.Count(data, "=ro") != 3 {
+		t.Errorf("Expected a few branches to fit in the mount data, got %s %v", data, appended)
+	}
+}
@@ -0,0 +1,141 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Device is a device of the host made available in a container: its node is
+// created in the container, and the device cgroup of the container allows
+// it with Permissions, a combination of r (read), w (write) and m (mknod)
+type Device struct {
+	PathOnHost      string
+	PathInContainer string
+	Permissions     string
+
+	Type  string // "c" or "b"
+	Major int64
+	Minor int64
+	Mode  os.FileMode
+}
+
+var devicePermissions = regexp.MustCompile(`^[rwm]{1,3}$`)
+
+// parseDevice parses a device specification: /host[:/container][:PERMISSIONS].
+// The path in the container defaults to the one of the host, and the
+// permissions to rwm.
+func parseDevice(spec string) (*Device, error) {
+	parts := strings.Split(spec, ":")
+	device := &Device{PathOnHost: parts[0], Permissions: "rwm"}
+	switch len(parts) {
+	case 1:
+		device.PathInContainer = parts[0]
+	case 2:
+		if devicePermissions.MatchString(parts[1]) {
+			device.PathInContainer = parts[0]
+			device.Permissions = parts[1]
+		} else {
+			device.PathInContainer = parts[1]
+		}
+	case 3:
+		device.PathInContainer = parts[1]
+		device.Permissions = parts[2]
+	default:
+		return nil, fmt.Errorf("Invalid device: %s (expected /host[:/container][:PERMISSIONS])", spec)
+	}
+	if !path.IsAbs(device.PathOnHost) || !path.IsAbs(device.PathInContainer) {
+		return nil, fmt.Errorf("Invalid device: %s (the paths must be absolute)", spec)
+	}
+	if !devicePermissions.MatchString(device.Permissions) || strings.Count(device.Permissions, "r") > 1 || strings.Count(device.Permissions, "w") > 1 || strings.Count(device.Permissions, "m") > 1 {
+		return nil, fmt.Errorf("Invalid device: %s (the permissions are a combination of r, w and m)", spec)
+	}
+	device.PathOnHost = path.Clean(device.PathOnHost)
+	device.PathInContainer = path.Clean(device.PathInContainer)
+	return device, nil
+}
+
+// DEFAULT_DEVICE_RULES is the device cgroup whitelist of the containers,
+// unless the daemon is given its own with -default-device-rule. Fuse
+// (c 10:229) and rtc (c 254:0) aren't allowed by default.
+var DEFAULT_DEVICE_RULES = []string{
+	"c 1:3 rwm", "c 1:5 rwm", // /dev/null and zero
+	"c 5:1 rwm", "c 5:0 rwm", "c 4:0 rwm", "c 4:1 rwm", // consoles
+	"c 1:9 rwm", "c 1:8 rwm", // /dev/urandom,/dev/random
+	"c 136:* rwm", "c 5:2 rwm", // /dev/pts/* - pts namespaces are "coming soon"
+	"c 10:200 rwm", // tuntap
+}
+
+var deviceRuleNumber = regexp.MustCompile(`^(\*|[0-9]+)$`)
+
+// parseDeviceRule checks a device cgroup rule: TYPE MAJOR:MINOR PERMISSIONS,
+// where TYPE is a (all), b (block) or c (char), the numbers may be *, and
+// the permissions are a combination of r, w and m. The rule is returned
+// with its fields separated by single spaces.
+func parseDeviceRule(rule string) (string, error) {
+	fields := strings.Fields(rule)
+	if len(fields) != 3 {
+		return "", fmt.Errorf("Invalid device cgroup rule: %s (expected TYPE MAJOR:MINOR PERMISSIONS)", rule)
+	}
+	if fields[0] != "a" && fields[0] != "b" && fields[0] != "c" {
+		return "", fmt.Errorf("Invalid device cgroup rule: %s (the type is a, b or c)", rule)
+	}
+	numbers := strings.Split(fields[1], ":")
+	if len(numbers) != 2 || !deviceRuleNumber.MatchString(numbers[0]) || !deviceRuleNumber.MatchString(numbers[1]) {
+		return "", fmt.Errorf("Invalid device cgroup rule: %s (the numbers are integers or *)", rule)
+	}
+	if !devicePermissions.MatchString(fields[2]) || strings.Count(fields[2], "r") > 1 || strings.Count(fields[2], "w") > 1 || strings.Count(fields[2], "m") > 1 {
+		return "", fmt.Errorf("Invalid device cgroup rule: %s (the permissions are a combination of r, w and m)", rule)
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// deviceRules returns the default device cgroup whitelist of the containers
+func (config *DaemonConfig) deviceRules() []string {
+	if len(config.DefaultDeviceRules) > 0 {
+		return append([]string{}, config.DefaultDeviceRules...)
+	}
+	return append([]string{}, DEFAULT_DEVICE_RULES...)
+}
+
+// DeviceRules returns the device cgroup whitelist of the container: the
+// default rules of the daemon, then the rules of its config. The devices
+// given with -device are allowed as well.
+func (container *Container) DeviceRules() []string {
+	var allowed []string
+	for _, rule := range append(container.runtime.config.deviceRules(), container.Config.DeviceRules...) {
+		// The rules were checked when the daemon and the container were created
+		if rule, err := parseDeviceRule(rule); err == nil {
+			allowed = append(allowed, rule)
+		}
+	}
+	return allowed
+}
+
+// mkdev encodes the numbers of a device like the kernel does in dev_t
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+// Devices returns the devices of the container, with their numbers read
+// from the host
+func (container *Container) Devices() ([]*Device, error) {
+	var devices []*Device
+	specs := container.Config.Devices
+	if container.prestart != nil {
+		specs = append(append([]string{}, specs...), container.prestart.Devices...)
+	}
+	for _, spec := range specs {
+		device, err := parseDevice(spec)
+		if err != nil {
+			return nil, err
+		}
+		if err := device.stat(); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
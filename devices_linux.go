@@ -0,0 +1,71 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+)
+
+// stat fills the type, numbers and mode of the device from its node on the
+// host
+func (device *Device) stat() error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(device.PathOnHost, &st); err != nil {
+		return fmt.Errorf("Unable to find device %s: %s", device.PathOnHost, err)
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		device.Type = "c"
+	case syscall.S_IFBLK:
+		device.Type = "b"
+	default:
+		return fmt.Errorf("%s is not a device", device.PathOnHost)
+	}
+	device.Major = int64((st.Rdev>>8)&0xfff | (st.Rdev>>32)&^0xfff)
+	device.Minor = int64(st.Rdev&0xff | (st.Rdev>>12)&^0xff)
+	device.Mode = os.FileMode(st.Mode & 07777)
+	return nil
+}
+
+// createDevices creates the nodes of the devices of the container in its
+// root filesystem, replacing the ones left by a previous start. The links
+// of the image are followed within the root filesystem.
+func (container *Container) createDevices() error {
+	devices, err := container.Devices()
+	if err != nil {
+		return err
+	}
+	rootfs := container.RootfsPath()
+	for _, device := range devices {
+		p, err := FollowSymlinkInScope(path.Join(rootfs, device.PathInContainer), rootfs)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		mode := uint32(device.Mode)
+		if device.Type == "c" {
+			mode |= syscall.S_IFCHR
+		} else {
+			mode |= syscall.S_IFBLK
+		}
+		if err := syscall.Mknod(p, mode, mkdev(device.Major, device.Minor)); err != nil {
+			return fmt.Errorf("Unable to create device %s: %s", device.PathInContainer, err)
+		}
+		// The umask may have masked the mode of the host
+		if err := os.Chmod(p, device.Mode); err != nil {
+			return err
+		}
+		if remap := container.runtime.remap; remap != nil {
+			if err := remap.Chown(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseDevice(t *testing.T) {
+	for spec, expected := range map[string]Device{
+		"/dev/fuse":                 {PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse", Permissions: "rwm"},
+		"/dev/sda:r":                {PathOnHost: "/dev/sda", PathInContainer: "/dev/sda", Permissions: "r"},
+		"/dev/nvidia0:/dev/gpu":     {PathOnHost: "/dev/nvidia0", PathInContainer: "/dev/gpu", Permissions: "rwm"},
+		"/dev/nvidia0/:/dev/gpu:rw": {PathOnHost: "/dev/nvidia0", PathInContainer: "/dev/gpu", Permissions: "rw"},
+	} {
+		device, err := parseDevice(spec)
+		if err != nil {
+			t.Errorf("%s: %s", spec, err)
+		} else if *device != expected {
+			t.Errorf("%s: unexpected %v", spec, device)
+		}
+	}
+	for _, spec := range []string{"", "fuse", "/dev/fuse:fuse", "/dev/fuse:/dev/fuse:rx", "/dev/fuse:/dev/fuse:rr", "/a:/b:r:w"} {
+		if _, err := parseDevice(spec); err == nil {
+			t.Errorf("%q should be invalid", spec)
+		}
+	}
+}
+
+func TestParseDeviceRule(t *testing.T) {
+	for rule, expected := range map[string]string{
+		"c 10:229 rwm":  "c 10:229 rwm",
+		"b  8:* r":      "b 8:* r",
+		"a *:* rwm":     "a *:* rwm",
+		" c 136:1  wr ": "c 136:1 wr",
+	} {
+		if parsed, err := parseDeviceRule(rule); err != nil {
+			t.Errorf("%q: %s", rule, err)
+		} else if parsed != expected {
+			t.Errorf("%q: expected %q, got %q", rule, expected, parsed)
+		}
+	}
+	for _, rule := range []string{"", "c 10:229", "x 10:229 rwm", "c 10 rwm", "c 10:a rwm", "c -1:2 rw", "c 10:229 rx", "c 10:229 rr", "c 10:229 rwm extra"} {
+		if _, err := parseDeviceRule(rule); err == nil {
+			t.Errorf("%q should be invalid", rule)
+		}
+	}
+}
+
+func TestContainerDeviceRules(t *testing.T) {
+	config := DefaultDaemonConfig()
+	container := &Container{runtime: &Runtime{config: config}, Config: &Config{DeviceRules: []string{"c 10:229 rwm"}}}
+	rules := container.DeviceRules()
+	if len(rules) != len(DEFAULT_DEVICE_RULES)+1 || rules[0] != DEFAULT_DEVICE_RULES[0] || rules[len(rules)-1] != "c 10:229 rwm" {
+		t.Errorf("Unexpected rules: %v", rules)
+	}
+	config.DefaultDeviceRules = ListOpts{"c 1:3 rwm", "c 254:0 r"}
+	if rules := container.DeviceRules(); strings.Join(rules, ",") != "c 1:3 rwm,c 254:0 r,c 10:229 rwm" {
+		t.Errorf("The rules of the daemon should replace the default ones, got %v", rules)
+	}
+	if len(DEFAULT_DEVICE_RULES) != 11 {
+		t.Errorf("The default rules shouldn't change, got %v", DEFAULT_DEVICE_RULES)
+	}
+}
+
+func TestDeviceStat(t *testing.T) {
+	device, err := parseDevice("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := device.stat(); err != nil {
+		t.Fatal(err)
+	}
+	if device.Type != "c" || device.Major != 1 || device.Minor != 3 {
+		t.Errorf("Unexpected device: %v", device)
+	}
+	if mkdev(1, 3) != 0x103 || mkdev(259, 300) != 0x11032c {
+		t.Errorf("Unexpected device numbers: %x %x", mkdev(1, 3), mkdev(259, 300))
+	}
+	device.PathOnHost = "/dev"
+	if err := device.stat(); err == nil {
+		t.Errorf("/dev is not a device")
+	}
+}
+
+func TestDevices(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	container, err := runtime.Create(&Config{
+		Image:   GetTestImage(runtime).Id,
+		Cmd:     []string{"sh", "-c", "head -c 4 /dev/zero2 | wc -c; echo -n x > /dev/full2 || echo denied"},
+		Devices: []string{"/dev/zero:/dev/zero2:r", "/dev/full:/dev/full2:r"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := strings.Fields(string(output)); len(fields) != 2 || fields[0] != "4" || fields[1] != "denied" {
+		t.Errorf("Unexpected output: %s", output)
+	}
+}
+
+func TestCreateDevicesSymlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside := path.Join(root, "outside")
+	for _, dir := range []string{outside, path.Join(root, "rootfs")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The /dev of the image leads to a directory of the host
+	if err := os.Symlink(outside, path.Join(root, "rootfs", "dev")); err != nil {
+		t.Fatal(err)
+	}
+	container := &Container{root: root, runtime: &Runtime{}, Config: &Config{Devices: []string{"/dev/null:/dev/null2"}}}
+	if err := container.createDevices(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path.Join(outside, "null2")); !os.IsNotExist(err) {
+		t.Errorf("The device shouldn't be created out of the root filesystem")
+	}
+	if _, err := os.Lstat(path.Join(root, "rootfs", outside, "null2")); err != nil {
+		t.Errorf("The device should be created within the root filesystem: %s", err)
+	}
+}
@@ -1,16 +1,28 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"github.com/dotcloud/docker"
+	"github.com/dotcloud/docker/api"
+	"github.com/dotcloud/docker/cli"
+	"github.com/dotcloud/docker/client"
 	"github.com/dotcloud/docker/rcli"
 	"github.com/dotcloud/docker/term"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path"
+	"syscall"
 )
 
 func main() {
+	if path.Base(os.Args[0]) == docker.SHIM_NAME {
+		// Running as the shim of a container
+		docker.RunShim()
+		return
+	}
 	if docker.SelfPath() == "/sbin/init" {
 		// Running in init mode
 		docker.SysInit()
@@ -19,14 +31,84 @@ func main() {
 	// FIXME: Switch d and D ? (to be more sshd like)
 	flDaemon := flag.Bool("d", false, "Daemon mode")
 	flDebug := flag.Bool("D", false, "Debug mode")
+	flConfigFile := flag.String("config-file", docker.DEFAULT_DAEMON_CONFIG_FILE, "JSON file of daemon settings, by flag name; the flags take precedence (daemon mode only)")
+	config := docker.DefaultDaemonConfig()
+	config.InstallFlags(flag.CommandLine)
+	var flHosts docker.ListOpts
+	flag.Var(&flHosts, "H", "Serve the remote API on, or connect to, unix://PATH, tcp://HOST:PORT, ssh://[USER@]HOST[:PORT] (client only) or fd://[NAME] for the sockets passed by systemd (daemon only) (default $DOCKER_HOST or unix://"+docker.DEFAULT_API_SOCKET+")")
+	flTls := flag.Bool("tls", false, "Use TLS for the remote API (implied by -tlsverify)")
+	flTlsVerify := flag.Bool("tlsverify", false, "Use TLS for the remote API and verify the peer: the daemon requires client certificates signed by -tlscacert, the client checks the daemon certificate against $DOCKER_CERT_PATH/ca.pem")
+	certPath := docker.DefaultCertPath()
+	flTlsCaCert := flag.String("tlscacert", path.Join(certPath, docker.DEFAULT_CA_FILE), "Trust only client certificates signed by this CA")
+	flTlsCert := flag.String("tlscert", path.Join(certPath, docker.DEFAULT_CERT_FILE), "Path to the TLS certificate of the daemon")
+	flTlsKey := flag.String("tlskey", path.Join(certPath, docker.DEFAULT_KEY_FILE), "Path to the TLS key of the daemon")
 	flag.Parse()
+	if *flDaemon {
+		// The flags not given on the command line may be set by the config file
+		configFileGiven := false
+		flag.Visit(func(f *flag.Flag) { configFileGiven = configFileGiven || f.Name == "config-file" })
+		if err := docker.LoadDaemonConfigFile(flag.CommandLine, *flConfigFile, configFileGiven); err != nil {
+			log.Fatal(err)
+		}
+		if config.Rootless {
+			if err := docker.SetRootlessDefaults(flag.CommandLine); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 	rcli.DEBUG_FLAG = *flDebug
 	if *flDaemon {
 		if flag.NArg() != 0 {
 			flag.Usage()
 			return
 		}
-		if err := daemon(); err != nil {
+		if *flDebug && config.LogLevel == docker.DefaultDaemonConfig().LogLevel {
+			config.LogLevel = "debug"
+		}
+		if err := config.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		if config.Rootless && !docker.InRootlessNamespace() {
+			// Runs the daemon again with the same flags
+			log.Fatal(docker.RootlessExec(os.Args))
+		}
+		log.Printf("Effective configuration:\n%s", config)
+		if len(flHosts) == 0 && config.Rootless {
+			flHosts = append(flHosts, "unix://"+docker.RootlessSocket())
+		} else if len(flHosts) == 0 {
+			flHosts = append(flHosts, "unix://"+docker.DEFAULT_API_SOCKET)
+		}
+		var tlsConfig *tls.Config
+		if *flTls || *flTlsVerify {
+			var err error
+			if tlsConfig, err = docker.ServerTLSConfig(*flTlsCaCert, *flTlsCert, *flTlsKey, *flTlsVerify); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := daemon(flHosts, tlsConfig, config); err != nil {
+			log.Fatal(err)
+		}
+	} else if len(flag.Args()) > 0 && cli.HasCommand(flag.Arg(0)) {
+		host := os.Getenv("DOCKER_HOST")
+		if len(flHosts) > 0 {
+			host = flHosts[0]
+		}
+		var tlsConfig *tls.Config
+		if *flTls || *flTlsVerify {
+			var err error
+			if tlsConfig, err = docker.ClientTLSConfig(certPath, *flTlsVerify); err != nil {
+				log.Fatal(err)
+			}
+		}
+		c, err := client.NewClient(host, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dockerCli := cli.NewDockerCli(os.Stdin, os.Stdout, os.Stderr, c)
+		if err := dockerCli.Cmd(flag.Args()...); err != nil {
+			if statusErr, ok := err.(*cli.StatusError); ok {
+				os.Exit(statusErr.Status)
+			}
 			log.Fatal(err)
 		}
 	} else {
@@ -36,12 +118,47 @@ func main() {
 	}
 }
 
-func daemon() error {
-	service, err := docker.NewServer()
+func daemon(hosts []string, tlsConfig *tls.Config, config *docker.DaemonConfig) error {
+	service, err := docker.NewServer(config)
 	if err != nil {
 		return err
 	}
-	return rcli.ListenAndServe("tcp", "127.0.0.1:4242", service)
+	errors := make(chan error, len(hosts)+2)
+	for _, host := range hosts {
+		proto, addr, err := api.ParseHost(host)
+		if err != nil {
+			return err
+		}
+		go func() {
+			errors <- docker.ListenAndServeAPI(proto, addr, service, tlsConfig)
+		}()
+	}
+	go func() {
+		errors <- rcli.ListenAndServe("tcp", "127.0.0.1:4242", service)
+	}()
+	if config.MetricsAddr != "" {
+		go func() {
+			errors <- docker.ListenAndServeMetrics(config.MetricsAddr, service)
+		}()
+	}
+	dumps := make(chan os.Signal, 1)
+	notifyDumps(dumps)
+	go func() {
+		for range dumps {
+			docker.DumpStacks()
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errors:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+		// A second signal forces the daemon out
+		signal.Stop(signals)
+		return service.Shutdown()
+	}
 }
 
 func runCommand(args []string) error {
@@ -79,7 +196,7 @@ func runCommand(args []string) error {
 			}
 		}
 	} else {
-		service, err := docker.NewServer()
+		service, err := docker.NewServer(docker.DefaultDaemonConfig())
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDumps relays SIGUSR1, which dumps the stacks of the daemon, to c
+func notifyDumps(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
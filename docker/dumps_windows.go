@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// notifyDumps does nothing on windows, which has no SIGUSR1
+func notifyDumps(c chan os.Signal) {
+}
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ParseEnvFile reads the variables of an env file: KEY=VALUE lines, with
+// blank lines and comments starting with '#' ignored. A line with a KEY
+// alone takes the value of the environment, if it is set. The values are
+// taken literally, up to the end of the line, unless expand is true: then
+// $NAME and ${NAME} are replaced with the variables defined before in the
+// file, or in the environment.
+func ParseEnvFile(filename string, expand bool) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var env []string
+	values := make(map[string]string)
+	lookup := func(name string) string {
+		if value, exists := values[name]; exists {
+			return value
+		}
+		return os.Getenv(name)
+	}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimRight(parts[0], " \t")
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("Invalid env file %s, line %d: %s (expected KEY=VALUE)", filename, n, line)
+		}
+		var value string
+		if len(parts) == 1 {
+			var exists bool
+			if value, exists = os.LookupEnv(key); !exists {
+				continue
+			}
+		} else if value = parts[1]; expand {
+			value = expandVariables(value, lookup)
+		}
+		values[key] = value
+		env = append(env, key+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// overrideEnv returns env with the variables of overrides, which replace
+// those of env with the same name
+func overrideEnv(env, overrides []string) []string {
+	names := make(map[string]bool)
+	for _, e := range overrides {
+		names[strings.SplitN(e, "=", 2)[0]] = true
+	}
+	var result []string
+	for _, e := range env {
+		if !names[strings.SplitN(e, "=", 2)[0]] {
+			result = append(result, e)
+		}
+	}
+	return append(result, overrides...)
+}
@@ -0,0 +1,60 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeEnvFile(t *testing.T, dir, content string) string {
+	file := path.Join(dir, "env")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestParseEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-envfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("DOCKER_TEST_HOST", "db.example.com")
+	defer os.Unsetenv("DOCKER_TEST_HOST")
+	file := writeEnvFile(t, dir, `# Database
+DB_USER=web
+  DB_PASSWORD=p$ss w0rd#1
+
+DB_URL=postgres://${DB_USER}@$DOCKER_TEST_HOST/app
+DOCKER_TEST_HOST
+DOCKER_TEST_UNSET
+`)
+	for expand, expected := range map[bool][]string{
+		false: {"DB_USER=web", "DB_PASSWORD=p$ss w0rd#1", "DB_URL=postgres://${DB_USER}@$DOCKER_TEST_HOST/app", "DOCKER_TEST_HOST=db.example.com"},
+		true:  {"DB_USER=web", "DB_PASSWORD=p w0rd#1", "DB_URL=postgres://web@db.example.com/app", "DOCKER_TEST_HOST=db.example.com"},
+	} {
+		env, err := ParseEnvFile(file, expand)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(env, expected) {
+			t.Errorf("Unexpected env with expand=%v: %q", expand, env)
+		}
+	}
+
+	for _, content := range []string{"=value\n", "DB USER=web\n"} {
+		if _, err := ParseEnvFile(writeEnvFile(t, dir, content), false); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("Expected an error for %q, got %v", content, err)
+		}
+	}
+}
+
+func TestOverrideEnv(t *testing.T) {
+	env := overrideEnv([]string{"A=1", "B=2", "C"}, []string{"B=3", "C=4"})
+	if !equalStrings(env, []string{"A=1", "B=3", "C=4"}) {
+		t.Fatalf("Unexpected env: %v", env)
+	}
+}
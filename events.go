@@ -0,0 +1,218 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of past events kept for replay
+const EVENTS_HISTORY = 256
+
+// Size of the buffer of each subscriber. Events are dropped for the
+// subscribers which don't keep up.
+const eventsSubscriberBuffer = 100
+
+// An Event of the runtime, as it is streamed, with the labels of its
+// object
+type Event struct {
+	api.Event
+
+	labels map[string]string // Of the container or image, for the filters
+}
+
+// The type of the object of the events, by status
+var eventTypes = map[string]string{
+	"create":     "container",
+	"start":      "container",
+	"die":        "container",
+	"kill":       "container",
+	"destroy":    "container",
+	"checkpoint": "container",
+	"restore":    "container",
+	"update":     "container",
+	"oom":        "container",
+	"pull":       "image",
+	"scan":       "image",
+	"tag":        "image",
+	"untag":      "image",
+	"trust":      "trust",
+	"untrust":    "trust",
+}
+
+// EventBus dispatches the events of the runtime to its subscribers, and
+// remembers the last events in a ring buffer.
+type EventBus struct {
+	lock        sync.Mutex
+	history     []Event
+	next        int // Index of the next event in history, once it is full
+	subscribers map[chan Event]struct{}
+	// Returns the labels of the object of an event when it is logged, if
+	// not nil
+	labels func(event *Event) map[string]string
+}
+
+func NewEventBus(size int) *EventBus {
+	return &EventBus{
+		history:     make([]Event, 0, size),
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Log records an event about the container or image id, and sends it to
+// the subscribers. from is the image of a container.
+func (bus *EventBus) Log(status, id, from string, attributes map[string]string) {
+	if bus == nil {
+		return
+	}
+	event := Event{Event: api.Event{
+		Status:     status,
+		Id:         id,
+		Type:       eventTypes[status],
+		From:       from,
+		Time:       time.Now().Unix(),
+		Attributes: attributes,
+	}}
+	if bus.labels != nil {
+		event.labels = bus.labels(&event)
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	if len(bus.history) < cap(bus.history) {
+		bus.history = append(bus.history, event)
+	} else if len(bus.history) > 0 {
+		bus.history[bus.next] = event
+		bus.next = (bus.next + 1) % len(bus.history)
+	}
+	for ch := range bus.subscribers {
+		select {
+		case ch <- event:
+		default:
+			Debugf("Dropping event %s of %s for a slow subscriber", status, id)
+		}
+	}
+}
+
+// Subscribe returns the past events which happened at or after since
+// (if since is not 0), and a channel receiving the next ones.
+func (bus *EventBus) Subscribe(since int64) ([]Event, chan Event) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	var past []Event
+	if since != 0 {
+		for i := range bus.history {
+			event := bus.history[(bus.next+i)%len(bus.history)]
+			if event.Time >= since {
+				past = append(past, event)
+			}
+		}
+	}
+	ch := make(chan Event, eventsSubscriberBuffer)
+	bus.subscribers[ch] = struct{}{}
+	return past, ch
+}
+
+func (bus *EventBus) Unsubscribe(ch chan Event) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	delete(bus.subscribers, ch)
+}
+
+// eventFilter selects the events sent to a subscriber, like the filters of
+// the containers
+type eventFilter struct {
+	filters map[string][]string
+	images  []string // Ids of the images of the image filters
+}
+
+var eventFilters = map[string]bool{
+	"type":      true, // "container", "image" or "trust"
+	"event":     true, // Status of the event
+	"container": true, // Prefix of the id of the container
+	"image":     true, // Name or id of the image, or of the image of a container
+	"label":     true, // "KEY" or "KEY=VALUE", of the container or image
+}
+
+// parseFilterOpts parses KEY=VALUE filters, the values of a filter given
+// several times being listed in order
+func parseFilterOpts(opts ListOpts) (map[string][]string, error) {
+	filters := make(map[string][]string)
+	for _, value := range opts {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, FilterError(fmt.Sprintf("Invalid filter: %s (expected KEY=VALUE)", value))
+		}
+		filters[parts[0]] = append(filters[parts[0]], parts[1])
+	}
+	return filters, nil
+}
+
+// parseEventFilters validates the filters of the events. lookupImage
+// resolves the names of the image filters.
+func parseEventFilters(filters map[string][]string, lookupImage func(name string) (*Image, error)) (*eventFilter, error) {
+	filter := &eventFilter{filters: filters}
+	for name, values := range filters {
+		if !eventFilters[name] {
+			return nil, FilterError(fmt.Sprintf("Invalid filter: %s", name))
+		}
+		for _, value := range values {
+			switch name {
+			case "type":
+				if value != "container" && value != "image" && value != "trust" {
+					return nil, FilterError(fmt.Sprintf("Invalid type filter: %s (expected container, image or trust)", value))
+				}
+			case "label":
+				if err := validateLabelFilter(value); err != nil {
+					return nil, err
+				}
+			case "image":
+				// The images pulled or untagged may not exist (anymore)
+				if img, err := lookupImage(value); err == nil {
+					filter.images = append(filter.images, img.Id)
+				}
+			}
+		}
+	}
+	return filter, nil
+}
+
+// match returns true if the event matches one of the values of each filter
+func (filter *eventFilter) match(event Event) bool {
+	if filter == nil {
+		return true
+	}
+	for name, values := range filter.filters {
+		matched := false
+		for _, value := range values {
+			switch name {
+			case "type":
+				matched = event.Type == value
+			case "event":
+				matched = event.Status == value
+			case "container":
+				matched = event.Type == "container" && strings.HasPrefix(event.Id, value)
+			case "image":
+				matched = event.From == value || (event.Type == "image" && (event.Id == value || event.Attributes["name"] == value))
+			case "label":
+				matched = matchLabel(event.labels, value)
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched && name == "image" {
+			for _, id := range filter.images {
+				if (event.Type == "image" && event.Id == id) || event.From == id {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched && len(values) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBusHistory(t *testing.T) {
+	bus := NewEventBus(3)
+	for i := 0; i < 5; i++ {
+		bus.Log("create", fmt.Sprintf("c%d", i), "", nil)
+	}
+	past, ch := bus.Subscribe(1)
+	defer bus.Unsubscribe(ch)
+	if len(past) != 3 {
+		t.Fatalf("Expected the 3 last events, got %v", past)
+	}
+	for i, event := range past {
+		if expected := fmt.Sprintf("c%d", i+2); event.Id != expected {
+			t.Errorf("Expected event %d to be about %s, got %s", i, expected, event.Id)
+		}
+	}
+
+	// Events older than since aren't replayed
+	past, ch2 := bus.Subscribe(time.Now().Add(time.Hour).Unix())
+	defer bus.Unsubscribe(ch2)
+	if len(past) != 0 {
+		t.Errorf("Expected no past events, got %v", past)
+	}
+}
+
+func TestEventBusSubscribe(t *testing.T) {
+	bus := NewEventBus(EVENTS_HISTORY)
+	past, ch := bus.Subscribe(0)
+	if len(past) != 0 {
+		t.Errorf("Expected no past events without since, got %v", past)
+	}
+	bus.Log("die", "c1", "img", map[string]string{"exitCode": "1"})
+	select {
+	case event := <-ch:
+		if event.Status != "die" || event.Id != "c1" || event.From != "img" || event.Attributes["exitCode"] != "1" {
+			t.Errorf("Unexpected event: %#v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The event wasn't received")
+	}
+
+	bus.Unsubscribe(ch)
+	bus.Log("destroy", "c1", "img", nil)
+	select {
+	case event := <-ch:
+		t.Errorf("Unsubscribed channel received %#v", event)
+	default:
+	}
+
+	// A subscriber which doesn't read doesn't block the bus
+	_, slow := bus.Subscribe(0)
+	defer bus.Unsubscribe(slow)
+	for i := 0; i < eventsSubscriberBuffer+10; i++ {
+		bus.Log("start", "c2", "", nil)
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	bus := NewEventBus(EVENTS_HISTORY)
+	bus.labels = func(event *Event) map[string]string {
+		if event.Id == "c1" {
+			return map[string]string{"owner": "web"}
+		}
+		return nil
+	}
+	bus.Log("create", "c1", "img1", nil)
+	bus.Log("die", "c1", "img1", map[string]string{"exitCode": "0"})
+	bus.Log("create", "c2", "img2", nil)
+	bus.Log("tag", "img1", "", map[string]string{"name": "base:latest"})
+	bus.Log("trust", "release", "", nil)
+	past, ch := bus.Subscribe(1)
+	bus.Unsubscribe(ch)
+
+	lookupImage := func(name string) (*Image, error) {
+		if name == "base" {
+			return &Image{Id: "img1"}, nil
+		}
+		return nil, fmt.Errorf("No such image: %s", name)
+	}
+	for filters, expected := range map[string]string{
+		"":                         "create c1,die c1,create c2,tag img1,trust release",
+		"type=image":               "tag img1",
+		"type=container,event=die": "die c1",
+		"event=create,event=tag":   "create c1,create c2,tag img1",
+		"container=c":              "create c1,die c1,create c2",
+		"image=base":               "create c1,die c1,tag img1",
+		"image=base:latest":        "tag img1",
+		"image=img2":               "create c2",
+		"label=owner=web":          "create c1,die c1",
+		"label=owner=db":           "",
+	} {
+		values := make(map[string][]string)
+		if filters != "" {
+			for _, filter := range strings.Split(filters, ",") {
+				parts := strings.SplitN(filter, "=", 2)
+				values[parts[0]] = append(values[parts[0]], parts[1])
+			}
+		}
+		filter, err := parseEventFilters(values, lookupImage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var matched []string
+		for _, event := range past {
+			if filter.match(event) {
+				matched = append(matched, event.Status+" "+event.Id)
+			}
+		}
+		if strings.Join(matched, ",") != expected {
+			t.Errorf("Expected %q with %q, got %q", expected, filters, strings.Join(matched, ","))
+		}
+	}
+	for _, invalid := range []map[string][]string{{"status": {"running"}}, {"type": {"volume"}}, {"label": {"=web"}}} {
+		if _, err := parseEventFilters(invalid, lookupImage); err == nil {
+			t.Errorf("%v should be refused", invalid)
+		}
+	}
+}
+
+func TestServerEventsUntil(t *testing.T) {
+	srv := &Server{runtime: &Runtime{events: NewEventBus(EVENTS_HISTORY)}}
+	srv.runtime.events.Log("create", "c1", "img", nil)
+	now := time.Now().Unix()
+	done := make(chan []string)
+	go func() {
+		var received []string
+		srv.Events(1, now+1, nil, nil, func(event Event) error {
+			received = append(received, event.Status)
+			return nil
+		})
+		done <- received
+	}()
+	time.Sleep(10 * time.Millisecond)
+	srv.runtime.events.Log("start", "c1", "img", nil)
+	select {
+	case received := <-done:
+		if strings.Join(received, ",") != "create,start" {
+			t.Fatalf("Unexpected events: %v", received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The events should stop at until")
+	}
+}
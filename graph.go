@@ -2,16 +2,75 @@ package docker
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	DEFAULT_DOWNLOAD_RETRIES     = 5
+	DEFAULT_DOWNLOAD_RETRY_DELAY = time.Second
+)
+
 type Graph struct {
 	Root string
+
+	// Number of times an interrupted layer download is retried, and the
+	// delay before the first retry. The delay doubles after each retry.
+	DownloadRetries    int
+	DownloadRetryDelay time.Duration
+
+	// Layers being downloaded, indexed by image id. A pull which needs a
+	// layer already being downloaded waits on its channel instead.
+	pulling     map[string]chan struct{}
+	pullingLock sync.Mutex
+
+	// Sizes of the layers, by image id. Layers don't change once they are
+	// registered, so their sizes are computed once.
+	sizes     map[string]int64
+	sizesLock sync.Mutex
+
+	// Images loaded by Get, by id, so that their json is only read again
+	// if it was modified
+	images     map[string]*cachedImage
+	imagesLock sync.Mutex
+
+	// Read-only branches of the images mounted, by id, so that the
+	// containers started from the same image don't walk its layers again
+	branches     map[string]*imageBranches
+	branchesLock sync.Mutex
+
+	// Storage driver mounting the images, aufs unless set, see DaemonConfig
+	driver string
+	// With userns-remap, the layers are owned by the host ids of the remap
+	remap *UsernsRemap
+	// With SELinux, the layers are labeled to be shared by the containers
+	selinux bool
+	// Signs the tags pushed and verifies the tags pulled, see trust.go.
+	// With contentTrust, the images which aren't signed are refused.
+	trust        *TrustStore
+	contentTrust bool
+	// Hosts the foreign layers of the v2 manifests may be downloaded from,
+	// see registry_v2.go
+	foreignLayerHosts []string
+	// Layers of the images committed at most, or 0 for no limit. Beyond,
+	// the commits fail, or squash the image with squashLayers, see depth.go.
+	maxLayers    int
+	squashLayers bool
+	// Sends the requests to the registries through their proxies, see
+	// proxy.go. The default transport if nil.
+	transport http.RoundTripper
+
+	// Held while the scan reports of an image are updated, see scan.go
+	scansLock sync.Mutex
+	// Held while the v2 blob of a layer is updated, see registry_v2.go
+	blobsLock sync.Mutex
 }
 
 func NewGraph(root string) (*Graph, error) {
@@ -24,10 +83,22 @@ func NewGraph(root string) (*Graph, error) {
 		return nil, err
 	}
 	return &Graph{
-		Root: abspath,
+		Root:               abspath,
+		DownloadRetries:    DEFAULT_DOWNLOAD_RETRIES,
+		DownloadRetryDelay: DEFAULT_DOWNLOAD_RETRY_DELAY,
+		pulling:            make(map[string]chan struct{}),
+		sizes:              make(map[string]int64),
+		images:             make(map[string]*cachedImage),
+		branches:           make(map[string]*imageBranches),
 	}, nil
 }
 
+type cachedImage struct {
+	img   *Image
+	mtime time.Time // Of the json of the image
+	size  int64
+}
+
 // FIXME: Implement error subclass instead of looking at the error text
 // Note: This is the way golang implements os.IsNotExists on Plan9
 func (graph *Graph) IsNotExist(err error) bool {
@@ -43,7 +114,18 @@ func (graph *Graph) Exists(id string) bool {
 
 func (graph *Graph) Get(id string) (*Image, error) {
 	// FIXME: return nil when the image doesn't exist, instead of an error
-	img, err := LoadImage(graph.imageRoot(id))
+	root := graph.imageRoot(id)
+	info, err := os.Stat(jsonPath(root))
+	graph.imagesLock.Lock()
+	if cached, exists := graph.images[id]; exists && err == nil && cached.mtime.Equal(info.ModTime()) && cached.size == info.Size() {
+		img := *cached.img
+		graph.imagesLock.Unlock()
+		return &img, nil
+	}
+	delete(graph.images, id)
+	graph.imagesLock.Unlock()
+
+	img, err := LoadImage(root)
 	if err != nil {
 		return nil, err
 	}
@@ -51,17 +133,43 @@ func (graph *Graph) Get(id string) (*Image, error) {
 		return nil, fmt.Errorf("Image stored at '%s' has wrong id '%s'", id, img.Id)
 	}
 	img.graph = graph
+	if info != nil {
+		cached := *img
+		graph.imagesLock.Lock()
+		graph.images[id] = &cachedImage{img: &cached, mtime: info.ModTime(), size: info.Size()}
+		graph.imagesLock.Unlock()
+	}
 	return img, nil
 }
 
-func (graph *Graph) Create(layerData Archive, container *Container, comment string) (*Image, error) {
+// forget drops the image id from the cache of Get, and from the cache of
+// the branches
+func (graph *Graph) forget(id string) {
+	graph.imagesLock.Lock()
+	delete(graph.images, id)
+	graph.imagesLock.Unlock()
+	graph.branchesLock.Lock()
+	delete(graph.branches, id)
+	graph.branchesLock.Unlock()
+}
+
+func (graph *Graph) Create(layerData Archive, container *Container, comment string, config *Config) (*Image, error) {
+	return graph.create(layerData, container, comment, config, false)
+}
+
+// create creates an image like Create. If squashed is set, layerData is the
+// whole filesystem of the container, and the image has no parent.
+func (graph *Graph) create(layerData Archive, container *Container, comment string, config *Config, squashed bool) (*Image, error) {
 	img := &Image{
 		Id:      GenerateId(),
 		Comment: comment,
 		Created: time.Now(),
+		Config:  config,
 	}
 	if container != nil {
-		img.Parent = container.Image
+		if !squashed {
+			img.Parent = container.Image
+		}
 		img.Container = container.Id
 		img.ContainerConfig = *container.Config
 	}
@@ -72,6 +180,15 @@ func (graph *Graph) Create(layerData Archive, container *Container, comment stri
 }
 
 func (graph *Graph) Register(layerData Archive, img *Image) error {
+	return graph.register(layerData, img, nil)
+}
+
+// register registers img like Register. If check is set, it is called once
+// the layer is extracted, and the image is discarded if it fails, eg.
+// because the checksum of the layer computed during the extraction doesn't
+// match.
+func (graph *Graph) register(layerData Archive, img *Image, check func() error) error {
+	defer graphOperationDuration.since(time.Now(), "register")
 	if err := ValidateId(img.Id); err != nil {
 		return err
 	}
@@ -79,14 +196,40 @@ func (graph *Graph) Register(layerData Archive, img *Image) error {
 	if graph.Exists(img.Id) {
 		return fmt.Errorf("Image %s already exists", img.Id)
 	}
+	graph.forget(img.Id)
 	tmp, err := graph.Mktemp(img.Id)
 	defer os.RemoveAll(tmp)
 	if err != nil {
 		return fmt.Errorf("Mktemp failed: %s", err)
 	}
+	if graph.remap != nil {
+		layerData = graph.remap.ArchiveToHost(layerData)
+	}
 	if err := StoreImage(img, layerData, tmp); err != nil {
+		// A corrupted layer is reported as such, rather than by the error
+		// of its extraction
+		if check != nil {
+			if err := check(); err != nil {
+				return err
+			}
+		}
 		return err
 	}
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	if graph.remap != nil {
+		if err := graph.remap.Chown(layerPath(tmp)); err != nil {
+			return err
+		}
+	}
+	if graph.selinux {
+		if err := relabel(layerPath(tmp), sharedFileLabel()); err != nil {
+			return err
+		}
+	}
 	// Commit
 	if err := os.Rename(tmp, graph.imageRoot(img.Id)); err != nil {
 		return err
@@ -95,6 +238,30 @@ func (graph *Graph) Register(layerData Archive, img *Image) error {
 	return nil
 }
 
+// TarLayer returns an archive of the layer of the image id, owned by the ids
+// of the containers
+func (graph *Graph) TarLayer(id string, compression Compression) (Archive, error) {
+	layer := layerPath(graph.imageRoot(id))
+	if graph.remap == nil {
+		return Tar(layer, compression)
+	}
+	archive, err := Tar(layer, Uncompressed)
+	if err != nil {
+		return nil, err
+	}
+	return compressArchive(graph.remap.ArchiveToContainer(archive), compression)
+}
+
+// layerArchiveSize returns the size of the compressed archive of the layer
+// of the image id, made by TarLayer
+func (graph *Graph) layerArchiveSize(id string) (int64, error) {
+	archive, err := graph.TarLayer(id, Gzip)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(ioutil.Discard, archive)
+}
+
 func (graph *Graph) Mktemp(id string) (string, error) {
 	tmp, err := NewGraph(path.Join(graph.Root, ":tmp:"))
 	if err != nil {
@@ -106,6 +273,15 @@ func (graph *Graph) Mktemp(id string) (string, error) {
 	return tmp.imageRoot(id), nil
 }
 
+// Directory holding the layers being downloaded from a registry
+func (graph *Graph) downloadsDir() (string, error) {
+	downloads := path.Join(graph.Root, ":downloads:")
+	if err := os.Mkdir(downloads, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return downloads, nil
+}
+
 func (graph *Graph) Garbage() (*Graph, error) {
 	return NewGraph(path.Join(graph.Root, ":garbage:"))
 }
@@ -125,6 +301,11 @@ func isNotEmpty(err error) bool {
 }
 
 func (graph *Graph) Delete(id string) error {
+	defer graphOperationDuration.since(time.Now(), "delete")
+	graph.sizesLock.Lock()
+	delete(graph.sizes, id)
+	graph.sizesLock.Unlock()
+	graph.forget(id)
 	garbage, err := graph.Garbage()
 	if err != nil {
 		return err
@@ -132,18 +313,18 @@ func (graph *Graph) Delete(id string) error {
 	err = os.Rename(graph.imageRoot(id), garbage.imageRoot(id))
 	if err != nil {
 		if isNotEmpty(err) {
-			Debugf("The image %s is already present in garbage. Removing it.", id)
+			graphLog.Debugf("The image %s is already present in garbage. Removing it.", id)
 			if err = os.RemoveAll(garbage.imageRoot(id)); err != nil {
-				Debugf("Error while removing the image %s from garbage: %s\n", id, err)
+				graphLog.Debugf("Error while removing the image %s from garbage: %s\n", id, err)
 				return err
 			}
-			Debugf("Image %s removed from garbage", id)
+			graphLog.Debugf("Image %s removed from garbage", id)
 			if err = os.Rename(graph.imageRoot(id), garbage.imageRoot(id)); err != nil {
 				return err
 			}
-			Debugf("Image %s put in the garbage", id)
+			graphLog.Debugf("Image %s put in the garbage", id)
 		} else {
-			Debugf("Error putting the image %s to garbage: %s\n", id, err)
+			graphLog.Debugf("Error putting the image %s to garbage: %s\n", id, err)
 		}
 		return err
 	}
@@ -206,15 +387,10 @@ func (graph *Graph) WalkAll(handler func(*Image)) error {
 func (graph *Graph) ByParent() (map[string][]*Image, error) {
 	byParent := make(map[string][]*Image)
 	err := graph.WalkAll(func(image *Image) {
-		image, err := graph.Get(image.Parent)
-		if err != nil {
+		if _, err := graph.Get(image.Parent); err != nil {
 			return
 		}
-		if children, exists := byParent[image.Parent]; exists {
-			byParent[image.Parent] = []*Image{image}
-		} else {
-			byParent[image.Parent] = append(children, image)
-		}
+		byParent[image.Parent] = append(byParent[image.Parent], image)
 	})
 	return byParent, err
 }
@@ -235,6 +411,35 @@ func (graph *Graph) Heads() (map[string]*Image, error) {
 	return heads, err
 }
 
+// LayerSize returns the size of the files of the layer of an image
+func (graph *Graph) LayerSize(id string) (int64, error) {
+	graph.sizesLock.Lock()
+	size, cached := graph.sizes[id]
+	graph.sizesLock.Unlock()
+	if cached {
+		return size, nil
+	}
+	size, err := dirSize(layerPath(graph.imageRoot(id)), nil)
+	if err != nil {
+		return 0, err
+	}
+	graph.sizesLock.Lock()
+	graph.sizes[id] = size
+	graph.sizesLock.Unlock()
+	return size, nil
+}
+
+// Size returns the size of an image with its parents
+func (graph *Graph) Size(img *Image) (int64, error) {
+	var size int64
+	err := img.WalkHistory(func(img *Image) error {
+		layerSize, err := graph.LayerSize(img.Id)
+		size += layerSize
+		return err
+	})
+	return size, err
+}
+
 func (graph *Graph) imageRoot(id string) string {
 	return path.Join(graph.Root, id)
 }
@@ -3,6 +3,7 @@ package docker
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
@@ -35,7 +36,7 @@ func TestGraphCreate(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	image, err := graph.Create(archive, nil, "Testing")
+	image, err := graph.Create(archive, nil, "Testing", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -92,7 +93,7 @@ func TestMount(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	image, err := graph.Create(archive, nil, "Testing")
+	image, err := graph.Create(archive, nil, "Testing", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -128,7 +129,7 @@ func TestDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 	assertNImages(graph, t, 0)
-	img, err := graph.Create(archive, nil, "Bla bla")
+	img, err := graph.Create(archive, nil, "Bla bla", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -139,11 +140,11 @@ func TestDelete(t *testing.T) {
 	assertNImages(graph, t, 0)
 
 	// Test 2 create (same name) / 1 delete
-	img1, err := graph.Create(archive, nil, "Testing")
+	img1, err := graph.Create(archive, nil, "Testing", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err = graph.Create(archive, nil, "Testing"); err != nil {
+	if _, err = graph.Create(archive, nil, "Testing", nil); err != nil {
 		t.Fatal(err)
 	}
 	assertNImages(graph, t, 2)
@@ -168,6 +169,137 @@ func TestDelete(t *testing.T) {
 	assertNImages(graph, t, 1)
 }
 
+func TestGetCache(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	img, err := graph.Create(testArchive(t), nil, "Cached", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := graph.Get(img.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The callers get their own copy
+	loaded.Comment = "Modified"
+	if cached, err := graph.Get(img.Id); err != nil || cached.Comment != "Cached" || cached.graph != graph {
+		t.Fatalf("Unexpected image from the cache: %#v (%v)", cached, err)
+	}
+	// The json is read again once it changed
+	data, err := json.Marshal(&Image{Id: img.Id, Comment: "Edited"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(jsonPath(graph.imageRoot(img.Id)), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if edited, err := graph.Get(img.Id); err != nil || edited.Comment != "Edited" {
+		t.Fatalf("Expected the edited image, got %#v (%v)", edited, err)
+	}
+	if err := os.RemoveAll(graph.imageRoot(img.Id)); err != nil {
+		t.Fatal(err)
+	}
+	if graph.Exists(img.Id) {
+		t.Fatalf("A removed image shouldn't exist anymore")
+	}
+}
+
+func TestBranchesCache(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	img, err := graph.Create(testArchive(t), nil, "Cached", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := img.layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(layer, "etc", ".wh.shadow"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	branches, err := img.branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branches.layers) != 1 || branches.layers[0] != layer || !equalStrings(branches.deletes, []string{"/etc/shadow"}) {
+		t.Fatalf("Unexpected branches: %#v", branches)
+	}
+	// The containers started from the same image reuse its branches
+	if cached, err := img.branches(); err != nil || cached != branches {
+		t.Fatalf("Expected the cached branches, got %#v (%v)", cached, err)
+	}
+	if err := graph.Delete(img.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := graph.branches[img.Id]; exists {
+		t.Fatalf("The branches of a deleted image should be dropped")
+	}
+}
+
+func TestByParent(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	parent, err := graph.Create(testArchive(t), nil, "Parent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var children []*Image
+	for i := 0; i < 2; i++ {
+		child := &Image{Id: GenerateId(), Parent: parent.Id, Created: time.Now()}
+		if err := graph.Register(testArchive(t), child); err != nil {
+			t.Fatal(err)
+		}
+		children = append(children, child)
+	}
+	byParent, err := graph.ByParent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byParent) != 1 || len(byParent[parent.Id]) != 2 {
+		t.Fatalf("Expected %s to have 2 children, got %v", parent.Id, byParent)
+	}
+	heads, err := graph.Heads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heads) != 2 || heads[children[0].Id] == nil || heads[children[1].Id] == nil {
+		t.Fatalf("Expected the children to be the heads, got %v", heads)
+	}
+}
+
+func TestSize(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	parent, err := graph.Create(testArchive(t), nil, "Parent", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := &Image{Id: GenerateId(), Parent: parent.Id, Created: time.Now()}
+	if err := graph.Register(testArchive(t), child); err != nil {
+		t.Fatal(err)
+	}
+	// fakeTar holds 3 files of 13 bytes
+	if size, err := graph.LayerSize(parent.Id); err != nil || size != 39 {
+		t.Errorf("Expected a layer of 39 bytes, got %d (%v)", size, err)
+	}
+	if size, err := graph.Size(child); err != nil || size != 78 {
+		t.Errorf("Expected an image of 78 bytes, got %d (%v)", size, err)
+	}
+	// The size of the archive pushed
+	archive, err := graph.TarLayer(parent.Id, Gzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := graph.layerArchiveSize(parent.Id); err != nil || size != int64(len(data)) {
+		t.Errorf("Expected an archive of %d bytes, got %d (%v)", len(data), size, err)
+	}
+}
+
 func assertNImages(graph *Graph, t *testing.T, n int) {
 	if images, err := graph.All(); err != nil {
 		t.Fatal(err)
@@ -0,0 +1,216 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A PrestartHook adds devices, mounts and environment variables to a
+// container each time it starts, eg. the GPUs and the driver libraries of
+// the host for the containers which ask for them. The hooks registered with
+// the runtime run in the order they were registered, once the root
+// filesystem of the container is mounted.
+type PrestartHook interface {
+	// Prestart returns what to add to a container about to start, or nil
+	Prestart(container *Container) (*PrestartSpec, error)
+}
+
+// PrestartSpec is what a hook adds to a container. It only applies to the
+// current start: the config of the container is left unchanged.
+type PrestartSpec struct {
+	Devices []string // Like -device: /host[:/container][:PERMISSIONS]
+	Mounts  []string // Bind mounts of files or directories of the host: /host:/container[:ro]
+	Env     []string // KEY=VALUE, overriding the variables of the config
+}
+
+func (spec *PrestartSpec) validate() error {
+	for _, device := range spec.Devices {
+		if _, err := parseDevice(device); err != nil {
+			return err
+		}
+	}
+	for _, mount := range spec.Mounts {
+		if src, _, _, _, err := parseBind(mount); err != nil {
+			return err
+		} else if !path.IsAbs(src) {
+			return fmt.Errorf("Invalid mount: %s (the source must be a path of the host)", mount)
+		}
+	}
+	for _, env := range spec.Env {
+		if parts := strings.SplitN(env, "=", 2); len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Invalid environment variable: %s (expected KEY=VALUE)", env)
+		}
+	}
+	return nil
+}
+
+// commandHook runs an external hook: COMMAND CONTAINER_ID, with the
+// container as shown by inspect on stdin, its root filesystem in Rootfs. It
+// writes a JSON PrestartSpec on stdout, or nothing. It is killed, and the
+// start fails, if it runs longer than its timeout.
+type commandHook struct {
+	command string
+	timeout time.Duration // prestartHookTimeout if 0
+}
+
+const prestartHookTimeout = 30 * time.Second
+
+func (hook *commandHook) Prestart(container *Container) (*PrestartSpec, error) {
+	input, err := json.Marshal(struct {
+		*Container
+		Rootfs string
+	}{container, container.RootfsPath()})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(hook.command, container.Id)
+	cmd.Stdin = bytes.NewReader(input)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s failed: %s", hook.command, err)
+	}
+	timeout := hook.timeout
+	if timeout == 0 {
+		timeout = prestartHookTimeout
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("%s failed: %s %s", hook.command, err, strings.TrimSpace(stderr.String()))
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("%s timed out after %s", hook.command, timeout)
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, nil
+	}
+	spec := &PrestartSpec{}
+	if err := json.Unmarshal(stdout.Bytes(), spec); err != nil {
+		return nil, fmt.Errorf("Invalid output of %s: %s", hook.command, err)
+	}
+	return spec, nil
+}
+
+type namedPrestartHook struct {
+	name string
+	hook PrestartHook
+}
+
+// The prestart hooks of a runtime, in the order they were registered
+type prestartHooks struct {
+	hooks []namedPrestartHook
+	lock  sync.Mutex
+}
+
+// RegisterPrestartHook adds a hook, which applies to the containers started
+// after it is registered
+func (runtime *Runtime) RegisterPrestartHook(name string, hook PrestartHook) error {
+	runtime.prestartHooks.lock.Lock()
+	defer runtime.prestartHooks.lock.Unlock()
+	for _, h := range runtime.prestartHooks.hooks {
+		if h.name == name {
+			return fmt.Errorf("Prestart hook %s is already registered", name)
+		}
+	}
+	runtime.prestartHooks.hooks = append(runtime.prestartHooks.hooks, namedPrestartHook{name, hook})
+	return nil
+}
+
+// registerCommandHooks registers the hooks of the daemon settings, named
+// after their commands
+func (runtime *Runtime) registerCommandHooks(commands []string) error {
+	for _, command := range commands {
+		if err := runtime.RegisterPrestartHook(path.Base(command), &commandHook{command: command}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPrestartHooks merges the specs of the hooks into container.prestart,
+// and creates the mount points of their mounts
+func (container *Container) runPrestartHooks() error {
+	container.prestart = nil
+	runtime := container.runtime
+	runtime.prestartHooks.lock.Lock()
+	hooks := append([]namedPrestartHook{}, runtime.prestartHooks.hooks...)
+	runtime.prestartHooks.lock.Unlock()
+	if len(hooks) == 0 {
+		return nil
+	}
+	merged := &PrestartSpec{}
+	for _, h := range hooks {
+		spec, err := h.hook.Prestart(container)
+		if err != nil {
+			return fmt.Errorf("Prestart hook %s failed: %s", h.name, err)
+		}
+		if spec == nil {
+			continue
+		}
+		if err := spec.validate(); err != nil {
+			return fmt.Errorf("Prestart hook %s failed: %s", h.name, err)
+		}
+		merged.Devices = append(merged.Devices, spec.Devices...)
+		merged.Mounts = append(merged.Mounts, spec.Mounts...)
+		merged.Env = overrideEnv(merged.Env, spec.Env)
+	}
+	rootfs := container.RootfsPath()
+	for _, mount := range merged.Mounts {
+		src, dst, _, _, _ := parseBind(mount)
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		// The links of the image are followed within its root filesystem
+		p, err := FollowSymlinkInScope(path.Join(rootfs, dst), rootfs)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = os.MkdirAll(p, 0755)
+		} else if err = os.MkdirAll(path.Dir(p), 0755); err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	container.prestart = merged
+	return nil
+}
+
+// PrestartMount is a bind mount added by the prestart hooks
+type PrestartMount struct {
+	Source      string
+	Destination string
+	RW          bool
+}
+
+// PrestartMounts returns the bind mounts added by the prestart hooks for
+// the current start
+func (container *Container) PrestartMounts() []PrestartMount {
+	if container.prestart == nil {
+		return nil
+	}
+	var mounts []PrestartMount
+	for _, mount := range container.prestart.Mounts {
+		// Checked by runPrestartHooks
+		src, dst, rw, _, _ := parseBind(mount)
+		mounts = append(mounts, PrestartMount{src, dst, rw})
+	}
+	return mounts
+}
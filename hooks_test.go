@@ -0,0 +1,124 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakePrestartHook struct {
+	spec *PrestartSpec
+}
+
+func (hook *fakePrestartHook) Prestart(container *Container) (*PrestartSpec, error) {
+	return hook.spec, nil
+}
+
+func TestCommandHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-hook-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := path.Join(dir, "gpu-hook")
+	// Only the containers asking for GPUs get them
+	if err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+grep -q GPUS=all || exit 0
+echo "{\"Devices\": [\"/dev/null:/dev/nvidia0\"], \"Env\": [\"CONTAINER=$1\"]}"
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hook := &commandHook{command: script}
+	container := &Container{Id: "abc", root: dir, Config: &Config{Env: []string{"GPUS=all"}}}
+	spec, err := hook.Prestart(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec == nil || !equalStrings(spec.Devices, []string{"/dev/null:/dev/nvidia0"}) || !equalStrings(spec.Env, []string{"CONTAINER=abc"}) {
+		t.Fatalf("Unexpected spec: %#v", spec)
+	}
+	container.Config.Env = nil
+	if spec, err := hook.Prestart(container); err != nil || spec != nil {
+		t.Fatalf("Expected no spec, got %#v (%v)", spec, err)
+	}
+	if _, err := (&commandHook{command: "/bin/false"}).Prestart(container); err == nil {
+		t.Fatalf("A failing hook should fail the start")
+	}
+	slow := path.Join(dir, "slow-hook")
+	if err := ioutil.WriteFile(slow, []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&commandHook{command: slow, timeout: 100 * time.Millisecond}).Prestart(container); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("A hook running too long should fail the start, got %v", err)
+	}
+}
+
+func TestRunPrestartHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-hook-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	libs := path.Join(dir, "libs")
+	if err := os.MkdirAll(libs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	runtime := &Runtime{}
+	for i, spec := range []*PrestartSpec{
+		{Devices: []string{"/dev/null:/dev/gpu0"}, Env: []string{"GPU=0", "DRIVER=1"}},
+		nil,
+		{Mounts: []string{libs + ":/usr/lib/gpu:ro", "/dev/null:/etc/gpu.conf"}, Env: []string{"GPU=1"}},
+	} {
+		if err := runtime.RegisterPrestartHook([]string{"a", "b", "c"}[i], &fakePrestartHook{spec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runtime.RegisterPrestartHook("a", &fakePrestartHook{}); err == nil {
+		t.Fatalf("A hook can't be registered twice")
+	}
+	container := &Container{root: path.Join(dir, "container"), runtime: runtime, Config: &Config{}}
+	// The /etc of the image leads to a directory of the host
+	if err := os.MkdirAll(container.RootfsPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(libs, path.Join(container.RootfsPath(), "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := container.runPrestartHooks(); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(container.prestart.Env, []string{"DRIVER=1", "GPU=1"}) {
+		t.Errorf("Unexpected env: %v", container.prestart.Env)
+	}
+	devices, err := container.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].PathInContainer != "/dev/gpu0" || len(container.Config.Devices) != 0 {
+		t.Errorf("Unexpected devices: %v", devices)
+	}
+	mounts := container.PrestartMounts()
+	if len(mounts) != 2 || mounts[0] != (PrestartMount{libs, "/usr/lib/gpu", false}) || mounts[1] != (PrestartMount{"/dev/null", "/etc/gpu.conf", true}) {
+		t.Errorf("Unexpected mounts: %v", mounts)
+	}
+	// The mount points are created within the root filesystem
+	if _, err := os.Lstat(path.Join(libs, "gpu.conf")); !os.IsNotExist(err) {
+		t.Errorf("The mount point shouldn't be created out of the root filesystem")
+	}
+	if info, err := os.Stat(path.Join(container.RootfsPath(), "usr/lib/gpu")); err != nil || !info.IsDir() {
+		t.Errorf("Expected a directory to mount on, got %v", err)
+	}
+	if info, err := os.Stat(path.Join(container.RootfsPath(), libs, "gpu.conf")); err != nil || info.IsDir() {
+		t.Errorf("Expected a file to mount on, got %v", err)
+	}
+
+	invalid := &Runtime{}
+	invalid.RegisterPrestartHook("invalid", &fakePrestartHook{&PrestartSpec{Mounts: []string{"volume:/data"}}})
+	container.runtime = invalid
+	if err := container.runPrestartHooks(); err == nil {
+		t.Fatalf("A mount of a volume should be refused")
+	}
+}
@@ -20,6 +20,7 @@ type Image struct {
 	Created         time.Time `json:"created"`
 	Container       string    `json:"container,omitempty"`
 	ContainerConfig Config    `json:"container_config,omitempty"`
+	Config          *Config   `json:"config,omitempty"` // Defaults for containers created from this image
 	graph           *Graph
 }
 
@@ -83,24 +84,52 @@ func jsonPath(root string) string {
 	return path.Join(root, "json")
 }
 
+// The mount data of aufs is a single page: the ro branches which don't fit
+// in it are appended one by one by remounting
+const aufsMountDataSize = 4096
+
+// aufsBranches returns the mount data of MountAUFS, with the rw branch and
+// as many ro branches as fit in it, and the ro branches left to append
+func aufsBranches(ro []string, rw string) (string, []string) {
+	data := fmt.Sprintf("br:%v=rw", rw)
+	for i, layer := range ro {
+		branch := fmt.Sprintf(":%v=ro", layer)
+		// The data is terminated by a null byte
+		if len(data)+len(branch) >= aufsMountDataSize {
+			return data, ro[i:]
+		}
+		data += branch
+	}
+	return data, nil
+}
+
 func MountAUFS(ro []string, rw string, target string) error {
-	// FIXME: Now mount the layers
-	rwBranch := fmt.Sprintf("%v=rw", rw)
-	roBranches := ""
-	for _, layer := range ro {
-		roBranches += fmt.Sprintf("%v=ro:", layer)
+	data, appended := aufsBranches(ro, rw)
+	if err := mount("none", target, "aufs", 0, data); err != nil {
+		return err
 	}
-	branches := fmt.Sprintf("br:%v:%v", rwBranch, roBranches)
-	return mount("none", target, "aufs", 0, branches)
+	for _, layer := range appended {
+		if err := remount(target, "aufs", fmt.Sprintf("append:%v=ro", layer)); err != nil {
+			Unmount(target)
+			return fmt.Errorf("Unable to append the layer %v: %v", layer, err)
+		}
+	}
+	return nil
 }
 
 func (image *Image) Mount(root, rw string) error {
+	return image.mount(root, rw, nil)
+}
+
+// mount mounts the image like Mount, and stops applying the changes of the
+// layers, unmounting root, once aborted is closed
+func (image *Image) mount(root, rw string, aborted <-chan struct{}) error {
 	if mounted, err := Mounted(root); err != nil {
 		return err
 	} else if mounted {
 		return fmt.Errorf("%s is already mounted", root)
 	}
-	layers, err := image.layers()
+	branches, err := image.branches()
 	if err != nil {
 		return err
 	}
@@ -111,35 +140,76 @@ func (image *Image) Mount(root, rw string) error {
 	if err := os.Mkdir(rw, 0755); err != nil && !os.IsExist(err) {
 		return err
 	}
+	mountLayers := MountAUFS
+	if image.graph != nil && image.graph.driver == "fuse-overlayfs" {
+		mountLayers = MountFuseOverlay
+	}
 	// FIXME: @creack shouldn't we do this after going over changes?
-	if err := MountAUFS(layers, rw, root); err != nil {
+	if err := mountLayers(branches.layers, rw, root); err != nil {
 		return err
 	}
+	// Whiteout the files deleted by the image in the rw branch
+	for _, deleted := range branches.deletes {
+		if isAborted(aborted) {
+			Unmount(root)
+			return ErrAborted
+		}
+		// Make sure the directory exists
+		file_path, file_name := path.Dir(deleted), path.Base(deleted)
+		if err := os.MkdirAll(path.Join(rw, file_path), 0755); err != nil {
+			return err
+		}
+		// And create the whiteout (we just need to create empty file, discard the return)
+		if _, err := os.Create(path.Join(path.Join(rw, file_path),
+			".wh."+path.Base(file_name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageBranches are the read-only branches of the mount of an image: its
+// layers, and the files it deletes, which are whited out in the rw branch
+type imageBranches struct {
+	layers  []string
+	deletes []string
+}
+
+// branches returns the branches of the image. They are computed once per
+// image registered in a graph, since its layers don't change.
+func (image *Image) branches() (*imageBranches, error) {
+	graph := image.graph
+	if graph != nil {
+		graph.branchesLock.Lock()
+		branches, exists := graph.branches[image.Id]
+		graph.branchesLock.Unlock()
+		if exists {
+			return branches, nil
+		}
+	}
+	layers, err := image.layers()
+	if err != nil {
+		return nil, err
+	}
 	// FIXME: Create tests for deletion
 	// FIXME: move this part to change.go
 	// Retrieve the changeset from the parent and apply it to the container
-	//  - Retrieve the changes
 	changes, err := Changes(layers, layers[0])
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Iterate on changes
+	branches := &imageBranches{layers: layers}
 	for _, c := range changes {
-		// If there is a delete
 		if c.Kind == ChangeDelete {
-			// Make sure the directory exists
-			file_path, file_name := path.Dir(c.Path), path.Base(c.Path)
-			if err := os.MkdirAll(path.Join(rw, file_path), 0755); err != nil {
-				return err
-			}
-			// And create the whiteout (we just need to create empty file, discard the return)
-			if _, err := os.Create(path.Join(path.Join(rw, file_path),
-				".wh."+path.Base(file_name))); err != nil {
-				return err
-			}
+			branches.deletes = append(branches.deletes, c.Path)
 		}
 	}
-	return nil
+	if graph != nil {
+		graph.branchesLock.Lock()
+		graph.branches[image.Id] = branches
+		graph.branchesLock.Unlock()
+	}
+	return branches, nil
 }
 
 func (image *Image) Changes(rw string) ([]Change, error) {
@@ -237,6 +307,14 @@ func (img *Image) GetParent() (*Image, error) {
 	return img.graph.Get(img.Parent)
 }
 
+// Labels returns the labels set in the config of the image, if any
+func (img *Image) Labels() map[string]string {
+	if img.Config == nil {
+		return nil
+	}
+	return img.Config.Labels
+}
+
 func (img *Image) root() (string, error) {
 	if img.graph == nil {
 		return "", fmt.Errorf("Can't lookup root of unregistered image")
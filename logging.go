@@ -0,0 +1,175 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	return logLevelNames[level]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if name == levelName {
+			return LogLevel(level), nil
+		}
+	}
+	return LogInfo, fmt.Errorf("Invalid log level: %s (expected debug, info, warn or error)", name)
+}
+
+// The subsystems of the daemon, each with its own logger
+var logSubsystems = map[string]bool{
+	"api":       true,
+	"container": true,
+	"graph":     true,
+	"network":   true,
+	"plugin":    true,
+	"registry":  true,
+	"runtime":   true,
+	"trust":     true,
+	"volume":    true,
+}
+
+var (
+	apiLog       = &Logger{"api"}
+	containerLog = &Logger{"container"}
+	graphLog     = &Logger{"graph"}
+	networkLog   = &Logger{"network"}
+	pluginLog    = &Logger{"plugin"}
+	registryLog  = &Logger{"registry"}
+	runtimeLog   = &Logger{"runtime"}
+	trustLog     = &Logger{"trust"}
+	volumeLog    = &Logger{"volume"}
+)
+
+var logFormats = map[string]bool{
+	"text": true, // DATE TIME [LEVEL] SUBSYSTEM: MESSAGE
+	"json": true, // One object per line, with the keys time, level, subsystem and msg
+}
+
+// The settings shared by the loggers
+var logging = struct {
+	sync.Mutex
+	level  LogLevel            // Default level
+	levels map[string]LogLevel // Levels of the subsystems which override the default one
+	json   bool
+	output io.Writer
+}{level: LogInfo, output: os.Stderr}
+
+// parseLogLevels parses a default level followed by levels of subsystems,
+// eg. "info,graph=debug,network=warn"
+func parseLogLevels(spec string) (LogLevel, map[string]LogLevel, error) {
+	level := LogInfo
+	levels := make(map[string]LogLevel)
+	for i, part := range strings.Split(spec, ",") {
+		subsystem, name := "", part
+		if parts := strings.SplitN(part, "=", 2); len(parts) == 2 {
+			subsystem, name = parts[0], parts[1]
+			if !logSubsystems[subsystem] {
+				return level, nil, fmt.Errorf("Unknown log subsystem: %s", subsystem)
+			}
+		} else if i > 0 {
+			return level, nil, fmt.Errorf("Invalid log level: %s (expected SUBSYSTEM=LEVEL after the default level)", part)
+		}
+		l, err := ParseLogLevel(name)
+		if err != nil {
+			return level, nil, err
+		}
+		if subsystem == "" {
+			level = l
+		} else {
+			levels[subsystem] = l
+		}
+	}
+	return level, levels, nil
+}
+
+// SetupLogging sets the levels of the loggers, as parsed by parseLogLevels,
+// and their format: "text" or "json"
+func SetupLogging(levels, format string) error {
+	level, subsystemLevels, err := parseLogLevels(levels)
+	if err != nil {
+		return err
+	}
+	if !logFormats[format] {
+		return fmt.Errorf("Unknown log format: %s (expected text or json)", format)
+	}
+	logging.Lock()
+	defer logging.Unlock()
+	logging.level = level
+	logging.levels = subsystemLevels
+	logging.json = format == "json"
+	return nil
+}
+
+// Logger logs the messages of a subsystem of the daemon, prefixed with the
+// level and the subsystem, or as JSON objects
+type Logger struct {
+	subsystem string
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	logging.Lock()
+	defer logging.Unlock()
+	min, exists := logging.levels[l.subsystem]
+	if !exists {
+		min = logging.level
+	}
+	return level >= min
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	message := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	logging.Lock()
+	defer logging.Unlock()
+	if !logging.json {
+		fmt.Fprintf(logging.output, "%s [%s] %s: %s\n", time.Now().Format("2006/01/02 15:04:05"), level, l.subsystem, message)
+		return
+	}
+	line, err := json.Marshal(struct {
+		Time      string `json:"time"`
+		Level     string `json:"level"`
+		Subsystem string `json:"subsystem"`
+		Message   string `json:"msg"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), level.String(), l.subsystem, message})
+	if err != nil {
+		return
+	}
+	logging.output.Write(append(line, '\n'))
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LogDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LogInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LogWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LogError, format, args...)
+}
@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	level, levels, err := parseLogLevels("warn,graph=debug,network=error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level != LogWarn || len(levels) != 2 || levels["graph"] != LogDebug || levels["network"] != LogError {
+		t.Errorf("Unexpected levels: %v %v", level, levels)
+	}
+	for _, spec := range []string{"", "verbose", "info,debug", "info,storage=debug", "info,graph=verbose"} {
+		if _, _, err := parseLogLevels(spec); err == nil {
+			t.Errorf("%q should be invalid", spec)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var output bytes.Buffer
+	logging.output = &output
+	defer func() {
+		logging.output = os.Stderr
+		SetupLogging("info", "text")
+	}()
+
+	if err := SetupLogging("warn,graph=debug", "text"); err != nil {
+		t.Fatal(err)
+	}
+	graphLog.Debugf("Layer %s", "abc")
+	networkLog.Infof("Bridge %s", "lxcbr0")
+	networkLog.Errorf("Unable to unmap port %d\n", 80)
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", output.String())
+	}
+	if !strings.HasSuffix(lines[0], " [debug] graph: Layer abc") {
+		t.Errorf("Unexpected line: %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " [error] network: Unable to unmap port 80") {
+		t.Errorf("Unexpected line: %q", lines[1])
+	}
+
+	output.Reset()
+	if err := SetupLogging("info", "json"); err != nil {
+		t.Fatal(err)
+	}
+	registryLog.Debugf("Hidden")
+	registryLog.Warnf("Token expired")
+	var entry map[string]string
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("%s: %q", err, output.String())
+	}
+	if entry["level"] != "warn" || entry["subsystem"] != "registry" || entry["msg"] != "Token expired" || entry["time"] == "" {
+		t.Errorf("Unexpected entry: %v", entry)
+	}
+}
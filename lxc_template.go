@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"fmt"
 	"text/template"
 )
 
@@ -11,16 +12,32 @@ lxc.utsname = {{.Config.Hostname}}
 {{else}}
 lxc.utsname = {{.Id}}
 {{end}}
-#lxc.aa_profile = unconfined
+{{if .AppArmorProfile}}
+lxc.aa_profile = {{.AppArmorProfile}}
+{{end}}
+{{if .ProcessLabel}}
+lxc.se_context = {{.ProcessLabel}}
+{{end}}
 
 # network configuration
+{{if .PooledVeth}}
+lxc.network.type = phys
+lxc.network.link = {{.PooledVeth}}
+{{else}}
 lxc.network.type = veth
-lxc.network.flags = up
 lxc.network.link = lxcbr0
+{{end}}
+lxc.network.flags = up
 lxc.network.name = eth0
 lxc.network.mtu = 1500
 lxc.network.ipv4 = {{.NetworkSettings.IpAddress}}/{{.NetworkSettings.IpPrefixLen}}
 
+{{with .UsernsRemap}}
+# user namespace
+lxc.id_map = u 0 {{.Uids.Start}} {{.Uids.Size}}
+lxc.id_map = g 0 {{.Gids.Start}} {{.Gids.Size}}
+{{end}}
+
 # root filesystem
 {{$ROOTFS := .RootfsPath}}
 lxc.rootfs = {{$ROOTFS}}
@@ -35,35 +52,25 @@ lxc.console = none
 # no controlling tty at all
 lxc.tty = 1
 
+{{if .Cgroups}}
+{{if .Config.Privileged}}
+# access to all the devices
+{{$.CgroupPrefix}}.devices.allow = a
+{{else}}
 # no implicit access to devices
-lxc.cgroup.devices.deny = a
-
-# /dev/null and zero
-lxc.cgroup.devices.allow = c 1:3 rwm
-lxc.cgroup.devices.allow = c 1:5 rwm
-
-# consoles
-lxc.cgroup.devices.allow = c 5:1 rwm
-lxc.cgroup.devices.allow = c 5:0 rwm
-lxc.cgroup.devices.allow = c 4:0 rwm
-lxc.cgroup.devices.allow = c 4:1 rwm
-
-# /dev/urandom,/dev/random
-lxc.cgroup.devices.allow = c 1:9 rwm
-lxc.cgroup.devices.allow = c 1:8 rwm
+{{$.CgroupPrefix}}.devices.deny = a
 
-# /dev/pts/* - pts namespaces are "coming soon"
-lxc.cgroup.devices.allow = c 136:* rwm
-lxc.cgroup.devices.allow = c 5:2 rwm
-
-# tuntap
-lxc.cgroup.devices.allow = c 10:200 rwm
-
-# fuse
-#lxc.cgroup.devices.allow = c 10:229 rwm
+# whitelist of the daemon and of the container, see devices.go
+{{range .DeviceRules}}
+{{$.CgroupPrefix}}.devices.allow = {{.}}
+{{end}}
 
-# rtc
-#lxc.cgroup.devices.allow = c 254:0 rwm
+# devices given with -device
+{{range .Devices}}
+{{$.CgroupPrefix}}.devices.allow = {{.Type}} {{.Major}}:{{.Minor}} {{.Permissions}}
+{{end}}
+{{end}}
+{{end}}
 
 
 # standard mount point
@@ -72,7 +79,24 @@ lxc.mount.entry = sysfs {{$ROOTFS}}/sys sysfs nosuid,nodev,noexec 0 0
 lxc.mount.entry = devpts {{$ROOTFS}}/dev/pts devpts newinstance,ptmxmode=0666,nosuid,noexec 0 0
 #lxc.mount.entry = varrun {{$ROOTFS}}/var/run tmpfs mode=755,size=4096k,nosuid,nodev,noexec 0 0
 #lxc.mount.entry = varlock {{$ROOTFS}}/var/lock tmpfs size=1024k,nosuid,nodev,noexec 0 0
-#lxc.mount.entry = shm {{$ROOTFS}}/dev/shm tmpfs size=65536k,nosuid,nodev,noexec 0 0
+{{with .ShmSize}}
+lxc.mount.entry = shm {{$ROOTFS}}/dev/shm tmpfs mode=1777,size={{.}},nosuid,nodev,noexec 0 0
+{{end}}
+
+# volumes
+{{range $path, $hostPath := .Volumes}}
+lxc.mount.entry = {{mountPath $hostPath}} {{$ROOTFS}}{{mountPath $path}} none bind,{{if index $.VolumesRW $path}}rw{{else}}ro{{end}} 0 0
+{{end}}
+
+# mounts of the prestart hooks, see hooks.go
+{{range .PrestartMounts}}
+lxc.mount.entry = {{mountPath .Source}} {{$ROOTFS}}{{mountPath .Destination}} none bind,{{if .RW}}rw{{else}}ro{{end}} 0 0
+{{end}}
+
+# tmpfs
+{{range $path, $options := .Config.Tmpfs}}
+lxc.mount.entry = tmpfs {{$ROOTFS}}{{mountPath $path}} tmpfs {{tmpfsOptions $options}} 0 0
+{{end}}
 
 # Inject docker-init
 lxc.mount.entry = {{.SysInitPath}} {{$ROOTFS}}/sbin/init none bind,ro 0 0
@@ -80,17 +104,17 @@ lxc.mount.entry = {{.SysInitPath}} {{$ROOTFS}}/sbin/init none bind,ro 0 0
 # In order to get a working DNS environment, mount bind (ro) the host's /etc/resolv.conf into the container
 lxc.mount.entry = /etc/resolv.conf {{$ROOTFS}}/etc/resolv.conf none bind,ro 0 0
 
+{{with .TimezoneFile}}
+# timezone, see timezone.go
+lxc.mount.entry = {{.}} {{$ROOTFS}}/etc/localtime none bind,ro 0 0
+{{end}}
+
 
-# drop linux capabilities (apply mainly to the user root in the container)
-lxc.cap.drop = audit_control audit_write mac_admin mac_override mknod setfcap setpcap sys_admin sys_boot sys_module sys_nice sys_pacct sys_rawio sys_resource sys_time sys_tty_config
+# linux capabilities are dropped by docker-init, once it set up the network
 
-# limits
-{{if .Config.Memory}}
-lxc.cgroup.memory.limit_in_bytes = {{.Config.Memory}}
-lxc.cgroup.memory.soft_limit_in_bytes = {{.Config.Memory}}
-{{with $memSwap := getMemorySwap .Config}}
-lxc.cgroup.memory.memsw.limit_in_bytes = {{$memSwap}}
-{{end}}
+# limits, see cgroups.go
+{{range .CgroupLimits}}
+{{$.CgroupPrefix}}.{{.File}} = {{.Value}}
 {{end}}
 `
 
@@ -105,10 +129,21 @@ func getMemorySwap(config *Config) int64 {
 	return config.Memory * 2
 }
 
+// lxcMountPath refuses the paths which would end a mount entry, and
+// inject lines in the config, eg. those of containers created before they
+// were validated
+func lxcMountPath(p string) (string, error) {
+	if !validMountPath(p) {
+		return "", fmt.Errorf("Invalid mount path: %q", p)
+	}
+	return p, nil
+}
+
 func init() {
 	var err error
 	funcMap := template.FuncMap{
-		"getMemorySwap": getMemorySwap,
+		"tmpfsOptions": tmpfsOptions,
+		"mountPath":    lxcMountPath,
 	}
 	LxcTemplateCompiled, err = template.New("lxc").Funcs(funcMap).Parse(LxcTemplate)
 	if err != nil {
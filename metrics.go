@@ -0,0 +1,234 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics of the daemon are served on /metrics at -metrics-addr, in the
+// text format of Prometheus. Counters and histograms are recorded while the
+// daemon runs; the gauges are read from its state when they are scraped.
+
+var (
+	apiRequestDuration = newHistogramVec("docker_api_request_duration_seconds", "Duration of the API requests, by method, route and status code",
+		durationBuckets, "method", "route", "code")
+	graphOperationDuration = newHistogramVec("docker_graph_operation_duration_seconds", "Duration of the operations of the graph on the layers, by operation",
+		durationBuckets, "operation")
+	imagePulls         = newCounterVec("docker_image_pulls_total", "Image pulls, by result", "result")
+	imagePullsProgress = newGaugeVec("docker_image_pulls_in_progress", "Image pulls in progress")
+	builds             = newCounterVec("docker_builds_total", "Builds, by result", "result")
+
+	// Written in this order, after the gauges of the state of the daemon
+	metrics = []metric{apiRequestDuration, graphOperationDuration, imagePulls, imagePullsProgress, builds}
+)
+
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+// counterVec holds a value by combination of label values: a counter, or a
+// gauge which may be decremented.
+type counterVec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+	lock   sync.Mutex
+	values map[string]float64 // By label values, joined by labelSeparator
+}
+
+const labelSeparator = "\xff"
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, kind: "counter", labels: labels, values: make(map[string]float64)}
+}
+
+func newGaugeVec(name, help string, labels ...string) *counterVec {
+	c := newCounterVec(name, help, labels...)
+	c.kind = "gauge"
+	return c
+}
+
+func (c *counterVec) add(delta float64, values ...string) {
+	c.lock.Lock()
+	c.values[strings.Join(values, labelSeparator)] += delta
+	c.lock.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.kind); err != nil {
+		return err
+	}
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		return writeSample(w, c.name, nil, nil, 0)
+	}
+	for _, key := range sortedKeys(c.values) {
+		if err := writeSample(w, c.name, c.labels, splitLabelValues(key), c.values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogramVec counts observations in cumulative buckets, by combination of
+// label values
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // By bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, buckets: buckets, labels: labels, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(value float64, values ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := strings.Join(values, labelSeparator)
+	hist, exists := h.values[key]
+	if !exists {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// since observes the seconds elapsed since start, eg. with
+// defer h.since(time.Now(), "create")
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Now().Sub(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		hist, values := h.values[key], splitLabelValues(key)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			if err := writeSample(w, h.name+"_bucket", labels, append(append([]string{}, values...), le), float64(cumulative)); err != nil {
+				return err
+			}
+		}
+		if err := writeSample(w, h.name+"_bucket", labels, append(append([]string{}, values...), "+Inf"), float64(hist.count)); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_sum", h.labels, values, hist.sum); err != nil {
+			return err
+		}
+		if err := writeSample(w, h.name+"_count", h.labels, values, float64(hist.count)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func splitLabelValues(key string) []string {
+	return strings.Split(key, labelSeparator)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample writes a line of the text format: name{label="value",...} value
+func writeSample(w io.Writer, name string, labels, values []string, value float64) error {
+	var pairs []string
+	for i, label := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, labelValueEscaper.Replace(values[i])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+	return err
+}
+
+// WriteMetrics writes the metrics of the daemon in the text format of
+// Prometheus
+func (srv *Server) WriteMetrics(w io.Writer) error {
+	containers := map[string]float64{"running": 0, "stopped": 0}
+	for _, container := range srv.runtime.List() {
+		if container.State.Running {
+			containers["running"]++
+		} else {
+			containers["stopped"]++
+		}
+	}
+	srv.buildsLock.Lock()
+	buildsInProgress := len(srv.builds)
+	srv.buildsLock.Unlock()
+
+	state := newGaugeVec("docker_containers", "Containers, by state", "state")
+	for _, key := range sortedKeys(containers) {
+		state.add(containers[key], key)
+	}
+	inProgress := newGaugeVec("docker_builds_in_progress", "Builds in progress")
+	inProgress.add(float64(buildsInProgress))
+	queued := newGaugeVec("docker_operations_queued", "Pulls, pushes and builds waiting to start, by operation", "operation")
+	queued.add(float64(srv.buildQueue.queued()), "build")
+	queued.add(float64(srv.pullQueue.queued()), "pull")
+	queued.add(float64(srv.pushQueue.queued()), "push")
+	for _, m := range append([]metric{state, inProgress, queued}, metrics...) {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListenAndServeMetrics serves the metrics of the daemon on /metrics at addr,
+// HOST:PORT
+func ListenAndServeMetrics(addr string, srv *Server) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := srv.WriteMetrics(w); err != nil {
+			apiLog.Errorf("Error sending the metrics: %s", err)
+		}
+	})
+	apiLog.Infof("Serving the metrics on http://%s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,85 @@
+package docker
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("docker_test_total", "Test counter", "result", "name")
+	c.add(1, "success", "a")
+	c.add(2, "success", "a")
+	c.add(1, "failure", `b"\`)
+	var buf bytes.Buffer
+	if err := c.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP docker_test_total Test counter
+# TYPE docker_test_total counter
+docker_test_total{result="failure",name="b\"\\"} 1
+docker_test_total{result="success",name="a"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	g := newGaugeVec("docker_test", "Test gauge")
+	buf.Reset()
+	if err := g.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(buf.String(), "# TYPE docker_test gauge\ndocker_test 0\n") {
+		t.Errorf("A gauge without labels should be written as 0, got:\n%s", buf.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("docker_test_seconds", "Test histogram", []float64{.1, 1}, "operation")
+	h.observe(.05, "register")
+	h.observe(.1, "register")
+	h.observe(.5, "register")
+	h.observe(5, "register")
+	var buf bytes.Buffer
+	if err := h.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP docker_test_seconds Test histogram
+# TYPE docker_test_seconds histogram
+docker_test_seconds_bucket{operation="register",le="0.1"} 2
+docker_test_seconds_bucket{operation="register",le="1"} 3
+docker_test_seconds_bucket{operation="register",le="+Inf"} 4
+docker_test_seconds_sum{operation="register"} 5.65
+docker_test_seconds_count{operation="register"} 4
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	srv := &Server{runtime: &Runtime{containers: list.New(), config: DefaultDaemonConfig()}}
+	req, _ := http.NewRequest("GET", "/v"+API_VERSION+"/version", nil)
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+
+	var buf bytes.Buffer
+	if err := srv.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`docker_containers{state="running"} 0`,
+		`docker_containers{state="stopped"} 0`,
+		"docker_builds_in_progress 0",
+		`docker_operations_queued{operation="pull"} 0`,
+		"docker_image_pulls_in_progress 0",
+		"# TYPE docker_graph_operation_duration_seconds histogram",
+		`docker_api_request_duration_seconds_count{method="GET",route="/version",code="200"}`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected %q in the metrics:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// With -network-pool-size, the daemon keeps veth pairs ready in the
+// background, their host side attached to the bridge, so that starting a
+// container doesn't wait for them to be created. A container started while
+// the pool is empty gets a veth pair created by lxc, as without the pool.
+// The container side of a pair is moved into the container by lxc, and the
+// pair is destroyed with the network namespace of the container, so each
+// pair is used once and the pool is refilled as pairs are claimed.
+
+// The names of the pairs start with VETH_POOL_PREFIX, so that the pairs
+// left behind by a previous daemon can be removed
+const VETH_POOL_PREFIX = "dkp"
+
+const vethPoolRetryDelay = 5 * time.Second
+
+// A vethPair is a pair of veth interfaces of the host
+type vethPair struct {
+	host string // Attached to the bridge
+	peer string // Moved into the container as eth0
+}
+
+func newVethPair() *vethPair {
+	id := GenerateId()[:8]
+	return &vethPair{
+		host: VETH_POOL_PREFIX + id + "h",
+		peer: VETH_POOL_PREFIX + id + "c",
+	}
+}
+
+// Wrapper around the ip command
+func ipCommand(args ...string) error {
+	path, err := exec.LookPath("ip")
+	if err != nil {
+		return fmt.Errorf("command not found: ip")
+	}
+	if output, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip failed: ip %v: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func createVethPair(pair *vethPair, bridge string) error {
+	if err := ipCommand("link", "add", pair.host, "type", "veth", "peer", "name", pair.peer); err != nil {
+		return err
+	}
+	if err := ipCommand("link", "set", pair.host, "master", bridge, "up"); err != nil {
+		removeVethPair(pair)
+		return err
+	}
+	return nil
+}
+
+// removeVethPair removes a pair, unless it is already gone with the
+// namespace of its container
+func removeVethPair(pair *vethPair) error {
+	if _, err := net.InterfaceByName(pair.host); err != nil {
+		return nil
+	}
+	return ipCommand("link", "del", pair.host)
+}
+
+type vethPool struct {
+	bridge string
+	pairs  chan *vethPair
+	refill chan struct{}
+	closed chan struct{} // Closed by Close
+	done   chan struct{} // Closed once fill returned
+
+	// Create and remove the pairs of the host, replaced by the tests
+	create func(pair *vethPair, bridge string) error
+	remove func(pair *vethPair) error
+}
+
+func newVethPool(bridge string, size int) *vethPool {
+	return &vethPool{
+		bridge: bridge,
+		pairs:  make(chan *vethPair, size),
+		refill: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+		create: createVethPair,
+		remove: removeVethPair,
+	}
+}
+
+// removeStalePairs removes the pairs of the pool of a previous daemon
+func removeStalePairs() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		networkLog.Warnf("Couldn't list the network interfaces: %s", err)
+		return
+	}
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, VETH_POOL_PREFIX) && strings.HasSuffix(iface.Name, "h") {
+			if err := ipCommand("link", "del", iface.Name); err != nil {
+				networkLog.Warnf("Couldn't remove the veth pair %s: %s", iface.Name, err)
+			}
+		}
+	}
+}
+
+// fill creates pairs until the pool is full, then waits for a claim, until
+// the pool is closed. It runs in its own goroutine.
+func (pool *vethPool) fill() {
+	defer close(pool.done)
+	for {
+		for len(pool.pairs) < cap(pool.pairs) {
+			select {
+			case <-pool.closed:
+				return
+			default:
+			}
+			pair := newVethPair()
+			if err := pool.create(pair, pool.bridge); err != nil {
+				networkLog.Warnf("Couldn't create a veth pair for the pool, retrying in %s: %s", vethPoolRetryDelay, err)
+				select {
+				case <-time.After(vethPoolRetryDelay):
+					continue
+				case <-pool.closed:
+					return
+				}
+			}
+			// Only fill adds pairs, so there is room for it
+			pool.pairs <- pair
+		}
+		select {
+		case <-pool.refill:
+		case <-pool.closed:
+			return
+		}
+	}
+}
+
+// Claim takes a pair out of the pool, or returns nil if the pool is empty
+func (pool *vethPool) Claim() *vethPair {
+	select {
+	case pair := <-pool.pairs:
+		select {
+		case pool.refill <- struct{}{}:
+		default:
+		}
+		return pair
+	default:
+		return nil
+	}
+}
+
+// Close stops filling the pool, and removes the pairs which weren't claimed
+func (pool *vethPool) Close() {
+	close(pool.closed)
+	<-pool.done
+	for {
+		select {
+		case pair := <-pool.pairs:
+			if err := pool.remove(pair); err != nil {
+				networkLog.Warnf("Couldn't remove the veth pair %s: %s", pair.host, err)
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVethPool records the pairs created and removed instead of touching
+// the interfaces of the host
+type fakeVethPool struct {
+	*vethPool
+	created map[string]bool
+	lock    sync.Mutex
+}
+
+func newFakeVethPool(size int) *fakeVethPool {
+	pool := &fakeVethPool{vethPool: newVethPool("lxcbr0", size), created: make(map[string]bool)}
+	pool.create = func(pair *vethPair, bridge string) error {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		pool.created[pair.host] = true
+		return nil
+	}
+	pool.remove = func(pair *vethPair) error {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		delete(pool.created, pair.host)
+		return nil
+	}
+	return pool
+}
+
+func (pool *fakeVethPool) exists(pair *vethPair) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.created[pair.host]
+}
+
+func (pool *fakeVethPool) count() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.created)
+}
+
+// waitFull waits until the pool holds its size of pairs
+func (pool *fakeVethPool) waitFull(t *testing.T) {
+	for i := 0; len(pool.pairs) < cap(pool.pairs); i++ {
+		if i == 100 {
+			t.Fatalf("The pool should be refilled, it holds %d pairs", len(pool.pairs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVethPool(t *testing.T) {
+	pool := newFakeVethPool(3)
+	go pool.fill()
+	pool.waitFull(t)
+
+	pair := pool.Claim()
+	if pair == nil || pair.host == pair.peer || len(pair.host) > 15 {
+		t.Fatalf("Unexpected pair: %#v", pair)
+	}
+	// A claimed pair is replaced
+	pool.waitFull(t)
+	if n := pool.count(); n != 4 {
+		t.Errorf("Expected 4 pairs, got %d", n)
+	}
+
+	// The pairs which weren't claimed are removed on close
+	pool.Close()
+	if n := pool.count(); n != 1 {
+		t.Errorf("Only the claimed pair should be left, got %d pairs", n)
+	}
+	if pool.Claim() != nil {
+		t.Errorf("A closed pool should be empty")
+	}
+}
+
+func TestAllocateFromVethPool(t *testing.T) {
+	pool := newFakeVethPool(1)
+	go pool.fill()
+	defer pool.Close()
+	pool.waitFull(t)
+	manager := &NetworkManager{
+		bridgeNetwork: &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.IPv4Mask(255, 255, 255, 0)},
+		portAllocator: &PortAllocator{},
+		pool:          pool.vethPool,
+	}
+	var err error
+	if manager.ipAllocator, err = newIPAllocator(manager.bridgeNetwork); err != nil {
+		t.Fatal(err)
+	}
+	iface, err := manager.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := &Container{network: iface}
+	if container.PooledVeth() != iface.veth.peer || !pool.exists(iface.veth) {
+		t.Fatalf("The interface should get the pair of the pool")
+	}
+	// Removed if the container didn't take it with its namespace
+	if err := iface.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if pool.exists(iface.veth) {
+		t.Errorf("The pair should be removed once released")
+	}
+}
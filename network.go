@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os/exec"
 	"strconv"
@@ -110,6 +109,7 @@ func getIfaceAddr(name string) (net.Addr, error) {
 // It keeps track of all mappings and is able to unmap at will
 type PortMapper struct {
 	mapping map[int]net.TCPAddr
+	parent  *rootlessPorts // Exposes the ports on the host in rootless mode, see rootless.go
 }
 
 func (mapper *PortMapper) cleanup() error {
@@ -144,6 +144,12 @@ func (mapper *PortMapper) Map(port int, dest net.TCPAddr) error {
 	if err := mapper.iptablesForward("-A", port, dest); err != nil {
 		return err
 	}
+	if mapper.parent != nil {
+		if err := mapper.parent.Expose(port, dest); err != nil {
+			mapper.iptablesForward("-D", port, dest)
+			return err
+		}
+	}
 	mapper.mapping[port] = dest
 	return nil
 }
@@ -156,6 +162,11 @@ func (mapper *PortMapper) Unmap(port int) error {
 	if err := mapper.iptablesForward("-D", port, dest); err != nil {
 		return err
 	}
+	if mapper.parent != nil {
+		if err := mapper.parent.Unexpose(port); err != nil {
+			networkLog.Warnf("%s", err)
+		}
+	}
 	delete(mapper.mapping, port)
 	return nil
 }
@@ -203,6 +214,19 @@ func (alloc *PortAllocator) Release(port int) error {
 	return nil
 }
 
+// Take a given port out of the allocator, eg. a port used by a container left
+// running by a previous daemon
+func (alloc *PortAllocator) AcquirePort(port int) error {
+	for i := len(alloc.ports); i > 0; i-- {
+		p := <-alloc.ports
+		if p == port {
+			return nil
+		}
+		alloc.ports <- p
+	}
+	return fmt.Errorf("Port %d is not available", port)
+}
+
 func newPortAllocator(start, end int) (*PortAllocator, error) {
 	allocator := &PortAllocator{}
 	allocator.populate(start, end)
@@ -263,6 +287,18 @@ func (alloc *IPAllocator) Release(ip net.IP) error {
 	return nil
 }
 
+// Take a given address out of the allocator
+func (alloc *IPAllocator) AcquireIP(ip net.IP) error {
+	for i := len(alloc.queue); i > 0; i-- {
+		queued := <-alloc.queue
+		if queued.Equal(ip) {
+			return nil
+		}
+		alloc.queue <- queued
+	}
+	return fmt.Errorf("IP address %s is not available", ip)
+}
+
 func newIPAllocator(network *net.IPNet) (*IPAllocator, error) {
 	alloc := &IPAllocator{
 		network: network,
@@ -280,6 +316,7 @@ type NetworkInterface struct {
 
 	manager  *NetworkManager
 	extPorts []int
+	veth     *vethPair // Claimed from the pool, if any, see netpool.go
 }
 
 // Allocate an external TCP port and map it to the interface
@@ -300,13 +337,19 @@ func (iface *NetworkInterface) AllocatePort(port int) (int, error) {
 func (iface *NetworkInterface) Release() error {
 	for _, port := range iface.extPorts {
 		if err := iface.manager.portMapper.Unmap(port); err != nil {
-			log.Printf("Unable to unmap port %v: %v", port, err)
+			networkLog.Errorf("Unable to unmap port %v: %v", port, err)
 		}
 		if err := iface.manager.portAllocator.Release(port); err != nil {
-			log.Printf("Unable to release port %v: %v", port, err)
+			networkLog.Errorf("Unable to release port %v: %v", port, err)
 		}
 
 	}
+	if iface.veth != nil {
+		// Gone with the namespace of the container, unless it never started
+		if err := iface.manager.pool.remove(iface.veth); err != nil {
+			networkLog.Errorf("Unable to remove the veth pair %v: %v", iface.veth.host, err)
+		}
+	}
 	return iface.manager.ipAllocator.Release(iface.IPNet.IP)
 }
 
@@ -319,6 +362,7 @@ type NetworkManager struct {
 	ipAllocator   *IPAllocator
 	portAllocator *PortAllocator
 	portMapper    *PortMapper
+	pool          *vethPool // Veth pairs created in advance, if enabled
 }
 
 // Allocate a network interface
@@ -332,10 +376,48 @@ func (manager *NetworkManager) Allocate() (*NetworkInterface, error) {
 		Gateway: manager.bridgeNetwork.IP,
 		manager: manager,
 	}
+	if manager.pool != nil {
+		iface.veth = manager.pool.Claim()
+	}
 	return iface, nil
 }
 
-func newNetworkManager(bridgeIface string) (*NetworkManager, error) {
+// Reclaim the network interface of a container left running by a previous
+// daemon: its address, and its external ports by internal port
+func (manager *NetworkManager) Reclaim(ip net.IP, ports map[int]int) (*NetworkInterface, error) {
+	if err := manager.ipAllocator.AcquireIP(ip); err != nil {
+		return nil, err
+	}
+	iface := &NetworkInterface{
+		IPNet:   net.IPNet{IP: ip, Mask: manager.bridgeNetwork.Mask},
+		Gateway: manager.bridgeNetwork.IP,
+		manager: manager,
+	}
+	for port, extPort := range ports {
+		if err := manager.portAllocator.AcquirePort(extPort); err != nil {
+			iface.Release()
+			return nil, err
+		}
+		if err := manager.portMapper.Map(extPort, net.TCPAddr{IP: ip, Port: port}); err != nil {
+			manager.portAllocator.Release(extPort)
+			iface.Release()
+			return nil, err
+		}
+		iface.extPorts = append(iface.extPorts, extPort)
+	}
+	return iface, nil
+}
+
+// Close removes the veth pairs of the pool which weren't claimed
+func (manager *NetworkManager) Close() {
+	if manager.pool != nil {
+		manager.pool.Close()
+	}
+}
+
+// newNetworkManager manages the network of the containers on bridgeIface,
+// with a pool of poolSize veth pairs if poolSize isn't 0
+func newNetworkManager(bridgeIface string, poolSize int) (*NetworkManager, error) {
 	addr, err := getIfaceAddr(bridgeIface)
 	if err != nil {
 		return nil, err
@@ -364,5 +446,10 @@ func newNetworkManager(bridgeIface string) (*NetworkManager, error) {
 		portAllocator: portAllocator,
 		portMapper:    portMapper,
 	}
+	if poolSize > 0 {
+		removeStalePairs()
+		manager.pool = newVethPool(bridgeIface, poolSize)
+		go manager.pool.fill()
+	}
 	return manager, nil
 }
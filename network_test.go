@@ -141,3 +141,43 @@ func TestIPAllocator(t *testing.T) {
 		t.Fatal(ip.String())
 	}
 }
+
+func TestAllocatorsAcquireGiven(t *testing.T) {
+	gwIP, n, _ := net.ParseCIDR("127.0.0.1/29")
+	alloc, err := newIPAllocator(&net.IPNet{IP: gwIP, Mask: n.Mask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	given := net.ParseIP("127.0.0.4")
+	if err := alloc.AcquireIP(given); err != nil {
+		t.Fatal(err)
+	}
+	if err := alloc.AcquireIP(given); err == nil {
+		t.Error("An address can't be acquired twice")
+	}
+	for i := 0; i < 4; i++ {
+		ip, err := alloc.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.Equal(given) {
+			t.Fatalf("%s was allocated twice", ip)
+		}
+	}
+
+	ports, err := newPortAllocator(40000, 40003)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ports.AcquirePort(40001); err != nil {
+		t.Fatal(err)
+	}
+	if err := ports.AcquirePort(40001); err == nil {
+		t.Error("A port can't be acquired twice")
+	}
+	for i := 0; i < 2; i++ {
+		if port, err := ports.Acquire(); err != nil || port == 40001 {
+			t.Fatalf("Unexpected port %d (%v)", port, err)
+		}
+	}
+}
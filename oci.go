@@ -0,0 +1,551 @@
+package docker
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 'docker save -oci' writes images as a tar archive of an OCI image layout,
+// which other container tools read, and 'docker load -oci' registers the
+// images of such a layout:
+//
+//	oci-layout              {"imageLayoutVersion": "1.0.0"}
+//	index.json              The manifest of each name saved
+//	blobs/sha256/HEX        The manifests, configs and layers, by digest
+//
+// The layers are uncompressed, the base layer first. The history of the
+// images is in the config, but not their ids: the images loaded get ids
+// derived from the digests of their layers, so that loading a layout again
+// reuses them.
+
+const (
+	ociLayoutVersion      = "1.0.0"
+	ociIndexMediaType     = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType  = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType    = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType     = "application/vnd.oci.image.layer.v1.tar"
+	dockerConfigMediaType = "application/vnd.docker.container.image.v1+json"
+	// The name of a manifest of the index, and its tag alone
+	ociImageNameAnnotation = "io.containerd.image.name"
+	ociRefNameAnnotation   = "org.opencontainers.image.ref.name"
+)
+
+// The media types of the layers loaded, extracted by Untar
+var ociLayerMediaTypes = map[string]bool{
+	ociLayerMediaType: true,
+	"application/vnd.oci.image.layer.v1.tar+gzip": true,
+	"application/vnd.oci.image.layer.v1.tar+zstd": true,
+	layerMediaType: true,
+}
+
+var ociDigestRegexp = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociImageConfig struct {
+	Created      *time.Time       `json:"created,omitempty"`
+	Architecture string           `json:"architecture"`
+	OS           string           `json:"os"`
+	Config       ociRuntimeConfig `json:"config"`
+	RootFS       ociRootFS        `json:"rootfs"`
+	History      []ociHistory     `json:"history,omitempty"`
+}
+
+// ociRuntimeConfig holds the defaults of the containers of an image
+type ociRuntimeConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"` // eg. "80/tcp"
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIds []string `json:"diff_ids"`
+}
+
+type ociHistory struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// ociRuntimeConfigOf returns the part of config an OCI image config holds
+func ociRuntimeConfigOf(config *Config) ociRuntimeConfig {
+	if config == nil {
+		return ociRuntimeConfig{}
+	}
+	runtimeConfig := ociRuntimeConfig{
+		User:       config.User,
+		Env:        config.Env,
+		Entrypoint: config.Entrypoint,
+		Cmd:        config.Cmd,
+		Volumes:    config.Volumes,
+		WorkingDir: config.WorkingDir,
+		Labels:     config.Labels,
+		StopSignal: config.StopSignal,
+	}
+	for _, port := range config.Ports {
+		if runtimeConfig.ExposedPorts == nil {
+			runtimeConfig.ExposedPorts = make(map[string]struct{})
+		}
+		runtimeConfig.ExposedPorts[fmt.Sprintf("%d/tcp", port)] = struct{}{}
+	}
+	return runtimeConfig
+}
+
+// config returns the config of the image of an OCI image config. The ports
+// which aren't tcp are left out.
+func (runtimeConfig *ociRuntimeConfig) config() *Config {
+	config := &Config{
+		User:       runtimeConfig.User,
+		Env:        runtimeConfig.Env,
+		Entrypoint: runtimeConfig.Entrypoint,
+		Cmd:        runtimeConfig.Cmd,
+		Volumes:    runtimeConfig.Volumes,
+		WorkingDir: runtimeConfig.WorkingDir,
+		Labels:     runtimeConfig.Labels,
+		StopSignal: runtimeConfig.StopSignal,
+	}
+	for exposed := range runtimeConfig.ExposedPorts {
+		parts := strings.SplitN(exposed, "/", 2)
+		if len(parts) == 2 && parts[1] != "tcp" {
+			continue
+		}
+		if port, err := strconv.Atoi(parts[0]); err == nil {
+			config.Ports = append(config.Ports, port)
+		}
+	}
+	sort.Ints(config.Ports)
+	return config
+}
+
+// ociLayoutWriter writes the blobs of an OCI image layout to a tar archive,
+// each once
+type ociLayoutWriter struct {
+	tw      *tar.Writer
+	graph   *Graph
+	written map[string]bool          // Blobs, by digest
+	layers  map[string]ociDescriptor // Layers written, by image id
+}
+
+// writeBlob writes the blob data, and returns its descriptor
+func (layout *ociLayoutWriter) writeBlob(mediaType string, data []byte) (ociDescriptor, error) {
+	desc := ociDescriptor{MediaType: mediaType, Digest: digestOf(data), Size: int64(len(data))}
+	if layout.written[desc.Digest] {
+		return desc, nil
+	}
+	layout.written[desc.Digest] = true
+	return desc, writeTarFile(layout.tw, ociBlobPath(desc.Digest), data)
+}
+
+// writeLayer writes the uncompressed layer of the image id. The archive of
+// the layer is made in a temporary file first, for its digest and size.
+func (layout *ociLayoutWriter) writeLayer(id string) (ociDescriptor, error) {
+	if desc, exists := layout.layers[id]; exists {
+		return desc, nil
+	}
+	layer, err := layout.graph.TarLayer(id, Uncompressed)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	tmp, err := ioutil.TempFile("", "docker-save-")
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), layer)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	desc := ociDescriptor{MediaType: ociLayerMediaType, Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), Size: size}
+	layout.layers[id] = desc
+	if layout.written[desc.Digest] {
+		return desc, nil
+	}
+	layout.written[desc.Digest] = true
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := layout.tw.WriteHeader(&tar.Header{Name: ociBlobPath(desc.Digest), Mode: 0644, Size: size, ModTime: time.Now()}); err != nil {
+		return ociDescriptor{}, err
+	}
+	_, err = io.Copy(layout.tw, tmp)
+	return desc, err
+}
+
+// writeImage writes the layers, the config and the manifest of the image id,
+// and returns the descriptor of the manifest
+func (layout *ociLayoutWriter) writeImage(id string) (ociDescriptor, error) {
+	img, err := layout.graph.Get(id)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	history, err := img.History()
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	manifest := &ociManifest{SchemaVersion: 2, MediaType: ociManifestMediaType}
+	created := img.Created
+	config := &ociImageConfig{
+		Created:      &created,
+		Architecture: daemonPlatform.Architecture,
+		OS:           "linux",
+		Config:       ociRuntimeConfigOf(img.Config),
+		RootFS:       ociRootFS{Type: "layers"},
+	}
+	// The base image first
+	for i := len(history) - 1; i >= 0; i-- {
+		layer, err := layout.writeLayer(history[i].Id)
+		if err != nil {
+			return ociDescriptor{}, err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+		config.RootFS.DiffIds = append(config.RootFS.DiffIds, layer.Digest)
+		created := history[i].Created
+		config.History = append(config.History, ociHistory{
+			Created:   &created,
+			CreatedBy: strings.Join(history[i].ContainerConfig.Cmd, " "),
+			Comment:   history[i].Comment,
+		})
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if manifest.Config, err = layout.writeBlob(ociConfigMediaType, data); err != nil {
+		return ociDescriptor{}, err
+	}
+	if data, err = json.Marshal(manifest); err != nil {
+		return ociDescriptor{}, err
+	}
+	return layout.writeBlob(ociManifestMediaType, data)
+}
+
+func ociBlobPath(digest string) string {
+	return path.Join("blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// ImageSaveOCI writes the images, repositories and tags names to w as a tar
+// archive of an OCI image layout, with a manifest per tag and per image
+// named by id
+func (srv *Server) ImageSaveOCI(w io.Writer, names []string) error {
+	repositories, heads, err := srv.savedNames(names)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir, ModTime: time.Now()}); err != nil {
+			return err
+		}
+	}
+	layout := &ociLayoutWriter{
+		tw:      tw,
+		graph:   srv.runtime.graph,
+		written: make(map[string]bool),
+		layers:  make(map[string]ociDescriptor),
+	}
+	index := &ociIndex{SchemaVersion: 2, MediaType: ociIndexMediaType}
+	tagged := make(map[string]bool)
+	var repoNames []string
+	for name := range repositories {
+		repoNames = append(repoNames, name)
+	}
+	sort.Strings(repoNames)
+	for _, name := range repoNames {
+		var tags []string
+		for tag := range repositories[name] {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			id := repositories[name][tag]
+			desc, err := layout.writeImage(id)
+			if err != nil {
+				return err
+			}
+			desc.Annotations = map[string]string{
+				ociImageNameAnnotation: name + ":" + tag,
+				ociRefNameAnnotation:   tag,
+			}
+			index.Manifests = append(index.Manifests, desc)
+			tagged[id] = true
+		}
+	}
+	// The images named by id
+	for _, id := range heads {
+		if tagged[id] {
+			continue
+		}
+		tagged[id] = true
+		desc, err := layout.writeImage(id)
+		if err != nil {
+			return err
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "index.json", data); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "oci-layout", []byte(`{"imageLayoutVersion":"`+ociLayoutVersion+`"}`)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ociLayout reads the blobs of an OCI image layout extracted in dir
+type ociLayout struct {
+	dir string
+}
+
+// blobPath returns the path of the blob of desc, once its digest and its
+// size are verified
+func (layout *ociLayout) blobPath(desc ociDescriptor) (string, error) {
+	if !ociDigestRegexp.MatchString(desc.Digest) {
+		return "", fmt.Errorf("Unsupported digest: %s", desc.Digest)
+	}
+	p := path.Join(layout.dir, ociBlobPath(desc.Digest))
+	f, err := os.Open(p)
+	if err != nil {
+		return "", fmt.Errorf("Invalid OCI layout: %s", err)
+	}
+	defer f.Close()
+	counter := &countingReader{r: f}
+	digest, err := sha256Digest(counter)
+	if err != nil {
+		return "", err
+	}
+	if digest != desc.Digest || counter.n != desc.Size {
+		return "", fmt.Errorf("Invalid OCI layout: the blob %s doesn't match its digest or its size", desc.Digest)
+	}
+	return p, nil
+}
+
+// readBlob returns the content of the blob of desc, once verified
+func (layout *ociLayout) readBlob(desc ociDescriptor) ([]byte, error) {
+	p, err := layout.blobPath(desc)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+// manifest returns the manifest of desc. For an image index, it is the
+// manifest of the platform of the daemon.
+func (layout *ociLayout) manifest(desc ociDescriptor) (*ociManifest, error) {
+	data, err := layout.readBlob(desc)
+	if err != nil {
+		return nil, err
+	}
+	switch desc.MediaType {
+	case ociIndexMediaType, manifestListMediaType:
+		index := &ociIndex{}
+		if err := json.Unmarshal(data, index); err != nil {
+			return nil, fmt.Errorf("Invalid image index %s: %s", desc.Digest, err)
+		}
+		for _, entry := range index.Manifests {
+			if entry.Platform != nil && entry.Platform.Architecture == daemonPlatform.Architecture && entry.Platform.OS == "linux" {
+				return layout.manifest(entry)
+			}
+		}
+		return nil, fmt.Errorf("The image index %s has no manifest for linux/%s", desc.Digest, daemonPlatform.Architecture)
+	case ociManifestMediaType, manifestV2MediaType:
+		manifest := &ociManifest{}
+		if err := json.Unmarshal(data, manifest); err != nil {
+			return nil, fmt.Errorf("Invalid manifest %s: %s", desc.Digest, err)
+		}
+		return manifest, nil
+	}
+	return nil, fmt.Errorf("Unsupported manifest media type: %s", desc.MediaType)
+}
+
+// ociImageId returns the id of an image loaded from an OCI layout, derived
+// from the id of its parent and the digests of its layer, and of the config
+// for the top image
+func ociImageId(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadOCIImage registers the layers of manifest, the images which already
+// exist excepted, and returns the top image
+func (graph *Graph) loadOCIImage(layout *ociLayout, manifest *ociManifest, stdout io.Writer) (*Image, error) {
+	if manifest.Config.MediaType != ociConfigMediaType && manifest.Config.MediaType != dockerConfigMediaType {
+		return nil, fmt.Errorf("Unsupported config media type: %s", manifest.Config.MediaType)
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("The manifest has no layer")
+	}
+	data, err := layout.readBlob(manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	config := &ociImageConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %s", manifest.Config.Digest, err)
+	}
+	// The history of the layers, if it has an entry per layer
+	var history []ociHistory
+	for _, entry := range config.History {
+		if !entry.EmptyLayer {
+			history = append(history, entry)
+		}
+	}
+	if len(history) != len(manifest.Layers) {
+		history = nil
+	}
+	var img *Image
+	parent := ""
+	for i, layer := range manifest.Layers {
+		if !ociLayerMediaTypes[layer.MediaType] {
+			return nil, fmt.Errorf("Unsupported layer media type: %s", layer.MediaType)
+		}
+		img = &Image{Id: ociImageId(parent, layer.Digest), Parent: parent, Created: time.Now()}
+		if history != nil {
+			if history[i].Created != nil {
+				img.Created = *history[i].Created
+			}
+			img.Comment = history[i].Comment
+			if history[i].CreatedBy != "" {
+				img.ContainerConfig.Cmd = []string{history[i].CreatedBy}
+			}
+		}
+		if i == len(manifest.Layers)-1 {
+			img.Id = ociImageId(parent, layer.Digest, manifest.Config.Digest)
+			img.Config = config.Config.config()
+			if config.Created != nil {
+				img.Created = *config.Created
+			}
+		}
+		parent = img.Id
+		if graph.Exists(img.Id) {
+			continue
+		}
+		p, err := layout.blobPath(layer)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		err = graph.Register(f, img)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(stdout, "Loaded image %s\n", img.Id)
+	}
+	return img, nil
+}
+
+// ImageLoadOCI registers the images of a tar archive of an OCI image
+// layout, and tags them with their names. The manifests only named by a tag
+// are tagged in repository, if given.
+func (srv *Server) ImageLoadOCI(archive io.Reader, repository string, stdout io.Writer) error {
+	if repository != "" {
+		if err := validateRepoName(repository); err != nil {
+			return err
+		}
+	}
+	dir, err := ioutil.TempDir("", "docker-load-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := Untar(archive, dir); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "oci-layout"))
+	if err != nil {
+		return fmt.Errorf("Invalid OCI layout: %s", err)
+	}
+	var version struct {
+		ImageLayoutVersion string `json:"imageLayoutVersion"`
+	}
+	if err := json.Unmarshal(data, &version); err != nil {
+		return fmt.Errorf("Invalid OCI layout: %s", err)
+	}
+	if version.ImageLayoutVersion != ociLayoutVersion {
+		return fmt.Errorf("Unsupported OCI layout version: %s", version.ImageLayoutVersion)
+	}
+	if data, err = ioutil.ReadFile(path.Join(dir, "index.json")); err != nil {
+		return fmt.Errorf("Invalid OCI layout: %s", err)
+	}
+	index := &ociIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return fmt.Errorf("Invalid OCI layout: index.json: %s", err)
+	}
+	layout := &ociLayout{dir: dir}
+	for _, desc := range index.Manifests {
+		manifest, err := layout.manifest(desc)
+		if err != nil {
+			return err
+		}
+		img, err := srv.runtime.graph.loadOCIImage(layout, manifest, stdout)
+		if err != nil {
+			return err
+		}
+		name := desc.Annotations[ociImageNameAnnotation]
+		if ref := desc.Annotations[ociRefNameAnnotation]; name == "" && ref != "" && repository != "" {
+			name = repository + ":" + ref
+		}
+		if name == "" {
+			fmt.Fprintf(stdout, "Loaded %s\n", img.Id)
+			continue
+		}
+		repoName, tag := parseRepositoryTag(name)
+		if err := srv.runtime.repositories.Set(repoName, tag, img.Id, true); err != nil {
+			return err
+		}
+		if tag == "" {
+			tag = DEFAULT_TAG
+		}
+		fmt.Fprintf(stdout, "Loaded %s:%s\n", repoName, tag)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoadOCI(t *testing.T) {
+	newServer := func() *Server {
+		graph := tempGraph(t)
+		store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Server{runtime: &Runtime{graph: graph, repositories: store}}
+	}
+	srv := newServer()
+	defer os.RemoveAll(srv.runtime.graph.Root)
+	base := &Image{Id: GenerateId(), Comment: "base"}
+	child := &Image{
+		Id:              GenerateId(),
+		Parent:          base.Id,
+		ContainerConfig: Config{Cmd: []string{"/bin/sh", "-c", "make"}},
+		Config:          &Config{Cmd: []string{"/app"}, Ports: []int{80}, Labels: map[string]string{"owner": "web"}},
+	}
+	for _, img := range []*Image{base, child} {
+		if err := srv.runtime.graph.Register(testArchive(t), img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.runtime.repositories.Set("app", "v1", child.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := srv.ImageSaveOCI(&archive, []string{"app:v1"}); err != nil {
+		t.Fatal(err)
+	}
+	data := archive.Bytes()
+
+	// The layout
+	files := make(map[string][]byte)
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, tr)
+		files[hdr.Name] = buf.Bytes()
+	}
+	if string(files["oci-layout"]) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Errorf("Unexpected oci-layout: %s", files["oci-layout"])
+	}
+	index := &ociIndex{}
+	if err := json.Unmarshal(files["index.json"], index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Annotations[ociImageNameAnnotation] != "app:v1" || index.Manifests[0].Annotations[ociRefNameAnnotation] != "v1" {
+		t.Fatalf("Unexpected index: %s", files["index.json"])
+	}
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(files[ociBlobPath(index.Manifests[0].Digest)], manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 2 || manifest.Config.MediaType != ociConfigMediaType {
+		t.Errorf("Unexpected manifest: %v", manifest)
+	}
+	for _, layer := range manifest.Layers {
+		if _, exists := files[ociBlobPath(layer.Digest)]; !exists {
+			t.Errorf("The layer %s is missing", layer.Digest)
+		}
+	}
+
+	srv2 := newServer()
+	defer os.RemoveAll(srv2.runtime.graph.Root)
+	var output bytes.Buffer
+	if err := srv2.ImageLoadOCI(bytes.NewReader(data), "", &output); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := srv2.runtime.repositories.LookupImage("app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Config == nil || strings.Join(loaded.Config.Cmd, " ") != "/app" || len(loaded.Config.Ports) != 1 || loaded.Config.Ports[0] != 80 || loaded.Config.Labels["owner"] != "web" {
+		t.Errorf("Unexpected config: %#v", loaded.Config)
+	}
+	if strings.Join(loaded.ContainerConfig.Cmd, " ") != "/bin/sh -c make" {
+		t.Errorf("Unexpected history: %v", loaded.ContainerConfig.Cmd)
+	}
+	history, err := loaded.History()
+	if err != nil || len(history) != 2 || history[1].Comment != "base" {
+		t.Errorf("Expected the history of app:v1 to be loaded, got %v (%v)", history, err)
+	}
+	if !strings.Contains(output.String(), "Loaded app:v1") {
+		t.Errorf("Unexpected output: %s", output.String())
+	}
+
+	// Loading the layout again reuses the images, and a manifest only
+	// named by a tag is tagged in the repository given
+	output.Reset()
+	renamed := rewriteArchive(t, data, func(name string, content []byte) []byte {
+		if name == "index.json" {
+			return bytes.Replace(content, []byte(`"`+ociImageNameAnnotation+`":"app:v1",`), nil, 1)
+		}
+		return content
+	})
+	if err := srv2.ImageLoadOCI(renamed, "imported", &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "Loaded imported:v1\n" {
+		t.Errorf("Unexpected output: %s", output.String())
+	}
+	if img, err := srv2.runtime.repositories.LookupImage("imported:v1"); err != nil || img.Id != loaded.Id {
+		t.Errorf("Expected imported:v1 to refer to %s, got %v (%v)", loaded.Id, img, err)
+	}
+
+	// A corrupted layer
+	srv3 := newServer()
+	defer os.RemoveAll(srv3.runtime.graph.Root)
+	corrupted := rewriteArchive(t, data, func(name string, content []byte) []byte {
+		if name == ociBlobPath(manifest.Layers[1].Digest) {
+			return testLayer(t, false, "etc/motd", "tampered")
+		}
+		return content
+	})
+	if err := srv3.ImageLoadOCI(corrupted, "", &output); err == nil || !strings.Contains(err.Error(), "doesn't match its digest") {
+		t.Errorf("Expected the corrupted layer to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The fuse-overlayfs storage driver mounts the layers with fuse-overlayfs,
+// which an unprivileged user can mount, eg. in rootless mode, see
+// rootless.go. It reads the .wh. whiteouts of the layers like aufs, but
+// may whiteout the files the container deletes with 0:0 character devices,
+// like overlayfs. Those are turned into .wh. files by aufsWhiteouts before
+// the changes of the container are read.
+
+// MountFuseOverlay mounts the read-only layers ro, the top one first, and
+// the rw branch on target. The work directory of fuse-overlayfs is next to
+// the rw branch.
+func MountFuseOverlay(ro []string, rw string, target string) error {
+	work := path.Join(path.Dir(rw), path.Base(rw)+"-work")
+	if err := os.Mkdir(work, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(ro, ":"), rw, work)
+	if output, err := exec.Command("fuse-overlayfs", "-o", options, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("fuse-overlayfs failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// aufsWhiteouts replaces the overlayfs whiteouts of the rw branch with
+// empty .wh. files
+func aufsWhiteouts(rw string) error {
+	var whiteouts []string
+	err := filepath.Walk(rw, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isOverlayWhiteout(f) {
+			whiteouts = append(whiteouts, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, whiteout := range whiteouts {
+		if err := os.Remove(whiteout); err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(filepath.Dir(whiteout), ".wh."+filepath.Base(whiteout)))
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package docker
+
+import (
+	"os"
+	"syscall"
+)
+
+// isOverlayWhiteout returns whether f is an overlayfs whiteout
+func isOverlayWhiteout(f os.FileInfo) bool {
+	if f.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := f.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
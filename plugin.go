@@ -0,0 +1,275 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins extend the daemon without recompiling it. A plugin is a process
+// serving HTTP, found by name: NAME.sock is its unix socket in
+// DEFAULT_PLUGIN_SOCKET_DIR, or NAME.spec in one of DEFAULT_PLUGIN_SPEC_DIRS
+// holds its address, unix://PATH or tcp://HOST:PORT.
+// Each call POSTs a JSON object to /TYPE.METHOD, eg. /VolumeDriver.Mount,
+// and the plugin answers a JSON object, with the error in Err if the call
+// failed. A plugin is activated on first use by /Plugin.Activate, which
+// answers the types it implements: {"Implements": ["VolumeDriver"]}.
+// The calls which can't reach the plugin are retried with an exponential
+// backoff, since the plugin may be starting or restarting, and the plugin
+// is activated again once it is reachable.
+
+const (
+	DEFAULT_PLUGIN_SOCKET_DIR = "/run/docker/plugins"
+	PLUGIN_CONTENT_TYPE       = "application/vnd.docker.plugins.v1+json"
+
+	pluginRetries    = 5 // Retries of a call which can't reach the plugin
+	pluginRetryDelay = 500 * time.Millisecond
+	pluginTimeout    = 30 * time.Second
+)
+
+var DEFAULT_PLUGIN_SPEC_DIRS = []string{"/etc/docker/plugins", "/usr/lib/docker/plugins"}
+
+// The types of plugins. The networking of the containers is built in, it
+// can't be extended by plugins.
+var pluginTypes = map[string]bool{
+	"VolumeDriver": true, // Stores named volumes, see volume_driver.go
+	"AuthzPlugin":  true, // Allows or denies the API requests, see authz.go
+}
+
+// A Plugin is a daemon extension reached over HTTP
+type Plugin struct {
+	Name       string
+	Addr       string   // unix://PATH or tcp://HOST:PORT
+	Implements []string // Types of the plugin, set once it is activated
+
+	client     *http.Client
+	url        string // Prefix of the URLs of the calls
+	activated  bool
+	retryDelay time.Duration // Doubled after each attempt
+	lock       sync.Mutex
+}
+
+func newPlugin(name, addr string) (*Plugin, error) {
+	proto, sockAddr, err := api.ParseHost(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid address of plugin %s: %s", name, addr)
+	}
+	plugin := &Plugin{
+		Name:       name,
+		Addr:       addr,
+		retryDelay: pluginRetryDelay,
+	}
+	transport := &http.Transport{}
+	if proto == "unix" {
+		transport.Dial = func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sockAddr)
+		}
+		// The host of the URLs is ignored
+		plugin.url = "http://plugin"
+	} else {
+		plugin.url = "http://" + sockAddr
+	}
+	plugin.client = &http.Client{Transport: transport, Timeout: pluginTimeout}
+	return plugin, nil
+}
+
+// A pluginError is an error answered by the plugin, as opposed to a plugin
+// which can't be reached
+type pluginError struct {
+	plugin string
+	msg    string
+}
+
+func (err *pluginError) Error() string {
+	return fmt.Sprintf("Plugin %s: %s", err.plugin, err.msg)
+}
+
+// post makes one attempt of a call. The error is a *pluginError if the
+// plugin was reached.
+func (plugin *Plugin) post(method string, body []byte, ret interface{}) error {
+	req, err := http.NewRequest("POST", plugin.url+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", PLUGIN_CONTENT_TYPE)
+	req.Header.Set("Content-Type", PLUGIN_CONTENT_TYPE)
+	req.Header.Set("User-Agent", "Docker/"+VERSION)
+	res, err := plugin.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Err string
+	}
+	// The body of an error may not be JSON
+	if json.Unmarshal(data, &result) == nil && result.Err != "" {
+		return &pluginError{plugin.Name, result.Err}
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg := strings.TrimSpace(string(data))
+		if msg == "" {
+			msg = res.Status
+		}
+		return &pluginError{plugin.Name, msg}
+	}
+	if ret == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, ret); err != nil {
+		return &pluginError{plugin.Name, fmt.Sprintf("invalid answer to %s: %s", method, err)}
+	}
+	return nil
+}
+
+// postRetry makes a call, retrying while the plugin can't be reached
+func (plugin *Plugin) postRetry(method string, args, ret interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	delay := plugin.retryDelay
+	for attempt := 0; ; attempt++ {
+		err = plugin.post(method, body, ret)
+		if _, reached := err.(*pluginError); err == nil || reached {
+			return err
+		}
+		if attempt == pluginRetries {
+			return fmt.Errorf("Plugin %s can't be reached: %s", plugin.Name, err)
+		}
+		pluginLog.Warnf("Plugin %s can't be reached, retrying in %s: %s", plugin.Name, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// activate activates the plugin, unless it already is
+func (plugin *Plugin) activate() error {
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	if plugin.activated {
+		return nil
+	}
+	var result struct {
+		Implements []string
+	}
+	if err := plugin.postRetry("Plugin.Activate", struct{}{}, &result); err != nil {
+		return err
+	}
+	plugin.Implements = result.Implements
+	plugin.activated = true
+	pluginLog.Infof("Activated plugin %s (%s), implementing %s", plugin.Name, plugin.Addr, strings.Join(plugin.Implements, ", "))
+	return nil
+}
+
+// Call calls METHOD of the plugin, eg. VolumeDriver.Mount, with args, and
+// decodes the answer into ret, unless ret is nil
+func (plugin *Plugin) Call(method string, args, ret interface{}) error {
+	if err := plugin.activate(); err != nil {
+		return err
+	}
+	err := plugin.postRetry(method, args, ret)
+	if _, reached := err.(*pluginError); err != nil && !reached {
+		// It may come back as a new process, which must be activated
+		plugin.lock.Lock()
+		plugin.activated = false
+		plugin.lock.Unlock()
+	}
+	return err
+}
+
+// implements returns whether the plugin implements the type of plugins
+func (plugin *Plugin) implements(kind string) bool {
+	for _, k := range plugin.Implements {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// PluginStore finds the plugins by name, and keeps them once they are
+// found
+type PluginStore struct {
+	socketDir string
+	specDirs  []string
+	plugins   map[string]*Plugin
+	lock      sync.Mutex
+}
+
+func NewPluginStore(socketDir string, specDirs []string) *PluginStore {
+	return &PluginStore{
+		socketDir: socketDir,
+		specDirs:  specDirs,
+		plugins:   make(map[string]*Plugin),
+	}
+}
+
+// lookup finds the address of a plugin in the plugin directories
+func (store *PluginStore) lookup(name string) (string, error) {
+	if strings.ContainsAny(name, "/\x00") || name == "" || name[0] == '.' {
+		return "", fmt.Errorf("Invalid plugin name: %s", name)
+	}
+	if socket := path.Join(store.socketDir, name+".sock"); store.socketDir != "" {
+		if fi, err := os.Stat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return "unix://" + socket, nil
+		}
+	}
+	for _, dir := range store.specDirs {
+		data, err := ioutil.ReadFile(path.Join(dir, name+".spec"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", fmt.Errorf("No such plugin: %s", name)
+}
+
+// Get returns the plugin named name, activated, which must implement the
+// type of plugins kind, eg. VolumeDriver
+func (store *PluginStore) Get(name, kind string) (*Plugin, error) {
+	if !pluginTypes[kind] {
+		return nil, fmt.Errorf("Unknown type of plugins: %s", kind)
+	}
+	store.lock.Lock()
+	plugin, exists := store.plugins[name]
+	if !exists {
+		addr, err := store.lookup(name)
+		if err != nil {
+			store.lock.Unlock()
+			return nil, err
+		}
+		if plugin, err = newPlugin(name, addr); err != nil {
+			store.lock.Unlock()
+			return nil, err
+		}
+		store.plugins[name] = plugin
+	}
+	store.lock.Unlock()
+	if err := plugin.activate(); err != nil {
+		// Looked up again next time, in case it moved
+		store.lock.Lock()
+		delete(store.plugins, name)
+		store.lock.Unlock()
+		return nil, err
+	}
+	if !plugin.implements(kind) {
+		return nil, fmt.Errorf("Plugin %s is not a %s", name, kind)
+	}
+	return plugin, nil
+}
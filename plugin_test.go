@@ -0,0 +1,219 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPlugin serves the calls of a plugin implementing the volume driver,
+// recording them
+type testPlugin struct {
+	implements []string
+	calls      []string
+	lock       sync.Mutex
+}
+
+func (p *testPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var req pluginVolumeRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	p.calls = append(p.calls, strings.TrimSpace(method+" "+req.Name))
+	w.Header().Set("Content-Type", PLUGIN_CONTENT_TYPE)
+	switch {
+	case method == "Plugin.Activate":
+		json.NewEncoder(w).Encode(map[string][]string{"Implements": p.implements})
+	case req.Name == "broken":
+		json.NewEncoder(w).Encode(map[string]string{"Err": "broken volume"})
+	case req.Name == "lost" && method == "VolumeDriver.Path":
+		json.NewEncoder(w).Encode(map[string]string{"Err": "no mountpoint"})
+	case method == "VolumeDriver.Mount" || method == "VolumeDriver.Path":
+		json.NewEncoder(w).Encode(map[string]string{"Mountpoint": "/mnt/" + req.Name})
+	case strings.HasPrefix(method, "VolumeDriver."):
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (p *testPlugin) Calls() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return strings.Join(p.calls, ", ")
+}
+
+// serveTestPlugin serves p on the unix socket at socket until the server
+// is closed
+func serveTestPlugin(t *testing.T, socket string, p *testPlugin) *http.Server {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: p}
+	go server.Serve(listener)
+	return server
+}
+
+func TestPluginStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-plugins-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockets, specs := path.Join(dir, "run"), path.Join(dir, "etc")
+	for _, d := range []string{sockets, specs} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nfs := &testPlugin{implements: []string{"VolumeDriver"}}
+	defer serveTestPlugin(t, path.Join(sockets, "nfs.sock"), nfs).Close()
+	authz := &testPlugin{implements: []string{"AuthzPlugin"}}
+	server := httptest.NewServer(authz)
+	defer server.Close()
+	if err := ioutil.WriteFile(path.Join(specs, "policy.spec"), []byte("tcp://"+server.Listener.Addr().String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewPluginStore(sockets, []string{path.Join(dir, "lib"), specs})
+	plugin, err := store.Get("nfs", "VolumeDriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plugin.Addr != "unix://"+path.Join(sockets, "nfs.sock") {
+		t.Errorf("Unexpected address: %s", plugin.Addr)
+	}
+	// Activated once
+	if again, err := store.Get("nfs", "VolumeDriver"); err != nil || again != plugin {
+		t.Errorf("Expected the same plugin, got %v (%v)", again, err)
+	}
+	if calls := nfs.Calls(); calls != "Plugin.Activate" {
+		t.Errorf("Unexpected calls: %s", calls)
+	}
+	if _, err := store.Get("policy", "AuthzPlugin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("policy", "VolumeDriver"); err == nil {
+		t.Errorf("Getting a plugin of a type it doesn't implement should fail")
+	}
+	for _, name := range []string{"missing", "../run/nfs", ""} {
+		if _, err := store.Get(name, "VolumeDriver"); err == nil {
+			t.Errorf("Getting the plugin %q should fail", name)
+		}
+	}
+	for _, kind := range []string{"Scanner", "NetworkDriver"} {
+		if _, err := store.Get("nfs", kind); err == nil {
+			t.Errorf("Getting a plugin of the unknown type %s should fail", kind)
+		}
+	}
+}
+
+func TestPluginCall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-plugins-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "nfs.sock")
+	plugin, err := newPlugin("nfs", "unix://"+socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin.retryDelay = 10 * time.Millisecond
+
+	// The calls are retried until the plugin is started
+	p := &testPlugin{implements: []string{"VolumeDriver"}}
+	servers := make(chan *http.Server, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		servers <- serveTestPlugin(t, socket, p)
+	}()
+	res := &pluginVolumeResponse{}
+	if err := plugin.Call("VolumeDriver.Mount", &pluginVolumeRequest{"data"}, res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Mountpoint != "/mnt/data" {
+		t.Errorf("Unexpected mount point: %s", res.Mountpoint)
+	}
+	if err := plugin.Call("VolumeDriver.Mount", &pluginVolumeRequest{"broken"}, res); err == nil || !strings.Contains(err.Error(), "broken volume") {
+		t.Errorf("Expected the error of the plugin, got %v", err)
+	}
+	if err := plugin.Call("Plugin.Frobnicate", &pluginVolumeRequest{"data"}, nil); err == nil {
+		t.Errorf("An unknown method should fail")
+	}
+	if calls := p.Calls(); calls != "Plugin.Activate, VolumeDriver.Mount data, VolumeDriver.Mount broken, Plugin.Frobnicate data" {
+		t.Errorf("Unexpected calls: %s", calls)
+	}
+
+	// A plugin which went away is activated again when it comes back
+	(<-servers).Close()
+	os.Remove(socket)
+	if err := plugin.Call("VolumeDriver.Unmount", &pluginVolumeRequest{"data"}, nil); err == nil {
+		t.Fatalf("Calling a plugin which is gone should fail")
+	}
+	p = &testPlugin{implements: []string{"VolumeDriver"}}
+	defer serveTestPlugin(t, socket, p).Close()
+	if err := plugin.Call("VolumeDriver.Unmount", &pluginVolumeRequest{"data"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if calls := p.Calls(); calls != "Plugin.Activate, VolumeDriver.Unmount data" {
+		t.Errorf("Unexpected calls: %s", calls)
+	}
+}
+
+func TestPluginVolumeDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-plugins-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &testPlugin{implements: []string{"VolumeDriver"}}
+	defer serveTestPlugin(t, path.Join(dir, "nfs.sock"), p).Close()
+	store, err := NewVolumeStore(path.Join(dir, "volumes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.plugins = NewPluginStore(dir, nil)
+	volume, err := store.Create("data", "nfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.Path != "/mnt/data" {
+		t.Errorf("Unexpected path: %s", volume.Path)
+	}
+	if err := store.Mount(volume); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Unmount(volume); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove("data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create("broken", "nfs"); err == nil {
+		t.Errorf("A failed creation should fail")
+	}
+	if _, err := store.Create("lost", "nfs"); err == nil || !strings.Contains(err.Error(), "no mountpoint") {
+		t.Errorf("A volume without path should fail to be created, got %v", err)
+	}
+	if _, err := store.Get("lost"); err == nil {
+		t.Errorf("A volume which failed to be created should not be kept")
+	}
+	if _, err := store.Create("data", "ceph"); err == nil {
+		t.Errorf("Creating a volume with an unknown driver should fail")
+	}
+	expected := "Plugin.Activate, VolumeDriver.Create data, VolumeDriver.Path data, VolumeDriver.Mount data, VolumeDriver.Unmount data, VolumeDriver.Remove data, VolumeDriver.Create broken, VolumeDriver.Create lost, VolumeDriver.Path lost, VolumeDriver.Remove lost"
+	if calls := p.Calls(); calls != expected {
+		t.Errorf("Unexpected calls: %s", calls)
+	}
+}
@@ -0,0 +1,188 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// The requests of the daemon to the registries, for the pulls, pushes,
+// searches and logins, go through the proxy of -http-proxy or -https-proxy,
+// by scheme of the registry, or HTTP_PROXY and HTTPS_PROXY in the
+// environment of the daemon, except for the hosts of -no-proxy or NO_PROXY
+// and the loopback. The proxies are asked to CONNECT to the https
+// registries, so that TLS goes from the daemon to the registry.
+// -registry-proxy=HOST=URL overrides the proxy of a registry, and
+// HOST=direct bypasses the proxies.
+
+const DIRECT_PROXY = "direct"
+
+// registryProxies selects the proxy of each request to a registry
+type registryProxies struct {
+	httpProxy  *url.URL // nil for none
+	httpsProxy *url.URL
+	noProxy    []string
+	registries map[string]*url.URL // Overrides by HOST[:PORT], nil to bypass the proxies
+}
+
+// proxyEnv returns the value of the environment variable name, in upper or
+// lower case
+func proxyEnv(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// parseProxyURL parses the URL of a proxy, http:// by default, or returns
+// nil if it is empty
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+		return nil, fmt.Errorf("Invalid proxy: %s (expected an http, https or socks5 URL)", proxy)
+	}
+	return u, nil
+}
+
+// parseRegistryProxy parses an override of the proxy of a registry:
+// HOST[:PORT]=URL, or HOST[:PORT]=direct
+func parseRegistryProxy(override string) (host string, proxy *url.URL, err error) {
+	parts := strings.SplitN(override, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", nil, fmt.Errorf("Invalid registry proxy: %s (expected HOST=URL or HOST=%s)", override, DIRECT_PROXY)
+	}
+	if parts[1] == DIRECT_PROXY {
+		return parts[0], nil, nil
+	}
+	proxy, err = parseProxyURL(parts[1])
+	return parts[0], proxy, err
+}
+
+// newRegistryProxies returns the proxies of the registries, from the
+// environment unless they are given
+func newRegistryProxies(httpProxy, httpsProxy, noProxy string, overrides []string) (*registryProxies, error) {
+	if httpProxy == "" {
+		httpProxy = proxyEnv("HTTP_PROXY")
+	}
+	if httpsProxy == "" {
+		httpsProxy = proxyEnv("HTTPS_PROXY")
+	}
+	if noProxy == "" {
+		noProxy = proxyEnv("NO_PROXY")
+	}
+	proxies := &registryProxies{registries: make(map[string]*url.URL)}
+	var err error
+	if proxies.httpProxy, err = parseProxyURL(httpProxy); err != nil {
+		return nil, err
+	}
+	if proxies.httpsProxy, err = parseProxyURL(httpsProxy); err != nil {
+		return nil, err
+	}
+	for _, host := range strings.Split(noProxy, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			proxies.noProxy = append(proxies.noProxy, strings.ToLower(host))
+		}
+	}
+	for _, override := range overrides {
+		host, proxy, err := parseRegistryProxy(override)
+		if err != nil {
+			return nil, err
+		}
+		proxies.registries[strings.ToLower(host)] = proxy
+	}
+	return proxies, nil
+}
+
+// bypass returns whether the requests to u go to it directly
+func (proxies *registryProxies) bypass(u *url.URL) bool {
+	hostname := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" && u.Scheme == "https" {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+	ip := net.ParseIP(hostname)
+	if hostname == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return true
+	}
+	for _, entry := range proxies.noProxy {
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		// example.com, .example.com and *.example.com match the domain and
+		// its subdomains
+		domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Proxy returns the proxy of req, or nil to send it directly, like
+// http.ProxyFromEnvironment
+func (proxies *registryProxies) Proxy(req *http.Request) (*url.URL, error) {
+	for _, host := range []string{req.URL.Host, req.URL.Hostname()} {
+		if proxy, exists := proxies.registries[strings.ToLower(host)]; exists {
+			return proxy, nil
+		}
+	}
+	if proxies.bypass(req.URL) {
+		return nil, nil
+	}
+	if req.URL.Scheme == "https" {
+		return proxies.httpsProxy, nil
+	}
+	return proxies.httpProxy, nil
+}
+
+// Transport returns the transport of the requests to the registries
+func (proxies *registryProxies) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxies.Proxy
+	return transport
+}
+
+// redactProxy hides the password of the URL of a proxy, eg. in the logs
+func redactProxy(proxy string) string {
+	u, err := parseProxyURL(proxy)
+	if err != nil || u == nil || u.User == nil {
+		return proxy
+	}
+	return u.Redacted()
+}
+
+// redactRegistryProxies hides the passwords of the proxies of overrides
+func redactRegistryProxies(overrides []string) []string {
+	var redacted []string
+	for _, override := range overrides {
+		parts := strings.SplitN(override, "=", 2)
+		if len(parts) == 2 {
+			override = parts[0] + "=" + redactProxy(parts[1])
+		}
+		redacted = append(redacted, override)
+	}
+	return redacted
+}
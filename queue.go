@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The pulls, pushes and builds run at most -max-pulls, -max-pushes and
+// -max-builds at a time, so that many simultaneous requests don't exhaust
+// the file descriptors or the disk of the host. The others wait in a queue,
+// and start in the order they were requested.
+
+// opQueue lets at most limit operations run at a time, or any number if
+// limit is 0. A nil queue doesn't limit the operations either.
+type opQueue struct {
+	name    string // Of the operations, eg. "pulls"
+	limit   int
+	lock    sync.Mutex
+	running int
+	waiting []chan struct{} // Closed when the operation can start, in order
+}
+
+func newOpQueue(name string, limit int) *opQueue {
+	return &opQueue{name: name, limit: limit}
+}
+
+// acquire waits until the operation reporting to stdout can start, unless
+// aborted is closed first. release must be called once it is done.
+func (q *opQueue) acquire(stdout io.Writer, aborted <-chan struct{}) error {
+	if q == nil || q.limit == 0 {
+		return nil
+	}
+	q.lock.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 {
+		q.running++
+		q.lock.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	q.waiting = append(q.waiting, ready)
+	fmt.Fprintf(stdout, "Waiting for %d %s in progress (%d queued)\n", q.running, q.name, len(q.waiting))
+	q.lock.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-aborted:
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		for i, c := range q.waiting {
+			if c == ready {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				return ErrAborted
+			}
+		}
+		// The operation was started by release in the meantime: let the
+		// next one start instead
+		q.releaseLocked()
+		return ErrAborted
+	}
+}
+
+// release lets the next operation in the queue start
+func (q *opQueue) release() {
+	if q == nil || q.limit == 0 {
+		return
+	}
+	q.lock.Lock()
+	q.releaseLocked()
+	q.lock.Unlock()
+}
+
+func (q *opQueue) releaseLocked() {
+	if len(q.waiting) == 0 {
+		q.running--
+		return
+	}
+	// The slot goes to the first waiting operation
+	close(q.waiting[0])
+	q.waiting = q.waiting[1:]
+}
+
+// queued returns the number of operations waiting to start
+func (q *opQueue) queued() int {
+	if q == nil {
+		return 0
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.waiting)
+}
@@ -0,0 +1,80 @@
+package docker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpQueueOrder(t *testing.T) {
+	q := newOpQueue("pulls", 1)
+	if err := q.acquire(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		var progress bytes.Buffer
+		go func(i int, progress *bytes.Buffer) {
+			if err := q.acquire(progress, nil); err != nil {
+				t.Error(err)
+			}
+			started <- i
+		}(i, &progress)
+		// Queue them in order
+		for q.queued() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+		if !strings.Contains(progress.String(), "Waiting for 1 pulls in progress") {
+			t.Errorf("Unexpected progress: %q", progress.String())
+		}
+	}
+	for i := 0; i < 3; i++ {
+		q.release()
+		if started := <-started; started != i {
+			t.Fatalf("Expected the operation %d to start, got %d", i, started)
+		}
+	}
+	q.release()
+	if q.running != 0 || q.queued() != 0 {
+		t.Fatalf("Expected an empty queue, got %d running and %d queued", q.running, q.queued())
+	}
+}
+
+func TestOpQueueAborted(t *testing.T) {
+	q := newOpQueue("builds", 1)
+	if err := q.acquire(ioutil.Discard, nil); err != nil {
+		t.Fatal(err)
+	}
+	aborted := make(chan struct{})
+	errors := make(chan error)
+	go func() {
+		errors <- q.acquire(ioutil.Discard, aborted)
+	}()
+	for q.queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(aborted)
+	if err := <-errors; err != ErrAborted {
+		t.Fatalf("Expected ErrAborted, got %v", err)
+	}
+	if q.queued() != 0 {
+		t.Fatalf("The aborted operation should leave the queue")
+	}
+	q.release()
+	if q.running != 0 {
+		t.Fatalf("Expected no operation running, got %d", q.running)
+	}
+}
+
+func TestOpQueueUnlimited(t *testing.T) {
+	for _, q := range []*opQueue{nil, newOpQueue("pushes", 0)} {
+		for i := 0; i < 10; i++ {
+			if err := q.acquire(ioutil.Discard, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		q.release()
+	}
+}
@@ -22,6 +22,12 @@ type Service interface {
 	Help() string
 }
 
+// A Service implementing Interceptor serves each command through
+// InterceptCall, which runs it with serve, eg. to authorize or log it
+type Interceptor interface {
+	InterceptCall(cmd string, args []string, serve func() error) error
+}
+
 type Cmd func(io.ReadCloser, io.Writer, ...string) error
 type CmdMethod func(Service, io.ReadCloser, io.Writer, ...string) error
 
@@ -46,10 +52,15 @@ func LocalCall(service Service, stdin io.ReadCloser, stdout io.Writer, args ...s
 		cmd = "help"
 	}
 	method := getMethod(service, cmd)
-	if method != nil {
-		return method(stdin, stdout, flags.Args()[1:]...)
+	if method == nil {
+		return errors.New("No such command: " + cmd)
+	}
+	if interceptor, ok := service.(Interceptor); ok {
+		return interceptor.InterceptCall(cmd, flags.Args()[1:], func() error {
+			return method(stdin, stdout, flags.Args()[1:]...)
+		})
 	}
-	return errors.New("No such command: " + cmd)
+	return method(stdin, stdout, flags.Args()[1:]...)
 }
 
 func getMethod(service Service, name string) Cmd {
@@ -1,25 +1,209 @@
 package docker
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/dotcloud/docker/auth"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 //FIXME: Set the endpoint in a conf file or via commandline
 //const REGISTRY_ENDPOINT = "http://registry-creack.dotcloud.com/v1"
 const REGISTRY_ENDPOINT = auth.REGISTRY_SERVER + "/v1"
 
+// Maximum number of tags pulled at the same time by a repository pull, and
+// of layers downloaded at the same time by an image pull
+const maxConcurrentDownloads = 3
+
+// Split a repository name into the hostname of the registry serving it and
+// the name of the repository on that registry.
+// Names whose first component looks like a hostname (it contains a "." or a
+// ":", or is "localhost") are served by that host, eg.
+// "myregistry.example.com:5000/team/app". Every other name is served by the
+// default index, and the returned hostname is empty.
+func splitReposName(reposName string) (hostname, remoteName string) {
+	nameParts := strings.SplitN(reposName, "/", 2)
+	if len(nameParts) == 1 || (!strings.Contains(nameParts[0], ".") &&
+		!strings.Contains(nameParts[0], ":") && nameParts[0] != "localhost") {
+		return "", reposName
+	}
+	return nameParts[0], nameParts[1]
+}
+
+// Return the base url of the registry api served by hostname.
+// An empty hostname designates the default index.
+// Registries are reached over https, unless they were explicitly
+// declared as insecure when starting the daemon.
+func (runtime *Runtime) registryEndpoint(hostname string) string {
+	if hostname == "" {
+		return REGISTRY_ENDPOINT
+	}
+	scheme := "https"
+	for _, insecure := range runtime.insecureRegistries {
+		if insecure == hostname {
+			scheme = "http"
+			break
+		}
+	}
+	return scheme + "://" + hostname + "/v1"
+}
+
+// Return the registries to pull from, in order of preference.
+// Images from the default index are looked up on the mirrors first.
+func (runtime *Runtime) pullEndpoints(hostname string) []string {
+	if hostname != "" {
+		return []string{runtime.registryEndpoint(hostname)}
+	}
+	return append(append([]string{}, runtime.registryMirrors...), REGISTRY_ENDPOINT)
+}
+
+// Turn the address of a mirror ("host:port", "http://host:port/", etc.)
+// into the base url of its registry api
+func mirrorEndpoint(mirror string) string {
+	mirror = strings.TrimRight(mirror, "/")
+	if !strings.Contains(mirror, "://") {
+		mirror = "https://" + mirror
+	}
+	if !strings.HasSuffix(mirror, "/v1") {
+		mirror += "/v1"
+	}
+	return mirror
+}
+
+// Maximum time we agree to wait when a registry asks us to slow down
+const maxRateLimitDelay = 5 * time.Minute
+
+// registryTransport returns the transport of the requests to the
+// registries
+func (graph *Graph) registryTransport() http.RoundTripper {
+	if graph.transport == nil {
+		return http.DefaultTransport
+	}
+	return graph.transport
+}
+
+// registryClient returns the client of the requests to the registries
+func (graph *Graph) registryClient() *http.Client {
+	return &http.Client{Transport: graph.registryTransport()}
+}
+
+// Token granted by a registry is stored in the AuthConfig of the current
+// pull or push, which may be shared by several goroutines
+var registryTokenLock sync.Mutex
+
+// Send an authenticated request to a registry, and return its response.
+// When the registry grants a token (X-Docker-Token), the following requests
+// of the same pull or push use it instead of the password. If the token
+// expires before the operation completes, a new one is requested and the
+// failed request is sent again.
+// Requests rejected because of rate limiting (HTTP 429) are sent again once
+// the delay given by the registry in Retry-After has passed, at most
+// graph.DownloadRetries times.
+func (graph *Graph) registryDo(stdout io.Writer, aborted <-chan struct{}, req *http.Request, authConfig *auth.AuthConfig) (*http.Response, error) {
+	client := graph.registryClient()
+	req.Cancel = aborted
+	tokenRefreshed := false
+	for attempt := 1; ; attempt++ {
+		registryTokenLock.Lock()
+		token := authConfig.Token
+		registryTokenLock.Unlock()
+		if token != "" {
+			req.Header.Del("X-Docker-Token")
+			req.Header.Set("Authorization", "Token "+token)
+		} else {
+			req.Header.Set("X-Docker-Token", "true")
+			req.SetBasicAuth(authConfig.Username, authConfig.Password)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case res.StatusCode == 401 && token != "" && !tokenRefreshed && rewindRequest(req):
+			res.Body.Close()
+			registryLog.Debugf("Registry token expired, requesting a new one")
+			registryTokenLock.Lock()
+			if authConfig.Token == token {
+				authConfig.Token = ""
+			}
+			registryTokenLock.Unlock()
+			tokenRefreshed = true
+			continue
+		case res.StatusCode == 429:
+			if err := graph.waitRateLimit(stdout, aborted, req, res, attempt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if newToken := res.Header.Get("X-Docker-Token"); newToken != "" {
+			registryTokenLock.Lock()
+			authConfig.Token = newToken
+			registryTokenLock.Unlock()
+		}
+		return res, nil
+	}
+}
+
+// Wait until a request rejected because of rate limiting can be sent again,
+// or return an error if it can't.
+func (graph *Graph) waitRateLimit(stdout io.Writer, aborted <-chan struct{}, req *http.Request, res *http.Response, attempt int) error {
+	res.Body.Close()
+	delay := retryAfter(res, graph.DownloadRetryDelay)
+	if attempt > graph.DownloadRetries || delay > maxRateLimitDelay || !rewindRequest(req) {
+		return fmt.Errorf("The registry is rate limiting requests, try again in %s", delay)
+	}
+	fmt.Fprintf(stdout, "The registry is rate limiting requests, retrying in %s (%d/%d)\n", delay, attempt, graph.DownloadRetries)
+	return sleepAbortable(aborted, delay)
+}
+
+// Prepare a request to be sent again. Returns false if it can't be, because
+// its body was already consumed.
+func rewindRequest(req *http.Request) bool {
+	if req.Body == nil {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+// Parse the Retry-After header of a response, which is either a number of
+// seconds or a date. Returns defaultDelay if the header is missing or invalid.
+func retryAfter(res *http.Response, defaultDelay time.Duration) time.Duration {
+	value := res.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(time.Now()); delay > 0 {
+			return delay
+		}
+		return 0
+	}
+	return defaultDelay
+}
+
 // Build an Image object from raw json data
 func NewImgJson(src []byte) (*Image, error) {
 	ret := &Image{}
 
-	Debugf("Json string: {%s}\n", src)
+	registryLog.Debugf("Json string: {%s}\n", src)
 	// FIXME: Is there a cleaner way to "puryfy" the input json?
 	if err := json.Unmarshal(src, ret); err != nil {
 		return nil, err
@@ -47,15 +231,12 @@ func NewMultipleImgJson(src []byte) ([]*Image, error) {
 
 // Retrieve the history of a given image from the Registry.
 // Return a list of the parent's json (requested image included)
-func (graph *Graph) getRemoteHistory(imgId string, authConfig *auth.AuthConfig) ([]*Image, error) {
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", REGISTRY_ENDPOINT+"/images/"+imgId+"/history", nil)
+func (graph *Graph) getRemoteHistory(stdout io.Writer, aborted <-chan struct{}, imgId, registry string, authConfig *auth.AuthConfig) ([]*Image, error) {
+	req, err := http.NewRequest("GET", registry+"/images/"+imgId+"/history", nil)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(authConfig.Username, authConfig.Password)
-	res, err := client.Do(req)
+	res, err := graph.registryDo(stdout, aborted, req, authConfig)
 	if err != nil || res.StatusCode != 200 {
 		if res != nil {
 			return nil, fmt.Errorf("Internal server error: %d trying to fetch remote history for %s", res.StatusCode, imgId)
@@ -77,10 +258,10 @@ func (graph *Graph) getRemoteHistory(imgId string, authConfig *auth.AuthConfig)
 }
 
 // Check if an image exists in the Registry
-func (graph *Graph) LookupRemoteImage(imgId string, authConfig *auth.AuthConfig) bool {
-	rt := &http.Transport{Proxy: http.ProxyFromEnvironment}
+func (graph *Graph) LookupRemoteImage(imgId, registry string, authConfig *auth.AuthConfig) bool {
+	rt := graph.registryTransport()
 
-	req, err := http.NewRequest("GET", REGISTRY_ENDPOINT+"/images/"+imgId+"/json", nil)
+	req, err := http.NewRequest("GET", registry+"/images/"+imgId+"/json", nil)
 	if err != nil {
 		return false
 	}
@@ -92,101 +273,374 @@ func (graph *Graph) LookupRemoteImage(imgId string, authConfig *auth.AuthConfig)
 	return res.StatusCode == 307
 }
 
-// Retrieve an image from the Registry.
-// Returns the Image object as well as the layer as an Archive (io.Reader)
-func (graph *Graph) getRemoteImage(stdout io.Writer, imgId string, authConfig *auth.AuthConfig) (*Image, Archive, error) {
-	client := &http.Client{}
-
+// Retrieve the metadata of an image from the Registry. It is checked
+// against the signed digest expectedDigest, unless it is empty.
+func (graph *Graph) getRemoteImage(stdout io.Writer, aborted <-chan struct{}, imgId, registry string, authConfig *auth.AuthConfig, expectedDigest string) (*Image, error) {
 	fmt.Fprintf(stdout, "Pulling %s metadata\n", imgId)
 	// Get the Json
-	req, err := http.NewRequest("GET", REGISTRY_ENDPOINT+"/images/"+imgId+"/json", nil)
+	req, err := http.NewRequest("GET", registry+"/images/"+imgId+"/json", nil)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to download json: %s", err)
+		return nil, fmt.Errorf("Failed to download json: %s", err)
 	}
-	req.SetBasicAuth(authConfig.Username, authConfig.Password)
-	res, err := client.Do(req)
+	res, err := graph.registryDo(stdout, aborted, req, authConfig)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to download json: %s", err)
+		return nil, fmt.Errorf("Failed to download json: %s", err)
 	}
+	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return nil, nil, fmt.Errorf("HTTP code %d", res.StatusCode)
+		return nil, fmt.Errorf("HTTP code %d", res.StatusCode)
 	}
-	defer res.Body.Close()
 
 	jsonString, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to download json: %s", err)
+		return nil, fmt.Errorf("Failed to download json: %s", err)
+	}
+	if expectedDigest != "" && jsonDigest(jsonString) != expectedDigest {
+		return nil, fmt.Errorf("The metadata of %s doesn't match its signature", imgId)
 	}
 
 	img, err := NewImgJson(jsonString)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to parse json: %s", err)
+		return nil, fmt.Errorf("Failed to parse json: %s", err)
 	}
 	img.Id = imgId
+	return img, nil
+}
 
-	// Get the layer
-	fmt.Fprintf(stdout, "Pulling %s fs layer\n", imgId)
-	req, err = http.NewRequest("GET", REGISTRY_ENDPOINT+"/images/"+imgId+"/layer", nil)
+// Download the layer of an image from the Registry into a temporary file,
+// and return that file rewound to its start.
+// Interrupted downloads are retried up to graph.DownloadRetries times, waiting
+// twice as long before each new attempt. Every attempt (as well as a later
+// pull of the same image) resumes from the data already downloaded.
+func (graph *Graph) downloadLayer(stdout io.Writer, aborted <-chan struct{}, imgId, registry string, authConfig *auth.AuthConfig) (*os.File, error) {
+	return graph.download(stdout, aborted, imgId, registry+"/images/"+imgId+"/layer", func(req *http.Request) (*http.Response, error) {
+		return graph.registryDo(stdout, aborted, req, authConfig)
+	})
+}
+
+// Download the layer of imgId from url, sending the requests with do. See
+// downloadLayer.
+func (graph *Graph) download(stdout io.Writer, aborted <-chan struct{}, imgId, url string, do func(*http.Request) (*http.Response, error)) (*os.File, error) {
+	downloads, err := graph.downloadsDir()
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error while getting from the server: %s\n", err)
+		return nil, err
 	}
-	req.SetBasicAuth(authConfig.Username, authConfig.Password)
-	res, err = client.Do(req)
+	layerFile, err := os.OpenFile(path.Join(downloads, imgId), os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return img, res.Body, nil
+	fmt.Fprintf(stdout, "Pulling %s fs layer\n", imgId)
+	delay := graph.DownloadRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := graph.downloadAttempt(stdout, aborted, layerFile, imgId, url, do)
+		if err == nil {
+			break
+		}
+		if isAborted(aborted) {
+			layerFile.Close()
+			return nil, ErrAborted
+		}
+		if attempt > graph.DownloadRetries {
+			layerFile.Close()
+			return nil, err
+		}
+		fmt.Fprintf(stdout, "%s: Download failed (%s), retrying in %s (%d/%d)\n", Trunc(imgId, 12), err, delay, attempt, graph.DownloadRetries)
+		if err := sleepAbortable(aborted, delay); err != nil {
+			layerFile.Close()
+			return nil, err
+		}
+		delay *= 2
+	}
+	if _, err := layerFile.Seek(0, 0); err != nil {
+		layerFile.Close()
+		return nil, err
+	}
+	return layerFile, nil
 }
 
-func (graph *Graph) PullImage(stdout io.Writer, imgId string, authConfig *auth.AuthConfig) error {
-	history, err := graph.getRemoteHistory(imgId, authConfig)
+// Append the missing part of a layer to layerFile, using a Range request if
+// part of it was already downloaded.
+func (graph *Graph) downloadAttempt(stdout io.Writer, aborted <-chan struct{}, layerFile *os.File, imgId, url string, do func(*http.Request) (*http.Response, error)) error {
+	offset, err := layerFile.Seek(0, 2)
 	if err != nil {
 		return err
 	}
-	// FIXME: Try to stream the images?
-	// FIXME: Lunch the getRemoteImage() in goroutines
-	for _, j := range history {
-		if !graph.Exists(j.Id) {
-			img, layer, err := graph.getRemoteImage(stdout, j.Id, authConfig)
-			if err != nil {
-				// FIXME: Keep goging in case of error?
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("Error while getting from the server: %s\n", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	req.Cancel = aborted
+	res, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		// The server sent the whole layer, start over
+		if offset > 0 {
+			if err := layerFile.Truncate(0); err != nil {
 				return err
 			}
-			if err = graph.Register(layer, img); err != nil {
+			if _, err := layerFile.Seek(0, 0); err != nil {
 				return err
 			}
+			offset = 0
 		}
+	case 206:
+		registryLog.Debugf("Resuming download of %s at byte %d", imgId, offset)
+	case 416:
+		// The range starts at the end of the layer: we already have all of it
+		return nil
+	default:
+		return fmt.Errorf("HTTP code %d while downloading layer %s", res.StatusCode, imgId)
+	}
+	progress := LineProgressReader(res.Body, int(offset+res.ContentLength), stdout, Trunc(imgId, 12)+": Downloading")
+	progress.readProgress = int(offset)
+	progress.lastUpdate = int(offset)
+	n, err := io.Copy(layerFile, progress)
+	if err != nil {
+		return err
+	}
+	if res.ContentLength >= 0 && n != res.ContentLength {
+		return fmt.Errorf("Truncated download of layer %s (%d bytes of %d)", imgId, n, res.ContentLength)
 	}
 	return nil
 }
 
-// FIXME: Handle the askedTag parameter
-func (graph *Graph) PullRepository(stdout io.Writer, remote, askedTag string, repositories *TagStore, authConfig *auth.AuthConfig) error {
-	client := &http.Client{}
+func (graph *Graph) PullImage(stdout io.Writer, aborted <-chan struct{}, imgId, registry string, authConfig *auth.AuthConfig) error {
+	// Only the tags are signed
+	if graph.contentTrust {
+		return fmt.Errorf("Content trust is enforced: %s can only be pulled by tag", imgId)
+	}
+	return graph.pullImage(stdout, aborted, imgId, registry, authConfig, nil)
+}
 
-	fmt.Fprintf(stdout, "Pulling repository %s\n", remote)
+// pullImage pulls an image and its parents. If signed isn't nil, it holds
+// the signed layers of the history, which must match it.
+func (graph *Graph) pullImage(stdout io.Writer, aborted <-chan struct{}, imgId, registry string, authConfig *auth.AuthConfig, signed map[string]ManifestLayer) error {
+	history, err := graph.getRemoteHistory(stdout, aborted, imgId, registry, authConfig)
+	if err != nil {
+		return err
+	}
+	if signed != nil {
+		if len(history) != len(signed) {
+			return fmt.Errorf("The history of %s doesn't match its signature", imgId)
+		}
+		for _, img := range history {
+			if _, exists := signed[img.Id]; !exists {
+				return fmt.Errorf("The history of %s doesn't match its signature", imgId)
+			}
+		}
+	}
+	ids := make([]string, len(history))
+	for i, img := range history {
+		ids[len(history)-1-i] = img.Id
+	}
+	return graph.pullLayers(stdout, aborted, ids, func(i int, parentRegistered func() error) error {
+		return graph.pullLayer(stdout, aborted, ids[i], registry, authConfig, signed[ids[i]], parentRegistered)
+	})
+}
+
+// pullLayers pulls the images ids, each one the parent of the next, with
+// pull. Their layers are downloaded concurrently, a few at a time, but pull
+// must call parentRegistered before registering an image: the parents are
+// registered first, so that an interrupted pull never leaves an image
+// without its parents.
+func (graph *Graph) pullLayers(stdout io.Writer, aborted <-chan struct{}, ids []string, pull func(i int, parentRegistered func() error) error) error {
+	workers := make(chan bool, maxConcurrentDownloads)
+	errs := make([]error, len(ids))
+	registered := make([]chan struct{}, len(ids))
+	for i := range ids {
+		registered[i] = make(chan struct{})
+	}
+	for i := range ids {
+		go func(i int) {
+			defer close(registered[i])
+			errs[i] = graph.pullOnce(stdout, aborted, ids[i], func() error {
+				select {
+				case workers <- true:
+				case <-aborted:
+					return ErrAborted
+				}
+				downloading := true
+				release := func() {
+					if downloading {
+						downloading = false
+						<-workers
+					}
+				}
+				defer release()
+				return pull(i, func() error {
+					// Let the other layers download meanwhile
+					release()
+					if i == 0 {
+						return nil
+					}
+					<-registered[i-1]
+					return errs[i-1]
+				})
+			})
+		}(i)
+	}
+	for i := range ids {
+		<-registered[i]
+		if errs[i] != nil {
+			// The images after it fail as well
+			for _, done := range registered[i+1:] {
+				<-done
+			}
+			return errs[i]
+		}
+	}
+	return nil
+}
+
+// Download and register a single image, once its parent is registered. The
+// image is checked against its signed layer, unless it isn't signed.
+func (graph *Graph) pullLayer(stdout io.Writer, aborted <-chan struct{}, imgId, registry string, authConfig *auth.AuthConfig, signed ManifestLayer, parentRegistered func() error) error {
+	expectedDigest := signed.JsonDigest
+	if signed.TarSum != "" && expectedDigest == "" {
+		return fmt.Errorf("The signature of %s doesn't cover its metadata", imgId)
+	}
+	img, err := graph.getRemoteImage(stdout, aborted, imgId, registry, authConfig, expectedDigest)
+	if err != nil {
+		return err
+	}
+	layer, err := graph.downloadLayer(stdout, aborted, imgId, registry, authConfig)
+	if err != nil {
+		return err
+	}
+	// Once the download is complete, the temporary file is not reused,
+	// even if the layer turns out to be corrupted
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+	if err := parentRegistered(); err != nil {
+		return err
+	}
+	// Stop extracting the layer if the pull is aborted
+	var layerData Archive = &abortableReader{layer, aborted}
+	if signed.TarSum == "" {
+		return graph.Register(layerData, img)
+	}
+	verifier := newLayerVerifier(layerData, tarSum)
+	defer verifier.Close()
+	return graph.register(verifier, img, func() error {
+		if sum, err := verifier.Sum(); err != nil {
+			return err
+		} else if sum != signed.TarSum {
+			return fmt.Errorf("The layer of %s doesn't match its signature", imgId)
+		}
+		return nil
+	})
+}
+
+// layerVerifier computes the checksum of a layer while it is read, so that
+// the layer is only read once when it is extracted and checked
+type layerVerifier struct {
+	io.Reader
+	pipe   *io.PipeWriter
+	result chan layerSum
+}
+
+type layerSum struct {
+	sum string
+	err error
+}
+
+func newLayerVerifier(layer io.Reader, checksum func(Archive) (string, error)) *layerVerifier {
+	r, w := io.Pipe()
+	v := &layerVerifier{Reader: io.TeeReader(layer, w), pipe: w, result: make(chan layerSum, 1)}
+	go func() {
+		sum, err := checksum(r)
+		// Keep the extraction going if the checksum failed early
+		io.Copy(ioutil.Discard, r)
+		v.result <- layerSum{sum, err}
+	}()
+	return v
+}
+
+// Sum reads the rest of the layer, eg. the padding the extraction skipped,
+// and returns its checksum
+func (v *layerVerifier) Sum() (string, error) {
+	if _, err := io.Copy(ioutil.Discard, v.Reader); err != nil {
+		return "", err
+	}
+	v.pipe.Close()
+	result := <-v.result
+	return result.sum, result.err
+}
+
+// Close stops the computation of the checksum, if Sum wasn't called
+func (v *layerVerifier) Close() error {
+	return v.pipe.Close()
+}
+
+// Run pull to download and register imgId, unless it already exists.
+// If another pull is already downloading the same image, wait for it to
+// complete instead of downloading the layer twice.
+func (graph *Graph) pullOnce(stdout io.Writer, aborted <-chan struct{}, imgId string, pull func() error) error {
+	var done chan struct{}
+	for {
+		graph.pullingLock.Lock()
+		if graph.Exists(imgId) {
+			graph.pullingLock.Unlock()
+			return nil
+		}
+		pending, exists := graph.pulling[imgId]
+		if !exists {
+			done = make(chan struct{})
+			graph.pulling[imgId] = done
+			graph.pullingLock.Unlock()
+			break
+		}
+		graph.pullingLock.Unlock()
+		fmt.Fprintf(stdout, "%s: Waiting for concurrent download\n", Trunc(imgId, 12))
+		select {
+		case <-pending:
+		case <-aborted:
+			return ErrAborted
+		}
+		// The other download might have failed: check again
+	}
+	defer func() {
+		graph.pullingLock.Lock()
+		delete(graph.pulling, imgId)
+		graph.pullingLock.Unlock()
+		close(done)
+	}()
+	return pull()
+}
+
+// Pull a repository from the registry and tag its images locally as `local`.
+// `remote` is the name of the repository on the registry.
+// FIXME: Handle the askedTag parameter
+func (graph *Graph) PullRepository(stdout io.Writer, aborted <-chan struct{}, remote, local, askedTag, registry string, repositories *TagStore, authConfig *auth.AuthConfig) error {
+	fmt.Fprintf(stdout, "Pulling repository %s from %s\n", local, registry)
 
 	var repositoryTarget string
 	// If we are asking for 'root' repository, lookup on the Library's registry
 	if strings.Index(remote, "/") == -1 {
-		repositoryTarget = REGISTRY_ENDPOINT + "/library/" + remote
+		repositoryTarget = registry + "/library/" + remote
 	} else {
-		repositoryTarget = REGISTRY_ENDPOINT + "/users/" + remote
+		repositoryTarget = registry + "/users/" + remote
 	}
 
 	req, err := http.NewRequest("GET", repositoryTarget, nil)
 	if err != nil {
 		return err
 	}
-	req.SetBasicAuth(authConfig.Username, authConfig.Password)
-	res, err := client.Do(req)
+	res, err := graph.registryDo(stdout, aborted, req, authConfig)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != 200 {
 		return fmt.Errorf("HTTP code: %d", res.StatusCode)
 	}
-	defer res.Body.Close()
 	rawJson, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return err
@@ -195,24 +649,178 @@ func (graph *Graph) PullRepository(stdout io.Writer, remote, askedTag string, re
 	if err = json.Unmarshal(rawJson, &t); err != nil {
 		return err
 	}
+	// Pull the tags concurrently, a few at a time. Layers shared by several
+	// tags are only downloaded once (see pullLayer).
+	type pullResult struct {
+		tag, rev string
+		err      error
+	}
+	workers := make(chan bool, maxConcurrentDownloads)
+	results := make(chan pullResult, len(t))
 	for tag, rev := range t {
-		fmt.Fprintf(stdout, "Pulling tag %s:%s\n", remote, tag)
-		if err = graph.PullImage(stdout, rev, authConfig); err != nil {
+		go func(tag, rev string) {
+			workers <- true
+			defer func() { <-workers }()
+			fmt.Fprintf(stdout, "Pulling tag %s:%s\n", local, tag)
+			signed, err := graph.verifyTag(stdout, aborted, repositoryTarget, remote, local, tag, rev, authConfig)
+			if err == nil {
+				err = graph.pullImage(stdout, aborted, rev, registry, authConfig, signed)
+			}
+			results <- pullResult{tag, rev, err}
+		}(tag, rev)
+	}
+	var pullErr error
+	for i := 0; i < len(t); i++ {
+		result := <-results
+		if result.err != nil {
+			fmt.Fprintf(stdout, "Error pulling tag %s:%s: %s\n", local, result.tag, result.err)
+			if pullErr == nil {
+				pullErr = result.err
+			}
+			continue
+		}
+		if err := repositories.Set(local, result.tag, result.rev, true); err != nil && pullErr == nil {
+			pullErr = err
+		}
+	}
+	if pullErr != nil {
+		return pullErr
+	}
+	if err = repositories.Save(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getManifest returns the signed manifest of a tag of a repository, or nil
+// if the tag isn't signed
+func (graph *Graph) getManifest(stdout io.Writer, aborted <-chan struct{}, repositoryTarget, tag string, authConfig *auth.AuthConfig) (*ImageManifest, error) {
+	req, err := http.NewRequest("GET", repositoryTarget+"/"+tag+"/signature", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := graph.registryDo(stdout, aborted, req, authConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, nil
+	} else if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP code %d while fetching the signature of %s", res.StatusCode, tag)
+	}
+	manifest := &ImageManifest{}
+	if err := json.NewDecoder(res.Body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("Invalid signature of %s: %s", tag, err)
+	}
+	return manifest, nil
+}
+
+// signsTags returns whether the tags pushed are signed, once the daemon has
+// a signing key. Only v1 exchanges the signatures.
+func (graph *Graph) signsTags() bool {
+	return graph.trust != nil && graph.trust.HasSigningKey()
+}
+
+// verifiesTags returns whether the signatures of the tags pulled are
+// verified, once the daemon trusts keys. Only v1 exchanges the signatures.
+func (graph *Graph) verifiesTags() bool {
+	if graph.trust == nil {
+		return false
+	}
+	keys, err := graph.trust.Keys()
+	return err != nil || len(keys) > 0
+}
+
+// verifyTag checks the signature of remote:tag pointing to rev, and returns
+// the signed layers of its images. Without a trusted signature, the tag is
+// refused if content trust is enforced, and pulled unverified otherwise.
+func (graph *Graph) verifyTag(stdout io.Writer, aborted <-chan struct{}, repositoryTarget, remote, local, tag, rev string, authConfig *auth.AuthConfig) (map[string]ManifestLayer, error) {
+	if graph.trust == nil {
+		return nil, nil
+	}
+	manifest, err := graph.getManifest(stdout, aborted, repositoryTarget, tag, authConfig)
+	if err != nil {
+		if graph.contentTrust {
+			return nil, err
+		}
+		fmt.Fprintf(stdout, "Warning: the signature of %s:%s can't be fetched, it isn't verified: %s\n", local, tag, err)
+		return nil, nil
+	}
+	if manifest == nil {
+		if graph.contentTrust {
+			return nil, fmt.Errorf("Content trust is enforced: %s:%s isn't signed", local, tag)
+		}
+		return nil, nil
+	}
+	key, err := graph.trust.Verify(manifest, remote, tag)
+	if err != nil {
+		if graph.contentTrust {
+			return nil, err
+		}
+		fmt.Fprintf(stdout, "Warning: %s:%s isn't signed by a trusted key, it isn't verified\n", local, tag)
+		return nil, nil
+	}
+	if len(manifest.Layers) == 0 || manifest.Layers[0].Id != rev {
+		return nil, fmt.Errorf("The signature of %s:%s doesn't match its image", local, tag)
+	}
+	fmt.Fprintf(stdout, "%s:%s is signed by %s\n", local, tag, key.Name)
+	return manifest.layers(), nil
+}
+
+// pushManifest signs the image of a tag with the key of the daemon, and
+// pushes the signature
+func (graph *Graph) pushManifest(stdout io.Writer, aborted <-chan struct{}, remote, tag string, img *Image, registry string, authConfig *auth.AuthConfig) error {
+	key, err := graph.trust.SigningKey()
+	if err != nil {
+		return err
+	}
+	manifest := &ImageManifest{Name: remote, Tag: tag}
+	if err := img.WalkHistory(func(img *Image) error {
+		layer, err := graph.TarLayer(img.Id, Uncompressed)
+		if err != nil {
 			return err
 		}
-		if err = repositories.Set(remote, tag, rev, true); err != nil {
+		sum, err := tarSum(layer)
+		if err != nil {
+			return err
+		}
+		jsonRaw, err := ioutil.ReadFile(path.Join(graph.Root, img.Id, "json"))
+		if err != nil {
 			return err
 		}
+		manifest.Layers = append(manifest.Layers, ManifestLayer{Id: img.Id, TarSum: sum, JsonDigest: jsonDigest(jsonRaw)})
+		return nil
+	}); err != nil {
+		return err
 	}
-	if err = repositories.Save(); err != nil {
+	if err := manifest.Sign(key); err != nil {
+		return err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Signing tag %s:%s\n", remote, tag)
+	req, err := http.NewRequest("PUT", registry+"/users/"+remote+"/"+tag+"/signature", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-type", "application/json")
+	res, err := graph.registryDo(stdout, aborted, req, authConfig)
+	if err != nil {
 		return err
 	}
+	res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return fmt.Errorf("HTTP code %d while pushing the signature of %s:%s", res.StatusCode, remote, tag)
+	}
 	return nil
 }
 
 // Push a local image to the registry with its history if needed
-func (graph *Graph) PushImage(stdout io.Writer, imgOrig *Image, authConfig *auth.AuthConfig) error {
-	client := &http.Client{}
+func (graph *Graph) PushImage(stdout io.Writer, aborted <-chan struct{}, imgOrig *Image, registry string, authConfig *auth.AuthConfig) error {
+	client := graph.registryClient()
 
 	// FIXME: Factorize the code
 	// FIXME: Do the puts in goroutines
@@ -227,13 +835,12 @@ func (graph *Graph) PushImage(stdout io.Writer, imgOrig *Image, authConfig *auth
 
 		// FIXME: try json with UTF8
 		jsonData := strings.NewReader(string(jsonRaw))
-		req, err := http.NewRequest("PUT", REGISTRY_ENDPOINT+"/images/"+img.Id+"/json", jsonData)
+		req, err := http.NewRequest("PUT", registry+"/images/"+img.Id+"/json", jsonData)
 		if err != nil {
 			return err
 		}
 		req.Header.Add("Content-type", "application/json")
-		req.SetBasicAuth(authConfig.Username, authConfig.Password)
-		res, err := client.Do(req)
+		res, err := graph.registryDo(stdout, aborted, req, authConfig)
 		if err != nil {
 			return fmt.Errorf("Failed to upload metadata: %s", err)
 		}
@@ -253,9 +860,11 @@ func (graph *Graph) PushImage(stdout io.Writer, imgOrig *Image, authConfig *auth
 		}
 
 		fmt.Fprintf(stdout, "Pushing %s fs layer\n", img.Id)
-		req2, err := http.NewRequest("PUT", REGISTRY_ENDPOINT+"/images/"+img.Id+"/layer", nil)
-		req2.SetBasicAuth(authConfig.Username, authConfig.Password)
-		res2, err := client.Do(req2)
+		req2, err := http.NewRequest("PUT", registry+"/images/"+img.Id+"/layer", nil)
+		if err != nil {
+			return err
+		}
+		res2, err := graph.registryDo(stdout, aborted, req2, authConfig)
 		if err != nil || res2.StatusCode != 307 {
 			return fmt.Errorf("Registry returned error: %s", err)
 		}
@@ -264,24 +873,25 @@ func (graph *Graph) PushImage(stdout io.Writer, imgOrig *Image, authConfig *auth
 			return fmt.Errorf("Failed to retrieve layer upload location: %s", err)
 		}
 
-		// FIXME: Don't do this :D. Check the S3 requierement and implement chunks of 5MB
-		// FIXME2: I won't stress it enough, DON'T DO THIS! very high priority
-		layerData2, err := Tar(path.Join(graph.Root, img.Id, "layer"), Gzip)
-		layerData, err := Tar(path.Join(graph.Root, img.Id, "layer"), Gzip)
+		// The upload needs the length of the layer: the archive is made
+		// twice, to count its bytes, then to stream it to the registry,
+		// rather than being held in memory
+		size, err := graph.layerArchiveSize(img.Id)
 		if err != nil {
 			return fmt.Errorf("Failed to generate layer archive: %s", err)
 		}
-		req3, err := http.NewRequest("PUT", url.String(), layerData)
+		layerData, err := graph.TarLayer(img.Id, Gzip)
 		if err != nil {
-			return err
+			return fmt.Errorf("Failed to generate layer archive: %s", err)
 		}
-		tmp, err := ioutil.ReadAll(layerData2)
+		req3, err := http.NewRequest("PUT", url.String(), layerData)
 		if err != nil {
 			return err
 		}
-		req3.ContentLength = int64(len(tmp))
+		req3.ContentLength = size
 
 		req3.TransferEncoding = []string{"none"}
+		req3.Cancel = aborted
 		res3, err := client.Do(req3)
 		if err != nil {
 			return fmt.Errorf("Failed to upload layer: %s", err)
@@ -298,7 +908,7 @@ func (graph *Graph) PushImage(stdout io.Writer, imgOrig *Image, authConfig *auth
 
 // push a tag on the registry.
 // Remote has the format '<user>/<repo>
-func (graph *Graph) pushTag(remote, revision, tag string, authConfig *auth.AuthConfig) error {
+func (graph *Graph) pushTag(stdout io.Writer, aborted <-chan struct{}, remote, revision, tag, registry string, authConfig *auth.AuthConfig) error {
 
 	// Keep this for backward compatibility
 	if tag == "" {
@@ -308,20 +918,21 @@ func (graph *Graph) pushTag(remote, revision, tag string, authConfig *auth.AuthC
 	// "jsonify" the string
 	revision = "\"" + revision + "\""
 
-	Debugf("Pushing tags for rev [%s] on {%s}\n", revision, REGISTRY_ENDPOINT+"/users/"+remote+"/"+tag)
+	registryLog.Debugf("Pushing tags for rev [%s] on {%s}\n", revision, registry+"/users/"+remote+"/"+tag)
 
-	client := &http.Client{}
-	req, err := http.NewRequest("PUT", REGISTRY_ENDPOINT+"/users/"+remote+"/"+tag, strings.NewReader(revision))
+	req, err := http.NewRequest("PUT", registry+"/users/"+remote+"/"+tag, strings.NewReader(revision))
+	if err != nil {
+		return err
+	}
 	req.Header.Add("Content-type", "application/json")
-	req.SetBasicAuth(authConfig.Username, authConfig.Password)
-	res, err := client.Do(req)
+	res, err := graph.registryDo(stdout, aborted, req, authConfig)
 	if err != nil || (res.StatusCode != 200 && res.StatusCode != 201) {
 		if res != nil {
 			return fmt.Errorf("Internal server error: %d trying to push tag %s on %s", res.StatusCode, tag, remote)
 		}
 		return err
 	}
-	Debugf("Result of push tag: %d\n", res.StatusCode)
+	registryLog.Debugf("Result of push tag: %d\n", res.StatusCode)
 	switch res.StatusCode {
 	default:
 		return fmt.Errorf("Error %d\n", res.StatusCode)
@@ -331,20 +942,20 @@ func (graph *Graph) pushTag(remote, revision, tag string, authConfig *auth.AuthC
 	return nil
 }
 
-func (graph *Graph) LookupRemoteRepository(remote string, authConfig *auth.AuthConfig) bool {
-	rt := &http.Transport{Proxy: http.ProxyFromEnvironment}
+func (graph *Graph) LookupRemoteRepository(remote, registry string, authConfig *auth.AuthConfig) bool {
+	rt := graph.registryTransport()
 
 	var repositoryTarget string
 	// If we are asking for 'root' repository, lookup on the Library's registry
 	if strings.Index(remote, "/") == -1 {
-		repositoryTarget = REGISTRY_ENDPOINT + "/library/" + remote + "/lookup"
+		repositoryTarget = registry + "/library/" + remote + "/lookup"
 	} else {
-		repositoryTarget = REGISTRY_ENDPOINT + "/users/" + remote + "/lookup"
+		repositoryTarget = registry + "/users/" + remote + "/lookup"
 	}
-	Debugf("Checking for permissions on: %s", repositoryTarget)
+	registryLog.Debugf("Checking for permissions on: %s", repositoryTarget)
 	req, err := http.NewRequest("PUT", repositoryTarget, strings.NewReader("\"\""))
 	if err != nil {
-		Debugf("%s\n", err)
+		registryLog.Debugf("%s\n", err)
 		return false
 	}
 	req.SetBasicAuth(authConfig.Username, authConfig.Password)
@@ -355,14 +966,14 @@ func (graph *Graph) LookupRemoteRepository(remote string, authConfig *auth.AuthC
 		if err != nil {
 			errBody = []byte(err.Error())
 		}
-		Debugf("Lookup status code: %d (body: %s)", res.StatusCode, errBody)
+		registryLog.Debugf("Lookup status code: %d (body: %s)", res.StatusCode, errBody)
 		return false
 	}
 	return true
 }
 
 // FIXME: this should really be PushTag
-func (graph *Graph) pushPrimitive(stdout io.Writer, remote, tag, imgId string, authConfig *auth.AuthConfig) error {
+func (graph *Graph) pushPrimitive(stdout io.Writer, aborted <-chan struct{}, remote, tag, imgId, registry string, authConfig *auth.AuthConfig) error {
 	// Check if the local impage exists
 	img, err := graph.Get(imgId)
 	if err != nil {
@@ -371,32 +982,81 @@ func (graph *Graph) pushPrimitive(stdout io.Writer, remote, tag, imgId string, a
 	}
 	fmt.Fprintf(stdout, "Pushing tag %s:%s\n", remote, tag)
 	// Push the image
-	if err = graph.PushImage(stdout, img, authConfig); err != nil {
+	if err = graph.PushImage(stdout, aborted, img, registry, authConfig); err != nil {
 		return err
 	}
 	fmt.Fprintf(stdout, "Registering tag %s:%s\n", remote, tag)
 	// And then the tag
-	if err = graph.pushTag(remote, imgId, tag, authConfig); err != nil {
+	if err = graph.pushTag(stdout, aborted, remote, imgId, tag, registry, authConfig); err != nil {
 		return err
 	}
+	// The registries without signatures still get the tag, unless content
+	// trust is enforced
+	if graph.trust != nil {
+		if err := graph.pushManifest(stdout, aborted, remote, tag, img, registry, authConfig); err != nil {
+			if graph.contentTrust {
+				return err
+			}
+			fmt.Fprintf(stdout, "Warning: %s:%s isn't signed: %s\n", remote, tag, err)
+		}
+	}
 	return nil
 }
 
 // Push a repository to the registry.
 // Remote has the format '<user>/<repo>
-func (graph *Graph) PushRepository(stdout io.Writer, remote string, localRepo Repository, authConfig *auth.AuthConfig) error {
+func (graph *Graph) PushRepository(stdout io.Writer, aborted <-chan struct{}, remote string, localRepo Repository, registry string, authConfig *auth.AuthConfig) error {
 	// Check if the remote repository exists/if we have the permission
-	if !graph.LookupRemoteRepository(remote, authConfig) {
+	if !graph.LookupRemoteRepository(remote, registry, authConfig) {
 		return fmt.Errorf("Permission denied on repository %s\n", remote)
 	}
 
 	fmt.Fprintf(stdout, "Pushing repository %s (%d tags)\n", remote, len(localRepo))
 	// For each image within the repo, push them
 	for tag, imgId := range localRepo {
-		if err := graph.pushPrimitive(stdout, remote, tag, imgId, authConfig); err != nil {
+		if err := graph.pushPrimitive(stdout, aborted, remote, tag, imgId, registry, authConfig); err != nil {
 			// FIXME: Continue on error?
 			return err
 		}
 	}
 	return nil
 }
+
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	StarCount   int    `json:"star_count"`
+	IsOfficial  bool   `json:"is_official"`
+	IsTrusted   bool   `json:"is_trusted"`
+}
+
+type SearchResults struct {
+	Query      string          `json:"query"`
+	NumResults int             `json:"num_results"`
+	Results    []*SearchResult `json:"results"`
+}
+
+// Search the repositories of the registry matching term
+func (graph *Graph) Search(stdout io.Writer, term, registry string, authConfig *auth.AuthConfig) (*SearchResults, error) {
+	req, err := http.NewRequest("GET", registry+"/search?q="+url.QueryEscape(term), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := graph.registryDo(stdout, nil, req, authConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP code %d while searching for %s", res.StatusCode, term)
+	}
+	rawJson, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	results := &SearchResults{}
+	if err := json.Unmarshal(rawJson, results); err != nil {
+		return nil, fmt.Errorf("Error while parsing the search results: %s", err)
+	}
+	return results, nil
+}
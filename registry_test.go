@@ -0,0 +1,319 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dotcloud/docker/auth"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitReposName(t *testing.T) {
+	for _, test := range []struct {
+		name, hostname, remoteName string
+	}{
+		{"base", "", "base"},
+		{"shykes/base", "", "shykes/base"},
+		{"localhost/base", "localhost", "base"},
+		{"myregistry.example.com:5000/team/app", "myregistry.example.com:5000", "team/app"},
+		{"10.0.0.1:5000/app", "10.0.0.1:5000", "app"},
+	} {
+		hostname, remoteName := splitReposName(test.name)
+		if hostname != test.hostname || remoteName != test.remoteName {
+			t.Errorf("splitReposName(%s): expected (%s, %s), got (%s, %s)",
+				test.name, test.hostname, test.remoteName, hostname, remoteName)
+		}
+	}
+}
+
+func TestParseRepositoryTag(t *testing.T) {
+	for _, test := range []struct {
+		name, repoName, tag string
+	}{
+		{"base", "base", ""},
+		{"base:v1", "base", "v1"},
+		{"localhost:5000/base", "localhost:5000/base", ""},
+		{"localhost:5000/base:v1", "localhost:5000/base", "v1"},
+	} {
+		repoName, tag := parseRepositoryTag(test.name)
+		if repoName != test.repoName || tag != test.tag {
+			t.Errorf("parseRepositoryTag(%s): expected (%s, %s), got (%s, %s)",
+				test.name, test.repoName, test.tag, repoName, tag)
+		}
+	}
+	if err := validateRepoName("localhost:5000/base"); err != nil {
+		t.Error(err)
+	}
+	if err := validateRepoName("base:v1"); err == nil {
+		t.Errorf("base:v1 shouldn't be a valid repository name")
+	}
+	if err := validateRepoName("base@sha256:abc"); err == nil {
+		t.Errorf("base@sha256:abc shouldn't be a valid repository name")
+	}
+}
+
+func TestTagStoreUntag(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := &Image{Id: GenerateId()}
+	if err := graph.Register(testArchive(t), img); err != nil {
+		t.Fatal(err)
+	}
+	other := &Image{Id: GenerateId()}
+	if err := graph.Register(testArchive(t), other); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"app", "team/app", "localhost:5000/my-team/app.web"} {
+		if err := store.Set(name, "latest", img.Id, false); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	for _, name := range []string{"team//app", "-app", "App Server", "team/app@sha256:abc"} {
+		if err := store.Set(name, "latest", img.Id, false); err == nil {
+			t.Errorf("%s shouldn't be a valid repository name", name)
+		}
+	}
+	if err := store.Set("app", "latest", img.Id, false); err != nil {
+		t.Errorf("Setting a tag to the same image doesn't need force: %s", err)
+	}
+	if err := store.Set("app", "latest", other.Id, false); err == nil {
+		t.Errorf("A tag shouldn't be moved without force")
+	}
+	if err := store.Set("app", "latest", other.Id, true); err != nil {
+		t.Error(err)
+	}
+	if err := store.SetDigest("app", digestOf([]byte("manifest")), img.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := store.Untag("app"); err != nil || id != other.Id {
+		t.Errorf("Expected app:latest to point to %s, got %s (%v)", other.Id, id, err)
+	}
+	if _, exists := store.Repositories["app"]; exists {
+		t.Errorf("The repository without tags wasn't removed")
+	}
+	if id, err := store.Untag("app@" + digestOf([]byte("manifest"))); err != nil || id != img.Id {
+		t.Errorf("Expected the digest to point to %s, got %s (%v)", img.Id, id, err)
+	}
+	if _, err := store.Untag("team/app:v1"); err == nil {
+		t.Errorf("Untagging a missing tag should fail")
+	}
+}
+
+func TestDownloadLayerResume(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	graph.DownloadRetryDelay = time.Millisecond
+
+	layer := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Interrupt the first download half way
+			w.Header().Set("Content-Length", fmt.Sprint(len(layer)))
+			w.Write(layer[:len(layer)/2])
+			return
+		}
+		http.ServeContent(w, r, "layer", time.Now(), bytes.NewReader(layer))
+	}))
+	defer server.Close()
+
+	layerFile, err := graph.downloadLayer(ioutil.Discard, nil, "foo", server.URL, &auth.AuthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layerFile.Close()
+	data, err := ioutil.ReadAll(layerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, layer) {
+		t.Fatalf("Downloaded layer is corrupted (%d bytes instead of %d)", len(data), len(layer))
+	}
+	if len(ranges) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(ranges))
+	}
+	if ranges[0] != "" || !strings.HasPrefix(ranges[1], fmt.Sprintf("bytes=%d-", len(layer)/2)) {
+		t.Fatalf("The download wasn't resumed: %v", ranges)
+	}
+}
+
+func TestDownloadLayerAborted(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	// The retries would wait for an hour
+	graph.DownloadRetryDelay = time.Hour
+
+	started := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		w.Header().Set("Content-Length", "10000")
+		w.Write([]byte("01234"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	aborted := make(chan struct{})
+	go func() {
+		<-started
+		close(aborted)
+	}()
+	errors := make(chan error)
+	go func() {
+		_, err := graph.downloadLayer(ioutil.Discard, aborted, "foo", server.URL, &auth.AuthConfig{})
+		errors <- err
+	}()
+	select {
+	case err := <-errors:
+		if err != ErrAborted {
+			t.Fatalf("Expected the download to be aborted, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The download wasn't aborted")
+	}
+}
+
+func TestLayerVerifier(t *testing.T) {
+	layer := bytes.Repeat([]byte("0123456789"), 10000)
+	verifier := newLayerVerifier(bytes.NewReader(layer), sha256Digest)
+	defer verifier.Close()
+	// Only part of the layer is read by the extraction
+	if _, err := io.CopyN(ioutil.Discard, verifier, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if digest, err := verifier.Sum(); err != nil || digest != digestOf(layer) {
+		t.Fatalf("Expected the digest %s, got %s (%v)", digestOf(layer), digest, err)
+	}
+}
+
+func TestPullLayers(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	ids := []string{"base", "middle", "top"}
+	// The layers are all downloading at the same time, and registered from
+	// the oldest
+	var downloading sync.WaitGroup
+	downloading.Add(len(ids))
+	var lock sync.Mutex
+	var order []string
+	err := graph.pullLayers(ioutil.Discard, nil, ids, func(i int, parentRegistered func() error) error {
+		downloading.Done()
+		downloading.Wait()
+		if err := parentRegistered(); err != nil {
+			return err
+		}
+		lock.Lock()
+		order = append(order, ids[i])
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(order, " ") != "base middle top" {
+		t.Errorf("Expected the layers to be registered in order, got %v", order)
+	}
+
+	// The images of a parent which failed aren't registered
+	order = nil
+	err = graph.pullLayers(ioutil.Discard, nil, ids, func(i int, parentRegistered func() error) error {
+		if i == 1 {
+			return fmt.Errorf("Failed")
+		}
+		if err := parentRegistered(); err != nil {
+			return err
+		}
+		lock.Lock()
+		order = append(order, ids[i])
+		lock.Unlock()
+		return nil
+	})
+	if err == nil || err.Error() != "Failed" {
+		t.Errorf("Expected the error of the middle layer, got %v", err)
+	}
+	if strings.Join(order, " ") != "base" {
+		t.Errorf("Only the base layer should be registered, got %v", order)
+	}
+}
+
+func TestPullEndpoints(t *testing.T) {
+	runtime := &Runtime{
+		insecureRegistries: []string{"localhost:5000"},
+		registryMirrors:    []string{mirrorEndpoint("mirror.example.com:5000/"), mirrorEndpoint("http://10.0.0.1")},
+	}
+	endpoints := runtime.pullEndpoints("")
+	expected := []string{"https://mirror.example.com:5000/v1", "http://10.0.0.1/v1", REGISTRY_ENDPOINT}
+	if strings.Join(endpoints, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected endpoints %v, got %v", expected, endpoints)
+	}
+	// Mirrors only apply to the default index
+	if endpoints := runtime.pullEndpoints("localhost:5000"); len(endpoints) != 1 || endpoints[0] != "http://localhost:5000/v1" {
+		t.Fatalf("Expected only http://localhost:5000/v1, got %v", endpoints)
+	}
+}
+
+func TestRegistryDoRetries(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			// Slow down!
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(429)
+		case 2:
+			// Grant a token, which is expired by the next request
+			w.Header().Set("X-Docker-Token", "expired")
+		case 3:
+			if r.Header.Get("Authorization") != "Token expired" {
+				t.Errorf("The granted token wasn't used: %s", r.Header.Get("Authorization"))
+			}
+			w.WriteHeader(401)
+		case 4:
+			if _, _, ok := r.BasicAuth(); !ok {
+				t.Errorf("A new token wasn't requested with the credentials")
+			}
+			w.Header().Set("X-Docker-Token", "fresh")
+		}
+	}))
+	defer server.Close()
+
+	authConfig := &auth.AuthConfig{Username: "ken", Password: "test"}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := graph.registryDo(ioutil.Discard, nil, req, authConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Expected HTTP code 200, got %d", res.StatusCode)
+		}
+	}
+	if requests != 4 {
+		t.Fatalf("Expected 4 requests, got %d", requests)
+	}
+	if authConfig.Token != "fresh" {
+		t.Fatalf("The token wasn't refreshed: %s", authConfig.Token)
+	}
+}
@@ -0,0 +1,1005 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/auth"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Registry protocol v2: a tag points to a manifest, which references the
+// layers of the image and its history by the digests of their blobs. Blobs
+// are content-addressed, so that a layer is pushed once to a registry and
+// mounted from a repository to another instead of being uploaded again.
+
+const (
+	manifestV2MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	// A manifest list points to a manifest per platform
+	manifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	// The config of a manifest is the json of the images of the history,
+	// the base image first, so that they keep their ids
+	historyMediaType = "application/vnd.docker.image.history.v1+json"
+	layerMediaType   = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	// Foreign layers are downloaded from their URLs, and never pushed to a
+	// registry, eg. because their license forbids it
+	foreignLayerMediaType = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// Size of the chunks of the blob uploads
+var blobChunkSize int64 = 5 * 1024 * 1024
+
+type Descriptor struct {
+	MediaType string   `json:"mediaType"`
+	Size      int64    `json:"size"`
+	Digest    string   `json:"digest"`
+	URLs      []string `json:"urls,omitempty"` // Of a foreign layer
+}
+
+type ManifestV2 struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type ManifestList struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	MediaType     string              `json:"mediaType"`
+	Manifests     []ManifestListEntry `json:"manifests"`
+}
+
+type ManifestListEntry struct {
+	Descriptor
+	Platform Platform `json:"platform"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"` // eg. amd64 or arm
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"` // eg. v7 for arm
+}
+
+func (platform *Platform) String() string {
+	if platform.Variant != "" {
+		return platform.OS + "/" + platform.Architecture + "/" + platform.Variant
+	}
+	return platform.OS + "/" + platform.Architecture
+}
+
+// The platform of the daemon, whose manifest is selected in manifest lists
+var daemonPlatform = Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS, Variant: hostVariant()}
+
+// hostVariant returns the variant of the arm CPU of the host, or an empty
+// string for the other architectures
+func hostVariant() string {
+	if runtime.GOARCH != "arm" && runtime.GOARCH != "arm64" {
+		return ""
+	}
+	cpuinfo, _ := ioutil.ReadFile("/proc/cpuinfo")
+	return cpuVariant(runtime.GOARCH, string(cpuinfo))
+}
+
+// cpuVariant returns the variant of arch according to cpuinfo, the content
+// of /proc/cpuinfo: v8 for arm64, and the CPU architecture for arm, eg. v7
+func cpuVariant(arch, cpuinfo string) string {
+	if arch == "arm64" {
+		return "v8"
+	}
+	if arch != "arm" {
+		return ""
+	}
+	for _, line := range strings.Split(cpuinfo, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "CPU architecture" {
+			continue
+		}
+		switch version := strings.TrimSpace(parts[1]); {
+		case version == "AArch64":
+			return "v8"
+		case version != "" && version[0] >= '5' && version[0] <= '8':
+			return "v" + version[:1]
+		}
+	}
+	return ""
+}
+
+// match returns the entry of the list for the architecture, the os and the
+// variant of platform, or nil. When platform has a variant, the entries of
+// another variant don't match, and those without variant match only if
+// none has the variant of platform.
+func (list *ManifestList) match(platform Platform) *ManifestListEntry {
+	var match *ManifestListEntry
+	for i, entry := range list.Manifests {
+		if entry.Platform.Architecture != platform.Architecture || entry.Platform.OS != platform.OS {
+			continue
+		}
+		if platform.Variant == "" || entry.Platform.Variant == platform.Variant {
+			return &list.Manifests[i]
+		}
+		if entry.Platform.Variant == "" && match == nil {
+			match = &list.Manifests[i]
+		}
+	}
+	return match
+}
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// sha256Digest returns the digest of the data read from r
+func sha256Digest(r Archive) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Split name@sha256:... into the name and the digest of a manifest. The
+// digest is empty if there is none.
+func splitDigest(remoteName string) (name, digest string) {
+	if i := strings.Index(remoteName, "@"); i >= 0 {
+		return remoteName[:i], remoteName[i+1:]
+	}
+	return remoteName, ""
+}
+
+// registryV2 is a pull or a push with a registry speaking the v2 protocol
+type registryV2 struct {
+	graph      *Graph
+	endpoint   string // eg. https://registry.example.com/v2
+	authConfig *auth.AuthConfig
+	aborted    <-chan struct{} // Closed when the pull or the push is aborted
+	// Bearer token granted by the authentication server of the registry
+	token     string
+	tokenLock sync.Mutex
+}
+
+// negotiateV2 returns a v2 session with the registry of the v1 endpoint
+// registry if it speaks the v2 protocol, or nil to fall back to v1.
+// Signatures are only exchanged with v1, so when content trust is enforced
+// the v1 protocol is always used, and the callers keep to it as well when
+// the tags are signed or verified (see signsTags and verifiesTags). The
+// requests of the session are
+// cancelled once aborted is closed.
+func (graph *Graph) negotiateV2(stdout io.Writer, aborted <-chan struct{}, registry string, authConfig *auth.AuthConfig) *registryV2 {
+	if graph.contentTrust {
+		return nil
+	}
+	r := &registryV2{
+		graph:      graph,
+		endpoint:   strings.TrimSuffix(registry, "/v1") + "/v2",
+		authConfig: authConfig,
+		aborted:    aborted,
+	}
+	req, err := http.NewRequest("GET", r.endpoint+"/", nil)
+	if err != nil {
+		return nil
+	}
+	res, err := r.do(stdout, req)
+	if err != nil {
+		registryLog.Debugf("%s doesn't speak the v2 protocol: %s", registry, err)
+		return nil
+	}
+	res.Body.Close()
+	if res.Header.Get("Docker-Distribution-API-Version") != "registry/2.0" || (res.StatusCode != 200 && res.StatusCode != 401) {
+		registryLog.Debugf("%s doesn't speak the v2 protocol: HTTP code %d", registry, res.StatusCode)
+		return nil
+	}
+	registryLog.Debugf("Using the v2 protocol with %s", r.endpoint)
+	return r
+}
+
+// The official images of the index are in the library namespace
+func (r *registryV2) repositoryName(remote string) string {
+	if !strings.Contains(remote, "/") {
+		return "library/" + remote
+	}
+	return remote
+}
+
+// do sends a request to the registry. When the registry asks for a bearer
+// token, it is requested from its authentication server with the
+// credentials, and the request is sent again with it. Requests rejected
+// because of rate limiting are sent again, like with v1.
+func (r *registryV2) do(stdout io.Writer, req *http.Request) (*http.Response, error) {
+	return r.doScoped(stdout, req)
+}
+
+// doScoped sends a request like do, and requests the token with the
+// additional scopes, eg. to read the repository a blob is mounted from
+func (r *registryV2) doScoped(stdout io.Writer, req *http.Request, scopes ...string) (*http.Response, error) {
+	client := r.graph.registryClient()
+	req.Cancel = r.aborted
+	authenticated := false
+	for attempt := 1; ; attempt++ {
+		r.tokenLock.Lock()
+		token := r.token
+		r.tokenLock.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if r.authConfig.Username != "" {
+			req.SetBasicAuth(r.authConfig.Username, r.authConfig.Password)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		challenge := res.Header.Get("WWW-Authenticate")
+		switch {
+		case res.StatusCode == 401 && strings.HasPrefix(challenge, "Bearer ") && !authenticated && rewindRequest(req):
+			res.Body.Close()
+			if err := r.authenticate(stdout, challenge, scopes); err != nil {
+				return nil, err
+			}
+			authenticated = true
+			continue
+		case res.StatusCode == 429:
+			if err := r.graph.waitRateLimit(stdout, r.aborted, req, res, attempt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return res, nil
+	}
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Parse the parameters of a challenge, eg.
+// Bearer realm="https://auth.example.com/token",service="registry",scope="..."
+func parseChallenge(challenge string) map[string]string {
+	params := make(map[string]string)
+	for _, match := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	return params
+}
+
+// authenticate requests a bearer token answering challenge, with the
+// additional scopes
+func (r *registryV2) authenticate(stdout io.Writer, challenge string, scopes []string) error {
+	params := parseChallenge(challenge)
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("Invalid authentication challenge: %s", challenge)
+	}
+	query := realm.Query()
+	for _, param := range []string{"service", "scope"} {
+		if params[param] != "" {
+			query.Set(param, params[param])
+		}
+	}
+	for _, scope := range scopes {
+		query.Add("scope", scope)
+	}
+	if r.authConfig.Username != "" {
+		query.Set("account", r.authConfig.Username)
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.authConfig.Username != "" {
+		req.SetBasicAuth(r.authConfig.Username, r.authConfig.Password)
+	}
+	res, err := r.graph.registryClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("HTTP code %d while authenticating with %s", res.StatusCode, realm.Host)
+	}
+	var response struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("Invalid token from %s: %s", realm.Host, err)
+	}
+	r.tokenLock.Lock()
+	defer r.tokenLock.Unlock()
+	if r.token = response.Token; r.token == "" {
+		r.token = response.AccessToken
+	}
+	return nil
+}
+
+// getManifest returns the manifest of a tag or a digest, with its digest.
+// A manifest list is resolved to the manifest of the platform of the
+// daemon, which is returned too. The digest is then the one of the list.
+func (r *registryV2) getManifest(stdout io.Writer, name, reference string) (*ManifestV2, string, *Platform, error) {
+	data, mediaType, err := r.fetchManifest(stdout, name, reference)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	digest := digestOf(data)
+	var platform *Platform
+	if mediaType == manifestListMediaType {
+		list := &ManifestList{}
+		if err := json.Unmarshal(data, list); err != nil {
+			return nil, "", nil, fmt.Errorf("Invalid manifest list of %s:%s: %s", name, reference, err)
+		}
+		entry := list.match(daemonPlatform)
+		if entry == nil {
+			return nil, "", nil, fmt.Errorf("%s:%s has no manifest for %s", name, reference, daemonPlatform.String())
+		}
+		if data, mediaType, err = r.fetchManifest(stdout, name, entry.Digest); err != nil {
+			return nil, "", nil, err
+		}
+		if mediaType == manifestListMediaType {
+			return nil, "", nil, fmt.Errorf("The manifest list of %s:%s is nested", name, reference)
+		}
+		platform = &entry.Platform
+	}
+	manifest := &ManifestV2{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, "", nil, fmt.Errorf("Invalid manifest of %s:%s: %s", name, reference, err)
+	}
+	if manifest.SchemaVersion != 2 || manifest.Config.MediaType != historyMediaType {
+		return nil, "", nil, fmt.Errorf("Unsupported manifest of %s:%s (schema version %d, config %s)", name, reference, manifest.SchemaVersion, manifest.Config.MediaType)
+	}
+	return manifest, digest, platform, nil
+}
+
+// fetchManifest returns a manifest or a manifest list, with its media type
+func (r *registryV2) fetchManifest(stdout io.Writer, name, reference string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", r.endpoint+"/"+name+"/manifests/"+reference, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", manifestV2MediaType+", "+manifestListMediaType)
+	res, err := r.do(stdout, req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, "", fmt.Errorf("No such manifest: %s:%s", name, reference)
+	} else if res.StatusCode != 200 {
+		return nil, "", fmt.Errorf("HTTP code %d while fetching the manifest of %s:%s", res.StatusCode, name, reference)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if strings.HasPrefix(reference, "sha256:") && reference != digestOf(data) {
+		return nil, "", fmt.Errorf("The manifest of %s@%s doesn't match its digest", name, reference)
+	}
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(data, &versioned); err != nil {
+		return nil, "", fmt.Errorf("Invalid manifest of %s:%s: %s", name, reference, err)
+	}
+	if versioned.MediaType == "" {
+		versioned.MediaType = res.Header.Get("Content-Type")
+	}
+	return data, versioned.MediaType, nil
+}
+
+// getHistory returns the images of the config blob of a manifest, the
+// base image first
+func (r *registryV2) getHistory(stdout io.Writer, name string, manifest *ManifestV2) ([]*Image, error) {
+	req, err := http.NewRequest("GET", r.endpoint+"/"+name+"/blobs/"+manifest.Config.Digest, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.do(stdout, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP code %d while fetching the history of %s", res.StatusCode, name)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if digestOf(data) != manifest.Config.Digest {
+		return nil, fmt.Errorf("The history of %s doesn't match its digest", name)
+	}
+	var history []*Image
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("Invalid history of %s: %s", name, err)
+	}
+	if len(history) == 0 || len(history) != len(manifest.Layers) {
+		return nil, fmt.Errorf("The history of %s doesn't match its layers", name)
+	}
+	for i, img := range history {
+		if err := ValidateId(img.Id); err != nil {
+			return nil, err
+		}
+		if err := validateForeignLayer(manifest.Layers[i]); err != nil {
+			return nil, err
+		}
+		if (i == 0 && img.Parent != "") || (i > 0 && img.Parent != history[i-1].Id) {
+			return nil, fmt.Errorf("The history of %s is broken at %s", name, img.Id)
+		}
+	}
+	return history, nil
+}
+
+// pullManifest pulls the images of a manifest, and returns the top one. The
+// platform selected in a manifest list, if any, is recorded with it.
+func (r *registryV2) pullManifest(stdout io.Writer, name string, manifest *ManifestV2, platform *Platform) (*Image, error) {
+	history, err := r.getHistory(stdout, name, manifest)
+	if err != nil {
+		return nil, err
+	}
+	// Download the layers concurrently and register the parents first,
+	// like with v1
+	ids := make([]string, len(history))
+	for i, img := range history {
+		ids[i] = img.Id
+	}
+	if err := r.graph.pullLayers(stdout, r.aborted, ids, func(i int, parentRegistered func() error) error {
+		return r.pullLayer(stdout, name, history[i], manifest.Layers[i], parentRegistered)
+	}); err != nil {
+		return nil, err
+	}
+	for i, img := range history {
+		if err := r.graph.addBlobSource(img.Id, manifest.Layers[i], r.endpoint, name); err != nil {
+			return nil, err
+		}
+	}
+	top := history[len(history)-1]
+	if platform != nil {
+		fmt.Fprintf(stdout, "%s: Selected the manifest for %s\n", Trunc(top.Id, 12), platform.String())
+		if err := r.graph.setPlatform(top.Id, platform); err != nil {
+			return nil, err
+		}
+	}
+	return top, nil
+}
+
+// validateForeignLayer checks that a foreign layer can be downloaded, and
+// that only foreign layers have URLs
+func validateForeignLayer(layer Descriptor) error {
+	if layer.MediaType != foreignLayerMediaType {
+		if len(layer.URLs) > 0 {
+			return fmt.Errorf("The layer %s has URLs but isn't foreign", layer.Digest)
+		}
+		return nil
+	}
+	if len(layer.URLs) == 0 {
+		return fmt.Errorf("The foreign layer %s has no URLs", layer.Digest)
+	}
+	for _, rawurl := range layer.URLs {
+		if u, err := url.Parse(rawurl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("Invalid URL of the foreign layer %s: %s", layer.Digest, rawurl)
+		}
+	}
+	return nil
+}
+
+// pullLayer downloads the blob of the layer of img, and registers it once
+// its parent is registered and its digest is checked
+func (r *registryV2) pullLayer(stdout io.Writer, name string, img *Image, layer Descriptor, parentRegistered func() error) error {
+	var file *os.File
+	var err error
+	if layer.MediaType == foreignLayerMediaType {
+		file, err = r.downloadForeign(stdout, img, layer)
+	} else {
+		file, err = r.graph.download(stdout, r.aborted, img.Id, r.endpoint+"/"+name+"/blobs/"+layer.Digest, func(req *http.Request) (*http.Response, error) {
+			return r.do(stdout, req)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	// Don't extract a truncated layer
+	if info, err := file.Stat(); err != nil {
+		return err
+	} else if layer.Size > 0 && info.Size() != layer.Size {
+		return fmt.Errorf("The layer of %s is truncated (%d bytes of %d)", img.Id, info.Size(), layer.Size)
+	}
+	if err := parentRegistered(); err != nil {
+		return err
+	}
+	// The digest is computed during the extraction
+	verifier := newLayerVerifier(&abortableReader{file, r.aborted}, sha256Digest)
+	defer verifier.Close()
+	return r.graph.register(verifier, img, func() error {
+		if digest, err := verifier.Sum(); err != nil {
+			return err
+		} else if digest != layer.Digest {
+			return fmt.Errorf("The layer of %s doesn't match its digest %s", img.Id, layer.Digest)
+		}
+		return nil
+	})
+}
+
+// downloadForeign downloads a foreign layer from the first of its URLs
+// which serves it. The credentials of the registry aren't sent to them, and
+// only the URLs of the hosts of -foreign-layer-host are downloaded from,
+// redirections included.
+func (r *registryV2) downloadForeign(stdout io.Writer, img *Image, layer Descriptor) (*os.File, error) {
+	client := r.graph.registryClient()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !foreignLayerAllowed(r.graph.foreignLayerHosts, req.URL) {
+			return fmt.Errorf("The foreign layer %s is redirected to %s, which isn't allowed by -foreign-layer-host", layer.Digest, req.URL.Host)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("Stopped after 10 redirects")
+		}
+		return nil
+	}
+	err := fmt.Errorf("The foreign layer %s can't be downloaded: the hosts of its URLs aren't allowed by -foreign-layer-host", layer.Digest)
+	for _, rawurl := range layer.URLs {
+		if u, e := url.Parse(rawurl); e != nil || !foreignLayerAllowed(r.graph.foreignLayerHosts, u) {
+			registryLog.Infof("Skipping the URL %s of the foreign layer of %s: its host isn't allowed", rawurl, img.Id)
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: Pulling foreign layer from %s\n", Trunc(img.Id, 12), rawurl)
+		var file *os.File
+		if file, err = r.graph.download(stdout, r.aborted, img.Id, rawurl, client.Do); err == nil {
+			return file, nil
+		}
+		registryLog.Errorf("Downloading the foreign layer of %s from %s failed: %s", img.Id, rawurl, err)
+	}
+	return nil, err
+}
+
+// foreignLayerAllowed returns whether a foreign layer may be downloaded
+// from u: an http or https URL of one of hosts, which are HOST, HOST:PORT,
+// or .DOMAIN for the subdomains of DOMAIN
+func foreignLayerAllowed(hosts []string, u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	hostname := strings.ToLower(u.Hostname())
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		if strings.HasPrefix(host, ".") {
+			if strings.HasSuffix(hostname, host) {
+				return true
+			}
+		} else if _, _, err := net.SplitHostPort(host); err == nil {
+			if strings.ToLower(u.Host) == host {
+				return true
+			}
+		} else if hostname == strings.Trim(host, "[]") {
+			return true
+		}
+	}
+	return false
+}
+
+// PullRepository pulls the tags of the repository remote on the registry,
+// and tags their images locally as local
+func (r *registryV2) PullRepository(stdout io.Writer, remote, local string, repositories *TagStore) error {
+	fmt.Fprintf(stdout, "Pulling repository %s from %s\n", local, r.endpoint)
+	name := r.repositoryName(remote)
+	req, err := http.NewRequest("GET", r.endpoint+"/"+name+"/tags/list", nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.do(stdout, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("HTTP code %d while listing the tags of %s", res.StatusCode, remote)
+	}
+	var tags struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tags); err != nil {
+		return err
+	}
+	// Pull the tags concurrently, like with v1
+	type pullResult struct {
+		tag, rev, digest string
+		err              error
+	}
+	workers := make(chan bool, maxConcurrentDownloads)
+	results := make(chan pullResult, len(tags.Tags))
+	for _, tag := range tags.Tags {
+		go func(tag string) {
+			workers <- true
+			defer func() { <-workers }()
+			fmt.Fprintf(stdout, "Pulling tag %s:%s\n", local, tag)
+			manifest, digest, platform, err := r.getManifest(stdout, name, tag)
+			if err != nil {
+				results <- pullResult{tag, "", "", err}
+				return
+			}
+			img, err := r.pullManifest(stdout, name, manifest, platform)
+			if err != nil {
+				results <- pullResult{tag, "", "", err}
+				return
+			}
+			fmt.Fprintf(stdout, "%s:%s: digest %s\n", local, tag, digest)
+			results <- pullResult{tag, img.Id, digest, nil}
+		}(tag)
+	}
+	var pullErr error
+	for range tags.Tags {
+		result := <-results
+		if result.err != nil {
+			fmt.Fprintf(stdout, "Error pulling tag %s:%s: %s\n", local, result.tag, result.err)
+			if pullErr == nil {
+				pullErr = result.err
+			}
+			continue
+		}
+		if err := repositories.Set(local, result.tag, result.rev, true); err != nil && pullErr == nil {
+			pullErr = err
+		}
+		if err := repositories.SetDigest(local, result.digest, result.rev); err != nil && pullErr == nil {
+			pullErr = err
+		}
+	}
+	if pullErr != nil {
+		return pullErr
+	}
+	return repositories.Save()
+}
+
+// PullDigest pulls the image of the manifest digest of the repository
+// remote. The image isn't tagged, but can be referred to as local@digest.
+func (r *registryV2) PullDigest(stdout io.Writer, remote, local, digest string, repositories *TagStore) error {
+	fmt.Fprintf(stdout, "Pulling %s@%s from %s\n", remote, digest, r.endpoint)
+	name := r.repositoryName(remote)
+	manifest, _, platform, err := r.getManifest(stdout, name, digest)
+	if err != nil {
+		return err
+	}
+	img, err := r.pullManifest(stdout, name, manifest, platform)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s@%s: image %s\n", local, digest, img.Id)
+	return repositories.SetDigest(local, digest, img.Id)
+}
+
+// PushRepository pushes the tags of the repository local as remote, and
+// records the digests of their manifests. Layers already on the registry are
+// neither uploaded nor mounted again.
+func (r *registryV2) PushRepository(stdout io.Writer, remote, local string, localRepo Repository, repositories *TagStore) error {
+	fmt.Fprintf(stdout, "Pushing repository %s (%d tags)\n", remote, len(localRepo))
+	name := r.repositoryName(remote)
+	for tag, imgId := range localRepo {
+		img, err := r.graph.Get(imgId)
+		if err != nil {
+			fmt.Fprintf(stdout, "Skipping tag %s:%s: %s does not exist\n", remote, tag, imgId)
+			continue
+		}
+		fmt.Fprintf(stdout, "Pushing tag %s:%s\n", remote, tag)
+		digest, err := r.pushManifest(stdout, name, tag, img)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s:%s: digest %s\n", remote, tag, digest)
+		if err := repositories.SetDigest(local, digest, img.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushManifest pushes the layers and the history of img, and its manifest
+// as tag. It returns the digest of the manifest.
+func (r *registryV2) pushManifest(stdout io.Writer, name, tag string, img *Image) (string, error) {
+	history, err := img.History()
+	if err != nil {
+		return "", err
+	}
+	// The base image first
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+	manifest := &ManifestV2{SchemaVersion: 2, MediaType: manifestV2MediaType}
+	for _, img := range history {
+		layer, err := r.pushLayer(stdout, name, img)
+		if err != nil {
+			return "", err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	config, err := json.Marshal(history)
+	if err != nil {
+		return "", err
+	}
+	manifest.Config = Descriptor{MediaType: historyMediaType, Size: int64(len(config)), Digest: digestOf(config)}
+	if exists, err := r.blobExists(stdout, name, manifest.Config.Digest); err != nil {
+		return "", err
+	} else if !exists {
+		if _, _, err := r.uploadBlob(stdout, name, bytes.NewReader(config)); err != nil {
+			return "", err
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("PUT", r.endpoint+"/"+name+"/manifests/"+tag, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", manifestV2MediaType)
+	res, err := r.do(stdout, req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode != 201 && res.StatusCode != 200 {
+		return "", fmt.Errorf("HTTP code %d while pushing the manifest of %s:%s", res.StatusCode, name, tag)
+	}
+	return digestOf(data), nil
+}
+
+// pushLayer pushes the layer of img, unless it is already in the
+// repository, or can be mounted from another repository of the registry
+func (r *registryV2) pushLayer(stdout io.Writer, name string, img *Image) (Descriptor, error) {
+	blob, err := r.graph.layerBlob(img.Id)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if blob != nil && blob.MediaType == foreignLayerMediaType {
+		fmt.Fprintf(stdout, "%s: Skipping foreign layer\n", Trunc(img.Id, 12))
+		return blob.Descriptor, nil
+	}
+	if blob != nil {
+		if exists, err := r.blobExists(stdout, name, blob.Digest); err != nil {
+			return Descriptor{}, err
+		} else if exists {
+			fmt.Fprintf(stdout, "%s: Layer already pushed\n", Trunc(img.Id, 12))
+			return blob.Descriptor, nil
+		}
+		for _, source := range blob.Sources {
+			if source.Endpoint != r.endpoint || source.Repository == name {
+				continue
+			}
+			if mounted, err := r.mountBlob(stdout, name, blob.Digest, source.Repository); err != nil {
+				return Descriptor{}, err
+			} else if mounted {
+				fmt.Fprintf(stdout, "%s: Layer mounted from %s\n", Trunc(img.Id, 12), source.Repository)
+				return blob.Descriptor, r.graph.addBlobSource(img.Id, blob.Descriptor, r.endpoint, name)
+			}
+		}
+	}
+	// The digest of a layer which was never pushed is unknown until it is
+	// uploaded: the archive is streamed from the graph to the registry,
+	// without storing it
+	archive, err := r.graph.TarLayer(img.Id, Gzip)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("Failed to generate layer archive: %s", err)
+	}
+	fmt.Fprintf(stdout, "Pushing %s fs layer\n", img.Id)
+	digest, size, err := r.uploadBlob(stdout, name, archive)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	layer := Descriptor{MediaType: layerMediaType, Size: size, Digest: digest}
+	return layer, r.graph.addBlobSource(img.Id, layer, r.endpoint, name)
+}
+
+func (r *registryV2) blobExists(stdout io.Writer, name, digest string) (bool, error) {
+	req, err := http.NewRequest("HEAD", r.endpoint+"/"+name+"/blobs/"+digest, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.do(stdout, req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, fmt.Errorf("HTTP code %d while looking up the blob %s", res.StatusCode, digest)
+}
+
+// mountBlob asks the registry to add the blob of the repository from to
+// name. It returns false if the registry can't, eg. because the user can't
+// read from.
+func (r *registryV2) mountBlob(stdout io.Writer, name, digest, from string) (bool, error) {
+	query := url.Values{"mount": {digest}, "from": {from}}
+	req, err := http.NewRequest("POST", r.endpoint+"/"+name+"/blobs/uploads/?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.doScoped(stdout, req, "repository:"+from+":pull")
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 201 {
+		// The registry started an upload instead, which is dropped
+		if location, err := res.Location(); err == nil && res.StatusCode == 202 {
+			if req, err := http.NewRequest("DELETE", location.String(), nil); err == nil {
+				if res, err := r.do(stdout, req); err == nil {
+					res.Body.Close()
+				}
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// uploadBlob uploads a blob in chunks of blobChunkSize, so that an upload
+// rejected by the registry, eg. because of rate limiting, only sends again
+// the current chunk. The blob is read once, and only a chunk of it is held
+// in memory. It returns the digest and the size of the blob.
+func (r *registryV2) uploadBlob(stdout io.Writer, name string, blob io.Reader) (string, int64, error) {
+	req, err := http.NewRequest("POST", r.endpoint+"/"+name+"/blobs/uploads/", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	res, err := r.do(stdout, req)
+	if err != nil {
+		return "", 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 202 {
+		return "", 0, fmt.Errorf("HTTP code %d while starting an upload to %s", res.StatusCode, name)
+	}
+	location, err := res.Location()
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to retrieve the upload location: %s", err)
+	}
+	h := sha256.New()
+	chunk := make([]byte, blobChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(blob, chunk)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return "", 0, err
+		}
+		h.Write(chunk[:n])
+		req, err := http.NewRequest("PATCH", location.String(), bytes.NewReader(chunk[:n]))
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(n)-1))
+		res, err := r.do(stdout, req)
+		if err != nil {
+			return "", 0, err
+		}
+		res.Body.Close()
+		if res.StatusCode != 202 {
+			return "", 0, fmt.Errorf("HTTP code %d while uploading to %s", res.StatusCode, name)
+		}
+		if location, err = res.Location(); err != nil {
+			return "", 0, fmt.Errorf("Failed to retrieve the upload location: %s", err)
+		}
+		offset += int64(n)
+		if n < len(chunk) {
+			break
+		}
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	req, err = http.NewRequest("PUT", location.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	res, err = r.do(stdout, req)
+	if err != nil {
+		return "", 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != 201 {
+		return "", 0, fmt.Errorf("HTTP code %d while completing the upload of %s", res.StatusCode, digest)
+	}
+	return digest, offset, nil
+}
+
+// The blob of a layer on v2 registries, and the repositories which have
+// it, to skip or mount it when the layer is pushed again
+type layerBlob struct {
+	Descriptor
+	Sources []blobSource
+}
+
+type blobSource struct {
+	Endpoint   string
+	Repository string
+}
+
+func (graph *Graph) blobPath(id string) string {
+	return path.Join(graph.imageRoot(id), "blob")
+}
+
+// layerBlob returns the blob of the layer of image id, or nil if it was
+// neither pulled nor pushed with v2
+func (graph *Graph) layerBlob(id string) (*layerBlob, error) {
+	data, err := ioutil.ReadFile(graph.blobPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	blob := &layerBlob{}
+	if err := json.Unmarshal(data, blob); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// addBlobSource records that the repository name of endpoint has the blob
+// of the layer of image id. A blob of another digest replaces the previous
+// one.
+func (graph *Graph) addBlobSource(id string, layer Descriptor, endpoint, name string) error {
+	graph.blobsLock.Lock()
+	defer graph.blobsLock.Unlock()
+	blob, err := graph.layerBlob(id)
+	if err != nil {
+		return err
+	}
+	if blob == nil || blob.Digest != layer.Digest {
+		blob = &layerBlob{Descriptor: layer}
+	}
+	source := blobSource{Endpoint: endpoint, Repository: name}
+	for _, s := range blob.Sources {
+		if s == source {
+			return nil
+		}
+	}
+	blob.Sources = append(blob.Sources, source)
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(graph.blobPath(id), data, 0600)
+}
+
+func (graph *Graph) platformPath(id string) string {
+	return path.Join(graph.imageRoot(id), "platform")
+}
+
+// Platform returns the platform selected in the manifest list image id was
+// pulled from, or nil
+func (graph *Graph) Platform(id string) (*Platform, error) {
+	data, err := ioutil.ReadFile(graph.platformPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	platform := &Platform{}
+	if err := json.Unmarshal(data, platform); err != nil {
+		return nil, err
+	}
+	return platform, nil
+}
+
+func (graph *Graph) setPlatform(id string, platform *Platform) error {
+	data, err := json.Marshal(platform)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(graph.platformPath(id), data, 0600)
+}
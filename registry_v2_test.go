@@ -0,0 +1,619 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/auth"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistryV2 serves the v2 protocol from memory, and grants bearer
+// tokens to ken, with the scopes asked for except on the unreadable
+// repositories
+type fakeRegistryV2 struct {
+	blobs      map[string][]byte            // By digest
+	repos      map[string]map[string]bool   // Digests of the blobs of each repository
+	manifests  map[string]map[string][]byte // By repository, by tag and by digest
+	uploads    map[string]*bytes.Buffer
+	chunks     int
+	mounts     int
+	unreadable map[string]bool
+	lock       sync.Mutex
+}
+
+func newFakeRegistryV2() *fakeRegistryV2 {
+	return &fakeRegistryV2{
+		blobs:      make(map[string][]byte),
+		repos:      make(map[string]map[string]bool),
+		manifests:  make(map[string]map[string][]byte),
+		uploads:    make(map[string]*bytes.Buffer),
+		unreadable: make(map[string]bool),
+	}
+}
+
+func (registry *fakeRegistryV2) addBlob(name, digest string, data []byte) {
+	registry.blobs[digest] = data
+	if registry.repos[name] == nil {
+		registry.repos[name] = make(map[string]bool)
+	}
+	registry.repos[name][digest] = true
+}
+
+func (registry *fakeRegistryV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if r.URL.Path == "/token" {
+		if user, password, ok := r.BasicAuth(); !ok || user != "ken" || password != "test" {
+			w.WriteHeader(401)
+			return
+		}
+		token := "secret"
+		for _, scope := range r.URL.Query()["scope"] {
+			if parts := strings.Split(scope, ":"); len(parts) != 3 || !registry.unreadable[parts[1]] {
+				token += " " + scope
+			}
+		}
+		fmt.Fprintf(w, `{"token": "%s"}`, token)
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer secret") {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="registry"`, r.Host))
+		w.WriteHeader(401)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if p == "" {
+		return
+	}
+	switch {
+	case strings.HasSuffix(p, "/tags/list"):
+		name := strings.TrimSuffix(p, "/tags/list")
+		var tags []string
+		for reference := range registry.manifests[name] {
+			if !strings.HasPrefix(reference, "sha256:") {
+				tags = append(tags, `"`+reference+`"`)
+			}
+		}
+		fmt.Fprintf(w, `{"name": "%s", "tags": [%s]}`, name, strings.Join(tags, ","))
+	case strings.Contains(p, "/manifests/"):
+		parts := strings.SplitN(p, "/manifests/", 2)
+		if r.Method == "PUT" {
+			data, _ := ioutil.ReadAll(r.Body)
+			if registry.manifests[parts[0]] == nil {
+				registry.manifests[parts[0]] = make(map[string][]byte)
+			}
+			registry.manifests[parts[0]][parts[1]] = data
+			registry.manifests[parts[0]][digestOf(data)] = data
+			w.WriteHeader(201)
+			return
+		}
+		data, exists := registry.manifests[parts[0]][parts[1]]
+		if !exists {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(data)
+	case strings.Contains(p, "/blobs/uploads/"):
+		parts := strings.SplitN(p, "/blobs/uploads/", 2)
+		switch r.Method {
+		case "POST":
+			from := r.URL.Query().Get("from")
+			if from != "" && !registry.unreadable[from] && !strings.Contains(r.Header.Get("Authorization"), "repository:"+from+":pull") {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="registry",scope="repository:%s:push,pull"`, r.Host, parts[0]))
+				w.WriteHeader(401)
+				return
+			}
+			if digest := r.URL.Query().Get("mount"); digest != "" && !registry.unreadable[from] && registry.repos[from][digest] {
+				registry.addBlob(parts[0], digest, registry.blobs[digest])
+				registry.mounts++
+				w.WriteHeader(201)
+				return
+			}
+			id := GenerateId()
+			registry.uploads[id] = &bytes.Buffer{}
+			w.Header().Set("Location", "/v2/"+parts[0]+"/blobs/uploads/"+id)
+			w.WriteHeader(202)
+		case "PATCH":
+			upload := registry.uploads[parts[1]]
+			if r.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", upload.Len(), upload.Len()+int(r.ContentLength)-1) {
+				w.WriteHeader(416)
+				return
+			}
+			upload.ReadFrom(r.Body)
+			registry.chunks++
+			w.Header().Set("Location", r.URL.Path)
+			w.WriteHeader(202)
+		case "PUT":
+			data := registry.uploads[parts[1]].Bytes()
+			if digestOf(data) != r.URL.Query().Get("digest") {
+				w.WriteHeader(400)
+				return
+			}
+			registry.addBlob(parts[0], digestOf(data), data)
+			w.WriteHeader(201)
+		}
+	case strings.Contains(p, "/blobs/"):
+		parts := strings.SplitN(p, "/blobs/", 2)
+		if !registry.repos[parts[0]][parts[1]] {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(registry.blobs[parts[1]])
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/app:pull,push"`)
+	if params["realm"] != "https://auth.example.com/token" || params["service"] != "registry.example.com" || params["scope"] != "repository:team/app:pull,push" {
+		t.Errorf("Unexpected parameters: %v", params)
+	}
+	if name, digest := splitDigest("team/app@sha256:abc"); name != "team/app" || digest != "sha256:abc" {
+		t.Errorf("Unexpected split: %s %s", name, digest)
+	}
+}
+
+func TestManifestListMatch(t *testing.T) {
+	list := &ManifestList{Manifests: []ManifestListEntry{
+		{Descriptor{Digest: "amd64"}, Platform{Architecture: "amd64", OS: "linux"}},
+		{Descriptor{Digest: "armv6"}, Platform{Architecture: "arm", OS: "linux", Variant: "v6"}},
+		{Descriptor{Digest: "arm"}, Platform{Architecture: "arm", OS: "linux"}},
+		{Descriptor{Digest: "armv7"}, Platform{Architecture: "arm", OS: "linux", Variant: "v7"}},
+	}}
+	for platform, digest := range map[Platform]string{
+		{Architecture: "amd64", OS: "linux"}:              "amd64",
+		{Architecture: "arm", OS: "linux", Variant: "v7"}: "armv7",
+		{Architecture: "arm", OS: "linux", Variant: "v5"}: "arm",
+		{Architecture: "arm", OS: "linux"}:                "armv6",
+	} {
+		if entry := list.match(platform); entry == nil || entry.Digest != digest {
+			t.Errorf("Expected %s to match %s, got %v", platform.String(), digest, entry)
+		}
+	}
+	list.Manifests = list.Manifests[:2]
+	if entry := list.match(Platform{Architecture: "arm", OS: "linux", Variant: "v7"}); entry != nil {
+		t.Errorf("linux/arm/v7 shouldn't match %s", entry.Platform.String())
+	}
+}
+
+func TestCpuVariant(t *testing.T) {
+	for _, test := range []struct {
+		arch, cpuinfo, variant string
+	}{
+		{"amd64", "", ""},
+		{"arm64", "", "v8"},
+		{"arm", "processor\t: 0\nmodel name\t: ARMv7 Processor rev 4 (v7l)\nCPU architecture: 7\n", "v7"},
+		{"arm", "CPU architecture: 6TEJ\n", "v6"},
+		{"arm", "CPU architecture: AArch64\n", "v8"},
+		{"arm", "", ""},
+	} {
+		if variant := cpuVariant(test.arch, test.cpuinfo); variant != test.variant {
+			t.Errorf("Expected the variant %q for %s with %q, got %q", test.variant, test.arch, test.cpuinfo, variant)
+		}
+	}
+}
+
+func TestNegotiateV2(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	v1 := httptest.NewServer(http.NotFoundHandler())
+	defer v1.Close()
+	if graph.negotiateV2(ioutil.Discard, nil, v1.URL+"/v1", &auth.AuthConfig{}) != nil {
+		t.Errorf("A v1 registry shouldn't be used with v2")
+	}
+	v2 := httptest.NewServer(newFakeRegistryV2())
+	defer v2.Close()
+	r := graph.negotiateV2(ioutil.Discard, nil, v2.URL+"/v1", &auth.AuthConfig{Username: "ken", Password: "test"})
+	if r == nil || r.endpoint != v2.URL+"/v2" || r.token != "secret" {
+		t.Fatalf("Expected a v2 session with a token, got %v", r)
+	}
+	graph.contentTrust = true
+	if graph.negotiateV2(ioutil.Discard, nil, v2.URL+"/v1", &auth.AuthConfig{}) != nil {
+		t.Errorf("Signed images should be exchanged with v1")
+	}
+}
+
+// The graph of the daemon always has a trust store, v2 is only left out
+// when content trust is enforced
+func TestNegotiateV2Runtime(t *testing.T) {
+	v2 := httptest.NewServer(newFakeRegistryV2())
+	defer v2.Close()
+	for _, contentTrust := range []bool{false, true} {
+		root, err := ioutil.TempDir("", "docker-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		config := DefaultDaemonConfig()
+		config.Root = root
+		config.ContentTrust = contentTrust
+		runtime, err := NewRuntimeFromConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := runtime.graph.negotiateV2(ioutil.Discard, nil, v2.URL+"/v1", &auth.AuthConfig{Username: "ken", Password: "test"})
+		if contentTrust && r != nil {
+			t.Errorf("Expected v1 with content trust enforced")
+		} else if !contentTrust && r == nil {
+			t.Errorf("Expected v2 to be negotiated")
+		}
+	}
+}
+
+// The signatures are only exchanged with v1
+func TestSignedTagsV1(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	if graph.signsTags() || graph.verifiesTags() {
+		t.Fatalf("The tags can't be signed without a trust store")
+	}
+	graph.trust = tempTrustStore(t)
+	defer os.RemoveAll(graph.trust.root)
+	if graph.signsTags() || graph.verifiesTags() {
+		t.Fatalf("The tags shouldn't be signed before the key of the daemon is generated")
+	}
+	_, data, err := graph.trust.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !graph.signsTags() || graph.verifiesTags() {
+		t.Errorf("The tags pushed should be signed once the daemon has a key")
+	}
+	if !(&TrustStore{root: graph.trust.root}).HasSigningKey() {
+		t.Errorf("The key of the daemon should be found on disk")
+	}
+	if _, err := graph.trust.AddKey("publisher", data); err != nil {
+		t.Fatal(err)
+	}
+	if !graph.verifiesTags() {
+		t.Errorf("The tags pulled should be verified once the daemon trusts a key")
+	}
+}
+
+func TestRegistryV2PushPull(t *testing.T) {
+	defer func(size int64) { blobChunkSize = size }(blobChunkSize)
+	blobChunkSize = 64
+
+	registry := newFakeRegistryV2()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	authConfig := &auth.AuthConfig{Username: "ken", Password: "test"}
+
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	base := &Image{Id: GenerateId(), Comment: "base"}
+	if err := graph.Register(testArchive(t), base); err != nil {
+		t.Fatal(err)
+	}
+	child := &Image{Id: GenerateId(), Parent: base.Id, Comment: "child"}
+	if err := graph.Register(childArchive(t), child); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := graph.negotiateV2(ioutil.Discard, nil, server.URL+"/v1", authConfig)
+	if r == nil {
+		t.Fatal("The registry should speak v2")
+	}
+	if err := r.PushRepository(ioutil.Discard, "team/app", "localhost/team/app", Repository{"latest": child.Id}, store); err != nil {
+		t.Fatal(err)
+	}
+	// The digest of the pushed manifest refers to the image
+	pushed := "localhost/team/app@" + digestOf(registry.manifests["team/app"]["latest"])
+	if img, err := store.LookupImage(pushed); err != nil || img.Id != child.Id {
+		t.Fatalf("Expected %s to refer to %s, got %v (%v)", pushed, child.Id, img, err)
+	}
+	// 2 layers and the history
+	if len(registry.repos["team/app"]) != 3 || registry.chunks <= 3 {
+		t.Fatalf("Expected 3 blobs uploaded in chunks, got %d blobs in %d chunks", len(registry.repos["team/app"]), registry.chunks)
+	}
+	// The layers are mounted in another repository of the registry
+	output := &bytes.Buffer{}
+	if err := r.PushRepository(output, "team/other", "localhost/team/other", Repository{"v1": child.Id}, store); err != nil {
+		t.Fatal(err)
+	}
+	if registry.mounts != 2 || !strings.Contains(output.String(), "Layer mounted from team/app") {
+		t.Fatalf("Expected the layers to be mounted, got %d mounts: %s", registry.mounts, output)
+	}
+	// And skipped in the same repository
+	output.Reset()
+	if err := r.PushRepository(output, "team/app", "localhost/team/app", Repository{"latest": child.Id}, store); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(output.String(), "Layer already pushed") != 2 {
+		t.Fatalf("Expected the layers to be skipped: %s", output)
+	}
+	// The layers of a repository the user can't read are uploaded again
+	registry.unreadable["team/app"] = true
+	registry.unreadable["team/other"] = true
+	output.Reset()
+	if err := r.PushRepository(output, "team/third", "localhost/team/third", Repository{"latest": child.Id}, store); err != nil {
+		t.Fatal(err)
+	}
+	if registry.mounts != 2 || len(registry.repos["team/third"]) != 3 || strings.Contains(output.String(), "mounted from") {
+		t.Fatalf("Expected the layers to be uploaded, got %d mounts: %s", registry.mounts, output)
+	}
+	registry.unreadable = make(map[string]bool)
+
+	graph2 := tempGraph(t)
+	defer os.RemoveAll(graph2.Root)
+	store2, err := NewTagStore(path.Join(graph2.Root, "repositories"), graph2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := graph2.negotiateV2(ioutil.Discard, nil, server.URL+"/v1", authConfig)
+	if err := r2.PullRepository(ioutil.Discard, "team/app", "localhost/team/app", store2); err != nil {
+		t.Fatal(err)
+	}
+	img, err := store2.GetImage("localhost/team/app", "latest")
+	if err != nil || img == nil || img.Id != child.Id || img.Comment != "child" {
+		t.Fatalf("Expected %s to be pulled, got %v (%v)", child.Id, img, err)
+	}
+	if img, err := store2.LookupImage(pushed); err != nil || img.Id != child.Id {
+		t.Fatalf("The digest of the pulled tag wasn't recorded: %v (%v)", img, err)
+	}
+	if !graph2.Exists(base.Id) {
+		t.Fatalf("The parent of %s wasn't pulled", child.Id)
+	}
+	if blob, err := graph2.layerBlob(base.Id); err != nil || blob == nil || blob.Sources[0].Repository != "team/app" {
+		t.Fatalf("The blob of %s wasn't recorded: %v (%v)", base.Id, blob, err)
+	}
+
+	// By digest
+	var digest string
+	for reference := range registry.manifests["team/other"] {
+		if strings.HasPrefix(reference, "sha256:") {
+			digest = reference
+		}
+	}
+	if err := r2.PullDigest(ioutil.Discard, "team/other", "localhost/team/other", digest, store2); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := store2.LookupImage("localhost/team/other@" + digest); err != nil || img.Id != child.Id {
+		t.Fatalf("Expected the digest to refer to %s, got %v (%v)", child.Id, img, err)
+	}
+	if _, err := store2.LookupImage("localhost/team/other@" + digestOf([]byte("bogus"))); !graph2.IsNotExist(err) {
+		t.Fatalf("Expected an unknown digest not to exist, got %v", err)
+	}
+	if err := r2.PullDigest(ioutil.Discard, "team/other", "localhost/team/other", digestOf([]byte("bogus")), store2); err == nil {
+		t.Fatal("Pulling an unknown digest should fail")
+	}
+	// A layer which doesn't match its digest is refused, once its size is
+	// checked
+	layerDigest := registry.manifestLayer(t, "team/other", digest)
+	blob := registry.blobs[layerDigest]
+	registry.blobs[layerDigest] = []byte("truncated")
+	if err := graph2.Delete(child.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.PullDigest(ioutil.Discard, "team/other", "localhost/team/other", digest, store2); err == nil || !strings.Contains(err.Error(), "is truncated") {
+		t.Fatalf("Expected a truncated layer, got %v", err)
+	}
+	registry.blobs[layerDigest] = bytes.Repeat([]byte("x"), len(blob))
+	graph3 := tempGraph(t)
+	defer os.RemoveAll(graph3.Root)
+	store3, err := NewTagStore(path.Join(graph3.Root, "repositories"), graph3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r3 := graph3.negotiateV2(ioutil.Discard, nil, server.URL+"/v1", authConfig)
+	if err := r3.PullDigest(ioutil.Discard, "team/other", "localhost/team/other", digest, store3); err == nil || !strings.Contains(err.Error(), "doesn't match its digest") {
+		t.Fatalf("Expected a digest mismatch, got %v", err)
+	}
+}
+
+// manifestLayer returns the digest of the top layer of a manifest
+func (registry *fakeRegistryV2) manifestLayer(t *testing.T, name, reference string) string {
+	data := registry.manifests[name][reference]
+	i := bytes.LastIndex(data, []byte(`"digest":"`))
+	if i < 0 {
+		t.Fatalf("No layer in %s", data)
+	}
+	return string(data[i+len(`"digest":"`) : i+len(`"digest":"`)+len("sha256:")+64])
+}
+
+// childArchive returns a layer which differs from testArchive
+func childArchive(t *testing.T) Archive {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	content := []byte("child\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "/etc/child", Size: int64(len(content)), Mode: 0644}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+	return buf
+}
+
+func TestRegistryV2ForeignLayer(t *testing.T) {
+	registry := newFakeRegistryV2()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	authConfig := &auth.AuthConfig{Username: "ken", Password: "test"}
+
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &Image{Id: GenerateId()}
+	if err := graph.Register(testArchive(t), base); err != nil {
+		t.Fatal(err)
+	}
+	r := graph.negotiateV2(ioutil.Discard, nil, server.URL+"/v1", authConfig)
+	if err := r.PushRepository(ioutil.Discard, "vendor/base", "localhost/vendor/base", Repository{"latest": base.Id}, store); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mark the layer as foreign, served by the vendor only
+	manifest := &ManifestV2{}
+	if err := json.Unmarshal(registry.manifests["vendor/base"]["latest"], manifest); err != nil {
+		t.Fatal(err)
+	}
+	layer := registry.blobs[manifest.Layers[0].Digest]
+	delete(registry.repos["vendor/base"], manifest.Layers[0].Digest)
+	var downloads int
+	vendor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("The credentials of the registry were sent to the vendor")
+		}
+		downloads++
+		w.Write(layer)
+	}))
+	defer vendor.Close()
+	manifest.Layers[0].MediaType = foreignLayerMediaType
+	manifest.Layers[0].URLs = []string{vendor.URL + "/base.tar.gz"}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.manifests["vendor/base"][digestOf(data)] = data
+
+	graph2 := tempGraph(t)
+	defer os.RemoveAll(graph2.Root)
+	store2, err := NewTagStore(path.Join(graph2.Root, "repositories"), graph2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := graph2.negotiateV2(ioutil.Discard, nil, server.URL+"/v1", authConfig)
+	// The hosts of the foreign layers must be allowed
+	if err := r2.PullDigest(ioutil.Discard, "vendor/base", "localhost/vendor/base", digestOf(data), store2); err == nil || !strings.Contains(err.Error(), "-foreign-layer-host") {
+		t.Fatalf("Expected the host of the vendor to be refused, got %v", err)
+	}
+	vendorURL, _ := url.Parse(vendor.URL)
+	graph2.foreignLayerHosts = []string{vendorURL.Host}
+	if err := r2.PullDigest(ioutil.Discard, "vendor/base", "localhost/vendor/base", digestOf(data), store2); err != nil {
+		t.Fatal(err)
+	}
+	if downloads != 1 || !graph2.Exists(base.Id) {
+		t.Fatalf("Expected the foreign layer to be downloaded from the vendor, got %d downloads", downloads)
+	}
+
+	// The foreign layer isn't pushed, and keeps its URLs
+	if err := r2.PushRepository(ioutil.Discard, "team/app", "localhost/team/app", Repository{"latest": base.Id}, store2); err != nil {
+		t.Fatal(err)
+	}
+	if registry.repos["team/app"][manifest.Layers[0].Digest] {
+		t.Fatalf("The foreign layer was pushed")
+	}
+	if !bytes.Contains(registry.manifests["team/app"]["latest"], []byte(vendor.URL)) {
+		t.Fatalf("The pushed manifest lost the URLs of the foreign layer: %s", registry.manifests["team/app"]["latest"])
+	}
+
+	if err := validateForeignLayer(Descriptor{MediaType: foreignLayerMediaType, URLs: []string{"file:///etc/passwd"}}); err == nil {
+		t.Fatalf("Only http and https URLs should be allowed")
+	}
+	if err := validateForeignLayer(Descriptor{MediaType: layerMediaType, URLs: []string{vendor.URL}}); err == nil {
+		t.Fatalf("Only foreign layers should have URLs")
+	}
+}
+
+func TestForeignLayerAllowed(t *testing.T) {
+	hosts := []string{"vendor.example.com", "cdn.example.org:8443", ".blobs.example.net"}
+	for rawurl, allowed := range map[string]bool{
+		"https://vendor.example.com/layer.tar.gz":      true,
+		"http://VENDOR.example.com:8080/layer.tar.gz":  true,
+		"https://cdn.example.org:8443/layer.tar.gz":    true,
+		"https://cdn.example.org/layer.tar.gz":         false,
+		"https://eu.blobs.example.net/layer.tar.gz":    true,
+		"https://blobs.example.net.evil/layer.tar.gz":  false,
+		"https://evil.example.com/layer.tar.gz":        false,
+		"ftp://vendor.example.com/layer.tar.gz":        false,
+		"file://vendor.example.com/etc/passwd":         false,
+		"https://vendor.example.com.evil/layer.tar.gz": false,
+	} {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if foreignLayerAllowed(hosts, u) != allowed {
+			t.Errorf("Expected %s to be allowed: %v", rawurl, allowed)
+		}
+	}
+	u, _ := url.Parse("https://vendor.example.com/layer.tar.gz")
+	if foreignLayerAllowed(nil, u) {
+		t.Errorf("No host should be allowed by default")
+	}
+}
+
+func TestRegistryV2ManifestList(t *testing.T) {
+	registry := newFakeRegistryV2()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	authConfig := &auth.AuthConfig{Username: "ken", Password: "test"}
+
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := &Image{Id: GenerateId()}
+	if err := graph.Register(testArchive(t), img); err != nil {
+		t.Fatal(err)
+	}
+	r := graph.negotiateV2(ioutil.Discard, nil, server.URL+"/v1", authConfig)
+	if err := r.PushRepository(ioutil.Discard, "team/app", "localhost/team/app", Repository{"native": img.Id}, store); err != nil {
+		t.Fatal(err)
+	}
+	native := registry.manifests["team/app"]["native"]
+	delete(registry.manifests["team/app"], "native")
+
+	addList := func(tag string, platforms ...Platform) {
+		list := &ManifestList{SchemaVersion: 2, MediaType: manifestListMediaType}
+		for _, platform := range platforms {
+			list.Manifests = append(list.Manifests, ManifestListEntry{
+				Descriptor: Descriptor{MediaType: manifestV2MediaType, Size: int64(len(native)), Digest: digestOf(native)},
+				Platform:   platform,
+			})
+		}
+		data, err := json.Marshal(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry.manifests["team/app"][tag] = data
+	}
+	addList("multi", Platform{Architecture: "mips", OS: "plan9"}, daemonPlatform)
+
+	graph2 := tempGraph(t)
+	defer os.RemoveAll(graph2.Root)
+	store2, err := NewTagStore(path.Join(graph2.Root, "repositories"), graph2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := graph2.negotiateV2(ioutil.Discard, nil, server.URL+"/v1", authConfig)
+	if err := r2.PullRepository(ioutil.Discard, "team/app", "localhost/team/app", store2); err != nil {
+		t.Fatal(err)
+	}
+	if pulled, err := store2.GetImage("localhost/team/app", "multi"); err != nil || pulled == nil || pulled.Id != img.Id {
+		t.Fatalf("Expected the manifest of %s to be selected, got %v (%v)", daemonPlatform.String(), pulled, err)
+	}
+	if platform, err := graph2.Platform(img.Id); err != nil || platform == nil || *platform != daemonPlatform {
+		t.Fatalf("Expected the platform %s to be recorded, got %v (%v)", daemonPlatform.String(), platform, err)
+	}
+	// The digest of a tag is the one of its list
+	if pulled, err := store2.LookupImage("localhost/team/app@" + digestOf(registry.manifests["team/app"]["multi"])); err != nil || pulled.Id != img.Id {
+		t.Fatalf("The digest of the list wasn't recorded: %v (%v)", pulled, err)
+	}
+
+	addList("other", Platform{Architecture: "mips", OS: "plan9"})
+	if _, _, _, err := r2.getManifest(ioutil.Discard, "team/app", "other"); err == nil || !strings.Contains(err.Error(), "has no manifest for") {
+		t.Fatalf("Expected no manifest for %s, got %v", daemonPlatform.String(), err)
+	}
+}
@@ -0,0 +1,182 @@
+package docker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Restart policies are applied by the monitor of a container when it exits.
+// A container stopped or killed by the operator isn't restarted. Those
+// stopped by the daemon shutting down are started again when it starts,
+// after the containers whose volumes they use.
+
+type restartPolicy struct {
+	Name       string // "no", "always" or "on-failure"
+	MaxRetries int    // Restarts allowed by on-failure, 0 for no limit
+}
+
+func parseRestartPolicy(policy string) (restartPolicy, error) {
+	parts := strings.SplitN(policy, ":", 2)
+	switch {
+	case parts[0] == "" && len(parts) == 1:
+		return restartPolicy{Name: "no"}, nil
+	case (parts[0] == "no" || parts[0] == "always") && len(parts) == 1:
+		return restartPolicy{Name: parts[0]}, nil
+	case parts[0] == "on-failure" && len(parts) == 1:
+		return restartPolicy{Name: parts[0]}, nil
+	case parts[0] == "on-failure":
+		if max, err := strconv.Atoi(parts[1]); err == nil && max >= 0 {
+			return restartPolicy{Name: parts[0], MaxRetries: max}, nil
+		}
+	}
+	return restartPolicy{}, fmt.Errorf("Invalid restart policy: %s (expected no, always or on-failure[:MAX])", policy)
+}
+
+// The delay before a restart doubles with each restart, from
+// minRestartDelay to maxRestartDelay, unless the container ran for
+// resetRestartDelay.
+var (
+	minRestartDelay   = 100 * time.Millisecond
+	maxRestartDelay   = time.Minute
+	resetRestartDelay = 10 * time.Second
+)
+
+func restartDelay(restarts int, ran time.Duration) time.Duration {
+	delay := minRestartDelay
+	if ran >= resetRestartDelay {
+		return delay
+	}
+	for i := 0; i < restarts && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartDelay {
+		delay = maxRestartDelay
+	}
+	return delay
+}
+
+// shouldRestart returns whether the restart policy of the container
+// restarts it after it exited with exitCode
+func (container *Container) shouldRestart(exitCode int) bool {
+	if container.stopRequested {
+		return false
+	}
+	// The policy was checked by validateConfig
+	policy, err := parseRestartPolicy(container.Config.Restart)
+	if err != nil {
+		return false
+	}
+	switch policy.Name {
+	case "always":
+		return true
+	case "on-failure":
+		return exitCode != 0 && (policy.MaxRetries == 0 || container.RestartCount < policy.MaxRetries)
+	}
+	return false
+}
+
+// restartOnExit restarts the container after the delay, unless it was
+// stopped, started or destroyed meanwhile
+func (container *Container) restartOnExit(ran time.Duration) {
+	time.Sleep(restartDelay(container.RestartCount, ran))
+	if container.stopRequested || container.State.Running || container.runtime.Get(container.Id) == nil {
+		return
+	}
+	container.RestartCount++
+	if err := container.Start(); err != nil {
+		containerLog.Errorf("%v: Failed to restart: %v", container.Id, err)
+	}
+}
+
+// dependencies returns the ids of the containers which must be started
+// before the container: the sources of its volumes
+func (container *Container) dependencies() []string {
+	var ids []string
+	for _, spec := range container.Config.VolumesFrom {
+		if id, _, err := parseVolumesFrom(spec); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// startOrder sorts containers so that each one comes after those of
+// containers it depends on, in the order of containers otherwise. The
+// containers of a dependency cycle, and those depending on them, are left
+// out and reported in the error.
+func startOrder(containers []*Container) ([]*Container, error) {
+	pending := make(map[string]*Container)
+	for _, container := range containers {
+		pending[container.Id] = container
+	}
+	var ordered []*Container
+	for len(pending) > 0 {
+		progress := false
+		for _, container := range containers {
+			if pending[container.Id] == nil {
+				continue
+			}
+			ready := true
+			for _, id := range container.dependencies() {
+				if pending[id] != nil {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				ordered = append(ordered, container)
+				delete(pending, container.Id)
+				progress = true
+			}
+		}
+		if !progress {
+			break
+		}
+	}
+	if len(pending) > 0 {
+		var cycle []string
+		for _, container := range containers {
+			if pending[container.Id] != nil {
+				cycle = append(cycle, container.Id)
+			}
+		}
+		return ordered, fmt.Errorf("Dependency cycle between the containers %s", strings.Join(cycle, ", "))
+	}
+	return ordered, nil
+}
+
+// restartStopped starts the containers with a restart policy which the
+// daemon stopped when it shut down, after the containers they depend on.
+// A container isn't started if one of its dependencies failed to start.
+func (runtime *Runtime) restartStopped(stopped []*Container) {
+	var containers []*Container
+	for _, container := range stopped {
+		if policy, err := parseRestartPolicy(container.Config.Restart); err == nil && policy.Name != "no" {
+			containers = append(containers, container)
+		}
+	}
+	ordered, err := startOrder(containers)
+	if err != nil {
+		runtimeLog.Errorf("%s: not restarting them", err)
+	}
+	failed := make(map[string]bool)
+	for _, container := range ordered {
+		for _, id := range container.dependencies() {
+			if failed[id] {
+				runtimeLog.Errorf("%v: Not restarting, its dependency %v failed to start", container.Id, id)
+				failed[container.Id] = true
+				break
+			}
+		}
+		if failed[container.Id] {
+			continue
+		}
+		runtimeLog.Infof("Restarting container %v", container.Id)
+		if err := container.Start(); err != nil {
+			runtimeLog.Errorf("%v: Failed to restart: %v", container.Id, err)
+			failed[container.Id] = true
+		}
+	}
+}
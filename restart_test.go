@@ -0,0 +1,133 @@
+package docker
+
+import (
+	"github.com/dotcloud/docker/api"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRestartPolicy(t *testing.T) {
+	for policy, expected := range map[string]restartPolicy{
+		"":             {Name: "no"},
+		"no":           {Name: "no"},
+		"always":       {Name: "always"},
+		"on-failure":   {Name: "on-failure"},
+		"on-failure:3": {Name: "on-failure", MaxRetries: 3},
+	} {
+		if parsed, err := parseRestartPolicy(policy); err != nil || parsed != expected {
+			t.Errorf("Expected %v for %q, got %v (%v)", expected, policy, parsed, err)
+		}
+	}
+	for _, invalid := range []string{"sometimes", "no:1", "always:3", "on-failure:", "on-failure:x", ":3"} {
+		if _, err := parseRestartPolicy(invalid); err == nil {
+			t.Errorf("%q should be refused", invalid)
+		}
+	}
+	config, _, err := ParseRun([]string{"-restart", "on-failure:3", "base", "true"}, ioutil.Discard)
+	if err != nil || config.Restart != "on-failure:3" {
+		t.Errorf("Unexpected restart policy: %q (%v)", config.Restart, err)
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	if delay := restartDelay(0, 0); delay != minRestartDelay {
+		t.Errorf("Expected %v before the first restart, got %v", minRestartDelay, delay)
+	}
+	if delay := restartDelay(3, time.Second); delay != 8*minRestartDelay {
+		t.Errorf("Expected the delay to double with each restart, got %v", delay)
+	}
+	if delay := restartDelay(100, time.Second); delay != maxRestartDelay {
+		t.Errorf("Expected at most %v, got %v", maxRestartDelay, delay)
+	}
+	if delay := restartDelay(100, resetRestartDelay); delay != minRestartDelay {
+		t.Errorf("Expected the delay to be reset once the container ran for a while, got %v", delay)
+	}
+}
+
+func TestRestartPolicy(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	container, err := runtime.Create(&Config{
+		Image:   GetTestImage(runtime).Id,
+		Cmd:     []string{"false"},
+		Restart: "on-failure:2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; container.RestartCount < 2 || container.State.Running; i++ {
+		if i > 100 {
+			t.Fatalf("Expected 2 restarts, got %d", container.RestartCount)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(2 * restartDelay(2, 0))
+	if container.RestartCount != 2 || container.State.Running {
+		t.Errorf("Expected the container to be restarted twice, got %d restarts", container.RestartCount)
+	}
+
+	// A container stopped by the operator isn't restarted
+	always := "always"
+	if err := container.Update(&api.Update{Restart: &always}); err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * restartDelay(container.RestartCount, 0))
+	if container.State.Running {
+		t.Errorf("A killed container shouldn't be restarted")
+	}
+}
+
+func TestStartOrder(t *testing.T) {
+	newContainer := func(id string, volumesFrom ...string) *Container {
+		return &Container{Id: id, Config: &Config{VolumesFrom: volumesFrom}}
+	}
+	ids := func(containers []*Container) string {
+		var ids []string
+		for _, container := range containers {
+			ids = append(ids, container.Id)
+		}
+		return strings.Join(ids, ",")
+	}
+	// app uses the volumes of data and of logs, which uses those of data,
+	// and other of a container which isn't restarted
+	ordered, err := startOrder([]*Container{
+		newContainer("app", "data", "logs:ro"),
+		newContainer("logs", "data"),
+		newContainer("other", "elsewhere"),
+		newContainer("data"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids(ordered) != "other,data,logs,app" {
+		t.Fatalf("Unexpected order: %s", ids(ordered))
+	}
+
+	ordered, err = startOrder([]*Container{
+		newContainer("a", "b"),
+		newContainer("b", "a"),
+		newContainer("c", "a"),
+		newContainer("d"),
+	})
+	if err == nil || err.Error() != "Dependency cycle between the containers a, b, c" {
+		t.Fatalf("Expected a dependency cycle, got %v", err)
+	}
+	if ids(ordered) != "d" {
+		t.Fatalf("Unexpected order: %s", ids(ordered))
+	}
+}
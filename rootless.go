@@ -0,0 +1,244 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// With -rootless, the daemon runs as an unprivileged user. It runs itself
+// again through rootlesskit, which creates a user namespace mapping root to
+// the user and the following ids to its subordinate ids, see subuid(5), and
+// mount and network namespaces. slirp4netns connects the network namespace
+// to the network of the host in userland, without privileges. In there, the
+// daemon is root of its namespaces: it creates its bridge, mounts the images
+// with fuse-overlayfs, see overlay.go, and starts the containers with lxc.
+// Root in the containers is the user on the host. The ports published are
+// exposed on the host by rootlesskit, through its API. The cgroups aren't
+// delegated to the user, so the containers have no resource limits nor
+// device whitelist, and can't create devices anyway.
+
+// The address of the bridge created in the network namespace
+const ROOTLESS_BRIDGE_ADDR = "10.0.3.1/24"
+
+// The MTU of the tap device of slirp4netns
+const rootlessMTU = 65520
+
+// InRootlessNamespace returns whether the daemon runs in the namespaces of
+// rootlesskit
+func InRootlessNamespace() bool {
+	return os.Getenv("ROOTLESSKIT_STATE_DIR") != ""
+}
+
+// rootlessRuntimeDir returns $XDG_RUNTIME_DIR, or the directory systemd
+// would give the user
+func rootlessRuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return fmt.Sprintf("/run/user/%d", os.Getuid())
+}
+
+// RootlessSocket returns the default API socket of a rootless daemon
+func RootlessSocket() string {
+	return path.Join(rootlessRuntimeDir(), "docker.sock")
+}
+
+// SetRootlessDefaults sets the root of the runtime and the storage driver
+// of a rootless daemon, unless they are set by the flags of fs
+func SetRootlessDefaults(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if name, isShorthand := daemonFlagShorthands[f.Name]; isShorthand {
+			given[name] = true
+		}
+	})
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		dataHome = path.Join(os.Getenv("HOME"), ".local", "share")
+	}
+	defaults := map[string]string{
+		"graph":          path.Join(dataHome, "docker"),
+		"storage-driver": "fuse-overlayfs",
+	}
+	for name, value := range defaults {
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RootlessExec runs the daemon again in the namespaces of rootlesskit, with
+// the same arguments. It only returns on error.
+func RootlessExec(args []string) error {
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("-rootless is for unprivileged users")
+	}
+	rootlesskit, err := exec.LookPath("rootlesskit")
+	if err != nil {
+		return fmt.Errorf("Rootless mode requires rootlesskit: %s", err)
+	}
+	if _, err := exec.LookPath("slirp4netns"); err != nil {
+		return fmt.Errorf("Rootless mode requires slirp4netns: %s", err)
+	}
+	// Root in the namespaces would get another default
+	runtimeDir := rootlessRuntimeDir()
+	os.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	params := []string{
+		"rootlesskit",
+		"--net=slirp4netns", fmt.Sprintf("--mtu=%d", rootlessMTU),
+		"--disable-host-loopback",
+		// /etc and /run become writable in the mount namespace
+		"--copy-up=/etc", "--copy-up=/run",
+		"--port-driver=builtin",
+		"--state-dir=" + path.Join(runtimeDir, "docker-rootless"),
+		"--", SelfPath(),
+	}
+	return syscall.Exec(rootlesskit, append(params, args[1:]...), os.Environ())
+}
+
+// setupRootlessNetwork creates the bridge in the network namespace of
+// rootlesskit if it doesn't exist, and masquerades the containers behind the
+// tap device of slirp4netns
+func setupRootlessNetwork(bridge string) error {
+	if _, err := net.InterfaceByName(bridge); err == nil {
+		return nil
+	}
+	_, network, err := net.ParseCIDR(ROOTLESS_BRIDGE_ADDR)
+	if err != nil {
+		return err
+	}
+	for _, args := range [][]string{
+		{"link", "add", bridge, "type", "bridge"},
+		{"addr", "add", ROOTLESS_BRIDGE_ADDR, "dev", bridge},
+		{"link", "set", bridge, "up"},
+	} {
+		if err := ipCommand(args...); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return err
+	}
+	return iptables("-t", "nat", "-A", "POSTROUTING", "-s", network.String(), "!", "-o", bridge, "-j", "MASQUERADE")
+}
+
+// checkRootlessLimits returns an error if config limits resources, which
+// can't be done in rootless mode
+func checkRootlessLimits(config *Config) error {
+	if config.Memory != 0 || config.MemorySwap != 0 || config.CpuShares != 0 || config.CpuQuota != 0 {
+		return fmt.Errorf("The resource limits aren't supported in rootless mode")
+	}
+	return nil
+}
+
+// rootlessPorts exposes the ports published in the network namespace of the
+// daemon on the host, through the API of rootlesskit on its state directory
+type rootlessPorts struct {
+	client *http.Client
+	ids    map[int]int // Ids of the ports of rootlesskit, by host port
+	lock   sync.Mutex
+}
+
+// rootlessPortSpec is a port exposed by rootlesskit
+type rootlessPortSpec struct {
+	Proto      string `json:"proto"`
+	ParentIP   string `json:"parentIP"`
+	ParentPort int    `json:"parentPort"`
+	ChildIP    string `json:"childIP"`
+	ChildPort  int    `json:"childPort"`
+}
+
+func newRootlessPorts(stateDir string) *rootlessPorts {
+	socket := path.Join(stateDir, "api.sock")
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}
+	return &rootlessPorts{
+		client: &http.Client{Transport: transport, Timeout: pluginTimeout},
+		ids:    make(map[int]int),
+	}
+}
+
+// call makes a request to the API of rootlesskit, and decodes its answer
+// into ret unless it is nil
+func (ports *rootlessPorts) call(method, url string, body, ret interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://rootlesskit"+url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := ports.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	answer, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("rootlesskit: %s: %s", res.Status, strings.TrimSpace(string(answer)))
+	}
+	if ret == nil {
+		return nil
+	}
+	return json.Unmarshal(answer, ret)
+}
+
+// Expose forwards port on the host to dest
+func (ports *rootlessPorts) Expose(port int, dest net.TCPAddr) error {
+	spec := &rootlessPortSpec{
+		Proto:      "tcp",
+		ParentIP:   "0.0.0.0",
+		ParentPort: port,
+		ChildIP:    dest.IP.String(),
+		ChildPort:  dest.Port,
+	}
+	var status struct {
+		ID int `json:"id"`
+	}
+	if err := ports.call("POST", "/v1/ports", spec, &status); err != nil {
+		return fmt.Errorf("Couldn't expose port %d on the host: %s", port, err)
+	}
+	ports.lock.Lock()
+	ports.ids[port] = status.ID
+	ports.lock.Unlock()
+	return nil
+}
+
+// Unexpose stops forwarding port on the host
+func (ports *rootlessPorts) Unexpose(port int) error {
+	ports.lock.Lock()
+	id, exists := ports.ids[port]
+	delete(ports.ids, port)
+	ports.lock.Unlock()
+	if !exists {
+		return fmt.Errorf("Port %d isn't exposed on the host", port)
+	}
+	return ports.call("DELETE", fmt.Sprintf("/v1/ports/%d", id), nil, nil)
+}
@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRootlessPorts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-rootless-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", path.Join(dir, "api.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fake API of rootlesskit
+	exposed := make(map[string]*rootlessPortSpec)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/ports":
+			spec := &rootlessPortSpec{}
+			json.NewDecoder(r.Body).Decode(spec)
+			exposed["7"] = spec
+			w.Write([]byte(`{"id": 7}`))
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/v1/ports/"):
+			delete(exposed, strings.TrimPrefix(r.URL.Path, "/v1/ports/"))
+		default:
+			http.NotFound(w, r)
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	ports := newRootlessPorts(dir)
+	if err := ports.Expose(49153, net.TCPAddr{IP: net.IPv4(10, 0, 3, 2), Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if spec := exposed["7"]; spec == nil || spec.ParentPort != 49153 || spec.ChildIP != "10.0.3.2" || spec.ChildPort != 80 {
+		t.Fatalf("Unexpected port exposed: %#v", spec)
+	}
+	if err := ports.Unexpose(49153); err != nil {
+		t.Fatal(err)
+	}
+	if len(exposed) != 0 {
+		t.Errorf("The port should be removed, got %v", exposed)
+	}
+	if err := ports.Unexpose(49153); err == nil {
+		t.Errorf("A port which isn't exposed can't be removed")
+	}
+}
+
+func TestSetRootlessDefaults(t *testing.T) {
+	config := DefaultDaemonConfig()
+	fs := flag.NewFlagSet("docker", flag.ContinueOnError)
+	config.InstallFlags(fs)
+	if err := fs.Parse([]string{"-rootless", "-g", "/srv/docker"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRootlessDefaults(fs); err != nil {
+		t.Fatal(err)
+	}
+	if config.Root != "/srv/docker" || config.StorageDriver != "fuse-overlayfs" {
+		t.Errorf("Unexpected defaults: %s %s", config.Root, config.StorageDriver)
+	}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,11 +3,14 @@ package docker
 import (
 	"container/list"
 	"fmt"
+	"github.com/dotcloud/docker/api"
 	"github.com/dotcloud/docker/auth"
+	"github.com/dotcloud/docker/rcli"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	goruntime "runtime"
 	"sort"
 	"sync"
 	"time"
@@ -20,7 +23,21 @@ type Runtime struct {
 	networkManager *NetworkManager
 	graph          *Graph
 	repositories   *TagStore
-	authConfig     *auth.AuthConfig
+	authConfigFile *auth.ConfigFile
+	// Registries which are reached over plain http instead of https
+	insecureRegistries []string
+	// Registries tried before the default index when pulling
+	registryMirrors []string
+	events          *EventBus
+	volumes         *VolumeStore
+	config          *DaemonConfig
+	remap           *UsernsRemap // Set with userns-remap
+	apparmor        bool         // Whether the containers are confined by AppArmor
+	labelsLock      sync.Mutex   // Held while the SELinux level of a container is allocated
+	trust           *TrustStore
+	scanners        imageScanners // Scan the images pulled and built, see scan.go
+	prestartHooks   prestartHooks // Add devices, mounts and env to the containers starting, see hooks.go
+	plugins         *PluginStore  // Daemon extensions, see plugin.go
 }
 
 var sysInitPath string
@@ -69,30 +86,68 @@ func (runtime *Runtime) Create(config *Config) (*Container, error) {
 	if err != nil {
 		return nil, err
 	}
+	if img.Config != nil {
+		MergeConfig(config, img.Config)
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	if runtime.config.Rootless {
+		if err := checkRootlessLimits(config); err != nil {
+			return nil, err
+		}
+	}
 	// Generate id
 	id := GenerateId()
 	// Generate default hostname
 	if config.Hostname == "" {
 		config.Hostname = id[:12]
 	}
+	if config.ReadOnly {
+		readOnlyTmpfs(config)
+	}
+	if config.Timezone == "" {
+		config.Timezone = runtime.config.DefaultTimezone
+	}
+	if config.ShmSize == 0 {
+		// Checked by Validate
+		config.ShmSize, _ = ParseSize(runtime.config.DefaultShmSize)
+	}
+	command := append(append([]string{}, config.Entrypoint...), config.Cmd...)
 	container := &Container{
 		// FIXME: we should generate the ID here instead of receiving it as an argument
 		Id:              id,
 		Created:         time.Now(),
-		Path:            config.Cmd[0],
-		Args:            config.Cmd[1:], //FIXME: de-duplicate from config
+		Path:            command[0],
+		Args:            command[1:], //FIXME: de-duplicate from config
 		Config:          config,
 		Image:           img.Id, // Always use the resolved image id
 		NetworkSettings: &NetworkSettings{},
 		// FIXME: do we need to store this in the container?
 		SysInitPath: sysInitPath,
+		LogDriver:   runtime.config.LogDriver,
 	}
 	container.root = runtime.containerRoot(container.Id)
+	runtime.labelsLock.Lock()
+	defer runtime.labelsLock.Unlock()
+	if err := runtime.setSecurityLabels(container); err != nil {
+		return nil, err
+	}
+	// The volumes of other containers are recorded right away, so that they
+	// are kept as long as the container exists
+	if err := runtime.inheritVolumes(container); err != nil {
+		return nil, err
+	}
 	// Step 1: create the container directory.
 	// This doubles as a barrier to avoid race conditions.
 	if err := os.Mkdir(container.root, 0700); err != nil {
 		return nil, err
 	}
+	if runtime.remap != nil {
+		if err := os.Chmod(container.root, 0711); err != nil {
+			return nil, err
+		}
+	}
 	// Step 2: save the container json
 	if err := container.ToDisk(); err != nil {
 		return nil, err
@@ -101,6 +156,7 @@ func (runtime *Runtime) Create(config *Config) (*Container, error) {
 	if err := runtime.Register(container); err != nil {
 		return nil, err
 	}
+	runtime.events.Log("create", container.Id, container.Image, nil)
 	return container, nil
 }
 
@@ -141,11 +197,13 @@ func (runtime *Runtime) Register(container *Container) error {
 		container.stdinPipe = NopWriteCloser(ioutil.Discard) // Silently drop stdin
 	}
 	// Setup logging of stdout and stderr to disk
-	if err := runtime.LogToDisk(container.stdout, container.logPath("stdout")); err != nil {
-		return err
-	}
-	if err := runtime.LogToDisk(container.stderr, container.logPath("stderr")); err != nil {
-		return err
+	if container.LogDriver != "none" {
+		if err := runtime.LogToDisk(container.stdout, container.logPath("stdout")); err != nil {
+			return err
+		}
+		if err := runtime.LogToDisk(container.stderr, container.logPath("stderr")); err != nil {
+			return err
+		}
 	}
 	// done
 	runtime.containers.PushBack(container)
@@ -182,24 +240,90 @@ func (runtime *Runtime) Destroy(container *Container) error {
 	if err := os.RemoveAll(container.root); err != nil {
 		return fmt.Errorf("Unable to remove filesystem for %v: %v", container.Id, err)
 	}
+	if err := container.removeVolumes(); err != nil {
+		return fmt.Errorf("Unable to remove the volumes of %v: %v", container.Id, err)
+	}
+	runtime.events.Log("destroy", container.Id, container.Image, nil)
+	return nil
+}
+
+// setSecurityLabels sets the AppArmor profile and the SELinux labels of a
+// new container, according to its security options
+func (runtime *Runtime) setSecurityLabels(container *Container) error {
+	options, err := parseSecurityOpts(container.Config.SecurityOpt)
+	if err != nil {
+		return err
+	}
+	if container.Config.Privileged {
+		// Privileged containers are unconfined and unlabeled
+		if runtime.remap != nil {
+			return fmt.Errorf("Privileged containers can't be run with userns-remap")
+		}
+		if runtime.apparmor {
+			container.AppArmorProfile = "unconfined"
+		}
+		return nil
+	}
+	if runtime.apparmor {
+		container.AppArmorProfile = DEFAULT_APPARMOR_PROFILE
+		if options.AppArmorProfile != "" {
+			container.AppArmorProfile = options.AppArmorProfile
+		}
+	} else if options.AppArmorProfile != "" && options.AppArmorProfile != "unconfined" {
+		return fmt.Errorf("AppArmor isn't enabled on this host")
+	}
+	if !runtime.config.SelinuxEnabled || options.LabelDisable {
+		return nil
+	}
+	// The level of a container is unique, so that the containers can't
+	// reach the files of each other
+	used := make(map[string]bool)
+	for _, c := range runtime.List() {
+		used[selinuxLevel(c.ProcessLabel)] = true
+	}
+	level := randomMcsLevel()
+	for used[level] {
+		level = randomMcsLevel()
+	}
+	container.ProcessLabel, container.MountLabel = selinuxLabels(options, level)
 	return nil
 }
 
 // Commit creates a new filesystem image from the current state of a container.
-// The image can optionally be tagged into a repository
-func (runtime *Runtime) Commit(id, repository, tag, comment string) (*Image, error) {
+// The image can optionally be tagged into a repository, and config, if not nil,
+// becomes the default configuration of containers created from the image.
+func (runtime *Runtime) Commit(id, repository, tag, comment string, config *Config) (*Image, error) {
+	return runtime.commit(id, repository, tag, comment, config, nil)
+}
+
+// commit commits the container like Commit, and stops registering its layer
+// once aborted is closed
+func (runtime *Runtime) commit(id, repository, tag, comment string, config *Config, aborted <-chan struct{}) (*Image, error) {
 	container := runtime.Get(id)
 	if container == nil {
 		return nil, fmt.Errorf("No such container: %s", id)
 	}
+	squashed, err := runtime.graph.squashCommit(container)
+	if err != nil {
+		return nil, err
+	}
 	// FIXME: freeze the container before copying it to avoid data corruption?
 	// FIXME: this shouldn't be in commands.
-	rwTar, err := container.ExportRw()
+	var rwTar Archive
+	if squashed {
+		var export io.ReadCloser
+		if export, err = container.Export(); err == nil {
+			defer export.Close()
+			rwTar = export
+		}
+	} else {
+		rwTar, err = container.ExportRw()
+	}
 	if err != nil {
 		return nil, err
 	}
 	// Create a new image from the container's base layers + a new layer from container changes
-	img, err := runtime.graph.Create(rwTar, container, comment)
+	img, err := runtime.graph.create(&abortableReader{rwTar, aborted}, container, comment, config, squashed)
 	if err != nil {
 		return nil, err
 	}
@@ -212,33 +336,205 @@ func (runtime *Runtime) Commit(id, repository, tag, comment string) (*Image, err
 	return img, nil
 }
 
+// Import creates a new base image from the contents of a tarball.
+// The image can optionally be tagged into a repository
+func (runtime *Runtime) Import(archive Archive, comment, repository, tag string) (*Image, error) {
+	img, err := runtime.graph.Create(archive, nil, comment, nil)
+	if err != nil {
+		return nil, err
+	}
+	if repository != "" {
+		if err := runtime.repositories.Set(repository, tag, img.Id, true); err != nil {
+			return img, err
+		}
+	}
+	return img, nil
+}
+
 func (runtime *Runtime) restore() error {
 	dir, err := ioutil.ReadDir(runtime.repository)
 	if err != nil {
 		return err
 	}
+	var stopped []*Container
 	for _, v := range dir {
 		id := v.Name()
 		container, err := runtime.Load(id)
 		if err != nil {
-			Debugf("Failed to load container %v: %v", id, err)
+			runtimeLog.Errorf("Failed to load container %v: %v", id, err)
 			continue
 		}
-		Debugf("Loaded container %v", container.Id)
+		runtimeLog.Debugf("Loaded container %v", container.Id)
+		if container.State.Running && container.Shim {
+			container.reconnectShim()
+		} else if container.Config.AutoRemove && !container.State.Running && !container.State.StartedAt.IsZero() {
+			// It exited while no daemon was running
+			if err := runtime.Destroy(container); err != nil {
+				runtimeLog.Errorf("Failed to remove container %v: %v", container.Id, err)
+			}
+		} else if container.StoppedByDaemon && !container.State.Running {
+			stopped = append(stopped, container)
+		}
 	}
+	runtime.restartStopped(stopped)
 	return nil
 }
 
+// Info returns the state of the runtime and of the host, and the settings
+// of the daemon
+func (runtime *Runtime) Info() *api.Info {
+	info := &api.Info{
+		StorageDriver:      runtime.config.StorageDriver,
+		Version:            VERSION,
+		GoVersion:          goruntime.Version(),
+		Root:               runtime.root,
+		BridgeIface:        runtime.config.BridgeIface,
+		LogDriver:          runtime.config.LogDriver,
+		DefaultUlimits:     runtime.config.DefaultUlimits,
+		DefaultDeviceRules: runtime.config.deviceRules(),
+		RegistryMirrors:    runtime.config.RegistryMirrors,
+		InsecureRegistries: runtime.config.InsecureRegistries,
+		LiveRestore:        runtime.config.LiveRestore,
+		Experimental:       runtime.config.Experimental,
+		Debug:              rcli.DEBUG_FLAG,
+	}
+	for _, container := range runtime.List() {
+		info.Containers++
+		if container.State.Running {
+			info.ContainersRunning++
+		} else {
+			info.ContainersStopped++
+		}
+	}
+	if images, err := runtime.graph.All(); err == nil {
+		info.Images = len(images)
+	}
+	supported := "no"
+	if filesystemSupported(storageDrivers[info.StorageDriver]) {
+		supported = "yes"
+	}
+	info.DriverStatus = [][2]string{
+		{"Root Dir", runtime.graph.Root},
+		{"Supported by the kernel", supported},
+	}
+	if version, err := KernelVersion(); err == nil {
+		info.KernelVersion = version
+	} else {
+		info.KernelVersion = "<unknown>"
+	}
+	info.MemoryLimit, info.SwapLimit = memoryLimitSupport()
+	info.CgroupVersion = cgroupVersion()
+	return info
+}
+
+// Shutdown stops the running containers within the shutdown timeout, except
+// the ones started through a shim with live-restore, then saves the state of
+// all the containers and unmounts the filesystems of the stopped ones.
+func (runtime *Runtime) Shutdown() error {
+	var running []*Container
+	left := 0
+	for _, container := range runtime.List() {
+		if !container.State.Running {
+			continue
+		}
+		if runtime.config.LiveRestore && container.Shim {
+			left++
+		} else {
+			running = append(running, container)
+		}
+	}
+	if left > 0 {
+		runtimeLog.Infof("Leaving %d running containers (live-restore)", left)
+	}
+	if len(running) > 0 {
+		runtimeLog.Infof("Stopping %d running containers", len(running))
+		errors := make(chan error, len(running))
+		for _, container := range running {
+			container.StoppedByDaemon = true
+			go func(container *Container) {
+				errors <- container.StopTimeout(runtime.config.ShutdownTimeout)
+			}(container)
+		}
+		for i := 0; i < len(running); i++ {
+			if err := <-errors; err != nil {
+				runtimeLog.Errorf("Failed to stop a container: %s", err)
+			}
+		}
+	}
+	var lastErr error
+	for _, container := range runtime.List() {
+		if err := container.ToDisk(); err != nil {
+			runtimeLog.Errorf("%v: Failed to save the state: %s", container.Id, err)
+			lastErr = err
+		}
+		if container.State.Running {
+			continue
+		}
+		if mounted, err := container.Mounted(); err == nil && mounted {
+			if err := container.Unmount(); err != nil {
+				runtimeLog.Errorf("%v: Failed to umount filesystem: %s", container.Id, err)
+				lastErr = err
+			}
+		}
+	}
+	if runtime.networkManager != nil {
+		runtime.networkManager.Close()
+	}
+	return lastErr
+}
+
 func NewRuntime() (*Runtime, error) {
-	return NewRuntimeFromDirectory("/var/lib/docker")
+	return NewRuntimeFromConfig(DefaultDaemonConfig())
 }
 
 func NewRuntimeFromDirectory(root string) (*Runtime, error) {
+	config := DefaultDaemonConfig()
+	config.Root = root
+	return NewRuntimeFromConfig(config)
+}
+
+func NewRuntimeFromConfig(config *DaemonConfig) (*Runtime, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if err := SetupLogging(config.LogLevel, config.LogFormat); err != nil {
+		return nil, err
+	}
+	if config.CgroupDriver == "systemd" {
+		if err := checkSystemdDriver(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Rootless {
+		if !InRootlessNamespace() {
+			return nil, fmt.Errorf("The rootless daemon must run in the namespaces of rootlesskit")
+		}
+		if err := setupRootlessNetwork(config.BridgeIface); err != nil {
+			return nil, err
+		}
+	}
+	root := config.Root
+	var remap *UsernsRemap
+	if config.UsernsRemap != "" {
+		var err error
+		if remap, err = LoadUsernsRemap(config.UsernsRemap, SUBUID_FILE, SUBGID_FILE); err != nil {
+			return nil, err
+		}
+		root = path.Join(root, remap.Dir())
+	}
 	runtimeRepo := path.Join(root, "containers")
 
 	if err := os.MkdirAll(runtimeRepo, 0700); err != nil && !os.IsExist(err) {
 		return nil, err
 	}
+	if remap != nil {
+		// The root of the containers must reach their filesystems
+		for _, dir := range []string{config.Root, root, runtimeRepo} {
+			if err := os.Chmod(dir, 0711); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	g, err := NewGraph(path.Join(root, "graph"))
 	if err != nil {
@@ -248,16 +544,54 @@ func NewRuntimeFromDirectory(root string) (*Runtime, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't create Tag store: %s", err)
 	}
-	netManager, err := newNetworkManager(networkBridgeIface)
+	netManager, err := newNetworkManager(config.BridgeIface, config.NetworkPoolSize)
+	if err != nil {
+		return nil, err
+	}
+	if config.Rootless {
+		netManager.portMapper.parent = newRootlessPorts(os.Getenv("ROOTLESSKIT_STATE_DIR"))
+	}
+	// Registry credentials are stored in the home directory of the user
+	// running the daemon
+	authRoot := os.Getenv("HOME")
+	if authRoot == "" {
+		authRoot = root
+	}
+	authConfigFile, err := auth.LoadConfig(authRoot)
 	if err != nil {
 		return nil, err
 	}
-	authConfig, err := auth.LoadConfig(root)
-	if err != nil && authConfig == nil {
-		// If the auth file does not exist, keep going
+
+	plugins := NewPluginStore(DEFAULT_PLUGIN_SOCKET_DIR, DEFAULT_PLUGIN_SPEC_DIRS)
+	volumes, err := NewVolumeStore(path.Join(root, "volumes"))
+	if err != nil {
+		return nil, err
+	}
+	volumes.plugins = plugins
+
+	trust, err := NewTrustStore(path.Join(root, "trust"))
+	if err != nil {
 		return nil, err
 	}
 
+	events := NewEventBus(EVENTS_HISTORY)
+	repositories.events = events
+	g.DownloadRetries = config.PullRetries
+	g.DownloadRetryDelay = config.PullRetryDelay
+	g.driver = config.StorageDriver
+	g.remap = remap
+	g.selinux = config.SelinuxEnabled
+	g.trust = trust
+	g.contentTrust = config.ContentTrust
+	g.foreignLayerHosts = config.ForeignLayerHosts
+	g.maxLayers = config.MaxLayers
+	g.squashLayers = config.SquashLayers
+	proxies, err := newRegistryProxies(config.HttpProxy, config.HttpsProxy, config.NoProxy, config.RegistryProxies)
+	if err != nil {
+		return nil, err
+	}
+	g.transport = proxies.Transport()
+
 	runtime := &Runtime{
 		root:           root,
 		repository:     runtimeRepo,
@@ -265,7 +599,32 @@ func NewRuntimeFromDirectory(root string) (*Runtime, error) {
 		networkManager: netManager,
 		graph:          g,
 		repositories:   repositories,
-		authConfig:     authConfig,
+		authConfigFile: authConfigFile,
+		events:         events,
+		volumes:        volumes,
+		plugins:        plugins,
+		config:         config,
+		remap:          remap,
+		trust:          trust,
+	}
+	events.labels = runtime.eventLabels
+	volumes.users = runtime.VolumeUsers
+	if apparmorEnabled() {
+		if err := installApparmorProfile(); err != nil {
+			runtimeLog.Warnf("%s: the containers won't be confined by AppArmor", err)
+		} else {
+			runtime.apparmor = true
+		}
+	}
+	if err := runtime.registerCommandScanners(config.Scanners); err != nil {
+		return nil, err
+	}
+	if err := runtime.registerCommandHooks(config.PrestartHooks); err != nil {
+		return nil, err
+	}
+	runtime.insecureRegistries = config.InsecureRegistries
+	for _, mirror := range config.RegistryMirrors {
+		runtime.registryMirrors = append(runtime.registryMirrors, mirrorEndpoint(mirror))
 	}
 
 	if err := runtime.restore(); err != nil {
@@ -274,6 +633,25 @@ func NewRuntimeFromDirectory(root string) (*Runtime, error) {
 	return runtime, nil
 }
 
+// eventLabels returns the labels of the container or image of an event
+func (runtime *Runtime) eventLabels(event *Event) map[string]string {
+	switch event.Type {
+	case "container":
+		if container := runtime.Get(event.Id); container != nil {
+			return container.Config.Labels
+		}
+		// Destroyed, only the labels of its image are left
+		if img, err := runtime.graph.Get(event.From); err == nil {
+			return img.Labels()
+		}
+	case "image":
+		if img, err := runtime.repositories.LookupImage(event.Id); err == nil {
+			return img.Labels()
+		}
+	}
+	return nil
+}
+
 type History []*Container
 
 func (history *History) Len() int {
@@ -0,0 +1,309 @@
+package docker
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	goruntime "runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 'docker save' writes images with their history to a tar archive, which
+// 'docker load' registers on another host:
+//
+//	repositories      {"REPOSITORY": {"TAG": "ID"}}, of the names saved
+//	manifest.json     The checksums of the images, see SavedImage
+//	ID/VERSION        1.0
+//	ID/json           The json of the image
+//	ID/layer.tar      The uncompressed archive of its layer
+//
+// On load, the layers whose parents are registered are extracted
+// concurrently, by as many workers as there are CPUs. VerifyImageArchive
+// checks an archive without loading it, see verify.go.
+
+// SavedImage holds the checksums of an image of a saved archive. The
+// archives saved before manifest.json was added have none.
+type SavedImage struct {
+	Id        string `json:"id"`
+	Json      string `json:"json"`  // sha256:HEX of ID/json
+	Layer     string `json:"layer"` // sha256:HEX of ID/layer.tar
+	LayerSize int64  `json:"layer_size"`
+}
+
+// savedNames resolves the names given to save: it returns the tags named,
+// whole repositories or REPOSITORY[:TAG], and the images named, by name.
+// The images named by REPOSITORY@DIGEST are saved without tag, like the
+// images named by id, since the archives only hold tags.
+func (srv *Server) savedNames(names []string) (map[string]Repository, []string, error) {
+	repositories := make(map[string]Repository)
+	var heads []string
+	for _, name := range names {
+		var ids []string
+		if repo, err := srv.runtime.repositories.Get(name); err != nil {
+			return nil, nil, err
+		} else if repo != nil {
+			// A whole repository
+			repositories[name] = repo
+			for _, id := range repo {
+				ids = append(ids, id)
+			}
+		} else {
+			img, err := srv.runtime.repositories.LookupImage(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, digest := splitDigest(name); img.Id != name && digest == "" {
+				repository, tag := parseRepositoryTag(name)
+				if tag == "" {
+					tag = DEFAULT_TAG
+				}
+				if repositories[repository] == nil {
+					repositories[repository] = make(Repository)
+				}
+				repositories[repository][tag] = img.Id
+			}
+			ids = append(ids, img.Id)
+		}
+		sort.Strings(ids)
+		heads = append(heads, ids...)
+	}
+	return repositories, heads, nil
+}
+
+// ImageSave writes the archive of the images, repositories and tags names
+// to w
+func (srv *Server) ImageSave(w io.Writer, names []string) error {
+	repositories, heads, err := srv.savedNames(names)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	saved := make(map[string]bool)
+	for _, id := range heads {
+		img, err := srv.runtime.graph.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := img.WalkHistory(func(img *Image) error {
+			if !saved[img.Id] {
+				saved[img.Id] = true
+				ids = append(ids, img.Id)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	tw := tar.NewWriter(w)
+	var manifest []*SavedImage
+	for _, id := range ids {
+		saved, err := srv.runtime.graph.saveImage(tw, id)
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, saved)
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "manifest.json", data); err != nil {
+		return err
+	}
+	data, err = json.Marshal(repositories)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "repositories", data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// saveImage writes the directory of the image id to tw, and returns its
+// checksums. The archive of the layer is made in a temporary file first,
+// for the size of its header.
+func (graph *Graph) saveImage(tw *tar.Writer, id string) (*SavedImage, error) {
+	jsonData, err := ioutil.ReadFile(jsonPath(graph.imageRoot(id)))
+	if err != nil {
+		return nil, err
+	}
+	layer, err := graph.TarLayer(id, Uncompressed)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "docker-save-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), layer)
+	if err != nil {
+		return nil, err
+	}
+	saved := &SavedImage{Id: id, Json: digestOf(jsonData), Layer: "sha256:" + hex.EncodeToString(h.Sum(nil)), LayerSize: size}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: id + "/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: time.Now()}); err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, id+"/VERSION", []byte("1.0")); err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, id+"/json", jsonData); err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: id + "/layer.tar", Mode: 0644, Size: size, ModTime: time.Now()}); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tw, tmp); err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// ImageLoad registers the images of an archive written by ImageSave, and
+// tags them
+func (srv *Server) ImageLoad(archive io.Reader, stdout io.Writer) error {
+	dir, err := ioutil.TempDir("", "docker-load-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := Untar(archive, dir); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	images := make(map[string]*Image)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, entry.Name(), "json"))
+		if err != nil {
+			return fmt.Errorf("Invalid archive: %s", err)
+		}
+		img := &Image{}
+		if err := json.Unmarshal(data, img); err != nil {
+			return fmt.Errorf("Invalid archive: the json of %s: %s", entry.Name(), err)
+		}
+		if img.Id != entry.Name() {
+			return fmt.Errorf("Invalid archive: %s holds the image %s", entry.Name(), img.Id)
+		}
+		images[img.Id] = img
+	}
+	if err := srv.runtime.graph.loadImages(dir, images, goruntime.NumCPU(), stdout); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path.Join(dir, "repositories"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	repositories := make(map[string]Repository)
+	if err := json.Unmarshal(data, &repositories); err != nil {
+		return fmt.Errorf("Invalid archive: %s", err)
+	}
+	for name, repo := range repositories {
+		for tag, id := range repo {
+			if err := srv.runtime.repositories.Set(name, tag, id, true); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "Loaded %s:%s\n", name, tag)
+		}
+	}
+	return nil
+}
+
+// loadImages registers the images extracted in dir, each once its parent is
+// registered, by at most workers at a time. The images which already exist
+// are skipped.
+func (graph *Graph) loadImages(dir string, images map[string]*Image, workers int, stdout io.Writer) error {
+	// The images of a cycle would wait for each other forever
+	for id, img := range images {
+		seen := map[string]bool{id: true}
+		for parent := img.Parent; images[parent] != nil; parent = images[parent].Parent {
+			if seen[parent] {
+				return fmt.Errorf("Invalid archive: the history of %s has a cycle through %s", id, parent)
+			}
+			seen[parent] = true
+		}
+	}
+	type result struct {
+		done chan struct{}
+		err  error
+	}
+	results := make(map[string]*result, len(images))
+	for id := range images {
+		results[id] = &result{done: make(chan struct{})}
+	}
+	slots := make(chan bool, workers)
+	var outputLock sync.Mutex
+	load := func(img *Image) error {
+		if parent, exists := results[img.Parent]; exists {
+			<-parent.done
+			if parent.err != nil {
+				return errParentNotLoaded
+			}
+		}
+		if graph.Exists(img.Id) {
+			return nil
+		}
+		slots <- true
+		defer func() { <-slots }()
+		layer, err := os.Open(path.Join(dir, img.Id, "layer.tar"))
+		if err != nil {
+			return fmt.Errorf("Invalid archive: %s", err)
+		}
+		defer layer.Close()
+		if err := graph.Register(layer, img); err != nil {
+			return err
+		}
+		outputLock.Lock()
+		fmt.Fprintf(stdout, "Loaded image %s\n", img.Id)
+		outputLock.Unlock()
+		return nil
+	}
+	for id, img := range images {
+		go func(r *result, img *Image) {
+			r.err = load(img)
+			close(r.done)
+		}(results[id], img)
+	}
+	// Report the error of an image rather than of its children
+	var err error
+	for _, r := range results {
+		<-r.done
+		if r.err != nil && (err == nil || err == errParentNotLoaded) {
+			err = r.err
+		}
+	}
+	return err
+}
+
+var errParentNotLoaded = errors.New("The parent of the image couldn't be loaded")
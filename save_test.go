@@ -0,0 +1,128 @@
+package docker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	newServer := func() *Server {
+		graph := tempGraph(t)
+		store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Server{runtime: &Runtime{graph: graph, repositories: store}}
+	}
+	srv := newServer()
+	defer os.RemoveAll(srv.runtime.graph.Root)
+	// Two branches on the same base
+	base := &Image{Id: GenerateId(), Comment: "base"}
+	var children []*Image
+	for _, img := range []*Image{base, {Id: GenerateId(), Parent: base.Id}, {Id: GenerateId(), Parent: base.Id}} {
+		if err := srv.runtime.graph.Register(testArchive(t), img); err != nil {
+			t.Fatal(err)
+		}
+		if img != base {
+			children = append(children, img)
+		}
+	}
+	if err := srv.runtime.repositories.Set("app", "v1", children[0].Id, true); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := srv.ImageSave(&archive, []string{"app:v1", children[1].Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv2 := newServer()
+	defer os.RemoveAll(srv2.runtime.graph.Root)
+	var output bytes.Buffer
+	if err := srv2.ImageLoad(&archive, &output); err != nil {
+		t.Fatal(err)
+	}
+	for _, img := range append(children, base) {
+		loaded, err := srv2.runtime.graph.Get(img.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Parent != img.Parent {
+			t.Errorf("Expected %s to have the parent %s, got %s", img.Id, img.Parent, loaded.Parent)
+		}
+	}
+	if img, err := srv2.runtime.repositories.LookupImage("app:v1"); err != nil || img.Id != children[0].Id {
+		t.Fatalf("Expected app:v1 to refer to %s, got %v (%v)", children[0].Id, img, err)
+	}
+	if !bytes.Contains(output.Bytes(), []byte("Loaded app:v1")) {
+		t.Errorf("Unexpected output: %s", output.String())
+	}
+}
+
+func TestLoadImagesParentFailed(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	dir, err := ioutil.TempDir("", "docker-load-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The layer of the parent is missing
+	parent := &Image{Id: "parent"}
+	child := &Image{Id: "child", Parent: "parent"}
+	if err := os.MkdirAll(path.Join(dir, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "child", "layer.tar"), testLayer(t, false, "etc/motd", "hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = graph.loadImages(dir, map[string]*Image{"parent": parent, "child": child}, 2, ioutil.Discard)
+	if err == nil || err == errParentNotLoaded {
+		t.Fatalf("Expected the error of the parent, got %v", err)
+	}
+	if graph.Exists("child") {
+		t.Fatalf("The child of an image which failed to load shouldn't be loaded")
+	}
+}
+
+func TestLoadImagesCycle(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	for _, images := range []map[string]*Image{
+		{"self": {Id: "self", Parent: "self"}},
+		{"a": {Id: "a", Parent: "b"}, "b": {Id: "b", Parent: "a"}, "c": {Id: "c", Parent: "a"}},
+	} {
+		err := graph.loadImages(graph.Root, images, 2, ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), "cycle") {
+			t.Errorf("Expected a cycle to be refused, got %v", err)
+		}
+	}
+}
+
+func TestSavedNamesDigest(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{runtime: &Runtime{graph: graph, repositories: store}}
+	img := &Image{Id: GenerateId()}
+	if err := graph.Register(testArchive(t), img); err != nil {
+		t.Fatal(err)
+	}
+	digest := "sha256:" + GenerateId()
+	if err := store.SetDigest("app", digest, img.Id); err != nil {
+		t.Fatal(err)
+	}
+	repositories, heads, err := srv.savedNames([]string{"app@" + digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repositories) != 0 || len(heads) != 1 || heads[0] != img.Id {
+		t.Errorf("Expected %s to be saved without tag, got %v %v", img.Id, repositories, heads)
+	}
+}
@@ -0,0 +1,273 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ImageScanner inspects the content of images, eg. for packages with
+// known vulnerabilities. The scanners registered with the runtime scan the
+// images pulled and built, and their reports are shown by inspect.
+type ImageScanner interface {
+	// Scan inspects an image, given with its layers, the layer of its base
+	// image first
+	Scan(img *Image, layers []ScanLayer) (*ScanReport, error)
+}
+
+// ScanLayer is a layer given to a scanner, which opens it as an
+// uncompressed tar archive only if it needs it
+type ScanLayer struct {
+	Id   string
+	Open func() (Archive, error)
+}
+
+type ScanReport struct {
+	Scanner         string
+	Time            time.Time
+	Vulnerabilities []Vulnerability
+}
+
+type Vulnerability struct {
+	Id           string // eg. CVE-2013-1234
+	Package      string
+	Version      string
+	FixedVersion string `json:",omitempty"`
+	Severity     string // low, medium, high or critical
+	Layer        string `json:",omitempty"` // Id of the image whose layer brings the package
+}
+
+var vulnerabilitySeverities = []string{"critical", "high", "medium", "low"}
+
+// Summary counts the vulnerabilities by severity, eg.
+// "3 vulnerabilities (1 high, 2 low)"
+func (report *ScanReport) Summary() string {
+	if len(report.Vulnerabilities) == 0 {
+		return "no vulnerabilities"
+	}
+	counts := make(map[string]int)
+	for _, vulnerability := range report.Vulnerabilities {
+		counts[strings.ToLower(vulnerability.Severity)]++
+	}
+	var parts []string
+	for _, severity := range vulnerabilitySeverities {
+		if counts[severity] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[severity], severity))
+			delete(counts, severity)
+		}
+	}
+	var others int
+	for _, count := range counts {
+		others += count
+	}
+	if others > 0 {
+		parts = append(parts, fmt.Sprintf("%d unknown", others))
+	}
+	return fmt.Sprintf("%d vulnerabilities (%s)", len(report.Vulnerabilities), strings.Join(parts, ", "))
+}
+
+// commandScanner runs an external scanner: COMMAND IMAGE_ID, with a tar
+// archive of the layers on stdin, ID/layer.tar for each layer, the layer of
+// the base image first. It writes a JSON object with the Vulnerabilities on
+// stdout.
+type commandScanner struct {
+	command string
+}
+
+func (scanner *commandScanner) Scan(img *Image, layers []ScanLayer) (*ScanReport, error) {
+	cmd := exec.Command(scanner.command, img.Id)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	writeErr := make(chan error, 1)
+	go func() {
+		err := writeScanLayers(stdin, layers)
+		stdin.Close()
+		writeErr <- err
+	}()
+	report := &ScanReport{}
+	decodeErr := json.NewDecoder(stdout).Decode(report)
+	io.Copy(ioutil.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("%s failed: %s %s", scanner.command, err, strings.TrimSpace(stderr.String()))
+	}
+	// The scanner may not read all the layers
+	if err := <-writeErr; err != nil && decodeErr != nil {
+		return nil, err
+	}
+	if decodeErr != nil {
+		return nil, fmt.Errorf("Invalid report of %s: %s", scanner.command, decodeErr)
+	}
+	return report, nil
+}
+
+// writeScanLayers writes the layers to w as a tar archive of the layer
+// archives, which are buffered to know their size
+func writeScanLayers(w io.Writer, layers []ScanLayer) error {
+	tw := tar.NewWriter(w)
+	for _, layer := range layers {
+		archive, err := layer.Open()
+		if err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile("", "docker-scan-")
+		if err != nil {
+			return err
+		}
+		size, err := io.Copy(tmp, archive)
+		if err == nil {
+			_, err = tmp.Seek(0, 0)
+		}
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: layer.Id + "/layer.tar", Mode: 0644, Size: size, Typeflag: tar.TypeReg, ModTime: time.Now()})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, tmp)
+		}
+		tmp.Close()
+		os.Remove(tmp.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// The scanners of a runtime, by name
+type imageScanners struct {
+	scanners map[string]ImageScanner
+	lock     sync.Mutex
+}
+
+// RegisterScanner adds a scanner, which scans the images pulled or built
+// after it is registered
+func (runtime *Runtime) RegisterScanner(name string, scanner ImageScanner) error {
+	runtime.scanners.lock.Lock()
+	defer runtime.scanners.lock.Unlock()
+	if _, exists := runtime.scanners.scanners[name]; exists {
+		return fmt.Errorf("Image scanner %s is already registered", name)
+	}
+	if runtime.scanners.scanners == nil {
+		runtime.scanners.scanners = make(map[string]ImageScanner)
+	}
+	runtime.scanners.scanners[name] = scanner
+	return nil
+}
+
+// registerCommandScanners registers the scanners of the daemon settings,
+// named after their commands
+func (runtime *Runtime) registerCommandScanners(commands []string) error {
+	for _, command := range commands {
+		if err := runtime.RegisterScanner(path.Base(command), &commandScanner{command: command}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanImage scans an image with every scanner, and stores their reports
+// with it. A scanner failing doesn't fail the others.
+func (runtime *Runtime) ScanImage(stdout io.Writer, img *Image) error {
+	runtime.scanners.lock.Lock()
+	var names []string
+	scanners := make(map[string]ImageScanner)
+	for name, scanner := range runtime.scanners.scanners {
+		names = append(names, name)
+		scanners[name] = scanner
+	}
+	runtime.scanners.lock.Unlock()
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	history, err := img.History()
+	if err != nil {
+		return err
+	}
+	var layers []ScanLayer
+	for i := len(history) - 1; i >= 0; i-- {
+		id := history[i].Id
+		layers = append(layers, ScanLayer{Id: id, Open: func() (Archive, error) {
+			return runtime.graph.TarLayer(id, Uncompressed)
+		}})
+	}
+	var lastErr error
+	for _, name := range names {
+		fmt.Fprintf(stdout, "Scanning %s with %s\n", Trunc(img.Id, 12), name)
+		report, err := scanners[name].Scan(img, layers)
+		if err != nil {
+			fmt.Fprintf(stdout, "Error scanning %s with %s: %s\n", Trunc(img.Id, 12), name, err)
+			graphLog.Errorf("Scanning %s with %s failed: %s", img.Id, name, err)
+			lastErr = err
+			continue
+		}
+		report.Scanner = name
+		report.Time = time.Now()
+		if err := runtime.graph.SetScanReport(img.Id, report); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s: %s\n", Trunc(img.Id, 12), report.Summary())
+		runtime.events.Log("scan", img.Id, "", map[string]string{"scanner": name, "vulnerabilities": fmt.Sprint(len(report.Vulnerabilities))})
+	}
+	return lastErr
+}
+
+func (graph *Graph) scansPath(id string) string {
+	return path.Join(graph.imageRoot(id), "scans")
+}
+
+// ScanReports returns the last report of each scanner on an image
+func (graph *Graph) ScanReports(id string) (map[string]*ScanReport, error) {
+	data, err := ioutil.ReadFile(graph.scansPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	reports := make(map[string]*ScanReport)
+	if err := json.Unmarshal(data, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// SetScanReport stores a report with an image, replacing the previous
+// report of the same scanner
+func (graph *Graph) SetScanReport(id string, report *ScanReport) error {
+	graph.scansLock.Lock()
+	defer graph.scansLock.Unlock()
+	reports, err := graph.ScanReports(id)
+	if err != nil {
+		return err
+	}
+	if reports == nil {
+		reports = make(map[string]*ScanReport)
+	}
+	reports[report.Scanner] = report
+	data, err := json.Marshal(reports)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(graph.scansPath(id), data, 0600)
+}
@@ -0,0 +1,131 @@
+package docker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestScanReportSummary(t *testing.T) {
+	report := &ScanReport{}
+	if report.Summary() != "no vulnerabilities" {
+		t.Errorf("Unexpected summary: %s", report.Summary())
+	}
+	report.Vulnerabilities = []Vulnerability{{Severity: "low"}, {Severity: "HIGH"}, {Severity: "low"}, {Severity: "bogus"}}
+	if report.Summary() != "4 vulnerabilities (1 high, 2 low, 1 unknown)" {
+		t.Errorf("Unexpected summary: %s", report.Summary())
+	}
+}
+
+func TestCommandScanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-scanner-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Reports the layers it received as packages
+	script := path.Join(dir, "scanner")
+	if err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+layers=$(tar tf - | tr '\n' ' ')
+echo "{\"Vulnerabilities\": [{\"Id\": \"CVE-2013-0001\", \"Package\": \"$1 $layers\", \"Severity\": \"high\"}]}"
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+	layer := func(id string) ScanLayer {
+		return ScanLayer{Id: id, Open: func() (Archive, error) {
+			return bytes.NewReader([]byte("layer " + id)), nil
+		}}
+	}
+	report, err := (&commandScanner{command: script}).Scan(&Image{Id: "top"}, []ScanLayer{layer("base"), layer("top")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Vulnerabilities) != 1 || strings.TrimSpace(report.Vulnerabilities[0].Package) != "top base/layer.tar top/layer.tar" {
+		t.Errorf("Unexpected report: %v", report)
+	}
+	if _, err := (&commandScanner{command: "/bin/false"}).Scan(&Image{Id: "top"}, nil); err == nil {
+		t.Errorf("A failing scanner should fail the scan")
+	}
+}
+
+func TestScanReports(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	if err := os.MkdirAll(graph.imageRoot("abc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if reports, err := graph.ScanReports("abc"); err != nil || reports != nil {
+		t.Errorf("Expected no reports, got %v (%v)", reports, err)
+	}
+	for _, report := range []*ScanReport{
+		{Scanner: "clair", Vulnerabilities: []Vulnerability{{Id: "CVE-2013-0001"}}},
+		{Scanner: "trivy"},
+		{Scanner: "clair"},
+	} {
+		if err := graph.SetScanReport("abc", report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reports, err := graph.ScanReports("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last report of each scanner is kept
+	if len(reports) != 2 || reports["clair"] == nil || len(reports["clair"].Vulnerabilities) != 0 || reports["trivy"] == nil {
+		t.Errorf("Unexpected reports: %v", reports)
+	}
+}
+
+type testScanner struct {
+	layers []string
+}
+
+func (scanner *testScanner) Scan(img *Image, layers []ScanLayer) (*ScanReport, error) {
+	for _, layer := range layers {
+		archive, err := layer.Open()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := ioutil.ReadAll(archive); err != nil {
+			return nil, err
+		}
+		scanner.layers = append(scanner.layers, layer.Id)
+	}
+	return &ScanReport{Vulnerabilities: []Vulnerability{{Id: "CVE-2013-0001", Severity: "critical"}}}, nil
+}
+
+func TestScanImage(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	scanner := &testScanner{}
+	if err := runtime.RegisterScanner("test", scanner); err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.RegisterScanner("test", scanner); err == nil {
+		t.Errorf("Registering a scanner twice should fail")
+	}
+	img := GetTestImage(runtime)
+	output := &bytes.Buffer{}
+	if err := runtime.ScanImage(output, img); err != nil {
+		t.Fatal(err)
+	}
+	if len(scanner.layers) == 0 || scanner.layers[len(scanner.layers)-1] != img.Id {
+		t.Errorf("Expected the layers up to %s, got %v", img.Id, scanner.layers)
+	}
+	if !strings.Contains(output.String(), "1 vulnerabilities (1 critical)") {
+		t.Errorf("Unexpected output: %s", output)
+	}
+	reports, err := runtime.graph.ScanReports(img.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := reports["test"]; report == nil || report.Scanner != "test" || report.Time.IsZero() {
+		t.Errorf("Unexpected reports: %v", reports)
+	}
+}
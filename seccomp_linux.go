@@ -0,0 +1,72 @@
+package docker
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// The offsets of the fields of struct seccomp_data
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+const AUDIT_ARCH_X86_64 = 0xc000003e
+
+// compile returns the BPF program of the profile
+func (p *SeccompProfile) compile() ([]syscall.SockFilter, error) {
+	actions, defaultAction, err := p.rules()
+	if err != nil {
+		return nil, err
+	}
+	filter := []syscall.SockFilter{
+		// Kill the processes using another architecture, whose system calls
+		// have other numbers
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, AUDIT_ARCH_X86_64, 1, 0),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, SECCOMP_RET_KILL),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+		// The x32 system calls share the architecture, with this bit set
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, 0x40000000, 0, 1),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, SECCOMP_RET_ERRNO|SECCOMP_EPERM),
+	}
+	for _, action := range actions {
+		filter = append(filter,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, uint32(action.nr), 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, action.action),
+		)
+	}
+	filter = append(filter, bpfStmt(syscall.BPF_RET|syscall.BPF_K, defaultAction))
+	return filter, nil
+}
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+const (
+	PR_SET_SECCOMP      = 22
+	SECCOMP_MODE_FILTER = 2
+)
+
+// applySeccomp filters the system calls of the process, and of the
+// programs it executes, with the profile. It needs sys_admin.
+func applySeccomp(p *SeccompProfile) error {
+	filter, err := p.compile()
+	if err != nil {
+		return err
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_SECCOMP, SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("Unable to apply the seccomp profile: %s", errno)
+	}
+	return nil
+}
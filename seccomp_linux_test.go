@@ -0,0 +1,134 @@
+package docker
+
+import (
+	"syscall"
+	"testing"
+)
+
+// runFilter interprets the instructions of the seccomp filters for a system
+// call
+func runFilter(t *testing.T, filter []syscall.SockFilter, arch uint32, nr int) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		inst := filter[pc]
+		switch inst.Code {
+		case syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS:
+			if inst.K == seccompDataArch {
+				acc = arch
+			} else {
+				acc = uint32(nr)
+			}
+		case syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K:
+			if acc == inst.K {
+				pc += int(inst.Jt)
+			} else {
+				pc += int(inst.Jf)
+			}
+		case syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K:
+			if acc >= inst.K {
+				pc += int(inst.Jt)
+			} else {
+				pc += int(inst.Jf)
+			}
+		case syscall.BPF_RET | syscall.BPF_K:
+			return inst.K
+		default:
+			t.Fatalf("Unexpected instruction %#v", inst)
+		}
+	}
+	t.Fatalf("The filter doesn't return")
+	return 0
+}
+
+func TestSeccompProfile(t *testing.T) {
+	if profile, err := ParseSeccompProfile(SECCOMP_UNCONFINED); err != nil || profile != nil {
+		t.Errorf("Unconfined containers shouldn't have a profile, got %v (%v)", profile, err)
+	}
+	profile, err := ParseSeccompProfile(SECCOMP_DEFAULT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := profile.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny := SECCOMP_RET_ERRNO | uint32(syscall.EPERM)
+	for nr, expected := range map[int]uint32{
+		syscall.SYS_READ:               SECCOMP_RET_ALLOW,
+		syscall.SYS_EXECVE:             SECCOMP_RET_ALLOW,
+		syscall.SYS_MOUNT:              deny,
+		syscall.SYS_PTRACE:             deny,
+		308:                            deny, // setns
+		0x40000000 | syscall.SYS_MOUNT: deny,
+	} {
+		if action := runFilter(t, filter, AUDIT_ARCH_X86_64, nr); action != expected {
+			t.Errorf("System call %d: expected %#x, got %#x", nr, expected, action)
+		}
+	}
+	// i386 system calls
+	if action := runFilter(t, filter, 0x40000003, syscall.SYS_READ); action != SECCOMP_RET_KILL {
+		t.Errorf("Other architectures should be killed, got %#x", action)
+	}
+
+	profile, err = ParseSeccompProfile(`{"defaultAction": "SCMP_ACT_ERRNO", "syscalls": [{"names": ["read", "write"], "action": "SCMP_ACT_ALLOW"}, {"names": ["write", "getpid"], "action": "SCMP_ACT_KILL"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter, err = profile.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for nr, expected := range map[int]uint32{
+		syscall.SYS_READ:   SECCOMP_RET_ALLOW,
+		syscall.SYS_WRITE:  SECCOMP_RET_ALLOW,
+		syscall.SYS_GETPID: SECCOMP_RET_KILL,
+		syscall.SYS_OPEN:   deny,
+	} {
+		if action := runFilter(t, filter, AUDIT_ARCH_X86_64, nr); action != expected {
+			t.Errorf("System call %d: expected %#x, got %#x", nr, expected, action)
+		}
+	}
+
+	for _, invalid := range []string{
+		"{",
+		`{"defaultAction": "SCMP_ACT_LOG"}`,
+		`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["frobnicate"], "action": "SCMP_ACT_ERRNO"}]}`,
+		`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["read"], "action": "DENY"}]}`,
+	} {
+		if _, err := ParseSeccompProfile(invalid); err == nil {
+			t.Errorf("%s should be invalid", invalid)
+		}
+	}
+}
+
+func TestSeccompContainer(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	for seccomp, expected := range map[string]string{
+		SECCOMP_DEFAULT: "denied",
+		`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["mkdir"], "action": "SCMP_ACT_ERRNO"}]}`: "denied",
+		SECCOMP_UNCONFINED: "allowed",
+	} {
+		container, err := runtime.Create(&Config{
+			Image: GetTestImage(runtime).Id,
+			// mkdir is denied by the custom profile, and unshare by the default one
+			Cmd:     []string{"sh", "-c", "if unshare -m true 2>/dev/null && mkdir /tmp/seccomp; then echo -n allowed; else echo -n denied; fi"},
+			CapAdd:  []string{"sys_admin"},
+			Seccomp: seccomp,
+		},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := container.Output()
+		runtime.Destroy(container)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != expected {
+			t.Errorf("%q: expected %s, got %s", seccomp, expected, output)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// The security options of a container, given as KEY=VALUE:
+//  - apparmor=PROFILE: the AppArmor profile of the container, or unconfined
+//  - label=user:USER, label=role:ROLE, label=type:TYPE, label=level:LEVEL:
+//    parts of the SELinux label of the container
+//  - label=disable: no SELinux label
+//  - no-new-privileges[=true|false]: the processes of the container can't
+//    gain privileges, eg. by executing setuid programs
+type securityOptions struct {
+	AppArmorProfile string
+	NoNewPrivileges bool
+	LabelDisable    bool
+	LabelUser       string
+	LabelRole       string
+	LabelType       string
+	LabelLevel      string
+}
+
+func parseSecurityOpts(opts []string) (*securityOptions, error) {
+	options := &securityOptions{}
+	for _, opt := range opts {
+		if opt == "no-new-privileges" {
+			options.NoNewPrivileges = true
+			continue
+		}
+		parts := strings.SplitN(opt, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid security option: %s (expected KEY=VALUE)", opt)
+		}
+		switch key, value := parts[0], parts[1]; key {
+		case "apparmor":
+			options.AppArmorProfile = value
+		case "no-new-privileges":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid security option: %s (expected no-new-privileges=true or false)", opt)
+			}
+			options.NoNewPrivileges = enabled
+		case "label":
+			if value == "disable" {
+				options.LabelDisable = true
+				continue
+			}
+			labelParts := strings.SplitN(value, ":", 2)
+			if len(labelParts) != 2 || labelParts[1] == "" {
+				return nil, fmt.Errorf("Invalid security option: %s (expected label=disable or label=PART:VALUE)", opt)
+			}
+			switch labelParts[0] {
+			case "user":
+				options.LabelUser = labelParts[1]
+			case "role":
+				options.LabelRole = labelParts[1]
+			case "type":
+				options.LabelType = labelParts[1]
+			case "level":
+				options.LabelLevel = labelParts[1]
+			default:
+				return nil, fmt.Errorf("Invalid security option: %s (the parts of a label are user, role, type and level)", opt)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown security option: %s", key)
+		}
+	}
+	return options, nil
+}
+
+// AppArmor
+
+const DEFAULT_APPARMOR_PROFILE = "docker-default"
+
+// Where the default profile is written for apparmor_parser
+const APPARMOR_PROFILE_PATH = "/etc/apparmor.d/docker"
+
+// The default profile lets the containers do what root can do in them, but
+// not mount filesystems or write to the settings of the kernel
+const apparmorProfileTemplate = `
+#include <tunables/global>
+
+profile {{.Name}} flags=(attach_disconnected,mediate_deleted) {
+  #include <abstractions/base>
+
+  network,
+  capability,
+  file,
+  umount,
+
+  deny @{PROC}/sys/fs/** wklx,
+  deny @{PROC}/sysrq-trigger rwklx,
+  deny @{PROC}/mem rwklx,
+  deny @{PROC}/kmem rwklx,
+  deny @{PROC}/sys/kernel/[^s][^h][^m]* wklx,
+  deny @{PROC}/sys/kernel/*/** wklx,
+
+  deny mount,
+
+  deny /sys/[^f]*/** wklx,
+  deny /sys/f[^s]*/** wklx,
+  deny /sys/fs/[^c]*/** wklx,
+  deny /sys/fs/c[^g]*/** wklx,
+  deny /sys/fs/cg[^r]*/** wklx,
+  deny /sys/firmware/efi/efivars/** rwklx,
+  deny /sys/kernel/security/** rwklx,
+}
+`
+
+var apparmorProfileCompiled = template.Must(template.New("apparmor").Parse(apparmorProfileTemplate))
+
+func apparmorProfile(name string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := apparmorProfileCompiled.Execute(&buf, struct{ Name string }{name}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// apparmorEnabled returns whether the kernel enforces AppArmor profiles,
+// and the profiles can be loaded
+func apparmorEnabled() bool {
+	if _, err := exec.LookPath("apparmor_parser"); err != nil {
+		return false
+	}
+	enabled, err := ioutil.ReadFile("/sys/module/apparmor/parameters/enabled")
+	return err == nil && len(enabled) > 0 && enabled[0] == 'Y'
+}
+
+// installApparmorProfile writes the default profile, and loads it in the
+// kernel, replacing the one loaded by a previous daemon
+func installApparmorProfile() error {
+	profile, err := apparmorProfile(DEFAULT_APPARMOR_PROFILE)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(APPARMOR_PROFILE_PATH), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(APPARMOR_PROFILE_PATH, profile, 0644); err != nil {
+		return err
+	}
+	if output, err := exec.Command("apparmor_parser", "-r", "-W", APPARMOR_PROFILE_PATH).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to load the AppArmor profile: %s (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// SELinux
+
+// The labels of the processes and files of the containers, completed with a
+// level: the shared level, or a level with categories unique to a container
+const (
+	SELINUX_PROCESS_LABEL = "system_u:system_r:svirt_lxc_net_t"
+	SELINUX_FILE_LABEL    = "system_u:object_r:svirt_sandbox_file_t"
+	SELINUX_SHARED_LEVEL  = "s0"
+)
+
+// The categories of the levels of the containers are taken from c0 to c1023
+const selinuxCategories = 1024
+
+// randomMcsLevel returns a level with two categories, eg. s0:c12,c345
+func randomMcsLevel() string {
+	c1, c2 := rand.Intn(selinuxCategories), rand.Intn(selinuxCategories)
+	for c1 == c2 {
+		c2 = rand.Intn(selinuxCategories)
+	}
+	if c1 > c2 {
+		c1, c2 = c2, c1
+	}
+	return fmt.Sprintf("%s:c%d,c%d", SELINUX_SHARED_LEVEL, c1, c2)
+}
+
+// selinuxLabels returns the labels of the processes and of the files of a
+// container, with the parts given by its options, and level by default
+func selinuxLabels(options *securityOptions, level string) (processLabel, mountLabel string) {
+	process := strings.Split(SELINUX_PROCESS_LABEL, ":")
+	file := strings.Split(SELINUX_FILE_LABEL, ":")
+	if options.LabelUser != "" {
+		process[0] = options.LabelUser
+		file[0] = options.LabelUser
+	}
+	if options.LabelRole != "" {
+		process[1] = options.LabelRole
+	}
+	if options.LabelType != "" {
+		process[2] = options.LabelType
+	}
+	if options.LabelLevel != "" {
+		level = options.LabelLevel
+	}
+	return strings.Join(append(process, level), ":"), strings.Join(append(file, level), ":")
+}
+
+// selinuxLevel returns the level of a label
+func selinuxLevel(label string) string {
+	parts := strings.SplitN(label, ":", 4)
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
+
+// relabel sets the SELinux label of the tree at p
+func relabel(p, label string) error {
+	if output, err := exec.Command("chcon", "-R", label, p).CombinedOutput(); err != nil {
+		return fmt.Errorf("Unable to relabel %s: %s (%s)", p, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// sharedFileLabel is the label of the files shared by the containers, eg.
+// the layers of the images or the volumes mounted with :z
+func sharedFileLabel() string {
+	return SELINUX_FILE_LABEL + ":" + SELINUX_SHARED_LEVEL
+}
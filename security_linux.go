@@ -0,0 +1,28 @@
+package docker
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Hardening
+
+const PR_SET_NO_NEW_PRIVS = 38
+
+// setNoNewPrivileges prevents the process and its children from gaining
+// privileges: setuid and setgid bits and file capabilities are ignored
+func setNoNewPrivileges() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("Unable to set no_new_privs: %s", errno)
+	}
+	return nil
+}
+
+// remountReadonly makes the root filesystem read-only. The volumes and the
+// other filesystems mounted in it stay writable.
+func remountReadonly() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("Unable to remount the root filesystem read-only: %s", err)
+	}
+	return nil
+}
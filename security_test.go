@@ -0,0 +1,106 @@
+package docker
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseSecurityOpts(t *testing.T) {
+	options, err := parseSecurityOpts([]string{"apparmor=unconfined", "label=user:user_u", "label=type:spc_t", "label=level:s0:c1,c2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.AppArmorProfile != "unconfined" || options.LabelUser != "user_u" || options.LabelType != "spc_t" || options.LabelLevel != "s0:c1,c2" || options.LabelDisable {
+		t.Errorf("Unexpected options: %v", options)
+	}
+	if options, err := parseSecurityOpts([]string{"label=disable"}); err != nil || !options.LabelDisable {
+		t.Errorf("label=disable should disable the labels (%v)", err)
+	}
+	for _, opt := range []string{"apparmor", "apparmor=", "label=user", "label=range:s0", "seccomp=unconfined"} {
+		if _, err := parseSecurityOpts([]string{opt}); err == nil {
+			t.Errorf("%s should be invalid", opt)
+		}
+	}
+}
+
+func TestSelinuxLabels(t *testing.T) {
+	level := randomMcsLevel()
+	if !regexp.MustCompile(`^s0:c\d+,c\d+$`).MatchString(level) {
+		t.Fatalf("Unexpected level: %s", level)
+	}
+	processLabel, mountLabel := selinuxLabels(&securityOptions{}, level)
+	if processLabel != SELINUX_PROCESS_LABEL+":"+level || mountLabel != SELINUX_FILE_LABEL+":"+level {
+		t.Errorf("Unexpected labels: %s %s", processLabel, mountLabel)
+	}
+	if selinuxLevel(processLabel) != level || selinuxLevel(mountLabel) != level {
+		t.Errorf("Expected the level %s of %s and %s", level, processLabel, mountLabel)
+	}
+	processLabel, mountLabel = selinuxLabels(&securityOptions{LabelUser: "user_u", LabelType: "spc_t", LabelLevel: "s0:c1,c2"}, level)
+	if processLabel != "user_u:system_r:spc_t:s0:c1,c2" || mountLabel != "user_u:object_r:svirt_sandbox_file_t:s0:c1,c2" {
+		t.Errorf("Unexpected labels: %s %s", processLabel, mountLabel)
+	}
+	if selinuxLevel("") != "" {
+		t.Errorf("An empty label has no level")
+	}
+}
+
+func TestApparmorProfile(t *testing.T) {
+	profile, err := apparmorProfile("docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(profile), "profile docker-test flags=") || !strings.Contains(string(profile), "deny mount,") {
+		t.Errorf("Unexpected profile:\n%s", profile)
+	}
+}
+
+func TestNoNewPrivileges(t *testing.T) {
+	for opts, expected := range map[string]bool{
+		"":                        false,
+		"no-new-privileges":       true,
+		"no-new-privileges=true":  true,
+		"no-new-privileges=false": false,
+	} {
+		var list []string
+		if opts != "" {
+			list = []string{opts}
+		}
+		options, err := parseSecurityOpts(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if options.NoNewPrivileges != expected {
+			t.Errorf("%q: expected %v", opts, expected)
+		}
+	}
+	if _, err := parseSecurityOpts([]string{"no-new-privileges=maybe"}); err == nil {
+		t.Errorf("no-new-privileges=maybe should be invalid")
+	}
+}
+
+func TestReadOnlyContainer(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	container, err := runtime.Create(&Config{
+		Image:       GetTestImage(runtime).Id,
+		Cmd:         []string{"sh", "-c", "touch /tmp/a /run/a && echo -n ok; touch /a 2>/dev/null || echo -n ,readonly; cat /proc/self/status | grep -q 'NoNewPrivs:.*1' && echo -n ,nonewprivs"},
+		ReadOnly:    true,
+		SecurityOpt: []string{"no-new-privileges"},
+	},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "ok,readonly,nonewprivs" {
+		t.Errorf("Unexpected output: %s", output)
+	}
+}
@@ -0,0 +1,1131 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operations shared by the rcli commands and the remote API.
+// They don't parse arguments nor format their output.
+
+// FilterError is returned for an invalid filter of a list, a prune or the
+// events
+type FilterError string
+
+func (e FilterError) Error() string {
+	return string(e)
+}
+
+// Filters accepted by Containers. There is no name filter: the containers
+// have no names, only ids, which the id filter matches by prefix.
+var containerFilters = map[string]bool{
+	"status":   true, // "running" or "exited"
+	"id":       true, // Prefix of the id
+	"ancestor": true, // Image the container is based on, directly or not
+	"exited":   true, // Exit code of a stopped container
+	"label":    true, // "KEY" or "KEY=VALUE"
+}
+
+// Containers returns the running containers, or all of them if all is
+// true, which match every filter. When a filter is given several values,
+// the container must match one of them. The status and exited filters
+// imply all.
+func (srv *Server) Containers(all bool, filters map[string][]string) ([]api.Containers, error) {
+	for name, values := range filters {
+		if name == "name" {
+			return nil, FilterError("Invalid filter: name (the containers have no names, filter them by id)")
+		}
+		if !containerFilters[name] {
+			return nil, FilterError(fmt.Sprintf("Invalid filter: %s", name))
+		}
+		for _, value := range values {
+			if err := srv.validateContainerFilter(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(filters["status"]) > 0 || len(filters["exited"]) > 0 {
+		all = true
+	}
+	out := []api.Containers{}
+	for _, container := range srv.runtime.List() {
+		if !container.State.Running && !all {
+			continue
+		}
+		if !srv.matchContainerFilters(container, filters) {
+			continue
+		}
+		out = append(out, api.Containers{
+			Id:      container.Id,
+			Image:   srv.runtime.repositories.ImageName(container.Image),
+			Command: fmt.Sprintf("%s %s", container.Path, strings.Join(container.Args, " ")),
+			Created: container.Created.Unix(),
+			Status:  container.State.String(),
+			Labels:  container.Config.Labels,
+		})
+	}
+	return out, nil
+}
+
+func (srv *Server) validateContainerFilter(name, value string) error {
+	switch name {
+	case "status":
+		if value != "running" && value != "exited" {
+			return FilterError(fmt.Sprintf("Invalid status filter: %s (expected running or exited)", value))
+		}
+	case "exited":
+		if _, err := strconv.Atoi(value); err != nil {
+			return FilterError(fmt.Sprintf("Invalid exited filter: %s", value))
+		}
+	case "ancestor":
+		if _, err := srv.runtime.repositories.LookupImage(value); err != nil {
+			return fmt.Errorf("No such image: %s", value)
+		}
+	case "label":
+		return validateLabelFilter(value)
+	}
+	return nil
+}
+
+func validateLabelFilter(value string) error {
+	if strings.SplitN(value, "=", 2)[0] == "" {
+		return FilterError(fmt.Sprintf("Invalid label filter: %s (expected KEY or KEY=VALUE)", value))
+	}
+	return nil
+}
+
+// matchLabel returns true if labels has the label of the filter "KEY", or
+// has it with the value of the filter "KEY=VALUE"
+func matchLabel(labels map[string]string, filter string) bool {
+	parts := strings.SplitN(filter, "=", 2)
+	value, exists := labels[parts[0]]
+	return exists && (len(parts) == 1 || value == parts[1])
+}
+
+func (srv *Server) matchContainerFilters(container *Container, filters map[string][]string) bool {
+	for name, values := range filters {
+		if len(values) == 0 {
+			continue
+		}
+		matched := false
+		for _, value := range values {
+			if srv.matchContainerFilter(container, name, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (srv *Server) matchContainerFilter(container *Container, name, value string) bool {
+	switch name {
+	case "status":
+		if value == "running" {
+			return container.State.Running
+		}
+		return container.State.exited()
+	case "id":
+		return strings.HasPrefix(container.Id, value)
+	case "exited":
+		code, _ := strconv.Atoi(value)
+		return container.State.exited() && container.State.ExitCode == code
+	case "ancestor":
+		ancestor, err := srv.runtime.repositories.LookupImage(value)
+		if err != nil {
+			return false
+		}
+		img, err := srv.runtime.graph.Get(container.Image)
+		if err != nil {
+			return false
+		}
+		found := false
+		img.WalkHistory(func(img *Image) error {
+			if img.Id == ancestor.Id {
+				found = true
+			}
+			return nil
+		})
+		return found
+	case "label":
+		return matchLabel(container.Config.Labels, value)
+	}
+	return false
+}
+
+// Filters accepted by Images
+var imageFilters = map[string]bool{
+	"label":    true, // "KEY" or "KEY=VALUE"
+	"dangling": true, // "true" or "false"
+	"untagged": true, // "REPOSITORY" or "REPOSITORY:TAG", the tag a dangling image lost
+}
+
+// ContainerPorts returns the port mappings of a running container, sorted by
+// private port
+func (srv *Server) ContainerPorts(name string) ([]api.Port, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	if !container.State.Running {
+		return nil, fmt.Errorf("Container %s is not running", name)
+	}
+	ports := []api.Port{}
+	for private, public := range container.NetworkSettings.PortMapping {
+		privatePort, err := strconv.Atoi(private)
+		if err != nil {
+			return nil, err
+		}
+		publicPort, err := strconv.Atoi(public)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, api.Port{PrivatePort: privatePort, PublicPort: publicPort})
+	}
+	sort.Sort(portsByPrivatePort(ports))
+	return ports, nil
+}
+
+type portsByPrivatePort []api.Port
+
+func (p portsByPrivatePort) Len() int           { return len(p) }
+func (p portsByPrivatePort) Less(i, j int) bool { return p[i].PrivatePort < p[j].PrivatePort }
+func (p portsByPrivatePort) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// ContainerUpdate changes the resource limits and the restart policy of a
+// container, running or not
+func (srv *Server) ContainerUpdate(name string, update *api.Update) error {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return fmt.Errorf("No such container: %s", name)
+	}
+	return container.Update(update)
+}
+
+// ContainerCheckpoints returns the checkpoints of a container, stored in
+// dir or in the container directory
+func (srv *Server) ContainerCheckpoints(name, dir string) ([]api.Checkpoint, error) {
+	container := srv.runtime.Get(name)
+	if container == nil {
+		return nil, fmt.Errorf("No such container: %s", name)
+	}
+	checkpoints, err := container.Checkpoints(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := []api.Checkpoint{}
+	for _, checkpoint := range checkpoints {
+		out = append(out, api.Checkpoint{Name: checkpoint.Name, Created: checkpoint.Created.Unix()})
+	}
+	return out, nil
+}
+
+// parseEventFilters validates the filters of the events: type, event,
+// container, image and label
+func (srv *Server) parseEventFilters(filters map[string][]string) (*eventFilter, error) {
+	return parseEventFilters(filters, srv.runtime.repositories.LookupImage)
+}
+
+// Events calls send with the events matching filter, starting with the past
+// events since the unix timestamp since (if not 0). It returns once send
+// fails, once closed is closed, or once the time is past the unix timestamp
+// until (if not 0).
+func (srv *Server) Events(since, until int64, filter *eventFilter, closed <-chan bool, send func(Event) error) {
+	past, ch := srv.runtime.events.Subscribe(since)
+	defer srv.runtime.events.Unsubscribe(ch)
+	for _, event := range past {
+		if until != 0 && event.Time > until {
+			return
+		}
+		if filter.match(event) && send(event) != nil {
+			return
+		}
+	}
+	var deadline <-chan time.Time
+	if until != 0 {
+		timer := time.NewTimer(time.Unix(until+1, 0).Sub(time.Now()))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		select {
+		case event := <-ch:
+			if until != 0 && event.Time > until {
+				return
+			}
+			if filter.match(event) && send(event) != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// Images returns the tagged images, restricted to the repository
+// nameFilter if it is not empty. Untagged heads (or all the untagged
+// images if all is true) are listed as well when there is no name filter.
+// The images must match every filter, and one of the values of a filter.
+func (srv *Server) Images(all bool, nameFilter string, filters map[string][]string) ([]api.Images, error) {
+	for name, values := range filters {
+		if !imageFilters[name] {
+			return nil, FilterError(fmt.Sprintf("Invalid filter: %s", name))
+		}
+		for _, value := range values {
+			if err := validateImageFilter(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var allImages map[string]*Image
+	var err error
+	if all {
+		allImages, err = srv.runtime.graph.Map()
+	} else {
+		allImages, err = srv.runtime.graph.Heads()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dangling map[string]*Image
+	if len(filters["dangling"]) > 0 || len(filters["untagged"]) > 0 {
+		if dangling, err = srv.danglingImages(); err != nil {
+			return nil, err
+		}
+	}
+	untagged := srv.runtime.repositories.Untagged
+	match := func(image *Image) bool {
+		for _, value := range filters["dangling"] {
+			if (value == "true") != (dangling[image.Id] != nil) {
+				return false
+			}
+		}
+		if references := filters["untagged"]; len(references) > 0 {
+			if dangling[image.Id] == nil || untagged[image.Id] == nil || !matchUntagged(untagged[image.Id].Name, references) {
+				return false
+			}
+		}
+		return matchImageFilters(image, filters)
+	}
+	var out []api.Images
+	for name, repository := range srv.runtime.repositories.Repositories {
+		if nameFilter != "" && name != nameFilter {
+			continue
+		}
+		for tag, id := range repository {
+			image, err := srv.runtime.graph.Get(id)
+			if err != nil {
+				registryLog.Warnf("Couldn't load %s from %s/%s: %s", id, name, tag, err)
+				continue
+			}
+			delete(allImages, id)
+			if !match(image) {
+				continue
+			}
+			out = append(out, api.Images{
+				Repository: name,
+				Tag:        tag,
+				Id:         id,
+				Created:    image.Created.Unix(),
+				ParentId:   image.Parent,
+				Labels:     image.Labels(),
+			})
+		}
+	}
+	if nameFilter == "" {
+		for id, image := range allImages {
+			if !match(image) {
+				continue
+			}
+			apiImage := api.Images{
+				Repository: "<none>",
+				Tag:        "<none>",
+				Id:         id,
+				Created:    image.Created.Unix(),
+				ParentId:   image.Parent,
+				Labels:     image.Labels(),
+			}
+			if lost := untagged[id]; lost != nil {
+				apiImage.Untagged = lost.Name
+			}
+			out = append(out, apiImage)
+		}
+	}
+	return out, nil
+}
+
+// validateImageFilter returns an error if value isn't valid for the image
+// filter name
+func validateImageFilter(name, value string) error {
+	switch name {
+	case "dangling":
+		if value != "true" && value != "false" {
+			return FilterError(fmt.Sprintf("Invalid dangling filter: %s (expected true or false)", value))
+		}
+	case "untagged":
+		if repoName, _ := parseRepositoryTag(value); validateRepoName(repoName) != nil {
+			return FilterError(fmt.Sprintf("Invalid untagged filter: %s (expected REPOSITORY[:TAG])", value))
+		}
+	default:
+		return validateLabelFilter(value)
+	}
+	return nil
+}
+
+// danglingImages returns the images which are neither tagged nor the parent
+// of another image, eg. the previous images of a tag moved by a rebuild
+func (srv *Server) danglingImages() (map[string]*Image, error) {
+	heads, err := srv.runtime.graph.Heads()
+	if err != nil {
+		return nil, err
+	}
+	for id := range srv.runtime.repositories.ById() {
+		delete(heads, id)
+	}
+	return heads, nil
+}
+
+// matchImageFilters returns whether image has one of the labels of the label
+// filter, if any
+func matchImageFilters(image *Image, filters map[string][]string) bool {
+	values := filters["label"]
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if matchLabel(image.Labels(), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageHistory returns the layers of an image, from the image itself to its
+// base image
+func (srv *Server) ImageHistory(name string) ([]api.History, error) {
+	image, err := srv.runtime.repositories.LookupImage(name)
+	if err != nil || image == nil {
+		return nil, fmt.Errorf("No such image: %s", name)
+	}
+	var history []api.History
+	err = image.WalkHistory(func(img *Image) error {
+		size, err := srv.runtime.graph.LayerSize(img.Id)
+		if err != nil {
+			return err
+		}
+		history = append(history, api.History{
+			Id:        img.Id,
+			Created:   img.Created.Unix(),
+			CreatedBy: strings.Join(img.ContainerConfig.Cmd, " "),
+			Size:      size,
+			Comment:   img.Comment,
+		})
+		return nil
+	})
+	return history, err
+}
+
+// ImagePull pulls an image or a repository, trying the registry mirrors
+// first for images of the index. The pull is aborted once aborted is
+// closed, eg. when its client disconnects.
+func (srv *Server) ImagePull(stdout io.Writer, aborted <-chan struct{}, remote string) error {
+	if err := srv.pullQueue.acquire(stdout, aborted); err != nil {
+		return err
+	}
+	defer srv.pullQueue.release()
+	imagePullsProgress.add(1)
+	defer imagePullsProgress.add(-1)
+	hostname, remoteName := splitReposName(remote)
+	var err error
+	for _, registry := range srv.runtime.pullEndpoints(hostname) {
+		if err = srv.pullFrom(stdout, aborted, remote, remoteName, registry); err == nil {
+			imagePulls.add(1, "success")
+			srv.runtime.events.Log("pull", remote, "", map[string]string{"registry": registry})
+			srv.scanPulled(stdout, remote, remoteName)
+			return nil
+		}
+		registryLog.Errorf("Pulling %s from %s failed: %s", remote, registry, err)
+		if isAborted(aborted) {
+			err = ErrAborted
+			break
+		}
+		if registry != REGISTRY_ENDPOINT && hostname == "" {
+			fmt.Fprintf(stdout, "Error pulling %s from mirror %s: %s, trying the next registry\n", remote, registry, err)
+		}
+	}
+	imagePulls.add(1, "failure")
+	return err
+}
+
+// scanPulled scans the image pulled, or the tagged images of the repository
+// pulled. The pull succeeds even if a scan fails.
+func (srv *Server) scanPulled(stdout io.Writer, remote, remoteName string) {
+	ids := make(map[string]bool)
+	if srv.runtime.graph.Exists(remoteName) {
+		ids[remoteName] = true
+	}
+	for _, id := range srv.runtime.repositories.Repositories[remote] {
+		ids[id] = true
+	}
+	if _, digest := splitDigest(remote); digest != "" {
+		if img, err := srv.runtime.repositories.LookupImage(remote); err == nil {
+			ids[img.Id] = true
+		}
+	}
+	for id := range ids {
+		img, err := srv.runtime.graph.Get(id)
+		if err != nil {
+			continue
+		}
+		srv.runtime.ScanImage(stdout, img)
+	}
+}
+
+// Pull an image or a repository named remote locally, and remoteName on the registry
+func (srv *Server) pullFrom(stdout io.Writer, aborted <-chan struct{}, remote, remoteName, registry string) error {
+	authConfig := srv.runtime.authConfigFile.ResolveAuthConfig(registry)
+	name, digest := splitDigest(remoteName)
+	// The manifests pulled by digest are checked against it, the tags
+	// are only verified with v1
+	if digest != "" || !srv.runtime.graph.verifiesTags() {
+		if v2 := srv.runtime.graph.negotiateV2(stdout, aborted, registry, &authConfig); v2 != nil {
+			if digest != "" {
+				local, _ := splitDigest(remote)
+				return v2.PullDigest(stdout, name, local, digest, srv.runtime.repositories)
+			}
+			return v2.PullRepository(stdout, remoteName, remote, srv.runtime.repositories)
+		}
+	}
+	if digest != "" {
+		return fmt.Errorf("Pulling %s by digest requires a registry speaking the v2 protocol", name)
+	}
+	if srv.runtime.graph.LookupRemoteImage(remoteName, registry, &authConfig) {
+		return srv.runtime.graph.PullImage(stdout, aborted, remoteName, registry, &authConfig)
+	}
+	// FIXME: Allow pull repo:tag
+	return srv.runtime.graph.PullRepository(stdout, aborted, remoteName, remote, "", registry, srv.runtime.repositories, &authConfig)
+}
+
+// ImagePush pushes an image or a repository with the stored credentials
+// of its registry. The push is aborted once aborted is closed.
+func (srv *Server) ImagePush(stdout io.Writer, aborted <-chan struct{}, local string) error {
+	if err := srv.pushQueue.acquire(stdout, aborted); err != nil {
+		return err
+	}
+	defer srv.pushQueue.release()
+	hostname, remote := splitReposName(local)
+	registry := srv.runtime.registryEndpoint(hostname)
+
+	authConfig := srv.runtime.authConfigFile.ResolveAuthConfig(registry)
+	if authConfig.Username == "" {
+		return fmt.Errorf("Please login prior to push. ('docker login')")
+	}
+
+	// Only the default index enforces the <user>/<repo> naming scheme
+	if hostname == "" && !strings.Contains(remote, "/") {
+		return fmt.Errorf(
+			"Impossible to push a \"root\" repository. Please rename your repository in <user>/<repo> (ex: %s/%s)",
+			authConfig.Username, local)
+	}
+
+	registryLog.Infof("Pushing [%s] to [%s] on %s", local, remote, registry)
+
+	// Try to get the image
+	// FIXME: Handle lookup
+	// FIXME: Also push the tags in case of ./docker push myrepo:mytag
+	img, err := srv.runtime.graph.Get(local)
+	if err != nil {
+		registryLog.Debugf("The push refers to a repository [%s] (len: %d)", local, len(srv.runtime.repositories.Repositories[local]))
+		// If it fails, try to get the repository
+		localRepo, exists := srv.runtime.repositories.Repositories[local]
+		if !exists {
+			return err
+		}
+		// The tags are only signed with v1
+		if !srv.runtime.graph.signsTags() {
+			if v2 := srv.runtime.graph.negotiateV2(stdout, aborted, registry, &authConfig); v2 != nil {
+				return v2.PushRepository(stdout, remote, local, localRepo, srv.runtime.repositories)
+			}
+		}
+		return srv.runtime.graph.PushRepository(stdout, aborted, remote, localRepo, registry, &authConfig)
+	}
+	// Images are only pushed by id with v1: v2 pushes repositories
+	return srv.runtime.graph.PushImage(stdout, aborted, img, registry, &authConfig)
+}
+
+// ImageTag tags the image name as repoName:tag. The tag may also be given
+// in repoName, and defaults to latest. An existing tag is only moved to
+// another image with force.
+func (srv *Server) ImageTag(name, repoName, tag string, force bool) error {
+	if tag == "" {
+		repoName, tag = parseRepositoryTag(repoName)
+	}
+	return srv.runtime.repositories.Set(repoName, tag, name, force)
+}
+
+// ConflictError is returned when an operation conflicts with the state of
+// an object, eg. a tag set to another image, or an image in use
+type ConflictError string
+
+func (e ConflictError) Error() string {
+	return string(e)
+}
+
+// ImageDelete deletes an image given by id, unless it has a name or is used
+// by another image or a container, or removes a name. Once no name refers
+// to the image of the name removed, it is deleted as well, then its parents
+// which have no name either, unless they are used by another image or a
+// container.
+func (srv *Server) ImageDelete(name string) ([]api.Rmi, error) {
+	if srv.runtime.graph.Exists(name) {
+		if inUse, err := srv.imageInUse(name); err != nil {
+			return nil, err
+		} else if inUse {
+			return nil, ConflictError(fmt.Sprintf("Image %s is in use: remove its tags, the images built on it and its containers first", name))
+		}
+		if err := srv.runtime.graph.Delete(name); err != nil {
+			return nil, err
+		}
+		return srv.untagDigests(nil, name)
+	}
+	id, err := srv.runtime.repositories.Untag(name)
+	if err != nil {
+		return nil, err
+	}
+	result := []api.Rmi{{Untagged: name}}
+	for id != "" {
+		img, err := srv.runtime.graph.Get(id)
+		if err != nil {
+			return result, err
+		}
+		if inUse, err := srv.imageInUse(id); err != nil || inUse {
+			return result, err
+		}
+		if err := srv.runtime.graph.Delete(id); err != nil {
+			return result, err
+		}
+		if result, err = srv.untagDigests(result, id); err != nil {
+			return result, err
+		}
+		id = img.Parent
+	}
+	return result, nil
+}
+
+// untagDigests removes the digest references to the image id, which was
+// deleted, and appends them and the image to result
+func (srv *Server) untagDigests(result []api.Rmi, id string) ([]api.Rmi, error) {
+	references, err := srv.runtime.repositories.UntagDigests(id)
+	for _, reference := range references {
+		result = append(result, api.Rmi{Untagged: reference})
+	}
+	return append(result, api.Rmi{Deleted: id}), err
+}
+
+// imageInUse returns whether an image has a tag, a child, or a container.
+// Its digest references are removed with it.
+func (srv *Server) imageInUse(id string) (bool, error) {
+	if len(srv.runtime.repositories.ById()[id]) > 0 {
+		return true, nil
+	}
+	byParent, err := srv.runtime.graph.ByParent()
+	if err != nil {
+		return false, err
+	}
+	if len(byParent[id]) > 0 {
+		return true, nil
+	}
+	for _, container := range srv.runtime.List() {
+		if container.Image == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Build executes dockerfile with b, and optionally tags the resulting image.
+// The build can be cancelled with CancelBuild while it is in progress.
+func (srv *Server) Build(b *Builder, dockerfile io.Reader, name string) (*Image, error) {
+	srv.buildsLock.Lock()
+	if srv.builds == nil {
+		srv.builds = make(map[string]*Builder)
+	}
+	srv.builds[b.Id] = b
+	srv.buildsLock.Unlock()
+	defer func() {
+		srv.buildsLock.Lock()
+		delete(srv.builds, b.Id)
+		srv.buildsLock.Unlock()
+	}()
+
+	if err := srv.buildQueue.acquire(b.out, b.cancelled); err != nil {
+		builds.add(1, "failure")
+		return nil, ErrBuildCancelled
+	}
+	defer srv.buildQueue.release()
+	img, err := b.Build(dockerfile)
+	if err != nil {
+		builds.add(1, "failure")
+		return nil, err
+	}
+	builds.add(1, "success")
+	// The build succeeds even if a scan fails
+	srv.runtime.ScanImage(b.out, img)
+	if name != "" {
+		repository, tag := parseRepositoryTag(name)
+		if err := srv.runtime.repositories.Set(repository, tag, img.Id, true); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+func (srv *Server) CancelBuild(id string) error {
+	srv.buildsLock.Lock()
+	b, exists := srv.builds[id]
+	srv.buildsLock.Unlock()
+	if !exists {
+		return fmt.Errorf("No such build: %s", id)
+	}
+	b.Cancel()
+	return nil
+}
+
+func (srv *Server) apiVolume(volume *Volume) api.Volume {
+	return api.Volume{
+		Name:       volume.Name,
+		Driver:     volume.Driver,
+		Path:       volume.Path,
+		Created:    volume.Created.Unix(),
+		Anonymous:  volume.Anonymous,
+		Containers: srv.runtime.VolumeUsers(volume),
+	}
+}
+
+// Volumes returns the volumes sorted by name
+func (srv *Server) Volumes() []api.Volume {
+	var out []api.Volume
+	for _, volume := range srv.runtime.volumes.List() {
+		out = append(out, srv.apiVolume(volume))
+	}
+	return out
+}
+
+// VolumeCreate creates a named volume with the given driver, or with the
+// local driver if driver is empty. Unlike the anonymous volumes, it is kept
+// until it is removed explicitly, even if its name is generated.
+func (srv *Server) VolumeCreate(name, driver string) (*api.Volume, error) {
+	if name == "" {
+		name = GenerateId()
+	}
+	volume, err := srv.runtime.volumes.Create(name, driver)
+	if err != nil {
+		return nil, err
+	}
+	out := srv.apiVolume(volume)
+	return &out, nil
+}
+
+func (srv *Server) VolumeInspect(name string) (*api.Volume, error) {
+	volume, err := srv.runtime.volumes.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	out := srv.apiVolume(volume)
+	return &out, nil
+}
+
+// VolumeRemove removes a volume, unless a container uses it
+func (srv *Server) VolumeRemove(name string) error {
+	return srv.runtime.volumes.Remove(name)
+}
+
+// TrustKeys lists the keys of the publishers whose signatures are trusted
+func (srv *Server) TrustKeys() ([]api.TrustKey, error) {
+	keys, err := srv.runtime.trust.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var out []api.TrustKey
+	for _, key := range keys {
+		out = append(out, api.TrustKey{Name: key.Name, Fingerprint: key.Fingerprint})
+	}
+	return out, nil
+}
+
+func (srv *Server) TrustKeyAdd(name string, key []byte) (*api.TrustKey, error) {
+	trusted, err := srv.runtime.trust.AddKey(name, key)
+	if err != nil {
+		return nil, err
+	}
+	srv.runtime.events.Log("trust", name, "", map[string]string{"fingerprint": trusted.Fingerprint})
+	return &api.TrustKey{Name: trusted.Name, Fingerprint: trusted.Fingerprint}, nil
+}
+
+func (srv *Server) TrustKeyRemove(name string) error {
+	if err := srv.runtime.trust.RemoveKey(name); err != nil {
+		return err
+	}
+	srv.runtime.events.Log("untrust", name, "", nil)
+	return nil
+}
+
+// TrustSigningKey returns the public key signing the tags pushed by the
+// daemon, to be trusted by the daemons pulling them
+func (srv *Server) TrustSigningKey() (*api.TrustKey, error) {
+	key, data, err := srv.runtime.trust.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return &api.TrustKey{Fingerprint: key.Fingerprint, Key: string(data)}, nil
+}
+
+// Filters accepted by the prune operations
+var pruneFilters = map[string]bool{
+	"until":    true, // Unix timestamp, or duration before now, eg. "24h"
+	"label":    true, // "KEY" or "KEY=VALUE". Volumes have no labels
+	"untagged": true, // "REPOSITORY" or "REPOSITORY:TAG", only for the images
+}
+
+type pruneFilter struct {
+	until    time.Time // Zero if not given
+	labels   []string
+	untagged []string // Only the dangling images which lost one of those tags
+}
+
+// parseUntil parses the until filter
+func parseUntil(value string) (time.Time, error) {
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(timestamp, 0), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, FilterError(fmt.Sprintf("Invalid until filter: %s (expected a timestamp or a duration)", value))
+}
+
+func parsePruneFilters(filters map[string][]string) (*pruneFilter, error) {
+	filter := &pruneFilter{}
+	for name, values := range filters {
+		if !pruneFilters[name] {
+			return nil, FilterError(fmt.Sprintf("Invalid filter: %s", name))
+		}
+		for _, value := range values {
+			switch name {
+			case "until":
+				until, err := parseUntil(value)
+				if err != nil {
+					return nil, err
+				}
+				// The earliest limit wins
+				if filter.until.IsZero() || until.Before(filter.until) {
+					filter.until = until
+				}
+			case "label":
+				if err := validateLabelFilter(value); err != nil {
+					return nil, err
+				}
+				filter.labels = append(filter.labels, value)
+			case "untagged":
+				if err := validateImageFilter(name, value); err != nil {
+					return nil, err
+				}
+				filter.untagged = append(filter.untagged, value)
+			}
+		}
+	}
+	return filter, nil
+}
+
+// match returns true if an object created at created, with labels, may be
+// pruned: it was created before until, and has one of the labels
+func (filter *pruneFilter) match(created time.Time, labels map[string]string) bool {
+	if !filter.until.IsZero() && !created.Before(filter.until) {
+		return false
+	}
+	if len(filter.labels) == 0 {
+		return true
+	}
+	for _, label := range filter.labels {
+		if matchLabel(labels, label) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainersPrune destroys the stopped containers which match the filters
+func (srv *Server) ContainersPrune(filters map[string][]string) (*api.PruneReport, error) {
+	filter, err := parsePruneFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	report := &api.PruneReport{}
+	// The untagged filter selects images only
+	if len(filter.untagged) > 0 {
+		return report, nil
+	}
+	for _, container := range srv.runtime.List() {
+		if container.State.Running || !filter.match(container.Created, container.Config.Labels) {
+			continue
+		}
+		// The root filesystem may be mounted from the image
+		size, err := dirSize(container.root, func(p string) bool { return p == container.RootfsPath() })
+		if err != nil {
+			graphLog.Warnf("Couldn't compute the size of %s: %s", container.Id, err)
+		}
+		if err := srv.runtime.Destroy(container); err != nil {
+			return report, err
+		}
+		report.ContainersDeleted = append(report.ContainersDeleted, container.Id)
+		report.SpaceReclaimed += size
+	}
+	return report, nil
+}
+
+// ImagesPrune deletes the images which match the filters and are neither
+// tagged nor used by a container, nor the parent of such an image
+func (srv *Server) ImagesPrune(filters map[string][]string) (*api.PruneReport, error) {
+	filter, err := parsePruneFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	images, err := srv.runtime.graph.Map()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	keep := func(id string) {
+		image, err := srv.runtime.graph.Get(id)
+		if err != nil {
+			return
+		}
+		image.WalkHistory(func(image *Image) error {
+			used[image.Id] = true
+			return nil
+		})
+	}
+	for id := range srv.runtime.repositories.ById() {
+		keep(id)
+	}
+	for _, container := range srv.runtime.List() {
+		keep(container.Image)
+	}
+	// The parents of the images which don't match are kept as well
+	for id, image := range images {
+		if !used[id] && !filter.match(image.Created, image.Labels()) {
+			keep(id)
+		}
+	}
+	// With the untagged filter, only the dangling images which lost one of
+	// those tags go, with the parents no other image needs
+	if len(filter.untagged) > 0 {
+		dangling, err := srv.danglingImages()
+		if err != nil {
+			return nil, err
+		}
+		untagged := srv.runtime.repositories.Untagged
+		for id := range dangling {
+			if untagged[id] == nil || !matchUntagged(untagged[id].Name, filter.untagged) {
+				keep(id)
+			}
+		}
+	}
+	report := &api.PruneReport{}
+	for id := range images {
+		if used[id] {
+			continue
+		}
+		size, err := srv.runtime.graph.LayerSize(id)
+		if err != nil {
+			graphLog.Warnf("Couldn't compute the size of %s: %s", id, err)
+		}
+		if err := srv.runtime.graph.Delete(id); err != nil {
+			return report, err
+		}
+		if _, err := srv.runtime.repositories.UntagDigests(id); err != nil {
+			return report, err
+		}
+		report.ImagesDeleted = append(report.ImagesDeleted, id)
+		report.SpaceReclaimed += size
+	}
+	sort.Strings(report.ImagesDeleted)
+	return report, srv.runtime.graph.GarbageCollect()
+}
+
+// VolumesPrune removes the volumes which match the filters and aren't used
+// by any container
+func (srv *Server) VolumesPrune(filters map[string][]string) (*api.PruneReport, error) {
+	filter, err := parsePruneFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	report := &api.PruneReport{}
+	if len(filter.untagged) > 0 {
+		return report, nil
+	}
+	for _, volume := range srv.runtime.volumes.List() {
+		if !filter.match(volume.Created, nil) || len(srv.runtime.VolumeUsers(volume)) > 0 {
+			continue
+		}
+		size, err := dirSize(volume.Path, nil)
+		if err != nil {
+			volumeLog.Warnf("Couldn't compute the size of volume %s: %s", volume.Name, err)
+		}
+		if err := srv.runtime.volumes.Remove(volume.Name); err != nil {
+			// Used by a container created in the meantime
+			if _, ok := err.(ConflictError); ok {
+				continue
+			}
+			return report, err
+		}
+		report.VolumesDeleted = append(report.VolumesDeleted, volume.Name)
+		report.SpaceReclaimed += size
+	}
+	return report, nil
+}
+
+// SystemPrune prunes the containers, then the images and the volumes they
+// no longer use
+func (srv *Server) SystemPrune(filters map[string][]string) (*api.PruneReport, error) {
+	report := &api.PruneReport{}
+	for _, prune := range []func(map[string][]string) (*api.PruneReport, error){
+		srv.ContainersPrune,
+		srv.ImagesPrune,
+		srv.VolumesPrune,
+	} {
+		pruned, err := prune(filters)
+		if pruned != nil {
+			report.ContainersDeleted = append(report.ContainersDeleted, pruned.ContainersDeleted...)
+			report.ImagesDeleted = append(report.ImagesDeleted, pruned.ImagesDeleted...)
+			report.VolumesDeleted = append(report.VolumesDeleted, pruned.VolumesDeleted...)
+			report.SpaceReclaimed += pruned.SpaceReclaimed
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// DiskUsage returns the disk space used by the images, the containers and
+// the volumes. The images are the ones listed by Images, whose layers are
+// shared if another of those images has them as well.
+func (srv *Server) DiskUsage() (*api.DiskUsage, error) {
+	graph := srv.runtime.graph
+	usage := &api.DiskUsage{}
+	all, err := graph.All()
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range all {
+		size, err := graph.LayerSize(img.Id)
+		if err != nil {
+			return nil, err
+		}
+		usage.LayersSize += size
+	}
+
+	// The layers of the images used by containers aren't reclaimable
+	usedLayers := make(map[string]bool)
+	containersByImage := make(map[string]int)
+	for _, container := range srv.runtime.List() {
+		img, err := graph.Get(container.Image)
+		if err != nil {
+			continue
+		}
+		img.WalkHistory(func(img *Image) error {
+			usedLayers[img.Id] = true
+			return nil
+		})
+		containersByImage[container.Image]++
+		size, err := container.RwSize()
+		if err != nil {
+			graphLog.Warnf("Couldn't compute the size of %s: %s", container.Id, err)
+		}
+		usage.Containers = append(usage.Containers, api.ContainerUsage{
+			Id:      container.Id,
+			Image:   srv.runtime.repositories.ImageName(container.Image),
+			Created: container.Created.Unix(),
+			Running: container.State.Running,
+			Size:    size,
+		})
+	}
+	usage.ImagesReclaimable = usage.LayersSize
+	for id := range usedLayers {
+		if size, err := graph.LayerSize(id); err == nil {
+			usage.ImagesReclaimable -= size
+		}
+	}
+
+	images, err := srv.Images(false, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	// Number of the listed images having each layer. An image with several
+	// tags is counted once.
+	layerUsers := make(map[string]int)
+	histories := make(map[string][]*Image)
+	for _, image := range images {
+		if _, exists := histories[image.Id]; exists {
+			continue
+		}
+		img, err := graph.Get(image.Id)
+		if err != nil {
+			return nil, err
+		}
+		history, err := img.History()
+		if err != nil {
+			return nil, err
+		}
+		histories[image.Id] = history
+		for _, layer := range history {
+			layerUsers[layer.Id]++
+		}
+	}
+	for _, image := range images {
+		imageUsage := api.ImageUsage{
+			Id:         image.Id,
+			Repository: image.Repository,
+			Tag:        image.Tag,
+			Created:    image.Created,
+			Containers: containersByImage[image.Id],
+		}
+		for _, layer := range histories[image.Id] {
+			size, err := graph.LayerSize(layer.Id)
+			if err != nil {
+				return nil, err
+			}
+			imageUsage.Size += size
+			if layerUsers[layer.Id] > 1 {
+				imageUsage.SharedSize += size
+			}
+		}
+		imageUsage.UniqueSize = imageUsage.Size - imageUsage.SharedSize
+		usage.Images = append(usage.Images, imageUsage)
+	}
+
+	for _, volume := range srv.runtime.volumes.List() {
+		size, err := dirSize(volume.Path, nil)
+		if err != nil {
+			volumeLog.Warnf("Couldn't compute the size of volume %s: %s", volume.Name, err)
+		}
+		usage.Volumes = append(usage.Volumes, api.VolumeUsage{
+			Name:       volume.Name,
+			Driver:     volume.Driver,
+			Size:       size,
+			Containers: len(srv.runtime.VolumeUsers(volume)),
+		})
+	}
+	return usage, nil
+}
@@ -0,0 +1,566 @@
+package docker
+
+import (
+	"container/list"
+	"github.com/dotcloud/docker/api"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContainersFilters(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	img := GetTestImage(runtime)
+	var containers []*Container
+	for i := 0; i < 3; i++ {
+		container, err := runtime.Create(&Config{Image: img.Id, Cmd: []string{"true"}, Labels: map[string]string{"index": strconv.Itoa(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer runtime.Destroy(container)
+		containers = append(containers, container)
+	}
+	// Fake the states rather than running the containers:
+	// 0 is running, 1 exited with 3, and 2 was never started
+	containers[0].State.Running = true
+	containers[0].State.StartedAt = time.Now()
+	containers[1].State.StartedAt = time.Now()
+	containers[1].State.FinishedAt = time.Now()
+	containers[1].State.ExitCode = 3
+	defer func() { containers[0].State.Running = false }()
+
+	for _, test := range []struct {
+		all      bool
+		filters  map[string][]string
+		expected []*Container
+	}{
+		{false, nil, containers[:1]},
+		{true, nil, containers},
+		{false, map[string][]string{"status": {"exited"}}, containers[1:2]},
+		{false, map[string][]string{"status": {"running", "exited"}}, containers[:2]},
+		{false, map[string][]string{"exited": {"3"}}, containers[1:2]},
+		{false, map[string][]string{"exited": {"0", "3"}}, containers[1:2]},
+		{true, map[string][]string{"id": {containers[2].Id[:8]}}, containers[2:]},
+		{false, map[string][]string{"ancestor": {img.Id}}, containers[:1]},
+		{true, map[string][]string{"ancestor": {img.Id}, "status": {"running"}}, containers[:1]},
+		{true, map[string][]string{"label": {"index=1", "index=2"}}, containers[1:]},
+		{true, map[string][]string{"label": {"index"}}, containers},
+		{true, map[string][]string{"label": {"index=3"}}, nil},
+	} {
+		out, err := srv.Containers(test.all, test.filters)
+		if err != nil {
+			t.Errorf("%v: %s", test.filters, err)
+			continue
+		}
+		ids := make(map[string]bool)
+		for _, c := range out {
+			ids[c.Id] = true
+		}
+		if len(out) != len(test.expected) {
+			t.Errorf("%v (all: %v): expected %d containers, got %d", test.filters, test.all, len(test.expected), len(out))
+			continue
+		}
+		for _, c := range test.expected {
+			if !ids[c.Id] {
+				t.Errorf("%v (all: %v): expected %s in the result", test.filters, test.all, c.Id)
+			}
+		}
+	}
+
+	for _, filters := range []map[string][]string{
+		{"foo": {"bar"}},
+		{"status": {"paused"}},
+		{"exited": {"abc"}},
+		{"ancestor": {"doesnotexist"}},
+		{"label": {"=1"}},
+	} {
+		if _, err := srv.Containers(true, filters); err == nil {
+			t.Errorf("%v should be refused", filters)
+		}
+	}
+}
+
+func TestImagesLabelFilter(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	container, err := runtime.Create(&Config{Image: GetTestImage(runtime).Id, Cmd: []string{"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	img, err := runtime.Commit(container.Id, "labeled", "", "", &Config{Labels: map[string]string{"owner": "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filters := range []map[string][]string{
+		{"label": {"owner"}},
+		{"label": {"owner=web", "owner=ops"}},
+	} {
+		images, err := srv.Images(true, "", filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(images) != 1 || images[0].Id != img.Id || images[0].Labels["owner"] != "web" {
+			t.Errorf("%v: unexpected images: %v", filters, images)
+		}
+	}
+	if images, err := srv.Images(true, "", map[string][]string{"label": {"owner=ops"}}); err != nil || len(images) != 0 {
+		t.Errorf("Expected no image, got %v (%v)", images, err)
+	}
+	if _, err := srv.Images(true, "", map[string][]string{"repository": {"labeled"}}); err == nil {
+		t.Errorf("Unknown filters should be refused")
+	}
+}
+
+func TestDanglingImages(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{runtime: &Runtime{graph: graph, repositories: store, containers: list.New()}}
+	// app:latest is rebuilt on base, the previous build had an intermediate
+	// image, and loose was never tagged
+	base := &Image{Id: GenerateId()}
+	intermediate := &Image{Id: GenerateId(), Parent: base.Id}
+	previous := &Image{Id: GenerateId(), Parent: intermediate.Id}
+	rebuilt := &Image{Id: GenerateId(), Parent: base.Id}
+	loose := &Image{Id: GenerateId()}
+	for _, img := range []*Image{base, intermediate, previous, rebuilt, loose} {
+		if err := graph.Register(testArchive(t), img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tag := range []struct{ repoName, id string }{{"base", base.Id}, {"app", previous.Id}, {"app", rebuilt.Id}} {
+		if err := store.Set(tag.repoName, "latest", tag.id, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if untagged := store.Untagged[previous.Id]; untagged == nil || untagged.Name != "app:latest" {
+		t.Fatalf("Expected %s to have lost app:latest, got %v", previous.Id, untagged)
+	}
+
+	ids := func(filters map[string][]string) map[string]string {
+		images, err := srv.Images(false, "", filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make(map[string]string)
+		for _, image := range images {
+			found[image.Id] = image.Untagged
+		}
+		return found
+	}
+	if found := ids(map[string][]string{"dangling": {"true"}}); len(found) != 2 || found[previous.Id] != "app:latest" || found[loose.Id] != "" {
+		t.Errorf("Unexpected dangling images: %v", found)
+	}
+	if found := ids(map[string][]string{"dangling": {"false"}}); len(found) != 2 || found[base.Id] != "" || found[rebuilt.Id] != "" {
+		t.Errorf("Unexpected tagged images: %v", found)
+	}
+	for _, reference := range []string{"app", "app:latest"} {
+		if found := ids(map[string][]string{"untagged": {reference}}); len(found) != 1 || found[previous.Id] != "app:latest" {
+			t.Errorf("%s: unexpected images: %v", reference, found)
+		}
+	}
+	if found := ids(map[string][]string{"untagged": {"app:v1"}}); len(found) != 0 {
+		t.Errorf("Expected no image, got %v", found)
+	}
+	for _, filters := range []map[string][]string{{"dangling": {"yes"}}, {"untagged": {"App Server"}}} {
+		if _, err := srv.Images(false, "", filters); err == nil {
+			t.Errorf("%v should be refused", filters)
+		}
+	}
+
+	report, err := srv.ImagesPrune(map[string][]string{"untagged": {"app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ImagesDeleted) != 2 || graph.Exists(previous.Id) || graph.Exists(intermediate.Id) {
+		t.Errorf("Expected the previous build of app to be deleted, got %v", report.ImagesDeleted)
+	}
+	for _, img := range []*Image{base, rebuilt, loose} {
+		if !graph.Exists(img.Id) {
+			t.Errorf("%s shouldn't have been deleted", img.Id)
+		}
+	}
+}
+
+func TestPruneFilters(t *testing.T) {
+	filter, err := parsePruneFilters(map[string][]string{"until": {"48h", "24h"}, "label": {"tmp", "owner=ci"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-72 * time.Hour)
+	for _, labels := range []map[string]string{{"tmp": ""}, {"owner": "ci"}} {
+		if !filter.match(old, labels) {
+			t.Errorf("%v should match", labels)
+		}
+	}
+	if filter.match(old, map[string]string{"owner": "web"}) {
+		t.Errorf("The labels should be matched")
+	}
+	if filter.match(time.Now().Add(-36*time.Hour), map[string]string{"tmp": ""}) {
+		t.Errorf("The earliest until should win")
+	}
+	if until, err := parseUntil("1370000000"); err != nil || until.Unix() != 1370000000 {
+		t.Errorf("Unexpected until: %v (%v)", until, err)
+	}
+	for _, filters := range []map[string][]string{
+		{"until": {"yesterday"}},
+		{"until": {"-1h"}},
+		{"label": {"=web"}},
+		{"untagged": {"-app"}},
+		{"status": {"exited"}},
+	} {
+		if _, err := parsePruneFilters(filters); err == nil {
+			t.Errorf("%v should be refused", filters)
+		}
+	}
+}
+
+func TestSystemPrune(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+	testImage := GetTestImage(runtime)
+	if err := runtime.repositories.Set("base", "latest", testImage.Id, true); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped, err := runtime.Create(&Config{Image: testImage.Id, Cmd: []string{"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stopped.Run(); err != nil {
+		t.Fatal(err)
+	}
+	labeled, err := runtime.Create(&Config{Image: testImage.Id, Cmd: []string{"true"}, Labels: map[string]string{"tmp": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(labeled)
+	// An untagged image, used by no container
+	img, err := runtime.Commit(stopped.Id, "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.VolumeCreate("unused", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := srv.ContainersPrune(map[string][]string{"label": {"tmp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ContainersDeleted) != 1 || report.ContainersDeleted[0] != labeled.Id {
+		t.Fatalf("Expected %s to be pruned, got %v", labeled.Id, report.ContainersDeleted)
+	}
+	report, err = srv.SystemPrune(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ContainersDeleted) != 1 || report.ContainersDeleted[0] != stopped.Id {
+		t.Errorf("Expected %s to be pruned, got %v", stopped.Id, report.ContainersDeleted)
+	}
+	if len(report.ImagesDeleted) != 1 || report.ImagesDeleted[0] != img.Id || runtime.graph.Exists(img.Id) {
+		t.Errorf("Expected %s to be pruned, got %v", img.Id, report.ImagesDeleted)
+	}
+	if len(report.VolumesDeleted) != 1 || report.VolumesDeleted[0] != "unused" {
+		t.Errorf("Expected the volume to be pruned, got %v", report.VolumesDeleted)
+	}
+	if !runtime.graph.Exists(testImage.Id) {
+		t.Errorf("The tagged test image shouldn't be pruned")
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+	testImage := GetTestImage(runtime)
+
+	container, err := runtime.Create(&Config{Image: testImage.Id, Cmd: []string{"touch", "/test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, repository := range []string{"first", "second"} {
+		if _, err := runtime.Commit(container.Id, repository, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage, err := srv.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testImageSize, err := runtime.graph.Size(testImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.LayersSize < testImageSize || usage.ImagesReclaimable >= usage.LayersSize {
+		t.Errorf("Unexpected sizes: %d, %d reclaimable", usage.LayersSize, usage.ImagesReclaimable)
+	}
+	for _, image := range usage.Images {
+		if image.Repository != "first" && image.Repository != "second" {
+			continue
+		}
+		if image.SharedSize < testImageSize || image.Size != image.SharedSize+image.UniqueSize {
+			t.Errorf("%s should share the layers of the test image: %#v", image.Repository, image)
+		}
+	}
+	if len(usage.Containers) != 1 || usage.Containers[0].Id != container.Id || usage.Containers[0].Running {
+		t.Errorf("Unexpected containers: %v", usage.Containers)
+	}
+}
+
+func TestImageTagDelete(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+	testImage := GetTestImage(runtime)
+
+	container, err := runtime.Create(&Config{Image: testImage.Id, Cmd: []string{"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	img, err := runtime.Commit(container.Id, "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ImageTag(img.Id, "app:v1", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ImageTag(img.Id, "app", "v2", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.ImageTag(testImage.Id, "app", "v2", false); err == nil {
+		t.Errorf("An existing tag shouldn't be moved without force")
+	}
+	if err := srv.ImageTag(img.Id, "app", "bad tag", false); err == nil {
+		t.Errorf("Invalid tags should be refused")
+	}
+
+	// The image is kept while a name refers to it
+	result, err := srv.ImageDelete("app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0].Untagged != "app:v1" || !runtime.graph.Exists(img.Id) {
+		t.Fatalf("Expected only app:v1 to be untagged, got %v", result)
+	}
+	result, err = srv.ImageDelete("app:v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test image is used by a container
+	if len(result) != 2 || result[1].Deleted != img.Id || runtime.graph.Exists(img.Id) || !runtime.graph.Exists(testImage.Id) {
+		t.Fatalf("Expected %s to be deleted, got %v", img.Id, result)
+	}
+	if _, err := srv.ImageDelete("app:v2"); err == nil {
+		t.Errorf("Removing a name twice should fail")
+	}
+}
+
+func TestImageDeleteDigests(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{runtime: &Runtime{graph: graph, repositories: store, containers: list.New()}}
+	tagged := &Image{Id: GenerateId()}
+	pulled := &Image{Id: GenerateId()}
+	for _, img := range []*Image{tagged, pulled} {
+		if err := graph.Register(testArchive(t), img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Set("app", "v1", tagged.Id, false); err != nil {
+		t.Fatal(err)
+	}
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for _, image := range []*Image{tagged, pulled} {
+		if err := store.SetDigest("app", digest, image.Id); err != nil {
+			t.Fatal(err)
+		}
+		digest = "sha256:" + strings.Repeat("b", 64)
+	}
+
+	// The digests don't keep the image, and go with it
+	result, err := srv.ImageDelete("app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 || result[0].Untagged != "app:v1" || result[1].Untagged != "app@sha256:"+strings.Repeat("a", 64) || result[2].Deleted != tagged.Id {
+		t.Errorf("Unexpected result: %v", result)
+	}
+	result, err = srv.ImageDelete(pulled.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result[0].Untagged != "app@"+digest || result[1].Deleted != pulled.Id {
+		t.Errorf("Unexpected result: %v", result)
+	}
+	if len(store.Digests) != 0 {
+		t.Errorf("The digests of the deleted images should be removed, got %v", store.Digests)
+	}
+}
+
+func TestImageHistory(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+	testImage := GetTestImage(runtime)
+
+	container, err := runtime.Create(&Config{Image: testImage.Id, Cmd: []string{"touch", "/history"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if err := container.Run(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := runtime.Commit(container.Id, "app", "", "Add history", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := srv.ImageHistory("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) < 2 || history[0].Id != img.Id || history[1].Id != testImage.Id {
+		t.Fatalf("Expected the layers of %s then %s, got %v", img.Id, testImage.Id, history)
+	}
+	if history[0].CreatedBy != "touch /history" || history[0].Comment != "Add history" {
+		t.Errorf("Unexpected layer: %v", history[0])
+	}
+	if _, err := srv.ImageHistory("nonexistent"); err == nil {
+		t.Errorf("The history of an unknown image should fail")
+	}
+}
+
+func TestContainerPorts(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	container, err := runtime.Create(&Config{
+		Image: GetTestImage(runtime).Id,
+		Cmd:   []string{"sleep", "10"},
+		Ports: []int{443, 80},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	if _, err := srv.ContainerPorts(container.Id); err == nil {
+		t.Errorf("The ports of a stopped container shouldn't be listed")
+	}
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+	ports, err := srv.ContainerPorts(container.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 || ports[0].PrivatePort != 80 || ports[1].PrivatePort != 443 {
+		t.Fatalf("Unexpected ports: %v", ports)
+	}
+	for _, port := range ports {
+		if port.PublicPort == 0 || container.NetworkSettings.PortMapping[strconv.Itoa(port.PrivatePort)] != strconv.Itoa(port.PublicPort) {
+			t.Errorf("Unexpected mapping: %v", port)
+		}
+	}
+}
+
+func TestContainerUpdate(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	container, err := runtime.Create(&Config{
+		Image:  GetTestImage(runtime).Id,
+		Cmd:    []string{"sleep", "10"},
+		Memory: 33554432,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	quota, shares, memory, always := int64(10), int64(512), int64(67108864), "always"
+	if err := srv.ContainerUpdate(container.Id, &api.Update{CpuQuota: &quota}); err == nil {
+		t.Errorf("An invalid CPU quota should be refused")
+	}
+	if err := srv.ContainerUpdate("nonexistent", &api.Update{CpuShares: &shares}); err == nil {
+		t.Errorf("Updating an unknown container should fail")
+	}
+	if err := container.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer container.Kill()
+	if err := srv.ContainerUpdate(container.Id, &api.Update{Memory: &memory, CpuShares: &shares, Restart: &always}); err != nil {
+		t.Fatal(err)
+	}
+	if container.Config.Memory != 67108864 || container.Config.CpuShares != 512 || container.Config.Restart != "always" || container.Config.Cmd[0] != "sleep" {
+		t.Errorf("Unexpected config: %#v", container.Config)
+	}
+	// 0 removes the CPU shares, the other settings are kept
+	var unset int64
+	if err := srv.ContainerUpdate(container.Id, &api.Update{CpuShares: &unset}); err != nil {
+		t.Fatal(err)
+	}
+	if container.Config.Memory != 67108864 || container.Config.CpuShares != 0 || container.Config.Restart != "always" {
+		t.Errorf("Unexpected config: %#v", container.Config)
+	}
+	mountpoint, err := cgroupMountpoint("memory")
+	if err != nil {
+		t.Skip(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(mountpoint, "lxc", container.Id, "memory.limit_in_bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(data)) != "67108864" {
+		t.Errorf("Expected the new memory limit in the cgroup, got %s", data)
+	}
+}
@@ -0,0 +1,410 @@
+package docker
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/kr/pty"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// With live-restore, the containers are started through a shim: the docker
+// binary run as docker-shim. It starts lxc-start in its own session, so that
+// the container outlives the daemon, serves the streams of the container on
+// a unix socket of the container directory, and records the exit code of
+// the container there. The daemon reconnects to the socket when it starts.
+const SHIM_NAME = "docker-shim"
+
+// The streams multiplexed on the socket of the shim
+const (
+	shimStdin  byte = 0 // From the daemon. An empty frame closes stdin
+	shimStdout byte = 1
+	shimStderr byte = 2
+)
+
+func shimSocketPath(root string) string {
+	return path.Join(root, "shim.sock")
+}
+
+func shimExitCodePath(root string) string {
+	return path.Join(root, "exitcode")
+}
+
+// writeFrame writes data on the socket of the shim: the stream, the length
+// of the data as a big endian uint32, then the data
+func writeFrame(w io.Writer, stream byte, data []byte) error {
+	frame := make([]byte, 5+len(data))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (stream byte, data []byte, err error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	data = make([]byte, binary.BigEndian.Uint32(header[1:5]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+// readShimExitCode returns the exit code recorded by the shim of the
+// container at root, or -1 if the shim died without recording it
+func readShimExitCode(root string) int {
+	data, err := ioutil.ReadFile(shimExitCodePath(root))
+	if err != nil {
+		return -1
+	}
+	exitCode, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return exitCode
+}
+
+type shim struct {
+	lock   sync.Mutex
+	client net.Conn           // The daemon, if it is connected
+	logs   map[byte]io.Writer // Where the output goes while the daemon is away
+	stdin  io.WriteCloser
+}
+
+// write sends the output of the container to the daemon, or to the logs
+// while the daemon is away
+func (s *shim) write(stream byte, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.client != nil {
+		if err := writeFrame(s.client, stream, data); err == nil {
+			return
+		}
+		s.client.Close()
+		s.client = nil
+	}
+	if w := s.logs[stream]; w != nil {
+		w.Write(data)
+	}
+}
+
+func (s *shim) copyOutput(stream byte, src io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			s.write(stream, buf[:n])
+		}
+		// A pty fails with EIO once the container closed it
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serve accepts the connections of the daemon. A new connection replaces
+// the previous one.
+func (s *shim) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		if s.client != nil {
+			s.client.Close()
+		}
+		s.client = conn
+		s.lock.Unlock()
+		go s.readStdin(conn)
+	}
+}
+
+func (s *shim) readStdin(conn net.Conn) {
+	for {
+		stream, data, err := readFrame(conn)
+		if err != nil {
+			// The daemon went away: stdin stays open for the next one
+			return
+		}
+		if stream != shimStdin || s.stdin == nil {
+			continue
+		}
+		if len(data) == 0 {
+			s.stdin.Close()
+			s.stdin = nil
+			continue
+		}
+		if _, err := s.stdin.Write(data); err != nil {
+			s.stdin.Close()
+			s.stdin = nil
+		}
+	}
+}
+
+// RunShim runs lxc-start with the arguments left after the flags, and exits
+// with the exit code of the container
+func RunShim() {
+	flags := flag.NewFlagSet(SHIM_NAME, flag.ExitOnError)
+	root := flags.String("root", "", "Directory of the container")
+	tty := flags.Bool("t", false, "Attach the streams to ttys")
+	openStdin := flags.Bool("i", false, "Open stdin")
+	stdoutLog := flags.String("stdout-log", "", "Where stdout goes while the daemon is away")
+	stderrLog := flags.String("stderr-log", "", "Where stderr goes while the daemon is away")
+	scope := flags.String("systemd-scope", "", "Systemd scope of the container, with the systemd cgroup driver")
+	flags.Parse(os.Args[1:])
+	if *root == "" || flags.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "%s is started by the docker daemon\n", SHIM_NAME)
+		os.Exit(1)
+	}
+	exitCode, err := runShim(*root, *tty, *openStdin, *stdoutLog, *stderrLog, *scope, flags.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(exitCode)
+}
+
+func runShim(root string, tty, openStdin bool, stdoutLog, stderrLog, scope string, args []string) (int, error) {
+	s := &shim{logs: make(map[byte]io.Writer)}
+	for stream, file := range map[byte]string{shimStdout: stdoutLog, shimStderr: stderrLog} {
+		if file == "" {
+			continue
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return -1, err
+		}
+		defer f.Close()
+		s.logs[stream] = f
+	}
+	os.Remove(shimExitCodePath(root))
+	socket := shimSocketPath(root)
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return -1, err
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return -1, err
+	}
+	defer os.Remove(socket)
+
+	cmd := lxcStartCommand(scope, args)
+	cmd.Env = os.Environ()
+	var outputs sync.WaitGroup
+	var slaves []*os.File
+	for _, stream := range []byte{shimStdout, shimStderr} {
+		var master, slave *os.File
+		if tty {
+			master, slave, err = pty.Open()
+		} else {
+			master, slave, err = os.Pipe()
+		}
+		if err != nil {
+			return -1, err
+		}
+		if stream == shimStdout {
+			cmd.Stdout = slave
+		} else {
+			cmd.Stderr = slave
+		}
+		slaves = append(slaves, slave)
+		outputs.Add(1)
+		go func(stream byte, master *os.File) {
+			defer outputs.Done()
+			s.copyOutput(stream, master)
+		}(stream, master)
+	}
+	if openStdin {
+		var master, slave *os.File
+		if tty {
+			master, slave, err = pty.Open()
+		} else {
+			slave, master, err = os.Pipe()
+		}
+		if err != nil {
+			return -1, err
+		}
+		cmd.Stdin = slave
+		slaves = append(slaves, slave)
+		s.stdin = master
+	}
+	// Wait for the daemon before starting the container, so that the daemon
+	// gets all of its output
+	unixListener := listener.(*net.UnixListener)
+	unixListener.SetDeadline(time.Now().Add(10 * time.Second))
+	if conn, err := listener.Accept(); err == nil {
+		s.client = conn
+		go s.readStdin(conn)
+	}
+	unixListener.SetDeadline(time.Time{})
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	for _, slave := range slaves {
+		slave.Close()
+	}
+	go s.serve(listener)
+
+	cmd.Wait()
+	exitCode := cmd.ProcessState.Sys().(syscall.WaitStatus).ExitStatus()
+	// Processes left behind by the container may keep its output open
+	done := make(chan bool)
+	go func() {
+		outputs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+	if err := ioutil.WriteFile(shimExitCodePath(root), []byte(strconv.Itoa(exitCode)), 0600); err != nil {
+		return -1, err
+	}
+	listener.Close()
+	s.lock.Lock()
+	if s.client != nil {
+		s.client.Close()
+	}
+	s.lock.Unlock()
+	return exitCode, nil
+}
+
+// shimCommand returns the command running lxc-start with params through
+// docker-shim
+func (container *Container) shimCommand(params []string) *exec.Cmd {
+	args := []string{SHIM_NAME, "-root", container.root}
+	if container.Config.Tty {
+		args = append(args, "-t")
+	}
+	if container.Config.OpenStdin {
+		args = append(args, "-i")
+	}
+	if container.LogDriver != "none" {
+		args = append(args, "-stdout-log", container.logPath("stdout"), "-stderr-log", container.logPath("stderr"))
+	}
+	if container.SystemdScope != "" {
+		args = append(args, "-systemd-scope", container.SystemdScope)
+	}
+	args = append(append(args, "--"), params...)
+	return &exec.Cmd{
+		Path:        container.SysInitPath,
+		Args:        args,
+		SysProcAttr: shimSysProcAttr(),
+	}
+}
+
+func (container *Container) startShim() error {
+	if err := container.cmd.Start(); err != nil {
+		return err
+	}
+	// The shim listens on its socket before it starts the container
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", shimSocketPath(container.root)); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		container.cmd.Process.Kill()
+		container.cmd.Wait()
+		return fmt.Errorf("Couldn't connect to the shim of %s: %s", container.Id, err)
+	}
+	container.attachShim(conn)
+	return nil
+}
+
+// attachShim connects the streams of the container to the socket of its shim
+func (container *Container) attachShim(conn net.Conn) {
+	container.shimDone = make(chan bool)
+	stdout, stderr, done := container.stdout, container.stderr, container.shimDone
+	go func() {
+		defer close(done)
+		defer conn.Close()
+		for {
+			stream, data, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			switch stream {
+			case shimStdout:
+				stdout.Write(data)
+			case shimStderr:
+				stderr.Write(data)
+			}
+		}
+	}()
+	if container.Config.OpenStdin {
+		stdin := container.stdin
+		go func() {
+			defer stdin.Close()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stdin.Read(buf)
+				if n > 0 {
+					if err := writeFrame(conn, shimStdin, buf[:n]); err != nil {
+						return
+					}
+				}
+				if err != nil {
+					writeFrame(conn, shimStdin, nil)
+					return
+				}
+			}
+		}()
+	}
+}
+
+// waitShim waits for the shim to close its socket, and returns the exit code
+// of the container
+func (container *Container) waitShim() int {
+	<-container.shimDone
+	if container.cmd != nil {
+		// The shim was started by this daemon
+		container.cmd.Wait()
+	}
+	return readShimExitCode(container.root)
+}
+
+// reconnectShim reconnects to the shim of a container left running by a
+// previous daemon, or records the exit of the container if the shim is gone
+func (container *Container) reconnectShim() {
+	conn, err := net.Dial("unix", shimSocketPath(container.root))
+	if err != nil {
+		exitCode := readShimExitCode(container.root)
+		containerLog.Infof("%v: The container exited while the daemon was away (%d)", container.Id, exitCode)
+		if mounted, err := container.Mounted(); err == nil && mounted {
+			if err := container.Unmount(); err != nil {
+				containerLog.Errorf("%v: Failed to umount filesystem: %v", container.Id, err)
+			}
+		}
+		container.NetworkSettings = &NetworkSettings{}
+		container.State.setStopped(exitCode)
+		container.ToDisk()
+		return
+	}
+	if err := container.reclaimNetwork(); err != nil {
+		containerLog.Errorf("%v: Failed to reclaim network: %v", container.Id, err)
+	}
+	if err := container.mountVolumes(); err != nil {
+		containerLog.Errorf("%v: Failed to mount volumes: %v", container.Id, err)
+	}
+	container.attachShim(conn)
+	go container.monitor()
+	containerLog.Infof("%v: Reconnected to the running container", container.Id)
+}
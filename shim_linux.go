@@ -0,0 +1,9 @@
+package docker
+
+import "syscall"
+
+// shimSysProcAttr starts the shim in its own session, so that the signals
+// sent to the daemon don't reach the container
+func shimSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,100 @@
+package docker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShimFrames(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, shimStdout, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(&buf, shimStdin, nil); err != nil {
+		t.Fatal(err)
+	}
+	if stream, data, err := readFrame(&buf); err != nil || stream != shimStdout || string(data) != "hello" {
+		t.Errorf("Unexpected frame: %d %q (%v)", stream, data, err)
+	}
+	if stream, data, err := readFrame(&buf); err != nil || stream != shimStdin || len(data) != 0 {
+		t.Errorf("Unexpected frame: %d %q (%v)", stream, data, err)
+	}
+	if _, _, err := readFrame(&buf); err == nil {
+		t.Error("Reading past the last frame should fail")
+	}
+}
+
+func TestReadShimExitCode(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-shim-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if exitCode := readShimExitCode(root); exitCode != -1 {
+		t.Errorf("A shim which died should report -1, got %d", exitCode)
+	}
+	if err := ioutil.WriteFile(shimExitCodePath(root), []byte("42"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if exitCode := readShimExitCode(root); exitCode != 42 {
+		t.Errorf("Expected exit code 42, got %d", exitCode)
+	}
+}
+
+// TestRunShim runs the shim with a fake lxc-start, which echoes its
+// arguments and a line of stdin
+func TestRunShim(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-shim-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	script := "#!/bin/sh\necho \"$@\"\nread line\necho $line >&2\nexit 3\n"
+	if err := ioutil.WriteFile(path.Join(root, "lxc-start"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", root+":"+os.Getenv("PATH"))
+
+	exitCodes := make(chan int)
+	go func() {
+		exitCode, err := runShim(root, false, true, "", "", "", []string{"-f", "config"})
+		if err != nil {
+			t.Error(err)
+		}
+		exitCodes <- exitCode
+	}()
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", shimSocketPath(root)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, shimStdin, []byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	output := make(map[byte]string)
+	for {
+		stream, data, err := readFrame(conn)
+		if err != nil {
+			break
+		}
+		output[stream] += string(data)
+	}
+	if output[shimStdout] != "-f config\n" || strings.TrimSpace(output[shimStderr]) != "hello" {
+		t.Errorf("Unexpected output: %q", output)
+	}
+	if exitCode := <-exitCodes; exitCode != 3 || readShimExitCode(root) != 3 {
+		t.Errorf("Expected exit code 3, got %d (recorded %d)", exitCode, readShimExitCode(root))
+	}
+}
@@ -7,13 +7,15 @@ import (
 )
 
 type State struct {
-	Running   bool
-	Pid       int
-	ExitCode  int
-	StartedAt time.Time
+	Running    bool
+	Pid        int
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time // When the container last exited, zero if it never did
 
 	stateChangeLock *sync.Mutex
 	stateChangeCond *sync.Cond
+	exits           int // Times the container exited, guarded by stateChangeLock
 }
 
 // String returns a human-readable description of the state
@@ -24,6 +26,12 @@ func (s *State) String() string {
 	return fmt.Sprintf("Exit %d", s.ExitCode)
 }
 
+// exited returns whether the container is stopped after it ran, unlike a
+// container which was never started
+func (s *State) exited() bool {
+	return !s.Running && !s.FinishedAt.IsZero()
+}
+
 func (s *State) setRunning(pid int) {
 	s.Running = true
 	s.ExitCode = 0
@@ -36,9 +44,33 @@ func (s *State) setStopped(exitCode int) {
 	s.Running = false
 	s.Pid = 0
 	s.ExitCode = exitCode
+	s.FinishedAt = time.Now()
+	s.stateChangeLock.Lock()
+	s.exits++
+	s.stateChangeLock.Unlock()
 	s.broadcast()
 }
 
+// exitCount returns the number of times the container exited, to be
+// passed to waitExit
+func (s *State) exitCount() int {
+	s.stateChangeLock.Lock()
+	defer s.stateChangeLock.Unlock()
+	return s.exits
+}
+
+// waitExit waits for the container to exit once more than exits times, and
+// returns the exit code. Unlike wait, it doesn't miss an exit happening
+// before it is called.
+func (s *State) waitExit(exits int) int {
+	s.stateChangeLock.Lock()
+	defer s.stateChangeLock.Unlock()
+	for s.exits == exits {
+		s.stateChangeCond.Wait()
+	}
+	return s.ExitCode
+}
+
 func (s *State) broadcast() {
 	s.stateChangeLock.Lock()
 	s.stateChangeCond.Broadcast()
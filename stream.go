@@ -0,0 +1,18 @@
+package docker
+
+import (
+	"io"
+	"sync"
+)
+
+// lockedWriter serializes concurrent writes to the same writer
+type lockedWriter struct {
+	io.Writer
+	lock sync.Mutex
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.Writer.Write(p)
+}
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Only the sysctls of the namespaces of the container can be set, so that
+// it can't change the settings of the host: those of its network namespace,
+// and the message queues of its IPC namespace. They are written to
+// /proc/sys by docker-init, before it drops the capabilities.
+
+// The whitelisted sysctls, by prefix
+var namespacedSysctls = []string{
+	"net.",
+	"kernel.msg",
+	"fs.mqueue.",
+}
+
+var sysctlRegexp = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_-]+)+$`)
+
+func validateSysctl(name, value string) error {
+	if !sysctlRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid sysctl: %s", name)
+	}
+	whitelisted := false
+	for _, prefix := range namespacedSysctls {
+		if strings.HasPrefix(name, prefix) {
+			whitelisted = true
+		}
+	}
+	if !whitelisted {
+		return fmt.Errorf("The sysctl %s isn't namespaced, only net.*, kernel.msg* and fs.mqueue.* can be set", name)
+	}
+	if value == "" || strings.ContainsAny(value, "\n\x00") {
+		return fmt.Errorf("Invalid value of the sysctl %s: %q", name, value)
+	}
+	return nil
+}
+
+// sysctlParams returns the sysctls as NAME=VALUE, sorted by name
+func sysctlParams(sysctls map[string]string) []string {
+	var params []string
+	for name, value := range sysctls {
+		params = append(params, name+"="+value)
+	}
+	sort.Strings(params)
+	return params
+}
+
+// sysctlPath returns the file of a sysctl in /proc/sys
+func sysctlPath(name string) string {
+	return path.Join("/proc/sys", strings.Replace(name, ".", "/", -1))
+}
+
+// setSysctl writes a sysctl given as NAME=VALUE, inside the container
+func setSysctl(param string) error {
+	parts := strings.SplitN(param, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid sysctl: %s", param)
+	}
+	if err := validateSysctl(parts[0], parts[1]); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(sysctlPath(parts[0]), []byte(parts[1]), 0644); err != nil {
+		return fmt.Errorf("Unable to set the sysctl %s: %s", parts[0], err)
+	}
+	return nil
+}
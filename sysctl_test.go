@@ -0,0 +1,41 @@
+package docker
+
+import (
+	"testing"
+)
+
+func TestValidateSysctl(t *testing.T) {
+	for name, value := range map[string]string{
+		"net.core.somaxconn":           "1024",
+		"net.ipv4.ip_local_port_range": "1024 65000",
+		"kernel.msgmax":                "65536",
+		"fs.mqueue.msg_max":            "100",
+	} {
+		if err := validateSysctl(name, value); err != nil {
+			t.Error(err)
+		}
+	}
+	for name, value := range map[string]string{
+		"kernel.shmmax":      "1",
+		"vm.swappiness":      "0",
+		"net":                "1",
+		"net.core.somaxconn": "",
+		"net.core..x":        "1",
+		"net/core/somaxconn": "1",
+		"net.core.rmem_max":  "1\n2",
+	} {
+		if err := validateSysctl(name, value); err == nil {
+			t.Errorf("%s=%q should be refused", name, value)
+		}
+	}
+}
+
+func TestSysctlParams(t *testing.T) {
+	params := sysctlParams(map[string]string{"net.core.somaxconn": "1024", "kernel.msgmax": "65536"})
+	if !equalStrings(params, []string{"kernel.msgmax=65536", "net.core.somaxconn=1024"}) {
+		t.Fatalf("Unexpected params: %v", params)
+	}
+	if p := sysctlPath("net.core.somaxconn"); p != "/proc/sys/net/core/somaxconn" {
+		t.Fatalf("Unexpected path: %s", p)
+	}
+}
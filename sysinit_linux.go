@@ -0,0 +1,276 @@
+package docker
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Setup networking
+func setupNetworking(gw string) {
+	if gw == "" {
+		return
+	}
+	cmd := exec.Command("/sbin/route", "add", "default", "gw", gw)
+	if err := cmd.Run(); err != nil {
+		log.Fatalf("Unable to set up networking: %v", err)
+	}
+}
+
+// Takes care of dropping privileges to the desired user, and group if
+// given as "user:group"
+func changeUser(u string) {
+	if u == "" {
+		return
+	}
+	var g string
+	if parts := strings.SplitN(u, ":", 2); len(parts) == 2 {
+		u, g = parts[0], parts[1]
+	}
+	userent, err := user.LookupId(u)
+	if err != nil {
+		userent, err = user.Lookup(u)
+	}
+	if err != nil {
+		log.Fatalf("Unable to find user %v: %v", u, err)
+	}
+
+	uid, err := strconv.Atoi(userent.Uid)
+	if err != nil {
+		log.Fatalf("Invalid uid: %v", userent.Uid)
+	}
+	gid, err := strconv.Atoi(userent.Gid)
+	if err != nil {
+		log.Fatalf("Invalid gid: %v", userent.Gid)
+	}
+	if g != "" {
+		groupent, err := user.LookupGroupId(g)
+		if err != nil {
+			groupent, err = user.LookupGroup(g)
+		}
+		if err != nil {
+			log.Fatalf("Unable to find group %v: %v", g, err)
+		}
+		if gid, err = strconv.Atoi(groupent.Gid); err != nil {
+			log.Fatalf("Invalid gid: %v", groupent.Gid)
+		}
+	}
+
+	if err := syscall.Setgid(gid); err != nil {
+		log.Fatalf("setgid failed: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		log.Fatalf("setuid failed: %v", err)
+	}
+}
+
+// Clear environment pollution introduced by lxc-start
+func cleanupEnv() {
+	env := os.Environ()
+	os.Clearenv()
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		if parts[0] == "container" {
+			continue
+		}
+		os.Setenv(parts[0], parts[1])
+	}
+}
+
+// Set the resource limits given as NAME=SOFT[:HARD]
+func setUlimits(ulimits []string) {
+	for _, ulimit := range ulimits {
+		resource, limit, err := parseUlimit(ulimit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: limit.Cur, Max: limit.Max}); err != nil {
+			log.Fatalf("Unable to set ulimit %v: %v", ulimit, err)
+		}
+	}
+}
+
+// Set the namespaced kernel parameters given as NAME=VALUE
+func setSysctls(sysctls []string) {
+	for _, sysctl := range sysctls {
+		if err := setSysctl(sysctl); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Drop the capabilities which aren't given, separated by commas, from the
+// bounding set, unless all of them are kept
+func keepCapabilities(caps string) {
+	if caps == "all" {
+		return
+	}
+	var keep []string
+	if caps != "" {
+		keep = strings.Split(caps, ",")
+	}
+	if err := dropCapabilities(keep); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Make the root filesystem read-only, once the working directory exists
+func lockRootfs() {
+	if err := remountReadonly(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Prevent the program from gaining privileges, eg. through setuid binaries
+func lockPrivileges() {
+	if err := setNoNewPrivileges(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Apply the seccomp profile, before dropping privileges as it needs sys_admin
+func filterSyscalls(seccomp string) {
+	profile, err := ParseSeccompProfile(seccomp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if profile == nil {
+		return
+	}
+	if err := applySeccomp(profile); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Move to the working directory, creating it if needed
+func changeDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("Unable to create working directory %v: %v", dir, err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatalf("Unable to change to working directory %v: %v", dir, err)
+	}
+}
+
+func executeProgram(name string, args []string) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		log.Printf("Unable to locate %v", name)
+		os.Exit(127)
+	}
+
+	if err := syscall.Exec(path, args, os.Environ()); err != nil {
+		panic(err)
+	}
+}
+
+// runInit runs the program as a child of docker-init, which stays PID 1:
+// it forwards the signals it gets to the program, reaps the zombies left
+// behind by the processes of the container, and exits with the exit code of
+// the program once it exits.
+func runInit(name string, args []string) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		log.Printf("Unable to locate %v", name)
+		os.Exit(127)
+	}
+	// Listen before starting the program, so that no SIGCHLD is missed
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+	process, err := os.StartProcess(path, args, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		log.Fatalf("Unable to start %v: %v", name, err)
+	}
+	for sig := range signals {
+		if sig != syscall.SIGCHLD {
+			process.Signal(sig)
+			continue
+		}
+		if status, exited := reapChildren(process.Pid); exited {
+			os.Exit(initExitCode(status))
+		}
+	}
+}
+
+// reapChildren waits for all the children which exited, and returns the
+// status of the child pid if it is one of them
+func reapChildren(pid int) (status syscall.WaitStatus, exited bool) {
+	for {
+		var ws syscall.WaitStatus
+		child, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err != nil || child <= 0 {
+			return
+		}
+		if child == pid {
+			status, exited = ws, true
+		}
+	}
+}
+
+// initExitCode returns the exit code of a program, or 128 plus the signal
+// which killed it, like the shells do
+func initExitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+// Sys Init code
+// This code is run INSIDE the container and is responsible for setting
+// up the environment before running the actual process
+func SysInit() {
+	if len(os.Args) <= 1 {
+		fmt.Println("You should not invoke docker-init manually")
+		os.Exit(1)
+	}
+	var u = flag.String("u", "", "username or uid")
+	var gw = flag.String("g", "", "gateway address")
+	var workdir = flag.String("w", "", "working directory")
+	var init = flag.Bool("init", false, "run the program as a child which is reaped and gets the signals")
+	var caps = flag.String("caps", "all", "capabilities kept, separated by commas")
+	var seccomp = flag.String("seccomp", SECCOMP_UNCONFINED, "seccomp profile")
+	var readonly = flag.Bool("read-only", false, "remount the root filesystem read-only")
+	var noNewPrivs = flag.Bool("no-new-privs", false, "prevent the program from gaining privileges")
+	var ulimits ListOpts
+	flag.Var(&ulimits, "ulimit", "resource limit")
+	var sysctls ListOpts
+	flag.Var(&sysctls, "sysctl", "namespaced kernel parameter")
+
+	flag.Parse()
+
+	setupNetworking(*gw)
+	cleanupEnv()
+	setUlimits(ulimits)
+	setSysctls(sysctls)
+	changeDir(*workdir)
+	if *readonly {
+		lockRootfs()
+	}
+	keepCapabilities(*caps)
+	if *noNewPrivs {
+		lockPrivileges()
+	}
+	filterSyscalls(*seccomp)
+	changeUser(*u)
+	if *init {
+		runInit(flag.Arg(0), flag.Args())
+	}
+	executeProgram(flag.Arg(0), flag.Args())
+}
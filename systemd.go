@@ -0,0 +1,72 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+)
+
+// With -cgroup-driver=systemd, each container is started in a transient
+// systemd scope, docker-ID.scope in SYSTEMD_SLICE, created by systemd-run.
+// The scope is delegated to lxc, which creates the cgroups of the container
+// below it, so that systemd neither moves the processes of the containers
+// nor resets their limits, eg. on daemon-reload. The scope goes away with
+// the last process of the container. With the cgroupfs driver, the default,
+// lxc creates the cgroups of the containers itself.
+
+const SYSTEMD_SLICE = "system.slice"
+
+var cgroupDrivers = map[string]bool{
+	"cgroupfs": true,
+	"systemd":  true,
+}
+
+// systemdBooted returns whether the host was booted with systemd, like
+// sd_booted(3)
+func systemdBooted() bool {
+	fi, err := os.Stat("/run/systemd/system")
+	return err == nil && fi.IsDir()
+}
+
+// checkSystemdDriver returns an error if the systemd cgroup driver can't be
+// used on this host
+func checkSystemdDriver() error {
+	if !systemdBooted() {
+		return fmt.Errorf("The systemd cgroup driver requires a host booted with systemd")
+	}
+	if _, err := exec.LookPath("systemd-run"); err != nil {
+		return fmt.Errorf("The systemd cgroup driver requires systemd-run: %s", err)
+	}
+	return nil
+}
+
+func systemdScopeName(id string) string {
+	return "docker-" + id + ".scope"
+}
+
+// lxcStartCommand returns the command running lxc-start with args, in the
+// systemd scope unless it is empty
+func lxcStartCommand(scope string, args []string) *exec.Cmd {
+	if scope == "" {
+		return exec.Command("lxc-start", args...)
+	}
+	// systemd-run moves itself to the scope, then runs lxc-start in place
+	params := []string{
+		"--scope", "--quiet",
+		"--unit", scope,
+		"--slice", SYSTEMD_SLICE,
+		"--property", "Delegate=yes",
+		"--", "lxc-start",
+	}
+	return exec.Command("systemd-run", append(params, args...)...)
+}
+
+// cgroupParent returns the cgroup below which lxc creates the cgroups of
+// the container, relative to the root of the hierarchies
+func (container *Container) cgroupParent() string {
+	if container.SystemdScope == "" {
+		return "/"
+	}
+	return path.Join("/", SYSTEMD_SLICE, container.SystemdScope)
+}
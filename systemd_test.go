@@ -0,0 +1,30 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLxcStartCommand(t *testing.T) {
+	cmd := lxcStartCommand("", []string{"-n", "abc"})
+	if strings.Join(cmd.Args, " ") != "lxc-start -n abc" {
+		t.Errorf("Unexpected command without scope: %v", cmd.Args)
+	}
+	cmd = lxcStartCommand(systemdScopeName("abc"), []string{"-n", "abc"})
+	args := strings.Join(cmd.Args, " ")
+	if !strings.HasPrefix(args, "systemd-run --scope") || !strings.Contains(args, "--unit docker-abc.scope") ||
+		!strings.Contains(args, "Delegate=yes") || !strings.HasSuffix(args, "-- lxc-start -n abc") {
+		t.Errorf("Unexpected command in a scope: %v", cmd.Args)
+	}
+}
+
+func TestCgroupParent(t *testing.T) {
+	container := &Container{Id: "abc"}
+	if parent := container.cgroupParent(); parent != "/" {
+		t.Errorf("Expected the root without scope, got %s", parent)
+	}
+	container.SystemdScope = systemdScopeName(container.Id)
+	if parent := container.cgroupParent(); parent != "/system.slice/docker-abc.scope" {
+		t.Errorf("Unexpected parent in a scope: %s", parent)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"time"
 )
 
 const DEFAULT_TAG = "latest"
@@ -16,10 +18,23 @@ type TagStore struct {
 	path         string
 	graph        *Graph
 	Repositories map[string]Repository
+	// Images pulled or pushed with the v2 protocol, by "repository@digest"
+	// of their manifests
+	Digests map[string]string
+	// Images which lost their last tag when it was moved to another image,
+	// eg. by a rebuild, by id
+	Untagged map[string]*UntaggedImage
+	events   *EventBus
 }
 
 type Repository map[string]string
 
+// UntaggedImage is the tag an image lost, and when
+type UntaggedImage struct {
+	Name string // "repository:tag"
+	Date time.Time
+}
+
 func NewTagStore(path string, graph *Graph) (*TagStore, error) {
 	abspath, err := filepath.Abs(path)
 	if err != nil {
@@ -29,6 +44,8 @@ func NewTagStore(path string, graph *Graph) (*TagStore, error) {
 		path:         abspath,
 		graph:        graph,
 		Repositories: make(map[string]Repository),
+		Digests:      make(map[string]string),
+		Untagged:     make(map[string]*UntaggedImage),
 	}
 	// Load the json file if it exists, otherwise create it.
 	if err := store.Reload(); os.IsNotExist(err) {
@@ -61,6 +78,13 @@ func (store *TagStore) Reload() error {
 	if err := json.Unmarshal(jsonData, store); err != nil {
 		return err
 	}
+	// Stores saved before digests were recorded
+	if store.Digests == nil {
+		store.Digests = make(map[string]string)
+	}
+	if store.Untagged == nil {
+		store.Untagged = make(map[string]*UntaggedImage)
+	}
 	return nil
 }
 
@@ -69,11 +93,14 @@ func (store *TagStore) LookupImage(name string) (*Image, error) {
 	if err != nil {
 		// FIXME: standardize on returning nil when the image doesn't exist, and err for everything else
 		// (so we can pass all errors here)
-		repoAndTag := strings.SplitN(name, ":", 2)
-		if len(repoAndTag) == 1 {
-			repoAndTag = append(repoAndTag, DEFAULT_TAG)
+		if repoName, digest := splitDigest(name); digest != "" {
+			return store.GetDigest(repoName, digest)
+		}
+		repoName, tag := parseRepositoryTag(name)
+		if tag == "" {
+			tag = DEFAULT_TAG
 		}
-		if i, err := store.GetImage(repoAndTag[0], repoAndTag[1]); err != nil {
+		if i, err := store.GetImage(repoName, tag); err != nil {
 			return nil, err
 		} else if i == nil {
 			return nil, fmt.Errorf("Image does not exist: %s", name)
@@ -102,6 +129,16 @@ func (store *TagStore) ById() map[string][]string {
 	return byId
 }
 
+// Return the "repository@digest" references of each image, sorted
+func (store *TagStore) DigestsById() map[string][]string {
+	byId := make(map[string][]string)
+	for reference, id := range store.Digests {
+		byId[id] = append(byId[id], reference)
+		sort.Strings(byId[id])
+	}
+	return byId
+}
+
 func (store *TagStore) ImageName(id string) string {
 	if names, exists := store.ById()[id]; exists && len(names) > 0 {
 		return names[0]
@@ -131,15 +168,123 @@ func (store *TagStore) Set(repoName, tag, imageName string, force bool) error {
 		repo = r
 	} else {
 		repo = make(map[string]string)
-		if old, exists := store.Repositories[repoName]; exists && !force {
-			return fmt.Errorf("Tag %s:%s is already set to %s", repoName, tag, old)
-		}
 		store.Repositories[repoName] = repo
 	}
+	old, exists := repo[tag]
+	if exists && old != img.Id && !force {
+		return ConflictError(fmt.Sprintf("Tag %s:%s is already set to %s, use -f to move it", repoName, tag, old))
+	}
 	repo[tag] = img.Id
+	delete(store.Untagged, img.Id)
+	if exists && old != img.Id && len(store.ById()[old]) == 0 {
+		store.Untagged[old] = &UntaggedImage{Name: repoName + ":" + tag, Date: time.Now()}
+	}
+	// The images deleted since
+	for id := range store.Untagged {
+		if !store.graph.Exists(id) {
+			delete(store.Untagged, id)
+		}
+	}
+	if err := store.Save(); err != nil {
+		return err
+	}
+	store.events.Log("tag", img.Id, "", map[string]string{"name": repoName + ":" + tag})
+	return nil
+}
+
+// Untag removes a "repository:tag" (the latest tag by default) or a
+// "repository@digest" reference, and returns the id of the image it pointed
+// to
+func (store *TagStore) Untag(name string) (string, error) {
+	if err := store.Reload(); err != nil {
+		return "", err
+	}
+	var id string
+	if repoName, digest := splitDigest(name); digest != "" {
+		var exists bool
+		if id, exists = store.Digests[name]; !exists {
+			return "", fmt.Errorf("No such image: %s", name)
+		}
+		delete(store.Digests, repoName+"@"+digest)
+	} else {
+		repoName, tag := parseRepositoryTag(name)
+		if tag == "" {
+			tag = DEFAULT_TAG
+		}
+		repo, exists := store.Repositories[repoName]
+		if exists {
+			id, exists = repo[tag]
+		}
+		if !exists {
+			return "", fmt.Errorf("No such image: %s:%s", repoName, tag)
+		}
+		delete(repo, tag)
+		if len(repo) == 0 {
+			delete(store.Repositories, repoName)
+		}
+		name = repoName + ":" + tag
+	}
+	if err := store.Save(); err != nil {
+		return "", err
+	}
+	store.events.Log("untag", id, "", map[string]string{"name": name})
+	return id, nil
+}
+
+// SetDigest records that the manifest digest of the repository repoName
+// points to the image id
+func (store *TagStore) SetDigest(repoName, digest, id string) error {
+	if err := validateRepoName(repoName); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return fmt.Errorf("Invalid digest: %s", digest)
+	}
+	if err := store.Reload(); err != nil {
+		return err
+	}
+	store.Digests[repoName+"@"+digest] = id
 	return store.Save()
 }
 
+// UntagDigests removes the "repository@digest" references to the image id,
+// and returns them, sorted
+func (store *TagStore) UntagDigests(id string) ([]string, error) {
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	var references []string
+	for reference, imgId := range store.Digests {
+		if imgId == id {
+			references = append(references, reference)
+			delete(store.Digests, reference)
+		}
+	}
+	if len(references) == 0 {
+		return nil, nil
+	}
+	sort.Strings(references)
+	if err := store.Save(); err != nil {
+		return nil, err
+	}
+	for _, reference := range references {
+		store.events.Log("untag", id, "", map[string]string{"name": reference})
+	}
+	return references, nil
+}
+
+// GetDigest returns the image of a manifest digest of a repository
+func (store *TagStore) GetDigest(repoName, digest string) (*Image, error) {
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	id, exists := store.Digests[repoName+"@"+digest]
+	if !exists {
+		return nil, fmt.Errorf("Image does not exist: %s@%s", repoName, digest)
+	}
+	return store.graph.Get(id)
+}
+
 func (store *TagStore) Get(repoName string) (Repository, error) {
 	if err := store.Reload(); err != nil {
 		return nil, err
@@ -163,13 +308,57 @@ func (store *TagStore) GetImage(repoName, tag string) (*Image, error) {
 	return nil, nil
 }
 
+// matchUntagged returns whether name, "repository:tag", is one of the
+// references, "repository" for all its tags or "repository:tag"
+func matchUntagged(name string, references []string) bool {
+	repoName, tag := parseRepositoryTag(name)
+	for _, reference := range references {
+		if r, t := parseRepositoryTag(reference); r == repoName && (t == "" || t == tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split "repository:tag" into its repository and tag parts.
+// The tag is empty if none was given. A ":" followed by a "/" belongs to the
+// registry hostname of the repository (eg. "localhost:5000/app"), not to a tag.
+func parseRepositoryTag(name string) (string, string) {
+	n := strings.LastIndex(name, ":")
+	if n < 0 {
+		return name, ""
+	}
+	if tag := name[n+1:]; !strings.Contains(tag, "/") {
+		return name[:n], tag
+	}
+	return name, ""
+}
+
+// Components of repository names, and tag names
+var (
+	validRepoComponent = regexp.MustCompile(`^[a-zA-Z0-9]+([._-][a-zA-Z0-9]+)*$`)
+	validTagName       = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// NameError is returned when the name of a repository or of a tag is
+// invalid
+type NameError string
+
+func (e NameError) Error() string {
+	return string(e)
+}
+
 // Validate the name of a repository
 func validateRepoName(name string) error {
 	if name == "" {
-		return fmt.Errorf("Repository name can't be empty")
+		return NameError("Repository name can't be empty")
 	}
-	if strings.Contains(name, ":") {
-		return fmt.Errorf("Illegal repository name: %s", name)
+	// The registry hostname may contain a port number
+	_, remoteName := splitReposName(name)
+	for _, component := range strings.Split(remoteName, "/") {
+		if !validRepoComponent.MatchString(component) {
+			return NameError(fmt.Sprintf("Illegal repository name: %s", name))
+		}
 	}
 	return nil
 }
@@ -177,10 +366,10 @@ func validateRepoName(name string) error {
 // Validate the name of a tag
 func validateTagName(name string) error {
 	if name == "" {
-		return fmt.Errorf("Tag name can't be empty")
+		return NameError("Tag name can't be empty")
 	}
-	if strings.Contains(name, "/") || strings.Contains(name, ":") {
-		return fmt.Errorf("Illegal tag name: %s", name)
+	if !validTagName.MatchString(name) {
+		return NameError(fmt.Sprintf("Illegal tag name: %s", name))
 	}
 	return nil
 }
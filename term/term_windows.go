@@ -0,0 +1,66 @@
+package term
+
+import "syscall"
+
+// On windows, the terminal is the console, which is put into raw mode by
+// disabling its input modes
+
+const (
+	enableProcessedInput = 0x1
+	enableLineInput      = 0x2
+	enableEchoInput      = 0x4
+)
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+type State struct {
+	mode uint32
+}
+
+// handle returns the console handle of the given file descriptor, 0, 1 and
+// 2 being the standard ones.
+func handle(fd int) syscall.Handle {
+	switch fd {
+	case 0:
+		return syscall.Stdin
+	case 1:
+		return syscall.Stdout
+	case 2:
+		return syscall.Stderr
+	}
+	return syscall.Handle(fd)
+}
+
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	if r, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// IsTerminal returns true if the given file descriptor is a terminal.
+func IsTerminal(fd int) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(handle(fd), &mode) == nil
+}
+
+// MakeRaw put the terminal connected to the given file descriptor into raw
+// mode and returns the previous state of the terminal so that it can be
+// restored.
+func MakeRaw(fd int) (*State, error) {
+	var oldState State
+	if err := syscall.GetConsoleMode(handle(fd), &oldState.mode); err != nil {
+		return nil, err
+	}
+	mode := oldState.mode &^ (enableProcessedInput | enableLineInput | enableEchoInput)
+	if err := setConsoleMode(handle(fd), mode); err != nil {
+		return nil, err
+	}
+	return &oldState, nil
+}
+
+// Restore restores the terminal connected to the given file descriptor to a
+// previous state.
+func Restore(fd int, state *State) error {
+	return setConsoleMode(handle(fd), state.mode)
+}
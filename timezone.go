@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+)
+
+// The timezone of a container is set by mounting a file of the host on its
+// /etc/localtime, read-only: the /etc/localtime of the host with "host", or
+// a zone of the zoneinfo database of the host, eg. Europe/Paris. It works
+// with the images which don't ship the zoneinfo database, unlike TZ.
+// "none" leaves the /etc/localtime of the image, usually UTC.
+
+const (
+	TIMEZONE_HOST = "host"
+	TIMEZONE_NONE = "none"
+)
+
+var (
+	hostLocaltime = "/etc/localtime"
+	zoneinfoDir   = "/usr/share/zoneinfo"
+)
+
+var timezoneRegexp = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+
+func validateTimezone(tz string) error {
+	if tz == "" || tz == TIMEZONE_HOST || tz == TIMEZONE_NONE {
+		return nil
+	}
+	if !timezoneRegexp.MatchString(tz) {
+		return fmt.Errorf("Invalid timezone: %s (expected host, none or a zone, eg. Europe/Paris)", tz)
+	}
+	return nil
+}
+
+// TimezoneFile returns the file of the host mounted on /etc/localtime, or
+// an empty string if the container keeps the one of its image
+func (container *Container) TimezoneFile() string {
+	switch tz := container.Config.Timezone; tz {
+	case "", TIMEZONE_NONE:
+		return ""
+	case TIMEZONE_HOST:
+		return hostLocaltime
+	default:
+		return path.Join(zoneinfoDir, tz)
+	}
+}
+
+// setupTimezone checks the timezone file of the host, and replaces the
+// /etc/localtime of the container, often a symlink, with an empty file to
+// mount it on. The links of /etc are followed within the root filesystem.
+func (container *Container) setupTimezone() error {
+	file := container.TimezoneFile()
+	if file == "" {
+		return nil
+	}
+	if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("Unknown timezone %s: %s isn't a file of the host", container.Config.Timezone, file)
+	}
+	rootfs := container.RootfsPath()
+	etc, err := FollowSymlinkInScope(path.Join(rootfs, "etc"), rootfs)
+	if err != nil {
+		return err
+	}
+	localtime := path.Join(etc, "localtime")
+	if info, err := os.Lstat(localtime); err == nil && info.Mode().IsRegular() {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(localtime), 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(localtime); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(localtime, nil, 0644)
+}
@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestValidateTimezone(t *testing.T) {
+	for _, tz := range []string{"", "host", "none", "UTC", "Europe/Paris", "America/Port-au-Prince", "Etc/GMT+5"} {
+		if err := validateTimezone(tz); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, tz := range []string{"/etc/localtime", "../etc/shadow", "Europe//Paris", "Europe/", "Europe Paris"} {
+		if err := validateTimezone(tz); err == nil {
+			t.Errorf("%q should be invalid", tz)
+		}
+	}
+}
+
+func TestSetupTimezone(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-timezone-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	zoneinfo := path.Join(root, "zoneinfo")
+	if err := os.MkdirAll(path.Join(zoneinfo, "Europe"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(zoneinfo, "Europe", "Paris"), []byte("TZif"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { zoneinfoDir = dir }(zoneinfoDir)
+	zoneinfoDir = zoneinfo
+
+	container := &Container{root: path.Join(root, "container"), Config: &Config{Timezone: "Europe/Paris"}}
+	localtime := path.Join(container.RootfsPath(), "etc", "localtime")
+	// The /etc/localtime of the image is a symlink
+	if err := os.MkdirAll(path.Dir(localtime), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/share/zoneinfo/Etc/UTC", localtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := container.setupTimezone(); err != nil {
+		t.Fatal(err)
+	}
+	if container.TimezoneFile() != path.Join(zoneinfo, "Europe", "Paris") {
+		t.Errorf("Unexpected timezone file: %s", container.TimezoneFile())
+	}
+	if info, err := os.Lstat(localtime); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("Expected a file to mount the timezone on, got %v (%v)", info, err)
+	}
+
+	// The /etc of another image leads to a directory of the host
+	other := &Container{root: path.Join(root, "other"), Config: &Config{Timezone: "Europe/Paris"}}
+	outside := path.Join(root, "outside")
+	for _, dir := range []string{outside, other.RootfsPath()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, path.Join(other.RootfsPath(), "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.setupTimezone(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path.Join(outside, "localtime")); !os.IsNotExist(err) {
+		t.Errorf("The timezone shouldn't be set up out of the root filesystem")
+	}
+	if _, err := os.Lstat(path.Join(other.RootfsPath(), outside, "localtime")); err != nil {
+		t.Errorf("The timezone should be set up within the root filesystem: %s", err)
+	}
+
+	container.Config.Timezone = "Mars/Olympus_Mons"
+	if err := container.setupTimezone(); err == nil {
+		t.Fatalf("An unknown timezone should be refused")
+	}
+	container.Config.Timezone = "none"
+	if container.TimezoneFile() != "" {
+		t.Fatalf("Expected no timezone file, got %s", container.TimezoneFile())
+	}
+}
@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Names of the files looked up in DOCKER_CERT_PATH
+const (
+	DEFAULT_CA_FILE   = "ca.pem"
+	DEFAULT_CERT_FILE = "cert.pem"
+	DEFAULT_KEY_FILE  = "key.pem"
+)
+
+// DefaultCertPath returns the directory holding the TLS certificates:
+// $DOCKER_CERT_PATH, or ~/.docker.
+func DefaultCertPath() string {
+	if certPath := os.Getenv("DOCKER_CERT_PATH"); certPath != "" {
+		return certPath
+	}
+	return path.Join(os.Getenv("HOME"), ".docker")
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns the TLS configuration of the remote API.
+// With verify, clients must present a certificate signed by caFile.
+func ServerTLSConfig(caFile, certFile, keyFile string, verify bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load X509 key pair: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if verify {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// ClientTLSConfig returns the TLS configuration used to reach the remote
+// API, with the certificates found in certPath. The client certificate
+// is optional; with verify, the daemon certificate must be signed by the
+// CA of certPath.
+func ClientTLSConfig(certPath string, verify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: !verify,
+	}
+	if verify {
+		pool, err := loadCertPool(path.Join(certPath, DEFAULT_CA_FILE))
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	certFile, keyFile := path.Join(certPath, DEFAULT_CERT_FILE), path.Join(certPath, DEFAULT_KEY_FILE)
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't load X509 key pair: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,136 @@
+package docker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Write a certificate and its key to dir/name-cert.pem and dir/name-key.pem,
+// signed by parent (self-signed if parent is nil)
+func writeTestCert(t *testing.T, dir, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(path.Join(dir, name+"-cert.pem"), certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name+"-key.pem"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestTLSVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := writeTestCert(t, dir, "ca", true, nil, nil)
+	writeTestCert(t, dir, "server", false, ca, caKey)
+	writeTestCert(t, dir, "client", false, ca, caKey)
+
+	serverConfig, err := ServerTLSConfig(path.Join(dir, "ca-cert.pem"), path.Join(dir, "server-cert.pem"), path.Join(dir, "server-key.pem"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	go ListenAndServeAPI("tcp", addr, &Server{}, serverConfig)
+
+	// Lay out the client certificates as in DOCKER_CERT_PATH
+	certPath := path.Join(dir, "client")
+	if err := os.Mkdir(certPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for src, dst := range map[string]string{
+		"ca-cert.pem":     DEFAULT_CA_FILE,
+		"client-cert.pem": DEFAULT_CERT_FILE,
+		"client-key.pem":  DEFAULT_KEY_FILE,
+	} {
+		if err := os.Rename(path.Join(dir, src), path.Join(certPath, dst)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clientConfig, err := ClientTLSConfig(certPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the server some time to start
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	get := func(client *http.Client) (*http.Response, error) {
+		return client.Get("https://" + addr + "/version")
+	}
+
+	res, err := get(&http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+
+	// Without a client certificate, the connection must be refused
+	os.Remove(path.Join(certPath, DEFAULT_CERT_FILE))
+	anonymousConfig, err := ClientTLSConfig(certPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := get(&http.Client{Transport: &http.Transport{TLSClientConfig: anonymousConfig}}); err == nil {
+		res.Body.Close()
+		t.Errorf("A client without certificate shouldn't be served")
+	}
+}
@@ -0,0 +1,319 @@
+package docker
+
+import (
+	"archive/tar"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Content trust: the tags pushed by the daemon are signed with its key, and
+// the signatures of the tags pulled are verified against the keys of the
+// publishers trusted by the daemon. A signature covers the name of the
+// repository and the tag, the ids of the images of the tag, the digests of
+// their JSON and the tarsums of their layers, so that it can neither be
+// moved to another tag nor to other images.
+
+// TrustStore keeps the signing key of the daemon, key.pem, and the public
+// keys of the trusted publishers, keys/NAME.pem
+type TrustStore struct {
+	root string
+	lock sync.Mutex
+	key  *ecdsa.PrivateKey
+}
+
+type TrustedKey struct {
+	Name        string
+	Fingerprint string
+	key         *ecdsa.PublicKey
+}
+
+var validKeyName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func NewTrustStore(root string) (*TrustStore, error) {
+	if err := os.MkdirAll(path.Join(root, "keys"), 0700); err != nil {
+		return nil, err
+	}
+	return &TrustStore{root: root}, nil
+}
+
+// SigningKey returns the key of the daemon, generated on first use
+func (store *TrustStore) SigningKey() (*ecdsa.PrivateKey, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.key != nil {
+		return store.key, nil
+	}
+	keyPath := path.Join(store.root, "key.pem")
+	data, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("Invalid signing key: %s", keyPath)
+		}
+		if store.key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Invalid signing key: %s: %s", keyPath, err)
+		}
+		return store.key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	trustLog.Infof("Generated the signing key %s", keyPath)
+	store.key = key
+	return key, nil
+}
+
+// HasSigningKey returns whether the key of the daemon has been generated
+func (store *TrustStore) HasSigningKey() bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.key != nil {
+		return true
+	}
+	_, err := os.Stat(path.Join(store.root, "key.pem"))
+	return !os.IsNotExist(err)
+}
+
+// PublicKey returns the public part of the signing key, in PEM, to be
+// trusted by the daemons pulling the images pushed by this one
+func (store *TrustStore) PublicKey() (*TrustedKey, []byte, error) {
+	key, err := store.SigningKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &TrustedKey{Fingerprint: keyFingerprint(der), key: &key.PublicKey}, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// parsePublicKey parses an ECDSA public key in PEM
+func parsePublicKey(data []byte) (*TrustedKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("Invalid public key: expected a PEM block of type PUBLIC KEY")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key: %s", err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Invalid public key: only ECDSA keys are supported")
+	}
+	return &TrustedKey{Fingerprint: keyFingerprint(block.Bytes), key: key}, nil
+}
+
+func keyFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func (store *TrustStore) keyPath(name string) string {
+	return path.Join(store.root, "keys", name+".pem")
+}
+
+// Keys returns the trusted keys, sorted by name
+func (store *TrustStore) Keys() ([]*TrustedKey, error) {
+	files, err := ioutil.ReadDir(path.Join(store.root, "keys"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*TrustedKey
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".pem") {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), ".pem")
+		data, err := ioutil.ReadFile(store.keyPath(name))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePublicKey(data)
+		if err != nil {
+			trustLog.Warnf("Ignoring the key %s: %s", name, err)
+			continue
+		}
+		key.Name = name
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// AddKey trusts the signatures of a publisher, whose public key is given in
+// PEM. An existing key of the same name is replaced.
+func (store *TrustStore) AddKey(name string, data []byte) (*TrustedKey, error) {
+	if !validKeyName.MatchString(name) {
+		return nil, fmt.Errorf("Invalid key name: %s", name)
+	}
+	key, err := parsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	key.Name = name
+	if err := ioutil.WriteFile(store.keyPath(name), data, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (store *TrustStore) RemoveKey(name string) error {
+	if !validKeyName.MatchString(name) {
+		return fmt.Errorf("No such key: %s", name)
+	}
+	if err := os.Remove(store.keyPath(name)); os.IsNotExist(err) {
+		return fmt.Errorf("No such key: %s", name)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ImageManifest lists the images of a tag, the tagged image first, with the
+// tarsums of their layers, and the signatures of this list
+type ImageManifest struct {
+	Name       string
+	Tag        string
+	Layers     []ManifestLayer
+	Signatures []ManifestSignature `json:",omitempty"`
+}
+
+type ManifestLayer struct {
+	Id         string
+	TarSum     string
+	JsonDigest string // sha256:HEX of the JSON of the image, as pushed
+}
+
+type ManifestSignature struct {
+	Key       string // Fingerprint of the public key
+	Signature []byte // ASN.1 ECDSA signature of the SHA-256 of the payload
+}
+
+// payload returns what the signatures sign: the manifest without them
+func (manifest *ImageManifest) payload() ([]byte, error) {
+	unsigned := *manifest
+	unsigned.Signatures = nil
+	return json.Marshal(&unsigned)
+}
+
+func (manifest *ImageManifest) Sign(key *ecdsa.PrivateKey) error {
+	payload, err := manifest.payload()
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	manifest.Signatures = append(manifest.Signatures, ManifestSignature{Key: keyFingerprint(der), Signature: signature})
+	return nil
+}
+
+// Verify returns the trusted key which signed the manifest of name:tag
+func (store *TrustStore) Verify(manifest *ImageManifest, name, tag string) (*TrustedKey, error) {
+	if manifest.Name != name || manifest.Tag != tag {
+		return nil, fmt.Errorf("The signature of %s:%s is for %s:%s", name, tag, manifest.Name, manifest.Tag)
+	}
+	keys, err := store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := manifest.payload()
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(payload)
+	for _, signature := range manifest.Signatures {
+		for _, key := range keys {
+			if key.Fingerprint == signature.Key && ecdsa.VerifyASN1(key.key, digest[:], signature.Signature) {
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s:%s isn't signed by a trusted key", manifest.Name, manifest.Tag)
+}
+
+// layers returns the signed layers, by image id
+func (manifest *ImageManifest) layers() map[string]ManifestLayer {
+	layers := make(map[string]ManifestLayer)
+	for _, layer := range manifest.Layers {
+		layers[layer.Id] = layer
+	}
+	return layers
+}
+
+// jsonDigest returns the digest of the JSON of an image signed by a
+// ManifestLayer
+func jsonDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// tarSum returns a checksum of a layer archive which depends neither on its
+// compression nor on the order of its entries, so that a layer extracted
+// and archived again keeps its checksum. It covers the names, modes,
+// owners, types, links and contents of the entries, but not their times.
+func tarSum(archive Archive) (string, error) {
+	uncompressed, err := decompressArchive(archive)
+	if err != nil {
+		return "", err
+	}
+	tr := tar.NewReader(uncompressed)
+	var sums []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		typeflag := hdr.Typeflag
+		if typeflag == tar.TypeRegA {
+			typeflag = tar.TypeReg
+		}
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\x00%o\x00%d\x00%d\x00%c\x00%s\x00%d\x00%d\x00",
+			path.Clean("/"+hdr.Name), hdr.Mode&07777, hdr.Uid, hdr.Gid, typeflag, hdr.Linkname, hdr.Devmajor, hdr.Devminor)
+		if _, err := io.Copy(h, tr); err != nil {
+			return "", err
+		}
+		sums = append(sums, hex.EncodeToString(h.Sum(nil)))
+	}
+	sort.Strings(sums)
+	h := sha256.New()
+	for _, sum := range sums {
+		io.WriteString(h, sum)
+	}
+	return "tarsum+sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,234 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/dotcloud/docker/auth"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func tempTrustStore(t *testing.T) *TrustStore {
+	root, err := ioutil.TempDir("", "docker-trust-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewTrustStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestTrustStore(t *testing.T) {
+	store := tempTrustStore(t)
+	defer os.RemoveAll(store.root)
+
+	key, data, err := store.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The signing key is kept across restarts
+	if reloaded, _, err := (&TrustStore{root: store.root}).PublicKey(); err != nil || reloaded.Fingerprint != key.Fingerprint {
+		t.Fatalf("Expected the same signing key, got %v (%v)", reloaded, err)
+	}
+	trusted, err := store.AddKey("publisher", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trusted.Fingerprint != key.Fingerprint {
+		t.Errorf("Expected the fingerprint %s, got %s", key.Fingerprint, trusted.Fingerprint)
+	}
+	if keys, err := store.Keys(); err != nil || len(keys) != 1 || keys[0].Name != "publisher" {
+		t.Errorf("Unexpected keys: %v (%v)", keys, err)
+	}
+	if _, err := store.AddKey("../publisher", data); err == nil {
+		t.Errorf("Invalid key names should be rejected")
+	}
+	if _, err := store.AddKey("other", []byte("not a key")); err == nil {
+		t.Errorf("Invalid keys should be rejected")
+	}
+	if err := store.RemoveKey("publisher"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RemoveKey("publisher"); err == nil || !strings.HasPrefix(err.Error(), "No such key") {
+		t.Errorf("Expected No such key, got %v", err)
+	}
+}
+
+func TestManifestSignature(t *testing.T) {
+	store := tempTrustStore(t)
+	defer os.RemoveAll(store.root)
+	key, err := store.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &ImageManifest{Name: "shykes/base", Tag: "latest", Layers: []ManifestLayer{{"b", "tarsum+sha256:2", "sha256:b"}, {"a", "tarsum+sha256:1", "sha256:a"}}}
+	if err := manifest.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Verify(manifest, "shykes/base", "latest"); err == nil {
+		t.Errorf("The manifest shouldn't be trusted before its key is")
+	}
+	_, data, err := store.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddKey("self", data); err != nil {
+		t.Fatal(err)
+	}
+	if trusted, err := store.Verify(manifest, "shykes/base", "latest"); err != nil || trusted.Name != "self" {
+		t.Errorf("Expected the manifest to be signed by self, got %v (%v)", trusted, err)
+	}
+	if _, err := store.Verify(manifest, "shykes/base", "stable"); err == nil {
+		t.Errorf("The manifest of another tag shouldn't be trusted")
+	}
+	manifest.Layers[1].JsonDigest = "sha256:c"
+	if _, err := store.Verify(manifest, "shykes/base", "latest"); err == nil {
+		t.Errorf("A modified manifest shouldn't be trusted")
+	}
+}
+
+func testLayer(t *testing.T, compress bool, files ...string) []byte {
+	buf := new(bytes.Buffer)
+	var tw *tar.Writer
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(buf)
+	}
+	for i := 0; i < len(files); i += 2 {
+		if err := tw.WriteHeader(&tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(files[i+1]))
+	}
+	tw.Close()
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+func TestTarSum(t *testing.T) {
+	sum := func(layer []byte) string {
+		s, err := tarSum(bytes.NewReader(layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	reference := sum(testLayer(t, false, "./etc/motd", "hello", "bin/sh", "#!"))
+	if !strings.HasPrefix(reference, "tarsum+sha256:") {
+		t.Fatalf("Unexpected tarsum: %s", reference)
+	}
+	// Neither the order nor the compression nor the ./ prefix matter
+	if s := sum(testLayer(t, true, "bin/sh", "#!", "etc/motd", "hello")); s != reference {
+		t.Errorf("Expected %s, got %s", reference, s)
+	}
+	if s := sum(testLayer(t, false, "etc/motd", "hello!", "bin/sh", "#!")); s == reference {
+		t.Errorf("A modified layer should have another tarsum")
+	}
+}
+
+func TestVerifyTag(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	graph.trust = tempTrustStore(t)
+	defer os.RemoveAll(graph.trust.root)
+
+	key, err := graph.trust.SigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := &ImageManifest{Name: "base", Tag: "signed", Layers: []ManifestLayer{{"b", "tarsum+sha256:2", "sha256:b"}, {"a", "tarsum+sha256:1", "sha256:a"}}}
+	if err := signed.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/library/base/signed/signature", "/library/base/moved/signature":
+			json.NewEncoder(w).Encode(signed)
+		case "/library/base/broken/signature":
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	verify := func(tag, rev string) (map[string]ManifestLayer, error) {
+		return graph.verifyTag(ioutil.Discard, nil, server.URL+"/library/base", "base", "base", tag, rev, &auth.AuthConfig{})
+	}
+	// Not trusted yet: pulled unverified, unless content trust is enforced
+	if sums, err := verify("signed", "b"); err != nil || sums != nil {
+		t.Errorf("Expected an unverified pull, got %v (%v)", sums, err)
+	}
+	graph.contentTrust = true
+	if _, err := verify("signed", "b"); err == nil {
+		t.Errorf("An untrusted signature should be refused")
+	}
+	_, data, err := graph.trust.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := graph.trust.AddKey("self", data); err != nil {
+		t.Fatal(err)
+	}
+	sums, err := verify("signed", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sums) != "map[a:{a tarsum+sha256:1 sha256:a} b:{b tarsum+sha256:2 sha256:b}]" {
+		t.Errorf("Unexpected layers: %v", sums)
+	}
+	if _, err := verify("moved", "b"); err == nil {
+		t.Errorf("The signature of another tag should be refused")
+	}
+	if _, err := verify("broken", "b"); err == nil {
+		t.Errorf("A signature which can't be fetched should be refused when content trust is enforced")
+	}
+	if _, err := verify("signed", "c"); err == nil {
+		t.Errorf("A signature of another image should be refused")
+	}
+	if _, err := verify("unsigned", "c"); err == nil {
+		t.Errorf("Unsigned tags should be refused when content trust is enforced")
+	}
+	graph.contentTrust = false
+	if sums, err := verify("unsigned", "c"); err != nil || sums != nil {
+		t.Errorf("Expected an unverified pull, got %v (%v)", sums, err)
+	}
+	if sums, err := verify("broken", "b"); err != nil || sums != nil {
+		t.Errorf("Expected an unverified pull, got %v (%v)", sums, err)
+	}
+}
+
+func TestRemoteImageDigest(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	id := GenerateId()
+	data := []byte(`{"id":"` + id + `","comment":"signed"}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+	img, err := graph.getRemoteImage(ioutil.Discard, nil, id, server.URL, &auth.AuthConfig{}, jsonDigest(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Comment != "signed" {
+		t.Errorf("Unexpected image: %#v", img)
+	}
+	if _, err := graph.getRemoteImage(ioutil.Discard, nil, id, server.URL, &auth.AuthConfig{}, jsonDigest([]byte("{}"))); err == nil {
+		t.Errorf("Metadata which doesn't match its signature should be refused")
+	}
+}
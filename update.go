@@ -0,0 +1,198 @@
+package docker
+
+import (
+	"fmt"
+	"github.com/dotcloud/docker/api"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The period of the CPU quota of the containers, in microseconds
+const cpuPeriod = 100000
+
+// Update changes the resource limits and the restart policy of the
+// container. The fields of update left nil leave the settings unchanged,
+// and the limits set to 0 are removed. The limits of a running container
+// are written to its cgroups right away.
+func (container *Container) Update(update *api.Update) error {
+	config := *container.Config
+	if update.Memory != nil {
+		config.Memory = *update.Memory
+	}
+	if update.MemorySwap != nil {
+		config.MemorySwap = *update.MemorySwap
+	}
+	if update.CpuShares != nil {
+		config.CpuShares = *update.CpuShares
+	}
+	if update.CpuQuota != nil {
+		config.CpuQuota = *update.CpuQuota
+	}
+	if update.Restart != nil {
+		config.Restart = *update.Restart
+	}
+	if err := validateConfig(&config); err != nil {
+		return err
+	}
+	if container.runtime.config.Rootless {
+		if err := checkRootlessLimits(&config); err != nil {
+			return err
+		}
+	}
+	if container.State.Running {
+		if err := container.updateCgroups(container.Config, &config); err != nil {
+			return err
+		}
+	}
+	container.Config = &config
+	if err := container.ToDisk(); err != nil {
+		return err
+	}
+	container.runtime.events.Log("update", container.Id, container.Image, nil)
+	return nil
+}
+
+// updateCgroups writes the limits of config which changed from old to the
+// cgroups of the running container. If a write fails, the files written
+// before get their previous values back.
+func (container *Container) updateCgroups(old, config *Config) error {
+	version := cgroupVersion()
+	var swap bool
+	if version == 2 {
+		_, swap = unifiedMemoryLimitSupport()
+	} else {
+		_, swap = memoryLimitSupport()
+	}
+	var writes []cgroupLimit
+	for _, limit := range cgroupUpdates(old, config, version, swap) {
+		file, err := container.cgroupFile(version, limit.File)
+		if err != nil {
+			return err
+		}
+		writes = append(writes, cgroupLimit{file, limit.Value})
+	}
+	return writeCgroupFiles(writes)
+}
+
+// cgroupUpdates returns the files of the cgroups of a running container to
+// write to change its limits from old to config, in the hierarchy of
+// version. The limits which config removes are reset to the values of the
+// cgroups without limit.
+func cgroupUpdates(old, config *Config, version int, swap bool) []cgroupLimit {
+	previous := make(map[string]string)
+	for _, limit := range cgroupSettings(old, version, swap) {
+		previous[limit.File] = limit.Value
+	}
+	var updates []cgroupLimit
+	for _, limit := range cgroupSettings(config, version, swap) {
+		if previous[limit.File] != limit.Value {
+			updates = append(updates, limit)
+		}
+	}
+	// On v1, the memory limit can't exceed the memory+swap limit: raise
+	// the latter first, or lower it last
+	for i, limit := range updates {
+		if limit.File == "memory.memsw.limit_in_bytes" && cgroupValueAbove(limit.Value, previous[limit.File]) {
+			updates = append([]cgroupLimit{limit}, append(updates[:i:i], updates[i+1:]...)...)
+			break
+		}
+	}
+	return updates
+}
+
+// cgroupSettings returns the values of all the files of the cgroups of a
+// container with config which cgroupLimits may set: its limits, and the
+// values without limit for the others
+func cgroupSettings(config *Config, version int, swap bool) []cgroupLimit {
+	settings := []cgroupLimit{
+		{"memory.limit_in_bytes", "-1"},
+		{"memory.soft_limit_in_bytes", "-1"},
+		{"memory.memsw.limit_in_bytes", "-1"},
+		{"cpu.shares", "1024"},
+		{"cpu.cfs_period_us", fmt.Sprint(cpuPeriod)},
+		{"cpu.cfs_quota_us", "-1"},
+	}
+	if version == 2 {
+		settings = []cgroupLimit{
+			{"memory.max", "max"},
+			{"memory.low", "0"},
+			{"memory.swap.max", "max"},
+			{"cpu.weight", "100"},
+			{"cpu.max", fmt.Sprintf("max %d", cpuPeriod)},
+		}
+	}
+	values := make(map[string]string)
+	for _, limit := range cgroupLimits(config, version, swap) {
+		values[limit.File] = limit.Value
+	}
+	var limits []cgroupLimit
+	for _, setting := range settings {
+		if !swap && (setting.File == "memory.memsw.limit_in_bytes" || setting.File == "memory.swap.max") {
+			continue
+		}
+		if value, exists := values[setting.File]; exists {
+			setting.Value = value
+		}
+		limits = append(limits, setting)
+	}
+	return limits
+}
+
+// cgroupValueAbove returns whether the limit value is above the limit
+// previous, -1 being unlimited
+func cgroupValueAbove(value, previous string) bool {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.ParseInt(previous, 10, 64)
+	if err != nil {
+		return false
+	}
+	if v == -1 || p == -1 {
+		return v == -1 && p != -1
+	}
+	return v > p
+}
+
+// cgroupFile returns the path of a file of the cgroup created by lxc for
+// the running container, in the hierarchy of version
+func (container *Container) cgroupFile(version int, file string) (string, error) {
+	if version == 2 {
+		dir, err := container.unifiedCgroupDir()
+		if err != nil {
+			return "", err
+		}
+		return path.Join(dir, file), nil
+	}
+	mountpoint, err := cgroupMountpoint(strings.SplitN(file, ".", 2)[0])
+	if err != nil {
+		return "", err
+	}
+	return path.Join(mountpoint, container.cgroupParent(), "lxc", container.Id, file), nil
+}
+
+// writeCgroupFiles writes the values of limits to their files, in order.
+// If a write fails, the files written before get their previous values
+// back, in the reverse order.
+func writeCgroupFiles(limits []cgroupLimit) error {
+	var written []cgroupLimit
+	for _, limit := range limits {
+		data, err := ioutil.ReadFile(limit.File)
+		if err == nil {
+			err = ioutil.WriteFile(limit.File, []byte(limit.Value), 0644)
+		}
+		if err != nil {
+			for i := len(written) - 1; i >= 0; i-- {
+				if err := ioutil.WriteFile(written[i].File, []byte(written[i].Value), 0644); err != nil {
+					containerLog.Errorf("Error restoring %s: %s", written[i].File, err)
+				}
+			}
+			return err
+		}
+		written = append(written, cgroupLimit{limit.File, strings.TrimSpace(string(data))})
+	}
+	return nil
+}
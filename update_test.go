@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestCgroupUpdates(t *testing.T) {
+	old := &Config{Memory: 33554432, CpuShares: 512, CpuQuota: 50000}
+
+	// Raising the memory raises memory+swap first
+	config := *old
+	config.Memory = 67108864
+	expected := []cgroupLimit{
+		{"memory.memsw.limit_in_bytes", "134217728"},
+		{"memory.limit_in_bytes", "67108864"},
+		{"memory.soft_limit_in_bytes", "67108864"},
+	}
+	if updates := cgroupUpdates(old, &config, 1, true); !reflect.DeepEqual(updates, expected) {
+		t.Errorf("Unexpected updates raising the memory: %v", updates)
+	}
+	// and lowering it lowers memory+swap last
+	if updates := cgroupUpdates(&config, old, 1, true); len(updates) != 3 || updates[2].File != "memory.memsw.limit_in_bytes" {
+		t.Errorf("Unexpected updates lowering the memory: %v", updates)
+	}
+
+	// The limits set to 0 are removed
+	expected = []cgroupLimit{
+		{"memory.memsw.limit_in_bytes", "-1"},
+		{"memory.limit_in_bytes", "-1"},
+		{"memory.soft_limit_in_bytes", "-1"},
+		{"cpu.shares", "1024"},
+		{"cpu.cfs_quota_us", "-1"},
+	}
+	if updates := cgroupUpdates(old, &Config{}, 1, true); !reflect.DeepEqual(updates, expected) {
+		t.Errorf("Unexpected v1 updates removing the limits: %v", updates)
+	}
+	expected = []cgroupLimit{
+		{"memory.max", "max"},
+		{"memory.low", "0"},
+		{"cpu.weight", "100"},
+		{"cpu.max", "max 100000"},
+	}
+	if updates := cgroupUpdates(old, &Config{}, 2, false); !reflect.DeepEqual(updates, expected) {
+		t.Errorf("Unexpected v2 updates removing the limits: %v", updates)
+	}
+
+	if updates := cgroupUpdates(old, old, 2, true); len(updates) != 0 {
+		t.Errorf("No updates expected, got %v", updates)
+	}
+}
+
+func TestWriteCgroupFilesRestoresOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for file, value := range map[string]string{"memory.max": "33554432\n", "memory.low": "33554432\n"} {
+		if err := ioutil.WriteFile(path.Join(dir, file), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writeCgroupFiles([]cgroupLimit{
+		{path.Join(dir, "memory.max"), "67108864"},
+		{path.Join(dir, "memory.low"), "67108864"},
+		{path.Join(dir, "missing", "cpu.max"), "50000 100000"},
+	})
+	if err == nil {
+		t.Fatal("Writing a missing file should fail")
+	}
+	for _, file := range []string{"memory.max", "memory.low"} {
+		if data, err := ioutil.ReadFile(path.Join(dir, file)); err != nil || string(data) != "33554432" {
+			t.Errorf("Expected the previous value of %s to be restored, got %q (%v)", file, data, err)
+		}
+	}
+
+	if err := writeCgroupFiles([]cgroupLimit{{path.Join(dir, "memory.max"), "max"}}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(dir, "memory.max")); string(data) != "max" {
+		t.Errorf("Expected memory.max to be written, got %q", data)
+	}
+}
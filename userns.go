@@ -0,0 +1,224 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The files giving the subordinate ids of the users, see subuid(5)
+const (
+	SUBUID_FILE = "/etc/subuid"
+	SUBGID_FILE = "/etc/subgid"
+)
+
+// IdRange is a range of host ids, which the ids 0 to Size-1 of the
+// containers are mapped to
+type IdRange struct {
+	Start int
+	Size  int
+}
+
+// UsernsRemap maps the users and groups of the containers to unprivileged
+// ranges of ids of the host, so that root in a container isn't root on the
+// host. The images and containers of a remap are kept in their own subtree
+// of the root of the runtime, whose layers are owned by the host ids.
+type UsernsRemap struct {
+	User  string
+	Group string
+	Uids  IdRange
+	Gids  IdRange
+}
+
+// parseUsernsRemap splits the value of the userns-remap setting:
+// USER[:GROUP]. The group defaults to the user.
+func parseUsernsRemap(spec string) (user, group string, err error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+		return "", "", fmt.Errorf("Invalid userns-remap: %s (expected USER or USER:GROUP)", spec)
+	}
+	user, group = parts[0], parts[0]
+	if len(parts) == 2 {
+		group = parts[1]
+	}
+	return user, group, nil
+}
+
+// parseSubIds returns the first range of subordinate ids of name in file,
+// whose lines are NAME:START:SIZE
+func parseSubIds(file, name string) (IdRange, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return IdRange{}, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(parts) != 3 || parts[0] != name {
+			continue
+		}
+		start, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return IdRange{}, fmt.Errorf("Invalid line in %s: %s", file, scanner.Text())
+		}
+		size, err := strconv.Atoi(parts[2])
+		if err != nil || size <= 0 {
+			return IdRange{}, fmt.Errorf("Invalid line in %s: %s", file, scanner.Text())
+		}
+		// The ids of the host below the range would be reachable from the containers
+		if start < size {
+			return IdRange{}, fmt.Errorf("The range of %s in %s must start above its size", name, file)
+		}
+		return IdRange{Start: start, Size: size}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return IdRange{}, err
+	}
+	return IdRange{}, fmt.Errorf("No subordinate ids for %s in %s", name, file)
+}
+
+func LoadUsernsRemap(spec, subuidFile, subgidFile string) (*UsernsRemap, error) {
+	user, group, err := parseUsernsRemap(spec)
+	if err != nil {
+		return nil, err
+	}
+	uids, err := parseSubIds(subuidFile, user)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := parseSubIds(subgidFile, group)
+	if err != nil {
+		return nil, err
+	}
+	return &UsernsRemap{User: user, Group: group, Uids: uids, Gids: gids}, nil
+}
+
+// Dir returns the name of the subtree of the root of the runtime holding the
+// images and containers of the remap, eg. 100000.100000
+func (remap *UsernsRemap) Dir() string {
+	return fmt.Sprintf("%d.%d", remap.Uids.Start, remap.Gids.Start)
+}
+
+// ToHost returns the host ids of the ids of a container. The ids outside
+// the range are mapped to the last id of the range, like the kernel maps
+// them to the overflow id.
+func (remap *UsernsRemap) ToHost(uid, gid int) (int, int) {
+	return toHostId(remap.Uids, uid), toHostId(remap.Gids, gid)
+}
+
+// ToContainer returns the ids in a container of the host ids
+func (remap *UsernsRemap) ToContainer(uid, gid int) (int, int) {
+	return toContainerId(remap.Uids, uid), toContainerId(remap.Gids, gid)
+}
+
+func toHostId(r IdRange, id int) int {
+	if id < 0 || id >= r.Size {
+		return r.Start + r.Size - 1
+	}
+	return r.Start + id
+}
+
+func toContainerId(r IdRange, id int) int {
+	if id < r.Start || id >= r.Start+r.Size {
+		return r.Size - 1
+	}
+	return id - r.Start
+}
+
+// Chown gives the file at path, but not its content, to root in the
+// containers
+func (remap *UsernsRemap) Chown(path string) error {
+	uid, gid := remap.ToHost(0, 0)
+	return os.Lchown(path, uid, gid)
+}
+
+// remapArchive rewrites the ownership of the entries of a tar archive with
+// mapIds
+func remapArchive(archive Archive, mapIds func(uid, gid int) (int, int)) Archive {
+	pipeR, pipeW := io.Pipe()
+	go func() {
+		uncompressed, err := decompressArchive(archive)
+		if err != nil {
+			pipeW.CloseWithError(err)
+			return
+		}
+		tr := tar.NewReader(uncompressed)
+		tw := tar.NewWriter(pipeW)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				pipeW.CloseWithError(err)
+				return
+			}
+			hdr.Uid, hdr.Gid = mapIds(hdr.Uid, hdr.Gid)
+			// The names would be looked up in the other user database
+			hdr.Uname, hdr.Gname = "", ""
+			if err := tw.WriteHeader(hdr); err != nil {
+				pipeW.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				pipeW.CloseWithError(err)
+				return
+			}
+		}
+		pipeW.CloseWithError(tw.Close())
+	}()
+	return pipeR
+}
+
+// decompressArchive detects the compression of archive, as bsdtar does
+// when extracting it
+func decompressArchive(archive Archive) (Archive, error) {
+	buf := bufio.NewReader(archive)
+	magic, err := buf.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(buf)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(buf), nil
+	}
+	return buf, nil
+}
+
+// compressArchive compresses an uncompressed archive
+func compressArchive(archive Archive, compression Compression) (Archive, error) {
+	var cmd *exec.Cmd
+	switch compression {
+	case Uncompressed:
+		return archive, nil
+	case Bzip2:
+		cmd = exec.Command("bzip2", "-c")
+	case Gzip:
+		cmd = exec.Command("gzip", "-c")
+	}
+	cmd.Stdin = archive
+	return CmdStream(cmd)
+}
+
+// ArchiveToHost maps the ownership of the entries of an archive made in a
+// container, or pulled, to the host ids
+func (remap *UsernsRemap) ArchiveToHost(archive Archive) Archive {
+	return remapArchive(archive, remap.ToHost)
+}
+
+// ArchiveToContainer maps the ownership of the entries of an archive of a
+// layer of the remap to the ids of the containers, so that it can be used
+// outside of the remap
+func (remap *UsernsRemap) ArchiveToContainer(archive Archive) Archive {
+	return remapArchive(archive, remap.ToContainer)
+}
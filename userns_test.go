@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadUsernsRemap(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	subuid, subgid := path.Join(root, "subuid"), path.Join(root, "subgid")
+	if err := ioutil.WriteFile(subuid, []byte("admin:165536:65536\ndockremap:100000:65536\ndockremap:300000:65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(subgid, []byte("dockremap:100000:65536\nlow:1000:65536\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remap, err := LoadUsernsRemap("dockremap", subuid, subgid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remap.Uids != (IdRange{100000, 65536}) || remap.Gids != (IdRange{100000, 65536}) || remap.Dir() != "100000.100000" {
+		t.Errorf("Unexpected remap: %#v", remap)
+	}
+	for _, spec := range []string{"admin", "dockremap:low", "nobody", "dockremap:", ":dockremap"} {
+		if _, err := LoadUsernsRemap(spec, subuid, subgid); err == nil {
+			t.Errorf("%q should fail", spec)
+		}
+	}
+
+	if uid, gid := remap.ToHost(0, 1000); uid != 100000 || gid != 101000 {
+		t.Errorf("Unexpected host ids: %d %d", uid, gid)
+	}
+	if uid, gid := remap.ToHost(70000, -1); uid != 165535 || gid != 165535 {
+		t.Errorf("The ids outside the range should be mapped to the overflow id, got %d %d", uid, gid)
+	}
+	if uid, gid := remap.ToContainer(100000, 101000); uid != 0 || gid != 1000 {
+		t.Errorf("Unexpected container ids: %d %d", uid, gid)
+	}
+	if uid, _ := remap.ToContainer(0, 0); uid != 65535 {
+		t.Errorf("The host root should be the overflow id, got %d", uid)
+	}
+}
+
+func TestRemapArchive(t *testing.T) {
+	remap := &UsernsRemap{Uids: IdRange{100000, 65536}, Gids: IdRange{200000, 65536}}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir, Uname: "root"},
+		{Name: "etc/motd", Mode: 0644, Size: 5, Uid: 1000, Gid: 1000},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("hello"))
+		}
+	}
+	tw.Close()
+	gz.Close()
+
+	// Pulled layers are compressed
+	remapped, err := ioutil.ReadAll(remap.ArchiveToHost(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(remap.ArchiveToContainer(bytes.NewReader(remapped)))
+	hostTr := tar.NewReader(bytes.NewReader(remapped))
+	for _, expected := range [][4]int{{100000, 200000, 0, 0}, {101000, 201000, 1000, 1000}} {
+		hostHdr, err := hostTr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hostHdr.Uid != expected[0] || hostHdr.Gid != expected[1] || hostHdr.Uname != "" {
+			t.Errorf("%s: unexpected host ids %d %d", hostHdr.Name, hostHdr.Uid, hostHdr.Gid)
+		}
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Uid != expected[2] || hdr.Gid != expected[3] {
+			t.Errorf("%s: unexpected container ids %d %d", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("The content should be kept, got %q (%v)", data, err)
+	}
+}
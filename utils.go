@@ -7,13 +7,18 @@ import (
 	"fmt"
 	"github.com/dotcloud/docker/rcli"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -28,10 +33,15 @@ func Go(f func() error) chan error {
 }
 
 // Request a given URL and return an io.Reader
-func Download(url string, stderr io.Writer) (*http.Response, error) {
-	var resp *http.Response
-	var err error = nil
-	if resp, err = http.Get(url); err != nil {
+// The request is cancelled once aborted is closed
+func Download(url string, stderr io.Writer, aborted <-chan struct{}) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Cancel = aborted
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode >= 400 {
@@ -68,23 +78,25 @@ type progressReader struct {
 	readTotal    int           // Expected stream length (bytes)
 	readProgress int           // How much has been read so far (bytes)
 	lastUpdate   int           // How many bytes read at least update
+	template     string        // Format of an update, given the bytes read, the total and the percentage
+	updateEvery  float64       // Fraction of the total to read between two updates
 }
 
 func (r *progressReader) Read(p []byte) (n int, err error) {
 	read, err := io.ReadCloser(r.reader).Read(p)
 	r.readProgress += read
 
-	// Only update progress for every 1% read
-	updateEvery := int(0.01 * float64(r.readTotal))
-	if r.readProgress-r.lastUpdate > updateEvery || r.readProgress == r.readTotal {
-		fmt.Fprintf(r.output, "%d/%d (%.0f%%)\r",
+	// Don't report progress on streams of unknown length
+	updateEvery := int(r.updateEvery * float64(r.readTotal))
+	if r.readTotal > 0 && (r.readProgress-r.lastUpdate > updateEvery || r.readProgress == r.readTotal) {
+		fmt.Fprintf(r.output, r.template,
 			r.readProgress,
 			r.readTotal,
 			float64(r.readProgress)/float64(r.readTotal)*100)
 		r.lastUpdate = r.readProgress
 	}
 	// Send newline when complete
-	if err == io.EOF {
+	if err == io.EOF && strings.HasSuffix(r.template, "\r") {
 		fmt.Fprintf(r.output, "\n")
 	}
 
@@ -93,8 +105,52 @@ func (r *progressReader) Read(p []byte) (n int, err error) {
 func (r *progressReader) Close() error {
 	return io.ReadCloser(r.reader).Close()
 }
+
+// ProgressReader reports progress on a single line, updated for every 1% read
 func ProgressReader(r io.ReadCloser, size int, output io.Writer) *progressReader {
-	return &progressReader{r, output, size, 0, 0}
+	return &progressReader{r, output, size, 0, 0, "%d/%d (%.0f%%)\r", 0.01}
+}
+
+// LineProgressReader prints a new line starting with prefix for every 10% read,
+// so that several downloads can report their progress on the same output.
+func LineProgressReader(r io.ReadCloser, size int, output io.Writer, prefix string) *progressReader {
+	return &progressReader{r, output, size, 0, 0, prefix + " %d/%d (%.0f%%)\n", 0.1}
+}
+
+// HumanSize returns a human-readable size in bytes, eg. "12.5 MB"
+func HumanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.4g %s", value, units[i])
+}
+
+// ParseSize parses a size in bytes, with an optional binary unit: b, k, m
+// or g, eg. "64m". The unit may be followed by "b", eg. "64mb".
+func ParseSize(size string) (int64, error) {
+	s := strings.ToLower(size)
+	if len(s) > 2 && s[len(s)-1] == 'b' && strings.IndexByte("kmg", s[len(s)-2]) >= 0 {
+		s = s[:len(s)-1]
+	}
+	multiplier := int64(1)
+	if s != "" {
+		if i := strings.IndexByte("bkmg", s[len(s)-1]); i >= 0 {
+			multiplier = int64(1) << (10 * uint(i))
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("Invalid size: %s (expected a number of bytes, optionally followed by k, m or g)", size)
+	}
+	return n * multiplier, nil
 }
 
 // HumanDuration returns a human-readable approximation of a duration
@@ -122,6 +178,57 @@ func HumanDuration(d time.Duration) string {
 	return fmt.Sprintf("%d years", d.Hours()/24/365)
 }
 
+// CheckCidFile fails if the container id file already exists, or can't be
+// written, so that run can give up before creating the container.
+func CheckCidFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("Container ID file found, make sure the other container isn't running or delete %s", path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".cidfile")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// WriteCidFile atomically writes the id of a container to path, and fails
+// if path already exists.
+func WriteCidFile(path, id string) error {
+	if path == "" {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".cidfile")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(id); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Unlike rename, link doesn't replace an existing file
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return CheckCidFile(path)
+		}
+		return err
+	}
+	return nil
+}
+
 func Trunc(s string, maxlen int) string {
 	if len(s) <= maxlen {
 		return s
@@ -258,3 +365,169 @@ func (w *writeBroadcaster) Close() error {
 func newWriteBroadcaster() *writeBroadcaster {
 	return &writeBroadcaster{list.New()}
 }
+
+// filesystemSupported returns true if the kernel lists fstype in
+// /proc/filesystems
+func filesystemSupported(fstype string) bool {
+	data, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == fstype {
+			return true
+		}
+	}
+	return false
+}
+
+// cgroupMountpoint returns where the cgroup hierarchy of subsystem is
+// mounted, according to /proc/mounts
+func cgroupMountpoint(subsystem string) (string, error) {
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "cgroup" {
+			continue
+		}
+		for _, option := range strings.Split(fields[3], ",") {
+			if option == subsystem {
+				return fields[1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("The %s cgroup isn't mounted", subsystem)
+}
+
+// memoryLimitSupport returns whether the kernel can limit the memory and the
+// swap of the containers
+func memoryLimitSupport() (memory, swap bool) {
+	if cgroupUnified() {
+		return unifiedMemoryLimitSupport()
+	}
+	mountpoint, err := cgroupMountpoint("memory")
+	if err != nil {
+		return false, false
+	}
+	_, err = os.Stat(path.Join(mountpoint, "memory.limit_in_bytes"))
+	memory = err == nil
+	_, err = os.Stat(path.Join(mountpoint, "memory.memsw.limit_in_bytes"))
+	swap = err == nil
+	return
+}
+
+// dirSize returns the total size of the regular files under root, without
+// descending into the directories for which skip returns true. skip may be
+// nil.
+func dirSize(root string, skip func(path string) bool) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && skip != nil && skip(path) {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// FollowSymlinkInScope resolves the symbolic links of p, which must be
+// under root, as if root was /: the absolute links are relative to root,
+// and .. stops at it, so that the path returned never leads out of root.
+// The components of p which don't exist are kept as they are.
+func FollowSymlinkInScope(p, root string) (string, error) {
+	root = path.Clean(root)
+	p = path.Clean(p)
+	if p == root {
+		return p, nil
+	}
+	if !strings.HasPrefix(p, root+"/") {
+		return "", fmt.Errorf("%s is not in %s", p, root)
+	}
+	// resolved is relative to root, unresolved is what is left of p
+	resolved, unresolved := "/", p[len(root):]
+	for links := 0; unresolved != ""; {
+		var part string
+		unresolved = strings.TrimLeft(unresolved, "/")
+		if i := strings.Index(unresolved, "/"); i >= 0 {
+			part, unresolved = unresolved[:i], unresolved[i:]
+		} else {
+			part, unresolved = unresolved, ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		fi, err := os.Lstat(path.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && fi.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("Too many levels of symbolic links in %s", p)
+		}
+		target, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		unresolved = "/" + target + unresolved
+	}
+	return path.Join(root, resolved), nil
+}
+
+// The real-time signals, given as RTMIN, RTMIN+N, RTMAX-N or RTMAX
+const (
+	sigRtMin = 34
+	sigRtMax = 64
+)
+
+// ParseSignal parses a signal given by number, or by name with or without
+// the SIG prefix, eg. 3, QUIT, SIGQUIT or SIGRTMIN+1
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > sigRtMax {
+			return 0, fmt.Errorf("Invalid signal: %s", s)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, exists := signalNames[name]; exists {
+		return sig, nil
+	}
+	var n int
+	var err error
+	switch {
+	case name == "RTMIN":
+		return sigRtMin, nil
+	case name == "RTMAX":
+		return sigRtMax, nil
+	case strings.HasPrefix(name, "RTMIN+"):
+		n, err = strconv.Atoi(name[len("RTMIN+"):])
+		n = sigRtMin + n
+	case strings.HasPrefix(name, "RTMAX-"):
+		n, err = strconv.Atoi(name[len("RTMAX-"):])
+		n = sigRtMax - n
+	}
+	if err == nil && n >= sigRtMin && n <= sigRtMax {
+		return syscall.Signal(n), nil
+	}
+	return 0, fmt.Errorf("Invalid signal: %s", s)
+}
@@ -0,0 +1,28 @@
+package docker
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	for s, expected := range map[string]syscall.Signal{"3": syscall.SIGQUIT, "QUIT": syscall.SIGQUIT, "SIGQUIT": syscall.SIGQUIT, "sigusr1": syscall.SIGUSR1, "hup": syscall.SIGHUP, "SIGCHLD": syscall.SIGCHLD, "RTMIN": 34, "SIGRTMIN+3": 37, "SIGRTMAX-2": 62, "SIGRTMAX": 64} {
+		if sig, err := ParseSignal(s); err != nil || sig != expected {
+			t.Errorf("%s: expected %v, got %v (%v)", s, expected, sig, err)
+		}
+	}
+	for _, s := range []string{"", "0", "65", "SIGFOO", "SIG", "SIGRTMIN-1", "SIGRTMAX+1", "SIGRTMIN+31", "SIGRTMIN3", "SIGRTMINX"} {
+		if _, err := ParseSignal(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+// The names are given the numbers of the architecture
+func TestSignalNames(t *testing.T) {
+	for name, expected := range map[string]syscall.Signal{"HUP": syscall.SIGHUP, "USR1": syscall.SIGUSR1, "CHLD": syscall.SIGCHLD, "STOP": syscall.SIGSTOP, "PWR": syscall.SIGPWR} {
+		if sig := signalNames[name]; sig != expected {
+			t.Errorf("%s: expected %d, got %d", name, expected, sig)
+		}
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
 )
 
@@ -124,3 +127,149 @@ func TestWriteBroadcaster(t *testing.T) {
 
 	writer.Close()
 }
+
+func TestWriteCidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-cidfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cidFile := path.Join(dir, "cid")
+
+	if err := CheckCidFile(cidFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteCidFile(cidFile, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(cidFile); err != nil || string(data) != "abc" {
+		t.Fatalf("Expected abc in the cidfile, got %q (%v)", data, err)
+	}
+	if err := CheckCidFile(cidFile); err == nil {
+		t.Errorf("An existing cidfile should be refused")
+	}
+	if err := WriteCidFile(cidFile, "def"); err == nil {
+		t.Errorf("An existing cidfile shouldn't be overwritten")
+	}
+	if data, _ := ioutil.ReadFile(cidFile); string(data) != "abc" {
+		t.Errorf("The cidfile was overwritten with %q", data)
+	}
+	// No temporary file is left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected only the cidfile in %s, got %d files", dir, len(files))
+	}
+	if err := CheckCidFile(path.Join(dir, "missing", "cid")); err == nil {
+		t.Errorf("A cidfile which can't be written should be refused")
+	}
+}
+
+func TestKernelVersion(t *testing.T) {
+	version, err := KernelVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == "" || strings.ContainsRune(version, 0) {
+		t.Errorf("Unexpected kernel version: %q", version)
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	for size, expected := range map[int64]string{
+		0:          "0 B",
+		999:        "999 B",
+		1000:       "1 kB",
+		12500000:   "12.5 MB",
+		3000000000: "3 GB",
+	} {
+		if human := HumanSize(size); human != expected {
+			t.Errorf("Expected %s for %d, got %s", expected, size, human)
+		}
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-size-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(path.Join(root, "skipped"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for file, size := range map[string]int{"a": 10, "b": 5, "skipped/c": 100} {
+		if err := ioutil.WriteFile(path.Join(root, file), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, err := dirSize(root, func(p string) bool { return p == path.Join(root, "skipped") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 15 {
+		t.Errorf("Expected 15 bytes, got %d", size)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{"0": 0, "512": 512, "512b": 512, "64k": 65536, "64m": 64 << 20, "64MB": 64 << 20, "1g": 1 << 30} {
+		if size, err := ParseSize(s); err != nil || size != expected {
+			t.Errorf("%s: expected %d, got %d (%v)", s, expected, size, err)
+		}
+	}
+	for _, s := range []string{"", "m", "-1m", "64q", "1.5g", "64bb", "9999999999g"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestFollowSymlinkInScope(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range []string{"usr/etc", "var"} {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"etc":       "/usr/etc",
+		"dev":       "/host/dev",
+		"up":        "../../../..",
+		"var/run":   "../up/tmp",
+		"loop":      "loop",
+		"usr/local": "../var",
+	} {
+		if err := os.Symlink(target, path.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for p, expected := range map[string]string{
+		"":                   "",
+		"etc/localtime":      "usr/etc/localtime",
+		"dev/null":           "host/dev/null",
+		"up/etc/passwd":      "usr/etc/passwd",
+		"var/run/lock":       "tmp/lock",
+		"usr/local/../etc":   "usr/etc",
+		"missing/../etc/tz":  "usr/etc/tz",
+		"../../../etc/hosts": "",
+	} {
+		resolved, err := FollowSymlinkInScope(path.Join(root, p), root)
+		if expected == "" && p != "" {
+			if err == nil {
+				t.Errorf("%s is not in the root, got %s", p, resolved)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", p, err)
+		} else if resolved != path.Join(root, expected) {
+			t.Errorf("%s: expected %s, got %s", p, path.Join(root, expected), resolved)
+		}
+	}
+	if _, err := FollowSymlinkInScope(path.Join(root, "loop/file"), root); err == nil {
+		t.Errorf("A loop of links should fail")
+	}
+}
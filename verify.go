@@ -0,0 +1,226 @@
+package docker
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+)
+
+// VerifyImageArchive checks an archive written by 'docker save' without
+// loading it, eg. before it is carried to an air-gapped host: the layers
+// and the json of the images match the checksums of manifest.json, the
+// layers are valid tar archives, the history of each image is in the
+// archive, and the tags refer to images of the archive. The archive is
+// read once, as a stream, and nothing is written to disk.
+
+// ImageArchiveReport is the result of VerifyImageArchive
+type ImageArchiveReport struct {
+	Images       []string              // Ids of the images, sorted
+	Repositories map[string]Repository // Tags of the archive
+	Checksums    bool                  // Whether the archive has the checksums of manifest.json
+	Errors       []string              // Inconsistencies found, none if the archive is valid
+}
+
+// Valid returns whether no inconsistency was found
+func (report *ImageArchiveReport) Valid() bool {
+	return len(report.Errors) == 0
+}
+
+func (report *ImageArchiveReport) errorf(format string, args ...interface{}) {
+	report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+}
+
+// archivedImage is what the archive holds of an image
+type archivedImage struct {
+	version   []byte
+	json      []byte
+	layer     string // sha256:HEX, if the archive has the layer
+	layerSize int64
+	layerErr  error // Why the layer isn't a valid tar archive, if it isn't
+}
+
+// readArchivedLayer returns the digest and the size of a layer, and whether
+// it is a valid tar archive
+func readArchivedLayer(r io.Reader) (digest string, size int64, layerErr error, err error) {
+	h := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, h)}
+	tr := tar.NewReader(counter)
+	for {
+		if _, layerErr = tr.Next(); layerErr != nil {
+			break
+		}
+		if _, layerErr = io.Copy(ioutil.Discard, tr); layerErr != nil {
+			break
+		}
+	}
+	if layerErr == io.EOF {
+		layerErr = nil
+	}
+	// The padding after the end of the archive
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return "", 0, nil, err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), counter.n, layerErr, nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// VerifyImageArchive reads a saved archive and reports its inconsistencies.
+// It only fails if the archive can't be read as a tar archive.
+func VerifyImageArchive(archive io.Reader) (*ImageArchiveReport, error) {
+	report := &ImageArchiveReport{Repositories: make(map[string]Repository)}
+	images := make(map[string]*archivedImage)
+	image := func(id string) *archivedImage {
+		if images[id] == nil {
+			images[id] = &archivedImage{}
+		}
+		return images[id]
+	}
+	var manifestData, repositoriesData []byte
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Invalid archive: %s", err)
+		}
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		dir, file := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+		// The files of the directory of an image
+		inImage := dir != "" && !strings.Contains(dir, "/")
+		switch {
+		case name == "manifest.json":
+			manifestData, err = ioutil.ReadAll(tr)
+		case name == "repositories":
+			repositoriesData, err = ioutil.ReadAll(tr)
+		case dir == "" && hdr.Typeflag == tar.TypeDir:
+			image(file)
+		case inImage && file == "VERSION":
+			image(dir).version, err = ioutil.ReadAll(tr)
+		case inImage && file == "json":
+			image(dir).json, err = ioutil.ReadAll(tr)
+		case inImage && file == "layer.tar":
+			img := image(dir)
+			img.layer, img.layerSize, img.layerErr, err = readArchivedLayer(tr)
+		default:
+			report.errorf("Unexpected entry %s", hdr.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid archive: %s: %s", hdr.Name, err)
+		}
+	}
+
+	for id := range images {
+		report.Images = append(report.Images, id)
+	}
+	sort.Strings(report.Images)
+	parents := make(map[string]string)
+	for _, id := range report.Images {
+		img := images[id]
+		if err := ValidateId(id); err != nil {
+			report.errorf("Invalid image id %s: %s", id, err)
+		}
+		if img.version == nil {
+			report.errorf("%s has no VERSION", id)
+		} else if v := strings.TrimSpace(string(img.version)); v != "1.0" {
+			report.errorf("%s has the unsupported version %s", id, v)
+		}
+		if img.layer == "" {
+			report.errorf("%s has no layer.tar", id)
+		} else if img.layerErr != nil {
+			report.errorf("The layer of %s isn't a valid tar archive: %s", id, img.layerErr)
+		}
+		if img.json == nil {
+			report.errorf("%s has no json", id)
+			continue
+		}
+		decoded := &Image{}
+		if err := json.Unmarshal(img.json, decoded); err != nil {
+			report.errorf("The json of %s is invalid: %s", id, err)
+			continue
+		}
+		if decoded.Id != id {
+			report.errorf("%s holds the json of the image %s", id, decoded.Id)
+		}
+		parents[id] = decoded.Parent
+	}
+
+	// The history of each image is in the archive, without cycle
+	for _, id := range report.Images {
+		seen := map[string]bool{id: true}
+		for parent := parents[id]; parent != ""; parent = parents[parent] {
+			if images[parent] == nil {
+				report.errorf("The parent %s of %s isn't in the archive", parent, id)
+				break
+			}
+			if seen[parent] {
+				report.errorf("The history of %s has a cycle through %s", id, parent)
+				break
+			}
+			seen[parent] = true
+		}
+	}
+
+	if repositoriesData != nil {
+		if err := json.Unmarshal(repositoriesData, &report.Repositories); err != nil {
+			report.errorf("Invalid repositories: %s", err)
+		}
+	}
+	for name, repo := range report.Repositories {
+		for tag, id := range repo {
+			if images[id] == nil {
+				report.errorf("%s:%s refers to %s, which isn't in the archive", name, tag, id)
+			}
+		}
+	}
+
+	if manifestData == nil {
+		return report, nil
+	}
+	report.Checksums = true
+	var manifest []*SavedImage
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		report.errorf("Invalid manifest.json: %s", err)
+		return report, nil
+	}
+	listed := make(map[string]bool)
+	for _, saved := range manifest {
+		listed[saved.Id] = true
+		img := images[saved.Id]
+		if img == nil {
+			report.errorf("%s is in manifest.json, but not in the archive", saved.Id)
+			continue
+		}
+		if img.json != nil && digestOf(img.json) != saved.Json {
+			report.errorf("The json of %s doesn't match its checksum", saved.Id)
+		}
+		if img.layer != "" && (img.layer != saved.Layer || img.layerSize != saved.LayerSize) {
+			report.errorf("The layer of %s doesn't match its checksum", saved.Id)
+		}
+	}
+	for _, id := range report.Images {
+		if !listed[id] {
+			report.errorf("%s isn't in manifest.json", id)
+		}
+	}
+	return report, nil
+}
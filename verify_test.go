@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// rewriteArchive copies the archive data, with the content of each entry
+// given by rewrite, or without the entry if rewrite returns nil
+func rewriteArchive(t *testing.T, data []byte, rewrite func(name string, content []byte) []byte) *bytes.Buffer {
+	tr := tar.NewReader(bytes.NewReader(data))
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content = rewrite(hdr.Name, content); content == nil {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			hdr.Size = int64(len(content))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(content)
+	}
+	tw.Close()
+	return buf
+}
+
+func TestVerifyImageArchive(t *testing.T) {
+	graph := tempGraph(t)
+	defer os.RemoveAll(graph.Root)
+	store, err := NewTagStore(path.Join(graph.Root, "repositories"), graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{runtime: &Runtime{graph: graph, repositories: store}}
+	base := &Image{Id: GenerateId()}
+	child := &Image{Id: GenerateId(), Parent: base.Id}
+	for _, img := range []*Image{base, child} {
+		if err := graph.Register(testArchive(t), img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Set("app", "v1", child.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := srv.ImageSave(&archive, []string{"app:v1"}); err != nil {
+		t.Fatal(err)
+	}
+	data := archive.Bytes()
+
+	verify := func(archive io.Reader) *ImageArchiveReport {
+		report, err := VerifyImageArchive(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	expectError := func(report *ImageArchiveReport, expected string) {
+		for _, e := range report.Errors {
+			if strings.Contains(e, expected) {
+				return
+			}
+		}
+		t.Errorf("Expected an error containing %q, got %v", expected, report.Errors)
+	}
+
+	report := verify(bytes.NewReader(data))
+	if !report.Valid() {
+		t.Fatalf("Expected the saved archive to be valid, got %v", report.Errors)
+	}
+	if !report.Checksums {
+		t.Errorf("Expected the saved archive to have checksums")
+	}
+	if len(report.Images) != 2 {
+		t.Errorf("Expected 2 images, got %v", report.Images)
+	}
+	if id := report.Repositories["app"]["v1"]; id != child.Id {
+		t.Errorf("Expected app:v1 to refer to %s, got %s", child.Id, id)
+	}
+
+	// A layer replaced by another valid one
+	report = verify(rewriteArchive(t, data, func(name string, content []byte) []byte {
+		if name == child.Id+"/layer.tar" {
+			return testLayer(t, false, "etc/motd", "tampered")
+		}
+		return content
+	}))
+	expectError(report, "The layer of "+child.Id+" doesn't match its checksum")
+
+	// The parent left out of the archive
+	report = verify(rewriteArchive(t, data, func(name string, content []byte) []byte {
+		if strings.HasPrefix(name, base.Id) {
+			return nil
+		}
+		return content
+	}))
+	expectError(report, "The parent "+base.Id+" of "+child.Id+" isn't in the archive")
+
+	// A tag referring to an image which isn't in the archive
+	other := GenerateId()
+	report = verify(rewriteArchive(t, data, func(name string, content []byte) []byte {
+		if name == "repositories" {
+			return []byte(`{"app":{"v1":"` + other + `"}}`)
+		}
+		return content
+	}))
+	expectError(report, "app:v1 refers to "+other)
+
+	// The archives written before manifest.json are checked without checksums
+	report = verify(rewriteArchive(t, data, func(name string, content []byte) []byte {
+		if name == "manifest.json" {
+			return nil
+		}
+		return content
+	}))
+	if !report.Valid() || report.Checksums {
+		t.Errorf("Expected a valid archive without checksums, got %v", report.Errors)
+	}
+
+	if _, err := VerifyImageArchive(strings.NewReader("not an archive")); err == nil {
+		t.Errorf("Expected an error reading something else than an archive")
+	}
+}
@@ -0,0 +1,109 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// A VolumeDriver stores the content of named volumes, eg. on the local
+// disk, on NFS or on a cloud block device. The content of a volume is
+// available on the host at Path while the volume is mounted.
+type VolumeDriver interface {
+	// Create prepares the storage of a new volume
+	Create(name string) error
+	// Remove destroys the storage of a volume and its content
+	Remove(name string) error
+	// Mount makes the content of the volume available at Path. It is
+	// called before the first running container using the volume starts.
+	Mount(name string) error
+	// Unmount is called once the last running container using the volume
+	// stopped
+	Unmount(name string) error
+	// Path returns the directory of the host where the volume is mounted
+	Path(name string) (string, error)
+}
+
+// localVolumeDriver stores the volumes in directories of the host, in
+// root/NAME/_data. It is the default driver.
+type localVolumeDriver struct {
+	root string
+}
+
+func (d *localVolumeDriver) Create(name string) error {
+	return os.MkdirAll(d.dir(name), 0755)
+}
+
+func (d *localVolumeDriver) Remove(name string) error {
+	return os.RemoveAll(d.dir(name))
+}
+
+func (d *localVolumeDriver) Mount(name string) error {
+	return nil
+}
+
+func (d *localVolumeDriver) Unmount(name string) error {
+	return nil
+}
+
+func (d *localVolumeDriver) Path(name string) (string, error) {
+	return d.dir(name), nil
+}
+
+func (d *localVolumeDriver) dir(name string) string {
+	return path.Join(d.root, name, "_data")
+}
+
+// pluginVolumeDriver is a VolumeDriver plugin, see plugin.go. Each method
+// is a call of the plugin, eg. /VolumeDriver.Mount with {"Name": NAME},
+// answered by {"Mountpoint": PATH} for Mount and Path.
+type pluginVolumeDriver struct {
+	plugin *Plugin
+}
+
+type pluginVolumeRequest struct {
+	Name string
+}
+
+type pluginVolumeResponse struct {
+	Mountpoint string
+}
+
+func (d *pluginVolumeDriver) call(method, name string) (string, error) {
+	res := &pluginVolumeResponse{}
+	if err := d.plugin.Call("VolumeDriver."+method, &pluginVolumeRequest{name}, res); err != nil {
+		return "", err
+	}
+	return res.Mountpoint, nil
+}
+
+func (d *pluginVolumeDriver) Create(name string) error {
+	_, err := d.call("Create", name)
+	return err
+}
+
+func (d *pluginVolumeDriver) Remove(name string) error {
+	_, err := d.call("Remove", name)
+	return err
+}
+
+func (d *pluginVolumeDriver) Mount(name string) error {
+	_, err := d.call("Mount", name)
+	return err
+}
+
+func (d *pluginVolumeDriver) Unmount(name string) error {
+	_, err := d.call("Unmount", name)
+	return err
+}
+
+func (d *pluginVolumeDriver) Path(name string) (string, error) {
+	p, err := d.call("Path", name)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(p) {
+		return "", fmt.Errorf("Invalid path of volume %s: %q", name, p)
+	}
+	return p, nil
+}
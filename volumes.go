@@ -0,0 +1,721 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var validVolumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// A Volume is a directory of the host which outlives the containers it is
+// mounted in
+type Volume struct {
+	Name    string
+	Driver  string // Name of the VolumeDriver storing the content
+	Path    string // Directory mounted in the containers
+	Created time.Time
+	// Anonymous volumes are created for the Volumes of a container config,
+	// and removed with the last container using them
+	Anonymous bool
+}
+
+// VolumeStore manages the volumes which are not bound to a path of the
+// host. Each volume has a directory in root, with its metadata in
+// root/NAME/json. Its content is stored by a VolumeDriver, which is "local"
+// unless another driver is registered with RegisterDriver, or is a plugin.
+// The drivers are activated and called by Create without holding the lock
+// of the store, since a plugin may take a while to answer. The calls of
+// Mount, Unmount and Remove hold it, to keep the number of mounts of each
+// volume in step with the driver. Remove checks that no container uses the
+// volume while holding it as well, so that a container starting can't mount
+// a volume being removed.
+type VolumeStore struct {
+	root     string
+	drivers  map[string]VolumeDriver
+	plugins  *PluginStore // Looked up for the drivers which aren't registered, if not nil
+	volumes  map[string]*Volume
+	creating map[string]bool        // Names of the volumes being created by their driver
+	mounts   map[string]int         // Number of running containers using each volume
+	users    func(*Volume) []string // Ids of the containers using a volume, if not nil
+	lock     sync.Mutex
+}
+
+func NewVolumeStore(root string) (*VolumeStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	store := &VolumeStore{
+		root:     root,
+		drivers:  map[string]VolumeDriver{"local": &localVolumeDriver{root: root}},
+		volumes:  make(map[string]*Volume),
+		creating: make(map[string]bool),
+		mounts:   make(map[string]int),
+	}
+	dir, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range dir {
+		data, err := ioutil.ReadFile(path.Join(root, fi.Name(), "json"))
+		if err != nil {
+			volumeLog.Warnf("Couldn't load volume %s: %s", fi.Name(), err)
+			continue
+		}
+		volume := &Volume{}
+		if err := json.Unmarshal(data, volume); err != nil {
+			volumeLog.Warnf("Couldn't load volume %s: %s", fi.Name(), err)
+			continue
+		}
+		if volume.Driver == "" {
+			volume.Driver = "local"
+		}
+		store.volumes[volume.Name] = volume
+	}
+	return store, nil
+}
+
+// RegisterDriver makes a driver available to the volumes created after it
+func (store *VolumeStore) RegisterDriver(name string, driver VolumeDriver) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, exists := store.drivers[name]; exists {
+		return fmt.Errorf("Volume driver %s is already registered", name)
+	}
+	store.drivers[name] = driver
+	return nil
+}
+
+// driver returns the driver of volume. The plugins are activated without
+// holding the lock of the store.
+func (store *VolumeStore) driver(volume *Volume) (VolumeDriver, error) {
+	store.lock.Lock()
+	driver, exists := store.drivers[volume.Driver]
+	store.lock.Unlock()
+	if exists {
+		return driver, nil
+	}
+	if store.plugins == nil {
+		return nil, fmt.Errorf("Unknown volume driver: %s", volume.Driver)
+	}
+	plugin, err := store.plugins.Get(volume.Driver, "VolumeDriver")
+	if err != nil {
+		return nil, fmt.Errorf("Unknown volume driver: %s (%s)", volume.Driver, err)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if driver, exists := store.drivers[volume.Driver]; exists {
+		return driver, nil
+	}
+	driver = &pluginVolumeDriver{plugin}
+	store.drivers[volume.Driver] = driver
+	return driver, nil
+}
+
+// Create creates an empty volume with the driver driverName, or with the
+// local driver if driverName is empty. A name is generated for an
+// anonymous volume if name is empty. The volume fails to be created if its
+// driver fails to create it or to give its path.
+func (store *VolumeStore) Create(name, driverName string) (*Volume, error) {
+	volume := &Volume{
+		Name:      name,
+		Driver:    driverName,
+		Created:   time.Now(),
+		Anonymous: name == "",
+	}
+	if volume.Driver == "" {
+		volume.Driver = "local"
+	}
+	if volume.Anonymous {
+		volume.Name = GenerateId()
+	} else if !validVolumeName.MatchString(name) {
+		return nil, fmt.Errorf("Invalid volume name: %s (only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed)", name)
+	}
+	driver, err := store.driver(volume)
+	if err != nil {
+		return nil, err
+	}
+	store.lock.Lock()
+	if _, exists := store.volumes[volume.Name]; exists || store.creating[volume.Name] {
+		store.lock.Unlock()
+		return nil, fmt.Errorf("Volume %s already exists", volume.Name)
+	}
+	store.creating[volume.Name] = true
+	store.lock.Unlock()
+
+	err = store.create(volume, driver)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.creating, volume.Name)
+	if err != nil {
+		return nil, err
+	}
+	store.volumes[volume.Name] = volume
+	return volume, nil
+}
+
+// create creates the storage of volume with its driver, and records its
+// metadata
+func (store *VolumeStore) create(volume *Volume, driver VolumeDriver) error {
+	root := path.Join(store.root, volume.Name)
+	if err := os.Mkdir(root, 0700); err != nil {
+		return err
+	}
+	if err := driver.Create(volume.Name); err != nil {
+		os.RemoveAll(root)
+		return err
+	}
+	p, err := driver.Path(volume.Name)
+	if err != nil {
+		driver.Remove(volume.Name)
+		os.RemoveAll(root)
+		return fmt.Errorf("Couldn't get the path of volume %s: %s", volume.Name, err)
+	}
+	volume.Path = p
+	data, err := json.Marshal(volume)
+	if err != nil {
+		driver.Remove(volume.Name)
+		os.RemoveAll(root)
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(root, "json"), data, 0600); err != nil {
+		driver.Remove(volume.Name)
+		os.RemoveAll(root)
+		return err
+	}
+	return nil
+}
+
+func (store *VolumeStore) Get(name string) (*Volume, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	volume, exists := store.volumes[name]
+	if !exists {
+		return nil, fmt.Errorf("No such volume: %s", name)
+	}
+	return volume, nil
+}
+
+// List returns the volumes sorted by name
+func (store *VolumeStore) List() []*Volume {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var volumes []*Volume
+	for _, volume := range store.volumes {
+		volumes = append(volumes, volume)
+	}
+	sort.Sort(volumesByName(volumes))
+	return volumes
+}
+
+// ByPath returns the volume whose content is in p, or nil if p isn't the
+// directory of a volume
+func (store *VolumeStore) ByPath(p string) *Volume {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, volume := range store.volumes {
+		if volume.Path == path.Clean(p) {
+			return volume
+		}
+	}
+	return nil
+}
+
+// Remove removes a volume and its content. Checking that the volume isn't
+// used is left to the caller.
+func (store *VolumeStore) Remove(name string) error {
+	volume, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	driver, err := store.driver(volume)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.volumes[name] != volume {
+		return fmt.Errorf("No such volume: %s", name)
+	}
+	if store.mounts[name] > 0 {
+		return ConflictError(fmt.Sprintf("Volume %s is mounted", name))
+	}
+	if store.users != nil {
+		if users := store.users(volume); len(users) > 0 {
+			return ConflictError(fmt.Sprintf("Volume %s is in use by %s", name, strings.Join(users, ", ")))
+		}
+	}
+	if err := driver.Remove(name); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path.Join(store.root, name)); err != nil {
+		return err
+	}
+	delete(store.volumes, name)
+	return nil
+}
+
+// Mount mounts a volume with its driver, unless a running container
+// already uses it
+func (store *VolumeStore) Mount(volume *Volume) error {
+	driver, err := store.driver(volume)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.volumes[volume.Name] != volume {
+		return fmt.Errorf("No such volume: %s", volume.Name)
+	}
+	if store.mounts[volume.Name] == 0 {
+		if err := driver.Mount(volume.Name); err != nil {
+			return err
+		}
+	}
+	store.mounts[volume.Name]++
+	return nil
+}
+
+// Unmount unmounts a volume with its driver once the last running
+// container using it stopped
+func (store *VolumeStore) Unmount(volume *Volume) error {
+	driver, err := store.driver(volume)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.mounts[volume.Name] == 0 {
+		return fmt.Errorf("Volume %s is not mounted", volume.Name)
+	}
+	if store.mounts[volume.Name]--; store.mounts[volume.Name] > 0 {
+		return nil
+	}
+	delete(store.mounts, volume.Name)
+	return driver.Unmount(volume.Name)
+}
+
+type volumesByName []*Volume
+
+func (v volumesByName) Len() int           { return len(v) }
+func (v volumesByName) Less(i, j int) bool { return v[i].Name < v[j].Name }
+func (v volumesByName) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// VolumeUsers returns the ids of the containers which have the volume
+// mounted, or will have it mounted once they are started
+func (runtime *Runtime) VolumeUsers(volume *Volume) []string {
+	var ids []string
+	for _, container := range runtime.List() {
+		if container.usesVolume(volume) {
+			ids = append(ids, container.Id)
+		}
+	}
+	return ids
+}
+
+func (container *Container) usesVolume(volume *Volume) bool {
+	for _, hostPath := range container.Volumes {
+		if hostPath == volume.Path {
+			return true
+		}
+	}
+	for _, bind := range container.Config.Binds {
+		if src, _, _, _, err := parseBind(bind); err == nil && src == volume.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBind parses a bind mount specification: SRC:/container[:OPTIONS],
+// where SRC is either a path of the host or the name of a volume, and
+// OPTIONS ro or rw, and z or Z, separated by commas. z and Z relabel SRC
+// for SELinux, shared by the containers with z, private to the container
+// with Z.
+func parseBind(bind string) (src, dst string, rw bool, label string, err error) {
+	parts := strings.Split(bind, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", "", false, "", fmt.Errorf("Invalid bind mount: %s (expected /host:/container[:ro|rw][,z|Z] or name:/container[:ro|rw][,z|Z])", bind)
+	}
+	rw = true
+	if len(parts) == 3 {
+		var mode string
+		for _, option := range strings.Split(parts[2], ",") {
+			switch {
+			case (option == "ro" || option == "rw") && mode == "":
+				mode = option
+			case (option == "z" || option == "Z") && label == "":
+				label = option
+			default:
+				return "", "", false, "", fmt.Errorf("Invalid bind mount: %s (expected /host:/container[:ro|rw][,z|Z] or name:/container[:ro|rw][,z|Z])", bind)
+			}
+		}
+		rw = mode != "ro"
+	}
+	if !validMountPath(parts[1]) || (!validMountPath(parts[0]) && !validVolumeName.MatchString(parts[0])) {
+		return "", "", false, "", fmt.Errorf("Invalid bind mount: %q (the container path must be absolute, and the source an absolute path or a volume name, without whitespace or control characters)", bind)
+	}
+	if path.IsAbs(parts[0]) {
+		parts[0] = path.Clean(parts[0])
+	}
+	return parts[0], path.Clean(parts[1]), rw, label, nil
+}
+
+// The flags of a tmpfs mount, by the flag they override
+var tmpfsFlags = map[string]string{
+	"rw":     "rw",
+	"ro":     "rw",
+	"exec":   "exec",
+	"noexec": "exec",
+	"suid":   "suid",
+	"nosuid": "suid",
+	"dev":    "dev",
+	"nodev":  "dev",
+}
+
+// The options of a tmpfs mount which take a value, eg. "size=16m", and
+// the values they accept
+var tmpfsValues = map[string]*regexp.Regexp{
+	"size":      regexp.MustCompile(`^[0-9]+[kmgKMG]?$`),
+	"nr_inodes": regexp.MustCompile(`^[0-9]+[kmgKMG]?$`),
+	"mode":      regexp.MustCompile(`^[0-7]{1,4}$`),
+	"uid":       regexp.MustCompile(`^[0-9]+$`),
+	"gid":       regexp.MustCompile(`^[0-9]+$`),
+}
+
+// Options of a tmpfs mount unless they are overridden
+var defaultTmpfsOptions = []string{"rw", "noexec", "nosuid", "nodev", "size=65536k"}
+
+func tmpfsOptionKey(option string) string {
+	if key, isFlag := tmpfsFlags[option]; isFlag {
+		return key
+	}
+	return strings.SplitN(option, "=", 2)[0]
+}
+
+// validateTmpfsOptions checks the options of a tmpfs mount strictly, since
+// they are written as is in the config of LXC
+func validateTmpfsOptions(options string) error {
+	for _, option := range strings.Split(options, ",") {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) == 1 && (option == "" || tmpfsFlags[option] != "") {
+			continue
+		}
+		if len(parts) == 2 && tmpfsValues[parts[0]] != nil && tmpfsValues[parts[0]].MatchString(parts[1]) {
+			continue
+		}
+		return fmt.Errorf("Invalid tmpfs option: %q", option)
+	}
+	return nil
+}
+
+// validMountPath returns whether p is an absolute path which can be written
+// in a mount entry of the config of LXC: whitespace or a control character
+// would end the entry, or the line
+func validMountPath(p string) bool {
+	return path.IsAbs(p) && strings.IndexFunc(p, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
+
+// tmpfsOptions returns the mount options of a tmpfs: the given options
+// followed by the defaults they don't override
+func tmpfsOptions(options string) string {
+	var out []string
+	overridden := make(map[string]bool)
+	for _, option := range strings.Split(options, ",") {
+		if option != "" {
+			out = append(out, option)
+			overridden[tmpfsOptionKey(option)] = true
+		}
+	}
+	for _, option := range defaultTmpfsOptions {
+		if !overridden[tmpfsOptionKey(option)] {
+			out = append(out, option)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// ShmSize returns the size of the tmpfs mounted on /dev/shm, or 0 if it
+// isn't mounted: for the containers which mount something else on it, and
+// those created before it was
+func (container *Container) ShmSize() int64 {
+	if _, exists := container.Config.Tmpfs["/dev/shm"]; exists {
+		return 0
+	}
+	if _, exists := container.Volumes["/dev/shm"]; exists {
+		return 0
+	}
+	return container.Config.ShmSize
+}
+
+// The writable paths of the containers with a read-only root filesystem
+var readOnlyTmpfsPaths = []string{"/tmp", "/run"}
+
+// readOnlyTmpfs mounts a tmpfs on the paths of readOnlyTmpfsPaths which
+// aren't already mounted by config
+func readOnlyTmpfs(config *Config) {
+	mounted := make(map[string]bool)
+	for p := range config.Volumes {
+		mounted[path.Clean(p)] = true
+	}
+	for _, bind := range config.Binds {
+		if _, dst, _, _, err := parseBind(bind); err == nil {
+			mounted[dst] = true
+		}
+	}
+	for _, p := range readOnlyTmpfsPaths {
+		if _, exists := config.Tmpfs[p]; exists || mounted[p] {
+			continue
+		}
+		if config.Tmpfs == nil {
+			config.Tmpfs = make(map[string]string)
+		}
+		config.Tmpfs[p] = ""
+	}
+}
+
+// parseVolumesFrom parses a -volumes-from specification: CONTAINER[:ro|rw]
+func parseVolumesFrom(spec string) (id string, rw bool, err error) {
+	parts := strings.Split(spec, ":")
+	if parts[0] == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "ro" && parts[1] != "rw") {
+		return "", false, fmt.Errorf("Invalid volumes-from: %s (expected CONTAINER[:ro|rw])", spec)
+	}
+	return parts[0], len(parts) == 1 || parts[1] == "rw", nil
+}
+
+// inheritVolumes records the volumes of the containers of
+// Config.VolumesFrom in container, at the same paths. They are read-only
+// if they are read-only in the source container, or if ":ro" is given.
+func (runtime *Runtime) inheritVolumes(container *Container) error {
+	for _, spec := range container.Config.VolumesFrom {
+		id, rw, err := parseVolumesFrom(spec)
+		if err != nil {
+			return ConfigError(err.Error())
+		}
+		source := runtime.Get(id)
+		if source == nil {
+			return ConfigError(fmt.Sprintf("Unable to mount the volumes of %s: no such container", id))
+		}
+		if source.Volumes == nil {
+			return ConfigError(fmt.Sprintf("Unable to mount the volumes of %s: it was never started", id))
+		}
+		if container.Volumes == nil {
+			container.Volumes = make(map[string]string)
+			container.VolumesRW = make(map[string]bool)
+		}
+		for p, hostPath := range source.Volumes {
+			if _, exists := container.Volumes[p]; exists {
+				return ConfigError(fmt.Sprintf("Duplicate volume %s in the volumes of %s", p, id))
+			}
+			container.Volumes[p] = hostPath
+			container.VolumesRW[p] = rw && source.VolumesRW[p]
+		}
+	}
+	return nil
+}
+
+// setupVolumes records the host directories mounted in the container: the
+// bind mounts, the named volumes (created if they don't exist yet), and a
+// new anonymous volume for each path in Config.Volumes which isn't
+// inherited from another container. The volumes are then mounted. The
+// volumes recorded by a previous start are kept.
+func (container *Container) setupVolumes() error {
+	if container.Volumes == nil {
+		container.Volumes = make(map[string]string)
+		container.VolumesRW = make(map[string]bool)
+	}
+	store := container.runtime.volumes
+	rootfs := container.RootfsPath()
+	// Paths of the volumes mounted in the container for the first time
+	var fresh []string
+	for _, bind := range container.Config.Binds {
+		src, dst, rw, label, err := parseBind(bind)
+		if err != nil {
+			return err
+		}
+		if path.IsAbs(src) {
+			if err := os.MkdirAll(src, 0755); err != nil {
+				return err
+			}
+			if err := container.relabelVolume(src, label); err != nil {
+				return err
+			}
+		} else {
+			volume, err := store.Get(src)
+			if err != nil {
+				if volume, err = store.Create(src, ""); err != nil {
+					return err
+				}
+			}
+			if _, exists := container.Volumes[dst]; !exists {
+				fresh = append(fresh, dst)
+			}
+			if err := container.relabelVolume(volume.Path, label); err != nil {
+				return err
+			}
+			src = volume.Path
+		}
+		container.Volumes[dst] = src
+		container.VolumesRW[dst] = rw
+	}
+	for p := range container.Config.Volumes {
+		p = path.Clean(p)
+		if _, exists := container.Volumes[p]; exists {
+			continue
+		}
+		volume, err := store.Create("", "")
+		if err != nil {
+			return err
+		}
+		// The volumes of the container are private to it
+		if err := container.relabelVolume(volume.Path, "Z"); err != nil {
+			return err
+		}
+		container.Volumes[p] = volume.Path
+		container.VolumesRW[p] = true
+		fresh = append(fresh, p)
+	}
+	if err := container.mountVolumes(); err != nil {
+		return err
+	}
+	for _, p := range fresh {
+		// Empty volumes belong to the root of the container
+		if remap := container.runtime.remap; remap != nil {
+			if err := remap.Chown(container.Volumes[p]); err != nil {
+				container.unmountVolumes()
+				return err
+			}
+		}
+		// The links of the image are followed within its root filesystem
+		src, err := FollowSymlinkInScope(path.Join(rootfs, p), rootfs)
+		if err == nil {
+			err = populateVolume(src, container.Volumes[p])
+		}
+		if err != nil {
+			container.unmountVolumes()
+			return fmt.Errorf("Unable to copy %s to the volume: %s", p, err)
+		}
+	}
+	// The mount points must exist in the container
+	var mountpoints []string
+	for p := range container.Volumes {
+		mountpoints = append(mountpoints, p)
+	}
+	for p := range container.Config.Tmpfs {
+		mountpoints = append(mountpoints, p)
+	}
+	for _, p := range mountpoints {
+		mountpoint, err := FollowSymlinkInScope(path.Join(rootfs, p), rootfs)
+		if err == nil {
+			err = os.MkdirAll(mountpoint, 0755)
+		}
+		if err != nil {
+			container.unmountVolumes()
+			return err
+		}
+	}
+	if err := container.ToDisk(); err != nil {
+		container.unmountVolumes()
+		return err
+	}
+	return nil
+}
+
+// relabelVolume sets the SELinux label of a volume mounted with the label
+// option z or Z, if the container has a label
+func (container *Container) relabelVolume(p, label string) error {
+	if container.MountLabel == "" {
+		return nil
+	}
+	switch label {
+	case "z":
+		return relabel(p, sharedFileLabel())
+	case "Z":
+		return relabel(p, container.MountLabel)
+	}
+	return nil
+}
+
+// populateVolume copies the directory src of the image, with its mode and
+// ownership, to a volume mounted for the first time, so that the data
+// shipped in the image at the path of the volume isn't hidden by the
+// volume. Volumes which aren't empty are left untouched.
+func populateVolume(src, volumePath string) error {
+	if stat, err := os.Stat(src); err != nil || !stat.IsDir() {
+		return nil
+	}
+	content, err := ioutil.ReadDir(volumePath)
+	if err != nil {
+		return err
+	}
+	if len(content) > 0 {
+		return nil
+	}
+	if output, err := exec.Command("cp", "-a", src+"/.", volumePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// mountVolumes mounts the volumes of the store used by the container, or
+// none of them if one fails to mount
+func (container *Container) mountVolumes() error {
+	store := container.runtime.volumes
+	var mounted []*Volume
+	for _, hostPath := range container.Volumes {
+		if volume := store.ByPath(hostPath); volume != nil {
+			if err := store.Mount(volume); err != nil {
+				for _, volume := range mounted {
+					store.Unmount(volume)
+				}
+				return err
+			}
+			mounted = append(mounted, volume)
+		}
+	}
+	return nil
+}
+
+// unmountVolumes unmounts the volumes mounted by mountVolumes
+func (container *Container) unmountVolumes() error {
+	store := container.runtime.volumes
+	for _, hostPath := range container.Volumes {
+		if volume := store.ByPath(hostPath); volume != nil {
+			if err := store.Unmount(volume); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeVolumes removes the anonymous volumes of a destroyed container
+// which aren't used by another container. The named volumes and the
+// directories bound from the host are left untouched.
+func (container *Container) removeVolumes() error {
+	store := container.runtime.volumes
+	for _, hostPath := range container.Volumes {
+		volume := store.ByPath(hostPath)
+		if volume == nil || !volume.Anonymous {
+			continue
+		}
+		if err := store.Remove(volume.Name); err != nil {
+			if _, ok := err.(ConflictError); ok {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,524 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestParseBind(t *testing.T) {
+	for bind, expected := range map[string]struct {
+		src, dst, label string
+		rw              bool
+	}{
+		"/srv:/data":        {"/srv", "/data", "", true},
+		"/srv/:/data/:ro":   {"/srv", "/data", "", false},
+		"/srv:/data/../etc": {"/srv", "/etc", "", true},
+		"srv:/data:ro":      {"srv", "/data", "", false},
+		"/srv:/data:z":      {"/srv", "/data", "z", true},
+		"/srv:/data:ro,Z":   {"/srv", "/data", "Z", false},
+	} {
+		src, dst, rw, label, err := parseBind(bind)
+		if err != nil {
+			t.Errorf("%s: %s", bind, err)
+		} else if src != expected.src || dst != expected.dst || rw != expected.rw || label != expected.label {
+			t.Errorf("%s: unexpected %s %s %v %s", bind, src, dst, rw, label)
+		}
+	}
+	for _, bind := range []string{"/srv", "./srv:/data", "-srv:/data", "/srv:data", "/srv:/data:rx", "/a:/b:ro:rw", "/a:/b:ro,rw", "/a:/b:z,Z", "/a:/b:", "/tmp:/x\nlxc.mount.entry = / /r none bind,rw 0 0", "/my dir:/data", "/srv:/da\tta"} {
+		if _, _, _, _, err := parseBind(bind); err == nil {
+			t.Errorf("%q should be invalid", bind)
+		}
+	}
+	// The config of LXC refuses them as well
+	if _, err := lxcMountPath("/x\nlxc.cgroup.devices.allow = a"); err == nil {
+		t.Errorf("A path with a newline shouldn't be written in the config of LXC")
+	}
+}
+
+func TestVolumeStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-volumes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store, err := NewVolumeStore(path.Join(root, "volumes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous, err := store.Create("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := store.Create("data", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !anonymous.Anonymous || named.Anonymous || named.Name != "data" {
+		t.Errorf("Unexpected volumes: %v %v", anonymous, named)
+	}
+	if _, err := store.Create("data", ""); err == nil {
+		t.Errorf("Creating a volume twice should fail")
+	}
+	if _, err := store.Create("../data", ""); err == nil {
+		t.Errorf("Invalid volume names should be rejected")
+	}
+	if _, err := store.Create("x", ""); err != nil {
+		t.Errorf("One-character volume names should be valid, got %v", err)
+	}
+	if store.ByPath(named.Path) != named || store.ByPath(root) != nil {
+		t.Errorf("Unexpected volume of %s", named.Path)
+	}
+
+	// The volumes are persisted
+	store, err = NewVolumeStore(path.Join(root, "volumes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volumes := store.List(); len(volumes) != 3 {
+		t.Fatalf("Expected 3 volumes after reload, got %d", len(volumes))
+	}
+	if volume, err := store.Get("data"); err != nil || volume.Path != named.Path || volume.Anonymous {
+		t.Fatalf("Unexpected volume after reload: %v (%v)", volume, err)
+	}
+
+	// The volumes used by a container are kept
+	store.users = func(volume *Volume) []string {
+		if volume.Name == "data" {
+			return []string{"abc"}
+		}
+		return nil
+	}
+	if err := store.Remove("data"); err == nil || err.Error() != "Volume data is in use by abc" {
+		t.Errorf("Removing a volume in use should fail, got %v", err)
+	} else if _, ok := err.(ConflictError); !ok {
+		t.Errorf("Expected a ConflictError, got %T", err)
+	}
+	store.users = nil
+
+	if err := store.Remove("data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("data"); err == nil {
+		t.Errorf("The volume should be removed")
+	}
+	if _, err := os.Stat(named.Path); !os.IsNotExist(err) {
+		t.Errorf("The content of the volume should be removed")
+	}
+	if err := store.Remove("data"); err == nil {
+		t.Errorf("Removing a missing volume should fail")
+	}
+}
+
+func TestTmpfsOptions(t *testing.T) {
+	for options, expected := range map[string]string{
+		"":                  "rw,noexec,nosuid,nodev,size=65536k",
+		"size=16m":          "size=16m,rw,noexec,nosuid,nodev",
+		"ro,exec,mode=1777": "ro,exec,mode=1777,nosuid,nodev,size=65536k",
+	} {
+		if err := validateTmpfsOptions(options); err != nil {
+			t.Errorf("%q: %s", options, err)
+		}
+		if output := tmpfsOptions(options); output != expected {
+			t.Errorf("%q: expected %q, got %q", options, expected, output)
+		}
+	}
+	for _, options := range []string{"size=", "size=16x", "size=16m 0 0\nlxc.cgroup.devices.allow = a", "nr_inodes=1k\n", "mode=999", "mode=0755 ", "uid=root", "gid=-1", "nosuid\t", "atime"} {
+		if err := validateTmpfsOptions(options); err == nil {
+			t.Errorf("%q should be invalid", options)
+		}
+	}
+	for p, valid := range map[string]bool{"/run": true, "/my data": false, "/run\nlxc.mount.entry = /": false, "/run\x00": false, "run": false} {
+		if validMountPath(p) != valid {
+			t.Errorf("%q: expected valid=%v", p, valid)
+		}
+	}
+}
+
+func TestPopulateVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-volumes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	src, volume := path.Join(root, "image", "data"), path.Join(root, "volume")
+	for _, dir := range []string{path.Join(src, "db"), volume} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(src, 0711); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(src, "db", "seed"), []byte("seed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := populateVolume(path.Join(root, "image", "missing"), volume); err != nil {
+		t.Fatal(err)
+	}
+	if err := populateVolume(src, volume); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(volume, "db", "seed")); err != nil || string(data) != "seed" {
+		t.Errorf("The content of the image should be copied, got %q (%v)", data, err)
+	}
+	if stat, err := os.Stat(volume); err != nil || stat.Mode().Perm() != 0711 {
+		t.Errorf("The mode of the directory should be copied: %v (%v)", stat.Mode(), err)
+	}
+
+	// A volume which isn't empty is left untouched
+	if err := ioutil.WriteFile(path.Join(src, "new"), []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := populateVolume(src, volume); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(volume, "new")); !os.IsNotExist(err) {
+		t.Errorf("A volume which isn't empty shouldn't be populated")
+	}
+}
+
+type testVolumeDriver struct {
+	root     string
+	calls    []string
+	onCreate func(name string) // Called by Create, if not nil
+}
+
+func (d *testVolumeDriver) Create(name string) error {
+	d.calls = append(d.calls, "create "+name)
+	if d.onCreate != nil {
+		d.onCreate(name)
+	}
+	return os.MkdirAll(path.Join(d.root, name), 0755)
+}
+
+func (d *testVolumeDriver) Remove(name string) error {
+	d.calls = append(d.calls, "remove "+name)
+	return os.RemoveAll(path.Join(d.root, name))
+}
+
+func (d *testVolumeDriver) Mount(name string) error {
+	d.calls = append(d.calls, "mount "+name)
+	return nil
+}
+
+func (d *testVolumeDriver) Unmount(name string) error {
+	d.calls = append(d.calls, "unmount "+name)
+	return nil
+}
+
+func (d *testVolumeDriver) Path(name string) (string, error) {
+	return path.Join(d.root, name), nil
+}
+
+func TestVolumeDrivers(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-volumes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store, err := NewVolumeStore(path.Join(root, "volumes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver := &testVolumeDriver{root: path.Join(root, "remote")}
+	if err := store.RegisterDriver("test", driver); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RegisterDriver("local", driver); err == nil {
+		t.Errorf("Registering a driver twice should fail")
+	}
+	if _, err := store.Create("data", "nfs"); err == nil {
+		t.Errorf("Creating a volume with an unknown driver should fail")
+	}
+	// The driver is called without holding the lock of the store, and the
+	// name stays reserved meanwhile
+	driver.onCreate = func(name string) {
+		if len(store.List()) != 0 {
+			t.Errorf("The volume %s should be listed once it is created", name)
+		}
+		if _, err := store.Create(name, "local"); err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("Creating a volume being created should fail, got %v", err)
+		}
+	}
+	volume, err := store.Create("data", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.onCreate = nil
+	if volume.Driver != "test" || volume.Path != path.Join(root, "remote", "data") {
+		t.Errorf("Unexpected volume: %v", volume)
+	}
+
+	// The volume is mounted once for all the running containers using it
+	for i := 0; i < 2; i++ {
+		if err := store.Mount(volume); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Remove("data"); err == nil {
+		t.Errorf("Removing a mounted volume should fail")
+	} else if _, ok := err.(ConflictError); !ok {
+		t.Errorf("Expected a ConflictError, got %T", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.Unmount(volume); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Unmount(volume); err == nil {
+		t.Errorf("Unmounting a volume which isn't mounted should fail")
+	}
+	if err := store.Remove("data"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := strings.Join(driver.calls, ", "); calls != "create data, mount data, unmount data, remove data" {
+		t.Errorf("Unexpected driver calls: %s", calls)
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	hostDir, err := ioutil.TempDir("", "docker-bind-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostDir)
+	if err := ioutil.WriteFile(path.Join(hostDir, "conf"), []byte("bound"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	container, err := runtime.Create(&Config{
+		Image:   GetTestImage(runtime).Id,
+		Cmd:     []string{"/bin/sh", "-c", "cat /mnt/conf; if touch /mnt/new; then exit 1; fi; echo $$ >> /data/pids; cat /data/pids | wc -l"},
+		Volumes: map[string]struct{}{"/data": {}},
+		Binds:   []string{hostDir + ":/mnt:ro"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(output), "bound") || container.State.ExitCode != 0 {
+		t.Fatalf("Unexpected output: %q (exit code %d)", output, container.State.ExitCode)
+	}
+	volume := container.Volumes["/data"]
+	if v := runtime.volumes.ByPath(volume); v == nil || !v.Anonymous || !container.VolumesRW["/data"] || container.VolumesRW["/mnt"] || container.Volumes["/mnt"] != hostDir {
+		t.Fatalf("Unexpected volumes: %v %v", container.Volumes, container.VolumesRW)
+	}
+
+	// The volume is kept across restarts
+	output, err = container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(strings.TrimPrefix(string(output), "bound")) != "2" || container.Volumes["/data"] != volume {
+		t.Errorf("Expected the volume to be kept, got %q and %v", output, container.Volumes)
+	}
+
+	if err := runtime.Destroy(container); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(volume); !os.IsNotExist(err) {
+		t.Errorf("The volume should be removed with the container")
+	}
+	if _, err := os.Stat(path.Join(hostDir, "conf")); err != nil {
+		t.Errorf("The bound directory should be left untouched: %s", err)
+	}
+}
+
+func TestNamedVolumes(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+	srv := &Server{runtime: runtime}
+
+	container, err := runtime.Create(&Config{
+		Image: GetTestImage(runtime).Id,
+		Cmd:   []string{"/bin/sh", "-c", "echo hello > /data/hello"},
+		Binds: []string{"shared:/data"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := container.Run(); err != nil {
+		t.Fatal(err)
+	}
+	volume, err := srv.VolumeInspect("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.Anonymous || len(volume.Containers) != 1 || volume.Containers[0] != container.Id {
+		t.Fatalf("Unexpected volume: %v", volume)
+	}
+	if err := srv.VolumeRemove("shared"); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Removing a volume in use should fail, got %v", err)
+	}
+
+	// A named volume outlives its containers
+	if err := runtime.Destroy(container); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path.Join(volume.Path, "hello")); err != nil || string(data) != "hello\n" {
+		t.Errorf("Unexpected content of the volume: %q (%v)", data, err)
+	}
+	if err := srv.VolumeRemove("shared"); err != nil {
+		t.Fatal(err)
+	}
+	if volumes := srv.Volumes(); len(volumes) != 0 {
+		t.Errorf("Expected no volume, got %v", volumes)
+	}
+}
+
+func TestStartFailureUnmountsVolumes(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+
+	container, err := runtime.Create(&Config{
+		Image: GetTestImage(runtime).Id,
+		Cmd:   []string{"true"},
+		Binds: []string{"shared:/data"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runtime.Destroy(container)
+	// The device is gone from the host once the container is created
+	container.Config.Devices = []string{"/dev/docker-test-missing"}
+	if err := container.Start(); err == nil {
+		t.Fatal("Starting a container without its device should fail")
+	}
+	volume, err := runtime.volumes.Get("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runtime.volumes.Unmount(volume); err == nil {
+		t.Errorf("The volumes of a container which failed to start should be unmounted")
+	}
+}
+
+func TestVolumesFrom(t *testing.T) {
+	runtime, err := newTestRuntime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nuke(runtime)
+
+	data, err := runtime.Create(&Config{
+		Image:   GetTestImage(runtime).Id,
+		Cmd:     []string{"/bin/sh", "-c", "echo hello > /data/hello"},
+		Volumes: map[string]struct{}{"/data": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Image:       GetTestImage(runtime).Id,
+		Cmd:         []string{"/bin/sh", "-c", "cat /data/hello; if touch /data/new; then exit 1; fi"},
+		VolumesFrom: []string{data.Id + ":ro"},
+	}
+	if _, err := runtime.Create(config); err == nil {
+		t.Errorf("Mounting the volumes of a container which was never started should fail")
+	}
+	if err := data.Run(); err != nil {
+		t.Fatal(err)
+	}
+	container, err := runtime.Create(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := data.Volumes["/data"]
+	if container.Volumes["/data"] != volume || container.VolumesRW["/data"] {
+		t.Fatalf("Unexpected volumes: %v %v", container.Volumes, container.VolumesRW)
+	}
+
+	// The volume is borrowed, it outlives the data container
+	if err := runtime.Destroy(data); err != nil {
+		t.Fatal(err)
+	}
+	output, err := container.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "hello\n" || container.State.ExitCode != 0 {
+		t.Errorf("Unexpected output: %q (exit code %d)", output, container.State.ExitCode)
+	}
+	if err := runtime.Destroy(container); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(volume); !os.IsNotExist(err) {
+		t.Errorf("The volume should be removed with its last container")
+	}
+}
+
+func TestReadOnlyTmpfs(t *testing.T) {
+	config := &Config{Binds: []string{"/srv/run:/run"}}
+	readOnlyTmpfs(config)
+	if len(config.Tmpfs) != 1 || config.Tmpfs["/tmp"] != "" {
+		t.Errorf("Expected a tmpfs on /tmp only, got %v", config.Tmpfs)
+	}
+	config = &Config{Tmpfs: map[string]string{"/tmp": "size=1m"}}
+	readOnlyTmpfs(config)
+	if len(config.Tmpfs) != 2 || config.Tmpfs["/tmp"] != "size=1m" {
+		t.Errorf("Unexpected tmpfs: %v", config.Tmpfs)
+	}
+}
+
+func TestSetupVolumesInScope(t *testing.T) {
+	root, err := ioutil.TempDir("", "docker-volumes-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store, err := NewVolumeStore(path.Join(root, "volumes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The links of the image lead to the host, outside of the rootfs
+	host := path.Join(root, "host")
+	rootfs := path.Join(root, "container", "rootfs")
+	for _, dir := range []string{host, rootfs} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(host, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"data", "scratch"} {
+		if err := os.Symlink(host, path.Join(rootfs, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	container := &Container{
+		root:    path.Join(root, "container"),
+		Config:  &Config{Volumes: map[string]struct{}{"/data": {}}, Tmpfs: map[string]string{"/scratch/tmp": ""}},
+		runtime: &Runtime{volumes: store},
+	}
+	if err := container.setupVolumes(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(container.Volumes["/data"], "secret")); !os.IsNotExist(err) {
+		t.Errorf("The files of the host shouldn't be copied to the volume")
+	}
+	if _, err := os.Stat(path.Join(host, "tmp")); !os.IsNotExist(err) {
+		t.Errorf("The mount points shouldn't be created on the host")
+	}
+	if _, err := os.Stat(path.Join(rootfs, host, "tmp")); err != nil {
+		t.Errorf("The mount point should be created in the rootfs: %s", err)
+	}
+}
@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// With -webhook, the daemon POSTs the events matching -webhook-filter to
+// each URL, as the JSON objects of /events. With -webhook-secret-file, the
+// body is signed with HMAC-SHA256 and the key in the file, in the header
+// X-Docker-Signature: sha256=HEX.
+// A failed POST is retried with an exponential backoff. Each URL has its
+// own queue, so that a slow or unreachable webhook doesn't delay the
+// others; the events are dropped once the queue is full.
+
+const (
+	webhookRetries    = 3 // Retries of a failed POST
+	webhookRetryDelay = time.Second
+	webhookTimeout    = 10 * time.Second
+	webhookQueueSize  = 100
+)
+
+type webhook struct {
+	url        string
+	secret     []byte // Signs the body, if not nil
+	client     *http.Client
+	queue      chan Event
+	retryDelay time.Duration // Doubled after each attempt
+}
+
+func newWebhook(url string, secret []byte) *webhook {
+	return &webhook{
+		url:        url,
+		secret:     secret,
+		client:     &http.Client{Timeout: webhookTimeout},
+		queue:      make(chan Event, webhookQueueSize),
+		retryDelay: webhookRetryDelay,
+	}
+}
+
+// webhookSignature returns the value of the X-Docker-Signature header of body
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (hook *webhook) post(event Event) error {
+	body, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Docker/"+VERSION)
+	req.Header.Set("X-Docker-Event", event.Status)
+	if hook.secret != nil {
+		req.Header.Set("X-Docker-Signature", webhookSignature(hook.secret, body))
+	}
+	res, err := hook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", hook.url, res.Status)
+	}
+	return nil
+}
+
+// run POSTs the events of the queue, in order
+func (hook *webhook) run() {
+	for event := range hook.queue {
+		delay := hook.retryDelay
+		for attempt := 0; ; attempt++ {
+			err := hook.post(event)
+			if err == nil {
+				break
+			}
+			if attempt == webhookRetries {
+				runtimeLog.Errorf("Dropping the %s event of %s for the webhook %s: %s", event.Status, event.Id, hook.url, err)
+				break
+			}
+			runtimeLog.Warnf("Error sending the %s event of %s to the webhook %s, retrying in %s: %s", event.Status, event.Id, hook.url, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// startWebhooks POSTs the events matching filters to urls, until the daemon
+// exits
+func (srv *Server) startWebhooks(urls []string, filters ListOpts, secretFile string) error {
+	var secret []byte
+	if secretFile != "" {
+		data, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return err
+		}
+		if secret = []byte(strings.TrimSpace(string(data))); len(secret) == 0 {
+			return fmt.Errorf("The webhook secret file %s is empty", secretFile)
+		}
+	}
+	values, err := parseFilterOpts(filters)
+	if err != nil {
+		return err
+	}
+	filter, err := srv.parseEventFilters(values)
+	if err != nil {
+		return err
+	}
+	var hooks []*webhook
+	for _, url := range urls {
+		hooks = append(hooks, newWebhook(url, secret))
+	}
+	srv.dispatchWebhooks(hooks, filter)
+	return nil
+}
+
+// dispatchWebhooks queues the events matching filter for each of hooks
+func (srv *Server) dispatchWebhooks(hooks []*webhook, filter *eventFilter) {
+	for _, hook := range hooks {
+		go hook.run()
+	}
+	_, ch := srv.runtime.events.Subscribe(0)
+	go func() {
+		for event := range ch {
+			if !filter.match(event) {
+				continue
+			}
+			for _, hook := range hooks {
+				select {
+				case hook.queue <- event:
+				default:
+					runtimeLog.Warnf("Dropping the %s event of %s for the slow webhook %s", event.Status, event.Id, hook.url)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		attempts int
+	)
+	received := make(chan Event, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts++
+		failed := attempts == 1
+		lock.Unlock()
+		// The first attempt fails, and is retried
+		if failed {
+			http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signature := r.Header.Get("X-Docker-Signature"); signature != webhookSignature([]byte("secret"), body) {
+			t.Errorf("Unexpected signature: %s", signature)
+		}
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if r.Header.Get("X-Docker-Event") != event.Status {
+			t.Errorf("Unexpected X-Docker-Event: %s", r.Header.Get("X-Docker-Event"))
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	srv := &Server{runtime: &Runtime{events: NewEventBus(EVENTS_HISTORY)}}
+	hook := newWebhook(server.URL, []byte("secret"))
+	hook.retryDelay = time.Millisecond
+	filter, err := parseEventFilters(map[string][]string{"event": {"die", "pull"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.dispatchWebhooks([]*webhook{hook}, filter)
+	srv.runtime.events.Log("start", "c1", "img", nil)
+	srv.runtime.events.Log("die", "c1", "img", map[string]string{"exitCode": "1"})
+	srv.runtime.events.Log("pull", "base", "", nil)
+	for _, expected := range []string{"die", "pull"} {
+		select {
+		case event := <-received:
+			if event.Status != expected || event.Id == "" {
+				t.Fatalf("Expected the %s event, got %#v", expected, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The %s event wasn't POSTed", expected)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if attempts != 3 {
+		t.Errorf("Expected 3 POSTs, got %d", attempts)
+	}
+}